@@ -3,22 +3,36 @@
 // Exposes gosymbol tools as an HTTP endpoint for AI agent frameworks.
 //
 // Usage:
-//   go run cmd/mcp-server/main.go -port 8080
+//
+//	go run cmd/mcp-server/main.go -port 8080 [-record] [-assumptions file.json] [-store dir]
+//
+// With -assumptions, every /tool and /tool/stream call runs through an
+// engine with the assumptions in the file, in the JSON form of gosymbol.Assumptions, e.g.
+// {"symbols": {"n": ["natural"]}, "relations": ["0 <= t <= 1"]}. A call
+// can add its own in an "assumptions" param.
+//
+// The store and recall tools keep expressions in memory for the life of
+// the server, or in dir with -store, so that IDs survive restarts.
 //
 // Tool call endpoint: POST /tool
+// Streaming endpoint: POST /tool/stream (Server-Sent Events)
 // Schema endpoint:    GET  /schema
 // Health endpoint:    GET  /health
+// Provenance log:     GET  /provenance (with -record; see gosymbol.Replay)
+//
+// With -record, streamed calls are recorded with their final response.
 package main
 
 import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"runtime/debug"
 	"time"
-	"io"
 
 	gosymbol "github.com/njchilds90/gosymbol"
 )
@@ -27,9 +41,25 @@ const maxBodyBytes = 1 << 20 // 1 MiB
 
 func main() {
 	port := flag.Int("port", 8080, "Port to listen on")
+	record := flag.Bool("record", false, "Record /tool and /tool/stream calls for GET /provenance")
+	assumptions := flag.String("assumptions", "", "JSON file of assumptions that every call respects")
+	storeDir := flag.String("store", "", "Directory that persists the expressions of the store tool")
 	flag.Parse()
 
 	mux := http.NewServeMux()
+	handle, stream := gosymbol.HandleToolCall, gosymbol.HandleToolCallStream
+	if *assumptions != "" || *storeDir != "" {
+		en, err := loadEngine(*assumptions, *storeDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handle, stream = en.HandleToolCall, en.HandleToolCallStream
+	}
+	var rec *gosymbol.Recorder
+	if *record {
+		rec = gosymbol.NewStreamRecorder(stream)
+		handle, stream = rec.HandleToolCall, rec.HandleToolCallStream
+	}
 
 	// POST /tool — handle a tool call
 	mux.HandleFunc("/tool", func(w http.ResponseWriter, r *http.Request) {
@@ -45,37 +75,48 @@ func main() {
 			return
 		}
 
-		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
-		defer r.Body.Close()
+		req, ok := decodeToolRequest(w, r)
+		if !ok {
+			return
+		}
+		resp := handle(req)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
 
-		dec := json.NewDecoder(r.Body)
-		dec.DisallowUnknownFields()
+	// POST /tool/stream — handle a tool call as Server-Sent Events: one
+	// "partial" event per term, iteration or step, then a "result" event.
+	// Closing the connection stops the computation.
+	mux.HandleFunc("/tool/stream", func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("panic in /tool/stream: %v\n%s", rec, string(debug.Stack()))
+			}
+		}()
 
-		var req gosymbol.ToolRequest
-		if err := dec.Decode(&req); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		// Ensure there's no trailing junk by attempting to decode one more value.
-		var extra interface{}
-		if err := dec.Decode(&extra); err == nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON: trailing data"})
-			return
-		} else if err != io.EOF {
-			// If there was a non-EOF error, report it.
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+
+		req, ok := decodeToolRequest(w, r)
+		if !ok {
 			return
 		}
-
-		resp := gosymbol.HandleToolCall(req)
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(resp)
+		rc := http.NewResponseController(w)
+		// Streams may outlive the server-wide write timeout.
+		_ = rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		ctx := r.Context()
+		emit := func(resp gosymbol.ToolResponse) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			return writeEvent(w, rc, "partial", resp) == nil
+		}
+		resp := stream(req, emit)
+		_ = writeEvent(w, rc, "result", resp)
 	})
 
 	// GET /schema — return tool schema for agent registration
@@ -84,6 +125,22 @@ func main() {
 		fmt.Fprint(w, gosymbol.MCPToolSpec())
 	})
 
+	// GET /provenance — the recorded /tool calls, replayable with
+	// gosymbol.Replay
+	mux.HandleFunc("/provenance", func(w http.ResponseWriter, r *http.Request) {
+		if rec == nil {
+			http.Error(w, "recording is off; start the server with -record", http.StatusNotFound)
+			return
+		}
+		data, err := rec.Export()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	})
+
 	// GET /health — liveness check
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -96,8 +153,12 @@ func main() {
 	addr := fmt.Sprintf(":%d", *port)
 	log.Printf("gosymbol MCP server listening on %s", addr)
 	log.Printf("  POST /tool   — execute a tool call")
+	log.Printf("  POST /tool/stream — execute a tool call, streaming partial results")
 	log.Printf("  GET  /schema — tool schema for agent registration")
 	log.Printf("  GET  /health — health check")
+	if rec != nil {
+		log.Printf("  GET  /provenance — recorded tool calls")
+	}
 
 	srv := &http.Server{
 		Addr:              addr,
@@ -111,4 +172,75 @@ func main() {
 	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
-}
\ No newline at end of file
+}
+
+// loadEngine returns an engine with the assumptions in the JSON file path
+// and an expression store persisted in dir; either may be empty.
+func loadEngine(path, dir string) (*gosymbol.Engine, error) {
+	var cfg gosymbol.EngineConfig
+	if dir != "" {
+		s, err := gosymbol.OpenExprStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Store = s
+	}
+	en, err := gosymbol.NewEngine(cfg)
+	if err != nil || path == "" {
+		return en, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var a gosymbol.Assumptions
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return en.WithAssumptions(a)
+}
+
+// decodeToolRequest reads a single ToolRequest from the body, replying with
+// 400 and reporting false when it is malformed.
+func decodeToolRequest(w http.ResponseWriter, r *http.Request) (gosymbol.ToolRequest, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	defer r.Body.Close()
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	var req gosymbol.ToolRequest
+	if err := dec.Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return req, false
+	}
+	// Ensure there's no trailing junk by attempting to decode one more value.
+	var extra interface{}
+	if err := dec.Decode(&extra); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON: trailing data"})
+		return req, false
+	} else if err != io.EOF {
+		// If there was a non-EOF error, report it.
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return req, false
+	}
+	return req, true
+}
+
+// writeEvent sends one Server-Sent Event whose data is resp as JSON.
+func writeEvent(w http.ResponseWriter, rc *http.ResponseController, event string, resp gosymbol.ToolResponse) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
@@ -0,0 +1,48 @@
+// examples/main.go — a short tour of the gosymbol API.
+//
+// Usage:
+//
+//	go run ./examples
+package main
+
+import (
+	"fmt"
+
+	gosymbol "github.com/njchilds90/gosymbol"
+)
+
+func main() {
+	x := gosymbol.S("x")
+
+	// Build 3*x^2 + 2*x + 1 programmatically...
+	expr := gosymbol.AddOf(
+		gosymbol.MulOf(gosymbol.N(3), gosymbol.PowOf(x, gosymbol.N(2))),
+		gosymbol.MulOf(gosymbol.N(2), x),
+		gosymbol.N(1),
+	).Simplify()
+	fmt.Println("expr:      ", expr)
+	fmt.Println("latex:     ", gosymbol.LaTeX(expr))
+
+	// ...or parse it from a string.
+	parsed, err := gosymbol.Parse("3*x^2 + 2*x + 1")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("parsed:    ", parsed.Simplify())
+
+	fmt.Println("d/dx:      ", gosymbol.Diff(expr, "x"))
+	if integral, ok := gosymbol.Integrate(expr, "x"); ok {
+		fmt.Println("∫ dx:      ", integral)
+	}
+	fmt.Println("at x=2:    ", gosymbol.Sub(expr, "x", gosymbol.N(2)))
+
+	product := gosymbol.MulOf(gosymbol.AddOf(x, gosymbol.N(1)), gosymbol.AddOf(x, gosymbol.N(2)))
+	fmt.Println("expand:    ", gosymbol.Expand(product))
+
+	fmt.Println("taylor:    ", gosymbol.TaylorSeries(gosymbol.SinOf(x), "x", gosymbol.N(0), 5))
+
+	res := gosymbol.SolveQuadratic(gosymbol.N(1), gosymbol.N(-3), gosymbol.N(2))
+	fmt.Println("roots:     ", res.Solutions)
+
+	fmt.Printf("∫₀¹ x² dx ≈ %.6f\n", gosymbol.DefiniteIntegrate(gosymbol.PowOf(x, gosymbol.N(2)), "x", 0, 1))
+}
@@ -0,0 +1,489 @@
+// Package geometry provides 2D plane geometry over symbolic coordinates.
+//
+// Points, lines, segments, circles and ellipses hold gosymbol.Expr values,
+// so distances, intersections, tangents and areas come out as exact
+// expressions that may contain free symbols. Results are simplified; tests
+// such as Contains or IsTangent expand and simplify a residual and report
+// true only when it reduces to zero.
+package geometry
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/njchilds90/gosymbol"
+)
+
+// ============================================================
+// Helpers
+// ============================================================
+
+func add(a ...gosymbol.Expr) gosymbol.Expr { return gosymbol.AddOf(a...) }
+func mul(a ...gosymbol.Expr) gosymbol.Expr { return gosymbol.MulOf(a...) }
+func neg(a gosymbol.Expr) gosymbol.Expr    { return gosymbol.Neg(a) }
+func sub(a, b gosymbol.Expr) gosymbol.Expr { return add(a, neg(b)) }
+func sq(a gosymbol.Expr) gosymbol.Expr     { return gosymbol.PowOf(a, gosymbol.N(2)) }
+func div(a, b gosymbol.Expr) gosymbol.Expr {
+	return mul(a, gosymbol.PowOf(b, gosymbol.N(-1)))
+}
+
+func simp(e gosymbol.Expr) gosymbol.Expr { return gosymbol.Expand(e) }
+
+// isZero reports whether e expands and simplifies to 0.
+func isZero(e gosymbol.Expr) bool {
+	n, ok := gosymbol.Expand(e).(*gosymbol.Num)
+	return ok && n.IsZero()
+}
+
+// ============================================================
+// Point
+// ============================================================
+
+// Point is a point in the plane.
+type Point struct {
+	X, Y gosymbol.Expr
+}
+
+// Pt returns the point (x, y).
+func Pt(x, y gosymbol.Expr) Point { return Point{X: x, Y: y} }
+
+// String renders the point as "(x, y)".
+func (p Point) String() string { return fmt.Sprintf("(%s, %s)", p.X, p.Y) }
+
+// Equal reports whether p and q coincide.
+func (p Point) Equal(q Point) bool { return isZero(sub(p.X, q.X)) && isZero(sub(p.Y, q.Y)) }
+
+// Distance returns the Euclidean distance from p to q.
+func (p Point) Distance(q Point) gosymbol.Expr {
+	return gosymbol.SqrtOf(simp(add(sq(sub(q.X, p.X)), sq(sub(q.Y, p.Y))))).Simplify()
+}
+
+// Midpoint returns the point halfway between p and q.
+func (p Point) Midpoint(q Point) Point {
+	half := gosymbol.F(1, 2)
+	return Pt(simp(mul(half, add(p.X, q.X))), simp(mul(half, add(p.Y, q.Y))))
+}
+
+// ============================================================
+// Line
+// ============================================================
+
+// Line is the line A*x + B*y + C = 0. A and B must not both be zero.
+type Line struct {
+	A, B, C gosymbol.Expr
+}
+
+// LineThrough returns the line through p and q.
+func LineThrough(p, q Point) Line {
+	return Line{
+		A: simp(sub(q.Y, p.Y)),
+		B: simp(sub(p.X, q.X)),
+		C: simp(sub(mul(q.X, p.Y), mul(p.X, q.Y))),
+	}
+}
+
+// Equation returns A*x + B*y + C = 0 in the symbols x and y.
+func (l Line) Equation() *gosymbol.Equation {
+	return gosymbol.Eq(l.at(Pt(gosymbol.S("x"), gosymbol.S("y"))), gosymbol.N(0))
+}
+
+// String renders the line as its equation.
+func (l Line) String() string { return l.Equation().String() }
+
+// at returns A*px + B*py + C.
+func (l Line) at(p Point) gosymbol.Expr { return simp(add(mul(l.A, p.X), mul(l.B, p.Y), l.C)) }
+
+// Slope returns -A/B. It reports false for vertical lines.
+func (l Line) Slope() (gosymbol.Expr, bool) {
+	if isZero(l.B) {
+		return nil, false
+	}
+	return div(neg(l.A), l.B).Simplify(), true
+}
+
+// Contains reports whether p lies on l.
+func (l Line) Contains(p Point) bool { return isZero(l.at(p)) }
+
+// Distance returns the perpendicular distance from p to l.
+func (l Line) Distance(p Point) gosymbol.Expr {
+	return div(gosymbol.AbsOf(l.at(p)), gosymbol.SqrtOf(simp(add(sq(l.A), sq(l.B))))).Simplify()
+}
+
+// IsParallel reports whether l and m are parallel (or coincide).
+func (l Line) IsParallel(m Line) bool { return isZero(sub(mul(l.A, m.B), mul(m.A, l.B))) }
+
+// IsPerpendicular reports whether l and m meet at a right angle.
+func (l Line) IsPerpendicular(m Line) bool { return isZero(add(mul(l.A, m.A), mul(l.B, m.B))) }
+
+// Intersect returns the intersection of l and m: one point, or none if the
+// lines are parallel. Coincident lines are an error.
+func (l Line) Intersect(m Line) ([]Point, error) {
+	x, y, err := gosymbol.SolveLinearSystem2x2(l.A, l.B, neg(l.C), m.A, m.B, neg(m.C))
+	if err != nil {
+		if isZero(sub(mul(l.A, m.C), mul(m.A, l.C))) && isZero(sub(mul(l.B, m.C), mul(m.B, l.C))) {
+			return nil, fmt.Errorf("geometry: lines coincide")
+		}
+		return nil, nil
+	}
+	return []Point{Pt(x, y)}, nil
+}
+
+// base returns a point on l and a direction vector along it.
+func (l Line) base() (Point, Point) {
+	n2 := add(sq(l.A), sq(l.B))
+	p := Pt(simp(div(mul(neg(l.A), l.C), n2)), simp(div(mul(neg(l.B), l.C), n2)))
+	return p, Pt(l.B, neg(l.A))
+}
+
+// ============================================================
+// Segment
+// ============================================================
+
+// Segment is the closed segment from P to Q.
+type Segment struct {
+	P, Q Point
+}
+
+// Length returns the length of s.
+func (s Segment) Length() gosymbol.Expr { return s.P.Distance(s.Q) }
+
+// Midpoint returns the midpoint of s.
+func (s Segment) Midpoint() Point { return s.P.Midpoint(s.Q) }
+
+// Line returns the line through s.
+func (s Segment) Line() Line { return LineThrough(s.P, s.Q) }
+
+// ============================================================
+// Circle and Ellipse
+// ============================================================
+
+// Circle is the circle with the given center and radius.
+type Circle struct {
+	Center Point
+	Radius gosymbol.Expr
+}
+
+// Area returns π·r².
+func (c Circle) Area() gosymbol.Expr { return mul(gosymbol.Pi, sq(c.Radius)).Simplify() }
+
+// Circumference returns 2·π·r.
+func (c Circle) Circumference() gosymbol.Expr {
+	return mul(gosymbol.N(2), gosymbol.Pi, c.Radius).Simplify()
+}
+
+// Equation returns (x - h)^2 + (y - k)^2 = r^2.
+func (c Circle) Equation() *gosymbol.Equation {
+	x, y := gosymbol.S("x"), gosymbol.S("y")
+	lhs := add(sq(sub(x, c.Center.X)), sq(sub(y, c.Center.Y)))
+	return gosymbol.Eq(lhs.Simplify(), sq(c.Radius).Simplify())
+}
+
+// Contains reports whether p lies on the circle.
+func (c Circle) Contains(p Point) bool { return c.ellipse().Contains(p) }
+
+// TangentAt returns the tangent line at p, which should lie on c.
+func (c Circle) TangentAt(p Point) Line {
+	a, b := simp(sub(p.X, c.Center.X)), simp(sub(p.Y, c.Center.Y))
+	return Line{A: a, B: b, C: simp(neg(add(mul(a, p.X), mul(b, p.Y))))}
+}
+
+// IsTangent reports whether l touches c at exactly one point.
+func (c Circle) IsTangent(l Line) bool {
+	return isZero(sub(sq(l.at(c.Center)), mul(sq(c.Radius), add(sq(l.A), sq(l.B)))))
+}
+
+// IntersectLine returns the points where l meets c.
+func (c Circle) IntersectLine(l Line) ([]Point, error) { return c.ellipse().IntersectLine(l) }
+
+// IntersectCircle returns the points where c and d meet. Concentric
+// circles are an error.
+func (c Circle) IntersectCircle(d Circle) ([]Point, error) {
+	if c.Center.Equal(d.Center) {
+		return nil, fmt.Errorf("geometry: circles are concentric")
+	}
+	// Subtracting the two equations leaves the radical line.
+	pow := func(k Circle) gosymbol.Expr {
+		return add(sq(k.Center.X), sq(k.Center.Y), neg(sq(k.Radius)))
+	}
+	radical := Line{
+		A: simp(mul(gosymbol.N(2), sub(d.Center.X, c.Center.X))),
+		B: simp(mul(gosymbol.N(2), sub(d.Center.Y, c.Center.Y))),
+		C: simp(sub(pow(c), pow(d))),
+	}
+	return c.IntersectLine(radical)
+}
+
+func (c Circle) ellipse() Ellipse { return Ellipse{Center: c.Center, A: c.Radius, B: c.Radius} }
+
+// Ellipse is the axis-aligned ellipse ((x-h)/A)^2 + ((y-k)/B)^2 = 1.
+type Ellipse struct {
+	Center Point
+	A, B   gosymbol.Expr
+}
+
+// Area returns π·A·B.
+func (e Ellipse) Area() gosymbol.Expr { return mul(gosymbol.Pi, e.A, e.B).Simplify() }
+
+// Equation returns B^2*(x - h)^2 + A^2*(y - k)^2 = A^2*B^2.
+func (e Ellipse) Equation() *gosymbol.Equation {
+	x, y := gosymbol.S("x"), gosymbol.S("y")
+	lhs := add(mul(sq(e.B), sq(sub(x, e.Center.X))), mul(sq(e.A), sq(sub(y, e.Center.Y))))
+	return gosymbol.Eq(lhs.Simplify(), mul(sq(e.A), sq(e.B)).Simplify())
+}
+
+// Contains reports whether p lies on the ellipse.
+func (e Ellipse) Contains(p Point) bool {
+	eq := e.Equation()
+	r := eq.Residual().Sub("x", p.X).Sub("y", p.Y)
+	return isZero(r)
+}
+
+// TangentAt returns the tangent line at p, which should lie on e.
+func (e Ellipse) TangentAt(p Point) Line {
+	dx, dy := sub(p.X, e.Center.X), sub(p.Y, e.Center.Y)
+	a, b := simp(mul(dx, sq(e.B))), simp(mul(dy, sq(e.A)))
+	return Line{A: a, B: b, C: simp(neg(add(mul(a, p.X), mul(b, p.Y))))}
+}
+
+// IntersectLine returns the points where l meets e: none, one (tangent) or
+// two. With symbolic coefficients two points are returned whenever the
+// discriminant is not a negative number.
+func (e Ellipse) IntersectLine(l Line) ([]Point, error) {
+	p, d := l.base()
+	// Substitute p + t·d into B²(x-h)² + A²(y-k)² - A²B² and solve for t.
+	ox, oy := sub(p.X, e.Center.X), sub(p.Y, e.Center.Y)
+	a2, b2 := sq(e.A), sq(e.B)
+	qa := simp(add(mul(b2, sq(d.X)), mul(a2, sq(d.Y))))
+	qb := simp(mul(gosymbol.N(2), add(mul(b2, d.X, ox), mul(a2, d.Y, oy))))
+	qc := simp(sub(add(mul(b2, sq(ox)), mul(a2, sq(oy))), mul(a2, b2)))
+	if isZero(qa) {
+		return nil, fmt.Errorf("geometry: degenerate line or ellipse")
+	}
+	res := gosymbol.SolveQuadratic(qa, qb, qc)
+	if res.Error != "" {
+		return nil, nil
+	}
+	pts := make([]Point, len(res.Solutions))
+	for i, t := range res.Solutions {
+		pts[i] = Pt(simp(add(p.X, mul(t, d.X))), simp(add(p.Y, mul(t, d.Y))))
+	}
+	return pts, nil
+}
+
+// ============================================================
+// Polygon
+// ============================================================
+
+// Polygon is a simple polygon given by its vertices in order. The last
+// vertex joins back to the first.
+type Polygon struct {
+	Vertices []Point
+}
+
+// Poly returns the polygon with the given vertices.
+func Poly(vertices ...Point) Polygon { return Polygon{Vertices: vertices} }
+
+// edges calls f for each edge (p, q) including the closing one.
+func (g Polygon) edges(f func(p, q Point)) {
+	for i, p := range g.Vertices {
+		f(p, g.Vertices[(i+1)%len(g.Vertices)])
+	}
+}
+
+// SignedArea returns the shoelace area: positive when the vertices run
+// counterclockwise, negative when clockwise.
+func (g Polygon) SignedArea() gosymbol.Expr {
+	var terms []gosymbol.Expr
+	g.edges(func(p, q Point) { terms = append(terms, cross(p, q)) })
+	return simp(mul(gosymbol.F(1, 2), add(terms...)))
+}
+
+// Area returns |SignedArea|.
+func (g Polygon) Area() gosymbol.Expr { return gosymbol.AbsOf(g.SignedArea()).Simplify() }
+
+// Perimeter returns the total edge length.
+func (g Polygon) Perimeter() gosymbol.Expr {
+	var terms []gosymbol.Expr
+	g.edges(func(p, q Point) { terms = append(terms, p.Distance(q)) })
+	return add(terms...).Simplify()
+}
+
+// Centroid returns the centroid of the polygon's area. It is an error for
+// the signed area to simplify to 0, as for collinear vertices, since the
+// area then has no centroid.
+func (g Polygon) Centroid() (Point, error) {
+	area := g.SignedArea()
+	if isZero(area) {
+		return Point{}, fmt.Errorf("geometry: centroid of a polygon with zero area")
+	}
+	var xs, ys []gosymbol.Expr
+	g.edges(func(p, q Point) {
+		c := cross(p, q)
+		xs = append(xs, mul(add(p.X, q.X), c))
+		ys = append(ys, mul(add(p.Y, q.Y), c))
+	})
+	k := div(gosymbol.N(1), mul(gosymbol.N(6), area))
+	return Pt(simp(mul(k, add(xs...))), simp(mul(k, add(ys...)))), nil
+}
+
+// cross returns px*qy - qx*py.
+func cross(p, q Point) gosymbol.Expr { return sub(mul(p.X, q.Y), mul(q.X, p.Y)) }
+
+// Contains reports whether p lies inside g or on its boundary. All
+// coordinates must evaluate to numbers; the test is exact on their
+// rational values.
+func (g Polygon) Contains(p Point) (bool, error) {
+	if len(g.Vertices) < 3 {
+		return false, fmt.Errorf("geometry: polygon needs at least 3 vertices")
+	}
+	px, py, err := ratPoint(p)
+	if err != nil {
+		return false, err
+	}
+	inside := false
+	for i := range g.Vertices {
+		ax, ay, err := ratPoint(g.Vertices[i])
+		if err != nil {
+			return false, err
+		}
+		bx, by, err := ratPoint(g.Vertices[(i+1)%len(g.Vertices)])
+		if err != nil {
+			return false, err
+		}
+		// (b - a) × (p - a) = 0 with p inside the bounding box: on the edge.
+		c := new(big.Rat).Sub(
+			new(big.Rat).Mul(new(big.Rat).Sub(bx, ax), new(big.Rat).Sub(py, ay)),
+			new(big.Rat).Mul(new(big.Rat).Sub(by, ay), new(big.Rat).Sub(px, ax)))
+		if c.Sign() == 0 && between(px, ax, bx) && between(py, ay, by) {
+			return true, nil
+		}
+		// Ray casting towards +x.
+		if (ay.Cmp(py) > 0) != (by.Cmp(py) > 0) {
+			// x where the edge crosses y = py.
+			t := new(big.Rat).Quo(new(big.Rat).Sub(py, ay), new(big.Rat).Sub(by, ay))
+			ix := new(big.Rat).Add(ax, t.Mul(t, new(big.Rat).Sub(bx, ax)))
+			if px.Cmp(ix) < 0 {
+				inside = !inside
+			}
+		}
+	}
+	return inside, nil
+}
+
+func between(v, a, b *big.Rat) bool {
+	if a.Cmp(b) > 0 {
+		a, b = b, a
+	}
+	return v.Cmp(a) >= 0 && v.Cmp(b) <= 0
+}
+
+func ratPoint(p Point) (*big.Rat, *big.Rat, error) {
+	x, okx := p.X.Eval()
+	y, oky := p.Y.Eval()
+	if !okx || !oky {
+		return nil, nil, fmt.Errorf("geometry: point %s is not numeric", p)
+	}
+	return x.Rat(), y.Rat(), nil
+}
+
+// Integrate returns the integral of f(x, y) over the polygon's area. By
+// Green's theorem it equals the boundary integral of F dy where F is an
+// x-antiderivative of f; each edge is parametrized linearly and integrated
+// symbolically, so f must be a form Integrate handles, such as a
+// polynomial. Vertices are assumed counterclockwise unless the signed area
+// is a negative number.
+func (g Polygon) Integrate(f gosymbol.Expr) (gosymbol.Expr, error) {
+	F, ok := gosymbol.Integrate(f, "x")
+	if !ok {
+		return nil, fmt.Errorf("geometry: cannot integrate %s in x", f)
+	}
+	t := gosymbol.S("$t")
+	var terms []gosymbol.Expr
+	var fail error
+	g.edges(func(p, q Point) {
+		if fail != nil {
+			return
+		}
+		dy := sub(q.Y, p.Y)
+		if isZero(dy) {
+			return
+		}
+		e := F.Sub("x", add(p.X, mul(t, sub(q.X, p.X)))).Sub("y", add(p.Y, mul(t, dy)))
+		a, ok := gosymbol.Integrate(simp(mul(e, dy)), "$t")
+		if !ok {
+			fail = fmt.Errorf("geometry: cannot integrate along edge %s-%s", p, q)
+			return
+		}
+		terms = append(terms, sub(a.Sub("$t", gosymbol.N(1)), a.Sub("$t", gosymbol.N(0))))
+	})
+	if fail != nil {
+		return nil, fail
+	}
+	r := simp(add(terms...))
+	if s, ok := g.SignedArea().(*gosymbol.Num); ok && s.Sign() < 0 {
+		r = simp(neg(r))
+	}
+	return r, nil
+}
+
+// ============================================================
+// Parametric curves
+// ============================================================
+
+// Curve is the parametric curve (X(t), Y(t)) in the parameter named T.
+type Curve struct {
+	X, Y gosymbol.Expr
+	T    string
+}
+
+// At returns the point at parameter t0.
+func (c Curve) At(t0 gosymbol.Expr) Point {
+	return Pt(gosymbol.Sub(c.X, c.T, t0), gosymbol.Sub(c.Y, c.T, t0))
+}
+
+// Tangent returns the velocity vector (X'(t), Y'(t)).
+func (c Curve) Tangent() Point { return Pt(gosymbol.Diff(c.X, c.T), gosymbol.Diff(c.Y, c.T)) }
+
+// Normal returns the tangent rotated a quarter turn counterclockwise,
+// (-Y'(t), X'(t)).
+func (c Curve) Normal() Point {
+	v := c.Tangent()
+	return Pt(neg(v.Y).Simplify(), v.X)
+}
+
+// Speed returns |(X'(t), Y'(t))|.
+func (c Curve) Speed() gosymbol.Expr {
+	v := c.Tangent()
+	return gosymbol.SqrtOf(simp(add(sq(v.X), sq(v.Y)))).Simplify()
+}
+
+// Curvature returns the signed curvature (x'y" - y'x") / (x'^2 + y'^2)^(3/2),
+// positive where the curve turns counterclockwise.
+func (c Curve) Curvature() gosymbol.Expr {
+	v := c.Tangent()
+	ax, ay := gosymbol.Diff(v.X, c.T), gosymbol.Diff(v.Y, c.T)
+	num := simp(sub(mul(v.X, ay), mul(v.Y, ax)))
+	den := gosymbol.PowOf(simp(add(sq(v.X), sq(v.Y))), gosymbol.F(3, 2))
+	return div(num, den).Simplify()
+}
+
+// TangentLine returns the tangent line at parameter t0.
+func (c Curve) TangentLine(t0 gosymbol.Expr) Line {
+	p := c.At(t0)
+	v := c.Tangent()
+	a := gosymbol.Sub(v.Y, c.T, t0)
+	b := gosymbol.Sub(neg(v.X), c.T, t0)
+	return Line{A: a, B: b, C: simp(neg(add(mul(a, p.X), mul(b, p.Y))))}
+}
+
+// ArcLength returns the length of the curve for t from a to b. It
+// integrates Speed symbolically when Integrate can, and otherwise returns
+// the unevaluated integral of Speed, which Eval evaluates by quadrature
+// when the bounds are numeric.
+func (c Curve) ArcLength(a, b gosymbol.Expr) (gosymbol.Expr, error) {
+	s := c.Speed()
+	if F, ok := gosymbol.Integrate(s, c.T); ok {
+		return simp(sub(F.Sub(c.T, b), F.Sub(c.T, a))), nil
+	}
+	return gosymbol.IntegralOf(s, c.T, a, b), nil
+}
@@ -0,0 +1,189 @@
+package geometry_test
+
+import (
+	"testing"
+
+	"github.com/njchilds90/gosymbol"
+	"github.com/njchilds90/gosymbol/geometry"
+)
+
+var (
+	n = gosymbol.N
+	r = gosymbol.S("r")
+)
+
+func pt(x, y int64) geometry.Point { return geometry.Pt(n(x), n(y)) }
+
+func assertStr(t *testing.T, got interface{ String() string }, want string) {
+	t.Helper()
+	if got.String() != want {
+		t.Errorf("got %q, want %q", got.String(), want)
+	}
+}
+
+func TestPointsAndLines(t *testing.T) {
+	o, p := pt(0, 0), pt(3, 4)
+	assertStr(t, o.Distance(p), "5")
+	assertStr(t, o.Midpoint(p), "(3/2, 2)")
+
+	l := geometry.LineThrough(o, p)
+	assertStr(t, l, "4*x - 3*y = 0")
+	assertStr(t, l.Distance(pt(5, 0)), "4")
+	if !l.Contains(pt(6, 8)) || l.Contains(pt(1, 1)) {
+		t.Error("Contains")
+	}
+	if s, ok := l.Slope(); !ok || s.String() != "4/3" {
+		t.Errorf("slope = %v, %v", s, ok)
+	}
+
+	m := geometry.LineThrough(pt(0, 4), pt(4, 0))
+	pts, err := l.Intersect(m)
+	if err != nil || len(pts) != 1 {
+		t.Fatalf("Intersect = %v, %v", pts, err)
+	}
+	assertStr(t, pts[0], "(12/7, 16/7)")
+	if pts, err := m.Intersect(geometry.LineThrough(pt(0, 5), pt(5, 0))); err != nil || len(pts) != 0 {
+		t.Errorf("parallel lines: %v, %v", pts, err)
+	}
+	if _, err := l.Intersect(l); err == nil {
+		t.Error("coincident lines should fail")
+	}
+	if !l.IsPerpendicular(geometry.LineThrough(o, pt(-4, 3))) || !m.IsParallel(geometry.LineThrough(pt(1, 0), pt(0, 1))) {
+		t.Error("IsPerpendicular / IsParallel")
+	}
+	assertStr(t, geometry.Segment{P: o, Q: p}.Length(), "5")
+}
+
+func TestCircles(t *testing.T) {
+	c := geometry.Circle{Center: pt(0, 0), Radius: n(5)}
+	assertStr(t, c.Area(), "25*pi")
+	assertStr(t, geometry.Circle{Center: pt(1, -2), Radius: r}.Equation(), "(x - 1)^2 + (y + 2)^2 = r^2")
+	assertStr(t, geometry.Circle{Center: pt(0, 0), Radius: r}.Circumference(), "2*r*pi")
+
+	pts, err := c.IntersectLine(geometry.LineThrough(pt(0, 0), pt(3, 4)))
+	if err != nil || len(pts) != 2 {
+		t.Fatalf("IntersectLine = %v, %v", pts, err)
+	}
+	assertStr(t, pts[0], "(3, 4)")
+	assertStr(t, pts[1], "(-3, -4)")
+
+	pts, err = c.IntersectCircle(geometry.Circle{Center: pt(6, 0), Radius: n(5)})
+	if err != nil || len(pts) != 2 || !c.Contains(pts[0]) {
+		t.Fatalf("IntersectCircle = %v, %v", pts, err)
+	}
+	assertStr(t, pts[0], "(3, 4)")
+	if pts, _ := c.IntersectLine(geometry.Line{A: n(0), B: n(1), C: n(-6)}); len(pts) != 0 {
+		t.Errorf("missed line: %v", pts)
+	}
+
+	tan := c.TangentAt(pt(3, 4))
+	assertStr(t, tan, "3*x + 4*y - 25 = 0")
+	if !c.IsTangent(tan) || c.IsTangent(geometry.LineThrough(pt(0, 0), pt(1, 1))) {
+		t.Error("IsTangent")
+	}
+	// y = r touches the circle of radius r for every r.
+	if !(geometry.Circle{Center: pt(0, 0), Radius: r}).IsTangent(geometry.Line{A: n(0), B: n(1), C: gosymbol.Neg(r)}) {
+		t.Error("symbolic tangency")
+	}
+}
+
+func TestEllipse(t *testing.T) {
+	e := geometry.Ellipse{Center: pt(0, 0), A: n(2), B: n(1)}
+	assertStr(t, e.Equation(), "x^2 + 4*y^2 = 4")
+	assertStr(t, e.Area(), "2*pi")
+	if !e.Contains(pt(0, 1)) || e.Contains(pt(1, 1)) {
+		t.Error("Contains")
+	}
+	assertStr(t, e.TangentAt(pt(2, 0)), "2*x - 4 = 0")
+	pts, err := e.IntersectLine(geometry.LineThrough(pt(0, 0), pt(1, 0)))
+	if err != nil || len(pts) != 2 {
+		t.Fatalf("IntersectLine = %v, %v", pts, err)
+	}
+	assertStr(t, pts[0], "(2, 0)")
+}
+
+func TestPolygon(t *testing.T) {
+	tri := geometry.Poly(pt(0, 0), pt(0, 3), pt(4, 0)) // clockwise
+	assertStr(t, tri.SignedArea(), "-6")
+	assertStr(t, tri.Area(), "6")
+	assertStr(t, tri.Perimeter(), "12")
+	c, err := tri.Centroid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, c, "(4/3, 1)")
+	for _, g := range []geometry.Polygon{geometry.Poly(pt(0, 0), pt(1, 1), pt(2, 2)), geometry.Poly(pt(1, 2)), geometry.Poly()} {
+		if _, err := g.Centroid(); err == nil {
+			t.Errorf("Centroid of %v should fail", g.Vertices)
+		}
+	}
+
+	sq := geometry.Poly(pt(0, 0), pt(2, 0), pt(2, 2), pt(0, 2))
+	for _, c := range []struct {
+		p    geometry.Point
+		want bool
+	}{{pt(1, 1), true}, {pt(2, 1), true}, {pt(0, 0), true}, {pt(3, 1), false}, {pt(1, 3), false}} {
+		if got, err := sq.Contains(c.p); err != nil || got != c.want {
+			t.Errorf("Contains(%s) = %v, %v", c.p, got, err)
+		}
+	}
+	if _, err := sq.Contains(geometry.Pt(r, n(0))); err == nil {
+		t.Error("symbolic point should fail Contains")
+	}
+
+	x, y := gosymbol.S("x"), gosymbol.S("y")
+	got, err := sq.Integrate(gosymbol.AddOf(gosymbol.MulOf(x, y), n(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, got, "8")
+	got, _ = tri.Integrate(x)
+	assertStr(t, got, "8")
+
+	rsq := geometry.Poly(pt(0, 0), geometry.Pt(r, n(0)), geometry.Pt(r, r), geometry.Pt(n(0), r))
+	assertStr(t, rsq.SignedArea(), "r^2")
+	c, _ = rsq.Centroid()
+	assertStr(t, c, "(1/2*r, 1/2*r)")
+	got, _ = rsq.Integrate(gosymbol.PowOf(x, n(2)))
+	assertStr(t, got, "1/3*r^4")
+}
+
+func TestCurve(t *testing.T) {
+	parse := func(s string) gosymbol.Expr {
+		e, err := gosymbol.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	circle := geometry.Curve{X: parse("3*cos(t)"), Y: parse("3*sin(t)"), T: "t"}
+	assertStr(t, circle.Tangent(), "(-3*sin(t), 3*cos(t))")
+	assertStr(t, circle.Normal(), "(-3*cos(t), -3*sin(t))")
+	assertStr(t, circle.Speed(), "3")
+	assertStr(t, circle.Curvature(), "1/3")
+	assertStr(t, circle.TangentLine(n(0)), "3*x - 9 = 0")
+	l, err := circle.ArcLength(n(0), gosymbol.Pi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, l, "3*pi")
+
+	cusp := geometry.Curve{X: parse("t"), Y: parse("2/3*t^(3/2)"), T: "t"}
+	l, _ = cusp.ArcLength(n(0), n(3))
+	assertStr(t, l, "14/3")
+
+	// sqrt(4*t^2 + 1) has no rule-based antiderivative: the integral stays
+	// unevaluated and Eval uses quadrature.
+	parabola := geometry.Curve{X: parse("t"), Y: parse("t^2"), T: "t"}
+	assertStr(t, parabola.Curvature(), "2*(4*t^2 + 1)^(-3/2)")
+	l, err = parabola.ArcLength(n(0), n(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, l, "integrate((4*t^2 + 1)^(1/2), t, 0, 1)")
+	if v, ok := l.Eval(); !ok || v.Float64() < 1.4789 || v.Float64() > 1.4790 {
+		t.Errorf("parabola arc length = %v, %v", v, ok)
+	}
+	l, _ = parabola.ArcLength(n(0), r)
+	assertStr(t, l, "integrate((4*t^2 + 1)^(1/2), t, 0, r)")
+}
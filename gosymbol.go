@@ -1 +1,20614 @@
-<no-file-changes>
\ No newline at end of file
+// Package gosymbol is a minimal, deterministic symbolic math kernel.
+//
+// Expressions are immutable trees built from a small set of node types
+// (Num, Sym, Const, Add, Mul, Pow, Func). The package provides exact rational
+// arithmetic, simplification, differentiation, rule-based integration,
+// expansion, simple solvers, LaTeX rendering, JSON serialization, and an
+// MCP-compatible tool interface for AI agents.
+//
+// Output is deterministic. Simplify orders terms and factors canonically,
+// whatever order they were built in; functions returning several names or
+// results sort them; and functions taking maps, such as SubMap, do not
+// depend on map iteration order. The same input therefore prints the same
+// string in every run, so golden files and cached tool responses stay
+// stable.
+package gosymbol
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ============================================================
+// Expr interface
+// ============================================================
+
+// Expr is the interface implemented by every expression node.
+//
+// Expressions are immutable: every method returns a new tree and never
+// modifies the receiver.
+type Expr interface {
+	// Simplify returns an algebraically simplified, canonically ordered form.
+	Simplify() Expr
+	// String returns a human-readable infix form.
+	String() string
+	// LaTeX returns a LaTeX rendering.
+	LaTeX() string
+	// Sub replaces every occurrence of the symbol varName with value.
+	Sub(varName string, value Expr) Expr
+	// Diff returns the (unsimplified) derivative with respect to varName.
+	Diff(varName string) Expr
+	// Eval evaluates the expression to a number if it has no free symbols.
+	Eval() (*Num, bool)
+	// Equal reports whether two expressions are equal after simplification.
+	Equal(other Expr) bool
+
+	exprType() string
+	toJSON() map[string]interface{}
+}
+
+// equal is the shared implementation of Expr.Equal.
+func equal(a, b Expr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if StructEqual(a, b) {
+		return true
+	}
+	return a.Simplify().String() == b.Simplify().String()
+}
+
+// ============================================================
+// Construction-time simplification
+// ============================================================
+
+var lightSimplify atomic.Bool
+
+func init() { lightSimplify.Store(true) }
+
+// SetAutoSimplify turns construction-time light simplification on or off
+// and returns the previous setting. While it is on (the default), AddOf,
+// MulOf and PowOf, and the intermediate trees built by Diff, apply cheap
+// local rewrites immediately: nested sums and products are flattened,
+// numeric terms and factors are folded, and x+0, 1*x, 0*x, x^0, x^1, 1^x
+// and numeric powers collapse. Term order is otherwise kept as given; call
+// Simplify for the canonical form. Turn it off to build trees exactly as
+// written.
+func SetAutoSimplify(on bool) bool { return lightSimplify.Swap(on) }
+
+// AutoSimplify reports whether construction-time simplification is on.
+func AutoSimplify() bool { return lightSimplify.Load() }
+
+// mkAdd builds a sum, applying the light rules when enabled.
+func mkAdd(terms []Expr) Expr {
+	if !lightSimplify.Load() {
+		return &Add{terms: terms}
+	}
+	var out []Expr
+	constant := new(big.Rat)
+	var collect func(ts []Expr)
+	collect = func(ts []Expr) {
+		for _, t := range ts {
+			switch v := t.(type) {
+			case *Add:
+				collect(v.terms)
+			case *Num:
+				constant.Add(constant, v.val)
+			default:
+				out = append(out, t)
+			}
+		}
+	}
+	collect(terms)
+	if constant.Sign() != 0 || len(out) == 0 {
+		out = append(out, numRat(constant))
+	}
+	if len(out) == 1 {
+		return out[0]
+	}
+	return &Add{terms: out}
+}
+
+// mkMul builds a product, applying the light rules when enabled.
+func mkMul(factors []Expr) Expr {
+	if !lightSimplify.Load() {
+		return &Mul{factors: factors}
+	}
+	var out []Expr
+	coeff := big.NewRat(1, 1)
+	var collect func(fs []Expr)
+	collect = func(fs []Expr) {
+		for _, f := range fs {
+			switch v := f.(type) {
+			case *Mul:
+				collect(v.factors)
+			case *Num:
+				coeff.Mul(coeff, v.val)
+			default:
+				out = append(out, f)
+			}
+		}
+	}
+	collect(factors)
+	if coeff.Sign() == 0 {
+		return N(0)
+	}
+	if coeff.Cmp(big.NewRat(1, 1)) != 0 || len(out) == 0 {
+		out = append([]Expr{numRat(coeff)}, out...)
+	}
+	if len(out) == 1 {
+		return out[0]
+	}
+	return &Mul{factors: out}
+}
+
+// mkPow builds a power, applying the light rules when enabled.
+func mkPow(base, exp Expr) Expr {
+	if !lightSimplify.Load() {
+		return &Pow{base: base, exp: exp}
+	}
+	en, expNum := exp.(*Num)
+	bn, baseNum := base.(*Num)
+	switch {
+	case expNum && en.IsZero():
+		return N(1)
+	case expNum && en.IsOne():
+		return base
+	case baseNum && bn.IsOne():
+		return N(1)
+	case baseNum && expNum:
+		if r, ok := ratPow(bn.val, en.val); ok {
+			return numRat(r)
+		}
+	}
+	return &Pow{base: base, exp: exp}
+}
+
+// ============================================================
+// Num — exact rational number
+// ============================================================
+
+// Num is an exact rational number backed by math/big.Rat.
+type Num struct {
+	val *big.Rat
+}
+
+// N returns the integer n as a Num.
+func N(n int64) *Num {
+	return &Num{val: new(big.Rat).SetInt64(n)}
+}
+
+// F returns the exact fraction p/q. It panics if q is zero.
+func F(p, q int64) *Num {
+	if q == 0 {
+		panic("gosymbol: zero denominator")
+	}
+	return &Num{val: big.NewRat(p, q)}
+}
+
+// NRat returns r as a Num, for fractions whose numerator or denominator
+// does not fit in an int64. r is copied.
+func NRat(r *big.Rat) *Num { return &Num{val: new(big.Rat).Set(r)} }
+
+// NFloat returns the exact rational value of the float64 f. Because binary
+// floats rarely have short decimal forms, prefer N and F where possible.
+// It panics if f is NaN or infinite.
+func NFloat(f float64) *Num {
+	r := new(big.Rat)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		panic("gosymbol: NFloat of non-finite value")
+	}
+	r.SetFloat64(f)
+	return &Num{val: r}
+}
+
+// numRat wraps r as a Num. The caller must not modify r afterwards.
+func numRat(r *big.Rat) *Num { return &Num{val: r} }
+
+// Rat returns a copy of the underlying rational value.
+func (n *Num) Rat() *big.Rat { return new(big.Rat).Set(n.val) }
+
+// Float64 returns the nearest float64 value.
+func (n *Num) Float64() float64 {
+	f, _ := n.val.Float64()
+	return f
+}
+
+// IsZero reports whether n == 0.
+func (n *Num) IsZero() bool { return n.val.Sign() == 0 }
+
+// IsOne reports whether n == 1.
+func (n *Num) IsOne() bool { return n.val.IsInt() && n.val.Num().IsInt64() && n.val.Num().Int64() == 1 }
+
+// IsInt reports whether n is an integer.
+func (n *Num) IsInt() bool { return n.val.IsInt() }
+
+// Sign returns -1, 0, or +1 depending on the sign of n.
+func (n *Num) Sign() int { return n.val.Sign() }
+
+func (n *Num) Simplify() Expr { return n }
+
+func (n *Num) String() string {
+	if n.val.IsInt() {
+		return n.val.Num().String()
+	}
+	return n.val.String()
+}
+
+func (n *Num) LaTeX() string {
+	if n.val.IsInt() {
+		return n.val.Num().String()
+	}
+	sign := ""
+	num := new(big.Int).Set(n.val.Num())
+	if num.Sign() < 0 {
+		sign = "-"
+		num.Neg(num)
+	}
+	return fmt.Sprintf("%s\\frac{%s}{%s}", sign, num.String(), n.val.Denom().String())
+}
+
+func (n *Num) Sub(string, Expr) Expr { return n }
+func (n *Num) Diff(string) Expr      { return N(0) }
+func (n *Num) Eval() (*Num, bool)    { return n, true }
+func (n *Num) Equal(other Expr) bool { return equal(n, other) }
+func (n *Num) exprType() string      { return "num" }
+func (n *Num) toJSON() map[string]interface{} {
+	return map[string]interface{}{"type": "num", "value": n.String()}
+}
+
+// ============================================================
+// Sym — symbolic variable
+// ============================================================
+
+// Sym is a named symbolic variable.
+type Sym struct {
+	name string
+}
+
+// S returns the symbol with the given name.
+func S(name string) *Sym { return &Sym{name: name} }
+
+// Name returns the symbol's name.
+func (s *Sym) Name() string { return s.name }
+
+func (s *Sym) Simplify() Expr { return s }
+func (s *Sym) String() string { return s.name }
+
+var greekLetters = map[string]bool{
+	"alpha": true, "beta": true, "gamma": true, "delta": true, "epsilon": true,
+	"zeta": true, "eta": true, "theta": true, "iota": true, "kappa": true,
+	"lambda": true, "mu": true, "nu": true, "xi": true, "pi": true, "rho": true,
+	"sigma": true, "tau": true, "upsilon": true, "phi": true, "chi": true,
+	"psi": true, "omega": true, "Gamma": true, "Delta": true, "Theta": true,
+	"Lambda": true, "Xi": true, "Pi": true, "Sigma": true, "Phi": true,
+	"Psi": true, "Omega": true,
+}
+
+func (s *Sym) LaTeX() string {
+	name, sub := s.name, ""
+	if i := strings.Index(name, "_"); i > 0 && i < len(name)-1 {
+		name, sub = name[:i], name[i+1:]
+	}
+	if greekLetters[name] {
+		name = "\\" + name
+	}
+	if sub != "" {
+		return name + "_{" + sub + "}"
+	}
+	return name
+}
+
+func (s *Sym) Sub(varName string, value Expr) Expr {
+	if s.name == varName {
+		return value
+	}
+	return s
+}
+
+func (s *Sym) Diff(varName string) Expr {
+	if s.name == varName {
+		return N(1)
+	}
+	return N(0)
+}
+
+func (s *Sym) Eval() (*Num, bool)    { return nil, false }
+func (s *Sym) Equal(other Expr) bool { return equal(s, other) }
+func (s *Sym) exprType() string      { return "sym" }
+func (s *Sym) toJSON() map[string]interface{} {
+	return map[string]interface{}{"type": "sym", "name": s.name}
+}
+
+// ============================================================
+// Const — named constants
+// ============================================================
+
+// Const is a named mathematical constant such as Pi. Constants stay exact
+// through Simplify and Diff and only become floats in Eval.
+type Const struct {
+	name  string
+	latex string
+	val   float64
+}
+
+// Pi is the constant π. Parse reads it as pi.
+var Pi = &Const{name: "pi", latex: `\pi`, val: math.Pi}
+
+// E is Euler's number e, read by Parse as e. It is the simplified form of
+// exp(1), and E^u simplifies to exp(u).
+var E = &Const{name: "e", latex: `e`, val: math.E}
+
+// Inf is positive infinity, read by Parse as oo. It is meant for
+// integration limits and distribution supports; arithmetic on it is not
+// specially simplified.
+var Inf = &Const{name: "oo", latex: `\infty`, val: math.Inf(1)}
+
+// constants maps the names accepted by Parse and FromJSON to constants.
+var constants = map[string]*Const{"pi": Pi, "e": E, "oo": Inf}
+
+// Name returns the constant's name.
+func (c *Const) Name() string { return c.name }
+
+// Float64 returns the constant's numeric value.
+func (c *Const) Float64() float64 { return c.val }
+
+func (c *Const) Simplify() Expr                      { return c }
+func (c *Const) String() string                      { return c.name }
+func (c *Const) LaTeX() string                       { return c.latex }
+func (c *Const) Sub(varName string, value Expr) Expr { return c }
+func (c *Const) Diff(varName string) Expr            { return N(0) }
+func (c *Const) Eval() (*Num, bool)                  { return floatNum(c.val) }
+func (c *Const) Equal(other Expr) bool               { return equal(c, other) }
+func (c *Const) exprType() string                    { return "const" }
+func (c *Const) toJSON() map[string]interface{} {
+	return map[string]interface{}{"type": "const", "name": c.name}
+}
+
+// ============================================================
+// Add — sum of terms
+// ============================================================
+
+// Add is a sum of two or more terms.
+type Add struct {
+	terms []Expr
+}
+
+// AddOf returns the sum of the given terms, lightly simplified unless
+// SetAutoSimplify(false) is in effect.
+func AddOf(terms ...Expr) Expr {
+	return mkAdd(append([]Expr(nil), terms...))
+}
+
+// Terms returns a copy of the summands.
+func (a *Add) Terms() []Expr { return append([]Expr(nil), a.terms...) }
+
+func (a *Add) Simplify() Expr {
+	var flat []Expr
+	for _, t := range a.terms {
+		s := t.Simplify()
+		if inner, ok := s.(*Add); ok {
+			flat = append(flat, inner.terms...)
+			continue
+		}
+		// A numeric multiple of a sum, such as -(x + 1) or 2*(x + 1), is
+		// distributed so that its terms collect with the others.
+		c, rest := splitCoeff(s)
+		inner, ok := rest.(*Add)
+		if !ok {
+			flat = append(flat, s)
+			continue
+		}
+		for _, u := range inner.terms {
+			uc, ur := splitCoeff(u)
+			if n, ok := u.(*Num); ok {
+				flat = append(flat, numRat(new(big.Rat).Mul(c, n.val)))
+			} else {
+				flat = append(flat, withCoeff(new(big.Rat).Mul(c, uc), ur))
+			}
+		}
+	}
+
+	constant := new(big.Rat)
+	type group struct {
+		coeff *big.Rat
+		rest  Expr
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, t := range flat {
+		if n, ok := bare(t).(*Num); ok {
+			constant.Add(constant, n.val)
+			continue
+		}
+		c, rest := splitCoeff(t)
+		k := rest.String()
+		if g, ok := groups[k]; ok {
+			g.coeff.Add(g.coeff, c)
+			continue
+		}
+		groups[k] = &group{coeff: new(big.Rat).Set(c), rest: rest}
+		order = append(order, k)
+	}
+
+	// c*sin(u)^2 + c*cos(u)^2 = c
+	for _, k := range order {
+		g := groups[k]
+		p, ok := g.rest.(*Pow)
+		if !ok || !isNumValue(p.exp, 2) || g.coeff.Sign() == 0 {
+			continue
+		}
+		f, ok := p.base.(*Func)
+		if !ok || f.name != "sin" {
+			continue
+		}
+		ck := (&Pow{base: &Func{name: "cos", args: f.args}, exp: N(2)}).String()
+		if cg, ok := groups[ck]; ok && cg.coeff.Cmp(g.coeff) == 0 {
+			constant.Add(constant, g.coeff)
+			g.coeff.SetInt64(0)
+			cg.coeff.SetInt64(0)
+		}
+	}
+
+	var out []Expr
+	for _, k := range order {
+		g := groups[k]
+		if g.coeff.Sign() == 0 {
+			continue
+		}
+		out = append(out, withCoeff(g.coeff, g.rest))
+	}
+	sortTerms(out)
+	if constant.Sign() != 0 || len(out) == 0 {
+		out = append(out, numRat(constant))
+	}
+	if len(out) == 1 {
+		return out[0]
+	}
+	return &Add{terms: out}
+}
+
+func (a *Add) String() string {
+	var sb strings.Builder
+	for i, t := range a.terms {
+		if pos, ok := negatedTerm(t); ok && i > 0 {
+			sb.WriteString(" - ")
+			if _, sum := pos.(*Add); sum {
+				sb.WriteString("(" + pos.String() + ")")
+			} else {
+				sb.WriteString(pos.String())
+			}
+			continue
+		}
+		if i > 0 {
+			sb.WriteString(" + ")
+		}
+		if _, ok := bare(t).(*Relational); ok {
+			sb.WriteString("(" + t.String() + ")")
+		} else {
+			sb.WriteString(t.String())
+		}
+	}
+	return sb.String()
+}
+
+func (a *Add) LaTeX() string {
+	var sb strings.Builder
+	for i, t := range a.terms {
+		if pos, ok := negatedTerm(t); ok && i > 0 {
+			sb.WriteString(" - ")
+			if _, sum := pos.(*Add); sum {
+				sb.WriteString("\\left(" + pos.LaTeX() + "\\right)")
+			} else {
+				sb.WriteString(pos.LaTeX())
+			}
+			continue
+		}
+		if i > 0 {
+			sb.WriteString(" + ")
+		}
+		sb.WriteString(t.LaTeX())
+	}
+	return sb.String()
+}
+
+// negatedTerm returns -t when t is a negative number or a product with a
+// negative numeric coefficient, so sums can print "a - b" for a + (-b).
+func negatedTerm(t Expr) (Expr, bool) {
+	switch v := bare(t).(type) {
+	case *Num:
+		if v.Sign() < 0 {
+			return numRat(new(big.Rat).Neg(v.val)), true
+		}
+	case *Mul:
+		if len(v.factors) < 2 {
+			return nil, false
+		}
+		c, ok := v.factors[0].(*Num)
+		if !ok || c.Sign() >= 0 {
+			return nil, false
+		}
+		pos := new(big.Rat).Neg(c.val)
+		rest := v.factors[1:]
+		if pos.Cmp(big.NewRat(1, 1)) == 0 {
+			if len(rest) == 1 {
+				return rest[0], true
+			}
+			return &Mul{factors: append([]Expr(nil), rest...)}, true
+		}
+		return &Mul{factors: append([]Expr{numRat(pos)}, rest...)}, true
+	}
+	return nil, false
+}
+
+func (a *Add) Sub(varName string, value Expr) Expr {
+	out := make([]Expr, len(a.terms))
+	for i, t := range a.terms {
+		out[i] = t.Sub(varName, value)
+	}
+	return &Add{terms: out}
+}
+
+func (a *Add) Diff(varName string) Expr {
+	out := make([]Expr, len(a.terms))
+	for i, t := range a.terms {
+		out[i] = t.Diff(varName)
+	}
+	return mkAdd(out)
+}
+
+func (a *Add) Eval() (*Num, bool) {
+	sum := new(big.Rat)
+	for _, t := range a.terms {
+		v, ok := t.Eval()
+		if !ok {
+			return nil, false
+		}
+		sum.Add(sum, v.val)
+	}
+	return numRat(sum), true
+}
+
+func (a *Add) Equal(other Expr) bool { return equal(a, other) }
+func (a *Add) exprType() string      { return "add" }
+func (a *Add) toJSON() map[string]interface{} {
+	return map[string]interface{}{"type": "add", "terms": exprsJSON(a.terms)}
+}
+
+// splitCoeff splits a simplified term into its numeric coefficient and the
+// remaining factor, e.g. 3*x*y -> (3, x*y).
+func splitCoeff(e Expr) (*big.Rat, Expr) {
+	m, ok := e.(*Mul)
+	if !ok || len(m.factors) == 0 {
+		return big.NewRat(1, 1), e
+	}
+	n, ok := m.factors[0].(*Num)
+	if !ok {
+		return big.NewRat(1, 1), e
+	}
+	rest := m.factors[1:]
+	if len(rest) == 1 {
+		return n.val, rest[0]
+	}
+	return n.val, &Mul{factors: append([]Expr(nil), rest...)}
+}
+
+// withCoeff multiplies an already simplified, coefficient-free term by c.
+func withCoeff(c *big.Rat, rest Expr) Expr {
+	if c.Cmp(big.NewRat(1, 1)) == 0 {
+		return rest
+	}
+	coeff := numRat(new(big.Rat).Set(c))
+	if m, ok := rest.(*Mul); ok {
+		return &Mul{factors: append([]Expr{coeff}, m.factors...)}
+	}
+	return &Mul{factors: []Expr{coeff, rest}}
+}
+
+// sortTerms orders the non-constant terms of a sum in graded lexicographic
+// order: higher total degree first, then higher powers of alphabetically
+// earlier symbols, then by the printed coefficient-free part.
+func sortTerms(terms []Expr) {
+	type keyed struct {
+		deg  float64
+		exps map[string]float64
+		key  string
+		e    Expr
+	}
+	ks := make([]keyed, len(terms))
+	for i, t := range terms {
+		_, rest := splitCoeff(t)
+		ks[i] = keyed{deg: sortDegree(rest), exps: symExponents(rest), key: rest.String(), e: t}
+	}
+	sort.SliceStable(ks, func(i, j int) bool {
+		if ks[i].deg != ks[j].deg {
+			return ks[i].deg > ks[j].deg
+		}
+		if c := compareExponents(ks[i].exps, ks[j].exps); c != 0 {
+			return c > 0
+		}
+		return ks[i].key < ks[j].key
+	})
+	for i := range ks {
+		terms[i] = ks[i].e
+	}
+}
+
+// symExponents returns the numeric exponents of the bare symbols in a
+// monomial, e.g. x^2*y -> {x: 2, y: 1}.
+func symExponents(e Expr) map[string]float64 {
+	out := map[string]float64{}
+	factors := []Expr{e}
+	if m, ok := e.(*Mul); ok {
+		factors = m.factors
+	}
+	for _, f := range factors {
+		base, exp := asPow(f)
+		s, ok := base.(*Sym)
+		n, ok2 := exp.(*Num)
+		if ok && ok2 {
+			out[s.name] += n.Float64()
+		}
+	}
+	return out
+}
+
+// compareExponents compares two exponent maps lexicographically by symbol
+// name, returning +1 if a has the higher power of the first differing symbol.
+func compareExponents(a, b map[string]float64) int {
+	names := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		names = append(names, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if a[k] > b[k] {
+			return 1
+		}
+		if a[k] < b[k] {
+			return -1
+		}
+	}
+	return 0
+}
+
+// sortDegree is the total degree used for canonical term ordering.
+func sortDegree(e Expr) float64 {
+	switch t := e.(type) {
+	case *Num:
+		return 0
+	case *Pow:
+		if n, ok := t.exp.(*Num); ok {
+			return sortDegree(t.base) * n.Float64()
+		}
+		return sortDegree(t.base)
+	case *Mul:
+		d := 0.0
+		for _, f := range t.factors {
+			d += sortDegree(f)
+		}
+		return d
+	case *Add:
+		d := 0.0
+		for _, f := range t.terms {
+			d = math.Max(d, sortDegree(f))
+		}
+		return d
+	}
+	return 1
+}
+
+// ============================================================
+// Mul — product of factors
+// ============================================================
+
+// Mul is a product of two or more factors.
+type Mul struct {
+	factors []Expr
+}
+
+// MulOf returns the product of the given factors, lightly simplified
+// unless SetAutoSimplify(false) is in effect.
+func MulOf(factors ...Expr) Expr {
+	return mkMul(append([]Expr(nil), factors...))
+}
+
+// Neg returns -x. Numeric arguments are negated directly and a double
+// negation -(-x) collapses to x. A product takes the sign into its leading
+// numeric coefficient (-(2*x) is -2*x, -(x*y) is -1*x*y), which is the tree
+// its printed form parses back to; anything else becomes -1*x.
+func Neg(x Expr) Expr {
+	switch t := x.(type) {
+	case *Num:
+		return numRat(new(big.Rat).Neg(t.val))
+	case *Mul:
+		if len(t.factors) < 2 {
+			break
+		}
+		c, ok := t.factors[0].(*Num)
+		switch {
+		case !ok:
+			return &Mul{factors: append([]Expr{N(-1)}, t.factors...)}
+		case !isNumValue(c, -1):
+			return &Mul{factors: append([]Expr{numRat(new(big.Rat).Neg(c.val))}, t.factors[1:]...)}
+		case len(t.factors) == 2:
+			return t.factors[1]
+		default:
+			return &Mul{factors: append([]Expr(nil), t.factors[1:]...)}
+		}
+	}
+	return &Mul{factors: []Expr{N(-1), x}}
+}
+
+func neg(e Expr) Expr { return Neg(e) }
+
+// Factors returns a copy of the factors.
+func (m *Mul) Factors() []Expr { return append([]Expr(nil), m.factors...) }
+
+func (m *Mul) Simplify() Expr {
+	var flat []Expr
+	for _, f := range m.factors {
+		s := f.Simplify()
+		if inner, ok := s.(*Mul); ok {
+			flat = append(flat, inner.factors...)
+		} else {
+			flat = append(flat, s)
+		}
+	}
+
+	coeff := big.NewRat(1, 1)
+	type group struct {
+		base Expr
+		exp  Expr
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, f := range flat {
+		if n, ok := bare(f).(*Num); ok {
+			if n.IsZero() {
+				return N(0)
+			}
+			coeff.Mul(coeff, n.val)
+			continue
+		}
+		// Powers of the same base merge by adding exponents, symbolic
+		// ones included: x^a*x^b is x^(a + b).
+		base, exp := asPow(f)
+		k := base.String()
+		if g, ok := groups[k]; ok {
+			gn, ok1 := g.exp.(*Num)
+			en, ok2 := exp.(*Num)
+			if ok1 && ok2 {
+				g.exp = numRat(new(big.Rat).Add(gn.val, en.val))
+			} else {
+				g.exp = (&Add{terms: []Expr{g.exp, exp}}).Simplify()
+			}
+			continue
+		}
+		groups[k] = &group{base: base, exp: exp}
+		order = append(order, k)
+	}
+
+	var out []Expr
+	resimplify := false
+	for _, k := range order {
+		g := groups[k]
+		var f Expr
+		if isNumValue(g.exp, 1) {
+			f = g.base
+		} else {
+			f = (&Pow{base: g.base, exp: g.exp}).Simplify()
+		}
+		switch ft := f.(type) {
+		case *Num:
+			coeff.Mul(coeff, ft.val)
+		case *Mul:
+			resimplify = true
+			out = append(out, ft)
+		default:
+			out = append(out, f)
+		}
+	}
+	if coeff.Sign() == 0 {
+		return N(0)
+	}
+	if resimplify {
+		return (&Mul{factors: append([]Expr{numRat(coeff)}, out...)}).Simplify()
+	}
+	sortFactors(out)
+	if len(out) == 0 {
+		return numRat(coeff)
+	}
+	if coeff.Cmp(big.NewRat(1, 1)) == 0 {
+		if len(out) == 1 {
+			return out[0]
+		}
+		return &Mul{factors: out}
+	}
+	return &Mul{factors: append([]Expr{numRat(coeff)}, out...)}
+}
+
+// asPow views e as base^exp, treating non-powers as e^1.
+func asPow(e Expr) (Expr, Expr) {
+	if p, ok := e.(*Pow); ok {
+		return p.base, p.exp
+	}
+	return e, N(1)
+}
+
+// sortFactors orders the non-numeric factors of a product: symbols and
+// their powers first, then everything else, each lexicographically.
+func sortFactors(fs []Expr) {
+	class := func(e Expr) int {
+		b, _ := asPow(e)
+		if _, ok := b.(*Sym); ok {
+			return 0
+		}
+		return 1
+	}
+	sort.SliceStable(fs, func(i, j int) bool {
+		ci, cj := class(fs[i]), class(fs[j])
+		if ci != cj {
+			return ci < cj
+		}
+		return fs[i].String() < fs[j].String()
+	})
+}
+
+func (m *Mul) String() string {
+	fs, sign := m.factors, ""
+	if len(fs) > 1 && isNumValue(fs[0], -1) {
+		fs, sign = fs[1:], "-"
+	}
+	parts := make([]string, len(fs))
+	for i, f := range fs {
+		s := f.String()
+		switch bare(f).(type) {
+		case *Add, *Relational:
+			s = "(" + s + ")"
+		}
+		parts[i] = s
+	}
+	out := strings.Join(parts, "*")
+	if sign != "" && strings.HasPrefix(out, "-") {
+		out = "(" + out + ")"
+	}
+	return sign + out
+}
+
+func (m *Mul) LaTeX() string {
+	fs, sign := m.factors, ""
+	if len(fs) > 1 && isNumValue(fs[0], -1) {
+		fs, sign = fs[1:], "-"
+	}
+	parts := make([]string, len(fs))
+	for i, f := range fs {
+		s := f.LaTeX()
+		switch bare(f).(type) {
+		case *Add, *Relational:
+			s = "\\left(" + s + "\\right)"
+		default:
+			// A sign after the first factor would read as subtraction:
+			// 2*(-3) is 2 \left(-3\right), not 2 -3.
+			if i > 0 && strings.HasPrefix(s, "-") {
+				s = "\\left(" + s + "\\right)"
+			}
+		}
+		parts[i] = s
+	}
+	out := strings.Join(parts, " ")
+	if sign != "" && strings.HasPrefix(out, "-") {
+		out = "\\left(" + out + "\\right)"
+	}
+	return sign + out
+}
+
+func (m *Mul) Sub(varName string, value Expr) Expr {
+	out := make([]Expr, len(m.factors))
+	for i, f := range m.factors {
+		out[i] = f.Sub(varName, value)
+	}
+	return &Mul{factors: out}
+}
+
+func (m *Mul) Diff(varName string) Expr {
+	var terms []Expr
+	for i := range m.factors {
+		fs := make([]Expr, len(m.factors))
+		copy(fs, m.factors)
+		fs[i] = m.factors[i].Diff(varName)
+		terms = append(terms, mkMul(fs))
+	}
+	return mkAdd(terms)
+}
+
+func (m *Mul) Eval() (*Num, bool) {
+	prod := big.NewRat(1, 1)
+	for _, f := range m.factors {
+		v, ok := f.Eval()
+		if !ok {
+			return nil, false
+		}
+		prod.Mul(prod, v.val)
+	}
+	return numRat(prod), true
+}
+
+func (m *Mul) Equal(other Expr) bool { return equal(m, other) }
+func (m *Mul) exprType() string      { return "mul" }
+func (m *Mul) toJSON() map[string]interface{} {
+	return map[string]interface{}{"type": "mul", "factors": exprsJSON(m.factors)}
+}
+
+// ============================================================
+// Pow — base^exp
+// ============================================================
+
+// Pow is base raised to the power exp.
+type Pow struct {
+	base Expr
+	exp  Expr
+}
+
+// PowOf returns base^exp, lightly simplified unless SetAutoSimplify(false)
+// is in effect.
+func PowOf(base, exp Expr) Expr { return mkPow(base, exp) }
+
+// SqrtOf returns x^(1/2).
+func SqrtOf(x Expr) Expr { return &Pow{base: x, exp: F(1, 2)} }
+
+// Base returns the base.
+func (p *Pow) Base() Expr { return p.base }
+
+// Exp returns the exponent.
+func (p *Pow) Exp() Expr { return p.exp }
+
+// maxExactExponent bounds exact evaluation of integer powers of rationals.
+const maxExactExponent = 256
+
+func (p *Pow) Simplify() Expr {
+	b := p.base.Simplify()
+	e := p.exp.Simplify()
+	en, expNum := e.(*Num)
+	if expNum {
+		if en.IsZero() {
+			return N(1)
+		}
+		if en.IsOne() {
+			return b
+		}
+	}
+	if bn, ok := b.(*Num); ok {
+		if bn.IsOne() {
+			return N(1)
+		}
+		if bn.IsZero() && expNum && en.Sign() > 0 {
+			return N(0)
+		}
+		if expNum {
+			if r, ok := ratPow(bn.val, en.val); ok {
+				return numRat(r)
+			}
+		}
+	}
+	if b == Expr(E) {
+		return (&Func{name: "exp", args: []Expr{e}}).Simplify()
+	}
+	switch b.(type) {
+	case *Delta, *Relational:
+		if expNum && en.IsInt() && en.Sign() > 0 {
+			// δ and relations are 0 or 1, so δ^n = δ.
+			return b
+		}
+	}
+	if inner, ok := b.(*Pow); ok && powersCombine(inner, e) {
+		return (&Pow{base: inner.base, exp: (&Mul{factors: []Expr{inner.exp, e}}).Simplify()}).Simplify()
+	}
+	if m, ok := b.(*Mul); ok && expNum && en.IsInt() {
+		fs := make([]Expr, len(m.factors))
+		for i, f := range m.factors {
+			fs[i] = &Pow{base: f, exp: en}
+		}
+		return (&Mul{factors: fs}).Simplify()
+	}
+	return &Pow{base: b, exp: e}
+}
+
+// powersCombine reports whether (inner)^e is inner.base^(inner.exp*e) for
+// every value of the symbols: when e is an integer, when inner.exp is a
+// real number in (-1, 1], or when inner.base is a positive constant. So
+// (x^a)^2 and (x^(1/2))^a combine, but (x^2)^(1/2) is |x|, not x; the
+// Engine combines it when its assumptions make x nonnegative.
+func powersCombine(inner *Pow, e Expr) bool {
+	if en, ok := e.(*Num); ok && en.IsInt() {
+		return true
+	}
+	if in, ok := inner.exp.(*Num); ok && in.val.Cmp(big.NewRat(-1, 1)) > 0 && in.val.Cmp(big.NewRat(1, 1)) <= 0 {
+		return true
+	}
+	switch t := inner.base.(type) {
+	case *Num:
+		return t.Sign() > 0
+	case *Const:
+		return t == Pi || t == E
+	}
+	return false
+}
+
+// ratPow computes b^e exactly when the result is rational.
+func ratPow(b, e *big.Rat) (*big.Rat, bool) {
+	if b.Sign() == 0 && e.Sign() < 0 {
+		return nil, false
+	}
+	p := new(big.Int).Set(e.Num())
+	q := e.Denom()
+	if !q.IsInt64() || q.Int64() > maxExactExponent {
+		return nil, false
+	}
+	if new(big.Int).Abs(p).Cmp(big.NewInt(maxExactExponent)) > 0 {
+		return nil, false
+	}
+	base := new(big.Rat).Set(b)
+	if q.Int64() != 1 {
+		num, ok1 := intRoot(base.Num(), q.Int64())
+		den, ok2 := intRoot(base.Denom(), q.Int64())
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		base.SetFrac(num, den)
+	}
+	neg := p.Sign() < 0
+	p.Abs(p)
+	num := new(big.Int).Exp(base.Num(), p, nil)
+	den := new(big.Int).Exp(base.Denom(), p, nil)
+	r := new(big.Rat).SetFrac(num, den)
+	if neg {
+		r.Inv(r)
+	}
+	return r, true
+}
+
+// intRoot returns the exact integer k-th root of n, if it exists.
+func intRoot(n *big.Int, k int64) (*big.Int, bool) {
+	if n.Sign() < 0 {
+		if k%2 == 0 {
+			return nil, false
+		}
+		r, ok := intRoot(new(big.Int).Neg(n), k)
+		if !ok {
+			return nil, false
+		}
+		return r.Neg(r), true
+	}
+	if n.Sign() == 0 || k == 1 {
+		return new(big.Int).Set(n), true
+	}
+	// Newton iteration on integers, starting above the root.
+	kk := big.NewInt(k)
+	x := new(big.Int).Lsh(big.NewInt(1), uint(n.BitLen()/int(k)+1))
+	for {
+		// y = ((k-1)*x + n / x^(k-1)) / k
+		xk1 := new(big.Int).Exp(x, big.NewInt(k-1), nil)
+		y := new(big.Int).Mul(big.NewInt(k-1), x)
+		y.Add(y, new(big.Int).Quo(n, xk1))
+		y.Quo(y, kk)
+		if y.Cmp(x) >= 0 {
+			break
+		}
+		x = y
+	}
+	if new(big.Int).Exp(x, kk, nil).Cmp(n) == 0 {
+		return x, true
+	}
+	return nil, false
+}
+
+// needsParens reports whether e must be parenthesized as a power base.
+func powBaseNeedsParens(e Expr) bool {
+	switch t := bare(e).(type) {
+	case *Add, *Mul, *Pow, *Relational:
+		return true
+	case *Num:
+		return t.Sign() < 0 || !t.IsInt()
+	}
+	return false
+}
+
+func (p *Pow) String() string {
+	b := p.base.String()
+	if powBaseNeedsParens(p.base) {
+		b = "(" + b + ")"
+	}
+	e := p.exp.String()
+	switch t := bare(p.exp).(type) {
+	case *Num:
+		if !t.IsInt() {
+			e = "(" + e + ")"
+		}
+	case *Sym, *Func, *WildSym:
+	default:
+		e = "(" + e + ")"
+	}
+	return b + "^" + e
+}
+
+func (p *Pow) LaTeX() string {
+	if isNumValue(p.exp, 0.5) {
+		return "\\sqrt{" + p.base.LaTeX() + "}"
+	}
+	b := p.base.LaTeX()
+	if powBaseNeedsParens(p.base) {
+		b = "\\left(" + b + "\\right)"
+	}
+	return b + "^{" + p.exp.LaTeX() + "}"
+}
+
+func (p *Pow) Sub(varName string, value Expr) Expr {
+	return &Pow{base: p.base.Sub(varName, value), exp: p.exp.Sub(varName, value)}
+}
+
+func (p *Pow) Diff(varName string) Expr {
+	baseDep := dependsOn(p.base, varName)
+	expDep := dependsOn(p.exp, varName)
+	switch {
+	case !baseDep && !expDep:
+		return N(0)
+	case !expDep:
+		// d/dx u^n = n*u^(n-1)*u'
+		return mkMul([]Expr{
+			p.exp,
+			mkPow(p.base, mkAdd([]Expr{p.exp, N(-1)})),
+			p.base.Diff(varName),
+		})
+	case !baseDep:
+		// d/dx a^v = a^v*ln(a)*v'
+		return mkMul([]Expr{p, &Func{name: "ln", args: []Expr{p.base}}, p.exp.Diff(varName)})
+	}
+	// d/dx u^v = u^v*(v'*ln(u) + v*u'/u)
+	return mkMul([]Expr{p, mkAdd([]Expr{
+		mkMul([]Expr{p.exp.Diff(varName), &Func{name: "ln", args: []Expr{p.base}}}),
+		mkMul([]Expr{p.exp, p.base.Diff(varName), mkPow(p.base, N(-1))}),
+	})})
+}
+
+func (p *Pow) Eval() (*Num, bool) {
+	b, ok := p.base.Eval()
+	if !ok {
+		return nil, false
+	}
+	e, ok := p.exp.Eval()
+	if !ok {
+		return nil, false
+	}
+	if r, ok := ratPow(b.val, e.val); ok {
+		return numRat(r), true
+	}
+	return floatNum(math.Pow(b.Float64(), e.Float64()))
+}
+
+func (p *Pow) Equal(other Expr) bool { return equal(p, other) }
+func (p *Pow) exprType() string      { return "pow" }
+func (p *Pow) toJSON() map[string]interface{} {
+	return map[string]interface{}{"type": "pow", "base": p.base.toJSON(), "exp": p.exp.toJSON()}
+}
+
+// floatNum converts a float result to a Num, failing for NaN and Inf.
+func floatNum(f float64) (*Num, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, false
+	}
+	return NFloat(f), true
+}
+
+// ============================================================
+// Func — named functions
+// ============================================================
+
+// Func is a named function applied to its arguments, one for most
+// functions and more for e.g. atan2(y, x). The behaviour of each name
+// (evaluation, derivative, rendering, special values) comes from the
+// function registry; see RegisterFunction.
+type Func struct {
+	name string
+	args []Expr
+}
+
+// FuncDef describes a function for the registry. Single-argument
+// functions set Eval and optionally Deriv, Simplify and LaTeX; functions
+// of Arity > 1 set the corresponding fields ending in N instead.
+type FuncDef struct {
+	// Name is the identifier used by Parse, FromJSON and String.
+	Name string
+	// Arity is the number of arguments; 0 means 1.
+	Arity int
+	// Eval evaluates a single-argument function numerically. Required
+	// when Arity <= 1.
+	Eval func(x float64) float64
+	// Deriv returns f'(u), the derivative with respect to the argument u.
+	// Diff applies the chain rule. Optional; differentiating a function
+	// without Deriv panics.
+	Deriv func(u Expr) Expr
+	// Simplify folds special values of an already simplified argument,
+	// e.g. sin(0) -> 0. It returns nil when no rule applies. Optional.
+	Simplify func(arg Expr) Expr
+	// LaTeX renders the function applied to an already rendered argument.
+	// Optional; defaults to \operatorname{name}\left(arg\right).
+	LaTeX func(arg string) string
+
+	// EvalN evaluates a function of several arguments numerically.
+	// Required when Arity > 1.
+	EvalN func(xs []float64) float64
+	// DerivN returns the partial derivative with respect to args[i]. Diff
+	// applies the chain rule to each argument. Optional, like Deriv.
+	DerivN func(args []Expr, i int) Expr
+	// SimplifyN folds special values of already simplified arguments,
+	// returning nil when no rule applies. Optional.
+	SimplifyN func(args []Expr) Expr
+	// LaTeXN renders the function applied to rendered arguments. Optional;
+	// defaults to \operatorname{name}\left(a, b\right).
+	LaTeXN func(args []string) string
+	// Rewrite expresses the function through single-argument functions,
+	// e.g. log(x, b) = ln(x)/ln(b), for EvalIn in domains that only apply
+	// those. Optional.
+	Rewrite func(args []Expr) Expr
+}
+
+func (d *FuncDef) arity() int { return max(d.Arity, 1) }
+
+var (
+	funcMu       sync.RWMutex
+	funcRegistry = map[string]*FuncDef{}
+)
+
+// RegisterFunction adds a function to the registry shared by Parse,
+// FromJSON, Simplify, Diff and Eval. The name must be a valid identifier
+// that is not already registered, and Eval must be set.
+func RegisterFunction(def FuncDef) error {
+	if !isIdentifier(def.Name) {
+		return fmt.Errorf("invalid function name %q", def.Name)
+	}
+	if def.Name == "sqrt" {
+		return fmt.Errorf("function %q is reserved", def.Name)
+	}
+	switch {
+	case def.Arity < 0:
+		return fmt.Errorf("function %q: negative arity", def.Name)
+	case def.Arity <= 1 && def.Eval == nil:
+		return fmt.Errorf("function %q: Eval is required", def.Name)
+	case def.Arity > 1 && def.EvalN == nil:
+		return fmt.Errorf("function %q: EvalN is required", def.Name)
+	}
+	funcMu.Lock()
+	defer funcMu.Unlock()
+	if _, ok := funcRegistry[def.Name]; ok {
+		return fmt.Errorf("function %q already registered", def.Name)
+	}
+	d := def
+	funcRegistry[def.Name] = &d
+	return nil
+}
+
+// LookupFunction returns the registered definition of name.
+func LookupFunction(name string) (FuncDef, bool) {
+	d := lookupFunc(name)
+	if d == nil {
+		return FuncDef{}, false
+	}
+	return *d, true
+}
+
+// RegisteredFunctions returns the names of all registered functions, sorted.
+func RegisteredFunctions() []string {
+	funcMu.RLock()
+	defer funcMu.RUnlock()
+	out := make([]string, 0, len(funcRegistry))
+	for k := range funcRegistry {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func lookupFunc(name string) *FuncDef {
+	funcMu.RLock()
+	defer funcMu.RUnlock()
+	return funcRegistry[name]
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// isVariableName reports whether s is an identifier that Parse reads as a
+// symbol rather than as one of the constants.
+func isVariableName(s string) bool {
+	_, isConst := constants[s]
+	return isIdentifier(s) && !isConst
+}
+
+// FuncOf returns name(args...) for a registered function name. It panics
+// if the name is not registered or takes a different number of arguments.
+func FuncOf(name string, args ...Expr) Expr {
+	d := lookupFunc(name)
+	if d == nil {
+		panic("gosymbol: unknown function " + name)
+	}
+	if len(args) != d.arity() {
+		panic(fmt.Sprintf("gosymbol: %s takes %d arguments, got %d", name, d.arity(), len(args)))
+	}
+	return &Func{name: name, args: append([]Expr(nil), args...)}
+}
+
+// SinOf returns sin(x).
+func SinOf(x Expr) Expr { return &Func{name: "sin", args: []Expr{x}} }
+
+// CosOf returns cos(x).
+func CosOf(x Expr) Expr { return &Func{name: "cos", args: []Expr{x}} }
+
+// TanOf returns tan(x).
+func TanOf(x Expr) Expr { return &Func{name: "tan", args: []Expr{x}} }
+
+// ExpOf returns exp(x).
+func ExpOf(x Expr) Expr { return &Func{name: "exp", args: []Expr{x}} }
+
+// LnOf returns the natural logarithm ln(x).
+func LnOf(x Expr) Expr { return &Func{name: "ln", args: []Expr{x}} }
+
+// Deg returns deg(x), the angle of x degrees. Its value is the radian
+// measure x*pi/180, so sin(Deg(N(30))) simplifies to 1/2, but the unit
+// stays visible until the argument is a number. Parse reads 30° as
+// deg(30).
+func Deg(x Expr) Expr { return &Func{name: "deg", args: []Expr{x}} }
+
+// Rad returns rad(x), the angle of x radians: it marks x as already in
+// radians, so that DegreeMode leaves it alone, and simplifies to x.
+func Rad(x Expr) Expr { return &Func{name: "rad", args: []Expr{x}} }
+
+// AbsOf returns |x|.
+func AbsOf(x Expr) Expr { return &Func{name: "abs", args: []Expr{x}} }
+
+// SignOf returns sign(x), which is -1, 0 or 1.
+func SignOf(x Expr) Expr { return &Func{name: "sign", args: []Expr{x}} }
+
+// LambertWOf returns W(x), the principal branch of the Lambert W function:
+// the solution w >= -1 of w*exp(w) = x, defined for x >= -1/e.
+func LambertWOf(x Expr) Expr { return &Func{name: "lambertw", args: []Expr{x}} }
+
+// LogOf returns log(x, base), the logarithm of x to the given base.
+func LogOf(x, base Expr) Expr { return &Func{name: "log", args: []Expr{x, base}} }
+
+// Atan2Of returns atan2(y, x), the angle in (-π, π] of the point (x, y).
+func Atan2Of(y, x Expr) Expr { return &Func{name: "atan2", args: []Expr{y, x}} }
+
+// MaxOf returns max(a, b).
+func MaxOf(a, b Expr) Expr { return &Func{name: "max", args: []Expr{a, b}} }
+
+// MinOf returns min(a, b).
+func MinOf(a, b Expr) Expr { return &Func{name: "min", args: []Expr{a, b}} }
+
+// Li2Of returns the dilogarithm Li₂(x) = -∫₀ˣ ln(1-t)/t dt, real for x <= 1.
+func Li2Of(x Expr) Expr { return &Func{name: "li2", args: []Expr{x}} }
+
+// Name returns the function name.
+func (f *Func) Name() string { return f.name }
+
+// Arg returns the first argument, the only one of most functions.
+func (f *Func) Arg() Expr { return f.args[0] }
+
+// Args returns a copy of the arguments.
+func (f *Func) Args() []Expr { return append([]Expr(nil), f.args...) }
+
+// mapArgs returns f applied to g of each argument.
+func (f *Func) mapArgs(g func(Expr) Expr) *Func {
+	args := make([]Expr, len(f.args))
+	for i, a := range f.args {
+		args[i] = g(a)
+	}
+	return &Func{name: f.name, args: args}
+}
+
+func (f *Func) Simplify() Expr {
+	s := f.mapArgs(Expr.Simplify)
+	if d := lookupFunc(f.name); d != nil {
+		var r Expr
+		switch {
+		case len(s.args) == 1 && d.Simplify != nil:
+			r = d.Simplify(s.args[0])
+		case len(s.args) > 1 && d.SimplifyN != nil:
+			r = d.SimplifyN(s.args)
+		}
+		if r != nil {
+			return r
+		}
+	}
+	return s
+}
+
+func (f *Func) String() string {
+	args := make([]string, len(f.args))
+	for i, a := range f.args {
+		args[i] = a.String()
+	}
+	return f.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (f *Func) LaTeX() string {
+	args := make([]string, len(f.args))
+	for i, a := range f.args {
+		args[i] = a.LaTeX()
+	}
+	if d := lookupFunc(f.name); d != nil {
+		switch {
+		case len(args) == 1 && d.LaTeX != nil:
+			return d.LaTeX(args[0])
+		case len(args) > 1 && d.LaTeXN != nil:
+			return d.LaTeXN(args)
+		}
+	}
+	return "\\operatorname{" + f.name + "}\\left(" + strings.Join(args, ", ") + "\\right)"
+}
+
+func (f *Func) Sub(varName string, value Expr) Expr {
+	return f.mapArgs(func(a Expr) Expr { return a.Sub(varName, value) })
+}
+
+func (f *Func) Diff(varName string) Expr {
+	d := lookupFunc(f.name)
+	var terms []Expr
+	for i, a := range f.args {
+		if !dependsOn(a, varName) {
+			continue
+		}
+		var p Expr
+		switch {
+		case d != nil && len(f.args) == 1 && d.Deriv != nil:
+			p = d.Deriv(a)
+		case d != nil && len(f.args) > 1 && d.DerivN != nil:
+			p = d.DerivN(f.args, i)
+		default:
+			panic("gosymbol: no derivative rule for " + f.name)
+		}
+		terms = append(terms, mkMul([]Expr{p, a.Diff(varName)}))
+	}
+	switch len(terms) {
+	case 0:
+		return N(0)
+	case 1:
+		return terms[0]
+	}
+	return &Add{terms: terms}
+}
+
+func (f *Func) Eval() (*Num, bool) {
+	xs := make([]float64, len(f.args))
+	for i, a := range f.args {
+		v, ok := a.Eval()
+		if !ok {
+			return nil, false
+		}
+		xs[i] = v.Float64()
+	}
+	if s, ok := f.Simplify().(*Num); ok {
+		return s, true
+	}
+	return floatNum(applyFunc(f.name, xs...))
+}
+
+// applyFunc evaluates the named function on float64 arguments, giving NaN
+// for unknown names and wrong argument counts.
+func applyFunc(name string, xs ...float64) float64 {
+	d := lookupFunc(name)
+	switch {
+	case d == nil || len(xs) != d.arity():
+		return math.NaN()
+	case len(xs) == 1:
+		return d.Eval(xs[0])
+	}
+	return d.EvalN(xs)
+}
+
+func (f *Func) Equal(other Expr) bool { return equal(f, other) }
+func (f *Func) exprType() string      { return "func" }
+
+// toJSON writes the argument of a single-argument function as "arg" and
+// those of other functions as "args".
+func (f *Func) toJSON() map[string]interface{} {
+	if len(f.args) == 1 {
+		return map[string]interface{}{"type": "func", "name": f.name, "arg": f.args[0].toJSON()}
+	}
+	return map[string]interface{}{"type": "func", "name": f.name, "args": exprsJSON(f.args)}
+}
+
+// latexCommand renders \name\left(arg\right) for functions with a LaTeX command.
+func latexCommand(cmd string) func(string) string {
+	return func(a string) string { return cmd + "\\left(" + a + "\\right)" }
+}
+
+// exactTrig returns the Simplify rule giving exact values of sin, cos or
+// tan at multiples of π/6 and π/4, e.g. sin(pi/6) -> 1/2 and
+// cos(pi/4) -> 1/2*2^(1/2). tan is left unevaluated at its poles.
+func exactTrig(name string) func(Expr) Expr {
+	return func(arg Expr) Expr {
+		r, ok := piMultiple(arg)
+		if !ok {
+			return nil
+		}
+		// Work in twelfths of π, reduced to [0, 24).
+		t := new(big.Rat).Mul(r, big.NewRat(12, 1))
+		if !t.IsInt() {
+			return nil
+		}
+		k := int(new(big.Int).Mod(t.Num(), big.NewInt(24)).Int64())
+		if k%2 != 0 && k%3 != 0 {
+			return nil
+		}
+		switch name {
+		case "cos":
+			k = (k + 6) % 24
+		case "tan":
+			k %= 12
+			if k == 6 {
+				return nil
+			}
+			if k > 6 {
+				return neg(tanTwelfths[12-k]).Simplify()
+			}
+			return tanTwelfths[k].Simplify()
+		}
+		sign := 1
+		if k >= 12 {
+			sign, k = -1, k-12
+		}
+		if k > 6 {
+			k = 12 - k
+		}
+		if sign < 0 {
+			return neg(sinTwelfths[k]).Simplify()
+		}
+		return sinTwelfths[k].Simplify()
+	}
+}
+
+// sinTwelfths and tanTwelfths hold sin and tan at k*π/12 for the first
+// quadrant entries the special-angle table needs.
+var (
+	sinTwelfths = map[int]Expr{
+		0: N(0),
+		2: F(1, 2),
+		3: &Mul{factors: []Expr{F(1, 2), SqrtOf(N(2))}},
+		4: &Mul{factors: []Expr{F(1, 2), SqrtOf(N(3))}},
+		6: N(1),
+	}
+	tanTwelfths = map[int]Expr{
+		0: N(0),
+		2: &Mul{factors: []Expr{F(1, 3), SqrtOf(N(3))}},
+		3: N(1),
+		4: SqrtOf(N(3)),
+	}
+)
+
+// piMultiple returns r when e is the simplified form of r*π (including 0).
+func piMultiple(e Expr) (*big.Rat, bool) {
+	switch t := e.(type) {
+	case *Num:
+		if t.IsZero() {
+			return new(big.Rat), true
+		}
+	case *Const:
+		if t == Pi {
+			return big.NewRat(1, 1), true
+		}
+	case *Mul:
+		if len(t.factors) == 2 && t.factors[1] == Expr(Pi) {
+			if n, ok := t.factors[0].(*Num); ok {
+				return n.val, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// foldAt returns a Simplify rule mapping the numeric argument at to result.
+func foldAt(at, result int64) func(Expr) Expr {
+	return func(arg Expr) Expr {
+		if n, ok := arg.(*Num); ok && n.val.Cmp(big.NewRat(at, 1)) == 0 {
+			return N(result)
+		}
+		return nil
+	}
+}
+
+// gammaInt folds Γ(n) = (n-1)! for integers 1 <= n <= 100.
+func gammaInt(arg Expr) Expr {
+	n, ok := arg.(*Num)
+	if !ok || !n.IsInt() || n.Sign() <= 0 || n.val.Num().Cmp(big.NewInt(100)) > 0 {
+		return nil
+	}
+	f := new(big.Int).MulRange(1, n.val.Num().Int64()-1)
+	return numRat(new(big.Rat).SetInt(f))
+}
+
+func init() {
+	builtins := []FuncDef{
+		{Name: "sin", Eval: math.Sin, Simplify: exactTrig("sin"), LaTeX: latexCommand("\\sin"),
+			Deriv: func(u Expr) Expr { return &Func{name: "cos", args: []Expr{u}} }},
+		{Name: "cos", Eval: math.Cos, Simplify: exactTrig("cos"), LaTeX: latexCommand("\\cos"),
+			Deriv: func(u Expr) Expr { return neg(&Func{name: "sin", args: []Expr{u}}) }},
+		{Name: "tan", Eval: math.Tan, Simplify: exactTrig("tan"), LaTeX: latexCommand("\\tan"),
+			Deriv: func(u Expr) Expr { return &Pow{base: &Func{name: "cos", args: []Expr{u}}, exp: N(-2)} }},
+		{Name: "exp", Eval: math.Exp,
+			Simplify: func(arg Expr) Expr {
+				switch {
+				case isNumValue(arg, 0):
+					return N(1)
+				case isNumValue(arg, 1):
+					return E
+				}
+				// exp(ln(u)) = u wherever ln(u) is real.
+				if f, ok := arg.(*Func); ok && f.name == "ln" {
+					return f.args[0]
+				}
+				return nil
+			},
+			LaTeX: func(a string) string { return "e^{" + a + "}" },
+			Deriv: func(u Expr) Expr { return &Func{name: "exp", args: []Expr{u}} }},
+		{Name: "ln", Eval: math.Log, LaTeX: latexCommand("\\ln"),
+			Simplify: func(arg Expr) Expr {
+				switch {
+				case isNumValue(arg, 1):
+					return N(0)
+				case arg == Expr(E):
+					return N(1)
+				}
+				// ln(exp(u)) = u for real u.
+				if f, ok := arg.(*Func); ok && f.name == "exp" {
+					return f.args[0]
+				}
+				return nil
+			},
+			Deriv: func(u Expr) Expr { return &Pow{base: u, exp: N(-1)} }},
+		{Name: "abs", Eval: math.Abs,
+			Simplify: func(arg Expr) Expr {
+				if n, ok := arg.(*Num); ok {
+					return numRat(new(big.Rat).Abs(n.val))
+				}
+				if inner, ok := arg.(*Func); ok && inner.name == "abs" {
+					return inner
+				}
+				// |-u| = |u|, with sums normalized to a positive leading term.
+				lead := arg
+				if a, ok := arg.(*Add); ok {
+					lead = a.terms[0]
+				}
+				if _, ok := negatedTerm(lead); ok {
+					return &Func{name: "abs", args: []Expr{Expand(neg(arg))}}
+				}
+				return nil
+			},
+			LaTeX: func(a string) string { return "\\left|" + a + "\\right|" },
+			Deriv: func(u Expr) Expr {
+				return &Mul{factors: []Expr{u, &Pow{base: &Func{name: "abs", args: []Expr{u}}, exp: N(-1)}}}
+			}},
+		{Name: "sign", Eval: signum, LaTeX: latexCommand("\\operatorname{sign}"),
+			Simplify: func(arg Expr) Expr {
+				if n, ok := arg.(*Num); ok {
+					return N(int64(n.Sign()))
+				}
+				if inner, ok := arg.(*Func); ok && inner.name == "sign" {
+					return inner
+				}
+				return nil
+			},
+			// Zero away from the jump at 0.
+			Deriv: func(u Expr) Expr { return N(0) }},
+		{Name: "deg", Eval: func(x float64) float64 { return x * math.Pi / 180 },
+			Simplify: func(arg Expr) Expr {
+				if n, ok := arg.(*Num); ok {
+					return (&Mul{factors: []Expr{numRat(new(big.Rat).Quo(n.val, big.NewRat(180, 1))), Pi}}).Simplify()
+				}
+				return nil
+			},
+			LaTeX: func(a string) string {
+				if strings.ContainsAny(a, " +-") {
+					a = "\\left(" + a + "\\right)"
+				}
+				return "{" + a + "^{\\circ}}"
+			},
+			Deriv: func(u Expr) Expr { return &Mul{factors: []Expr{F(1, 180), Pi}} }},
+		{Name: "rad", Eval: func(x float64) float64 { return x },
+			Simplify: func(arg Expr) Expr { return arg },
+			LaTeX:    func(a string) string { return "\\left(" + a + "\\right)\\,\\mathrm{rad}" },
+			Deriv:    func(u Expr) Expr { return N(1) }},
+		{Name: "asin", Eval: math.Asin, Simplify: foldAt(0, 0), LaTeX: latexCommand("\\arcsin"),
+			Deriv: func(u Expr) Expr { return &Pow{base: sub(N(1), &Pow{base: u, exp: N(2)}), exp: F(-1, 2)} }},
+		{Name: "acos", Eval: math.Acos, LaTeX: latexCommand("\\arccos"),
+			Deriv: func(u Expr) Expr { return neg(&Pow{base: sub(N(1), &Pow{base: u, exp: N(2)}), exp: F(-1, 2)}) }},
+		{Name: "atan", Eval: math.Atan, Simplify: foldAt(0, 0), LaTeX: latexCommand("\\arctan"),
+			Deriv: func(u Expr) Expr { return &Pow{base: &Add{terms: []Expr{N(1), &Pow{base: u, exp: N(2)}}}, exp: N(-1)} }},
+		{Name: "sinh", Eval: math.Sinh, Simplify: foldAt(0, 0), LaTeX: latexCommand("\\sinh"),
+			Deriv: func(u Expr) Expr { return &Func{name: "cosh", args: []Expr{u}} }},
+		{Name: "cosh", Eval: math.Cosh, Simplify: foldAt(0, 1), LaTeX: latexCommand("\\cosh"),
+			Deriv: func(u Expr) Expr { return &Func{name: "sinh", args: []Expr{u}} }},
+		{Name: "tanh", Eval: math.Tanh, Simplify: foldAt(0, 0), LaTeX: latexCommand("\\tanh"),
+			Deriv: func(u Expr) Expr { return &Pow{base: &Func{name: "cosh", args: []Expr{u}}, exp: N(-2)} }},
+		{Name: "erf", Eval: math.Erf, Simplify: foldAt(0, 0), LaTeX: latexCommand("\\operatorname{erf}"),
+			Deriv: func(u Expr) Expr {
+				// 2/sqrt(pi) * exp(-u^2)
+				return &Mul{factors: []Expr{N(2), &Pow{base: Pi, exp: F(-1, 2)}, &Func{name: "exp", args: []Expr{neg(&Pow{base: u, exp: N(2)})}}}}
+			}},
+		{Name: "gamma", Eval: math.Gamma, Simplify: gammaInt, LaTeX: latexCommand("\\Gamma"),
+			Deriv: func(u Expr) Expr {
+				return &Mul{factors: []Expr{&Func{name: "gamma", args: []Expr{u}}, &Func{name: "digamma", args: []Expr{u}}}}
+			}},
+		{Name: "digamma", Eval: digamma, LaTeX: latexCommand("\\psi"),
+			Deriv: func(u Expr) Expr { return &Func{name: "polygamma", args: []Expr{N(1), u}} }},
+		{Name: "polygamma", Arity: 2, EvalN: func(xs []float64) float64 { return polygamma(xs[0], xs[1]) },
+			SimplifyN: func(args []Expr) Expr {
+				if isNumValue(args[0], 0) {
+					return &Func{name: "digamma", args: []Expr{args[1]}}
+				}
+				return nil
+			},
+			LaTeXN: func(a []string) string { return "\\psi^{(" + a[0] + ")}\\left(" + a[1] + "\\right)" },
+			DerivN: func(args []Expr, i int) Expr {
+				if i == 0 {
+					panic("gosymbol: polygamma is only differentiable in its argument")
+				}
+				return &Func{name: "polygamma", args: []Expr{&Add{terms: []Expr{args[0], N(1)}}, args[1]}}
+			}},
+		{Name: "lambertw", Eval: lambertW, Simplify: lambertWExact, LaTeX: latexCommand("W"),
+			Deriv: func(u Expr) Expr {
+				// W(u)/(u*(1 + W(u)))
+				w := &Func{name: "lambertw", args: []Expr{u}}
+				return div(w, &Mul{factors: []Expr{u, &Add{terms: []Expr{N(1), w}}}})
+			}},
+		{Name: "li2", Eval: dilog, LaTeX: latexCommand("\\operatorname{Li}_2"),
+			Simplify: func(arg Expr) Expr {
+				// Li₂(1) = π²/6, Li₂(-1) = -π²/12
+				switch {
+				case isNumValue(arg, 0):
+					return N(0)
+				case isNumValue(arg, 1):
+					return &Mul{factors: []Expr{F(1, 6), &Pow{base: Pi, exp: N(2)}}}
+				case isNumValue(arg, -1):
+					return &Mul{factors: []Expr{F(-1, 12), &Pow{base: Pi, exp: N(2)}}}
+				}
+				return nil
+			},
+			Deriv: func(u Expr) Expr { return neg(div(&Func{name: "ln", args: []Expr{sub(N(1), u)}}, u)) }},
+		{Name: "log", Arity: 2, EvalN: func(xs []float64) float64 { return math.Log(xs[0]) / math.Log(xs[1]) },
+			SimplifyN: logSimplify,
+			LaTeXN:    func(a []string) string { return "\\log_{" + a[1] + "}\\left(" + a[0] + "\\right)" },
+			DerivN: func(args []Expr, i int) Expr {
+				x, b := args[0], args[1]
+				lnb := &Func{name: "ln", args: []Expr{b}}
+				if i == 0 {
+					// 1/(x*ln(b))
+					return &Pow{base: &Mul{factors: []Expr{x, lnb}}, exp: N(-1)}
+				}
+				// -ln(x)/(b*ln(b)^2)
+				return neg(div(&Func{name: "ln", args: []Expr{x}}, &Mul{factors: []Expr{b, &Pow{base: lnb, exp: N(2)}}}))
+			},
+			Rewrite: func(args []Expr) Expr {
+				return div(&Func{name: "ln", args: []Expr{args[0]}}, &Func{name: "ln", args: []Expr{args[1]}})
+			}},
+		{Name: "atan2", Arity: 2, EvalN: func(xs []float64) float64 { return math.Atan2(xs[0], xs[1]) },
+			SimplifyN: atan2Simplify,
+			DerivN: func(args []Expr, i int) Expr {
+				y, x := args[0], args[1]
+				r2 := &Add{terms: []Expr{&Pow{base: x, exp: N(2)}, &Pow{base: y, exp: N(2)}}}
+				if i == 0 {
+					return div(x, r2)
+				}
+				return neg(div(y, r2))
+			},
+			Rewrite: func(args []Expr) Expr {
+				// 2*atan(y/(sqrt(x^2 + y^2) + x)), undefined on the negative x axis.
+				y, x := args[0], args[1]
+				r := SqrtOf(&Add{terms: []Expr{&Pow{base: x, exp: N(2)}, &Pow{base: y, exp: N(2)}}})
+				return &Mul{factors: []Expr{N(2), &Func{name: "atan", args: []Expr{div(y, &Add{terms: []Expr{r, x}})}}}}
+			}},
+		extremum("max", 1, math.Max),
+		extremum("min", -1, math.Min),
+	}
+	for _, d := range builtins {
+		if err := RegisterFunction(d); err != nil {
+			panic(err)
+		}
+		builtinFuncs[d.Name] = true
+	}
+}
+
+// builtinFuncs holds the names of the functions registered by the package
+// itself, as opposed to RegisterFunction callers; it is fixed after init.
+var builtinFuncs = map[string]bool{}
+
+// logSimplify folds log(1, b) = 0, log(b, b) = 1 and log(x, e) = ln(x),
+// and log(x, b) = k when x = b^k for rational b and an integer k.
+func logSimplify(args []Expr) Expr {
+	x, b := args[0], args[1]
+	switch {
+	case isNumValue(x, 1):
+		return N(0)
+	case x.String() == b.String():
+		return N(1)
+	case b == Expr(E):
+		return (&Func{name: "ln", args: []Expr{x}}).Simplify()
+	}
+	xn, ok1 := x.(*Num)
+	bn, ok2 := b.(*Num)
+	if !ok1 || !ok2 || xn.Sign() <= 0 || bn.Sign() <= 0 || isNumValue(bn, 1) {
+		return nil
+	}
+	// Compare |log| against powers of the base above 1.
+	base, target, sign := new(big.Rat).Set(bn.val), new(big.Rat).Set(xn.val), int64(1)
+	if base.Cmp(big.NewRat(1, 1)) < 0 {
+		base.Inv(base)
+		sign = -sign
+	}
+	if target.Cmp(big.NewRat(1, 1)) < 0 {
+		target.Inv(target)
+		sign = -sign
+	}
+	p := new(big.Rat).Set(base)
+	for k := int64(1); p.Cmp(target) <= 0 && k <= 4096; k++ {
+		if p.Cmp(target) == 0 {
+			return N(sign * k)
+		}
+		p.Mul(p, base)
+	}
+	return nil
+}
+
+// atan2Simplify folds atan2 on the axes and rewrites atan2(y, x) for a
+// positive number x as atan(y/x).
+func atan2Simplify(args []Expr) Expr {
+	y, x := args[0], args[1]
+	xn, ok := x.(*Num)
+	if !ok {
+		return nil
+	}
+	if xn.Sign() > 0 {
+		return (&Func{name: "atan", args: []Expr{div(y, x)}}).Simplify()
+	}
+	yn, ok := y.(*Num)
+	if !ok {
+		return nil
+	}
+	switch {
+	case xn.Sign() == 0 && yn.Sign() == 0:
+		return nil
+	case xn.Sign() == 0:
+		return &Mul{factors: []Expr{F(int64(yn.Sign()), 2), Pi}}
+	case yn.Sign() == 0:
+		return Pi
+	}
+	r := (&Func{name: "atan", args: []Expr{div(y, x)}}).Simplify()
+	return (&Add{terms: []Expr{r, &Mul{factors: []Expr{N(int64(yn.Sign())), Pi}}}}).Simplify()
+}
+
+// extremum defines max (dir 1) or min (dir -1) of two arguments. Simplify
+// folds numbers and equal arguments and orders the arguments by printed
+// form; the partial derivatives are (1 ± sign(a - b))/2 away from a = b.
+func extremum(name string, dir int64, eval func(a, b float64) float64) FuncDef {
+	return FuncDef{Name: name, Arity: 2, EvalN: func(xs []float64) float64 { return eval(xs[0], xs[1]) },
+		SimplifyN: func(args []Expr) Expr {
+			a, b := args[0], args[1]
+			if an, ok := a.(*Num); ok {
+				if bn, ok := b.(*Num); ok {
+					if int64(an.val.Cmp(bn.val))*dir >= 0 {
+						return a
+					}
+					return b
+				}
+			}
+			switch c := strings.Compare(a.String(), b.String()); {
+			case c == 0:
+				return a
+			case c > 0:
+				return &Func{name: name, args: []Expr{b, a}}
+			}
+			return nil
+		},
+		LaTeXN: func(a []string) string { return "\\" + name + "\\left(" + a[0] + ", " + a[1] + "\\right)" },
+		DerivN: func(args []Expr, i int) Expr {
+			s := N(dir)
+			if i == 1 {
+				s = N(-dir)
+			}
+			sg := &Func{name: "sign", args: []Expr{sub(args[0], args[1])}}
+			return &Mul{factors: []Expr{F(1, 2), &Add{terms: []Expr{N(1), &Mul{factors: []Expr{s, sg}}}}}}
+		},
+		Rewrite: func(args []Expr) Expr {
+			// (a + b ± |a - b|)/2
+			d := &Mul{factors: []Expr{N(dir), &Func{name: "abs", args: []Expr{sub(args[0], args[1])}}}}
+			return &Mul{factors: []Expr{F(1, 2), &Add{terms: []Expr{args[0], args[1], d}}}}
+		}}
+}
+
+// signum returns -1, 0 or 1 according to the sign of x, and NaN for NaN.
+func signum(x float64) float64 {
+	switch {
+	case x > 0:
+		return 1
+	case x < 0:
+		return -1
+	}
+	return x
+}
+
+// digamma evaluates ψ(x) = Γ'(x)/Γ(x) by recurrence and asymptotic series.
+func digamma(x float64) float64 {
+	if x <= 0 && x == math.Floor(x) {
+		return math.NaN()
+	}
+	if x < 0 {
+		// Reflection: ψ(1-x) - ψ(x) = π cot(πx).
+		return digamma(1-x) - math.Pi/math.Tan(math.Pi*x)
+	}
+	r := 0.0
+	for x < 10 {
+		r -= 1 / x
+		x++
+	}
+	f := 1 / (x * x)
+	return r + math.Log(x) - 0.5/x - f*(1.0/12-f*(1.0/120-f*(1.0/252-f*(1.0/240-f/132))))
+}
+
+// polygamma evaluates ψ⁽ⁿ⁾(x), the n-th derivative of ψ, for an integer
+// n >= 0 by recurrence and asymptotic series. Other orders give NaN.
+func polygamma(n, x float64) float64 {
+	if n < 0 || n != math.Floor(n) || x <= 0 && x == math.Floor(x) {
+		return math.NaN()
+	}
+	if n == 0 {
+		return digamma(x)
+	}
+	// ψ⁽ⁿ⁾(x) = ψ⁽ⁿ⁾(x+1) + (-1)^(n+1) n!/x^(n+1), then the series
+	// (-1)^(n+1) [(n-1)!/x^n + n!/(2x^(n+1)) + Σ B₂ₖ (2k+n-1)!/((2k)! x^(2k+n))].
+	fact := math.Gamma(n + 1)
+	r := 0.0
+	for x < 20+n {
+		r += fact / math.Pow(x, n+1)
+		x++
+	}
+	r += math.Gamma(n)/math.Pow(x, n) + fact/(2*math.Pow(x, n+1))
+	for k, b := range []float64{1.0 / 6, -1.0 / 30, 1.0 / 42, -1.0 / 30, 5.0 / 66} {
+		k2 := float64(2 * (k + 1))
+		r += b * math.Gamma(k2+n) / (math.Gamma(k2+1) * math.Pow(x, k2+n))
+	}
+	if math.Mod(n, 2) == 0 {
+		return -r
+	}
+	return r
+}
+
+// lambertWExact folds W(c*exp(c)) = c for rational c >= -1, which covers
+// W(0) = 0 and W(e) = 1.
+func lambertWExact(arg Expr) Expr {
+	if arg == Expr(E) {
+		return N(1)
+	}
+	c, e := Expr(N(1)), arg
+	if m, ok := arg.(*Mul); ok && len(m.factors) == 2 {
+		c, e = m.factors[0], m.factors[1]
+	}
+	if isNumValue(arg, 0) {
+		return N(0)
+	}
+	n, ok := c.(*Num)
+	f, ok2 := e.(*Func)
+	if !ok || !ok2 || f.name != "exp" || n.val.Cmp(big.NewRat(-1, 1)) < 0 || f.args[0].String() != n.String() {
+		return nil
+	}
+	return n
+}
+
+// lambertW evaluates the principal branch W₀ by Halley's iteration, and
+// returns NaN below the branch point -1/e.
+func lambertW(x float64) float64 {
+	const branch = -1 / math.E
+	switch {
+	case math.IsNaN(x) || x < branch:
+		return math.NaN()
+	case x == branch:
+		return -1
+	case math.IsInf(x, 1):
+		return x
+	case x == 0:
+		return 0
+	}
+	var w float64
+	switch {
+	case x < -0.25:
+		// Series about the branch point in p = sqrt(2(ex + 1)).
+		p := math.Sqrt(2 * (math.E*x + 1))
+		w = -1 + p - p*p/3 + 11.0/72*p*p*p
+	case x < 3:
+		w = math.Log1p(x) * 0.75
+	default:
+		l := math.Log(x)
+		w = l - math.Log(l)
+	}
+	for i := 0; i < 50; i++ {
+		e := math.Exp(w)
+		f := w*e - x
+		d := e*(w+1) - (w+2)*f/(2*w+2)
+		if d == 0 || math.IsNaN(d) {
+			break
+		}
+		next := w - f/d
+		if math.Abs(next-w) <= 1e-15*math.Max(1, math.Abs(next)) {
+			return next
+		}
+		w = next
+	}
+	return w
+}
+
+// dilog evaluates Li₂(x) for real x <= 1 (NaN above 1) by reducing to
+// 0 <= x <= 1/2, where the power series Σ xᵏ/k² converges at least like
+// 2⁻ᵏ.
+func dilog(x float64) float64 {
+	const pi26 = math.Pi * math.Pi / 6
+	switch {
+	case math.IsNaN(x) || x > 1:
+		return math.NaN()
+	case x == 1:
+		return pi26
+	case x < -1:
+		// Li₂(x) = -π²/6 - ln²(-x)/2 - Li₂(1/x)
+		l := math.Log(-x)
+		return -pi26 - l*l/2 - dilog(1/x)
+	case x < 0:
+		// Li₂(x) = Li₂(x²)/2 - Li₂(-x)
+		return dilog(x*x)/2 - dilog(-x)
+	case x > 0.5:
+		// Li₂(x) = π²/6 - ln(x)ln(1-x) - Li₂(1-x)
+		return pi26 - math.Log(x)*math.Log1p(-x) - dilog(1-x)
+	}
+	sum, p := 0.0, x
+	for k := 1.0; k < 200 && p != 0; k++ {
+		term := p / (k * k)
+		sum += term
+		if term < 1e-17*sum {
+			break
+		}
+		p *= x
+	}
+	return sum
+}
+
+// ============================================================
+// UndefFunc — undefined function
+// ============================================================
+
+// UndefFunc is an unknown function f, or its n-th derivative, applied to
+// an argument: f(x), f'(x) and so on. It is built with Function and
+// stands for a quantity defined implicitly, e.g. by an ODE. Diff applies
+// the chain rule and raises the derivative order; Integrate undoes one
+// derivative of f(x) with respect to x. It cannot be evaluated.
+type UndefFunc struct {
+	name  string
+	order int
+	arg   Expr
+}
+
+// Function returns the unknown function named name, to be applied to an
+// argument: f := Function("f"); f(x). It also declares name to Parse,
+// which from then on reads f(x) and f'(x) as the unknown function and its
+// derivative, so printed results parse back. It panics if name is not an
+// identifier or names a registered function.
+func Function(name string) func(x Expr) Expr {
+	if !isIdentifier(name) || name == "sqrt" || lookupFunc(name) != nil {
+		panic(fmt.Sprintf("gosymbol: Function name %q is not free", name))
+	}
+	declareFunction(name)
+	return func(x Expr) Expr { return &UndefFunc{name: name, arg: x} }
+}
+
+// maxFunctionOrder bounds the derivative order of an unknown function
+// that FromJSON and Parse accept, as intParam bounds tool integers.
+const maxFunctionOrder = 1000
+
+// declaredFuncs holds the names passed to Function, guarded by funcMu.
+// Input from FromJSON or a tool call never adds to it; a call names its
+// unknown functions with ParseWithFunctions instead.
+var declaredFuncs = map[string]bool{}
+
+func declareFunction(name string) {
+	funcMu.Lock()
+	defer funcMu.Unlock()
+	declaredFuncs[name] = true
+}
+
+func isDeclaredFunction(name string) bool {
+	funcMu.RLock()
+	defer funcMu.RUnlock()
+	return declaredFuncs[name]
+}
+
+// Name returns the function name.
+func (u *UndefFunc) Name() string { return u.name }
+
+// Order returns the number of times the function is differentiated.
+func (u *UndefFunc) Order() int { return u.order }
+
+// Arg returns the function argument.
+func (u *UndefFunc) Arg() Expr { return u.arg }
+
+func (u *UndefFunc) Simplify() Expr {
+	return &UndefFunc{name: u.name, order: u.order, arg: u.arg.Simplify()}
+}
+
+// String returns e.g. "f(x)", or "f'(x)" for the first derivative, with
+// one prime per order up to the third; higher orders print as
+// "Derivative(f(x), (x, 4))", taken with respect to the argument. Parse
+// reads all of them back.
+func (u *UndefFunc) String() string {
+	f := u.name + "(" + u.arg.String() + ")"
+	if u.order > 3 {
+		return fmt.Sprintf("Derivative(%s, (%s, %d))", f, u.arg, u.order)
+	}
+	return u.name + strings.Repeat("'", u.order) + "(" + u.arg.String() + ")"
+}
+
+// LaTeX returns e.g. f'\left(x\right), or f^{(4)}\left(x\right) from the
+// fourth derivative on.
+func (u *UndefFunc) LaTeX() string {
+	d := strings.Repeat("'", u.order)
+	if u.order > 3 {
+		d = fmt.Sprintf("^{(%d)}", u.order)
+	}
+	return (&Sym{name: u.name}).LaTeX() + d + `\left(` + u.arg.LaTeX() + `\right)`
+}
+
+func (u *UndefFunc) Sub(varName string, value Expr) Expr {
+	return &UndefFunc{name: u.name, order: u.order, arg: u.arg.Sub(varName, value)}
+}
+
+func (u *UndefFunc) Diff(varName string) Expr {
+	if !dependsOn(u.arg, varName) {
+		return N(0)
+	}
+	return mkMul([]Expr{&UndefFunc{name: u.name, order: u.order + 1, arg: u.arg}, u.arg.Diff(varName)})
+}
+
+func (u *UndefFunc) Eval() (*Num, bool)    { return nil, false }
+func (u *UndefFunc) Equal(other Expr) bool { return equal(u, other) }
+func (u *UndefFunc) exprType() string      { return "function" }
+func (u *UndefFunc) toJSON() map[string]interface{} {
+	m := map[string]interface{}{"type": "function", "name": u.name, "arg": u.arg.toJSON()}
+	if u.order > 0 {
+		m["order"] = u.order
+	}
+	return m
+}
+
+// ============================================================
+// Integral — unevaluated definite integral
+// ============================================================
+
+// Integral is the definite integral of integrand over v from lo to hi. The
+// variable v is bound, as described for binder. Limits may be Inf or -Inf.
+type Integral struct {
+	integrand Expr
+	v         string
+	lo, hi    Expr
+	// divergent marks an integral that Simplify found to diverge, so
+	// that simplifying it again leaves it as it is.
+	divergent bool
+}
+
+// IntegralOf returns the unevaluated integral of f over v from lo to hi.
+// Simplify replaces it with F(hi) - F(lo) when Integrate finds an
+// antiderivative F and both limits are finite, case by case when F is a
+// Piecewise; it stays unevaluated when F is singular at a limit, or in
+// the cases where it is. Eval uses quadrature.
+func IntegralOf(f Expr, v string, lo, hi Expr) Expr {
+	return &Integral{integrand: f, v: v, lo: lo, hi: hi}
+}
+
+// Integrand returns the integrand.
+func (i *Integral) Integrand() Expr { return i.integrand }
+
+// Var returns the name of the integration variable.
+func (i *Integral) Var() string { return i.v }
+
+// Limits returns the lower and upper limits.
+func (i *Integral) Limits() (Expr, Expr) { return i.lo, i.hi }
+
+func (i *Integral) Simplify() Expr {
+	if i.divergent {
+		return i
+	}
+	f, lo, hi := i.integrand.Simplify(), i.lo.Simplify(), i.hi.Simplify()
+	if lo.String() == hi.String() {
+		return N(0)
+	}
+	if !dependsOnInf(lo) && !dependsOnInf(hi) {
+		if r, ok := integrateKinks(f, i.v, lo, hi); ok {
+			return r
+		}
+		if F, ok := Integrate(f, i.v); ok {
+			return definite(F, &Integral{integrand: f, v: i.v, lo: lo, hi: hi, divergent: true})
+		}
+	}
+	return &Integral{integrand: f, v: i.v, lo: lo, hi: hi}
+}
+
+// definite evaluates the antiderivative F of the integrand of the
+// divergent-marked in between its limits, case by case when F is a
+// Piecewise in parameters. A limit where F is singular, as at ln(0) or
+// 0^-1, means the integral diverges, and in is returned. A power 0^p with
+// p symbolic is 0 only when p > 0, so ∫ x^n dx from 0 to 1 is 1/(n + 1)
+// when n > -1 and in otherwise.
+func definite(F Expr, in *Integral) Expr {
+	if p, ok := F.(*Piecewise); ok {
+		q := &Piecewise{cases: make([]PieceCase, len(p.cases)), otherwise: definite(p.otherwise, in)}
+		for j, c := range p.cases {
+			if dependsOn(c.Cond.Lhs, in.v) || dependsOn(c.Cond.Rhs, in.v) {
+				return in
+			}
+			q.cases[j] = PieceCase{definite(c.Value, in), c.Cond}
+		}
+		return q.Simplify()
+	}
+	var conds []Cond
+	a, ok1 := boundValue(F, in.v, in.hi, &conds)
+	b, ok2 := boundValue(F, in.v, in.lo, &conds)
+	if !ok1 || !ok2 {
+		return in
+	}
+	r := sub(a, b).Simplify()
+	for j := len(conds) - 1; j >= 0; j-- {
+		r = &Piecewise{cases: []PieceCase{{r, conds[j]}}, otherwise: in}
+	}
+	return r.Simplify()
+}
+
+// boundValue returns F at v = a, reporting false when F is singular
+// there. Each power 0^p with p symbolic is replaced by 0 and the condition
+// p > 0 appended to conds.
+func boundValue(F Expr, v string, a Expr, conds *[]Cond) (Expr, bool) {
+	ok := true
+	var fix func(Expr) Expr
+	fix = func(e Expr) Expr {
+		switch t := e.(type) {
+		case *Func:
+			if t.name == "ln" && isNumValue(t.args[0], 0) {
+				ok = false
+			}
+		case *Pow:
+			if isNumValue(t.base, 0) {
+				k, isNum := t.exp.(*Num)
+				if !isNum {
+					*conds = append(*conds, positiveCond(t.exp))
+					return N(0)
+				}
+				if k.Sign() < 0 {
+					ok = false
+				}
+			}
+		}
+		_, cs := labeledChildren(e)
+		if len(cs) == 0 {
+			return e
+		}
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = fix(c)
+		}
+		return withChildren(e, out)
+	}
+	r := fix(F.Sub(v, a).Simplify())
+	return r, ok
+}
+
+// dependsOnInf reports whether e mentions Inf.
+func dependsOnInf(e Expr) bool {
+	if e == Inf {
+		return true
+	}
+	_, children := labeledChildren(e)
+	for _, c := range children {
+		if dependsOnInf(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Integral) String() string {
+	return fmt.Sprintf("integrate(%s, %s, %s, %s)", i.integrand, i.v, i.lo, i.hi)
+}
+
+func (i *Integral) LaTeX() string {
+	return fmt.Sprintf(`\int_{%s}^{%s} %s \, d%s`, i.lo.LaTeX(), i.hi.LaTeX(), i.integrand.LaTeX(), i.v)
+}
+
+func (i *Integral) Sub(varName string, value Expr) Expr { return subBound(i, varName, value) }
+
+func (i *Integral) binding() (string, Expr, []Expr) { return i.v, i.integrand, []Expr{i.lo, i.hi} }
+
+func (i *Integral) rebind(v string, body Expr, rest []Expr) Expr {
+	return &Integral{integrand: body, v: v, lo: rest[0], hi: rest[1]}
+}
+
+// Diff applies the Leibniz rule.
+func (i *Integral) Diff(varName string) Expr {
+	var terms []Expr
+	if varName != i.v && dependsOn(i.integrand, varName) {
+		terms = append(terms, &Integral{integrand: i.integrand.Diff(varName), v: i.v, lo: i.lo, hi: i.hi})
+	}
+	if dependsOn(i.hi, varName) {
+		terms = append(terms, &Mul{factors: []Expr{i.integrand.Sub(i.v, i.hi), i.hi.Diff(varName)}})
+	}
+	if dependsOn(i.lo, varName) {
+		terms = append(terms, &Mul{factors: []Expr{N(-1), i.integrand.Sub(i.v, i.lo), i.lo.Diff(varName)}})
+	}
+	return mkAdd(append(terms, N(0)))
+}
+
+func (i *Integral) Eval() (*Num, bool) {
+	v, ok := evalFloat(i, nil)
+	if !ok {
+		return nil, false
+	}
+	return floatNum(v)
+}
+
+func (i *Integral) Equal(other Expr) bool { return equal(i, other) }
+func (i *Integral) exprType() string      { return "integral" }
+func (i *Integral) toJSON() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "integral", "var": i.v,
+		"integrand": i.integrand.toJSON(), "lo": i.lo.toJSON(), "hi": i.hi.toJSON(),
+	}
+}
+
+// binder is implemented by the nodes that bind a variable within one of
+// their subexpressions: Integral, Sum, Product and Lambda. The bound variable is
+// not free in the node, so FreeSymbols omits it and Sub of it changes
+// only the other parts, such as the limits. Substituting a value that
+// mentions the bound variable renames it first, to v_1 or the first
+// v_k that is free in neither, so the value's v is not captured:
+// Sub(Σ_k x*k, x, k) is Σ_k_1 k*k_1, not Σ_k k^2.
+type binder interface {
+	Expr
+	// binding returns the bound variable, the subexpression it is bound
+	// in, and the other children, where it is free.
+	binding() (v string, body Expr, rest []Expr)
+	// rebind returns a node of the same kind with the given parts.
+	rebind(v string, body Expr, rest []Expr) Expr
+}
+
+// subBound is Sub for a binder.
+func subBound(b binder, varName string, value Expr) Expr {
+	v, body, rest := b.binding()
+	out := make([]Expr, len(rest))
+	for i, r := range rest {
+		out[i] = r.Sub(varName, value)
+	}
+	if varName == v || !dependsOn(body, varName) {
+		return b.rebind(v, body, out)
+	}
+	if dependsOn(value, v) {
+		fresh := freshName(v, value, body)
+		body, v = body.Sub(v, S(fresh)), fresh
+	}
+	return b.rebind(v, body.Sub(varName, value), out)
+}
+
+// freshName returns the first of v_1, v_2, … that is free in none of es.
+func freshName(v string, es ...Expr) string {
+	for k := 1; ; k++ {
+		fresh := fmt.Sprintf("%s_%d", v, k)
+		used := false
+		for _, e := range es {
+			used = used || dependsOn(e, fresh)
+		}
+		if !used {
+			return fresh
+		}
+	}
+}
+
+// BoundSymbols returns the sorted names of the variables bound anywhere in
+// e by an Integral, Sum, Product or Lambda.
+func BoundSymbols(e Expr) []string {
+	set := map[string]bool{}
+	Walk(e, func(e Expr) bool {
+		if b, ok := e.(binder); ok {
+			v, _, _ := b.binding()
+			set[v] = true
+		}
+		return true
+	})
+	return sortedNames(set)
+}
+
+// quadrature integrates f over [a, b] with composite 10-point
+// Gauss–Legendre rules. Infinite limits are mapped onto a finite interval
+// first.
+func quadrature(f func(float64) (float64, bool), a, b float64) (float64, bool) {
+	switch {
+	case a > b:
+		v, ok := quadrature(f, b, a)
+		return -v, ok
+	case math.IsInf(a, -1) && math.IsInf(b, 1):
+		// s = u/(1-u^2), u in (-1, 1)
+		return quadrature(func(u float64) (float64, bool) {
+			w := 1 - u*u
+			v, ok := f(u / w)
+			return v * (1 + u*u) / (w * w), ok
+		}, -1, 1)
+	case math.IsInf(b, 1):
+		// s = a + u/(1-u), u in [0, 1)
+		return quadrature(func(u float64) (float64, bool) {
+			v, ok := f(a + u/(1-u))
+			return v / ((1 - u) * (1 - u)), ok
+		}, 0, 1)
+	case math.IsInf(a, -1):
+		return quadrature(func(u float64) (float64, bool) { return f(-u) }, -b, math.Inf(1))
+	}
+	const panels = 32
+	h := (b - a) / panels
+	sum := 0.0
+	for p := 0; p < panels; p++ {
+		mid := a + (float64(p)+0.5)*h
+		for k, xk := range gaussNodes {
+			v, ok := f(mid + h/2*xk)
+			if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+				return 0, false
+			}
+			sum += gaussWeights[k] * v
+		}
+	}
+	return sum * h / 2, true
+}
+
+// ============================================================
+// Sum and Product — indexed sums and products
+// ============================================================
+
+// Sum is the sum of term over the integer index k from lo to hi, and
+// Product the product. The index is bound, as described for binder, and
+// the bounds are meant to be integers; hi may be Inf. An empty range,
+// with hi < lo, gives 0 and 1, and a non-integer numeric bound leaves the
+// node unevaluated.
+//
+// Simplify writes out ranges of up to 1000 terms with numeric bounds and otherwise looks for a closed form: for a Sum,
+// terms constant in k, polynomials in k (by Faulhaber's formula) and
+// geometric terms c*r^(a*k + b), the last Piecewise in r = 1 and with an
+// infinite upper bound when |r| < 1 is known; for a Product, factors
+// constant in k, shifts k + a of the index (through gamma), and powers
+// whose exponent sums in closed form. Sums without one stay unevaluated
+// and evaluate numerically when the bounds are numbers.
+type Sum struct {
+	term   Expr
+	k      string
+	lo, hi Expr
+}
+
+// Product is the product counterpart of Sum.
+type Product struct {
+	term   Expr
+	k      string
+	lo, hi Expr
+}
+
+// maxIndexedTerms bounds the ranges Sum and Product write out term by
+// term, and maxEvalTerms those they evaluate numerically.
+const (
+	maxIndexedTerms = 1000
+	maxEvalTerms    = 1 << 20
+)
+
+// SumOf returns the sum of term for k from lo to hi.
+func SumOf(term Expr, k string, lo, hi Expr) Expr { return &Sum{term: term, k: k, lo: lo, hi: hi} }
+
+// ProductOf returns the product of term for k from lo to hi.
+func ProductOf(term Expr, k string, lo, hi Expr) Expr {
+	return &Product{term: term, k: k, lo: lo, hi: hi}
+}
+
+// Term returns the summand.
+func (s *Sum) Term() Expr { return s.term }
+
+// Index returns the name of the summation index.
+func (s *Sum) Index() string { return s.k }
+
+// Limits returns the lower and upper bounds.
+func (s *Sum) Limits() (Expr, Expr) { return s.lo, s.hi }
+
+// Term returns the factor.
+func (p *Product) Term() Expr { return p.term }
+
+// Index returns the name of the product index.
+func (p *Product) Index() string { return p.k }
+
+// Limits returns the lower and upper bounds.
+func (p *Product) Limits() (Expr, Expr) { return p.lo, p.hi }
+
+// indexRange returns the terms of a range with numeric integer bounds, in
+// order, or false when the bounds are not such numbers or the range has
+// more than limit terms.
+func indexRange(lo, hi Expr, limit int64) ([]*big.Rat, bool) {
+	a, ok1 := lo.(*Num)
+	b, ok2 := hi.(*Num)
+	if !ok1 || !ok2 || !a.IsInt() || !b.IsInt() {
+		return nil, false
+	}
+	n := new(big.Int).Sub(b.val.Num(), a.val.Num())
+	if n.Sign() < 0 {
+		return nil, true
+	}
+	if !n.IsInt64() || n.Int64() >= limit {
+		return nil, false
+	}
+	out := make([]*big.Rat, n.Int64()+1)
+	for i := range out {
+		out[i] = new(big.Rat).Add(a.val, big.NewRat(int64(i), 1))
+	}
+	return out, true
+}
+
+func (s *Sum) Simplify() Expr {
+	term, lo, hi := s.term.Simplify(), s.lo.Simplify(), s.hi.Simplify()
+	if ks, ok := indexRange(lo, hi, maxIndexedTerms); ok {
+		terms := make([]Expr, 0, len(ks)+1)
+		for _, k := range ks {
+			terms = append(terms, term.Sub(s.k, numRat(k)))
+		}
+		return (&Add{terms: append(terms, N(0))}).Simplify()
+	}
+	if !dependsOnInf(lo) && integerBounds(lo, hi) {
+		if r, ok := closedSum(term, s.k, lo, hi); ok {
+			return r.Simplify()
+		}
+	}
+	return &Sum{term: term, k: s.k, lo: lo, hi: hi}
+}
+
+// integerBounds reports whether neither bound is a non-integer number,
+// for which a closed form would sum over a range that is not there:
+// sum(k, k, 1/2, 3) stays unevaluated.
+func integerBounds(lo, hi Expr) bool {
+	for _, b := range []Expr{lo, hi} {
+		if n, ok := b.(*Num); ok && !n.IsInt() {
+			return false
+		}
+	}
+	return true
+}
+
+// closedSum returns the sum of term for k from lo to hi in closed form,
+// sum by sum when term is a sum; see Sum.
+func closedSum(term Expr, k string, lo, hi Expr) (Expr, bool) {
+	infinite := dependsOnInf(hi)
+	if cs := PolyCoeffs(term, k); cs != nil && !infinite {
+		// Σ_{k=lo}^{hi} k^p = S_p(hi) - S_p(lo - 1), with S_p(n) = Σ_{j=1}^{n} j^p.
+		var terms []Expr
+		for p, c := range cs {
+			if p > maxFaulhaberDegree {
+				return nil, false
+			}
+			sp := powerSumPoly(p)
+			terms = append(terms, &Mul{factors: []Expr{c, sub(polyAtExpr(sp, hi), polyAtExpr(sp, sub(lo, N(1))))}})
+		}
+		return Expand(&Add{terms: append(terms, N(0))}), true
+	}
+	if r, ok := geometricSum(term, k, lo, hi); ok {
+		return r, true
+	}
+	a, ok := term.(*Add)
+	if !ok {
+		return nil, false
+	}
+	terms := make([]Expr, len(a.terms))
+	for i, t := range a.terms {
+		r, ok := closedSum(t, k, lo, hi)
+		if !ok {
+			return nil, false
+		}
+		terms[i] = r
+	}
+	return &Add{terms: terms}, true
+}
+
+// maxFaulhaberDegree is the highest power of the index closedSum sums
+// by Faulhaber's formula.
+const maxFaulhaberDegree = 32
+
+// geometricSum returns the sum of term = c*r^(a*k + b) for k from lo to
+// hi, with c, r, a and b free of k, as c*r^b*(q^(hi+1) - q^lo)/(q - 1)
+// for q = r^a, or c*r^b*(hi - lo + 1) when q = 1. exp(u) counts as e^u.
+// With hi = Inf the sum is c*r^b*q^lo/(1 - q) and requires |q| < 1.
+func geometricSum(term Expr, k string, lo, hi Expr) (Expr, bool) {
+	factors := []Expr{term}
+	if m, ok := term.(*Mul); ok {
+		factors = m.factors
+	}
+	var coef []Expr
+	var base, exp Expr
+	for _, f := range factors {
+		if !dependsOn(f, k) {
+			coef = append(coef, f)
+			continue
+		}
+		b, x := asPow(f)
+		if fn, ok := f.(*Func); ok && fn.name == "exp" {
+			b, x = E, fn.args[0]
+		}
+		if base != nil || dependsOn(b, k) {
+			return nil, false
+		}
+		base, exp = b, x
+	}
+	if base == nil {
+		return nil, false
+	}
+	cs := PolyCoeffs(exp, k)
+	if cs == nil || Degree(exp, k) != 1 {
+		return nil, false
+	}
+	if cs[0] != nil {
+		coef = append(coef, &Pow{base: base, exp: cs[0]})
+	}
+	q := (&Pow{base: base, exp: cs[1]}).Simplify()
+	c := &Mul{factors: append(coef, N(1))}
+	if dependsOnInf(hi) {
+		v, ok := evalFloat(q, nil)
+		if !ok || math.Abs(v) >= 1 {
+			return nil, false
+		}
+		return &Mul{factors: []Expr{c, &Pow{base: q, exp: lo}, &Pow{base: sub(N(1), q), exp: N(-1)}}}, true
+	}
+	closed := &Mul{factors: []Expr{c, sub(&Pow{base: q, exp: &Add{terms: []Expr{hi, N(1)}}}, &Pow{base: q, exp: lo}), &Pow{base: sub(q, N(1)), exp: N(-1)}}}
+	count := &Mul{factors: []Expr{c, &Add{terms: []Expr{hi, neg(lo), N(1)}}}}
+	return PiecewiseOf([]PieceCase{{count, zeroCond(sub(q, N(1)))}}, closed), true
+}
+
+// powerSumPoly returns the coefficients of S_p(n) = Σ_{j=1}^{n} j^p as a
+// polynomial in n, 1/(p+1) Σ_{j=0}^{p} C(p+1, j) B⁺_j n^(p+1-j).
+func powerSumPoly(p int) []*big.Rat {
+	b := make([]*big.Rat, p+1)
+	for m := range b {
+		// B_m = -1/(m+1) Σ_{j<m} C(m+1, j) B_j, which gives B_1 = -1/2.
+		s := new(big.Rat)
+		for j := 0; j < m; j++ {
+			s.Add(s, new(big.Rat).Mul(new(big.Rat).SetInt(new(big.Int).Binomial(int64(m+1), int64(j))), b[j]))
+		}
+		b[m] = s.Quo(s, big.NewRat(-int64(m+1), 1))
+		if m == 0 {
+			b[m].SetInt64(1)
+		}
+	}
+	if p >= 1 {
+		b[1].Neg(b[1])
+	}
+	out := make([]*big.Rat, p+2)
+	for i := range out {
+		out[i] = new(big.Rat)
+	}
+	for j := 0; j <= p; j++ {
+		c := new(big.Rat).SetInt(new(big.Int).Binomial(int64(p+1), int64(j)))
+		c.Mul(c, b[j]).Quo(c, big.NewRat(int64(p+1), 1))
+		out[p+1-j].Add(out[p+1-j], c)
+	}
+	return out
+}
+
+// polyAtExpr returns the polynomial with coefficients p evaluated at x.
+func polyAtExpr(p []*big.Rat, x Expr) Expr {
+	terms := []Expr{N(0)}
+	for i, c := range p {
+		if c.Sign() != 0 {
+			terms = append(terms, &Mul{factors: []Expr{numRat(c), &Pow{base: x, exp: N(int64(i))}}})
+		}
+	}
+	return &Add{terms: terms}
+}
+
+func (p *Product) Simplify() Expr {
+	term, lo, hi := p.term.Simplify(), p.lo.Simplify(), p.hi.Simplify()
+	if ks, ok := indexRange(lo, hi, maxIndexedTerms); ok {
+		factors := make([]Expr, 0, len(ks)+1)
+		for _, k := range ks {
+			factors = append(factors, term.Sub(p.k, numRat(k)))
+		}
+		return (&Mul{factors: append(factors, N(1))}).Simplify()
+	}
+	if !dependsOnInf(lo) && !dependsOnInf(hi) && integerBounds(lo, hi) {
+		if r, ok := closedProduct(term, p.k, lo, hi); ok {
+			return r.Simplify()
+		}
+	}
+	return &Product{term: term, k: p.k, lo: lo, hi: hi}
+}
+
+// closedProduct returns the product of term for k from lo to hi in closed
+// form, factor by factor; see Sum.
+func closedProduct(term Expr, k string, lo, hi Expr) (Expr, bool) {
+	if m, ok := term.(*Mul); ok {
+		factors := make([]Expr, len(m.factors))
+		for i, f := range m.factors {
+			r, ok := closedProduct(f, k, lo, hi)
+			if !ok {
+				return nil, false
+			}
+			factors[i] = r
+		}
+		return &Mul{factors: factors}, true
+	}
+	if !dependsOn(term, k) {
+		return &Pow{base: term, exp: &Add{terms: []Expr{hi, neg(lo), N(1)}}}, true
+	}
+	base, exp := asPow(term)
+	if fn, ok := term.(*Func); ok && fn.name == "exp" {
+		base, exp = E, fn.args[0]
+	}
+	switch {
+	case !dependsOn(base, k):
+		s, ok := closedSum(exp, k, lo, hi)
+		if !ok {
+			return nil, false
+		}
+		return &Pow{base: base, exp: s}, true
+	case !isNumValue(exp, 1):
+		if n, ok := exp.(*Num); ok && n.IsInt() {
+			r, ok := closedProduct(base, k, lo, hi)
+			return &Pow{base: r, exp: exp}, ok
+		}
+		return nil, false
+	}
+	// Π_{k=lo}^{hi} (k + a) = Γ(hi + a + 1)/Γ(lo + a) when lo + a ≥ 1.
+	cs := PolyCoeffs(term, k)
+	if cs == nil || Degree(term, k) != 1 || !isNumValue(cs[1], 1) {
+		return nil, false
+	}
+	a := cs[0]
+	if a == nil {
+		a = N(0)
+	}
+	start, ok := (&Add{terms: []Expr{lo, a}}).Simplify().(*Num)
+	if !ok || !start.IsInt() || start.Sign() <= 0 {
+		return nil, false
+	}
+	return &Mul{factors: []Expr{
+		&Func{name: "gamma", args: []Expr{&Add{terms: []Expr{hi, a, N(1)}}}},
+		&Pow{base: &Func{name: "gamma", args: []Expr{start}}, exp: N(-1)},
+	}}, true
+}
+
+func (s *Sum) String() string {
+	return fmt.Sprintf("sum(%s, %s, %s, %s)", s.term, s.k, s.lo, s.hi)
+}
+
+func (p *Product) String() string {
+	return fmt.Sprintf("product(%s, %s, %s, %s)", p.term, p.k, p.lo, p.hi)
+}
+
+func (s *Sum) LaTeX() string     { return indexedLaTeX(`\sum`, s.term, s.k, s.lo, s.hi) }
+func (p *Product) LaTeX() string { return indexedLaTeX(`\prod`, p.term, p.k, p.lo, p.hi) }
+
+func indexedLaTeX(op string, term Expr, k string, lo, hi Expr) string {
+	body := term.LaTeX()
+	if _, ok := bare(term).(*Add); ok {
+		body = `\left(` + body + `\right)`
+	}
+	return fmt.Sprintf(`%s_{%s = %s}^{%s} %s`, op, S(k).LaTeX(), lo.LaTeX(), hi.LaTeX(), body)
+}
+
+func (s *Sum) Sub(varName string, value Expr) Expr     { return subBound(s, varName, value) }
+func (p *Product) Sub(varName string, value Expr) Expr { return subBound(p, varName, value) }
+
+func (s *Sum) binding() (string, Expr, []Expr)     { return s.k, s.term, []Expr{s.lo, s.hi} }
+func (p *Product) binding() (string, Expr, []Expr) { return p.k, p.term, []Expr{p.lo, p.hi} }
+
+func (s *Sum) rebind(k string, term Expr, rest []Expr) Expr {
+	return &Sum{term: term, k: k, lo: rest[0], hi: rest[1]}
+}
+
+func (p *Product) rebind(k string, term Expr, rest []Expr) Expr {
+	return &Product{term: term, k: k, lo: rest[0], hi: rest[1]}
+}
+
+// Diff differentiates term by term. The bounds are integers, so a
+// dependence of theirs on varName is ignored.
+func (s *Sum) Diff(varName string) Expr {
+	if varName == s.k || !dependsOn(s.term, varName) {
+		return N(0)
+	}
+	return &Sum{term: s.term.Diff(varName), k: s.k, lo: s.lo, hi: s.hi}
+}
+
+// Diff applies the product rule, (Π f)' = Π f * Σ f'/f, ignoring the
+// bounds as Sum.Diff does.
+func (p *Product) Diff(varName string) Expr {
+	if varName == p.k || !dependsOn(p.term, varName) {
+		return N(0)
+	}
+	return &Mul{factors: []Expr{p, &Sum{term: div(p.term.Diff(varName), p.term), k: p.k, lo: p.lo, hi: p.hi}}}
+}
+
+func (s *Sum) Eval() (*Num, bool) {
+	v, ok := evalFloat(s, nil)
+	if !ok {
+		return nil, false
+	}
+	return floatNum(v)
+}
+
+func (p *Product) Eval() (*Num, bool) {
+	v, ok := evalFloat(p, nil)
+	if !ok {
+		return nil, false
+	}
+	return floatNum(v)
+}
+
+func (s *Sum) Equal(other Expr) bool     { return equal(s, other) }
+func (p *Product) Equal(other Expr) bool { return equal(p, other) }
+func (s *Sum) exprType() string          { return "sum" }
+func (p *Product) exprType() string      { return "product" }
+
+func (s *Sum) toJSON() map[string]interface{} {
+	return indexedJSON("sum", s.term, s.k, s.lo, s.hi)
+}
+
+func (p *Product) toJSON() map[string]interface{} {
+	return indexedJSON("product", p.term, p.k, p.lo, p.hi)
+}
+
+func indexedJSON(typ string, term Expr, k string, lo, hi Expr) map[string]interface{} {
+	return map[string]interface{}{"type": typ, "index": k, "term": term.toJSON(), "lo": lo.toJSON(), "hi": hi.toJSON()}
+}
+
+// evalIndexed evaluates the sum, or with prod the product, of term for k
+// over the range from lo to hi, which must evaluate to integers at most
+// maxEvalTerms apart.
+func evalIndexed(term Expr, k string, lo, hi Expr, prod bool, env map[string]float64) (float64, bool) {
+	a, ok1 := evalFloat(lo, env)
+	b, ok2 := evalFloat(hi, env)
+	if !ok1 || !ok2 || a != math.Trunc(a) || b != math.Trunc(b) || b-a >= maxEvalTerms {
+		return 0, false
+	}
+	inner := make(map[string]float64, len(env)+1)
+	for name, v := range env {
+		inner[name] = v
+	}
+	acc := 0.0
+	if prod {
+		acc = 1
+	}
+	f := term.Simplify()
+	for i := a; i <= b; i++ {
+		inner[k] = i
+		v, ok := evalFloat(f, inner)
+		if !ok {
+			return 0, false
+		}
+		if prod {
+			acc *= v
+		} else {
+			acc += v
+		}
+	}
+	return acc, true
+}
+
+// ============================================================
+// Lambda — anonymous functions
+// ============================================================
+
+// Lambda is the function v ↦ body of one variable. v is bound in body, as
+// described for binder, so Lambda(x, x*y) with y = x substituted becomes
+// Lambda(x_1, x*x_1). Call applies it; a function of several variables is
+// a Lambda whose body is a Lambda.
+type Lambda struct {
+	v    string
+	body Expr
+}
+
+// LambdaOf returns the function v ↦ body.
+func LambdaOf(v string, body Expr) Expr { return &Lambda{v: v, body: body} }
+
+// Var returns the name of the variable.
+func (l *Lambda) Var() string { return l.v }
+
+// Body returns the body.
+func (l *Lambda) Body() Expr { return l.body }
+
+// Call returns the body with arg substituted for the variable, unsimplified:
+// Lambda(x, x^2) called on y + 1 is (y + 1)^2.
+func (l *Lambda) Call(arg Expr) Expr { return l.body.Sub(l.v, arg) }
+
+func (l *Lambda) Simplify() Expr { return &Lambda{v: l.v, body: l.body.Simplify()} }
+
+func (l *Lambda) String() string { return fmt.Sprintf("Lambda(%s, %s)", l.v, l.body) }
+
+func (l *Lambda) LaTeX() string {
+	return `\left(` + S(l.v).LaTeX() + ` \mapsto ` + l.body.LaTeX() + `\right)`
+}
+
+func (l *Lambda) Sub(varName string, value Expr) Expr { return subBound(l, varName, value) }
+
+func (l *Lambda) binding() (string, Expr, []Expr) { return l.v, l.body, nil }
+
+func (l *Lambda) rebind(v string, body Expr, _ []Expr) Expr { return &Lambda{v: v, body: body} }
+
+// Diff differentiates the body with respect to a symbol other than the
+// variable, giving the function v ↦ ∂body/∂varName.
+func (l *Lambda) Diff(varName string) Expr {
+	if varName == l.v || !dependsOn(l.body, varName) {
+		return N(0)
+	}
+	return &Lambda{v: l.v, body: l.body.Diff(varName)}
+}
+
+// Eval reports false: a function is not a number.
+func (l *Lambda) Eval() (*Num, bool) { return nil, false }
+
+func (l *Lambda) Equal(other Expr) bool { return equal(l, other) }
+func (l *Lambda) exprType() string      { return "lambda" }
+func (l *Lambda) toJSON() map[string]interface{} {
+	return map[string]interface{}{"type": "lambda", "var": l.v, "body": l.body.toJSON()}
+}
+
+// ============================================================
+// Piecewise — conditional expression
+// ============================================================
+
+// RelOp is the comparison operator of a Cond.
+type RelOp int
+
+const (
+	RelEq RelOp = iota // =
+	RelNe              // !=
+	RelLt              // <
+	RelLe              // <=
+	RelGt              // >
+	RelGe              // >=
+)
+
+var (
+	relOpNames  = [...]string{"=", "!=", "<", "<=", ">", ">="}
+	relOpLaTeX  = [...]string{"=", `\neq`, "<", `\leq`, ">", `\geq`}
+	relOpMathML = [...]string{"=", "≠", "<", "≤", ">", "≥"}
+)
+
+func (op RelOp) String() string { return relOpNames[op] }
+
+// relOpNamed returns the operator whose String is name.
+func relOpNamed(name interface{}) (RelOp, bool) {
+	for k, s := range relOpNames {
+		if name == s {
+			return RelOp(k), true
+		}
+	}
+	return 0, false
+}
+
+// holds reports whether a - b compares to 0 as op requires, given the sign
+// of a - b.
+func (op RelOp) holds(sign int) bool {
+	switch op {
+	case RelEq:
+		return sign == 0
+	case RelNe:
+		return sign != 0
+	case RelLt:
+		return sign < 0
+	case RelLe:
+		return sign <= 0
+	case RelGt:
+		return sign > 0
+	}
+	return sign >= 0
+}
+
+// Cond is the condition Lhs Op Rhs between real values, such as the
+// condition n = -1 of a Piecewise case.
+type Cond struct {
+	Lhs Expr
+	Op  RelOp
+	Rhs Expr
+}
+
+// String returns e.g. "n = -1", or the chain for the Cond of a chain.
+func (c Cond) String() string {
+	if r, ok := c.chain(); ok {
+		return r.String()
+	}
+	return c.Lhs.String() + " " + c.Op.String() + " " + c.Rhs.String()
+}
+
+// LaTeX returns e.g. "n \neq -1".
+func (c Cond) LaTeX() string {
+	if r, ok := c.chain(); ok {
+		return r.LaTeX()
+	}
+	return c.Lhs.LaTeX() + " " + relOpLaTeX[c.Op] + " " + c.Rhs.LaTeX()
+}
+
+// Simplify simplifies both sides.
+// The Cond of a chain stays one while its simplified chain keeps two or
+// more links.
+func (c Cond) Simplify() Cond {
+	if _, ok := c.chain(); ok {
+		if r, ok := c.Lhs.Simplify().(*Relational); ok {
+			return r.Cond()
+		}
+	}
+	return Cond{c.Lhs.Simplify(), c.Op, c.Rhs.Simplify()}
+}
+
+// Sub substitutes value for varName on both sides.
+func (c Cond) Sub(varName string, value Expr) Cond {
+	return Cond{c.Lhs.Sub(varName, value), c.Op, c.Rhs.Sub(varName, value)}
+}
+
+// Decide reports whether c holds when that does not depend on any symbol:
+// Lhs - Rhs must simplify to a number, or evaluate to a nonzero value
+// such as pi - 3. known is false otherwise.
+func (c Cond) Decide() (holds, known bool) {
+	d := sub(c.Lhs, c.Rhs).Simplify()
+	if n, ok := d.(*Num); ok {
+		return c.Op.holds(n.Sign()), true
+	}
+	if len(FreeSymbols(d)) == 0 {
+		if v, ok := evalFloat(d, nil); ok && v != 0 && !math.IsNaN(v) {
+			return c.Op.holds(int(signum(v))), true
+		}
+	}
+	return false, false
+}
+
+// Holds evaluates c numerically with the given bindings. ok is false when
+// a side cannot be evaluated.
+func (c Cond) Holds(env map[string]float64) (holds, ok bool) {
+	l, ok1 := evalFloat(c.Lhs, env)
+	r, ok2 := evalFloat(c.Rhs, env)
+	if !ok1 || !ok2 || math.IsNaN(l) || math.IsNaN(r) {
+		return false, false
+	}
+	return c.Op.holds(int(signum(l - r))), true
+}
+
+// zeroCond returns the condition d = 0, written as s = r when d is linear
+// in its only symbol s, so that Piecewise.Simplify can substitute it.
+func zeroCond(d Expr) Cond {
+	d = d.Simplify()
+	if syms := FreeSymbols(d); len(syms) == 1 {
+		if cs := PolyCoeffs(d, syms[0]); cs != nil && Degree(d, syms[0]) == 1 {
+			c0 := cs[0]
+			if c0 == nil {
+				c0 = N(0)
+			}
+			return Cond{S(syms[0]), RelEq, neg(div(c0, cs[1])).Simplify()}
+		}
+	}
+	return Cond{d, RelEq, N(0)}
+}
+
+// positiveCond returns the condition d > 0, written as s > r or s < r
+// when d is linear in its only symbol s.
+func positiveCond(d Expr) Cond {
+	d = d.Simplify()
+	if syms := FreeSymbols(d); len(syms) == 1 {
+		if cs := PolyCoeffs(d, syms[0]); cs != nil && Degree(d, syms[0]) == 1 {
+			if k, ok := cs[1].(*Num); ok {
+				c0 := cs[0]
+				if c0 == nil {
+					c0 = N(0)
+				}
+				op := RelGt
+				if k.Sign() < 0 {
+					op = RelLt
+				}
+				return Cond{S(syms[0]), op, neg(div(c0, k)).Simplify()}
+			}
+		}
+	}
+	return Cond{d, RelGt, N(0)}
+}
+
+// PieceCase is one case of a Piecewise: Value where Cond holds.
+type PieceCase struct {
+	Value Expr
+	Cond  Cond
+}
+
+// Piecewise is a conditional expression: its value is that of the first
+// case whose condition holds, or the fallback when none does. Integrate
+// and the solvers use it for results that depend on a parameter, such as
+// ∫ x^n dx, which is ln|x| when n = -1.
+//
+// Simplify drops cases whose condition is decidably false or repeats an
+// earlier one, stops at the first decidably true one, and substitutes a condition of the form
+// s = r into its case's value. Diff differentiates every case, which is
+// valid away from the boundaries between them.
+type Piecewise struct {
+	cases     []PieceCase
+	otherwise Expr
+}
+
+// PiecewiseOf returns the Piecewise expression that tries cases in order
+// and falls back to otherwise.
+func PiecewiseOf(cases []PieceCase, otherwise Expr) Expr {
+	return &Piecewise{cases: append([]PieceCase(nil), cases...), otherwise: otherwise}
+}
+
+// Cases returns a copy of the cases.
+func (p *Piecewise) Cases() []PieceCase { return append([]PieceCase(nil), p.cases...) }
+
+// Otherwise returns the fallback value.
+func (p *Piecewise) Otherwise() Expr { return p.otherwise }
+
+// mapParts applies f to every value and condition side.
+func (p *Piecewise) mapParts(f func(Expr) Expr) *Piecewise {
+	cases := make([]PieceCase, len(p.cases))
+	for i, c := range p.cases {
+		cases[i] = PieceCase{f(c.Value), Cond{f(c.Cond.Lhs), c.Cond.Op, f(c.Cond.Rhs)}}
+	}
+	return &Piecewise{cases: cases, otherwise: f(p.otherwise)}
+}
+
+func (p *Piecewise) Simplify() Expr {
+	var cases []PieceCase
+	var otherwise Expr
+	seen := map[string]bool{}
+	for _, c := range p.cases {
+		cond := c.Cond.Simplify()
+		holds, known := cond.Decide()
+		if known && !holds || seen[cond.String()] {
+			continue
+		}
+		seen[cond.String()] = true
+		v := c.Value
+		if s, ok := cond.Lhs.(*Sym); ok && cond.Op == RelEq && !dependsOn(cond.Rhs, s.name) {
+			v = v.Sub(s.name, cond.Rhs)
+		}
+		if v = v.Simplify(); known {
+			otherwise = v
+			break
+		}
+		cases = append(cases, PieceCase{v, cond})
+	}
+	if otherwise == nil {
+		otherwise = p.otherwise.Simplify()
+		if q, ok := otherwise.(*Piecewise); ok {
+			cases, otherwise = append(cases, q.cases...), q.otherwise
+		}
+	}
+	for len(cases) > 0 && cases[len(cases)-1].Value.String() == otherwise.String() {
+		cases = cases[:len(cases)-1]
+	}
+	if len(cases) == 0 {
+		return otherwise
+	}
+	return &Piecewise{cases: cases, otherwise: otherwise}
+}
+
+// String returns e.g. "piecewise((ln(x), n = -1), (x^n, otherwise))",
+// which Parse reads back.
+func (p *Piecewise) String() string {
+	parts := make([]string, 0, len(p.cases)+1)
+	for _, c := range p.cases {
+		parts = append(parts, "("+c.Value.String()+", "+c.Cond.String()+")")
+	}
+	parts = append(parts, "("+p.otherwise.String()+", otherwise)")
+	return "piecewise(" + strings.Join(parts, ", ") + ")"
+}
+
+func (p *Piecewise) LaTeX() string {
+	rows := make([]string, 0, len(p.cases)+1)
+	for _, c := range p.cases {
+		rows = append(rows, c.Value.LaTeX()+` & \text{if } `+c.Cond.LaTeX())
+	}
+	rows = append(rows, p.otherwise.LaTeX()+` & \text{otherwise}`)
+	return `\begin{cases} ` + strings.Join(rows, ` \\ `) + ` \end{cases}`
+}
+
+func (p *Piecewise) Sub(varName string, value Expr) Expr {
+	return p.mapParts(func(e Expr) Expr { return e.Sub(varName, value) })
+}
+
+func (p *Piecewise) Diff(varName string) Expr {
+	cases := make([]PieceCase, len(p.cases))
+	for i, c := range p.cases {
+		cases[i] = PieceCase{c.Value.Diff(varName), c.Cond}
+	}
+	return &Piecewise{cases: cases, otherwise: p.otherwise.Diff(varName)}
+}
+
+func (p *Piecewise) Eval() (*Num, bool) {
+	v, ok := evalFloat(p, nil)
+	if !ok {
+		return nil, false
+	}
+	return floatNum(v)
+}
+
+func (p *Piecewise) Equal(other Expr) bool { return equal(p, other) }
+func (p *Piecewise) exprType() string      { return "piecewise" }
+func (p *Piecewise) toJSON() map[string]interface{} {
+	cases := make([]interface{}, len(p.cases))
+	for i, c := range p.cases {
+		cases[i] = map[string]interface{}{
+			"value": c.Value.toJSON(), "lhs": c.Cond.Lhs.toJSON(), "op": c.Cond.Op.String(), "rhs": c.Cond.Rhs.toJSON(),
+		}
+	}
+	return map[string]interface{}{"type": "piecewise", "cases": cases, "otherwise": p.otherwise.toJSON()}
+}
+
+// ============================================================
+// KroneckerDelta — index equality
+// ============================================================
+
+// Delta is the Kronecker delta δ(i, j): 1 when the indices are equal and 0
+// otherwise. It is symmetric, so Simplify orders the indices, and it
+// decides equality whenever i - j expands to a number. ContractDelta
+// sums a product containing it over one of its indices.
+type Delta struct {
+	i, j Expr
+}
+
+// KroneckerDelta returns δ(i, j).
+func KroneckerDelta(i, j Expr) Expr { return &Delta{i: i, j: j} }
+
+// Indices returns the two indices.
+func (d *Delta) Indices() (Expr, Expr) { return d.i, d.j }
+
+func (d *Delta) Simplify() Expr {
+	i, j := d.i.Simplify(), d.j.Simplify()
+	if n, ok := Expand(sub(i, j)).(*Num); ok {
+		if n.IsZero() {
+			return N(1)
+		}
+		return N(0)
+	}
+	if i.String() > j.String() {
+		i, j = j, i
+	}
+	return &Delta{i: i, j: j}
+}
+
+func (d *Delta) String() string { return "KroneckerDelta(" + d.i.String() + ", " + d.j.String() + ")" }
+func (d *Delta) LaTeX() string  { return `\delta_{` + d.i.LaTeX() + "," + d.j.LaTeX() + "}" }
+
+func (d *Delta) Sub(varName string, value Expr) Expr {
+	return &Delta{i: d.i.Sub(varName, value), j: d.j.Sub(varName, value)}
+}
+
+// Diff is zero: δ is constant wherever it is differentiable.
+func (d *Delta) Diff(varName string) Expr { return N(0) }
+
+func (d *Delta) Eval() (*Num, bool) {
+	v, ok := evalFloat(d, nil)
+	if !ok {
+		return nil, false
+	}
+	return floatNum(v)
+}
+
+func (d *Delta) Equal(other Expr) bool { return equal(d, other) }
+func (d *Delta) exprType() string      { return "delta" }
+func (d *Delta) toJSON() map[string]interface{} {
+	return map[string]interface{}{"type": "delta", "i": d.i.toJSON(), "j": d.j.toJSON()}
+}
+
+// ContractDelta evaluates the sum of e over all values of index, where
+// every term of e is a product with a factor δ(index, k) or δ(k, index)
+// and k does not involve index: the delta is removed and index replaced
+// by k, so Σ_j δ(i, j)*a(j) = a(i) and Σ_j δ(i, j)*δ(j, k) = δ(i, k). It
+// reports false when a term has no such factor, since the sum then
+// depends on the range of index.
+func ContractDelta(e Expr, index string) (Expr, bool) {
+	e = e.Simplify()
+	var out []Expr
+	for _, t := range addTerms(e) {
+		factors := []Expr{t}
+		if m, ok := t.(*Mul); ok {
+			factors = m.factors
+		}
+		done := false
+		for k, f := range factors {
+			d, ok := f.(*Delta)
+			if !ok {
+				continue
+			}
+			other := d.j
+			if !isSym(d.i, index) {
+				other = d.i
+				if !isSym(d.j, index) {
+					continue
+				}
+			}
+			if dependsOn(other, index) {
+				continue
+			}
+			rest := append(append([]Expr{N(1)}, factors[:k]...), factors[k+1:]...)
+			out = append(out, (&Mul{factors: rest}).Sub(index, other))
+			done = true
+			break
+		}
+		if !done {
+			return nil, false
+		}
+	}
+	return (&Add{terms: append(out, N(0))}).Simplify(), true
+}
+
+// ============================================================
+// Relational — comparison as an expression
+// ============================================================
+
+// Relational is the comparison lhs op rhs as an expression node, for
+// solvers, assumptions and Piecewise conditions that pass relations
+// around as values. Its value is 1 where the comparison holds and 0 where
+// it does not, so Eval gives its truth value and a product with it
+// switches a term on and off. Simplify folds it to 1 or 0 when Cond.Decide
+// settles it. Cond and Cond.Relation convert to and from the Cond of a
+// Piecewise case.
+//
+// A Relational may also be a chain such as 0 < x <= 1, built by Chain or
+// parsed as written, which holds when each of its links, 0 < x and
+// x <= 1, does.
+type Relational struct {
+	sides []Expr  // at least two
+	ops   []RelOp // ops[i] compares sides[i] with sides[i+1]
+}
+
+// Rel returns the relation lhs op rhs.
+func Rel(lhs Expr, op RelOp, rhs Expr) Expr {
+	return &Relational{sides: []Expr{lhs, rhs}, ops: []RelOp{op}}
+}
+
+// Chain returns the chained comparison sides[0] ops[0] sides[1] ops[1] …,
+// e.g. Chain([]Expr{N(0), x, N(1)}, RelLt, RelLt) is 0 < x < 1. It panics
+// unless there is one operator fewer than sides, and at least one.
+func Chain(sides []Expr, ops ...RelOp) Expr {
+	if len(ops) == 0 || len(sides) != len(ops)+1 {
+		panic(fmt.Sprintf("gosymbol: Chain of %d sides needs %d operators, got %d", len(sides), len(sides)-1, len(ops)))
+	}
+	return &Relational{sides: append([]Expr(nil), sides...), ops: append([]RelOp(nil), ops...)}
+}
+
+// Lt returns the relation lhs < rhs.
+func Lt(lhs, rhs Expr) Expr { return Rel(lhs, RelLt, rhs) }
+
+// Le returns the relation lhs <= rhs.
+func Le(lhs, rhs Expr) Expr { return Rel(lhs, RelLe, rhs) }
+
+// Gt returns the relation lhs > rhs.
+func Gt(lhs, rhs Expr) Expr { return Rel(lhs, RelGt, rhs) }
+
+// Ge returns the relation lhs >= rhs.
+func Ge(lhs, rhs Expr) Expr { return Rel(lhs, RelGe, rhs) }
+
+// Ne returns the relation lhs != rhs.
+func Ne(lhs, rhs Expr) Expr { return Rel(lhs, RelNe, rhs) }
+
+// Relation returns c as a Relational expression; the condition Cond
+// returns for a chain gives back the chain.
+func (c Cond) Relation() Expr {
+	if r, ok := c.chain(); ok {
+		return r
+	}
+	return Rel(c.Lhs, c.Op, c.Rhs)
+}
+
+// chain returns the chain c stands for when it has the form chain != 0.
+func (c Cond) chain() (*Relational, bool) {
+	r, ok := c.Lhs.(*Relational)
+	if !ok || len(r.ops) < 2 || c.Op != RelNe || !isNumValue(c.Rhs, 0) {
+		return nil, false
+	}
+	return r, true
+}
+
+// Lhs returns the left-hand side, the first side of a chain.
+func (r *Relational) Lhs() Expr { return r.sides[0] }
+
+// Op returns the comparison operator, the first of a chain.
+func (r *Relational) Op() RelOp { return r.ops[0] }
+
+// Rhs returns the right-hand side, the last side of a chain.
+func (r *Relational) Rhs() Expr { return r.sides[len(r.sides)-1] }
+
+// Links returns the comparisons of r, one for a plain relation and one
+// per operator of a chain.
+func (r *Relational) Links() []Cond {
+	out := make([]Cond, len(r.ops))
+	for i, op := range r.ops {
+		out[i] = Cond{r.sides[i], op, r.sides[i+1]}
+	}
+	return out
+}
+
+// Cond returns r as the condition of a Piecewise case. A chain becomes
+// the condition that its value, 1 or 0, is nonzero, which Cond.String
+// prints as the chain.
+func (r *Relational) Cond() Cond {
+	if len(r.ops) > 1 {
+		return Cond{r, RelNe, N(0)}
+	}
+	return Cond{r.sides[0], r.ops[0], r.sides[1]}
+}
+
+// Decide reports whether r holds when that does not depend on any
+// symbol, as Cond.Decide. A chain is known to fail as soon as one link
+// is.
+func (r *Relational) Decide() (holds, known bool) {
+	known = true
+	for _, c := range r.Links() {
+		h, k := c.Decide()
+		if k && !h {
+			return false, true
+		}
+		known = known && k
+	}
+	return known, known
+}
+
+// Holds evaluates r numerically with the given bindings, as Cond.Holds.
+func (r *Relational) Holds(env map[string]float64) (holds, ok bool) {
+	holds = true
+	for _, c := range r.Links() {
+		h, ok := c.Holds(env)
+		if !ok {
+			return false, false
+		}
+		holds = holds && h
+	}
+	return holds, true
+}
+
+// Simplify simplifies the sides and folds r to 0 when a link fails and
+// to 1 when all hold. Links that hold at either end of a chain are
+// dropped, so 0 < 1 < x becomes 1 < x.
+func (r *Relational) Simplify() Expr {
+	sides := make([]Expr, len(r.sides))
+	for i, s := range r.sides {
+		sides[i] = s.Simplify()
+	}
+	holds := make([]bool, len(r.ops))
+	for i, op := range r.ops {
+		h, k := Cond{sides[i], op, sides[i+1]}.Decide()
+		if k && !h {
+			return N(0)
+		}
+		holds[i] = k
+	}
+	lo, hi := 0, len(r.ops)
+	for lo < hi && holds[lo] {
+		lo++
+	}
+	for hi > lo && holds[hi-1] {
+		hi--
+	}
+	if lo == hi {
+		return N(1)
+	}
+	return &Relational{sides: sides[lo : hi+1], ops: append([]RelOp(nil), r.ops[lo:hi]...)}
+}
+
+// String returns e.g. "x < 1" or "0 < x <= 1", which Parse reads back.
+func (r *Relational) String() string {
+	var sb strings.Builder
+	for i, s := range r.sides {
+		if i > 0 {
+			sb.WriteString(" " + r.ops[i-1].String() + " ")
+		}
+		if _, ok := bare(s).(*Relational); ok {
+			sb.WriteString("(" + s.String() + ")")
+		} else {
+			sb.WriteString(s.String())
+		}
+	}
+	return sb.String()
+}
+
+func (r *Relational) LaTeX() string {
+	var sb strings.Builder
+	for i, s := range r.sides {
+		if i > 0 {
+			sb.WriteString(" " + relOpLaTeX[r.ops[i-1]] + " ")
+		}
+		if _, ok := bare(s).(*Relational); ok {
+			sb.WriteString(`\left(` + s.LaTeX() + `\right)`)
+		} else {
+			sb.WriteString(s.LaTeX())
+		}
+	}
+	return sb.String()
+}
+
+// mapSides applies f to every side.
+func (r *Relational) mapSides(f func(Expr) Expr) *Relational {
+	sides := make([]Expr, len(r.sides))
+	for i, s := range r.sides {
+		sides[i] = f(s)
+	}
+	return &Relational{sides: sides, ops: r.ops}
+}
+
+func (r *Relational) Sub(varName string, value Expr) Expr {
+	return r.mapSides(func(e Expr) Expr { return e.Sub(varName, value) })
+}
+
+// Diff is zero: a relation is constant wherever it is differentiable.
+func (r *Relational) Diff(varName string) Expr { return N(0) }
+
+func (r *Relational) Eval() (*Num, bool) {
+	v, ok := evalFloat(r, nil)
+	if !ok {
+		return nil, false
+	}
+	return floatNum(v)
+}
+
+func (r *Relational) Equal(other Expr) bool { return equal(r, other) }
+func (r *Relational) exprType() string      { return "relational" }
+func (r *Relational) toJSON() map[string]interface{} {
+	if len(r.ops) == 1 {
+		return map[string]interface{}{"type": "relational", "lhs": r.sides[0].toJSON(), "op": r.ops[0].String(), "rhs": r.sides[1].toJSON()}
+	}
+	sides := make([]interface{}, len(r.sides))
+	for i, s := range r.sides {
+		sides[i] = s.toJSON()
+	}
+	ops := make([]interface{}, len(r.ops))
+	for i, op := range r.ops {
+		ops[i] = op.String()
+	}
+	return map[string]interface{}{"type": "relational", "sides": sides, "ops": ops}
+}
+
+// ============================================================
+// Wild — pattern placeholder
+// ============================================================
+
+// WildSym is a placeholder in a pattern for Match: it matches any
+// subexpression that contains none of its excluded symbols. It is not a
+// symbol of the expression, so FreeSymbols and Sub ignore it, Diff treats
+// it as a constant and it cannot be evaluated.
+type WildSym struct {
+	name    string
+	exclude []string
+}
+
+// Wild returns the placeholder named name, matching subexpressions that do
+// not depend on any of the symbols in exclude, e.g. Wild("a", "x") matches
+// only coefficients free of x.
+func Wild(name string, exclude ...string) Expr {
+	return &WildSym{name: name, exclude: append([]string(nil), exclude...)}
+}
+
+// Name returns the placeholder's name, the key of its binding in Match.
+func (w *WildSym) Name() string { return w.name }
+
+// Exclude returns the symbols a match may not contain.
+func (w *WildSym) Exclude() []string { return append([]string(nil), w.exclude...) }
+
+func (w *WildSym) Simplify() Expr { return w }
+
+// String returns "Wild(a)", or "Wild(a, x, y)" with excluded symbols,
+// which Parse reads back.
+func (w *WildSym) String() string {
+	return "Wild(" + strings.Join(append([]string{w.name}, w.exclude...), ", ") + ")"
+}
+
+func (w *WildSym) LaTeX() string                       { return (&Sym{name: w.name}).LaTeX() + "_{*}" }
+func (w *WildSym) Sub(varName string, value Expr) Expr { return w }
+func (w *WildSym) Diff(varName string) Expr            { return N(0) }
+func (w *WildSym) Eval() (*Num, bool)                  { return nil, false }
+func (w *WildSym) Equal(other Expr) bool               { return equal(w, other) }
+func (w *WildSym) exprType() string                    { return "wild" }
+func (w *WildSym) toJSON() map[string]interface{} {
+	m := map[string]interface{}{"type": "wild", "name": w.name}
+	if len(w.exclude) > 0 {
+		ex := make([]interface{}, len(w.exclude))
+		for i, s := range w.exclude {
+			ex[i] = s
+		}
+		m["exclude"] = ex
+	}
+	return m
+}
+
+// Match reports whether e has the shape of pattern and returns the
+// subexpression bound to each Wild. A Wild occurring twice must match
+// equal subexpressions. Sums and products match regardless of the order of
+// their terms or factors, and the last Wild among them absorbs the
+// leftovers, or 0 or 1 when there are none, so MulOf(Wild("a"),
+// SinOf(Wild("b"))) matches 2*x*sin(y) with a = 2*x and also sin(y) with
+// a = 1. A power pattern u^n matches a non-power with n = 1. Annotations
+// on e are ignored. Neither argument is simplified, so pass both in
+// canonical form.
+func Match(e, pattern Expr) (map[string]Expr, bool) {
+	var out map[string]Expr
+	ok := matchExpr(e, pattern, nil, func(b map[string]Expr) bool {
+		out = b
+		return true
+	})
+	if !ok {
+		return nil, false
+	}
+	if out == nil {
+		out = map[string]Expr{}
+	}
+	return out, true
+}
+
+// matchExpr matches e against p extending the bindings b, and on success
+// calls k with the extended bindings; it reports whether k accepted one of
+// the ways e matches. b is never modified.
+func matchExpr(e, p Expr, b map[string]Expr, k func(map[string]Expr) bool) bool {
+	e = bare(e)
+	switch pt := p.(type) {
+	case *WildSym:
+		if prev, ok := b[pt.name]; ok {
+			return prev.String() == e.String() && k(b)
+		}
+		for _, s := range pt.exclude {
+			if dependsOn(e, s) {
+				return false
+			}
+		}
+		nb := make(map[string]Expr, len(b)+1)
+		for name, v := range b {
+			nb[name] = v
+		}
+		nb[pt.name] = e
+		return k(nb)
+	case *Add:
+		return matchList(addTerms(e), pt.terms, b, func(es []Expr) Expr { return (&Add{terms: append(es, N(0))}).Simplify() }, k)
+	case *Mul:
+		factors := []Expr{e}
+		if m, ok := e.(*Mul); ok {
+			factors = m.factors
+		}
+		return matchList(factors, pt.factors, b, func(es []Expr) Expr { return (&Mul{factors: append(es, N(1))}).Simplify() }, k)
+	case *Pow:
+		base, exp := e, Expr(N(1))
+		if ep, ok := e.(*Pow); ok {
+			base, exp = ep.base, ep.exp
+		}
+		return matchExpr(base, pt.base, b, func(b map[string]Expr) bool { return matchExpr(exp, pt.exp, b, k) })
+	case *Func:
+		// Arguments match one by one below.
+		if f, ok := e.(*Func); !ok || f.name != pt.name || len(f.args) != len(pt.args) {
+			return false
+		}
+	}
+	if !hasWild(p) {
+		return e.String() == p.String() && k(b)
+	}
+	// Other nodes match child by child when everything but the children
+	// agrees, which the printed forms with placeholder children show.
+	pl, pcs := labeledChildren(p)
+	el, ecs := labeledChildren(e)
+	if e.exprType() != p.exprType() || strings.Join(pl, ",") != strings.Join(el, ",") {
+		return false
+	}
+	holes := make([]Expr, len(pcs))
+	for i := range holes {
+		holes[i] = S(ParseHole)
+	}
+	if withChildren(e, holes).String() != withChildren(p, holes).String() {
+		return false
+	}
+	var step func(i int, b map[string]Expr) bool
+	step = func(i int, b map[string]Expr) bool {
+		if i == len(pcs) {
+			return k(b)
+		}
+		return matchExpr(ecs[i], pcs[i], b, func(b map[string]Expr) bool { return step(i+1, b) })
+	}
+	return step(0, b)
+}
+
+// matchList matches the terms or factors es against the patterns ps in
+// any order. The last Wild in ps, if any, matches combine of the elements
+// the other patterns leave over.
+func matchList(es, ps []Expr, b map[string]Expr, combine func([]Expr) Expr, k func(map[string]Expr) bool) bool {
+	absorb := -1
+	for i, p := range ps {
+		if _, ok := p.(*WildSym); ok {
+			absorb = i
+		}
+	}
+	var fixed []Expr
+	for i, p := range ps {
+		if i != absorb {
+			fixed = append(fixed, p)
+		}
+	}
+	used := make([]bool, len(es))
+	var step func(i int, b map[string]Expr) bool
+	step = func(i int, b map[string]Expr) bool {
+		if i == len(fixed) {
+			var rest []Expr
+			for j, e := range es {
+				if !used[j] {
+					rest = append(rest, e)
+				}
+			}
+			if absorb < 0 {
+				return len(rest) == 0 && k(b)
+			}
+			return matchExpr(combine(rest), ps[absorb], b, k)
+		}
+		for j, e := range es {
+			if used[j] {
+				continue
+			}
+			used[j] = true
+			if matchExpr(e, fixed[i], b, func(b map[string]Expr) bool { return step(i+1, b) }) {
+				return true
+			}
+			used[j] = false
+		}
+		return false
+	}
+	return step(0, b)
+}
+
+// hasWild reports whether e contains a Wild.
+func hasWild(e Expr) bool {
+	found := false
+	Walk(e, func(n Expr) bool {
+		_, ok := n.(*WildSym)
+		found = found || ok
+		return !found
+	})
+	return found
+}
+
+// RewriteRule rewrites subexpressions matching Pattern, in the sense of
+// Match, to Replacement with each Wild replaced by its binding. Every Wild
+// in Replacement must occur in Pattern; the others are left in place. A
+// sum pattern must account for all terms of the sum it matches, so rules
+// meant for part of a sum end in a Wild for the rest:
+//
+//	RewriteRule{
+//		Pattern:     AddOf(PowOf(SinOf(u), N(2)), PowOf(CosOf(u), N(2)), r),
+//		Replacement: AddOf(N(1), r),
+//	}
+type RewriteRule struct {
+	Pattern, Replacement Expr
+}
+
+// ApplyRules simplifies expr and rewrites it with rules until nothing
+// changes or maxIters passes have run, at least one. Each pass works
+// bottom-up: the children of a node are rewritten first, then the first
+// rule whose pattern matches the node and whose result differs from it
+// replaces the node, which is simplified. The cap stops rule sets that
+// never settle, such as x → x + 1.
+func ApplyRules(expr Expr, rules []RewriteRule, maxIters int) Expr {
+	rs := make([]RewriteRule, len(rules))
+	for i, r := range rules {
+		rs[i] = RewriteRule{r.Pattern.Simplify(), r.Replacement}
+	}
+	e := expr.Simplify()
+	for i := 0; i < max(maxIters, 1); i++ {
+		next, changed := rewritePass(e, rs)
+		if !changed {
+			break
+		}
+		e = next
+	}
+	return e
+}
+
+// rewritePass applies one bottom-up pass of rules to e and reports whether
+// it changed anything.
+func rewritePass(e Expr, rules []RewriteRule) (Expr, bool) {
+	_, cs := labeledChildren(e)
+	changed := false
+	if len(cs) > 0 {
+		ncs := make([]Expr, len(cs))
+		for i, c := range cs {
+			var ok bool
+			ncs[i], ok = rewritePass(c, rules)
+			changed = changed || ok
+		}
+		if changed {
+			e = withChildren(e, ncs).Simplify()
+		}
+	}
+	for _, r := range rules {
+		b, ok := Match(e, r.Pattern)
+		if !ok {
+			continue
+		}
+		if out := fillWilds(r.Replacement, b).Simplify(); out.String() != e.String() {
+			return out, true
+		}
+	}
+	return e, changed
+}
+
+// fillWilds replaces each Wild in e that has a binding in b.
+func fillWilds(e Expr, b map[string]Expr) Expr {
+	if w, ok := e.(*WildSym); ok {
+		if v, ok := b[w.name]; ok {
+			return v
+		}
+		return w
+	}
+	_, cs := labeledChildren(e)
+	if len(cs) == 0 {
+		return e
+	}
+	ncs := make([]Expr, len(cs))
+	for i, c := range cs {
+		ncs[i] = fillWilds(c, b)
+	}
+	return withChildren(e, ncs)
+}
+
+// ============================================================
+// Annotated — expression with metadata
+// ============================================================
+
+// Meta is metadata carried by an Annotated expression.
+type Meta struct {
+	Label  string `json:"label,omitempty"`  // name of the quantity, e.g. "kinetic energy"
+	Source string `json:"source,omitempty"` // source position, e.g. "model.txt:12:5"
+	Unit   string `json:"unit,omitempty"`   // unit tag, e.g. "J"; not checked
+	// Provenance lists the transformations that produced the expression,
+	// oldest first, e.g. "Diff x" or "result of Diff step 3".
+	Provenance []string `json:"provenance,omitempty"`
+}
+
+// Annotated wraps an expression with Meta. It prints, evaluates and
+// compares like the wrapped expression. The metadata propagates as
+// follows:
+//
+//   - Simplify, Sub and Expand transform the wrapped expression and keep
+//     the metadata. Expand does not distribute across the annotation.
+//   - Diff keeps Source and appends "Diff v" to Provenance, but drops Label
+//     and Unit: they describe the original quantity, not its derivative.
+//   - Inside sums and products an Annotated subtree is a unit that is not
+//     split up; like terms and equal bases still combine by printed form,
+//     keeping the first occurrence. An annotated number folds into the
+//     numeric coefficient and its metadata is dropped.
+//   - Integrate and the polynomial routines (PolyCoeffs, Degree and the
+//     solvers built on them) see through annotations and return plain
+//     expressions.
+type Annotated struct {
+	expr Expr
+	meta Meta
+}
+
+// Annotate attaches m to e. Annotating an Annotated expression merges the
+// metadata: the non-empty fields of m replace the old ones and m's
+// provenance is appended.
+func Annotate(e Expr, m Meta) Expr {
+	if a, ok := e.(*Annotated); ok {
+		old := a.meta
+		if m.Label == "" {
+			m.Label = old.Label
+		}
+		if m.Source == "" {
+			m.Source = old.Source
+		}
+		if m.Unit == "" {
+			m.Unit = old.Unit
+		}
+		m.Provenance = append(append([]string(nil), old.Provenance...), m.Provenance...)
+		e = a.expr
+	}
+	m.Provenance = append([]string(nil), m.Provenance...)
+	return &Annotated{expr: e, meta: m}
+}
+
+// WithProvenance records step in the provenance of e, annotating e if it
+// is not annotated yet.
+func WithProvenance(e Expr, step string) Expr {
+	return Annotate(e, Meta{Provenance: []string{step}})
+}
+
+// MetaOf returns the metadata of e when e is Annotated.
+func MetaOf(e Expr) (Meta, bool) {
+	a, ok := e.(*Annotated)
+	if !ok {
+		return Meta{}, false
+	}
+	return a.Meta(), true
+}
+
+// Annotations returns the annotated subtrees of e in pre-order.
+func Annotations(e Expr) []*Annotated {
+	var out []*Annotated
+	Walk(e, func(e Expr) bool {
+		if a, ok := e.(*Annotated); ok {
+			out = append(out, a)
+		}
+		return true
+	})
+	return out
+}
+
+// StripMeta returns e with every annotation removed.
+func StripMeta(e Expr) Expr {
+	switch t := e.(type) {
+	case *Annotated:
+		return StripMeta(t.expr)
+	case *Add:
+		return &Add{terms: stripAll(t.terms)}
+	case *Mul:
+		return &Mul{factors: stripAll(t.factors)}
+	case *Pow:
+		return &Pow{base: StripMeta(t.base), exp: StripMeta(t.exp)}
+	case *Func:
+		return t.mapArgs(StripMeta)
+	case binder:
+		v, body, rest := t.binding()
+		return t.rebind(v, StripMeta(body), stripAll(rest))
+	case *Piecewise:
+		return t.mapParts(StripMeta)
+	case *Delta:
+		return &Delta{i: StripMeta(t.i), j: StripMeta(t.j)}
+	case *Relational:
+		return t.mapSides(StripMeta)
+	case *UndefFunc:
+		return &UndefFunc{name: t.name, order: t.order, arg: StripMeta(t.arg)}
+	}
+	return e
+}
+
+func stripAll(es []Expr) []Expr {
+	out := make([]Expr, len(es))
+	for i, e := range es {
+		out[i] = StripMeta(e)
+	}
+	return out
+}
+
+// Expr returns the wrapped expression.
+func (a *Annotated) Expr() Expr { return a.expr }
+
+// Meta returns a copy of the metadata.
+func (a *Annotated) Meta() Meta {
+	m := a.meta
+	m.Provenance = append([]string(nil), m.Provenance...)
+	return m
+}
+
+func (a *Annotated) Simplify() Expr {
+	return Annotate(a.expr.Simplify(), a.meta)
+}
+
+func (a *Annotated) String() string { return a.expr.String() }
+func (a *Annotated) LaTeX() string  { return a.expr.LaTeX() }
+
+func (a *Annotated) Sub(varName string, value Expr) Expr {
+	return &Annotated{expr: a.expr.Sub(varName, value), meta: a.meta}
+}
+
+func (a *Annotated) Diff(varName string) Expr {
+	m := Meta{Source: a.meta.Source}
+	m.Provenance = append(append([]string(nil), a.meta.Provenance...), "Diff "+varName)
+	return &Annotated{expr: a.expr.Diff(varName), meta: m}
+}
+
+func (a *Annotated) Eval() (*Num, bool)    { return a.expr.Eval() }
+func (a *Annotated) Equal(other Expr) bool { return equal(a, other) }
+func (a *Annotated) exprType() string      { return "annotated" }
+func (a *Annotated) toJSON() map[string]interface{} {
+	meta := map[string]interface{}{}
+	for k, v := range map[string]string{"label": a.meta.Label, "source": a.meta.Source, "unit": a.meta.Unit} {
+		if v != "" {
+			meta[k] = v
+		}
+	}
+	if len(a.meta.Provenance) > 0 {
+		ps := make([]interface{}, len(a.meta.Provenance))
+		for i, p := range a.meta.Provenance {
+			ps[i] = p
+		}
+		meta["provenance"] = ps
+	}
+	return map[string]interface{}{"type": "annotated", "expr": a.expr.toJSON(), "meta": meta}
+}
+
+// ============================================================
+// Helpers
+// ============================================================
+
+// isNumValue reports whether e is a Num equal to v.
+func isNumValue(e Expr, v float64) bool {
+	n, ok := e.(*Num)
+	if !ok {
+		return false
+	}
+	r := new(big.Rat)
+	r.SetFloat64(v)
+	return n.val.Cmp(r) == 0
+}
+
+// dependsOn reports whether e contains the symbol varName.
+func dependsOn(e Expr, varName string) bool {
+	set := map[string]struct{}{}
+	collectSymbols(e, set)
+	_, ok := set[varName]
+	return ok
+}
+
+// bare returns e without its top-level annotations, for decisions that
+// depend on the node type, such as where to print parentheses.
+func bare(e Expr) Expr {
+	for {
+		a, ok := e.(*Annotated)
+		if !ok {
+			return e
+		}
+		e = a.expr
+	}
+}
+
+func sub(a, b Expr) Expr { return &Add{terms: []Expr{a, neg(b)}} }
+func div(a, b Expr) Expr { return &Mul{factors: []Expr{a, &Pow{base: b, exp: N(-1)}}} }
+
+func exprsJSON(es []Expr) []interface{} {
+	out := make([]interface{}, len(es))
+	for i, e := range es {
+		out[i] = e.toJSON()
+	}
+	return out
+}
+
+// Simplify returns e.Simplify().
+func Simplify(e Expr) Expr { return e.Simplify() }
+
+// SimplifyBudget bounds the work of SimplifyBudgeted. A zero field means
+// no limit.
+type SimplifyBudget struct {
+	MaxNodes int           // subexpressions visited
+	Timeout  time.Duration // wall-clock time
+}
+
+// SimplifyBudgeted simplifies e bottom-up, one subexpression at a time,
+// until the budget runs out. It returns the best expression found so far,
+// which is e with every subexpression finished in time simplified, and
+// partial is true when the budget ran out before the root was simplified.
+// With an unlimited budget the result is e.Simplify(). The budget is
+// checked between subexpressions, so a single step, such as evaluating an
+// Integral, may overrun it.
+func SimplifyBudgeted(e Expr, b SimplifyBudget) (r Expr, partial bool) {
+	s := &budgetedSimplifier{budget: b}
+	if b.Timeout > 0 {
+		s.deadline = time.Now().Add(b.Timeout)
+	}
+	r = s.simplify(e)
+	return r, s.spent
+}
+
+type budgetedSimplifier struct {
+	budget   SimplifyBudget
+	deadline time.Time
+	visited  int
+	spent    bool
+}
+
+// visit counts one subexpression and reports whether the budget allows
+// simplifying it.
+func (s *budgetedSimplifier) visit() bool {
+	if !s.spent {
+		s.visited++
+		s.spent = s.budget.MaxNodes > 0 && s.visited > s.budget.MaxNodes ||
+			!s.deadline.IsZero() && time.Now().After(s.deadline)
+	}
+	return !s.spent
+}
+
+func (s *budgetedSimplifier) simplify(e Expr) Expr {
+	if !s.visit() {
+		return e
+	}
+	if _, children := labeledChildren(e); len(children) > 0 {
+		out := make([]Expr, len(children))
+		for i, c := range children {
+			out[i] = s.simplify(c)
+		}
+		e = withChildren(e, out)
+	}
+	if s.spent {
+		return e
+	}
+	return e.Simplify()
+}
+
+// SimplifyOpts selects the rewrites SimplifyWith applies and bounds its
+// work. A zero MaxIterations means 10 and a zero Timeout means no limit.
+type SimplifyOpts struct {
+	// Strategies is the pipeline applied in order on each pass, by name:
+	// "simplify", "expand", "factor", "together", "cancel" (alias
+	// "ratsimp"), "apart", "trigsimp", "trigexpand", "logexpand",
+	// "logcombine" and "radsimp". Empty means {"simplify"}.
+	Strategies    []string
+	MaxIterations int           // passes over the pipeline
+	Timeout       time.Duration // wall-clock time
+}
+
+const defaultSimplifyIterations = 10
+
+var simplifyStrategies = map[string]func(Expr) Expr{
+	"simplify":   Simplify,
+	"expand":     Expand,
+	"factor":     Factor,
+	"together":   Together,
+	"cancel":     Cancel,
+	"ratsimp":    Cancel,
+	"trigsimp":   TrigSimp,
+	"trigexpand": TrigExpand,
+	"logexpand":  func(e Expr) Expr { return LogExpand(e) },
+	"logcombine": func(e Expr) Expr { return LogCombine(e) },
+	"radsimp":    func(e Expr) Expr { return RadSimp(e) },
+	"apart": func(e Expr) Expr {
+		if syms := FreeSymbols(e); len(syms) == 1 {
+			return Apart(e, syms[0])
+		}
+		return e
+	},
+}
+
+// SimplifyWith applies the pipeline opts.Strategies to e repeatedly until
+// a pass leaves the expression unchanged or returns to one seen before,
+// so {"expand", "factor"} on (x + 1)^2 stops after one pass rather than
+// alternating. partial is true when the iterations or the time ran out
+// first; the result is then the expression after the last completed
+// step. The "simplify" step is bounded by the remaining time, as in
+// SimplifyBudgeted; the others are checked between steps. An unknown
+// strategy is an error.
+func SimplifyWith(e Expr, opts SimplifyOpts) (r Expr, partial bool, err error) {
+	names := opts.Strategies
+	if len(names) == 0 {
+		names = []string{"simplify"}
+	}
+	steps := make([]func(Expr) Expr, len(names))
+	for i, name := range names {
+		f, ok := simplifyStrategies[name]
+		if !ok {
+			return nil, false, fmt.Errorf("unknown strategy %q", name)
+		}
+		steps[i] = f
+	}
+	iterations := opts.MaxIterations
+	if iterations <= 0 {
+		iterations = defaultSimplifyIterations
+	}
+	var deadline time.Time
+	if opts.Timeout > 0 {
+		deadline = time.Now().Add(opts.Timeout)
+	}
+	seen := map[string]bool{e.String(): true}
+	for pass := 0; pass < iterations; pass++ {
+		for i, f := range steps {
+			if !deadline.IsZero() {
+				left := time.Until(deadline)
+				if left <= 0 {
+					return e, true, nil
+				}
+				if names[i] == "simplify" {
+					var spent bool
+					if e, spent = SimplifyBudgeted(e, SimplifyBudget{Timeout: left}); spent {
+						return e, true, nil
+					}
+					continue
+				}
+			}
+			e = f(e)
+		}
+		key := e.String()
+		if seen[key] {
+			return e, false, nil
+		}
+		seen[key] = true
+	}
+	return e, true, nil
+}
+
+// SearchOpts configures SimplifySearch. Zero fields take the defaults in
+// brackets.
+type SearchOpts struct {
+	// Strategies are the rewrites explored, named as in SimplifyOpts
+	// [all except "apart" and "ratsimp"].
+	Strategies []string
+	MaxSteps   int            // rewrites tried [2000]
+	Timeout    time.Duration  // wall-clock time [100ms]
+	Seed       int64          // random source; equal seeds explore equally
+	Cost       func(Expr) int // what is minimised [CountOps]
+}
+
+var searchStrategies = []string{"simplify", "expand", "factor", "together", "cancel", "trigsimp", "trigexpand", "logexpand", "logcombine", "radsimp"}
+
+// SimplifySearch looks for the cheapest form of e reachable by sequences
+// of rewrites, where the greedy pipeline of SimplifyWith gets stuck
+// because the way down first goes up: (sin(x) + cos(x))^2 - 2*sin(x)*cos(x)
+// must be expanded, at a cost, before TrigSimp reduces it to 1. The search
+// is simulated annealing: each step applies a random strategy to the
+// current form and moves there if it is cheaper, or with a probability
+// that falls as the step cost rises and as the steps run out. After 20
+// steps without improvement it backtracks to the best form
+// found. Rewrites that grow the cost beyond four times the start plus 50
+// are rejected, which keeps Expand of large powers from dominating.
+//
+// The result never costs more than e.Simplify(), and with equal opts it is
+// the same on every run unless the time runs out first.
+func SimplifySearch(e Expr, opts SearchOpts) (Expr, error) {
+	names := opts.Strategies
+	if len(names) == 0 {
+		names = searchStrategies
+	}
+	steps := make([]func(Expr) Expr, len(names))
+	for i, name := range names {
+		f, ok := simplifyStrategies[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown strategy %q", name)
+		}
+		steps[i] = f
+	}
+	maxSteps, timeout, cost := opts.MaxSteps, opts.Timeout, opts.Cost
+	if maxSteps <= 0 {
+		maxSteps = 2000
+	}
+	if timeout <= 0 {
+		timeout = 100 * time.Millisecond
+	}
+	if cost == nil {
+		cost = CountOps
+	}
+	deadline := time.Now().Add(timeout)
+	rng := rand.New(rand.NewSource(opts.Seed))
+
+	type state struct {
+		e    Expr
+		key  string
+		cost int
+	}
+	costs := map[string]int{}
+	at := func(e Expr) state {
+		key := e.String()
+		c, ok := costs[key]
+		if !ok {
+			c = cost(e)
+			costs[key] = c
+		}
+		return state{e, key, c}
+	}
+	better := func(a, b state) bool {
+		return a.cost < b.cost || a.cost == b.cost && len(a.key) < len(b.key)
+	}
+	moves := map[string]state{}
+	cur := at(e.Simplify())
+	best := cur
+	limit := 4*cur.cost + 50
+	stale := 0
+	for k := 0; k < maxSteps && time.Now().Before(deadline); k++ {
+		i := rng.Intn(len(steps))
+		next, ok := moves[cur.key+"\x00"+names[i]]
+		if !ok {
+			next = at(steps[i](cur.e))
+			moves[cur.key+"\x00"+names[i]] = next
+		}
+		temp := 2 * (1 - float64(k)/float64(maxSteps))
+		if d := next.cost - cur.cost; next.cost <= limit && (d <= 0 || rng.Float64() < math.Exp(-float64(d)/temp)) {
+			cur = next
+		}
+		if better(cur, best) {
+			best, stale = cur, 0
+		} else if stale++; stale >= searchPatience {
+			cur, stale = best, 0
+		}
+	}
+	return best.e, nil
+}
+
+// searchPatience is the number of steps SimplifySearch takes without
+// improving on its best form before returning to it.
+const searchPatience = 20
+
+// SimplifyShared is Simplify for expressions that share subtrees, such as
+// those produced by repeated squaring or by automatic differentiation.
+// Like EvalInShared it identifies subtrees by pointer and simplifies each
+// distinct one once, reusing the result wherever the subtree occurs, so
+// x*x with x = y*y thirty levels deep simplifies in thirty steps to
+// y^1073741824. Each step still reads its simplified children, so the
+// saving is largest when they stay small.
+func SimplifyShared(e Expr) Expr { return simplifyShared(e, map[Expr]Expr{}) }
+
+func simplifyShared(e Expr, memo map[Expr]Expr) Expr {
+	if r, ok := memo[e]; ok {
+		return r
+	}
+	r := e
+	if _, children := labeledChildren(e); len(children) > 0 {
+		out := make([]Expr, len(children))
+		for i, c := range children {
+			out[i] = simplifyShared(c, memo)
+		}
+		r = withChildren(e, out)
+	}
+	r = r.Simplify()
+	memo[e] = r
+	return r
+}
+
+// String returns e.String().
+func String(e Expr) string { return e.String() }
+
+// LaTeX returns e.LaTeX().
+func LaTeX(e Expr) string { return e.LaTeX() }
+
+// Sub substitutes value for varName in e and simplifies the result.
+func Sub(e Expr, varName string, value Expr) Expr {
+	return e.Sub(varName, value).Simplify()
+}
+
+// SubExpr replaces the subexpression target by value throughout e and
+// simplifies the result, so SubExpr(sin(x)^2 + sin(x), sin(x), u) is
+// u^2 + u. Both e and target are simplified first and occurrences are
+// compared by printed form. A product or sum target also matches within a
+// larger product or sum containing all its factors or terms, and a power
+// target b^k matches b^m and b when m/k is an integer, so x^2 in
+// x^4 + x^2 gives u^2 + u and sqrt(x) in x + sqrt(x) gives u^2 + u. Occurrences involving the variable of an enclosing
+// Integral are left alone, and a symbol target is an ordinary Sub.
+func SubExpr(e, target, value Expr) Expr {
+	target = target.Simplify()
+	if s, ok := target.(*Sym); ok {
+		return Sub(e, s.name, value)
+	}
+	return replaceSubexpr(e.Simplify(), target, value).Simplify()
+}
+
+// SubMap substitutes every symbol named in values at once and simplifies
+// the result. Replacements are not themselves rewritten, so
+// SubMap(x + y, {x: y, y: x}) is y + x, and the result does not depend on
+// map iteration order.
+func SubMap(e Expr, values map[string]Expr) Expr {
+	vars := make([]string, 0, len(values))
+	for v := range values {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	vals := make([]Expr, len(vars))
+	for i, v := range vars {
+		vals[i] = values[v]
+	}
+	return subAll(e, vars, vals).Simplify()
+}
+
+// FreeSymbols returns the sorted names of the symbols appearing free in
+// e. The variable of an Integral, Sum or Product is bound inside its
+// integrand or term; see BoundSymbols.
+func FreeSymbols(e Expr) []string {
+	set := map[string]struct{}{}
+	collectSymbols(e, set)
+	return sortedNames(set)
+}
+
+// Children returns the direct subexpressions of e: the terms of a sum, the
+// factors of a product, the base and exponent of a power, the argument of
+// a function, the integrand and limits of an Integral, the wrapped
+// expression of an Annotated, the values and condition sides of each case
+// of a Piecewise followed by its fallback, and the indices of a delta.
+// Other nodes have none. The slice is a copy.
+func Children(e Expr) []Expr {
+	_, children := labeledChildren(e)
+	return append([]Expr(nil), children...)
+}
+
+// Walk visits e and its subexpressions in pre-order, calling visit on each.
+// When visit returns false the children of that node are skipped.
+func Walk(e Expr, visit func(Expr) bool) {
+	if !visit(e) {
+		return
+	}
+	_, children := labeledChildren(e)
+	for _, c := range children {
+		Walk(c, visit)
+	}
+}
+
+func collectSymbols(e Expr, out map[string]struct{}) {
+	switch t := e.(type) {
+	case *Sym:
+		out[t.name] = struct{}{}
+	case *Add:
+		for _, x := range t.terms {
+			collectSymbols(x, out)
+		}
+	case *Mul:
+		for _, x := range t.factors {
+			collectSymbols(x, out)
+		}
+	case *Pow:
+		collectSymbols(t.base, out)
+		collectSymbols(t.exp, out)
+	case *Func:
+		for _, a := range t.args {
+			collectSymbols(a, out)
+		}
+	case *Annotated:
+		collectSymbols(t.expr, out)
+	case *Piecewise, *Delta, *Relational, *UndefFunc:
+		_, children := labeledChildren(t)
+		for _, x := range children {
+			collectSymbols(x, out)
+		}
+	case binder:
+		v, body, rest := t.binding()
+		inner := map[string]struct{}{}
+		collectSymbols(body, inner)
+		delete(inner, v)
+		for k := range inner {
+			out[k] = struct{}{}
+		}
+		for _, r := range rest {
+			collectSymbols(r, out)
+		}
+	}
+}
+
+// evalFloat evaluates e numerically with the given symbol bindings.
+func evalFloat(e Expr, env map[string]float64) (float64, bool) {
+	switch t := e.(type) {
+	case *Num:
+		return t.Float64(), true
+	case *Const:
+		return t.val, true
+	case *Sym:
+		v, ok := env[t.name]
+		return v, ok
+	case *Add:
+		s := 0.0
+		for _, x := range t.terms {
+			v, ok := evalFloat(x, env)
+			if !ok {
+				return 0, false
+			}
+			s += v
+		}
+		return s, true
+	case *Mul:
+		p := 1.0
+		for _, x := range t.factors {
+			v, ok := evalFloat(x, env)
+			if !ok {
+				return 0, false
+			}
+			p *= v
+		}
+		return p, true
+	case *Pow:
+		b, ok1 := evalFloat(t.base, env)
+		x, ok2 := evalFloat(t.exp, env)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		return math.Pow(b, x), true
+	case *Func:
+		xs := make([]float64, len(t.args))
+		for i, a := range t.args {
+			var ok bool
+			if xs[i], ok = evalFloat(a, env); !ok {
+				return 0, false
+			}
+		}
+		return applyFunc(t.name, xs...), true
+	case *Annotated:
+		return evalFloat(t.expr, env)
+	case *Piecewise:
+		for _, c := range t.cases {
+			holds, ok := c.Cond.Holds(env)
+			if !ok {
+				return 0, false
+			}
+			if holds {
+				return evalFloat(c.Value, env)
+			}
+		}
+		return evalFloat(t.otherwise, env)
+	case *Delta:
+		i, ok1 := evalFloat(t.i, env)
+		j, ok2 := evalFloat(t.j, env)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		if i == j {
+			return 1, true
+		}
+		return 0, true
+	case *Relational:
+		holds, ok := t.Holds(env)
+		if !ok {
+			return 0, false
+		}
+		if holds {
+			return 1, true
+		}
+		return 0, true
+	case *Integral:
+		lo, ok1 := evalFloat(t.lo, env)
+		hi, ok2 := evalFloat(t.hi, env)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		inner := make(map[string]float64, len(env)+1)
+		for k, v := range env {
+			inner[k] = v
+		}
+		f := t.integrand.Simplify()
+		return splitQuadrature(func(s float64) (float64, bool) {
+			inner[t.v] = s
+			return evalFloat(f, inner)
+		}, lo, hi, breakpoints(f, t.v, lo, hi, env))
+	case *Sum:
+		return evalIndexed(t.term, t.k, t.lo, t.hi, false, env)
+	case *Product:
+		return evalIndexed(t.term, t.k, t.lo, t.hi, true, env)
+	}
+	return 0, false
+}
+
+// ============================================================
+// Generic numeric evaluation
+// ============================================================
+
+// Domain is the arithmetic an expression is evaluated in by EvalIn. Pow
+// and Apply report an error rather than panicking when an operation is not
+// defined for their arguments.
+type Domain[T any] interface {
+	FromRat(r *big.Rat) T
+	FromFloat(f float64) T
+	Add(a, b T) T
+	Mul(a, b T) T
+	Pow(base, exp T) (T, error)
+	// Apply evaluates the named function; see RegisteredFunctions.
+	Apply(name string, x T) (T, error)
+}
+
+// Comparer is implemented by domains whose values can be ordered, which
+// EvalIn needs to choose the case of a Piecewise. ok is false when a and b
+// are not comparable, e.g. complex values or overlapping intervals.
+type Comparer[T any] interface {
+	Cmp(a, b T) (c int, ok bool)
+}
+
+// EvalIn evaluates e in domain d with the given symbol bindings. Unbound
+// symbols are an error.
+func EvalIn[T any](e Expr, d Domain[T], env map[string]T) (T, error) {
+	return evalIn(e, d, env, nil)
+}
+
+// EvalInShared is EvalIn evaluating each distinct subtree once. Subtrees
+// are identified by pointer, so a node reachable along many paths, as in
+// derivatives that reuse the factors of the original expression, costs a
+// single evaluation: time is proportional to the number of unique nodes
+// rather than to the size of the fully expanded tree. The cache lasts for
+// this call only.
+func EvalInShared[T any](e Expr, d Domain[T], env map[string]T) (T, error) {
+	return evalIn(e, d, env, map[Expr]T{})
+}
+
+// evalIn implements EvalIn, memoizing the values of composite nodes in
+// memo when it is non-nil.
+func evalIn[T any](e Expr, d Domain[T], env map[string]T, memo map[Expr]T) (T, error) {
+	var zero T
+	switch t := e.(type) {
+	case *Num:
+		return d.FromRat(t.val), nil
+	case *Const:
+		return d.FromFloat(t.val), nil
+	case *Sym:
+		v, ok := env[t.name]
+		if !ok {
+			return zero, fmt.Errorf("unbound symbol %q", t.name)
+		}
+		return v, nil
+	}
+	if v, ok := memo[e]; ok {
+		return v, nil
+	}
+	v, err := evalNode(e, d, env, memo)
+	if err == nil && memo != nil {
+		memo[e] = v
+	}
+	return v, err
+}
+
+func evalNode[T any](e Expr, d Domain[T], env map[string]T, memo map[Expr]T) (T, error) {
+	var zero T
+	switch t := e.(type) {
+	case *Add, *Mul:
+		op, es, acc := d.Add, []Expr(nil), d.FromRat(new(big.Rat))
+		if a, ok := t.(*Add); ok {
+			es = a.terms
+		} else {
+			op, es, acc = d.Mul, t.(*Mul).factors, d.FromRat(big.NewRat(1, 1))
+		}
+		for _, x := range es {
+			v, err := evalIn(x, d, env, memo)
+			if err != nil {
+				return zero, err
+			}
+			acc = op(acc, v)
+		}
+		return acc, nil
+	case *Pow:
+		b, err := evalIn(t.base, d, env, memo)
+		if err != nil {
+			return zero, err
+		}
+		x, err := evalIn(t.exp, d, env, memo)
+		if err != nil {
+			return zero, err
+		}
+		return d.Pow(b, x)
+	case *Func:
+		if len(t.args) > 1 {
+			return evalFuncN(t, d, env, memo)
+		}
+		a, err := evalIn(t.args[0], d, env, memo)
+		if err != nil {
+			return zero, err
+		}
+		return d.Apply(t.name, a)
+	case *Annotated:
+		return evalIn(t.expr, d, env, memo)
+	case *Piecewise:
+		c, ok := d.(Comparer[T])
+		if !ok {
+			return zero, fmt.Errorf("cannot evaluate piecewise in %T: values are not ordered", d)
+		}
+		for _, pc := range t.cases {
+			l, err := evalIn(pc.Cond.Lhs, d, env, memo)
+			if err != nil {
+				return zero, err
+			}
+			r, err := evalIn(pc.Cond.Rhs, d, env, memo)
+			if err != nil {
+				return zero, err
+			}
+			sign, ok := c.Cmp(l, r)
+			if !ok {
+				return zero, fmt.Errorf("cannot decide %s", pc.Cond)
+			}
+			if pc.Cond.Op.holds(sign) {
+				return evalIn(pc.Value, d, env, memo)
+			}
+		}
+		return evalIn(t.otherwise, d, env, memo)
+	case *Delta:
+		c, ok := d.(Comparer[T])
+		if !ok {
+			return zero, fmt.Errorf("cannot evaluate KroneckerDelta in %T: values are not ordered", d)
+		}
+		i, err := evalIn(t.i, d, env, memo)
+		if err != nil {
+			return zero, err
+		}
+		j, err := evalIn(t.j, d, env, memo)
+		if err != nil {
+			return zero, err
+		}
+		sign, ok := c.Cmp(i, j)
+		if !ok {
+			return zero, fmt.Errorf("cannot compare the indices of %s", t)
+		}
+		if sign == 0 {
+			return d.FromRat(big.NewRat(1, 1)), nil
+		}
+		return d.FromRat(new(big.Rat)), nil
+	case *Relational:
+		c, ok := d.(Comparer[T])
+		if !ok {
+			return zero, fmt.Errorf("cannot evaluate %s in %T: values are not ordered", t, d)
+		}
+		vs := make([]T, len(t.sides))
+		for i, s := range t.sides {
+			v, err := evalIn(s, d, env, memo)
+			if err != nil {
+				return zero, err
+			}
+			vs[i] = v
+		}
+		holds := true
+		for i, op := range t.ops {
+			sign, ok := c.Cmp(vs[i], vs[i+1])
+			if !ok {
+				return zero, fmt.Errorf("cannot decide %s", t)
+			}
+			holds = holds && op.holds(sign)
+		}
+		if holds {
+			return d.FromRat(big.NewRat(1, 1)), nil
+		}
+		return d.FromRat(new(big.Rat)), nil
+	case *UndefFunc:
+		return zero, fmt.Errorf("cannot evaluate undefined function %s", t)
+	case *Sum:
+		return evalIndexedIn(t, d, env)
+	case *Product:
+		return evalIndexedIn(t, d, env)
+	}
+	return zero, fmt.Errorf("cannot evaluate %T", e)
+}
+
+// integerValue returns v as a Num when it is an integer real number, a
+// point interval at one, or a complex number with zero imaginary part.
+func integerValue(v any) (*Num, bool) {
+	var f float64
+	switch t := v.(type) {
+	case float64:
+		f = t
+	case complex128:
+		if imag(t) != 0 {
+			return nil, false
+		}
+		f = real(t)
+	case Interval:
+		if t.Lo != t.Hi {
+			return nil, false
+		}
+		f = t.Lo
+	case *big.Float:
+		if !t.IsInt() {
+			return nil, false
+		}
+		n, _ := t.Int(nil)
+		return numRat(new(big.Rat).SetInt(n)), true
+	default:
+		return nil, false
+	}
+	if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+		return nil, false
+	}
+	return N(int64(f)), true
+}
+
+// evalIndexedIn evaluates a Sum or Product term by term in d. The bounds
+// must be integers at most maxEvalTerms apart, either after Simplify or,
+// in domains of real numbers, intervals and complex numbers, after
+// evaluation in d.
+func evalIndexedIn[T any](b binder, d Domain[T], env map[string]T) (T, error) {
+	var zero T
+	k, term, rest := b.binding()
+	var bounds [2]Expr
+	for i, r := range rest {
+		bounds[i] = r.Simplify()
+		if _, ok := bounds[i].(*Num); ok {
+			continue
+		}
+		v, err := evalIn(bounds[i], d, env, map[Expr]T{})
+		if err != nil {
+			return zero, err
+		}
+		if n, ok := integerValue(v); ok {
+			bounds[i] = n
+		}
+	}
+	ks, ok := indexRange(bounds[0], bounds[1], maxEvalTerms)
+	if !ok {
+		return zero, fmt.Errorf("cannot evaluate %s: the bounds are not nearby integers", b)
+	}
+	_, prod := b.(*Product)
+	acc := d.FromRat(new(big.Rat))
+	if prod {
+		acc = d.FromRat(big.NewRat(1, 1))
+	}
+	inner := make(map[string]T, len(env)+1)
+	for name, v := range env {
+		inner[name] = v
+	}
+	for _, i := range ks {
+		inner[k] = d.FromRat(i)
+		v, err := evalIn(term, d, inner, map[Expr]T{})
+		if err != nil {
+			return zero, err
+		}
+		if prod {
+			acc = d.Mul(acc, v)
+		} else {
+			acc = d.Add(acc, v)
+		}
+	}
+	return acc, nil
+}
+
+// applierN is implemented by domains that evaluate functions of several
+// arguments directly. ok is false when they cannot, e.g. atan2 of complex
+// values; evalFuncN then falls back to FuncDef.Rewrite.
+type applierN[T any] interface {
+	applyN(def *FuncDef, xs []T) (v T, ok bool, err error)
+}
+
+// evalFuncN evaluates a function of several arguments in d.
+func evalFuncN[T any](f *Func, d Domain[T], env map[string]T, memo map[Expr]T) (T, error) {
+	var zero T
+	def := lookupFunc(f.name)
+	if def == nil {
+		return zero, fmt.Errorf("unknown function %q", f.name)
+	}
+	if a, ok := d.(applierN[T]); ok {
+		xs := make([]T, len(f.args))
+		for i, x := range f.args {
+			v, err := evalIn(x, d, env, memo)
+			if err != nil {
+				return zero, err
+			}
+			xs[i] = v
+		}
+		if v, ok, err := a.applyN(def, xs); ok || err != nil {
+			return v, err
+		}
+	}
+	if def.Rewrite == nil {
+		return zero, fmt.Errorf("cannot evaluate %s in %T", f.name, d)
+	}
+	return evalIn(def.Rewrite(f.args), d, env, memo)
+}
+
+// Numeric is the set of built-in number types EvalT supports.
+type Numeric interface {
+	float32 | float64 | complex64 | complex128
+}
+
+// EvalT evaluates e in the native arithmetic of T, e.g.
+//
+//	v, err := EvalT[complex128](LnOf(S("z")), map[string]complex128{"z": -1}) // iπ
+//
+// Real types follow math (ln(-1) is NaN); complex types use math/cmplx for
+// the elementary functions and fall back to the real definition for other
+// functions of real arguments. For arbitrary precision use EvalIn with
+// BigFloatDomain.
+func EvalT[T Numeric](e Expr, env map[string]T) (T, error) {
+	return EvalIn[T](e, nativeDomain[T]{}, env)
+}
+
+// EvalTShared is EvalT with the per-call subtree cache of EvalInShared.
+func EvalTShared[T Numeric](e Expr, env map[string]T) (T, error) {
+	return EvalInShared[T](e, nativeDomain[T]{}, env)
+}
+
+type nativeDomain[T Numeric] struct{}
+
+func (nativeDomain[T]) FromRat(r *big.Rat) T {
+	f, _ := r.Float64()
+	return nativeDomain[T]{}.FromFloat(f)
+}
+
+func (nativeDomain[T]) FromFloat(f float64) T {
+	var v T
+	switch p := any(&v).(type) {
+	case *float32:
+		*p = float32(f)
+	case *float64:
+		*p = f
+	case *complex64:
+		*p = complex(float32(f), 0)
+	case *complex128:
+		*p = complex(f, 0)
+	}
+	return v
+}
+
+func (nativeDomain[T]) Add(a, b T) T { return a + b }
+func (nativeDomain[T]) Mul(a, b T) T { return a * b }
+
+func (nativeDomain[T]) Pow(base, exp T) (T, error) {
+	return nativeDomain[T]{}.lift2(base, exp, math.Pow, cmplx.Pow), nil
+}
+
+func (nativeDomain[T]) Apply(name string, x T) (T, error) {
+	d := lookupFunc(name)
+	if d == nil {
+		var zero T
+		return zero, fmt.Errorf("unknown function %q", name)
+	}
+	switch p := any(x).(type) {
+	case complex64:
+		r, err := complexApply(d, complex128(p))
+		return any(complex64(r)).(T), err
+	case complex128:
+		r, err := complexApply(d, p)
+		return any(r).(T), err
+	case float32:
+		return any(float32(d.Eval(float64(p)))).(T), nil
+	}
+	return any(d.Eval(any(x).(float64))).(T), nil
+}
+
+// applyN evaluates functions of several real arguments with EvalN.
+func (nativeDomain[T]) applyN(def *FuncDef, xs []T) (T, bool, error) {
+	fs := make([]float64, len(xs))
+	for i, x := range xs {
+		switch p := any(x).(type) {
+		case float32:
+			fs[i] = float64(p)
+		case float64:
+			fs[i] = p
+		default:
+			var zero T
+			return zero, false, nil
+		}
+	}
+	return nativeDomain[T]{}.FromFloat(def.EvalN(fs)), true, nil
+}
+
+// Cmp orders real values; complex values compare only when both are real.
+func (nativeDomain[T]) Cmp(a, b T) (int, bool) {
+	var x, y float64
+	switch p := any(a).(type) {
+	case float32:
+		x, y = float64(p), float64(any(b).(float32))
+	case float64:
+		x, y = p, any(b).(float64)
+	case complex64:
+		q := any(b).(complex64)
+		if imag(p) != 0 || imag(q) != 0 {
+			return 0, false
+		}
+		x, y = float64(real(p)), float64(real(q))
+	case complex128:
+		q := any(b).(complex128)
+		if imag(p) != 0 || imag(q) != 0 {
+			return 0, false
+		}
+		x, y = real(p), real(q)
+	}
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return 0, false
+	}
+	return int(signum(x - y)), true
+}
+
+// lift2 applies the float64 or complex128 form of a binary operation.
+func (nativeDomain[T]) lift2(a, b T, rf func(x, y float64) float64, cf func(x, y complex128) complex128) T {
+	var v T
+	switch p := any(&v).(type) {
+	case *float32:
+		*p = float32(rf(float64(any(a).(float32)), float64(any(b).(float32))))
+	case *float64:
+		*p = rf(any(a).(float64), any(b).(float64))
+	case *complex64:
+		*p = complex64(cf(complex128(any(a).(complex64)), complex128(any(b).(complex64))))
+	case *complex128:
+		*p = cf(any(a).(complex128), any(b).(complex128))
+	}
+	return v
+}
+
+// complexFuncs are the built-ins with complex extensions in math/cmplx.
+var complexFuncs = map[string]func(complex128) complex128{
+	"sin": cmplx.Sin, "cos": cmplx.Cos, "tan": cmplx.Tan, "exp": cmplx.Exp,
+	"ln": cmplx.Log, "asin": cmplx.Asin, "acos": cmplx.Acos, "atan": cmplx.Atan,
+	"sinh": cmplx.Sinh, "cosh": cmplx.Cosh, "tanh": cmplx.Tanh,
+	"abs": func(z complex128) complex128 { return complex(cmplx.Abs(z), 0) },
+}
+
+func complexApply(d *FuncDef, z complex128) (complex128, error) {
+	if f, ok := complexFuncs[d.Name]; ok {
+		return f(z), nil
+	}
+	if imag(z) != 0 {
+		return 0, fmt.Errorf("%s is not defined for complex argument %v", d.Name, z)
+	}
+	return complex(d.Eval(real(z)), 0), nil
+}
+
+// BigFloatDomain evaluates with *big.Float at precision Prec (53 if zero).
+// Arithmetic, integer powers and square roots are carried out at full
+// precision; other functions, non-integer powers and constants such as Pi
+// are computed in float64 and converted, so they carry at most 53 bits.
+type BigFloatDomain struct {
+	Prec uint
+}
+
+func (d BigFloatDomain) prec() uint {
+	if d.Prec == 0 {
+		return 53
+	}
+	return d.Prec
+}
+
+func (d BigFloatDomain) FromRat(r *big.Rat) *big.Float {
+	return new(big.Float).SetPrec(d.prec()).SetRat(r)
+}
+
+func (d BigFloatDomain) FromFloat(f float64) *big.Float {
+	return new(big.Float).SetPrec(d.prec()).SetFloat64(f)
+}
+
+func (d BigFloatDomain) Add(a, b *big.Float) *big.Float {
+	return new(big.Float).SetPrec(d.prec()).Add(a, b)
+}
+
+func (d BigFloatDomain) Mul(a, b *big.Float) *big.Float {
+	return new(big.Float).SetPrec(d.prec()).Mul(a, b)
+}
+
+func (d BigFloatDomain) Pow(base, exp *big.Float) (*big.Float, error) {
+	if exp.IsInt() {
+		n, acc := exp.Int64()
+		if acc == big.Exact && n >= -maxExactExponent && n <= maxExactExponent {
+			r := d.FromRat(big.NewRat(1, 1))
+			b := base
+			if n < 0 {
+				if base.Sign() == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				b = new(big.Float).SetPrec(d.prec()).Quo(r, base)
+				n = -n
+			}
+			for ; n > 0; n-- {
+				r = d.Mul(r, b)
+			}
+			return r, nil
+		}
+	}
+	if base.Sign() < 0 {
+		return nil, fmt.Errorf("non-integer power of negative number")
+	}
+	if exp.Cmp(big.NewFloat(0.5)) == 0 {
+		return new(big.Float).SetPrec(d.prec()).Sqrt(base), nil
+	}
+	b, _ := base.Float64()
+	x, _ := exp.Float64()
+	return d.FromFloat(math.Pow(b, x)), nil
+}
+
+func (BigFloatDomain) Cmp(a, b *big.Float) (int, bool) { return a.Cmp(b), true }
+
+func (d BigFloatDomain) Apply(name string, x *big.Float) (*big.Float, error) {
+	switch name {
+	case "abs":
+		return new(big.Float).SetPrec(d.prec()).Abs(x), nil
+	}
+	def := lookupFunc(name)
+	if def == nil {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	f, _ := x.Float64()
+	r := def.Eval(f)
+	if math.IsNaN(r) || math.IsInf(r, 0) {
+		return nil, fmt.Errorf("%s(%v) is not finite", name, f)
+	}
+	return d.FromFloat(r), nil
+}
+
+// Interval is a closed interval [Lo, Hi] of reals, the value type of
+// IntervalDomain.
+type Interval struct {
+	Lo, Hi float64
+}
+
+// Contains reports whether x lies in the interval.
+func (iv Interval) Contains(x float64) bool { return iv.Lo <= x && x <= iv.Hi }
+
+// IntervalDomain is interval arithmetic with outward rounding: the interval
+// EvalIn returns is guaranteed to contain the value of the expression at
+// every point of the argument intervals. Operations that are undefined on
+// part of an interval (ln of an interval reaching 0, a negative base to a
+// non-integer power) are errors, as are functions without interval rules.
+type IntervalDomain struct{}
+
+func down(x float64) float64 { return math.Nextafter(x, math.Inf(-1)) }
+func up(x float64) float64   { return math.Nextafter(x, math.Inf(1)) }
+
+// widen pads [lo, hi] by n ulps on each side to absorb rounding in math
+// functions, which are accurate to about one ulp.
+func widen(lo, hi float64, n int) Interval {
+	for i := 0; i < n; i++ {
+		lo, hi = down(lo), up(hi)
+	}
+	return Interval{lo, hi}
+}
+
+func (IntervalDomain) FromRat(r *big.Rat) Interval {
+	f, exact := r.Float64()
+	if exact {
+		return Interval{f, f}
+	}
+	return widen(f, f, 1)
+}
+
+func (IntervalDomain) FromFloat(f float64) Interval { return widen(f, f, 1) }
+
+func (IntervalDomain) Add(a, b Interval) Interval {
+	return Interval{down(a.Lo + b.Lo), up(a.Hi + b.Hi)}
+}
+
+func (IntervalDomain) Mul(a, b Interval) Interval {
+	ps := [4]float64{a.Lo * b.Lo, a.Lo * b.Hi, a.Hi * b.Lo, a.Hi * b.Hi}
+	lo, hi := ps[0], ps[0]
+	for _, p := range ps[1:] {
+		lo, hi = math.Min(lo, p), math.Max(hi, p)
+	}
+	if math.IsNaN(lo) || math.IsNaN(hi) { // 0·∞
+		return Interval{math.Inf(-1), math.Inf(1)}
+	}
+	return Interval{down(lo), up(hi)}
+}
+
+func (d IntervalDomain) Pow(base, exp Interval) (Interval, error) {
+	if exp.Lo != exp.Hi {
+		if base.Lo <= 0 {
+			return Interval{}, fmt.Errorf("interval: power of %v with a varying exponent", base)
+		}
+		l, err := d.Apply("ln", base)
+		if err != nil {
+			return Interval{}, err
+		}
+		return d.Apply("exp", d.Mul(exp, l))
+	}
+	n := exp.Lo
+	if n == math.Trunc(n) && math.Abs(n) <= 1<<20 {
+		if n < 0 {
+			if base.Lo <= 0 && base.Hi >= 0 {
+				return Interval{}, fmt.Errorf("interval: %v^%g divides by zero", base, n)
+			}
+			p, _ := d.Pow(base, Interval{-n, -n})
+			return widen(1/p.Hi, 1/p.Lo, 1), nil
+		}
+		lo, hi := math.Pow(base.Lo, n), math.Pow(base.Hi, n)
+		if int64(n)%2 == 0 {
+			lo, hi = math.Abs(lo), math.Abs(hi)
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if base.Lo <= 0 && base.Hi >= 0 {
+				lo = 0
+			}
+		}
+		r := widen(lo, hi, 2)
+		if int64(n)%2 == 0 && r.Lo < 0 {
+			r.Lo = 0
+		}
+		return r, nil
+	}
+	if base.Lo < 0 {
+		return Interval{}, fmt.Errorf("interval: negative base %v to the power %g", base, n)
+	}
+	lo, hi := math.Pow(base.Lo, n), math.Pow(base.Hi, n)
+	if n < 0 {
+		lo, hi = hi, lo
+	}
+	return widen(lo, hi, 2), nil
+}
+
+// Cmp orders disjoint intervals; overlapping ones compare only when both
+// are the same single point.
+func (IntervalDomain) Cmp(a, b Interval) (int, bool) {
+	switch {
+	case a.Hi < b.Lo:
+		return -1, true
+	case a.Lo > b.Hi:
+		return 1, true
+	case a.Lo == a.Hi && a == b:
+		return 0, true
+	}
+	return 0, false
+}
+
+// Apply evaluates monotone functions at the endpoints and sin, cos, cosh
+// and abs with their interior extrema.
+func (IntervalDomain) Apply(name string, x Interval) (Interval, error) {
+	inc := func(f func(float64) float64) (Interval, error) { return widen(f(x.Lo), f(x.Hi), 2), nil }
+	switch name {
+	case "exp", "sinh", "tanh", "atan", "erf", "sign", "deg", "rad":
+		return inc(func(v float64) float64 { return applyFunc(name, v) })
+	case "ln":
+		if x.Lo <= 0 {
+			return Interval{}, fmt.Errorf("interval: ln of %v", x)
+		}
+		return inc(math.Log)
+	case "lambertw", "li2":
+		// Both are increasing where real; the iterations are accurate to a
+		// few ulps, so pad further.
+		if name == "lambertw" && x.Lo < -1/math.E || name == "li2" && x.Hi > 1 {
+			return Interval{}, fmt.Errorf("interval: %s of %v", name, x)
+		}
+		f := lookupFunc(name).Eval
+		return widen(f(x.Lo), f(x.Hi), 8), nil
+	case "asin":
+		if x.Lo < -1 || x.Hi > 1 {
+			return Interval{}, fmt.Errorf("interval: asin of %v", x)
+		}
+		return inc(math.Asin)
+	case "acos":
+		if x.Lo < -1 || x.Hi > 1 {
+			return Interval{}, fmt.Errorf("interval: acos of %v", x)
+		}
+		return widen(math.Acos(x.Hi), math.Acos(x.Lo), 2), nil
+	case "abs", "cosh":
+		f := math.Abs
+		if name == "cosh" {
+			f = math.Cosh
+		}
+		lo, hi := f(x.Lo), f(x.Hi)
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if x.Contains(0) {
+			lo = f(0)
+		}
+		return widen(lo, hi, 2), nil
+	case "sin":
+		return trigInterval(math.Sin, math.Pi/2, x.Lo, x.Hi), nil
+	case "cos":
+		return trigInterval(math.Cos, 0, x.Lo, x.Hi), nil
+	}
+	return Interval{}, fmt.Errorf("interval: no interval rule for %s", name)
+}
+
+// trigInterval encloses f, which is sin or cos, over [lo, hi] from its
+// values at the ends, widened to absorb their rounding, and its extrema
+// at phase + kπ, which the range covers. The ends are evaluated directly
+// rather than shifted by π/2, which would move a root such as sin(0) off
+// the enclosure.
+func trigInterval(f func(float64) float64, phase, lo, hi float64) Interval {
+	if hi-lo >= 2*math.Pi || math.IsInf(lo, 0) || math.IsInf(hi, 0) {
+		return Interval{-1, 1}
+	}
+	r := widen(math.Min(f(lo), f(hi)), math.Max(f(lo), f(hi)), 2)
+	// Extrema at phase + kπ: maxima for even k, minima for odd k. Test a
+	// slightly enlarged range so that rounding in the division by π
+	// cannot skip one.
+	lo, hi = lo-phase, hi-phase
+	lo, hi = lo-1e-9*math.Max(1, math.Abs(lo)), hi+1e-9*math.Max(1, math.Abs(hi))
+	first, last := math.Ceil(lo/math.Pi), math.Floor(hi/math.Pi)
+	if last-first >= 1 {
+		// A maximum and a minimum, which is also where the quotients of
+		// huge ends lose all precision.
+		return Interval{-1, 1}
+	}
+	if k := first; k == last {
+		if math.Mod(k, 2) == 0 {
+			r.Hi = 1
+		} else {
+			r.Lo = -1
+		}
+	}
+	return Interval{math.Max(r.Lo, -1), math.Min(r.Hi, 1)}
+}
+
+// dual is a dual number v + d·ε with ε² = 0; d carries the derivative.
+type dual struct{ v, d float64 }
+
+// dualDomain is forward-mode automatic differentiation over dual numbers.
+type dualDomain struct{}
+
+func (dualDomain) FromRat(r *big.Rat) dual {
+	f, _ := r.Float64()
+	return dual{v: f}
+}
+
+func (dualDomain) FromFloat(f float64) dual { return dual{v: f} }
+func (dualDomain) Add(a, b dual) dual       { return dual{a.v + b.v, a.d + b.d} }
+func (dualDomain) Mul(a, b dual) dual       { return dual{a.v * b.v, a.d*b.v + a.v*b.d} }
+
+func (dualDomain) Pow(a, b dual) (dual, error) {
+	v := math.Pow(a.v, b.v)
+	if b.d == 0 {
+		// d(u^n) = n*u^(n-1)*du, valid for negative u.
+		if a.d == 0 {
+			return dual{v: v}, nil
+		}
+		return dual{v, b.v * math.Pow(a.v, b.v-1) * a.d}, nil
+	}
+	// d(u^w) = u^w*(dw*ln(u) + w*du/u)
+	return dual{v, v * (b.d*math.Log(a.v) + b.v*a.d/a.v)}, nil
+}
+
+func (dualDomain) Cmp(a, b dual) (int, bool) { return int(signum(a.v - b.v)), !math.IsNaN(a.v - b.v) }
+
+func (dualDomain) Apply(name string, x dual) (dual, error) {
+	def := lookupFunc(name)
+	if def == nil {
+		return dual{}, fmt.Errorf("unknown function %q", name)
+	}
+	r := dual{v: def.Eval(x.v)}
+	if x.d == 0 {
+		return r, nil
+	}
+	if def.Deriv == nil {
+		return dual{}, fmt.Errorf("no derivative rule for %s", name)
+	}
+	u := "u"
+	fp, ok := evalFloat(def.Deriv(S(u)), map[string]float64{u: x.v})
+	if !ok {
+		return dual{}, fmt.Errorf("cannot evaluate derivative of %s", name)
+	}
+	r.d = fp * x.d
+	return r, nil
+}
+
+// applyN combines the partial derivatives from DerivN by the chain rule.
+func (dualDomain) applyN(def *FuncDef, xs []dual) (dual, bool, error) {
+	vs := make([]float64, len(xs))
+	args := make([]Expr, len(xs))
+	env := make(map[string]float64, len(xs))
+	for i, x := range xs {
+		vs[i] = x.v
+		args[i] = S(fmt.Sprintf("u%d", i))
+		env[fmt.Sprintf("u%d", i)] = x.v
+	}
+	r := dual{v: def.EvalN(vs)}
+	for i, x := range xs {
+		if x.d == 0 {
+			continue
+		}
+		if def.DerivN == nil {
+			return dual{}, true, fmt.Errorf("no derivative rule for %s", def.Name)
+		}
+		fp, ok := evalFloat(def.DerivN(args, i), env)
+		if !ok {
+			return dual{}, true, fmt.Errorf("cannot evaluate derivative of %s", def.Name)
+		}
+		r.d += fp * x.d
+	}
+	return r, true, nil
+}
+
+// EvalDual evaluates e and its derivative with respect to wrt at the given
+// bindings in a single pass using dual numbers (forward-mode automatic
+// differentiation), without building the symbolic derivative. It fails on
+// unbound symbols, like EvalIn.
+func EvalDual(e Expr, bindings map[string]float64, wrt string) (value, derivative float64, err error) {
+	env := make(map[string]dual, len(bindings))
+	for k, v := range bindings {
+		env[k] = dual{v: v}
+	}
+	if v, ok := bindings[wrt]; ok {
+		env[wrt] = dual{v: v, d: 1}
+	}
+	r, err := EvalIn[dual](e, dualDomain{}, env)
+	if err != nil {
+		return 0, 0, err
+	}
+	return r.v, r.d, nil
+}
+
+// minCancelBits is the loss of significance at which EvalWithError reports
+// a sum as a cancellation.
+const minCancelBits = 10
+
+// ErrorEstimate describes how far a float64 evaluation can be trusted. It
+// is returned by EvalWithError.
+type ErrorEstimate struct {
+	// Value is the float64 value, as from EvalT.
+	Value float64
+	// Bound is a rigorous bound on |Value - v|, where v is the exact value
+	// of the expression at the bindings, found by interval arithmetic. It is
+	// +Inf when some function has no interval rule.
+	Bound float64
+	// Condition is the relative condition number Σ |x ∂f/∂x| / |f| over the
+	// bound symbols: the factor by which relative errors in the bindings
+	// grow in the result. It is +Inf at a zero of f and NaN when a
+	// derivative cannot be evaluated.
+	Condition float64
+	// Cancellations lists the sums, in pre-order, whose terms cancel by at
+	// least minCancelBits bits.
+	Cancellations []Cancellation
+}
+
+// Cancellation is a sum whose value is much smaller than its terms, so
+// that the rounding errors of the terms dominate it: BitsLost is log2 of
+// Σ|term| / |sum|, +Inf for an exact zero.
+type Cancellation struct {
+	Sum      Expr
+	BitsLost float64
+}
+
+// CorrectDigits returns the number of significant decimal digits of Value
+// that Bound guarantees, from 0 up to the float64 limit of about 15.95.
+func (r ErrorEstimate) CorrectDigits() float64 {
+	limit := 53 * math.Log10(2)
+	if r.Bound == 0 {
+		return limit
+	}
+	d := -math.Log10(r.Bound / math.Abs(r.Value))
+	if math.IsNaN(d) || d < 0 {
+		return 0
+	}
+	return math.Min(d, limit)
+}
+
+// EvalWithError evaluates e in float64 at the bindings and reports how
+// much of the result survives rounding: a rigorous error bound from
+// interval arithmetic, the condition number with respect to the bindings,
+// and the sums that suffer catastrophic cancellation. The bindings are
+// taken as exact. For example, 1 + x - 1 at x = 1e-12 keeps only about
+// three correct digits, although its condition number is 1, and the sum
+// is reported as losing 40 bits.
+// It fails when e cannot be evaluated, as EvalT does.
+func EvalWithError(e Expr, bindings map[string]float64) (ErrorEstimate, error) {
+	v, err := EvalTShared(e, bindings)
+	if err != nil {
+		return ErrorEstimate{}, err
+	}
+	r := ErrorEstimate{Value: v, Bound: math.Inf(1)}
+	env := make(map[string]Interval, len(bindings))
+	for k, x := range bindings {
+		env[k] = Interval{x, x}
+	}
+	if iv, err := EvalInShared[Interval](e, IntervalDomain{}, env); err == nil && !math.IsNaN(iv.Lo) && !math.IsNaN(iv.Hi) {
+		r.Bound = math.Max(0, math.Max(iv.Hi-v, v-iv.Lo))
+	}
+
+	sens := 0.0
+	for _, name := range FreeSymbols(e) {
+		x, ok := bindings[name]
+		if !ok || x == 0 {
+			continue
+		}
+		_, d, err := EvalDual(e, bindings, name)
+		if err != nil {
+			sens = math.NaN()
+			break
+		}
+		sens += math.Abs(x * d)
+	}
+	switch {
+	case math.IsNaN(sens) || sens == 0:
+		r.Condition = sens
+	case v == 0:
+		r.Condition = math.Inf(1)
+	default:
+		r.Condition = sens / math.Abs(v)
+	}
+
+	memo := map[Expr]float64{}
+	seen := map[Expr]bool{}
+	var walk func(Expr)
+	walk = func(e Expr) {
+		if seen[e] {
+			return
+		}
+		seen[e] = true
+		if a, ok := e.(*Add); ok {
+			sum, mag := 0.0, 0.0
+			for _, t := range a.terms {
+				x, err := evalIn[float64](t, nativeDomain[float64]{}, bindings, memo)
+				if err != nil {
+					mag = 0
+					break
+				}
+				sum, mag = sum+x, mag+math.Abs(x)
+			}
+			if lost := math.Log2(mag / math.Abs(sum)); mag > 0 && lost >= minCancelBits {
+				r.Cancellations = append(r.Cancellations, Cancellation{Sum: e, BitsLost: lost})
+			}
+		}
+		if _, ok := e.(binder); ok {
+			return
+		}
+		_, cs := labeledChildren(e)
+		for _, c := range cs {
+			walk(c)
+		}
+	}
+	walk(e)
+	return r, nil
+}
+
+// TaylorModel encloses a function f of one variable x over the interval
+// Over by a polynomial and an interval remainder: for every x in Over,
+// f(x) lies in P(x - Center) + Rem, where P has the coefficients Coeffs,
+// lowest degree first. The polynomial captures how f varies, so the
+// enclosure does not suffer the dependency problem of plain interval
+// arithmetic, where x - x over [0, 1] is [-1, 1].
+type TaylorModel struct {
+	Over   Interval
+	Center float64
+	Coeffs []float64
+	Rem    Interval
+}
+
+// offsets returns an enclosure of x - Center for x in Over.
+func (m TaylorModel) offsets() Interval {
+	return Interval{down(m.Over.Lo - m.Center), up(m.Over.Hi - m.Center)}
+}
+
+// boundPieces is the number of subintervals on which Bound evaluates the
+// polynomial.
+const boundPieces = 16
+
+// Bound returns an interval containing f(x) for every x in Over. The
+// polynomial is evaluated by Horner's rule in interval arithmetic on
+// boundPieces subintervals, which keeps the overestimate small.
+func (m TaylorModel) Bound() Interval {
+	iv := IntervalDomain{}
+	t := m.offsets()
+	var p Interval
+	for i := 0; i < boundPieces; i++ {
+		lo := t.Lo + (t.Hi-t.Lo)*float64(i)/boundPieces
+		hi := t.Lo + (t.Hi-t.Lo)*float64(i+1)/boundPieces
+		s := Interval{math.Max(t.Lo, down(lo)), math.Min(t.Hi, up(hi))}
+		if i == 0 {
+			s.Lo = t.Lo
+		}
+		if i == boundPieces-1 {
+			s.Hi = t.Hi
+		}
+		v := Interval{m.Coeffs[len(m.Coeffs)-1], m.Coeffs[len(m.Coeffs)-1]}
+		for k := len(m.Coeffs) - 2; k >= 0; k-- {
+			v = iv.Mul(v, s)
+			if c := m.Coeffs[k]; c != 0 {
+				v = iv.Add(v, Interval{c, c})
+			}
+		}
+		if i == 0 {
+			p = v
+		} else {
+			p = Interval{math.Min(p.Lo, v.Lo), math.Max(p.Hi, v.Hi)}
+		}
+	}
+	return iv.Add(p, m.Rem)
+}
+
+// Expr returns the polynomial part P(x - Center) with the coefficients
+// converted exactly to rationals, where x is the symbol varName.
+func (m TaylorModel) Expr(varName string) Expr {
+	t := (&Add{terms: []Expr{S(varName), numRat(new(big.Rat).SetFloat64(-m.Center))}}).Simplify()
+	terms := []Expr{N(0)}
+	for k, c := range m.Coeffs {
+		if c != 0 {
+			terms = append(terms, &Mul{factors: []Expr{numRat(new(big.Rat).SetFloat64(c)), &Pow{base: t, exp: N(int64(k))}}})
+		}
+	}
+	return (&Add{terms: terms}).Simplify()
+}
+
+// TaylorModelDomain is Taylor-model arithmetic for EvalIn: each value is
+// a TaylorModel of degree at most Order over Over, expanded about the
+// midpoint of Over. Sums and products multiply the polynomials and move
+// the terms above Order, and all rounding errors, into the remainder.
+// Functions and non-integer powers compose their Taylor expansion about
+// the constant term of the argument with it and bound the Lagrange
+// remainder by interval arithmetic. Where that fails, e.g. abs over an
+// interval containing 0, the value degrades to a constant model holding
+// the interval enclosure. Bind the variable to Var().
+type TaylorModelDomain struct {
+	Order int
+	Over  Interval
+}
+
+func (d TaylorModelDomain) order() int { return max(d.Order, 0) }
+
+func (d TaylorModelDomain) center() float64 { return d.Over.Lo/2 + d.Over.Hi/2 }
+
+// Var returns the model of the variable itself, x = Center + (x - Center).
+func (d TaylorModelDomain) Var() TaylorModel {
+	c := d.center()
+	return d.sweep([]Interval{{c, c}, {1, 1}}, Interval{})
+}
+
+// sweep rounds the coefficient enclosures cs to floats and drops the
+// terms above Order, adding what is lost to the remainder rem.
+func (d TaylorModelDomain) sweep(cs []Interval, rem Interval) TaylorModel {
+	iv := IntervalDomain{}
+	m := TaylorModel{Over: d.Over, Center: d.center(), Coeffs: make([]float64, min(len(cs), d.order()+1))}
+	t := m.offsets()
+	for k, c := range cs {
+		p := c.Lo/2 + c.Hi/2
+		if k >= len(m.Coeffs) || math.IsInf(p, 0) || math.IsNaN(p) {
+			p = 0
+		}
+		if k < len(m.Coeffs) {
+			m.Coeffs[k] = p
+		}
+		if c.Lo == p && c.Hi == p {
+			continue
+		}
+		tk := Interval{1, 1}
+		if k > 0 {
+			tk, _ = iv.Pow(t, Interval{float64(k), float64(k)})
+		}
+		rem = iv.Add(rem, iv.Mul(Interval{down(c.Lo - p), up(c.Hi - p)}, tk))
+	}
+	if len(m.Coeffs) == 0 {
+		m.Coeffs = []float64{0}
+	}
+	m.Rem = rem
+	return m
+}
+
+func (d TaylorModelDomain) constant(c Interval) TaylorModel {
+	return d.sweep([]Interval{c}, Interval{})
+}
+
+func (d TaylorModelDomain) FromRat(r *big.Rat) TaylorModel {
+	return d.constant(IntervalDomain{}.FromRat(r))
+}
+
+func (d TaylorModelDomain) FromFloat(f float64) TaylorModel {
+	return d.constant(IntervalDomain{}.FromFloat(f))
+}
+
+func (d TaylorModelDomain) Add(a, b TaylorModel) TaylorModel {
+	iv := IntervalDomain{}
+	cs := make([]Interval, max(len(a.Coeffs), len(b.Coeffs)))
+	for k := range cs {
+		var x, y float64
+		if k < len(a.Coeffs) {
+			x = a.Coeffs[k]
+		}
+		if k < len(b.Coeffs) {
+			y = b.Coeffs[k]
+		}
+		cs[k] = iv.Add(Interval{x, x}, Interval{y, y})
+	}
+	return d.sweep(cs, iv.Add(a.Rem, b.Rem))
+}
+
+// Mul multiplies the polynomials and bounds the remainder of the product
+// by P_a·R_b + P_b·R_a + R_a·R_b.
+func (d TaylorModelDomain) Mul(a, b TaylorModel) TaylorModel {
+	iv := IntervalDomain{}
+	cs := make([]Interval, len(a.Coeffs)+len(b.Coeffs)-1)
+	for i, x := range a.Coeffs {
+		for j, y := range b.Coeffs {
+			cs[i+j] = iv.Add(cs[i+j], iv.Mul(Interval{x, x}, Interval{y, y}))
+		}
+	}
+	pa, pb := a, b
+	pa.Rem, pb.Rem = Interval{}, Interval{}
+	rem := iv.Add(iv.Add(iv.Mul(pa.Bound(), b.Rem), iv.Mul(pb.Bound(), a.Rem)), iv.Mul(a.Rem, b.Rem))
+	return d.sweep(cs, rem)
+}
+
+// maxTaylorPower bounds the integer powers that Pow computes by repeated
+// multiplication; larger ones are composed like non-integer powers.
+const maxTaylorPower = 64
+
+func (d TaylorModelDomain) Pow(base, exp TaylorModel) (TaylorModel, error) {
+	iv := IntervalDomain{}
+	e := exp.Bound()
+	if n := exp.Coeffs[0]; len(exp.Coeffs) == 1 && exp.Rem == (Interval{}) && !math.IsInf(n, 0) {
+		e = Interval{n, n}
+		if n == math.Trunc(n) && math.Abs(n) <= maxTaylorPower {
+			if n < 0 {
+				inv, err := d.compose(&Pow{base: S("u"), exp: N(-1)}, base, func(x Interval) (Interval, error) {
+					return iv.Pow(x, Interval{-1, -1})
+				})
+				if err != nil {
+					return TaylorModel{}, err
+				}
+				base, n = inv, -n
+			}
+			r := d.constant(Interval{1, 1})
+			for ; n > 0; n-- {
+				r = d.Mul(r, base)
+			}
+			return r, nil
+		}
+		return d.compose(&Pow{base: S("u"), exp: numRat(new(big.Rat).SetFloat64(n))}, base, func(x Interval) (Interval, error) {
+			return iv.Pow(x, e)
+		})
+	}
+	l, err := d.Apply("ln", base)
+	if err != nil {
+		return TaylorModel{}, err
+	}
+	return d.Apply("exp", d.Mul(exp, l))
+}
+
+// Cmp orders models whose bounds are disjoint, as IntervalDomain does.
+func (d TaylorModelDomain) Cmp(a, b TaylorModel) (int, bool) {
+	return IntervalDomain{}.Cmp(a.Bound(), b.Bound())
+}
+
+func (d TaylorModelDomain) Apply(name string, x TaylorModel) (TaylorModel, error) {
+	iv := IntervalDomain{}
+	if (name == "abs" || name == "sign") && x.Bound().Contains(0) {
+		// Not differentiable at 0: keep only the interval enclosure.
+		r, err := iv.Apply(name, x.Bound())
+		if err != nil {
+			return TaylorModel{}, err
+		}
+		return d.constant(r), nil
+	}
+	r, err := d.compose(&Func{name: name, args: []Expr{S("u")}}, x, func(r Interval) (Interval, error) {
+		return iv.Apply(name, r)
+	})
+	if err != nil {
+		return TaylorModel{}, err
+	}
+	if b := r.Bound(); (name == "sin" || name == "cos") && b.Hi-b.Lo > 2 {
+		// The model says less than |sin| <= 1, as for a huge argument
+		// whose rounding swamps the series.
+		e, err := iv.Apply(name, x.Bound())
+		return d.constant(e), err
+	}
+	return r, nil
+}
+
+// compose returns the model of g(x) for g in the symbol u: with x = c + h,
+// where c is the constant coefficient of x, it is the Taylor polynomial
+// Σ g⁽ᵏ⁾(c)/k!·hᵏ up to Order, evaluated in model arithmetic, plus the
+// Lagrange remainder g⁽ⁿ⁺¹⁾(ξ)/(n+1)!·hⁿ⁺¹ with ξ enclosed by the bound
+// of x. When a derivative cannot be enclosed, the result is the constant
+// model of fallback applied to the bound of x.
+func (d TaylorModelDomain) compose(g Expr, x TaylorModel, fallback func(Interval) (Interval, error)) (TaylorModel, error) {
+	iv := IntervalDomain{}
+	n := d.order()
+	c := x.Coeffs[0]
+	h := x
+	h.Coeffs = append([]float64{0}, x.Coeffs[1:]...)
+	rx, rh := x.Bound(), h.Bound()
+	xi := Interval{math.Min(rx.Lo, c), math.Max(rx.Hi, c)}
+	cs := make([]Interval, n+2)
+	for k := 0; k <= n+1; k++ {
+		at := Interval{c, c}
+		if k == n+1 {
+			at = xi
+		}
+		v, err := EvalIn[Interval](g, iv, map[string]Interval{"u": at})
+		if err != nil || math.IsNaN(v.Lo) || math.IsNaN(v.Hi) || math.IsInf(v.Lo, 0) || math.IsInf(v.Hi, 0) {
+			r, err := fallback(rx)
+			if err != nil {
+				return TaylorModel{}, err
+			}
+			return d.constant(r), nil
+		}
+		fact := new(big.Int).MulRange(1, int64(k))
+		cs[k] = iv.Mul(v, iv.FromRat(new(big.Rat).SetFrac(big.NewInt(1), fact)))
+		if k <= n {
+			g = g.Diff("u").Simplify()
+		}
+	}
+	r := d.constant(cs[n])
+	for k := n - 1; k >= 0; k-- {
+		r = d.Add(d.Mul(r, h), d.constant(cs[k]))
+	}
+	hn, err := iv.Pow(rh, Interval{float64(n + 1), float64(n + 1)})
+	if err != nil {
+		return TaylorModel{}, err
+	}
+	r.Rem = iv.Add(r.Rem, iv.Mul(cs[n+1], hn))
+	// Far from the origin, as in sin(10^100 + x), the rounding of c swamps
+	// the series and its bound overflows; the plain enclosure is then the
+	// better model.
+	if b := r.Bound(); math.IsInf(b.Hi-b.Lo, 0) || math.IsNaN(b.Hi-b.Lo) {
+		if f, err := fallback(rx); err == nil {
+			return d.constant(f), nil
+		}
+	}
+	return r, nil
+}
+
+// TaylorModelOf returns the Taylor model of the given order of e as a
+// function of varName over the interval over. Symbols other than varName
+// must be substituted first. Its Bound encloses the range of e over the
+// interval, usually much more tightly than EvalIn with IntervalDomain:
+// for x - x^2 over [0, 1] the order-2 model is bounded by [0, 0.25] up to
+// rounding, while interval arithmetic gives [-1, 1].
+func TaylorModelOf(e Expr, varName string, over Interval, order int) (TaylorModel, error) {
+	if over.Lo > over.Hi || math.IsInf(over.Lo, 0) || math.IsInf(over.Hi, 0) || math.IsNaN(over.Lo) || math.IsNaN(over.Hi) {
+		return TaylorModel{}, fmt.Errorf("taylor model: invalid interval [%g, %g]", over.Lo, over.Hi)
+	}
+	d := TaylorModelDomain{Order: order, Over: over}
+	return EvalInShared[TaylorModel](e, d, map[string]TaylorModel{varName: d.Var()})
+}
+
+// ============================================================
+// Compiled evaluation
+// ============================================================
+
+// Program is an expression compiled to stack-machine bytecode for
+// repeated float64 evaluation, e.g. in Monte Carlo loops that evaluate the
+// same expression at millions of sample points. Exec does not allocate.
+//
+// A Program owns a scratch stack, so it must not be used by several
+// goroutines at once; give each goroutine its own Clone.
+type Program struct {
+	code   []instr
+	consts []float64
+	funcs  []func(float64) float64
+	funcsN []func([]float64) float64
+	arity  []int
+	params []string
+	stack  []float64
+}
+
+type opcode uint8
+
+const (
+	opConst  opcode = iota // push consts[arg]
+	opParam                // push args[arg]
+	opAdd                  // pop b, a; push a + b
+	opSub                  // pop b, a; push a - b
+	opMul                  // pop b, a; push a * b
+	opDiv                  // pop b, a; push a / b
+	opPow                  // pop b, a; push a^b
+	opNeg                  // negate the top
+	opSquare               // square the top
+	opSqrt                 // replace the top by its square root
+	opFunc                 // apply funcs[arg] to the top
+	opFuncN                // pop arity[arg] values; push funcsN[arg] of them
+)
+
+type instr struct {
+	op  opcode
+	arg int
+}
+
+// CompileProgram compiles e for evaluation by Program.Exec, whose
+// arguments bind the symbols in paramOrder by position. Subexpressions
+// without parameters are evaluated once at compile time, and functions are
+// looked up in the registry once, so later registrations do not affect the
+// program. Results agree with EvalT[float64] up to rounding.
+//
+// It is an error for e to contain a symbol missing from paramOrder, an
+// unknown function, or an Integral whose bounds or integrand depend on a
+// parameter.
+func CompileProgram(e Expr, paramOrder []string) (*Program, error) {
+	c := &programCompiler{
+		p:     &Program{params: append([]string(nil), paramOrder...)},
+		index: make(map[string]int, len(paramOrder)),
+	}
+	for i, name := range paramOrder {
+		if _, dup := c.index[name]; dup {
+			return nil, fmt.Errorf("duplicate parameter %q", name)
+		}
+		c.index[name] = i
+	}
+	if err := c.compile(e); err != nil {
+		return nil, err
+	}
+	c.p.stack = make([]float64, c.maxDepth)
+	return c.p, nil
+}
+
+// Params returns the parameter names in argument order.
+func (p *Program) Params() []string { return append([]string(nil), p.params...) }
+
+// Len returns the number of instructions.
+func (p *Program) Len() int { return len(p.code) }
+
+// Clone returns a Program sharing p's bytecode with its own scratch stack.
+func (p *Program) Clone() *Program {
+	q := *p
+	q.stack = make([]float64, len(p.stack))
+	return &q
+}
+
+// Exec evaluates the program with args[i] bound to the i-th parameter.
+// It is an error for len(args) to differ from the number of parameters.
+func (p *Program) Exec(args []float64) (float64, error) {
+	if len(args) != len(p.params) {
+		return 0, fmt.Errorf("program: %d arguments for %d parameters", len(args), len(p.params))
+	}
+	s, n := p.stack, 0
+	for _, in := range p.code {
+		switch in.op {
+		case opConst:
+			s[n] = p.consts[in.arg]
+			n++
+		case opParam:
+			s[n] = args[in.arg]
+			n++
+		case opAdd:
+			n--
+			s[n-1] += s[n]
+		case opSub:
+			n--
+			s[n-1] -= s[n]
+		case opMul:
+			n--
+			s[n-1] *= s[n]
+		case opDiv:
+			n--
+			s[n-1] /= s[n]
+		case opPow:
+			n--
+			s[n-1] = math.Pow(s[n-1], s[n])
+		case opNeg:
+			s[n-1] = -s[n-1]
+		case opSquare:
+			s[n-1] *= s[n-1]
+		case opSqrt:
+			s[n-1] = math.Sqrt(s[n-1])
+		case opFunc:
+			s[n-1] = p.funcs[in.arg](s[n-1])
+		case opFuncN:
+			k := p.arity[in.arg]
+			s[n-k] = p.funcsN[in.arg](s[n-k : n])
+			n -= k - 1
+		}
+	}
+	return s[0], nil
+}
+
+type programCompiler struct {
+	p               *Program
+	index           map[string]int
+	depth, maxDepth int
+	consts          map[float64]int
+}
+
+// emit appends an instruction and tracks the stack depth it leaves.
+func (c *programCompiler) emit(op opcode, arg int) {
+	c.p.code = append(c.p.code, instr{op, arg})
+	switch op {
+	case opConst, opParam:
+		c.depth++
+		c.maxDepth = max(c.maxDepth, c.depth)
+	case opAdd, opSub, opMul, opDiv, opPow:
+		c.depth--
+	case opFuncN:
+		c.depth -= c.p.arity[arg] - 1
+	}
+}
+
+func (c *programCompiler) constant(v float64) {
+	i, ok := c.consts[v]
+	if !ok || math.IsNaN(v) {
+		if c.consts == nil {
+			c.consts = map[float64]int{}
+		}
+		i = len(c.p.consts)
+		c.p.consts = append(c.p.consts, v)
+		c.consts[v] = i
+	}
+	c.emit(opConst, i)
+}
+
+func (c *programCompiler) compile(e Expr) error {
+	if s, ok := e.(*Sym); ok {
+		i, ok := c.index[s.name]
+		if !ok {
+			return fmt.Errorf("unbound symbol %q", s.name)
+		}
+		c.emit(opParam, i)
+		return nil
+	}
+	if len(FreeSymbols(e)) == 0 {
+		v, ok := evalFloat(e, nil)
+		if !ok {
+			return fmt.Errorf("cannot evaluate %s", e)
+		}
+		c.constant(v)
+		return nil
+	}
+	switch t := e.(type) {
+	case *Add:
+		return c.fold(t.terms, func(x Expr) (Expr, opcode) {
+			if m, ok := x.(*Mul); ok && len(m.factors) > 1 && isNumValue(m.factors[0], -1) {
+				return productOf(m.factors[1:]), opSub
+			}
+			return x, opAdd
+		})
+	case *Mul:
+		if len(t.factors) > 1 && isNumValue(t.factors[0], -1) {
+			if err := c.compile(productOf(t.factors[1:])); err != nil {
+				return err
+			}
+			c.emit(opNeg, 0)
+			return nil
+		}
+		return c.fold(t.factors, func(x Expr) (Expr, opcode) {
+			if p, ok := x.(*Pow); ok && isNumValue(p.exp, -1) {
+				return p.base, opDiv
+			}
+			return x, opMul
+		})
+	case *Pow:
+		if err := c.compile(t.base); err != nil {
+			return err
+		}
+		switch {
+		case isNumValue(t.exp, 2):
+			c.emit(opSquare, 0)
+			return nil
+		case isNumValue(t.exp, 0.5):
+			c.emit(opSqrt, 0)
+			return nil
+		}
+		if err := c.compile(t.exp); err != nil {
+			return err
+		}
+		c.emit(opPow, 0)
+		return nil
+	case *Func:
+		d := lookupFunc(t.name)
+		if d == nil {
+			return fmt.Errorf("unknown function %q", t.name)
+		}
+		for _, a := range t.args {
+			if err := c.compile(a); err != nil {
+				return err
+			}
+		}
+		if len(t.args) > 1 {
+			c.p.funcsN = append(c.p.funcsN, d.EvalN)
+			c.p.arity = append(c.p.arity, len(t.args))
+			c.emit(opFuncN, len(c.p.funcsN)-1)
+			return nil
+		}
+		c.p.funcs = append(c.p.funcs, d.Eval)
+		c.emit(opFunc, len(c.p.funcs)-1)
+		return nil
+	case *Annotated:
+		return c.compile(t.expr)
+	}
+	return fmt.Errorf("cannot compile %T with parameters", e)
+}
+
+// fold compiles a sum or product left to right. After the first operand,
+// split may rewrite an operand as a cheaper operation on a simpler one: a
+// term -u becomes a subtraction and a factor u^-1 a division.
+func (c *programCompiler) fold(es []Expr, split func(Expr) (Expr, opcode)) error {
+	for i, x := range es {
+		var op opcode
+		if i > 0 {
+			x, op = split(x)
+		}
+		if err := c.compile(x); err != nil {
+			return err
+		}
+		if i > 0 {
+			c.emit(op, 0)
+		}
+	}
+	return nil
+}
+
+func productOf(fs []Expr) Expr {
+	if len(fs) == 1 {
+		return fs[0]
+	}
+	return &Mul{factors: fs}
+}
+
+// ============================================================
+// Fluent builder
+// ============================================================
+
+// Builder wraps an expression with chainable construction methods, so
+//
+//	B(x).Add(y).Pow(N(2)).Mul(SinOf(x)).Expr()
+//
+// reads left to right instead of as nested AddOf/PowOf/MulOf calls. Each
+// method returns a new Builder; the wrapped expression is never modified.
+// A Builder is not itself an Expr: call Expr to get the result.
+type Builder struct {
+	e Expr
+}
+
+// B starts a chain at e.
+func B(e Expr) Builder { return Builder{e: e} }
+
+// Expr returns the built expression.
+func (b Builder) Expr() Expr { return b.e }
+
+// Add returns b + terms.
+func (b Builder) Add(terms ...Expr) Builder {
+	return B(AddOf(append([]Expr{b.e}, terms...)...))
+}
+
+// Sub returns b - other.
+func (b Builder) Sub(other Expr) Builder { return B(AddOf(b.e, Neg(other))) }
+
+// Mul returns b * factors.
+func (b Builder) Mul(factors ...Expr) Builder {
+	return B(MulOf(append([]Expr{b.e}, factors...)...))
+}
+
+// Div returns b / other.
+func (b Builder) Div(other Expr) Builder { return B(MulOf(b.e, PowOf(other, N(-1)))) }
+
+// Pow returns b^exp.
+func (b Builder) Pow(exp Expr) Builder { return B(PowOf(b.e, exp)) }
+
+// Neg returns -b.
+func (b Builder) Neg() Builder { return B(Neg(b.e)) }
+
+// Apply returns name(b) for a registered function name; it panics like
+// FuncOf for unknown names.
+func (b Builder) Apply(name string) Builder { return B(FuncOf(name, b.e)) }
+
+// Simplify returns the simplified expression.
+func (b Builder) Simplify() Builder { return B(b.e.Simplify()) }
+
+// Expand returns Expand(b).
+func (b Builder) Expand() Builder { return B(Expand(b.e)) }
+
+// Diff returns the simplified derivative with respect to varName.
+func (b Builder) Diff(varName string) Builder { return B(Diff(b.e, varName)) }
+
+// Replace substitutes value for varName and simplifies, like Sub.
+func (b Builder) Replace(varName string, value Expr) Builder { return B(Sub(b.e, varName, value)) }
+
+// String returns the expression's string form.
+func (b Builder) String() string { return b.e.String() }
+
+// LaTeX returns the expression's LaTeX form.
+func (b Builder) LaTeX() string { return b.e.LaTeX() }
+
+// ============================================================
+// Calculus
+// ============================================================
+
+// Diff returns the simplified derivative of e with respect to varName.
+// Further variables differentiate the result in turn, so
+// Diff(e, "x", "y", "x") is the mixed partial ∂³e/∂x∂y∂x.
+func Diff(e Expr, varName string, more ...string) Expr {
+	out := e.Diff(varName).Simplify()
+	for _, v := range more {
+		out = out.Diff(v).Simplify()
+	}
+	return out
+}
+
+// Diff2 returns the simplified second derivative of e with respect to varName.
+func Diff2(e Expr, varName string) Expr {
+	return DiffN(e, varName, 2)
+}
+
+// DiffN returns the simplified nth derivative of e with respect to varName.
+func DiffN(e Expr, varName string, n int) Expr {
+	out := e.Simplify()
+	for i := 0; i < n; i++ {
+		out = Diff(out, varName)
+	}
+	return out
+}
+
+// Gradient returns the simplified partial derivatives of e with respect to
+// vars, in order.
+func Gradient(e Expr, vars ...string) []Expr {
+	e = e.Simplify()
+	out := make([]Expr, len(vars))
+	for i, v := range vars {
+		out[i] = Diff(e, v)
+	}
+	return out
+}
+
+// DiffMany returns the simplified derivatives of exprs with respect to
+// varName, in order, as GradientMany does for a single variable.
+func DiffMany(exprs []Expr, varName string) []Expr {
+	rows := GradientMany(exprs, varName)
+	out := make([]Expr, len(rows))
+	for i, r := range rows {
+		out[i] = r[0]
+	}
+	return out
+}
+
+// GradientMany returns Gradient(e, vars...) for each of exprs, in order,
+// which for a system of equations is the Jacobian by rows. The
+// expressions are differentiated in parallel on GOMAXPROCS goroutines, and
+// expressions that print alike, such as the same equation in several
+// places of a model, are simplified and differentiated once and share the
+// result. Annotated expressions are never shared, since their metadata
+// may differ. A panic while differentiating is re-raised in the caller.
+func GradientMany(exprs []Expr, vars ...string) [][]Expr {
+	slot := make([]int, len(exprs))
+	seen := map[string]int{}
+	var distinct []Expr
+	for i, e := range exprs {
+		key := e.String()
+		if n, ok := seen[key]; ok {
+			slot[i] = n
+			continue
+		}
+		if len(Annotations(e)) == 0 {
+			seen[key] = len(distinct)
+		}
+		slot[i] = len(distinct)
+		distinct = append(distinct, e)
+	}
+	grads := make([][]Expr, len(distinct))
+	parallelFor(len(distinct), func(i int) { grads[i] = Gradient(distinct[i], vars...) })
+	out := make([][]Expr, len(exprs))
+	for i, n := range slot {
+		out[i] = append([]Expr(nil), grads[n]...)
+	}
+	return out
+}
+
+// parallelFor calls f(0), …, f(n-1) on up to GOMAXPROCS goroutines and
+// returns when all calls have. The first panic in f is re-raised.
+func parallelFor(n int, f func(i int)) {
+	var (
+		next    atomic.Int64
+		wg      sync.WaitGroup
+		once    sync.Once
+		failure interface{}
+	)
+	for w := min(runtime.GOMAXPROCS(0), n); w > 0; w-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					once.Do(func() { failure = r })
+				}
+			}()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+// DiffShared is Diff for expressions that share subtrees. Each distinct
+// node, identified by pointer, is differentiated once, and the derivative
+// refers to the nodes of e instead of copying them, so its size in memory
+// follows the number of unique nodes of e rather than the size of the
+// expanded tree. The result is simplified with SimplifyShared. Sums,
+// products, powers and function applications are handled node by node;
+// other nodes, such as integrals and piecewise expressions, use their own
+// Diff.
+func DiffShared(e Expr, varName string) Expr {
+	d := &sharedDiff{v: varName, memo: map[Expr]Expr{}}
+	return SimplifyShared(d.diff(e))
+}
+
+type sharedDiff struct {
+	v    string
+	memo map[Expr]Expr
+}
+
+func (s *sharedDiff) diff(e Expr) Expr {
+	if r, ok := s.memo[e]; ok {
+		return r
+	}
+	r := s.node(e)
+	s.memo[e] = r
+	return r
+}
+
+// node differentiates e by the rules of the Diff methods. It builds plain
+// nodes, since the light rules of mkAdd and mkMul would flatten shared
+// sums and products into copies, and it drops zero terms instead of
+// calling dependsOn, which walks the expanded tree.
+func (s *sharedDiff) node(e Expr) Expr {
+	var terms []Expr
+	switch t := e.(type) {
+	case *Add:
+		for _, c := range t.terms {
+			if d := s.diff(c); !isNumValue(d, 0) {
+				terms = append(terms, d)
+			}
+		}
+	case *Mul:
+		for i, f := range t.factors {
+			d := s.diff(f)
+			if isNumValue(d, 0) {
+				continue
+			}
+			fs := append([]Expr(nil), t.factors...)
+			fs[i] = d
+			terms = append(terms, &Mul{factors: fs})
+		}
+	case *Pow:
+		// d/dx u^v = v*u^(v-1)*u' + u^v*ln(u)*v'
+		if d := s.diff(t.base); !isNumValue(d, 0) {
+			terms = append(terms, &Mul{factors: []Expr{t.exp, &Pow{base: t.base, exp: &Add{terms: []Expr{t.exp, N(-1)}}}, d}})
+		}
+		if d := s.diff(t.exp); !isNumValue(d, 0) {
+			terms = append(terms, &Mul{factors: []Expr{t, &Func{name: "ln", args: []Expr{t.base}}, d}})
+		}
+	case *Func:
+		fd := lookupFunc(t.name)
+		for i, a := range t.args {
+			d := s.diff(a)
+			if isNumValue(d, 0) {
+				continue
+			}
+			var p Expr
+			switch {
+			case fd != nil && len(t.args) == 1 && fd.Deriv != nil:
+				p = fd.Deriv(a)
+			case fd != nil && len(t.args) > 1 && fd.DerivN != nil:
+				p = fd.DerivN(t.args, i)
+			default:
+				panic("gosymbol: no derivative rule for " + t.name)
+			}
+			terms = append(terms, &Mul{factors: []Expr{p, d}})
+		}
+	case *UndefFunc:
+		if d := s.diff(t.arg); !isNumValue(d, 0) {
+			terms = append(terms, &Mul{factors: []Expr{&UndefFunc{name: t.name, order: t.order + 1, arg: t.arg}, d}})
+		}
+	default:
+		return e.Diff(s.v)
+	}
+	switch len(terms) {
+	case 0:
+		return N(0)
+	case 1:
+		return terms[0]
+	}
+	return &Add{terms: terms}
+}
+
+// Integrate computes an antiderivative of e with respect to varName using a
+// fixed set of rules. It reports false when no rule applies.
+func Integrate(e Expr, varName string) (Expr, bool) {
+	r, _, ok := integrateTraced(e, varName, false)
+	return r, ok
+}
+
+// integrateTraced runs Integrate, collecting the rule steps when trace is
+// set. Steps from a failed attempt on the unexpanded form are discarded.
+func integrateTraced(e Expr, varName string, trace bool) (Expr, []Step, bool) {
+	var steps []Step
+	rec := func() *[]Step {
+		if !trace {
+			return nil
+		}
+		steps = steps[:0]
+		return &steps
+	}
+	s := StripMeta(e).Simplify()
+	if r, ok := integrate(s, varName, rec()); ok {
+		return r.Simplify(), steps, true
+	}
+	ex := Expand(s)
+	if ex.String() != s.String() {
+		if r, ok := integrate(ex, varName, rec()); ok {
+			if trace {
+				expand := Step{Rule: "expand", Before: s, After: ex, LaTeX: s.LaTeX() + " = " + ex.LaTeX()}
+				steps = append([]Step{expand}, steps...)
+			}
+			return r.Simplify(), steps, true
+		}
+	}
+	ce := combineExps(ex).Simplify()
+	if ce.String() != ex.String() {
+		if r, ok := integrate(ce, varName, rec()); ok {
+			if trace {
+				combine := Step{Rule: "combine exponentials", Before: s, After: ce, LaTeX: s.LaTeX() + " = " + ce.LaTeX()}
+				steps = append([]Step{combine}, steps...)
+			}
+			return r.Simplify(), steps, true
+		}
+	}
+	if pf := Apart(s, varName); pf.String() != s.String() {
+		if r, ok := integrate(pf, varName, rec()); ok {
+			if trace {
+				apart := Step{Rule: "partial fractions", Before: s, After: pf, LaTeX: s.LaTeX() + " = " + pf.LaTeX()}
+				steps = append([]Step{apart}, steps...)
+			}
+			return r.Simplify(), steps, true
+		}
+	}
+	return nil, nil, false
+}
+
+// combineExps rewrites products of exponentials exp(a)*exp(b) in e as
+// exp(a + b), expanding the combined argument.
+func combineExps(e Expr) Expr {
+	switch t := e.(type) {
+	case *Add:
+		terms := make([]Expr, len(t.terms))
+		for i, x := range t.terms {
+			terms[i] = combineExps(x)
+		}
+		return &Add{terms: terms}
+	case *Mul:
+		var rest, args []Expr
+		for _, f := range t.factors {
+			if fn, ok := f.(*Func); ok && fn.name == "exp" {
+				args = append(args, fn.args[0])
+				continue
+			}
+			rest = append(rest, f)
+		}
+		if len(args) < 2 {
+			return e
+		}
+		return &Mul{factors: append(rest, &Func{name: "exp", args: []Expr{Expand(&Add{terms: args})}})}
+	}
+	return e
+}
+
+// integrate returns an unsimplified antiderivative of e. When steps is
+// non-nil each rule application is appended to it, innermost first.
+func integrate(e Expr, v string, steps *[]Step) (Expr, bool) {
+	r, rule, ok := integrateRule(e, v, steps)
+	if ok && steps != nil {
+		after := r.Simplify()
+		tex := fmt.Sprintf(`\int %s \, d%s = %s`, e.LaTeX(), S(v).LaTeX(), after.LaTeX())
+		*steps = append(*steps, Step{Rule: rule, Before: e, After: after, LaTeX: tex})
+	}
+	return r, ok
+}
+
+// integrateRule applies one integration rule to e and names it. Rules for
+// a linear inner argument other than v itself are reported as "linear
+// substitution (rule)".
+func integrateRule(e Expr, v string, steps *[]Step) (Expr, string, bool) {
+	x := S(v)
+	if !dependsOn(e, v) {
+		return &Mul{factors: []Expr{e, x}}, "constant", true
+	}
+	substituted := func(rule string, inner Expr) string {
+		if isSym(inner, v) {
+			return rule
+		}
+		return "linear substitution (" + rule + ")"
+	}
+	switch e.(type) {
+	case *Pow, *Mul:
+		if r, ok := integrateQuadraticFraction(e, v); ok {
+			return r, "quadratic denominator", true
+		}
+	}
+	switch t := e.(type) {
+	case *Sym:
+		return &Mul{factors: []Expr{F(1, 2), &Pow{base: x, exp: N(2)}}}, "power", true
+	case *UndefFunc:
+		if t.order > 0 && isSym(t.arg, v) {
+			return &UndefFunc{name: t.name, order: t.order - 1, arg: t.arg}, "derivative", true
+		}
+		return nil, "", false
+	case *Add:
+		out := make([]Expr, len(t.terms))
+		for i, term := range t.terms {
+			r, ok := integrate(term, v, steps)
+			if !ok {
+				return nil, "", false
+			}
+			out[i] = r
+		}
+		return &Add{terms: out}, "sum", true
+	case *Mul:
+		var consts, deps []Expr
+		for _, f := range t.factors {
+			if dependsOn(f, v) {
+				deps = append(deps, f)
+			} else {
+				consts = append(consts, f)
+			}
+		}
+		if len(deps) != 1 {
+			return nil, "", false
+		}
+		r, ok := integrate(deps[0], v, steps)
+		if !ok {
+			return nil, "", false
+		}
+		if p, ok := r.(*Piecewise); ok {
+			// Keep the cases at the top so that Simplify can prune them.
+			q := &Piecewise{cases: make([]PieceCase, len(p.cases)), otherwise: &Mul{factors: append(consts, p.otherwise)}}
+			for i, c := range p.cases {
+				q.cases[i] = PieceCase{&Mul{factors: append(append([]Expr(nil), consts...), c.Value)}, c.Cond}
+			}
+			return q, "constant multiple", true
+		}
+		return &Mul{factors: append(consts, r)}, "constant multiple", true
+	case *Pow:
+		if !dependsOn(t.exp, v) {
+			a, ok := linearCoeff(t.base, v)
+			if !ok {
+				return nil, "", false
+			}
+			log := div(&Func{name: "ln", args: []Expr{&Func{name: "abs", args: []Expr{t.base}}}}, a)
+			if isNumValue(t.exp.Simplify(), -1) {
+				// ∫ 1/(a*x+b) dx = ln|a*x+b|/a
+				return unlessZero(log, a, &Mul{factors: []Expr{t, x}}), substituted("reciprocal", t.base), true
+			}
+			n1 := &Add{terms: []Expr{t.exp, N(1)}}
+			r := unlessZero(div(&Pow{base: t.base, exp: n1}, &Mul{factors: []Expr{n1, a}}), n1, log)
+			return unlessZero(r, a, &Mul{factors: []Expr{t, x}}), substituted("power", t.base), true
+		}
+		if !dependsOn(t.base, v) {
+			// ∫ c^(a*x+b) dx = c^(a*x+b)/(a*ln(c))
+			a, ok := linearCoeff(t.exp, v)
+			if !ok {
+				return nil, "", false
+			}
+			r := unlessZero(div(t, &Mul{factors: []Expr{a, &Func{name: "ln", args: []Expr{t.base}}}}), sub(t.base, N(1)), x)
+			return unlessZero(r, a, &Mul{factors: []Expr{t, x}}), substituted("exponential", t.exp), true
+		}
+	case *Func:
+		if len(t.args) != 1 {
+			return nil, "", false
+		}
+		a, ok := linearCoeff(t.args[0], v)
+		if !ok {
+			return nil, "", false
+		}
+		u := t.args[0]
+		var r Expr
+		switch t.name {
+		case "sin":
+			r = neg(&Func{name: "cos", args: []Expr{u}})
+		case "cos":
+			r = &Func{name: "sin", args: []Expr{u}}
+		case "tan":
+			r = neg(&Func{name: "ln", args: []Expr{&Func{name: "abs", args: []Expr{&Func{name: "cos", args: []Expr{u}}}}}})
+		case "exp":
+			r = t
+		case "ln":
+			r = sub(&Mul{factors: []Expr{u, t}}, u)
+		default:
+			return nil, "", false
+		}
+		return unlessZero(div(r, a), a, &Mul{factors: []Expr{t, x}}), substituted(t.name, u), true
+	case *Piecewise:
+		for _, c := range t.cases {
+			if dependsOn(c.Cond.Lhs, v) || dependsOn(c.Cond.Rhs, v) {
+				return nil, "", false
+			}
+		}
+		q := &Piecewise{cases: make([]PieceCase, len(t.cases))}
+		for i, c := range t.cases {
+			r, ok := integrate(c.Value, v, steps)
+			if !ok {
+				return nil, "", false
+			}
+			q.cases[i] = PieceCase{r, c.Cond}
+		}
+		r, ok := integrate(t.otherwise, v, steps)
+		if !ok {
+			return nil, "", false
+		}
+		q.otherwise = r
+		return q, "piecewise", true
+	}
+	return nil, "", false
+}
+
+// integrateQuadraticFraction integrates (p*x + q)/(a*x^2 + b*x + c) with
+// rational coefficients and b^2 - 4*a*c < 0, the terms Apart leaves over
+// irreducible quadratics, as a logarithm plus an arctangent:
+//
+//	p/(2a)*ln(a*x^2 + b*x + c) + (2q - p*b/a)/√D * atan((2a*x + b)/√D)
+//
+// with D = 4*a*c - b^2, after making a positive.
+func integrateQuadraticFraction(e Expr, v string) (Expr, bool) {
+	num, den := numerDenom(e)
+	n, ok1 := ratPoly(num, v)
+	d, ok2 := ratPoly(den, v)
+	if !ok1 || !ok2 || len(d) != 3 || len(n) > 2 {
+		return nil, false
+	}
+	if d[2].Sign() < 0 {
+		for _, k := range append(append([]*big.Rat(nil), n...), d...) {
+			k.Neg(k)
+		}
+	}
+	a, b, c := d[2], d[1], d[0]
+	disc := new(big.Rat).Mul(big.NewRat(4, 1), new(big.Rat).Mul(a, c))
+	disc.Sub(disc, new(big.Rat).Mul(b, b))
+	if disc.Sign() <= 0 {
+		return nil, false
+	}
+	p, q := new(big.Rat), new(big.Rat)
+	if len(n) > 0 {
+		q.Set(n[0])
+	}
+	if len(n) > 1 {
+		p.Set(n[1])
+	}
+	x := S(v)
+	twoA := new(big.Rat).Add(a, a)
+	sqrtD := SqrtOf(numRat(disc))
+	// 2q - p*b/a
+	k := new(big.Rat).Sub(new(big.Rat).Add(q, q), new(big.Rat).Quo(new(big.Rat).Mul(p, b), a))
+	inner := div(&Add{terms: []Expr{&Mul{factors: []Expr{numRat(twoA), x}}, numRat(b)}}, sqrtD)
+	if r, ok := sqrtD.Simplify().(*Num); ok {
+		inner = ratPolyExpr([]*big.Rat{new(big.Rat).Quo(b, r.val), new(big.Rat).Quo(twoA, r.val)}, v)
+	}
+	return &Add{terms: []Expr{
+		&Mul{factors: []Expr{numRat(new(big.Rat).Quo(p, twoA)), &Func{name: "ln", args: []Expr{ratPolyExpr(d, v)}}}},
+		&Mul{factors: []Expr{div(numRat(k), sqrtD), &Func{name: "atan", args: []Expr{inner}}}},
+	}}, true
+}
+
+// unlessZero returns the antiderivative r, or, when d depends on
+// parameters, the Piecewise taking value where d = 0 and r elsewhere: the
+// general rule divides by d, so values making it vanish need their own
+// antiderivative, e.g. ∫ x^n dx = ln|x| for n = -1.
+func unlessZero(r, d, value Expr) Expr {
+	if len(FreeSymbols(d)) == 0 {
+		return r
+	}
+	return &Piecewise{cases: []PieceCase{{value, zeroCond(d)}}, otherwise: r}
+}
+
+// linearCoeff returns a when u = a*v + b with a, b free of v and a != 0.
+func linearCoeff(u Expr, v string) (Expr, bool) {
+	d := u.Diff(v).Simplify()
+	if dependsOn(d, v) {
+		return nil, false
+	}
+	if n, ok := d.(*Num); ok && n.IsZero() {
+		return nil, false
+	}
+	return d, true
+}
+
+// Gauss–Legendre nodes and weights on [-1, 1] (10 points).
+var (
+	gaussNodes = [10]float64{
+		-0.9739065285171717, -0.8650633666889845, -0.6794095682990244,
+		-0.4333953941292472, -0.1488743389816312, 0.1488743389816312,
+		0.4333953941292472, 0.6794095682990244, 0.8650633666889845,
+		0.9739065285171717,
+	}
+	gaussWeights = [10]float64{
+		0.0666713443086881, 0.1494513491505806, 0.2190863625159820,
+		0.2692667193099963, 0.2955242247147529, 0.2955242247147529,
+		0.2692667193099963, 0.2190863625159820, 0.1494513491505806,
+		0.0666713443086881,
+	}
+)
+
+// DefiniteIntegrate numerically integrates e over [a, b] with respect to
+// varName using 10-point Gauss–Legendre quadrature. The interval is first
+// split where an argument of abs or sign changes sign, so that each rule
+// sees a smooth piece: ∫₋₁¹ |x| dx is exactly 1. It returns NaN if e cannot
+// be evaluated.
+func DefiniteIntegrate(e Expr, varName string, a, b float64) float64 {
+	if a > b {
+		return -DefiniteIntegrate(e, varName, b, a)
+	}
+	s := e.Simplify()
+	sum := 0.0
+	env := map[string]float64{}
+	for _, p := range append(breakpoints(s, varName, a, b, nil), b) {
+		half, mid := (p-a)/2, (a+p)/2
+		for i, xi := range gaussNodes {
+			env[varName] = mid + half*xi
+			v, ok := evalFloat(s, env)
+			if !ok {
+				return math.NaN()
+			}
+			sum += half * gaussWeights[i] * v
+		}
+		a = p
+	}
+	return sum
+}
+
+// kinkArgs returns the distinct arguments of abs and sign in e that depend
+// on v, in pre-order. Nested integrals are not searched.
+func kinkArgs(e Expr, v string) []Expr {
+	var out []Expr
+	seen := map[string]bool{}
+	Walk(e, func(e Expr) bool {
+		if f, ok := e.(*Func); ok && (f.name == "abs" || f.name == "sign") && dependsOn(f.args[0], v) && !seen[f.args[0].String()] {
+			seen[f.args[0].String()] = true
+			out = append(out, f.args[0])
+		}
+		_, ok := e.(binder)
+		return !ok
+	})
+	return out
+}
+
+// breakpoints returns the points strictly between a and b, in increasing
+// order, where an argument of abs or sign in e may change sign, so that
+// quadrature sees smooth pieces. Roots are located with CertifyRoots,
+// preferring the simplest rational of each isolating interval when it is
+// an exact root; unresolved intervals contribute their endpoints. Symbols other than v
+// take their values from env, and infinite limits are searched up to ±1e6.
+func breakpoints(e Expr, v string, a, b float64, env map[string]float64) []float64 {
+	args := kinkArgs(e, v)
+	a, b = math.Min(a, b), math.Max(a, b)
+	lo, ok1 := floatNum(math.Max(a, -1e6))
+	hi, ok2 := floatNum(math.Min(b, 1e6))
+	if len(args) == 0 || !ok1 || !ok2 || lo.val.Cmp(hi.val) >= 0 {
+		return nil
+	}
+	var pts []float64
+	for _, u := range args {
+		for _, name := range FreeSymbols(u) {
+			if x, ok := env[name]; ok && name != v && !math.IsNaN(x) && !math.IsInf(x, 0) {
+				u = u.Sub(name, NFloat(x))
+			}
+		}
+		iso, err := CertifyRoots(u, v, lo, hi)
+		if err != nil {
+			continue
+		}
+		for _, r := range iso.Roots {
+			x := (r.Lo.Float64() + r.Hi.Float64()) / 2
+			if q := simplestRational(r.Lo.val, r.Hi.val); isNumValue(u.Sub(v, numRat(q)).Simplify(), 0) {
+				x, _ = q.Float64()
+			}
+			pts = append(pts, x)
+		}
+		for _, r := range iso.Unresolved {
+			pts = append(pts, r.Lo.Float64(), r.Hi.Float64())
+		}
+	}
+	sort.Float64s(pts)
+	out := pts[:0]
+	for _, p := range pts {
+		if p > a && p < b && (len(out) == 0 || p != out[len(out)-1]) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// splitQuadrature is quadrature applied piece by piece between the
+// breakpoints pts, which lie strictly between a and b.
+func splitQuadrature(f func(float64) (float64, bool), a, b float64, pts []float64) (float64, bool) {
+	if a > b {
+		v, ok := splitQuadrature(f, b, a, pts)
+		return -v, ok
+	}
+	sum := 0.0
+	for _, p := range append(pts, b) {
+		v, ok := quadrature(f, a, p)
+		if !ok {
+			return 0, false
+		}
+		sum, a = sum+v, p
+	}
+	return sum, true
+}
+
+// integrateKinks integrates f over [lo, hi] exactly when f contains abs or
+// sign of arguments depending on v. It splits the interval where the
+// innermost such arguments change sign and replaces abs(u) by ±u and
+// sign(u) by ±1 on each piece, repeating for nested ones, then sums the
+// antiderivative differences. It fails when a limit is not a number, a
+// breakpoint may be irrational, or a piece has no antiderivative.
+func integrateKinks(f Expr, v string, lo, hi Expr) (Expr, bool) {
+	args := kinkArgs(f, v)
+	a, ok1 := lo.(*Num)
+	b, ok2 := hi.(*Num)
+	if len(args) == 0 || !ok1 || !ok2 {
+		return nil, false
+	}
+	if a.val.Cmp(b.val) > 0 {
+		r, ok := integrateKinks(f, v, b, a)
+		if !ok {
+			return nil, false
+		}
+		return neg(r).Simplify(), true
+	}
+	var inner []Expr
+	for _, u := range args {
+		if len(kinkArgs(u, v)) == 0 {
+			inner = append(inner, u)
+		}
+	}
+	pts, ok := exactBreakpoints(inner, v, a.val, b.val)
+	if !ok {
+		return nil, false
+	}
+	pts = append(append([]*big.Rat{a.val}, pts...), b.val)
+	var terms []Expr
+	for k := 0; k+1 < len(pts); k++ {
+		p, q := numRat(pts[k]), numRat(pts[k+1])
+		m, _ := new(big.Rat).Add(p.val, q.val).Float64()
+		g, ok := resolveKinks(f, v, m/2)
+		if !ok {
+			return nil, false
+		}
+		if g = g.Simplify(); len(kinkArgs(g, v)) > 0 {
+			if len(kinkArgs(g, v)) >= len(args) {
+				return nil, false
+			}
+			r, ok := integrateKinks(g, v, p, q)
+			if !ok {
+				return nil, false
+			}
+			terms = append(terms, r)
+			continue
+		}
+		F, ok := Integrate(g, v)
+		if !ok {
+			return nil, false
+		}
+		terms = append(terms, F.Sub(v, q), neg(F.Sub(v, p)))
+	}
+	return (&Add{terms: append(terms, N(0))}).Simplify(), true
+}
+
+// exactBreakpoints returns the points strictly between a and b where the
+// arguments change sign, or false when one of them may be irrational. Roots
+// of polynomial arguments come from the rational root theorem, checked
+// against a Sturm count; other arguments are isolated by CertifyRoots and
+// each root must be the simplest rational in its interval.
+func exactBreakpoints(args []Expr, v string, a, b *big.Rat) ([]*big.Rat, bool) {
+	var pts []*big.Rat
+	inside := func(r *big.Rat) bool { return r.Cmp(a) > 0 && r.Cmp(b) < 0 }
+	for _, u := range args {
+		if p, ok := ratPoly(u, v); ok {
+			sf := primitivePoly(squareFree(p))
+			n := newSturm(sf).count(a, b)
+			for _, end := range []*big.Rat{a, b} {
+				if polyAt(sf, end).Sign() == 0 {
+					n--
+				}
+			}
+			for _, r := range rationalRoots(sf) {
+				if inside(r) {
+					pts = append(pts, r)
+					n--
+				}
+			}
+			if n != 0 {
+				return nil, false
+			}
+			continue
+		}
+		iso, err := CertifyRoots(u, v, numRat(a), numRat(b))
+		if err != nil || len(iso.Unresolved) > 0 {
+			return nil, false
+		}
+		for _, r := range iso.Roots {
+			q := simplestRational(r.Lo.val, r.Hi.val)
+			if !isNumValue(u.Sub(v, numRat(q)).Simplify(), 0) {
+				return nil, false
+			}
+			if inside(q) {
+				pts = append(pts, q)
+			}
+		}
+	}
+	sort.Slice(pts, func(i, j int) bool { return pts[i].Cmp(pts[j]) < 0 })
+	out := pts[:0]
+	for _, p := range pts {
+		if len(out) == 0 || p.Cmp(out[len(out)-1]) != 0 {
+			out = append(out, p)
+		}
+	}
+	return out, true
+}
+
+// simplestRational returns the rational with the smallest denominator in
+// [lo, hi], found from the continued fraction expansions of the ends.
+func simplestRational(lo, hi *big.Rat) *big.Rat {
+	switch {
+	case lo.Sign() <= 0 && hi.Sign() >= 0:
+		return new(big.Rat)
+	case hi.Sign() < 0:
+		return new(big.Rat).Neg(simplestRational(new(big.Rat).Neg(hi), new(big.Rat).Neg(lo)))
+	}
+	f := new(big.Rat).SetInt(new(big.Int).Quo(lo.Num(), lo.Denom()))
+	if f.Cmp(lo) == 0 {
+		return f
+	}
+	if g := new(big.Rat).Add(f, big.NewRat(1, 1)); g.Cmp(hi) <= 0 {
+		return g
+	}
+	r := simplestRational(new(big.Rat).Inv(new(big.Rat).Sub(hi, f)), new(big.Rat).Inv(new(big.Rat).Sub(lo, f)))
+	return r.Add(f, r.Inv(r))
+}
+
+// resolveKinks replaces abs(u) by u or -u and sign(u) by 1 or -1 according
+// to the sign of u at v = m, for the arguments u that depend on v but
+// contain no abs or sign of their own. It fails when such a u cannot be
+// evaluated or vanishes at m.
+func resolveKinks(e Expr, v string, m float64) (Expr, bool) {
+	all := func(es []Expr) ([]Expr, bool) {
+		out := make([]Expr, len(es))
+		for i, x := range es {
+			r, ok := resolveKinks(x, v, m)
+			if !ok {
+				return nil, false
+			}
+			out[i] = r
+		}
+		return out, true
+	}
+	switch t := e.(type) {
+	case *Add:
+		ts, ok := all(t.terms)
+		return &Add{terms: ts}, ok
+	case *Mul:
+		fs, ok := all(t.factors)
+		return &Mul{factors: fs}, ok
+	case *Pow:
+		bx, ok := all([]Expr{t.base, t.exp})
+		if !ok {
+			return nil, false
+		}
+		return &Pow{base: bx[0], exp: bx[1]}, true
+	case *Annotated:
+		x, ok := resolveKinks(t.expr, v, m)
+		return &Annotated{expr: x, meta: t.meta}, ok
+	case *Func:
+		if len(t.args) > 1 {
+			args, ok := all(t.args)
+			return &Func{name: t.name, args: args}, ok
+		}
+		leaf := len(kinkArgs(t.args[0], v)) == 0
+		arg, ok := resolveKinks(t.args[0], v, m)
+		if !ok {
+			return nil, false
+		}
+		if (t.name != "abs" && t.name != "sign") || !dependsOn(arg, v) || !leaf {
+			return &Func{name: t.name, args: []Expr{arg}}, true
+		}
+		x, ok := evalFloat(arg, map[string]float64{v: m})
+		if !ok || x == 0 || math.IsNaN(x) {
+			return nil, false
+		}
+		switch {
+		case t.name == "sign":
+			return N(int64(signum(x))), true
+		case x < 0:
+			return neg(arg), true
+		}
+		return arg, true
+	}
+	// Other nodes, such as Piecewise cases, are resolved child by child;
+	// kinkArgs does not look inside binders, so neither does this.
+	_, cs := labeledChildren(e)
+	if _, ok := e.(binder); ok || len(cs) == 0 {
+		return e, true
+	}
+	out, ok := all(cs)
+	if !ok {
+		return nil, false
+	}
+	return withChildren(e, out), true
+}
+
+// LineIntegral returns the work integral ∫ F·dr of the vector field
+// field, whose components are expressions in vars, along the path
+// vars[i] = path[i](t) for t from a to b. ScalarLineIntegral integrates a
+// scalar against arc length instead.
+func LineIntegral(field []Expr, vars []string, path []Expr, t string, a, b Expr) (Expr, error) {
+	if len(field) != len(vars) || len(path) != len(vars) {
+		return nil, fmt.Errorf("line integral: field, vars and path lengths differ")
+	}
+	terms := make([]Expr, len(field))
+	for i, f := range field {
+		terms[i] = &Mul{factors: []Expr{subAll(f, vars, path), Diff(path[i], t)}}
+	}
+	return integrateBetween(&Add{terms: terms}, t, a, b)
+}
+
+// ScalarLineIntegral returns ∫ f ds along the path vars[i] = path[i](t)
+// for t from a to b, where ds = |r'(t)| dt.
+func ScalarLineIntegral(f Expr, vars []string, path []Expr, t string, a, b Expr) (Expr, error) {
+	if len(path) != len(vars) {
+		return nil, fmt.Errorf("line integral: vars and path lengths differ")
+	}
+	sq := make([]Expr, len(path))
+	for i, p := range path {
+		sq[i] = &Pow{base: Diff(p, t), exp: N(2)}
+	}
+	speed := SqrtOf(Expand(&Add{terms: sq}))
+	return integrateBetween(&Mul{factors: []Expr{subAll(f, vars, path), speed}}, t, a, b)
+}
+
+// Surface is a parametrized surface in three dimensions: the point
+// (R[0], R[1], R[2]) for U in [U0, U1] and V in [V0, V1].
+type Surface struct {
+	R      [3]Expr
+	U, V   string
+	U0, U1 Expr
+	V0, V1 Expr
+}
+
+// normal returns r_u × r_v.
+func (s Surface) normal() [3]Expr {
+	var ru, rv [3]Expr
+	for i, r := range s.R {
+		ru[i], rv[i] = Diff(r, s.U), Diff(r, s.V)
+	}
+	c := func(i, j int) Expr {
+		return Expand(sub(&Mul{factors: []Expr{ru[i], rv[j]}}, &Mul{factors: []Expr{ru[j], rv[i]}}))
+	}
+	return [3]Expr{c(1, 2), c(2, 0), c(0, 1)}
+}
+
+// SurfaceIntegral returns ∬ f dS over s, where f is an expression in the
+// three names vars and dS = |r_u × r_v| du dv.
+func SurfaceIntegral(f Expr, vars []string, s Surface) (Expr, error) {
+	if len(vars) != 3 {
+		return nil, fmt.Errorf("surface integral: need 3 vars, got %d", len(vars))
+	}
+	n := s.normal()
+	area := SqrtOf(Expand(&Add{terms: []Expr{
+		&Pow{base: n[0], exp: N(2)}, &Pow{base: n[1], exp: N(2)}, &Pow{base: n[2], exp: N(2)},
+	}}))
+	return s.integrate(&Mul{factors: []Expr{subAll(f, vars, s.R[:]), area}})
+}
+
+// FluxIntegral returns the flux ∬ F·(r_u × r_v) du dv of field through s.
+// The orientation is the one given by the parametrization.
+func FluxIntegral(field []Expr, vars []string, s Surface) (Expr, error) {
+	if len(vars) != 3 || len(field) != 3 {
+		return nil, fmt.Errorf("surface integral: need 3 vars and field components")
+	}
+	n := s.normal()
+	terms := make([]Expr, 3)
+	for i, f := range field {
+		terms[i] = &Mul{factors: []Expr{subAll(f, vars, s.R[:]), n[i]}}
+	}
+	return s.integrate(&Add{terms: terms})
+}
+
+// integrate integrates e over the parameter rectangle, symbolically in U
+// then V when possible and by tensor Gauss–Legendre quadrature otherwise.
+func (s Surface) integrate(e Expr) (Expr, error) {
+	e = e.Simplify()
+	if F, ok := Integrate(e, s.U); ok {
+		inner := sub(F.Sub(s.U, s.U1), F.Sub(s.U, s.U0)).Simplify()
+		if r, err := integrateBetween(inner, s.V, s.V0, s.V1); err == nil {
+			return r, nil
+		}
+	}
+	bounds := make([]float64, 4)
+	for i, b := range []Expr{s.U0, s.U1, s.V0, s.V1} {
+		f, ok := evalFloat(b, nil)
+		if !ok {
+			return nil, fmt.Errorf("surface integral: cannot integrate %s symbolically and bound %s is not numeric", e, b)
+		}
+		bounds[i] = f
+	}
+	uh, um := (bounds[1]-bounds[0])/2, (bounds[1]+bounds[0])/2
+	vh, vm := (bounds[3]-bounds[2])/2, (bounds[3]+bounds[2])/2
+	env := map[string]float64{}
+	sum := 0.0
+	for i, ui := range gaussNodes {
+		for j, vj := range gaussNodes {
+			env[s.U], env[s.V] = um+uh*ui, vm+vh*vj
+			v, ok := evalFloat(e, env)
+			if !ok {
+				return nil, fmt.Errorf("surface integral: cannot evaluate %s", e)
+			}
+			sum += gaussWeights[i] * gaussWeights[j] * v
+		}
+	}
+	return NFloat(uh * vh * sum), nil
+}
+
+// integrateBetween returns the definite integral of e in v from a to b:
+// exactly via Integrate when possible, otherwise by DefiniteIntegrate when
+// the bounds are numeric and e has no other free symbols.
+func integrateBetween(e Expr, v string, a, b Expr) (Expr, error) {
+	e = e.Simplify()
+	if F, ok := Integrate(e, v); ok {
+		return sub(F.Sub(v, b), F.Sub(v, a)).Simplify(), nil
+	}
+	af, aok := evalFloat(a, nil)
+	bf, bok := evalFloat(b, nil)
+	if !aok || !bok {
+		return nil, fmt.Errorf("cannot integrate %s symbolically and bounds are not numeric", e)
+	}
+	r := DefiniteIntegrate(e, v, af, bf)
+	if math.IsNaN(r) {
+		return nil, fmt.Errorf("cannot evaluate %s on [%s, %s]", e, a, b)
+	}
+	return NFloat(r), nil
+}
+
+// subAll substitutes values[i] for vars[i] simultaneously.
+func subAll(e Expr, vars []string, values []Expr) Expr {
+	// Rename first so that a value mentioning another var is not rewritten.
+	tmp := make([]string, len(vars))
+	for i, v := range vars {
+		tmp[i] = "$" + v
+		e = e.Sub(v, S(tmp[i]))
+	}
+	for i, t := range tmp {
+		e = e.Sub(t, values[i])
+	}
+	return e
+}
+
+// TaylorSeries returns the Taylor expansion of e in varName around the
+// point around, up to and including the term of the given order.
+func TaylorSeries(e Expr, varName string, around Expr, order int) Expr {
+	return taylorTerms(e, varName, around, order, nil)
+}
+
+// Series returns the multivariate Taylor expansion of e around the point
+// given by about, which maps each expansion variable to its centre. All
+// terms of total degree at most order are kept, mixed ones included:
+//
+//	Σ_{|α| ≤ order} ∂^α e(a) / α! · Π (x_i - a_i)^α_i
+//
+// Symbols not in about are treated as constants. With one variable Series
+// agrees with TaylorSeries.
+func Series(e Expr, about map[string]Expr, order int) Expr {
+	vars := make([]string, 0, len(about))
+	for v := range about {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	shifts := make([]Expr, len(vars))
+	for i, v := range vars {
+		if isNumValue(about[v].Simplify(), 0) {
+			shifts[i] = S(v)
+		} else {
+			shifts[i] = sub(S(v), about[v])
+		}
+	}
+	var terms []Expr
+	// expand differentiates d by vars[i:] in turn, taking k derivatives of
+	// vars[i] for k = 0 .. left, and emits one term per multi-index.
+	var expand func(i int, d Expr, left int, factors []Expr, coeff *big.Rat)
+	expand = func(i int, d Expr, left int, factors []Expr, coeff *big.Rat) {
+		if i == len(vars) {
+			c := SubMap(d, about)
+			if isNumValue(c, 0) {
+				return
+			}
+			terms = append(terms, &Mul{factors: append([]Expr{c, numRat(coeff)}, factors...)})
+			return
+		}
+		c := new(big.Rat).Set(coeff)
+		for k := 0; k <= left; k++ {
+			if k > 0 {
+				d = Diff(d, vars[i])
+				c = new(big.Rat).Quo(c, new(big.Rat).SetInt64(int64(k)))
+			}
+			if isNumValue(d, 0) {
+				return
+			}
+			fs := factors
+			if k > 0 {
+				fs = append(append([]Expr(nil), factors...), &Pow{base: shifts[i], exp: N(int64(k))})
+			}
+			expand(i+1, d, left-k, fs, c)
+		}
+	}
+	expand(0, e.Simplify(), order, nil, big.NewRat(1, 1))
+	return seriesSum(terms)
+}
+
+// ReverseSeries returns the compositional inverse of the truncated power
+// series y = a0 + a1*x + ... + an*x^n in sym: the series x = b1*(y - a0)
+// + ... + bn*(y - a0)^n, written in sym, that satisfies series(x) = y up
+// to order n. The coefficients come from Lagrange inversion,
+//
+//	b_k = (1/k) [x^(k-1)] (x / (f(x) - a0))^k,
+//
+// so reversing x + x^2/2 + x^3/6, the series of exp(x) - 1, gives
+// x - x^2/2 + x^3/3, that of ln(1 + x). The order n is the degree of
+// series, and the coefficients may be symbolic. It
+// is an error for series not to be a polynomial in sym or for a1 to be
+// zero, in which case no power series inverse exists; apply TaylorSeries
+// first to reverse other expressions.
+func ReverseSeries(series Expr, sym string) (Expr, error) {
+	cs := PolyCoeffs(series, sym)
+	if cs == nil {
+		return nil, fmt.Errorf("reverse series: %v is not a polynomial in %s", series, sym)
+	}
+	n := 0
+	for k := range cs {
+		n = max(n, k)
+	}
+	if cs[1] == nil || isNumValue(cs[1].Simplify(), 0) {
+		return nil, fmt.Errorf("reverse series: %v has no linear term in %s", series, sym)
+	}
+	a := make([]Expr, n+1)
+	for k := range a {
+		if a[k] = cs[k]; a[k] == nil {
+			a[k] = N(0)
+		}
+	}
+	// h is the series of x / (f(x) - a0) = 1 / (a1 + a2*x + ...) to
+	// order n-1.
+	inv := (&Pow{base: a[1], exp: N(-1)}).Simplify()
+	h := make([]Expr, n)
+	h[0] = inv
+	for m := 1; m < n; m++ {
+		terms := []Expr{N(0)}
+		for j := 1; j <= m && j+1 <= n; j++ {
+			terms = append(terms, &Mul{factors: []Expr{a[j+1], h[m-j]}})
+		}
+		h[m] = Expand(&Mul{factors: []Expr{N(-1), inv, &Add{terms: terms}}})
+	}
+	// hk holds the coefficients of h^k, truncated to order n-1.
+	hk := []Expr{N(1)}
+	var terms []Expr
+	var shift Expr = S(sym)
+	if !isNumValue(a[0].Simplify(), 0) {
+		shift = sub(S(sym), a[0])
+	}
+	for k := 1; k <= n; k++ {
+		next := make([]Expr, n)
+		for i := range next {
+			var ts []Expr
+			for j := 0; j <= i && j < len(hk); j++ {
+				ts = append(ts, &Mul{factors: []Expr{hk[j], h[i-j]}})
+			}
+			next[i] = Expand(&Add{terms: append(ts, N(0))})
+		}
+		hk = next
+		b := Expand(&Mul{factors: []Expr{hk[k-1], F(1, int64(k))}})
+		terms = append(terms, &Mul{factors: []Expr{b, &Pow{base: shift, exp: N(int64(k))}}})
+	}
+	return (&Add{terms: append(terms, N(0))}).Simplify(), nil
+}
+
+// taylorTerms builds the series term by term. A non-nil yield is called
+// with the partial sum after each nonzero term; returning false stops the
+// expansion there.
+func taylorTerms(e Expr, varName string, around Expr, order int, yield func(k int, partial Expr) bool) Expr {
+	x := S(varName)
+	var shift Expr = x
+	if n, ok := around.Simplify().(*Num); !ok || !n.IsZero() {
+		shift = sub(x, around)
+	}
+	var terms []Expr
+	d := e.Simplify()
+	fact := big.NewInt(1)
+	for k := 0; k <= order; k++ {
+		if k > 0 {
+			fact.Mul(fact, big.NewInt(int64(k)))
+			d = Diff(d, varName)
+		}
+		ck := Sub(d, varName, around)
+		if n, ok := ck.(*Num); ok && n.IsZero() {
+			continue
+		}
+		terms = append(terms, &Mul{factors: []Expr{
+			ck,
+			numRat(new(big.Rat).SetFrac(big.NewInt(1), fact)),
+			&Pow{base: shift, exp: N(int64(k))},
+		}})
+		if yield != nil && !yield(k, seriesSum(terms)) {
+			break
+		}
+	}
+	return seriesSum(terms)
+}
+
+// seriesSum adds the terms of a series, each simplified, in the order
+// Simplify uses, but without distributing numeric coefficients over the
+// powers of x - a, so 2*(x - 1) stays a multiple of x - 1.
+func seriesSum(terms []Expr) Expr {
+	var out []Expr
+	constant := new(big.Rat)
+	for _, t := range terms {
+		s := t.Simplify()
+		us := []Expr{s}
+		if a, ok := s.(*Add); ok {
+			us = a.terms
+		}
+		for _, u := range us {
+			if n, ok := u.(*Num); ok {
+				constant.Add(constant, n.val)
+			} else {
+				out = append(out, u)
+			}
+		}
+	}
+	sortTerms(out)
+	if constant.Sign() != 0 || len(out) == 0 {
+		out = append(out, numRat(constant))
+	}
+	if len(out) == 1 {
+		return out[0]
+	}
+	return &Add{terms: out}
+}
+
+// Convolve returns the convolution (f*g)(t) = ∫ f(τ) g(t-τ) dτ over the
+// real line of two functions of t.
+//
+// Piecewise inputs whose conditions compare t with numbers, such as
+// piecewise((0, t < 0), (exp(-t), otherwise)) or the chain 0 <= t <= 1
+// of a box, are split into the
+// intervals where they are nonzero; other inputs are nonzero everywhere.
+// Each pair of pieces is integrated over the overlap of their intervals,
+// which gives a Piecewise in t with breakpoints at the sums of the ends.
+// A piece with no antiderivative, such as exp(-t^2), or with an infinite
+// integration limit is left as an Integral that Eval evaluates by
+// quadrature, as is the whole convolution when a condition cannot be
+// split.
+func Convolve(f, g Expr, t string) Expr {
+	tau := "tau"
+	for k := 1; dependsOn(f, tau) || dependsOn(g, tau) || tau == t; k++ {
+		tau = fmt.Sprintf("tau_%d", k)
+	}
+	tv, uv := S(t), S(tau)
+	fp, ok1 := signalPieces(f, t)
+	gp, ok2 := signalPieces(g, t)
+	if !ok1 || !ok2 {
+		integrand := &Mul{factors: []Expr{f.Sub(t, uv), g.Sub(t, sub(tv, uv))}}
+		return &Integral{integrand: integrand.Simplify(), v: tau, lo: neg(Inf), hi: Inf}
+	}
+	// (f*g)(t) changes form where t - τ crosses an end of a g piece at an
+	// end of an f piece.
+	var cuts []signalEnd
+	for _, a := range fp {
+		for _, b := range gp {
+			for _, x := range []signalEnd{a.lo, a.hi} {
+				for _, y := range []signalEnd{b.lo, b.hi} {
+					if !math.IsInf(x.f, 0) && !math.IsInf(y.f, 0) {
+						cuts = append(cuts, signalEnd{(&Add{terms: []Expr{x.e, y.e}}).Simplify(), x.f + y.f})
+					}
+				}
+			}
+		}
+	}
+	cuts = sortEnds(cuts)
+	values := make([]Expr, len(cuts)+1)
+	for i := range values {
+		m := midpoint(cuts, i)
+		var terms []Expr
+		for _, a := range fp {
+			for _, b := range gp {
+				// τ runs over (a.lo, a.hi) ∩ (t - b.hi, t - b.lo).
+				lo, hi := a.lo, a.hi
+				if m-b.hi.f > lo.f {
+					lo = signalEnd{sub(tv, b.hi.e), m - b.hi.f}
+				}
+				if m-b.lo.f < hi.f {
+					hi = signalEnd{sub(tv, b.lo.e), m - b.lo.f}
+				}
+				if !(lo.f < hi.f) {
+					continue
+				}
+				integrand := &Mul{factors: []Expr{a.value.Sub(t, uv), b.value.Sub(t, sub(tv, uv))}}
+				terms = append(terms, (&Integral{integrand: integrand, v: tau, lo: lo.e, hi: hi.e}).Simplify())
+			}
+		}
+		values[i] = Expand((&Add{terms: append(terms, N(0))}).Simplify())
+	}
+	var cases []PieceCase
+	for i, c := range cuts {
+		if values[i].String() == values[i+1].String() {
+			continue
+		}
+		cases = append(cases, PieceCase{values[i], Cond{tv, RelLt, c.e}})
+	}
+	if len(cases) == 0 {
+		return values[len(values)-1]
+	}
+	return &Piecewise{cases: cases, otherwise: values[len(values)-1]}
+}
+
+// signalEnd is an end of an interval, exact and as a float; infinite ends
+// are ±Inf.
+type signalEnd struct {
+	e Expr
+	f float64
+}
+
+// signalPiece is a function equal to value on the interval (lo, hi).
+type signalPiece struct {
+	value  Expr
+	lo, hi signalEnd
+}
+
+// signalPieces splits e, a function of v, into the intervals where it is
+// nonzero for Convolve. Each link of a chained condition such as 0 <= v
+// <= 1 contributes its breakpoint. ok is false when a comparison is not
+// linear in v alone or its breakpoint is not a real number.
+func signalPieces(e Expr, v string) ([]signalPiece, bool) {
+	e = StripMeta(e.Simplify())
+	minus, plus := signalEnd{neg(Inf), math.Inf(-1)}, signalEnd{Inf, math.Inf(1)}
+	p, ok := e.(*Piecewise)
+	if !ok {
+		if isNumValue(e, 0) {
+			return nil, true
+		}
+		return []signalPiece{{e, minus, plus}}, true
+	}
+	var cuts []signalEnd
+	for _, c := range p.cases {
+		links := []Cond{c.Cond}
+		if r, ok := c.Cond.chain(); ok {
+			links = r.Links()
+		}
+		for _, l := range links {
+			z := zeroCond(sub(l.Lhs, l.Rhs))
+			if s, ok := z.Lhs.(*Sym); !ok || s.name != v {
+				return nil, false
+			}
+			r, ok := evalFloat(z.Rhs, nil)
+			if !ok || math.IsNaN(r) || math.IsInf(r, 0) {
+				return nil, false
+			}
+			cuts = append(cuts, signalEnd{z.Rhs, r})
+		}
+	}
+	cuts = sortEnds(cuts)
+	var out []signalPiece
+	for i := 0; i <= len(cuts); i++ {
+		env := map[string]float64{v: midpoint(cuts, i)}
+		value := p.otherwise
+		for _, c := range p.cases {
+			if holds, ok := c.Cond.Holds(env); ok && holds {
+				value = c.Value
+				break
+			}
+		}
+		lo, hi := minus, plus
+		if i > 0 {
+			lo = cuts[i-1]
+		}
+		if i < len(cuts) {
+			hi = cuts[i]
+		}
+		switch {
+		case isNumValue(value.Simplify(), 0):
+		case len(out) > 0 && out[len(out)-1].hi.f == lo.f && out[len(out)-1].value.String() == value.String():
+			out[len(out)-1].hi = hi
+		default:
+			out = append(out, signalPiece{value, lo, hi})
+		}
+	}
+	return out, true
+}
+
+// sortEnds sorts finite ends and drops duplicates.
+func sortEnds(ends []signalEnd) []signalEnd {
+	sort.Slice(ends, func(i, j int) bool { return ends[i].f < ends[j].f })
+	out := ends[:0]
+	for _, x := range ends {
+		if len(out) == 0 || out[len(out)-1].f != x.f {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// midpoint returns a point strictly inside the i-th of the len(cuts)+1
+// intervals the sorted cuts divide the real line into.
+func midpoint(cuts []signalEnd, i int) float64 {
+	switch {
+	case len(cuts) == 0:
+		return 0
+	case i == 0:
+		return cuts[0].f - 1
+	case i == len(cuts):
+		return cuts[i-1].f + 1
+	}
+	return (cuts[i-1].f + cuts[i].f) / 2
+}
+
+// ============================================================
+// Algebra
+// ============================================================
+
+// MaxExpandTerms bounds the integer powers of sums expanded by Expand: a
+// power (a_1 + ... + a_m)^n is expanded only when its C(n+m-1, m-1) terms
+// number at most MaxExpandTerms, so (x + 1)^999 is expanded and
+// (x + 1)^1000 is kept.
+const MaxExpandTerms = 1000
+
+// Expand distributes products over sums and expands integer powers of
+// sums, (a+b)^n by the binomial theorem, up to MaxExpandTerms terms a
+// power; larger powers are kept as they are, which ExpandChecked reports.
+// It descends into function arguments, Piecewise cases and comparisons;
+// an unevaluated integral is kept as it is.
+func Expand(e Expr) Expr {
+	r, _ := ExpandChecked(e)
+	return r
+}
+
+// ExpandChecked is Expand, but returns an error naming the first power of
+// a sum it kept for having more than MaxExpandTerms terms, along with the
+// otherwise expanded result.
+func ExpandChecked(e Expr) (Expr, error) {
+	x := &expander{}
+	r := x.expand(e.Simplify()).Simplify()
+	if x.kept != nil {
+		return r, fmt.Errorf("expand: %s has more than %d terms", x.kept, MaxExpandTerms)
+	}
+	return r, nil
+}
+
+// expander records the first power too large to expand.
+type expander struct {
+	kept Expr
+}
+
+func (x *expander) expand(e Expr) Expr {
+	switch t := e.(type) {
+	case *Add:
+		out := make([]Expr, len(t.terms))
+		for i, u := range t.terms {
+			out[i] = x.expand(u)
+		}
+		return (&Add{terms: out}).Simplify()
+	case *Mul:
+		var acc Expr = N(1)
+		for _, f := range t.factors {
+			acc = distribute(acc, x.expand(f))
+		}
+		return acc
+	case *Pow:
+		b := x.expand(t.base)
+		if n, ok := t.exp.(*Num); ok && n.IsInt() && n.Sign() > 0 {
+			if s, isAdd := b.(*Add); isAdd {
+				if k, ok := expandedTerms(len(s.terms), n.val.Num()); ok {
+					return powerOfSum(s.terms, k)
+				}
+				if x.kept == nil {
+					x.kept = &Pow{base: b, exp: n}
+				}
+			}
+		}
+		return (&Pow{base: b, exp: x.expand(t.exp)}).Simplify()
+	case *Func:
+		return t.mapArgs(x.expand).Simplify()
+	case *Annotated:
+		return &Annotated{expr: x.expand(t.expr), meta: t.meta}
+	case *Piecewise:
+		return t.mapParts(x.expand)
+	case binder:
+		return e
+	}
+	_, cs := labeledChildren(e)
+	if len(cs) == 0 {
+		return e
+	}
+	out := make([]Expr, len(cs))
+	for i, c := range cs {
+		out[i] = x.expand(c)
+	}
+	return withChildren(e, out).Simplify()
+}
+
+// expandedTerms returns n as an int when a sum of m terms raised to n
+// expands to at most MaxExpandTerms terms.
+func expandedTerms(m int, n *big.Int) (int, bool) {
+	if !n.IsInt64() || n.Int64() >= MaxExpandTerms {
+		return 0, false
+	}
+	k := int(n.Int64())
+	c := new(big.Int).Binomial(int64(k+m-1), int64(m-1))
+	return k, c.Cmp(big.NewInt(MaxExpandTerms)) <= 0
+}
+
+// powerOfSum expands (terms[0] + terms[1] + ...)^n for expanded terms,
+// by the binomial theorem for two terms and repeated multiplication
+// otherwise.
+func powerOfSum(terms []Expr, n int) Expr {
+	if len(terms) != 2 {
+		b := &Add{terms: terms}
+		var acc Expr = b
+		for i := 1; i < n; i++ {
+			acc = distribute(acc, b)
+		}
+		return acc
+	}
+	a, b := terms[0], terms[1]
+	out := make([]Expr, 0, n+1)
+	c := big.NewInt(1)
+	for k := 0; k <= n; k++ {
+		out = append(out, (&Mul{factors: []Expr{numRat(new(big.Rat).SetInt(c)), &Pow{base: a, exp: N(int64(n - k))}, &Pow{base: b, exp: N(int64(k))}}}).Simplify())
+		c.Mul(c, big.NewInt(int64(n-k))).Quo(c, big.NewInt(int64(k+1)))
+	}
+	return (&Add{terms: out}).Simplify()
+}
+
+// distribute multiplies two expanded expressions term by term.
+func distribute(a, b Expr) Expr {
+	ta, tb := addTerms(a), addTerms(b)
+	out := make([]Expr, 0, len(ta)*len(tb))
+	for _, x := range ta {
+		for _, y := range tb {
+			out = append(out, &Mul{factors: []Expr{x, y}})
+		}
+	}
+	return (&Add{terms: out}).Simplify()
+}
+
+func addTerms(e Expr) []Expr {
+	if a, ok := e.(*Add); ok {
+		return a.terms
+	}
+	return []Expr{e}
+}
+
+// PolyCoeffs returns the coefficients of e viewed as a polynomial in
+// varName, keyed by degree. Zero coefficients are omitted. Powers of sums
+// are multiplied out coefficient by coefficient, not by Expand, so
+// (x + 1)^5000 has all its 5001 coefficients. It returns nil if e is not
+// a polynomial in varName, or if its coefficients take more than
+// maxPolyWork coefficient operations to compute.
+func PolyCoeffs(e Expr, varName string) map[int]Expr {
+	e = StripMeta(e).Simplify()
+	if out, ok := readPoly(e, varName); ok {
+		return out
+	}
+	groups := map[int][]Expr{}
+	for _, t := range addTerms(Expand(e)) {
+		k, c, ok := monomialDegree(t, varName)
+		if !ok {
+			return nil
+		}
+		groups[k] = append(groups[k], c)
+	}
+	out := map[int]Expr{}
+	for k, cs := range groups {
+		c := (&Add{terms: cs}).Simplify()
+		if n, ok := c.(*Num); ok && n.IsZero() {
+			continue
+		}
+		out[k] = c
+	}
+	return out
+}
+
+// maxPolyWork bounds the coefficient operations of readPoly: a product of
+// polynomials with a and b terms counts a*b, and a binomial power n counts
+// its n+1 coefficients, weighted by 1 + n/1024 for their size.
+const maxPolyWork = 1 << 18
+
+// readPoly reads the simplified e as a polynomial in v without expanding
+// it, returning its nonzero coefficients, each expanded. It reports false
+// when e is not visibly a polynomial in v, as with (x^2 + x)/x, or when
+// the work exceeds maxPolyWork.
+func readPoly(e Expr, v string) (map[int]Expr, bool) {
+	r := &polyReader{v: v}
+	p, ok := r.read(e)
+	if !ok {
+		return nil, false
+	}
+	out := map[int]Expr{}
+	for k, c := range p {
+		if c = Expand(c); !isNumValue(c, 0) {
+			out[k] = c
+		}
+	}
+	return out, true
+}
+
+// polyReader holds the variable read and the work spent by readPoly.
+type polyReader struct {
+	v    string
+	work int
+}
+
+func (r *polyReader) spend(n int) bool {
+	r.work += n
+	return r.work <= maxPolyWork
+}
+
+func (r *polyReader) read(e Expr) (map[int]Expr, bool) {
+	if !dependsOn(e, r.v) {
+		return map[int]Expr{0: e}, true
+	}
+	switch t := e.(type) {
+	case *Sym:
+		return map[int]Expr{1: N(1)}, true
+	case *Add:
+		out := map[int]Expr{}
+		for _, u := range t.terms {
+			p, ok := r.read(u)
+			if !ok || !r.spend(len(p)) {
+				return nil, false
+			}
+			for k, c := range p {
+				out[k] = addCoeff(out[k], c)
+			}
+		}
+		return out, true
+	case *Mul:
+		out := map[int]Expr{0: N(1)}
+		for _, f := range t.factors {
+			p, ok := r.read(f)
+			if !ok {
+				return nil, false
+			}
+			if out, ok = r.mul(out, p); !ok {
+				return nil, false
+			}
+		}
+		return out, true
+	case *Pow:
+		n, ok := t.exp.(*Num)
+		if !ok || !n.IsInt() || n.Sign() < 0 || !n.val.Num().IsInt64() {
+			return nil, false
+		}
+		p, ok := r.read(t.base)
+		if !ok {
+			return nil, false
+		}
+		return r.pow(p, n.val.Num().Int64())
+	}
+	return nil, false
+}
+
+// addCoeff adds c to the coefficient a, which may be nil.
+func addCoeff(a, c Expr) Expr {
+	if a == nil {
+		return c
+	}
+	return (&Add{terms: []Expr{a, c}}).Simplify()
+}
+
+func (r *polyReader) mul(a, b map[int]Expr) (map[int]Expr, bool) {
+	if !r.spend(len(a) * len(b)) {
+		return nil, false
+	}
+	out := map[int]Expr{}
+	for i, c := range a {
+		for j, d := range b {
+			if j > math.MaxInt32-i {
+				return nil, false
+			}
+			out[i+j] = addCoeff(out[i+j], (&Mul{factors: []Expr{c, d}}).Simplify())
+		}
+	}
+	return out, true
+}
+
+// pow raises p to n, by the binomial theorem when p has two terms and by
+// repeated squaring otherwise.
+func (r *polyReader) pow(p map[int]Expr, n int64) (map[int]Expr, bool) {
+	var ks []int
+	for k := range p {
+		if k > 0 && n > math.MaxInt32/int64(k) {
+			return nil, false
+		}
+		ks = append(ks, k)
+	}
+	switch len(ks) {
+	case 1:
+		k := ks[0]
+		return map[int]Expr{k * int(n): (&Pow{base: p[k], exp: N(n)}).Simplify()}, true
+	case 2:
+		if m := min(n, maxPolyWork); !r.spend(int((m + 1) * (1 + m/1024))) {
+			return nil, false
+		}
+		i, j := ks[0], ks[1]
+		out := map[int]Expr{}
+		c := big.NewInt(1)
+		for m := int64(0); m <= n; m++ {
+			t := (&Mul{factors: []Expr{numRat(new(big.Rat).SetInt(c)), &Pow{base: p[i], exp: N(n - m)}, &Pow{base: p[j], exp: N(m)}}}).Simplify()
+			k := i*int(n-m) + j*int(m)
+			out[k] = addCoeff(out[k], t)
+			c.Mul(c, big.NewInt(n-m)).Quo(c, big.NewInt(m+1))
+		}
+		return out, true
+	}
+	out := map[int]Expr{0: N(1)}
+	var ok bool
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			if out, ok = r.mul(out, p); !ok {
+				return nil, false
+			}
+		}
+		if n > 1 {
+			if p, ok = r.mul(p, p); !ok {
+				return nil, false
+			}
+		}
+	}
+	return out, true
+}
+
+// monomialDegree splits an expanded term into c*v^k with c free of v.
+func monomialDegree(t Expr, v string) (int, Expr, bool) {
+	factors := []Expr{t}
+	if m, ok := t.(*Mul); ok {
+		factors = m.factors
+	}
+	deg := 0
+	var rest []Expr
+	for _, f := range factors {
+		if !dependsOn(f, v) {
+			rest = append(rest, f)
+			continue
+		}
+		base, exp := asPow(f)
+		s, ok := base.(*Sym)
+		n, ok2 := exp.(*Num)
+		if !ok || s.name != v || !ok2 || !n.IsInt() || n.Sign() < 0 || !n.val.Num().IsInt64() {
+			return 0, nil, false
+		}
+		deg += int(n.val.Num().Int64())
+	}
+	return deg, (&Mul{factors: append(rest, N(1))}).Simplify(), true
+}
+
+// Collect expands e and gathers the terms by powers of varName, giving
+// a_n*x^n + ... + a_0 with each coefficient a_k free of varName; a*x^2 +
+// b*x^2 + x becomes (a + b)*x^2 + x. Rational and negative powers are
+// gathered as well. Terms that depend on varName in another way, such as
+// sin(x) or 2^x, are kept as they are.
+func Collect(e Expr, varName string) Expr {
+	pows, coeffs, rest := collectTerms(e, varName)
+	terms := make([]Expr, 0, len(pows)+len(rest)+1)
+	for i, k := range pows {
+		terms = append(terms, &Mul{factors: []Expr{coeffs[i], &Pow{base: S(varName), exp: k}}})
+	}
+	return (&Add{terms: append(append(terms, rest...), N(0))}).Simplify()
+}
+
+// Coeff returns the coefficient of varName^n in Collect(e, varName), or 0
+// when there is none. Coeff(e, x, 0) is the part of e free of varName.
+// Polynomials in varName are read as by PolyCoeffs, so the coefficients
+// of powers too large for Expand are found within its work limit.
+func Coeff(e Expr, varName string, n int) Expr {
+	pows, coeffs, _ := collectTerms(e, varName)
+	for i, k := range pows {
+		if k.val.Cmp(big.NewRat(int64(n), 1)) == 0 {
+			return coeffs[i]
+		}
+	}
+	return N(0)
+}
+
+// Horner rewrites polynomials in varName into nested Horner form, so
+// x^3 + 2*x^2 + 3*x + 4 becomes x*(x*(x + 2) + 3) + 4, which evaluates
+// with one multiplication and one addition per degree and is usually more
+// accurate than summing powers. Runs of zero coefficients become powers:
+// x^5 + x is x*(x^4 + 1). Coefficients may involve other symbols and are
+// simplified, not nested. A subexpression that is not a polynomial in
+// varName, such as sin(x^2 + x) or 1/(x^2 + 1), has its arguments
+// rewritten instead.
+func Horner(e Expr, varName string) Expr {
+	e = e.Simplify()
+	if !dependsOn(e, varName) {
+		return e
+	}
+	if cs := PolyCoeffs(e, varName); cs != nil {
+		if len(cs) == 0 {
+			// The terms cancel, as in x + (y - (x + y)).
+			return N(0)
+		}
+		degs := make([]int, 0, len(cs))
+		for k := range cs {
+			degs = append(degs, k)
+		}
+		sort.Ints(degs)
+		x := S(varName)
+		xPow := func(k int) Expr {
+			if k == 1 {
+				return x
+			}
+			return &Pow{base: x, exp: N(int64(k))}
+		}
+		acc := cs[degs[len(degs)-1]]
+		for i := len(degs) - 2; i >= 0; i-- {
+			acc = &Add{terms: []Expr{&Mul{factors: []Expr{xPow(degs[i+1] - degs[i]), acc}}, cs[degs[i]]}}
+		}
+		if degs[0] > 0 {
+			acc = &Mul{factors: []Expr{xPow(degs[0]), acc}}
+		}
+		return acc.Simplify()
+	}
+	_, cs := labeledChildren(e)
+	out := make([]Expr, len(cs))
+	for i, c := range cs {
+		out[i] = Horner(c, varName)
+	}
+	return withChildren(e, out).Simplify()
+}
+
+// collectTerms splits the expanded e into terms c*v^k with c free of v
+// and k a number, returning the distinct k in decreasing order with their
+// simplified nonzero coefficients, and the other terms.
+func collectTerms(e Expr, v string) ([]*Num, []Expr, []Expr) {
+	e = StripMeta(e).Simplify()
+	if p, ok := readPoly(e, v); ok {
+		var pows []*Num
+		for k := range p {
+			pows = append(pows, N(int64(k)))
+		}
+		sort.Slice(pows, func(i, j int) bool { return pows[i].val.Cmp(pows[j].val) > 0 })
+		coeffs := make([]Expr, len(pows))
+		for i, k := range pows {
+			coeffs[i] = p[int(k.val.Num().Int64())]
+		}
+		return pows, coeffs, nil
+	}
+	groups := map[string][]Expr{}
+	exps := map[string]*Num{}
+	var rest []Expr
+	for _, t := range addTerms(Expand(e)) {
+		factors := []Expr{t}
+		if m, ok := t.(*Mul); ok {
+			factors = m.factors
+		}
+		k, c := new(big.Rat), []Expr{N(1)}
+		for _, f := range factors {
+			if !dependsOn(f, v) {
+				c = append(c, f)
+				continue
+			}
+			base, exp := asPow(f)
+			s, ok := base.(*Sym)
+			n, ok2 := exp.(*Num)
+			if !ok || s.name != v || !ok2 {
+				k = nil
+				break
+			}
+			k.Add(k, n.val)
+		}
+		if k == nil {
+			rest = append(rest, t)
+			continue
+		}
+		key := k.RatString()
+		exps[key] = numRat(k)
+		groups[key] = append(groups[key], (&Mul{factors: c}).Simplify())
+	}
+	var pows []*Num
+	for key := range groups {
+		pows = append(pows, exps[key])
+	}
+	sort.Slice(pows, func(i, j int) bool { return pows[i].val.Cmp(pows[j].val) > 0 })
+	var out []*Num
+	var coeffs []Expr
+	for _, k := range pows {
+		c := (&Add{terms: groups[k.val.RatString()]}).Simplify()
+		if !isNumValue(c, 0) {
+			out = append(out, k)
+			coeffs = append(coeffs, c)
+		}
+	}
+	return out, coeffs, rest
+}
+
+// Degree returns the degree of e as a polynomial in varName, or -1 if e is
+// not a polynomial in varName or PolyCoeffs exceeds its work limit.
+func Degree(e Expr, varName string) int {
+	coeffs := PolyCoeffs(e, varName)
+	if coeffs == nil {
+		return -1
+	}
+	deg := 0
+	for k := range coeffs {
+		if k > deg {
+			deg = k
+		}
+	}
+	return deg
+}
+
+// PolyFactor is a factor Base^Mult of a polynomial factorization.
+type PolyFactor struct {
+	Base Expr
+	Mult int
+}
+
+// SquareFree returns the square-free decomposition of p as a polynomial in
+// varName: p = c * f_1 * f_2^2 * ... * f_k^k, where the f_i are square-free
+// and pairwise coprime, so the roots of f_i are exactly the roots of p of
+// multiplicity i. It returns the constant c and the f_i in increasing
+// multiplicity, omitting those equal to 1. Each f_i has integer
+// coefficients without a common divisor and a positive leading
+// coefficient.
+//
+// A power c*b^k, such as x^1000000, is decomposed from b alone, whatever
+// k. Otherwise it is an error for p not to be a nonzero polynomial in
+// varName with rational coefficients, or for its degree, bounded as for
+// Factor, to exceed MaxFactorDegree.
+func SquareFree(p Expr, varName string) (Expr, []PolyFactor, error) {
+	if c, out, ok, err := polyPowerFactors(p, varName, SquareFree); ok {
+		return c, out, err
+	}
+	f, err := densePoly(p, varName)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fs []intPolyFactor
+	for i, g := range yun(f) {
+		if len(g) > 1 {
+			fs = append(fs, intPolyFactor{primitivePoly(g), i + 1})
+		}
+	}
+	c, out := polyFactorList(f, fs, varName)
+	return c, out, nil
+}
+
+// FactorList factors p as a polynomial in varName as far as it can over
+// the rationals: it splits each part of the square-free decomposition into
+// the linear factors of its rational roots, then the quadratic factors
+// found by Kronecker's method, and whatever is left, so that p = c * Π
+// Base^Mult; x^4 + 4 is (x^2 - 2*x + 2)(x^2 + 2*x + 2). The leftover
+// factors have no factors of degree 1 or 2 but may still be reducible,
+// e.g. a product of two irreducible cubics is kept whole. Rational roots
+// are only searched for when the extreme coefficients are below 2^40 in
+// absolute value, and quadratic factors under the limits of
+// kroneckerQuadratic. Factors are normalized as in SquareFree and ordered
+// by degree, then printed form. Powers and the degree limit are handled
+// as in SquareFree.
+func FactorList(p Expr, varName string) (Expr, []PolyFactor, error) {
+	if c, out, ok, err := polyPowerFactors(p, varName, FactorList); ok {
+		return c, out, err
+	}
+	f, err := densePoly(p, varName)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, out := polyFactorList(f, ratFactors(f), varName)
+	sort.SliceStable(out, func(i, j int) bool {
+		di, dj := Degree(out[i].Base, varName), Degree(out[j].Base, varName)
+		if di != dj {
+			return di < dj
+		}
+		return out[i].Base.String() < out[j].Base.String()
+	})
+	return c, out, nil
+}
+
+// densePoly returns the coefficients of p for SquareFree and FactorList,
+// checking its degree before they are built.
+func densePoly(p Expr, varName string) ([]*big.Rat, error) {
+	if d := polyDegreeBound(p); d > MaxFactorDegree {
+		return nil, fmt.Errorf("%s has degree up to %d, above MaxFactorDegree %d", varName, d, MaxFactorDegree)
+	}
+	f, ok := ratPoly(p, varName)
+	if !ok || len(f) == 0 {
+		return nil, fmt.Errorf("%s is not a nonzero polynomial in %s with rational coefficients", p, varName)
+	}
+	return f, nil
+}
+
+// polyPowerFactors splits p = c*b^k, for an integer k > 1, by applying
+// split to b and multiplying the multiplicities by k, so that monomials
+// and powers of any degree need no dense coefficients. ok is false when
+// p is not such a power.
+func polyPowerFactors(p Expr, varName string, split func(Expr, string) (Expr, []PolyFactor, error)) (c Expr, out []PolyFactor, ok bool, err error) {
+	k0, rest := splitCoeff(StripMeta(p.Simplify()))
+	b, exp := asPow(rest)
+	k, isNum := exp.(*Num)
+	if !isNum || !k.IsInt() || k.val.Cmp(big.NewRat(1, 1)) <= 0 || !dependsOn(b, varName) {
+		return nil, nil, false, nil
+	}
+	if !k.val.Num().IsInt64() || k.val.Num().Int64() > math.MaxInt32 {
+		return nil, nil, true, fmt.Errorf("exponent %s of %s is too large", k, p)
+	}
+	n := int(k.val.Num().Int64())
+	var cb Expr
+	if s, isSym := b.(*Sym); isSym && s.name == varName {
+		cb, out = N(1), []PolyFactor{{Base: b, Mult: 1}}
+	} else if cb, out, err = split(b, varName); err != nil {
+		return nil, nil, true, err
+	}
+	for i := range out {
+		out[i].Mult *= n
+	}
+	// c = k0 * cb^n, exactly.
+	r := new(big.Rat).Set(cb.(*Num).val)
+	switch {
+	case r.Cmp(big.NewRat(1, 1)) == 0:
+	case r.Cmp(big.NewRat(-1, 1)) == 0:
+		if n%2 == 0 {
+			r.Neg(r)
+		}
+	default:
+		if r, ok = ratPow(r, big.NewRat(int64(n), 1)); !ok {
+			return nil, nil, true, fmt.Errorf("constant of %s is too large", p)
+		}
+	}
+	return numRat(r.Mul(r, k0)), out, true, nil
+}
+
+// MaxFactorDegree is the largest degree of a polynomial that Factor
+// factors, measured as by polyDegreeBound; the factor tool rejects larger
+// ones with an error.
+const MaxFactorDegree = 200
+
+// polyDegreeBound bounds the total degree of e as a polynomial without
+// expanding it: symbols count 1, sums take the largest bound of their
+// terms, products the sum over their factors and powers with a positive
+// integer exponent n the base's bound times n. Other nodes take the
+// largest bound of their children. It saturates at math.MaxInt32.
+func polyDegreeBound(e Expr) int {
+	sat := func(n int64) int {
+		if n > math.MaxInt32 {
+			return math.MaxInt32
+		}
+		return int(n)
+	}
+	switch t := e.(type) {
+	case *Sym:
+		return 1
+	case *Mul:
+		var n int64
+		for _, f := range t.factors {
+			n += int64(polyDegreeBound(f))
+		}
+		return sat(n)
+	case *Pow:
+		if k, ok := t.exp.(*Num); ok && k.IsInt() && k.Sign() > 0 {
+			b := int64(polyDegreeBound(t.base))
+			if b == 0 {
+				return 0
+			}
+			if !k.val.Num().IsInt64() || k.val.Num().Int64() > math.MaxInt32 {
+				return math.MaxInt32
+			}
+			return sat(b * k.val.Num().Int64())
+		}
+	}
+	n := 0
+	_, cs := labeledChildren(e)
+	for _, c := range cs {
+		if d := polyDegreeBound(c); d > n {
+			n = d
+		}
+	}
+	return n
+}
+
+// Factor factors e over the rationals. A polynomial in a single symbol
+// becomes c * Π Base^Mult as given by FactorList, so x^2 - 1 is (x - 1)*(x
+// + 1), 6*x^2 + 11*x + 3 is (2*x + 3)*(3*x + 1) and x^4 + x^2 + 1 is (x^2
+// + x + 1)*(x^2 - x + 1); irreducible factors such as x^2 - 2 stay whole.
+// A polynomial in several symbols loses its monomial factors, contents
+// and repeated factors, and a homogeneous one is factored through the
+// polynomial that setting a symbol to 1 leaves, so x^2*y - y is y*(x +
+// 1)*(x - 1) and x^2 - y^2 is (x + y)*(x - y); what remains, such as
+// x^2*y^2 - 1, is kept whole. The factors of products and the bases of
+// integer powers, e.g. the numerator and denominator of a rational
+// function, are factored in turn. Anything else, including a polynomial
+// of degree above MaxFactorDegree, is returned simplified but unfactored.
+func Factor(e Expr) Expr {
+	e = e.Simplify()
+	switch t := e.(type) {
+	case *Mul:
+		fs := make([]Expr, len(t.factors))
+		for i, f := range t.factors {
+			fs[i] = Factor(f)
+		}
+		return (&Mul{factors: fs}).Simplify()
+	case *Pow:
+		if n, ok := t.exp.(*Num); ok && n.IsInt() {
+			return (&Pow{base: Factor(t.base), exp: n}).Simplify()
+		}
+		return e
+	case *Annotated:
+		return Annotate(Factor(t.expr), t.meta)
+	}
+	if polyDegreeBound(e) > MaxFactorDegree {
+		return e
+	}
+	syms := FreeSymbols(e)
+	if len(syms) > 1 {
+		return factorSeveral(e, syms)
+	}
+	if len(syms) != 1 || Degree(e, syms[0]) < 2 {
+		return e
+	}
+	c, fs, err := FactorList(e, syms[0])
+	if err != nil {
+		return e
+	}
+	factors := []Expr{c}
+	for _, f := range fs {
+		factors = append(factors, &Pow{base: f.Base, exp: N(int64(f.Mult))})
+	}
+	return (&Mul{factors: factors}).Simplify()
+}
+
+// factorSeveral factors e as a polynomial with rational coefficients in
+// syms, two or more, for Factor, or returns it unchanged.
+func factorSeveral(e Expr, syms []string) Expr {
+	at := &polyAtoms{}
+	for _, s := range syms {
+		at.atom(S(s))
+	}
+	p := at.toPoly(e)
+	if len(at.atoms) != len(syms) || len(p) == 0 {
+		return e
+	}
+	var fs []mpoly
+	if !mpFactor(p, len(syms), &fs) {
+		return e
+	}
+	c := new(big.Rat).Set(p.lead().c)
+	var keys []string
+	bases, mults := map[string]Expr{}, map[string]int64{}
+	for _, f := range fs {
+		c.Quo(c, f.lead().c)
+		b := at.toExpr(f)
+		k := b.String()
+		if _, ok := bases[k]; !ok {
+			keys = append(keys, k)
+			bases[k] = b
+		}
+		mults[k]++
+	}
+	factors := []Expr{numRat(c)}
+	for _, k := range keys {
+		factors = append(factors, &Pow{base: bases[k], exp: N(mults[k])})
+	}
+	return (&Mul{factors: factors}).Simplify()
+}
+
+// mpFactor appends primitive factors of p in n indeterminates to out,
+// dropping constants. It splits off, in turn, monomial factors; the
+// content with respect to each indeterminate, the gcd of the coefficients
+// of p read as a polynomial in it; the repeated factors it shares with
+// its derivatives; and, for homogeneous p, the factors of the polynomial
+// in one indeterminate fewer left by setting one to 1, rehomogenized, so
+// x^2 - y^2 splits like x^2 - 1. A polynomial in one indeterminate is
+// factored as by FactorList; other factors are kept whole. It reports
+// false when a gcd exceeds its budget.
+func mpFactor(p mpoly, n int, out *[]mpoly) bool {
+	p = mpPrimitive(p)
+	if p.isConst() {
+		return true
+	}
+	low := make([]int, n)
+	for i := range low {
+		low[i] = -1
+	}
+	for _, t := range p {
+		for i := range low {
+			if k := expAt(t.exp, i); low[i] < 0 || k < low[i] {
+				low[i] = k
+			}
+		}
+	}
+	var used []int
+	rest := p
+	for i, k := range low {
+		if k > 0 {
+			x := make([]int, i+1)
+			x[i] = 1
+			for j := 0; j < k; j++ {
+				*out = append(*out, mpoly{expKey(x): {x, big.NewRat(1, 1)}})
+			}
+			shifted := mpoly{}
+			for _, t := range rest {
+				exp := padExp(t.exp, n)
+				exp[i] -= k
+				shifted.addTerm(exp, t.c)
+			}
+			rest = shifted
+		}
+	}
+	p = rest
+	for i := 0; i < n; i++ {
+		for _, t := range p {
+			if expAt(t.exp, i) > 0 {
+				used = append(used, i)
+				break
+			}
+		}
+	}
+	split := func(g mpoly) bool {
+		q, _ := mpQuo(p, g)
+		return mpFactor(g, n, out) && mpFactor(q, n, out)
+	}
+	switch len(used) {
+	case 0:
+		return true
+	case 1:
+		i := used[0]
+		f := make([]*big.Rat, 0)
+		for _, t := range p {
+			k := expAt(t.exp, i)
+			for len(f) <= k {
+				f = append(f, new(big.Rat))
+			}
+			f[k] = t.c
+		}
+		for _, g := range ratFactors(f) {
+			h := mpoly{}
+			for k, c := range g.p {
+				x := make([]int, i+1)
+				x[i] = k
+				h.addTerm(x, c)
+			}
+			for j := 0; j < g.mult; j++ {
+				*out = append(*out, h)
+			}
+		}
+		return true
+	}
+	for _, i := range used {
+		coeffs := map[int]mpoly{}
+		deriv := mpoly{}
+		for _, t := range p {
+			exp := padExp(t.exp, n)
+			k := exp[i]
+			exp[i] = 0
+			if coeffs[k] == nil {
+				coeffs[k] = mpoly{}
+			}
+			coeffs[k].addTerm(exp, t.c)
+			if k > 0 {
+				d := padExp(t.exp, n)
+				d[i]--
+				deriv.addTerm(d, new(big.Rat).Mul(t.c, big.NewRat(int64(k), 1)))
+			}
+		}
+		ks := make([]int, 0, len(coeffs))
+		for k := range coeffs {
+			ks = append(ks, k)
+		}
+		sort.Ints(ks)
+		var g mpoly
+		for _, k := range ks {
+			if g == nil {
+				g = coeffs[k]
+				continue
+			}
+			var ok bool
+			if g, ok = mpGCD(g, coeffs[k]); !ok {
+				return false
+			}
+			if g.isConst() {
+				break
+			}
+		}
+		if !g.isConst() {
+			return split(g)
+		}
+		g, ok := mpGCD(p, deriv)
+		if !ok {
+			return false
+		}
+		if !g.isConst() {
+			return split(g)
+		}
+	}
+	deg := -1
+	for _, t := range p {
+		d := expDeg(t.exp)
+		if deg >= 0 && d != deg {
+			// Not homogeneous.
+			*out = append(*out, p)
+			return true
+		}
+		deg = d
+	}
+	v := used[len(used)-1]
+	q := mpoly{}
+	for _, t := range p {
+		exp := padExp(t.exp, n)
+		exp[v] = 0
+		q.addTerm(exp, t.c)
+	}
+	var qs []mpoly
+	if !mpFactor(q, n, &qs) {
+		return false
+	}
+	for _, f := range qs {
+		d := 0
+		for _, t := range f {
+			d = max(d, expDeg(t.exp))
+		}
+		h := mpoly{}
+		for _, t := range f {
+			exp := make([]int, max(len(t.exp), v+1))
+			copy(exp, t.exp)
+			exp[v] += d - expDeg(t.exp)
+			h.addTerm(exp, t.c)
+		}
+		*out = append(*out, h)
+	}
+	return true
+}
+
+// padExp returns a copy of exp with at least n entries.
+func padExp(exp []int, n int) []int {
+	out := make([]int, max(len(exp), n))
+	copy(out, exp)
+	return out
+}
+
+// expDeg returns the total degree of a monomial.
+func expDeg(exp []int) int {
+	d := 0
+	for _, k := range exp {
+		d += k
+	}
+	return d
+}
+
+// Together writes sums of fractions over a common denominator, so 1/x +
+// 1/y becomes (x + y)*x^-1*y^-1, recursing into nested fractions such as
+// 1/(1 + 1/x). Denominators are the factors with negative integer
+// exponents; the common one takes each base with its highest multiplicity,
+// without factoring polynomials. The combined numerator is expanded so
+// that its terms collect, e.g. 1/(x + 1) - 1/(x - 1) becomes
+// -2*(x + 1)^-1*(x - 1)^-1.
+func Together(e Expr) Expr {
+	e = e.Simplify()
+	if _, cs := labeledChildren(e); len(cs) > 0 {
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = Together(c)
+		}
+		e = withChildren(e, out).Simplify()
+	}
+	a, ok := e.(*Add)
+	if !ok {
+		return e
+	}
+	type denFactor struct {
+		base Expr
+		mult *big.Rat
+	}
+	var keys []string
+	common := map[string]denFactor{}
+	nums := make([]Expr, len(a.terms))
+	dens := make([]map[string]*big.Rat, len(a.terms))
+	for i, t := range a.terms {
+		num, den := numerDenom(t)
+		nums[i], dens[i] = num, map[string]*big.Rat{}
+		factors := []Expr{den}
+		if m, ok := den.(*Mul); ok {
+			factors = m.factors
+		}
+		for _, f := range factors {
+			base, exp := asPow(f)
+			k, ok := exp.(*Num)
+			if !ok || isNumValue(f, 1) {
+				continue
+			}
+			key := base.String()
+			dens[i][key] = k.val
+			if c, ok := common[key]; !ok || c.mult.Cmp(k.val) < 0 {
+				if !ok {
+					keys = append(keys, key)
+				}
+				common[key] = denFactor{base, k.val}
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return e
+	}
+	terms := make([]Expr, len(nums))
+	for i, num := range nums {
+		fs := []Expr{num}
+		for _, key := range keys {
+			c := common[key]
+			k := new(big.Rat).Set(c.mult)
+			if d, ok := dens[i][key]; ok {
+				k.Sub(k, d)
+			}
+			if k.Sign() != 0 {
+				fs = append(fs, &Pow{base: c.base, exp: numRat(k)})
+			}
+		}
+		terms[i] = &Mul{factors: fs}
+	}
+	out := []Expr{Expand(&Add{terms: terms})}
+	for _, key := range keys {
+		c := common[key]
+		out = append(out, &Pow{base: c.base, exp: numRat(new(big.Rat).Neg(c.mult))})
+	}
+	return (&Mul{factors: out}).Simplify()
+}
+
+// Apart returns the partial fraction decomposition of a rational function
+// of varName with rational coefficients: a polynomial plus a sum of terms
+// r/f^k, where the f are the factors of the denominator found by
+// FactorList and each r has lower degree than its f. For example
+// 1/(x^2 - 1) becomes 1/2*(x - 1)^-1 - 1/2*(x + 1)^-1. Denominator factors
+// without rational roots are kept whole, so 1/(x^3 + x) gives x^-1 -
+// x*(x^2 + 1)^-1. Other expressions are returned simplified.
+func Apart(e Expr, varName string) Expr {
+	num, den := numerDenom(Together(StripMeta(e)))
+	p, ok1 := ratPoly(num, varName)
+	q, ok2 := ratPoly(den, varName)
+	if !ok1 || !ok2 || len(q) <= 1 {
+		return e.Simplify()
+	}
+	c, fs, err := FactorList(den, varName)
+	if err != nil {
+		return e.Simplify()
+	}
+	whole, r := polyDivMod(p, q)
+	// R/Q = (R/c) / Π f_i^m_i.
+	inv := new(big.Rat).Inv(c.(*Num).val)
+	for _, a := range r {
+		a.Mul(a, inv)
+	}
+	bases := make([][]*big.Rat, len(fs))
+	powers := make([][]*big.Rat, len(fs))
+	for i, f := range fs {
+		bases[i], _ = ratPoly(f.Base, varName)
+		powers[i] = []*big.Rat{big.NewRat(1, 1)}
+		for k := 0; k < f.Mult; k++ {
+			powers[i] = polyMul(powers[i], bases[i])
+		}
+	}
+	terms := []Expr{ratPolyExpr(whole, varName)}
+	for i, f := range fs {
+		// R_i = R * (Q / f_i^m_i)^-1 mod f_i^m_i, expanded in powers of f_i.
+		others := []*big.Rat{big.NewRat(1, 1)}
+		for j := range fs {
+			if j != i {
+				others = polyMul(others, powers[j])
+			}
+		}
+		s, ok := polyInvMod(others, powers[i])
+		if !ok {
+			return e.Simplify()
+		}
+		_, ri := polyDivMod(polyMul(r, s), powers[i])
+		for k := f.Mult; k >= 1 && len(ri) > 0; k-- {
+			var rem []*big.Rat
+			ri, rem = polyDivMod(ri, bases[i])
+			if len(rem) > 0 {
+				terms = append(terms, &Mul{factors: []Expr{ratPolyExpr(rem, varName), &Pow{base: f.Base, exp: N(int64(-k))}}})
+			}
+			ri = trimPoly(ri)
+		}
+	}
+	return (&Add{terms: terms}).Simplify()
+}
+
+// Cancel writes e as a quotient of polynomials without common factors, so
+// (x^2 - 1)/(x - 1) becomes x + 1 and (x - 1)/(x^2 - 1) becomes (x +
+// 1)^-1. Subexpressions are cancelled first, bottom-up, and fractions
+// are then combined by Together. A rational function with rational
+// coefficients has the gcd of numerator and denominator divided out,
+// leaving c*P*Q^-1 with P and Q expanded, and c the constant that makes
+// both primitive and Q's leading coefficient positive; in several symbols
+// the gcd comes from a Gröbner basis, so (x^2 - y^2)/(x - y) becomes x +
+// y, and the quotient is left as it is when that exceeds its budget.
+// Other expressions keep their form around cancelled parts, so
+// sin((x^2 - 1)/(x - 1)) + y becomes sin(x + 1) + y.
+func Cancel(e Expr) Expr {
+	e = e.Simplify()
+	if _, cs := labeledChildren(e); len(cs) > 0 {
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = Cancel(c)
+		}
+		e = withChildren(e, out).Simplify()
+	}
+	e = Together(e)
+	syms := FreeSymbols(e)
+	if len(syms) > 1 {
+		return cancelSeveral(e, syms)
+	}
+	if len(syms) != 1 {
+		return e
+	}
+	num, den := numerDenom(e)
+	p, ok1 := ratPoly(num, syms[0])
+	q, ok2 := ratPoly(den, syms[0])
+	if !ok1 || !ok2 || len(q) <= 1 {
+		return e
+	}
+	if len(p) == 0 {
+		return N(0)
+	}
+	g := polyGCD(p, q)
+	p, _ = polyDivMod(p, g)
+	q, _ = polyDivMod(q, g)
+	P, Q := primitivePoly(p), primitivePoly(q)
+	c := new(big.Rat).Quo(p[len(p)-1], P[len(P)-1])
+	c.Mul(c, new(big.Rat).Quo(Q[len(Q)-1], q[len(q)-1]))
+	factors := []Expr{numRat(c), ratPolyExpr(P, syms[0])}
+	if len(Q) > 1 {
+		factors = append(factors, &Pow{base: ratPolyExpr(Q, syms[0]), exp: N(-1)})
+	}
+	return (&Mul{factors: factors}).Simplify()
+}
+
+// cancelSeveral is Cancel for a quotient of polynomials in the symbols
+// syms, with the multivariate gcd from mpGCD.
+func cancelSeveral(e Expr, syms []string) Expr {
+	at := &polyAtoms{}
+	for _, s := range syms {
+		at.atom(S(s))
+	}
+	num, den := numerDenom(e)
+	p, q := at.toPoly(num), at.toPoly(den)
+	if len(at.atoms) != len(syms) || q.isConst() {
+		return e
+	}
+	if len(p) == 0 {
+		return N(0)
+	}
+	g, ok := mpGCD(p, q)
+	if !ok {
+		return e
+	}
+	p, _ = mpQuo(p, g)
+	q, _ = mpQuo(q, g)
+	P, Q := mpPrimitive(p), mpPrimitive(q)
+	c := new(big.Rat).Quo(p.lead().c, P.lead().c)
+	c.Mul(c, new(big.Rat).Quo(Q.lead().c, q.lead().c))
+	factors := []Expr{numRat(c), at.toExpr(P)}
+	if !Q.isConst() {
+		factors = append(factors, &Pow{base: at.toExpr(Q), exp: N(-1)})
+	}
+	return (&Mul{factors: factors}).Simplify()
+}
+
+type intPolyFactor struct {
+	p    []*big.Rat
+	mult int
+}
+
+// polyFactorList converts factors of f to expressions and returns them
+// with the constant c = lead(f) / Π lead(p)^mult.
+func polyFactorList(f []*big.Rat, fs []intPolyFactor, varName string) (Expr, []PolyFactor) {
+	c := new(big.Rat).Set(f[len(f)-1])
+	out := make([]PolyFactor, len(fs))
+	for i, g := range fs {
+		for k := 0; k < g.mult; k++ {
+			c.Quo(c, g.p[len(g.p)-1])
+		}
+		out[i] = PolyFactor{Base: ratPolyExpr(g.p, varName), Mult: g.mult}
+	}
+	return numRat(c), out
+}
+
+// ============================================================
+// Trigonometry
+// ============================================================
+
+// maxTrigMultiple bounds the integer multiples n*u that TrigExpand
+// expands.
+const maxTrigMultiple = 32
+
+// TrigExpand expands sines, cosines and tangents of sums and of integer
+// multiples by the angle-sum formulas, so sin(x + y) becomes
+// sin(x)*cos(y) + sin(y)*cos(x) and cos(2*x) becomes cos(x)^2 - sin(x)^2.
+// Tangents are written in tangents of the parts: tan(x + y) is (tan(x) +
+// tan(y))*(1 - tan(x)*tan(y))^-1. Multiples up to 32 are expanded, and
+// the result is expanded as by Expand.
+func TrigExpand(e Expr) Expr {
+	e = e.Simplify()
+	if _, cs := labeledChildren(e); len(cs) > 0 {
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = TrigExpand(c)
+		}
+		e = withChildren(e, out).Simplify()
+	}
+	f, ok := e.(*Func)
+	if !ok || len(f.args) != 1 || !trigSplits(f.args[0]) {
+		return e
+	}
+	switch f.name {
+	case "sin":
+		s, _ := trigPair(f.args[0])
+		return s
+	case "cos":
+		_, c := trigPair(f.args[0])
+		return c
+	case "tan":
+		return Cancel(trigTan(f.args[0]))
+	}
+	return e
+}
+
+// trigSplits reports whether the angle u is a sum or an integer multiple
+// that TrigExpand can split.
+func trigSplits(u Expr) bool {
+	if _, ok := u.(*Add); ok {
+		return true
+	}
+	_, _, ok := trigMultiple(u)
+	return ok
+}
+
+// trigMultiple splits u into n*r for an integer n ≠ 1 with |n| <=
+// maxTrigMultiple.
+func trigMultiple(u Expr) (int, Expr, bool) {
+	m, ok := u.(*Mul)
+	if !ok {
+		return 0, nil, false
+	}
+	c, ok := m.factors[0].(*Num)
+	if !ok || !c.val.IsInt() || !c.val.Num().IsInt64() {
+		return 0, nil, false
+	}
+	n := c.val.Num().Int64()
+	if n == 1 || n < -maxTrigMultiple || n > maxTrigMultiple {
+		return 0, nil, false
+	}
+	return int(n), (&Mul{factors: m.factors[1:]}).Simplify(), true
+}
+
+// trigPair returns sin(u) and cos(u) expanded by the angle-sum formulas.
+func trigPair(u Expr) (s, c Expr) {
+	step := func(s1, c1, s2, c2 Expr) (Expr, Expr) {
+		return Expand(&Add{terms: []Expr{&Mul{factors: []Expr{s1, c2}}, &Mul{factors: []Expr{c1, s2}}}}),
+			Expand(&Add{terms: []Expr{&Mul{factors: []Expr{c1, c2}}, neg(&Mul{factors: []Expr{s1, s2}})}})
+	}
+	if a, ok := u.(*Add); ok {
+		s, c = trigPair(a.terms[0])
+		for _, t := range a.terms[1:] {
+			s2, c2 := trigPair(t)
+			s, c = step(s, c, s2, c2)
+		}
+		return s, c
+	}
+	if n, r, ok := trigMultiple(u); ok {
+		s1, c1 := trigPair(r)
+		s, c = s1, c1
+		for k := 1; k < n || k < -n; k++ {
+			s, c = step(s, c, s1, c1)
+		}
+		if n < 0 {
+			s = Expand(neg(s))
+		}
+		return s, c
+	}
+	return SinOf(u).Simplify(), CosOf(u).Simplify()
+}
+
+// trigTan returns tan(u) expanded by tan(a + b) = (tan a + tan b)/(1 -
+// tan a tan b), before the fractions are combined.
+func trigTan(u Expr) Expr {
+	step := func(t1, t2 Expr) Expr {
+		return div(&Add{terms: []Expr{t1, t2}}, sub(N(1), &Mul{factors: []Expr{t1, t2}}))
+	}
+	if a, ok := u.(*Add); ok {
+		t := trigTan(a.terms[0])
+		for _, v := range a.terms[1:] {
+			t = step(t, trigTan(v))
+		}
+		return t
+	}
+	if n, r, ok := trigMultiple(u); ok {
+		t1 := trigTan(r)
+		t := t1
+		for k := 1; k < n || k < -n; k++ {
+			t = step(t, t1)
+		}
+		if n < 0 {
+			t = neg(t)
+		}
+		return t
+	}
+	return TanOf(u).Simplify()
+}
+
+// TrigSimp rewrites e with trigonometric identities into the form with
+// the smallest Complexity it finds. Working bottom-up, it tries at each
+// sum sin(u)^2 = 1 - cos(u)^2, cos(u)^2 = 1 - sin(u)^2 and the halving
+// formulas sin(u)^2 = (1 - cos(2u))/2 and cos(u)^2 = (1 + cos(2u))/2,
+// and at each product sin(u)/cos(u) = tan(u) and sin(u)*cos(u) =
+// sin(2u)/2, keeping a rewrite only when it makes the expression smaller.
+// So 3*sin(x)^2 + 5*cos(x)^2 becomes cos(2*x) + 4, cos(x)^2 - sin(x)^2
+// becomes cos(2*x), 2*sin(x)*cos(x) becomes sin(2*x) and
+// sin(x)^3/cos(x)^3 becomes tan(x)^3.
+func TrigSimp(e Expr) Expr {
+	e = e.Simplify()
+	if _, cs := labeledChildren(e); len(cs) > 0 {
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = TrigSimp(c)
+		}
+		e = withChildren(e, out).Simplify()
+	}
+	for size := Complexity(e); ; {
+		improved := false
+		for _, c := range trigCandidates(e) {
+			if n := Complexity(c); n < size {
+				e, size, improved = c, n, true
+			}
+		}
+		if !improved {
+			return e
+		}
+	}
+}
+
+// trigCandidates returns the rewrites of the sum or product e that
+// TrigSimp compares.
+func trigCandidates(e Expr) []Expr {
+	var out []Expr
+	switch t := e.(type) {
+	case *Add:
+		args := trigSquareArgs(t)
+		for _, key := range sortedNames(args) {
+			u := args[key]
+			for _, r := range []func(name string, n int64) Expr{
+				trigPythagorean(u, "sin", "cos"),
+				trigPythagorean(u, "cos", "sin"),
+				trigHalving(u),
+			} {
+				out = append(out, Expand(trigRewritePowers(t, key, r)))
+			}
+		}
+	case *Mul:
+		if c, ok := trigContract(t); ok {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// trigSquareArgs returns the arguments u of the factors sin(u)^n and
+// cos(u)^n with integer n >= 2 in the terms of a, by printed form.
+func trigSquareArgs(a *Add) map[string]Expr {
+	args := map[string]Expr{}
+	for _, t := range a.terms {
+		for _, f := range factorsOf(t) {
+			if u, _, _, ok := trigPower(f); ok {
+				args[u.String()] = u
+			}
+		}
+	}
+	return args
+}
+
+// factorsOf returns the factors of a product, or e itself.
+func factorsOf(e Expr) []Expr {
+	if m, ok := e.(*Mul); ok {
+		return m.factors
+	}
+	return []Expr{e}
+}
+
+// trigPower matches sin(u)^n or cos(u)^n with integer n >= 2.
+func trigPower(f Expr) (u Expr, name string, n int64, ok bool) {
+	base, exp := asPow(f)
+	fn, ok1 := base.(*Func)
+	k, ok2 := exp.(*Num)
+	if !ok1 || !ok2 || (fn.name != "sin" && fn.name != "cos") || len(fn.args) != 1 ||
+		!k.val.IsInt() || !k.val.Num().IsInt64() || k.val.Num().Int64() < 2 {
+		return nil, "", 0, false
+	}
+	return fn.args[0], fn.name, k.val.Num().Int64(), true
+}
+
+// trigRewritePowers replaces each factor sin(u)^n or cos(u)^n in the
+// terms of a, for the u printed as key, by r(name, n) when that is not
+// nil.
+func trigRewritePowers(a *Add, key string, r func(name string, n int64) Expr) Expr {
+	terms := make([]Expr, len(a.terms))
+	for i, t := range a.terms {
+		fs := append([]Expr(nil), factorsOf(t)...)
+		for j, f := range fs {
+			if u, name, n, ok := trigPower(f); ok && u.String() == key {
+				if x := r(name, n); x != nil {
+					fs[j] = x
+				}
+			}
+		}
+		terms[i] = &Mul{factors: fs}
+	}
+	return &Add{terms: terms}
+}
+
+// trigPythagorean rewrites from(u)^n as (1 - to(u)^2)^(n/2), times
+// from(u) for odd n.
+func trigPythagorean(u Expr, from, to string) func(string, int64) Expr {
+	return func(name string, n int64) Expr {
+		if name != from {
+			return nil
+		}
+		x := &Pow{base: sub(N(1), &Pow{base: &Func{name: to, args: []Expr{u}}, exp: N(2)}), exp: N(n / 2)}
+		return &Mul{factors: []Expr{x, &Pow{base: &Func{name: from, args: []Expr{u}}, exp: N(n % 2)}}}
+	}
+}
+
+// trigHalving rewrites sin(u)^n and cos(u)^n in powers of cos(2u).
+func trigHalving(u Expr) func(string, int64) Expr {
+	c2 := &Func{name: "cos", args: []Expr{&Mul{factors: []Expr{N(2), u}}}}
+	return func(name string, n int64) Expr {
+		var half Expr = &Add{terms: []Expr{N(1), c2}}
+		if name == "sin" {
+			half = sub(N(1), c2)
+		}
+		x := &Pow{base: &Mul{factors: []Expr{numRat(big.NewRat(1, 2)), half}}, exp: N(n / 2)}
+		return &Mul{factors: []Expr{x, &Pow{base: &Func{name: name, args: []Expr{u}}, exp: N(n % 2)}}}
+	}
+}
+
+// trigContract rewrites sin(u)^a*cos(u)^b in the product m as powers of
+// tan(u), and sin(u)*cos(u) as sin(2u)/2, for the first u that allows
+// either.
+func trigContract(m *Mul) (Expr, bool) {
+	type pair struct {
+		u          Expr
+		sinK, cosK *big.Rat
+		sinI, cosI int
+	}
+	pairs := map[string]*pair{}
+	var keys []string
+	for i, f := range m.factors {
+		base, exp := asPow(f)
+		fn, ok1 := base.(*Func)
+		k, ok2 := exp.(*Num)
+		if !ok1 || !ok2 || (fn.name != "sin" && fn.name != "cos") || len(fn.args) != 1 {
+			continue
+		}
+		key := fn.args[0].String()
+		p, ok := pairs[key]
+		if !ok {
+			p = &pair{u: fn.args[0], sinI: -1, cosI: -1}
+			pairs[key] = p
+			keys = append(keys, key)
+		}
+		if fn.name == "sin" {
+			p.sinK, p.sinI = k.val, i
+		} else {
+			p.cosK, p.cosI = k.val, i
+		}
+	}
+	for _, key := range keys {
+		p := pairs[key]
+		if p.sinI < 0 || p.cosI < 0 || p.sinK.Sign()*p.cosK.Sign() == 0 {
+			continue
+		}
+		fs := append([]Expr(nil), m.factors...)
+		s, c := new(big.Rat).Set(p.sinK), new(big.Rat).Set(p.cosK)
+		var extra Expr
+		switch {
+		case s.Sign() != c.Sign():
+			// sin^a cos^b = tan^k sin^(a-k) cos^(b+k) for k between 0 and a
+			// nearest to -b.
+			k := new(big.Rat).Neg(c)
+			if new(big.Rat).Abs(k).Cmp(new(big.Rat).Abs(s)) > 0 {
+				k.Set(s)
+			}
+			s.Sub(s, k)
+			c.Add(c, k)
+			extra = &Pow{base: TanOf(p.u), exp: numRat(k)}
+		case s.Cmp(big.NewRat(1, 1)) == 0 && c.Cmp(big.NewRat(1, 1)) == 0:
+			s.SetInt64(0)
+			c.SetInt64(0)
+			extra = &Mul{factors: []Expr{numRat(big.NewRat(1, 2)), SinOf(&Mul{factors: []Expr{N(2), p.u}})}}
+		default:
+			continue
+		}
+		fs[p.sinI] = &Pow{base: SinOf(p.u), exp: numRat(s)}
+		fs[p.cosI] = &Pow{base: CosOf(p.u), exp: numRat(c)}
+		return (&Mul{factors: append(fs, extra)}).Simplify(), true
+	}
+	return nil, false
+}
+
+// DegreeMode rewrites e as a calculator in degree mode reads it: the
+// arguments of sin, cos and tan are angles in degrees, wrapped in deg,
+// and asin, acos, atan and atan2 return degrees, multiplied by 180/pi.
+// Arguments already marked with deg or rad keep their unit, so in
+// DegreeMode(Parse("sin(30) + cos(rad(pi))")) only the 30 is converted;
+// the result simplifies to -1/2.
+func DegreeMode(e Expr) Expr {
+	_, cs := labeledChildren(e)
+	if len(cs) > 0 {
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = DegreeMode(c)
+		}
+		e = withChildren(e, out)
+	}
+	f, ok := e.(*Func)
+	if !ok {
+		return e
+	}
+	switch f.name {
+	case "sin", "cos", "tan":
+		if a, ok := f.args[0].(*Func); ok && (a.name == "deg" || a.name == "rad") {
+			return f
+		}
+		return &Func{name: f.name, args: []Expr{Deg(f.args[0])}}
+	case "asin", "acos", "atan", "atan2":
+		return &Mul{factors: []Expr{N(180), f, &Pow{base: Pi, exp: N(-1)}}}
+	}
+	return f
+}
+
+// ============================================================
+// Logarithms
+// ============================================================
+
+// LogExpand splits logarithms of products and powers, so ln(x*y) becomes
+// ln(x) + ln(y) and ln(x^n) becomes n*ln(x). The identities hold only for
+// positive arguments, so a factor or base is split off only when it is
+// known to be positive: a positive number, pi or e, exp(u), a symbol
+// listed in positive, or a sum, product or power of such. ln(2*x) becomes
+// ln(2) + ln(x) whatever x is, but ln(x*y) stays as written unless x or y
+// is listed.
+func LogExpand(e Expr, positive ...string) Expr {
+	return logExpand(e.Simplify(), symbolSet(positive)).Simplify()
+}
+
+func logExpand(e Expr, pos map[string]bool) Expr {
+	if _, cs := labeledChildren(e); len(cs) > 0 {
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = logExpand(c, pos)
+		}
+		e = withChildren(e, out)
+	}
+	if f, ok := e.(*Func); ok && f.name == "ln" {
+		return expandLn(f.args[0].Simplify(), pos)
+	}
+	return e
+}
+
+// expandLn returns ln(u) with the positive factors and bases of u split
+// off.
+func expandLn(u Expr, pos map[string]bool) Expr {
+	switch t := u.(type) {
+	case *Mul:
+		var terms, rest []Expr
+		for _, f := range t.factors {
+			if isPositive(f, pos) {
+				terms = append(terms, expandLn(f, pos))
+			} else {
+				rest = append(rest, f)
+			}
+		}
+		if len(terms) == 0 {
+			break
+		}
+		if len(rest) > 0 {
+			terms = append(terms, &Func{name: "ln", args: []Expr{(&Mul{factors: rest}).Simplify()}})
+		}
+		return &Add{terms: terms}
+	case *Pow:
+		if isPositive(t.base, pos) {
+			return &Mul{factors: []Expr{t.exp, expandLn(t.base, pos)}}
+		}
+	}
+	return &Func{name: "ln", args: []Expr{u}}
+}
+
+// LogCombine is the inverse of LogExpand: in each sum it merges the terms
+// c*ln(u) with u known to be positive, in the sense of LogExpand, into a
+// single ln(Π u^c). So ln(x) + ln(y) becomes ln(x*y) and 2*ln(x) - ln(y)
+// becomes ln(x^2*y^-1) when x and y are listed in positive, and ln(2) +
+// ln(3) becomes ln(6). The coefficient c is the product of the factors of
+// the term other than the logarithm.
+func LogCombine(e Expr, positive ...string) Expr {
+	return logCombine(e.Simplify(), symbolSet(positive)).Simplify()
+}
+
+func logCombine(e Expr, pos map[string]bool) Expr {
+	if _, cs := labeledChildren(e); len(cs) > 0 {
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = logCombine(c, pos)
+		}
+		e = withChildren(e, out).Simplify()
+	}
+	var terms []Expr
+	switch t := e.(type) {
+	case *Add:
+		terms = t.terms
+	case *Mul, *Func:
+		terms = []Expr{t}
+	default:
+		return e
+	}
+	var rest, powers []Expr
+	merged := false
+	for _, term := range terms {
+		c, u, ok := logTerm(term)
+		if !ok || !isPositive(u, pos) {
+			rest = append(rest, term)
+			continue
+		}
+		if len(powers) > 0 || !isNumValue(c, 1) {
+			merged = true
+		}
+		powers = append(powers, &Pow{base: u, exp: c})
+	}
+	if !merged {
+		return e
+	}
+	ln := &Func{name: "ln", args: []Expr{(&Mul{factors: powers}).Simplify()}}
+	return (&Add{terms: append(rest, ln)}).Simplify()
+}
+
+// logTerm views term as c*ln(u), where c is the product of the factors
+// other than the only logarithm.
+func logTerm(term Expr) (c, u Expr, ok bool) {
+	if f, ok := term.(*Func); ok && f.name == "ln" {
+		return N(1), f.args[0], true
+	}
+	m, isMul := term.(*Mul)
+	if !isMul {
+		return nil, nil, false
+	}
+	var coeff []Expr
+	for _, f := range m.factors {
+		if l, ok := f.(*Func); ok && l.name == "ln" && u == nil {
+			u = l.args[0]
+		} else if dependsOnFunc(f, "ln") {
+			return nil, nil, false
+		} else {
+			coeff = append(coeff, f)
+		}
+	}
+	if u == nil {
+		return nil, nil, false
+	}
+	return (&Mul{factors: append(coeff, N(1))}).Simplify(), u, true
+}
+
+// dependsOnFunc reports whether e contains a call of the function name.
+func dependsOnFunc(e Expr, name string) bool {
+	if f, ok := e.(*Func); ok && f.name == name {
+		return true
+	}
+	_, cs := labeledChildren(e)
+	for _, c := range cs {
+		if dependsOnFunc(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPositive reports whether e is positive for all real values of its
+// symbols, given that the symbols in pos are positive.
+func isPositive(e Expr, pos map[string]bool) bool {
+	switch t := e.(type) {
+	case *Num:
+		return t.Sign() > 0
+	case *Const:
+		return t.val > 0
+	case *Sym:
+		return pos[t.name]
+	case *Annotated:
+		return isPositive(t.expr, pos)
+	case *Pow:
+		return isPositive(t.base, pos)
+	case *Func:
+		return t.name == "exp" || t.name == "cosh"
+	case *Add, *Mul:
+		_, cs := labeledChildren(e)
+		for _, c := range cs {
+			if !isPositive(c, pos) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func symbolSet(names []string) map[string]bool {
+	s := make(map[string]bool, len(names))
+	for _, n := range names {
+		s[n] = true
+	}
+	return s
+}
+
+// ============================================================
+// Radicals
+// ============================================================
+
+// maxRadicalBits bounds the integers RadSimp searches for perfect powers.
+const maxRadicalBits = 512
+
+// maxTrialDivisor bounds the trial division that finds perfect powers;
+// larger factors stay under the radical.
+const maxTrialDivisor = 1 << 16
+
+// RadSimp simplifies radicals. Perfect powers come out of numeric roots
+// and denominators are made rational, so sqrt(8) becomes 2*2^(1/2),
+// 16^(1/3) becomes 2*2^(1/3), 1/sqrt(2) becomes 1/2*2^(1/2) and
+// 1/(1 + sqrt(2)) becomes 2^(1/2) - 1. Numeric roots of the same degree in
+// a product merge, so sqrt(2)*sqrt(6) becomes 2*3^(1/2). A root of a
+// product splits off its nonnegative factors, and an even power under a
+// root becomes an absolute value, so sqrt(8*x^2) becomes
+// 2*2^(1/2)*abs(x); for the symbols listed in positive, which are taken
+// to be positive, the absolute value is dropped and sqrt(x^2) is x.
+func RadSimp(e Expr, positive ...string) Expr {
+	return radSimp(e.Simplify(), symbolSet(positive)).Simplify()
+}
+
+func radSimp(e Expr, pos map[string]bool) Expr {
+	if _, cs := labeledChildren(e); len(cs) > 0 {
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = radSimp(c, pos)
+		}
+		e = withChildren(e, out).Simplify()
+	}
+	switch t := e.(type) {
+	case *Pow:
+		return radPow(t, pos)
+	case *Mul:
+		return radMul(t)
+	}
+	return e
+}
+
+// radPow simplifies base^exp for a rational exp.
+func radPow(p *Pow, pos map[string]bool) Expr {
+	en, ok := p.exp.(*Num)
+	if !ok {
+		return p
+	}
+	switch b := p.base.(type) {
+	case *Num:
+		if b.Sign() > 0 && !en.IsInt() {
+			if r, ok := numRadical(b.val, en.val); ok {
+				return r
+			}
+		}
+	case *Add:
+		if en.IsInt() && en.Sign() < 0 {
+			if r, ok := rationalize(b); ok {
+				return radSimp(&Pow{base: r, exp: numRat(new(big.Rat).Neg(en.val))}, pos)
+			}
+		}
+	case *Pow:
+		m, ok := b.exp.(*Num)
+		if !ok || en.IsInt() {
+			break
+		}
+		if isPositive(b.base, pos) {
+			return radSimp(&Pow{base: b.base, exp: numRat(new(big.Rat).Mul(m.val, en.val))}, pos)
+		}
+		// u^m = |u|^m for even m, and |u| is nonnegative.
+		if k := new(big.Rat).Mul(m.val, en.val); m.IsInt() && m.val.Num().Bit(0) == 0 {
+			if k.IsInt() && k.Num().Bit(0) == 0 {
+				return (&Pow{base: b.base, exp: numRat(k)}).Simplify()
+			}
+			return (&Pow{base: AbsOf(b.base), exp: numRat(k)}).Simplify()
+		}
+	case *Mul:
+		if en.IsInt() {
+			break
+		}
+		var split, rest []Expr
+		for _, f := range b.factors {
+			switch {
+			case isNonnegative(f, pos):
+				split = append(split, radSimp(&Pow{base: f, exp: en}, pos))
+			case isNumValue(f, -1):
+				rest = append(rest, f)
+			default:
+				if n, ok := f.(*Num); ok && n.Sign() < 0 {
+					split = append(split, radSimp(&Pow{base: numRat(new(big.Rat).Neg(n.val)), exp: en}, pos))
+					f = N(-1)
+				}
+				rest = append(rest, f)
+			}
+		}
+		if len(split) == 0 {
+			break
+		}
+		if len(rest) > 0 {
+			split = append(split, &Pow{base: (&Mul{factors: rest}).Simplify(), exp: en})
+		}
+		return radMul(&Mul{factors: split})
+	}
+	return p
+}
+
+// isNonnegative reports whether e is nonnegative for all real values of
+// its symbols: positive in the sense of isPositive, an even power or an
+// absolute value.
+func isNonnegative(e Expr, pos map[string]bool) bool {
+	switch t := e.(type) {
+	case *Pow:
+		if n, ok := t.exp.(*Num); ok && n.IsInt() && n.val.Num().Bit(0) == 0 {
+			return true
+		}
+	case *Func:
+		if t.name == "abs" {
+			return true
+		}
+	}
+	return isPositive(e, pos)
+}
+
+// numRadical writes b^e, for rational b > 0 and non-integer e = p/q, as
+// c*m^(1/k) with c rational and m a positive integer free of k-th powers
+// below maxTrialDivisor, where k divides q. It fails when the numbers are
+// too large.
+func numRadical(b, e *big.Rat) (Expr, bool) {
+	q := e.Denom()
+	if !q.IsInt64() || q.Int64() > maxExactExponent {
+		return nil, false
+	}
+	qn := q.Int64()
+	// b^(p/q) = b^s * b^(r/q) with 0 < r < q, and (a/d)^(r/q) =
+	// (a^r*d^(q-r))^(1/q)/d, whose radicand is an integer.
+	s := new(big.Int).Div(e.Num(), q)
+	r := new(big.Int).Sub(e.Num(), new(big.Int).Mul(s, q)).Int64()
+	c, ok := ratPow(b, new(big.Rat).SetInt(s))
+	if !ok {
+		return nil, false
+	}
+	a, d := b.Num(), b.Denom()
+	n := new(big.Int).Mul(new(big.Int).Exp(a, big.NewInt(r), nil), new(big.Int).Exp(d, big.NewInt(qn-r), nil))
+	if n.BitLen() > maxRadicalBits {
+		return nil, false
+	}
+	k, m := perfectPower(n, qn)
+	c.Mul(c, new(big.Rat).SetFrac(k, d))
+	for g := qn; g > 1; g-- {
+		if qn%g == 0 {
+			if t, ok := intRoot(m, g); ok {
+				m, qn = t, qn/g
+				break
+			}
+		}
+	}
+	if m.Cmp(big.NewInt(1)) == 0 {
+		return numRat(c), true
+	}
+	return (&Mul{factors: []Expr{numRat(c), &Pow{base: numRat(new(big.Rat).SetInt(m)), exp: F(1, qn)}}}).Simplify(), true
+}
+
+// perfectPower writes n > 0 as k^q * m, removing the q-th powers of the
+// integers up to maxTrialDivisor from m.
+func perfectPower(n *big.Int, q int64) (k, m *big.Int) {
+	k, m = big.NewInt(1), new(big.Int).Set(n)
+	qq := big.NewInt(q)
+	rem := new(big.Int)
+	for d := int64(2); d <= maxTrialDivisor; d++ {
+		bd := big.NewInt(d)
+		dq := new(big.Int).Exp(bd, qq, nil)
+		if dq.Cmp(m) > 0 {
+			break
+		}
+		for {
+			quo, r := new(big.Int).QuoRem(m, dq, rem)
+			if r.Sign() != 0 {
+				break
+			}
+			m = quo
+			k.Mul(k, bd)
+		}
+	}
+	return k, m
+}
+
+// radMul merges the numeric roots of the same degree among the factors of
+// m, so that 2^(1/2)*3^(1/2) becomes 6^(1/2).
+func radMul(m *Mul) Expr {
+	groups := map[int64]*big.Rat{}
+	var degrees []int64
+	var rest []Expr
+	for _, f := range m.factors {
+		if p, ok := f.(*Pow); ok {
+			b, ok1 := p.base.(*Num)
+			e, ok2 := p.exp.(*Num)
+			if ok1 && ok2 && b.Sign() > 0 && e.val.Num().IsInt64() && e.val.Num().Int64() == 1 && e.val.Denom().IsInt64() {
+				q := e.val.Denom().Int64()
+				if g, ok := groups[q]; ok {
+					g.Mul(g, b.val)
+				} else {
+					groups[q] = new(big.Rat).Set(b.val)
+					degrees = append(degrees, q)
+				}
+				continue
+			}
+		}
+		rest = append(rest, f)
+	}
+	for _, q := range degrees {
+		r, ok := numRadical(groups[q], big.NewRat(1, q))
+		if !ok {
+			r = &Pow{base: numRat(groups[q]), exp: F(1, q)}
+		}
+		rest = append(rest, r)
+	}
+	return (&Mul{factors: rest}).Simplify()
+}
+
+// rationalize returns the reciprocal of a sum t1 + t2 whose terms have
+// rational squares, at least one of them irrational, as (t1 - t2)/(t1^2 -
+// t2^2), which has a rational denominator.
+func rationalize(a *Add) (Expr, bool) {
+	if len(a.terms) != 2 {
+		return nil, false
+	}
+	t1, t2 := a.terms[0], a.terms[1]
+	_, n1 := t1.(*Num)
+	_, n2 := t2.(*Num)
+	s1, ok1 := (&Pow{base: t1, exp: N(2)}).Simplify().(*Num)
+	s2, ok2 := (&Pow{base: t2, exp: N(2)}).Simplify().(*Num)
+	if n1 && n2 || !ok1 || !ok2 || s1.val.Cmp(s2.val) == 0 {
+		return nil, false
+	}
+	d := new(big.Rat).Sub(s1.val, s2.val)
+	return Expand(&Mul{factors: []Expr{numRat(d.Inv(d)), &Add{terms: []Expr{t1, neg(t2)}}}}), true
+}
+
+// ============================================================
+// Sequences and generating functions
+// ============================================================
+
+// LinearRecurrence is the sequence a_n = Coeffs[0]*a_{n-1} + ... +
+// Coeffs[k-1]*a_{n-k} for n >= k, started from Initial = a_0..a_{k-1}.
+type LinearRecurrence struct {
+	Coeffs  []Expr
+	Initial []Expr
+}
+
+// Terms returns a_0..a_{count-1}.
+func (r LinearRecurrence) Terms(count int) []Expr {
+	k := len(r.Coeffs)
+	out := make([]Expr, 0, count)
+	for n := 0; n < count; n++ {
+		if n < k && n < len(r.Initial) {
+			out = append(out, r.Initial[n].Simplify())
+			continue
+		}
+		terms := make([]Expr, k)
+		for i, c := range r.Coeffs {
+			terms[i] = &Mul{factors: []Expr{c, out[n-1-i]}}
+		}
+		out = append(out, Expand(&Add{terms: terms}))
+	}
+	return out
+}
+
+// OGF returns the ordinary generating function Σ a_n x^n as the rational
+// function P(x)/Q(x) with Q(x) = 1 - Σ c_i x^i.
+func (r LinearRecurrence) OGF(varName string) Expr {
+	x := S(varName)
+	q := []Expr{N(1)}
+	for i, c := range r.Coeffs {
+		q = append(q, &Mul{factors: []Expr{N(-1), c, &Pow{base: x, exp: N(int64(i + 1))}}})
+	}
+	// P is Q times the initial terms, truncated below degree k.
+	var p []Expr
+	for n, a := range r.Initial {
+		terms := []Expr{a}
+		for i := 0; i < n && i < len(r.Coeffs); i++ {
+			terms = append(terms, &Mul{factors: []Expr{N(-1), r.Coeffs[i], r.Initial[n-1-i]}})
+		}
+		p = append(p, &Mul{factors: []Expr{&Add{terms: terms}, &Pow{base: x, exp: N(int64(n))}}})
+	}
+	return div(Expand(&Add{terms: append(p, N(0))}), Expand(&Add{terms: q})).Simplify()
+}
+
+// EGF returns the exponential generating function Σ a_n x^n/n! in closed
+// form from the roots of the characteristic polynomial. Recurrences of
+// order 1 and 2 are supported.
+func (r LinearRecurrence) EGF(varName string) (Expr, error) {
+	if len(r.Initial) != len(r.Coeffs) {
+		return nil, fmt.Errorf("egf: need %d initial terms, got %d", len(r.Coeffs), len(r.Initial))
+	}
+	x := S(varName)
+	exp := func(alpha Expr) Expr { return ExpOf(&Mul{factors: []Expr{alpha, x}}) }
+	switch len(r.Coeffs) {
+	case 1:
+		return (&Mul{factors: []Expr{r.Initial[0], exp(r.Coeffs[0])}}).Simplify(), nil
+	case 2:
+		// t^2 - c1 t - c2 = 0
+		roots := SolveQuadratic(N(1), neg(r.Coeffs[0]), neg(r.Coeffs[1]))
+		if roots.Error != "" {
+			return nil, fmt.Errorf("egf: %s", roots.Error)
+		}
+		a0, a1 := r.Initial[0], r.Initial[1]
+		if len(roots.Solutions) == 1 {
+			// a_n = (A + B n) α^n, and Σ n α^n x^n/n! = α x e^(αx).
+			alpha := roots.Solutions[0]
+			if isNumValue(alpha, 0) {
+				return nil, fmt.Errorf("egf: degenerate recurrence")
+			}
+			b := sub(div(a1, alpha), a0)
+			return Expand(&Mul{factors: []Expr{&Add{terms: []Expr{a0, &Mul{factors: []Expr{b, alpha, x}}}}, exp(alpha)}}), nil
+		}
+		alpha, beta := roots.Solutions[0], roots.Solutions[1]
+		b := Expand(div(sub(a1, &Mul{factors: []Expr{alpha, a0}}), Expand(sub(beta, alpha))))
+		a := Expand(sub(a0, b))
+		return (&Add{terms: []Expr{&Mul{factors: []Expr{a, exp(alpha)}}, &Mul{factors: []Expr{b, exp(beta)}}}}).Simplify(), nil
+	}
+	return nil, fmt.Errorf("egf: recurrences of order %d are not supported", len(r.Coeffs))
+}
+
+// RecurrenceFromOGF recovers the linear recurrence whose ordinary
+// generating function is the rational function g = P/Q in varName, with
+// deg P < deg Q and Q(0) != 0.
+func RecurrenceFromOGF(g Expr, varName string) (LinearRecurrence, error) {
+	num, den := numerDenom(g.Simplify())
+	qc := PolyCoeffs(den, varName)
+	pc := PolyCoeffs(num, varName)
+	if qc == nil || pc == nil {
+		return LinearRecurrence{}, fmt.Errorf("ogf: %s is not a rational function of %s", g, varName)
+	}
+	k := 0
+	for d := range qc {
+		k = max(k, d)
+	}
+	for d := range pc {
+		if d >= k {
+			return LinearRecurrence{}, fmt.Errorf("ogf: numerator degree must be below denominator degree")
+		}
+	}
+	q0, ok := qc[0]
+	if !ok {
+		return LinearRecurrence{}, fmt.Errorf("ogf: denominator vanishes at %s = 0", varName)
+	}
+	r := LinearRecurrence{Coeffs: make([]Expr, k)}
+	for i := 1; i <= k; i++ {
+		c, ok := qc[i]
+		if !ok {
+			c = N(0)
+		}
+		r.Coeffs[i-1] = neg(div(c, q0)).Simplify()
+	}
+	r.Initial = OGFCoefficients(g, varName, k)
+	return r, nil
+}
+
+// OGFCoefficients returns a_0..a_{n-1} from g = Σ a_k x^k, read off the
+// Taylor series of g at 0.
+func OGFCoefficients(g Expr, varName string, n int) []Expr {
+	cs := PolyCoeffs(TaylorSeries(g, varName, N(0), n-1), varName)
+	out := make([]Expr, n)
+	for k := range out {
+		if c, ok := cs[k]; ok {
+			out[k] = c
+		} else {
+			out[k] = N(0)
+		}
+	}
+	return out
+}
+
+// EGFCoefficients returns a_0..a_{n-1} from g = Σ a_k x^k/k!.
+func EGFCoefficients(g Expr, varName string, n int) []Expr {
+	out := OGFCoefficients(g, varName, n)
+	fact := big.NewInt(1)
+	for k := range out {
+		if k > 0 {
+			fact.Mul(fact, big.NewInt(int64(k)))
+		}
+		out[k] = (&Mul{factors: []Expr{numRat(new(big.Rat).SetInt(fact)), out[k]}}).Simplify()
+	}
+	return out
+}
+
+// numerDenom splits e into numerator and denominator, moving factors with
+// negative integer exponents below the line.
+func numerDenom(e Expr) (Expr, Expr) {
+	factors := []Expr{e}
+	if m, ok := e.(*Mul); ok {
+		factors = m.factors
+	}
+	var num, den []Expr
+	for _, f := range factors {
+		if p, ok := f.(*Pow); ok {
+			if n, ok := p.exp.(*Num); ok && n.IsInt() && n.Sign() < 0 {
+				den = append(den, (&Pow{base: p.base, exp: numRat(new(big.Rat).Neg(n.val))}).Simplify())
+				continue
+			}
+		}
+		num = append(num, f)
+	}
+	return (&Mul{factors: append(num, N(1))}).Simplify(), (&Mul{factors: append(den, N(1))}).Simplify()
+}
+
+// SeqFromFloats converts computed values to exact terms for
+// GuessRecurrence and GuessFormula: each becomes the simplest rational
+// within a relative 1e-9 of it, so 0.333333333333 reads as 1/3.
+func SeqFromFloats(xs []float64) ([]Expr, error) {
+	out := make([]Expr, len(xs))
+	for i, x := range xs {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil, fmt.Errorf("term %d is %v", i, x)
+		}
+		tol := 1e-9 * math.Max(1, math.Abs(x))
+		lo, hi := new(big.Rat).SetFloat64(x-tol), new(big.Rat).SetFloat64(x+tol)
+		out[i] = numRat(simplestRational(lo, hi))
+	}
+	return out, nil
+}
+
+// ratSeq returns the values of the numeric terms of seq.
+func ratSeq(seq []Expr) ([]*big.Rat, error) {
+	out := make([]*big.Rat, len(seq))
+	for i, e := range seq {
+		n, ok := e.Simplify().(*Num)
+		if !ok {
+			return nil, fmt.Errorf("term %d (%s) is not a number", i, e)
+		}
+		out[i] = n.val
+	}
+	return out, nil
+}
+
+// GuessRecurrence finds the linear recurrence of least order k with
+// constant rational coefficients that reproduces seq, whose first term is
+// a_0. Order k is tried only with at least 2k+1 terms, k to fit the
+// coefficients and k+1 to check them.
+func GuessRecurrence(seq []Expr) (LinearRecurrence, error) {
+	a, err := ratSeq(seq)
+	if err != nil {
+		return LinearRecurrence{}, err
+	}
+	for k := 1; 2*k+1 <= len(a); k++ {
+		var rows [][]*big.Rat
+		var rhs []*big.Rat
+		for n := k; n < len(a); n++ {
+			row := make([]*big.Rat, k)
+			for i := range row {
+				row[i] = a[n-1-i]
+			}
+			rows, rhs = append(rows, row), append(rhs, a[n])
+		}
+		c, ok := solveRatSystem(rows, rhs)
+		if !ok {
+			continue
+		}
+		r := LinearRecurrence{Coeffs: make([]Expr, k), Initial: make([]Expr, k)}
+		for i := range c {
+			r.Coeffs[i], r.Initial[i] = numRat(c[i]), numRat(a[i])
+		}
+		return r, nil
+	}
+	return LinearRecurrence{}, fmt.Errorf("no linear recurrence of order at most %d fits the %d terms", (len(a)-1)/2, len(a))
+}
+
+// solveRatSystem returns a solution of the possibly overdetermined system
+// rows·c = rhs, with free unknowns set to 0, or false when it is
+// inconsistent.
+func solveRatSystem(rows [][]*big.Rat, rhs []*big.Rat) ([]*big.Rat, bool) {
+	k := len(rows[0])
+	m := make([][]*big.Rat, len(rows))
+	for i, row := range rows {
+		m[i] = make([]*big.Rat, k+1)
+		for j, v := range row {
+			m[i][j] = new(big.Rat).Set(v)
+		}
+		m[i][k] = new(big.Rat).Set(rhs[i])
+	}
+	var pivots []int
+	r := 0
+	for col := 0; col < k && r < len(m); col++ {
+		p := r
+		for p < len(m) && m[p][col].Sign() == 0 {
+			p++
+		}
+		if p == len(m) {
+			continue
+		}
+		m[r], m[p] = m[p], m[r]
+		inv := new(big.Rat).Inv(m[r][col])
+		for j := col; j <= k; j++ {
+			m[r][j].Mul(m[r][j], inv)
+		}
+		for i := range m {
+			if i == r || m[i][col].Sign() == 0 {
+				continue
+			}
+			f := new(big.Rat).Set(m[i][col])
+			for j := col; j <= k; j++ {
+				m[i][j].Sub(m[i][j], new(big.Rat).Mul(f, m[r][j]))
+			}
+		}
+		pivots = append(pivots, col)
+		r++
+	}
+	for i := r; i < len(m); i++ {
+		if m[i][k].Sign() != 0 {
+			return nil, false
+		}
+	}
+	c := make([]*big.Rat, k)
+	for j := range c {
+		c[j] = new(big.Rat)
+	}
+	for i, col := range pivots {
+		c[col].Set(m[i][k])
+	}
+	return c, true
+}
+
+// GuessFormula returns closed forms in varName for the sequence seq, whose
+// first term is at varName = 0, each of which reproduces every term:
+//
+//   - a polynomial, when the finite differences of some order d vanish
+//     and at least d+2 terms confirm it;
+//   - a sum of terms c*n^j*r^n, from the characteristic roots of the
+//     recurrence GuessRecurrence finds, when they are rational; a
+//     recurrence of order 2 with irrational roots gives the Binet-style
+//     form in square roots.
+//
+// Equal candidates are reported once, and it fails when none is found.
+func GuessFormula(seq []Expr, varName string) ([]Expr, error) {
+	a, err := ratSeq(seq)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []Expr
+	seen := map[string]bool{}
+	add := func(f Expr) {
+		if f == nil || seen[Expand(f).String()] || !fitsSeq(f, varName, a) {
+			return
+		}
+		seen[Expand(f).String()] = true
+		candidates = append(candidates, f)
+	}
+	add(polyFromDifferences(a, varName))
+	if r, err := GuessRecurrence(seq); err == nil {
+		add(closedFormOf(r, varName))
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no closed form found for the %d terms", len(a))
+	}
+	return candidates, nil
+}
+
+// polyFromDifferences returns Newton's forward-difference polynomial
+// Σ Δ^k a_0 C(n, k) when the differences of a of some order vanish with
+// at least one term to spare, or nil.
+func polyFromDifferences(a []*big.Rat, varName string) Expr {
+	n := S(varName)
+	d := append([]*big.Rat(nil), a...)
+	var terms []Expr
+	binom := Expr(N(1))
+	for k := 0; len(d) > 0; k++ {
+		zero := true
+		for _, v := range d {
+			zero = zero && v.Sign() == 0
+		}
+		if zero {
+			return Expand(&Add{terms: append(terms, N(0))})
+		}
+		terms = append(terms, &Mul{factors: []Expr{numRat(d[0]), binom}})
+		binom = &Mul{factors: []Expr{binom, sub(n, N(int64(k))), F(1, int64(k+1))}}
+		next := make([]*big.Rat, len(d)-1)
+		for i := range next {
+			next[i] = new(big.Rat).Sub(d[i+1], d[i])
+		}
+		d = next
+	}
+	return nil
+}
+
+// closedFormOf solves the recurrence r through its characteristic roots,
+// or returns nil when a root is 0 or irrational beyond order 2.
+func closedFormOf(r LinearRecurrence, varName string) Expr {
+	n := S(varName)
+	k := len(r.Coeffs)
+	p := make([]*big.Rat, k+1)
+	p[k] = big.NewRat(1, 1)
+	for i, c := range r.Coeffs {
+		p[k-1-i] = new(big.Rat).Neg(c.(*Num).val)
+	}
+	if p[0].Sign() == 0 {
+		return nil
+	}
+	type basis struct {
+		root *big.Rat
+		j    int
+	}
+	var bs []basis
+	for _, root := range rationalRoots(primitivePoly(p)) {
+		for q, j := p, 0; ; j++ {
+			quo, rem := polyDivMod(q, []*big.Rat{new(big.Rat).Neg(root), big.NewRat(1, 1)})
+			if len(rem) > 0 {
+				break
+			}
+			bs, q = append(bs, basis{root, j}), quo
+		}
+	}
+	if len(bs) < k {
+		if k != 2 {
+			return nil
+		}
+		roots := SolveQuadratic(N(1), neg(r.Coeffs[0]), neg(r.Coeffs[1]))
+		if roots.Error != "" || len(roots.Solutions) != 2 {
+			return nil
+		}
+		alpha, beta := roots.Solutions[0], roots.Solutions[1]
+		a0, a1 := r.Initial[0], r.Initial[1]
+		b := Expand(div(sub(a1, &Mul{factors: []Expr{alpha, a0}}), Expand(sub(beta, alpha))))
+		return (&Add{terms: []Expr{
+			&Mul{factors: []Expr{Expand(sub(a0, b)), &Pow{base: alpha, exp: n}}},
+			&Mul{factors: []Expr{b, &Pow{base: beta, exp: n}}},
+		}}).Simplify()
+	}
+	rows := make([][]*big.Rat, k)
+	rhs := make([]*big.Rat, k)
+	for m := range rows {
+		rows[m] = make([]*big.Rat, k)
+		for i, b := range bs {
+			v, _ := ratPow(b.root, big.NewRat(int64(m), 1))
+			rows[m][i] = v.Mul(v, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(int64(m)), big.NewInt(int64(b.j)), nil)))
+		}
+		rhs[m] = r.Initial[m].(*Num).val
+	}
+	c, ok := solveRatSystem(rows, rhs)
+	if !ok {
+		return nil
+	}
+	terms := []Expr{N(0)}
+	for i, b := range bs {
+		terms = append(terms, &Mul{factors: []Expr{numRat(c[i]), &Pow{base: n, exp: N(int64(b.j))}, &Pow{base: numRat(b.root), exp: n}}})
+	}
+	return (&Add{terms: terms}).Simplify()
+}
+
+// fitsSeq reports whether f at varName = 0, 1, ... gives the terms a:
+// exactly when it simplifies to a number, else within a relative 1e-9.
+func fitsSeq(f Expr, varName string, a []*big.Rat) bool {
+	for i, want := range a {
+		v := f.Sub(varName, N(int64(i))).Simplify()
+		if n, ok := v.(*Num); ok {
+			if n.val.Cmp(want) != 0 {
+				return false
+			}
+			continue
+		}
+		got, ok := evalFloat(v, nil)
+		w, _ := want.Float64()
+		if !ok || math.Abs(got-w) > 1e-9*math.Max(1, math.Abs(w)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ============================================================
+// Solvers
+// ============================================================
+
+// SolveResult holds the solutions produced by a solver.
+type SolveResult struct {
+	Solutions []Expr
+	ExactForm bool
+	Error     string
+	// Conditions are the assumptions on symbolic coefficients under which
+	// the solutions hold, e.g. a != 0 when dividing by a.
+	Conditions []Cond
+}
+
+// SolveLinear solves a*x + b = 0 for x.
+func SolveLinear(a, b Expr) SolveResult {
+	as := a.Simplify()
+	if n, ok := as.(*Num); ok && n.IsZero() {
+		return SolveResult{Error: "no unique solution: coefficient a is zero"}
+	}
+	sol := neg(div(b, as)).Simplify()
+	return SolveResult{Solutions: []Expr{sol}, ExactForm: true, Conditions: nonzeroConds(as)}
+}
+
+// nonzeroConds returns the condition d != 0 when d depends on parameters.
+func nonzeroConds(d Expr) []Cond {
+	if len(FreeSymbols(d)) == 0 {
+		return nil
+	}
+	c := zeroCond(d)
+	c.Op = RelNe
+	return []Cond{c}
+}
+
+// SolveQuadratic solves a*x^2 + b*x + c = 0 for x. Roots are returned in
+// exact radical form; complex roots are reported as an error. With
+// symbolic coefficients the result carries the conditions a != 0 and, for
+// real roots, discriminant >= 0.
+func SolveQuadratic(a, b, c Expr) SolveResult {
+	as := a.Simplify()
+	if n, ok := as.(*Num); ok && n.IsZero() {
+		return SolveLinear(b, c)
+	}
+	disc := sub(&Pow{base: b, exp: N(2)}, &Mul{factors: []Expr{N(4), as, c}}).Simplify()
+	twoA := &Mul{factors: []Expr{N(2), as}}
+	conds := nonzeroConds(as)
+	if d, ok := disc.(*Num); ok {
+		switch d.Sign() {
+		case -1:
+			return SolveResult{Error: fmt.Sprintf("complex roots: discriminant %s < 0", d)}
+		case 0:
+			return SolveResult{Solutions: []Expr{neg(div(b, twoA)).Simplify()}, ExactForm: true, Conditions: conds}
+		}
+	} else if len(FreeSymbols(disc)) > 0 {
+		conds = append(conds, Cond{disc, RelGe, N(0)})
+	}
+	root := SqrtOf(disc)
+	r1 := div(sub(neg(b), root), twoA).Simplify()
+	r2 := div(&Add{terms: []Expr{neg(b), root}}, twoA).Simplify()
+	if v1, ok := r1.Eval(); ok {
+		if v2, ok := r2.Eval(); ok && v1.val.Cmp(v2.val) > 0 {
+			r1, r2 = r2, r1
+		}
+	}
+	return SolveResult{Solutions: []Expr{r1, r2}, ExactForm: true, Conditions: conds}
+}
+
+// SolveLinearSystem2x2 solves
+//
+//	a1*x + b1*y = c1
+//	a2*x + b2*y = c2
+//
+// exactly using Cramer's rule.
+func SolveLinearSystem2x2(a1, b1, c1, a2, b2, c2 Expr) (Expr, Expr, error) {
+	det := sub(&Mul{factors: []Expr{a1, b2}}, &Mul{factors: []Expr{a2, b1}}).Simplify()
+	if n, ok := det.(*Num); ok && n.IsZero() {
+		return nil, nil, fmt.Errorf("system is singular")
+	}
+	dx := sub(&Mul{factors: []Expr{c1, b2}}, &Mul{factors: []Expr{c2, b1}})
+	dy := sub(&Mul{factors: []Expr{a1, c2}}, &Mul{factors: []Expr{a2, c1}})
+	return div(dx, det).Simplify(), div(dy, det).Simplify(), nil
+}
+
+// SolveLinearSystem solves the square system of equations eqs, linear in
+// vars, by Gaussian elimination and returns the value of each variable in
+// the order of vars. Coefficients may be symbolic; the solution then holds
+// where the pivots are nonzero. It is an error for the system not to be
+// square, for an equation not to be linear in vars, or for it to be
+// singular.
+func SolveLinearSystem(eqs []*Equation, vars []string) ([]Expr, error) {
+	if len(vars) == 0 || len(eqs) != len(vars) {
+		return nil, fmt.Errorf("system: %d equations in %d unknowns", len(eqs), len(vars))
+	}
+	res := make([]Expr, len(eqs))
+	for i, eq := range eqs {
+		res[i] = eq.Residual()
+	}
+	sol, ok, err := solveLinearExact(res, vars)
+	if !ok {
+		return nil, fmt.Errorf("system: equations are not linear in %s", strings.Join(vars, ", "))
+	}
+	return sol, err
+}
+
+// FindRoot solves e = 0 for varName by Newton's method from x0, using the
+// symbolic derivative. It fails when e or its derivative cannot be
+// evaluated, the derivative vanishes, or 100 iterations do not converge.
+func FindRoot(e Expr, varName string, x0 float64) (float64, error) {
+	root := x0
+	err := newtonIterate(e, varName, x0, func(_ int, x, _ float64) bool {
+		root = x
+		return true
+	})
+	return root, err
+}
+
+// newtonIterate runs FindRoot, calling yield with each iterate and its
+// residual. Returning false from yield stops the iteration without error.
+func newtonIterate(e Expr, varName string, x0 float64, yield func(iter int, x, fx float64) bool) error {
+	de := Diff(e, varName)
+	env := map[string]float64{}
+	x := x0
+	for iter := 0; iter <= 100; iter++ {
+		env[varName] = x
+		fx, ok := evalFloat(e, env)
+		if !ok || math.IsNaN(fx) || math.IsInf(fx, 0) {
+			return fmt.Errorf("find_root: %s is not numeric at %s = %g", e, varName, x)
+		}
+		if !yield(iter, x, fx) || fx == 0 {
+			return nil
+		}
+		dfx, ok := evalFloat(de, env)
+		if !ok || dfx == 0 {
+			return fmt.Errorf("find_root: derivative vanishes at %s = %g", varName, x)
+		}
+		step := fx / dfx
+		x -= step
+		if math.Abs(step) <= 1e-15*(1+math.Abs(x)) {
+			env[varName] = x
+			fx, _ = evalFloat(e, env)
+			yield(iter+1, x, fx)
+			return nil
+		}
+	}
+	return fmt.Errorf("find_root: no convergence from %s = %g", varName, x0)
+}
+
+// ODEPoint is one sample of a numeric ODE solution.
+type ODEPoint struct {
+	T, Y float64
+}
+
+// SolveODE integrates dy/dt = f(t, y) from (t0, y0) to t1 with the
+// classical fourth-order Runge–Kutta method in the given number of equal
+// steps, returning steps+1 points including the initial value.
+func SolveODE(f Expr, t, y string, t0, y0, t1 float64, steps int) ([]ODEPoint, error) {
+	pts := []ODEPoint{{t0, y0}}
+	err := rk4Iterate(f, t, y, t0, y0, t1, steps, func(_ int, p ODEPoint) bool {
+		pts = append(pts, p)
+		return true
+	})
+	return pts, err
+}
+
+// rk4Iterate runs SolveODE, calling yield after each step. Returning false
+// from yield stops the integration without error.
+func rk4Iterate(f Expr, t, y string, t0, y0, t1 float64, steps int, yield func(step int, p ODEPoint) bool) error {
+	if steps < 1 {
+		return fmt.Errorf("ode: steps must be positive")
+	}
+	env := map[string]float64{}
+	var evalErr error
+	rhs := func(tv, yv float64) float64 {
+		env[t], env[y] = tv, yv
+		v, ok := evalFloat(f, env)
+		if (!ok || math.IsNaN(v) || math.IsInf(v, 0)) && evalErr == nil {
+			evalErr = fmt.Errorf("ode: %s is not numeric at %s = %g, %s = %g", f, t, tv, y, yv)
+		}
+		return v
+	}
+	h := (t1 - t0) / float64(steps)
+	tv, yv := t0, y0
+	for k := 1; k <= steps; k++ {
+		k1 := rhs(tv, yv)
+		k2 := rhs(tv+h/2, yv+h/2*k1)
+		k3 := rhs(tv+h/2, yv+h/2*k2)
+		k4 := rhs(tv+h, yv+h*k3)
+		if evalErr != nil {
+			return evalErr
+		}
+		yv += h / 6 * (k1 + 2*k2 + 2*k3 + k4)
+		tv = t0 + float64(k)*h
+		if !yield(k, ODEPoint{tv, yv}) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// RootInterval is a closed interval [Lo, Hi] with exact endpoints; Lo ==
+// Hi marks an exact root.
+type RootInterval struct {
+	Lo, Hi *Num
+}
+
+func (r RootInterval) String() string { return fmt.Sprintf("[%s, %s]", r.Lo, r.Hi) }
+
+// RootIsolation is the result of CertifyRoots. Each interval in Roots
+// contains exactly one root and each interval in RootFree contains none;
+// Unresolved lists the parts where neither could be proven.
+type RootIsolation struct {
+	Roots      []RootInterval
+	RootFree   []RootInterval
+	Unresolved []RootInterval
+}
+
+// CertifyRoots isolates the real roots of e = 0 on [lo, hi], where e
+// depends on varName only.
+//
+// A polynomial with rational coefficients is handled exactly: Sturm
+// sequences count the distinct roots of each subinterval, bisection
+// separates them, and sign changes narrow each isolating interval to a
+// width of at most (hi-lo)/2^32. Nothing is left unresolved.
+//
+// Any other expression is bisected up to 40 levels deep with
+// IntervalDomain: an interval is root-free when the enclosure of e excludes
+// 0, and holds exactly one root when the enclosure of the derivative
+// excludes 0 and e changes sign at the endpoints. Intervals where e or its
+// derivative has no enclosure, or that reach the depth limit, are
+// unresolved.
+func CertifyRoots(e Expr, varName string, lo, hi *Num) (RootIsolation, error) {
+	if lo.val.Cmp(hi.val) > 0 {
+		return RootIsolation{}, fmt.Errorf("certify: empty interval [%s, %s]", lo, hi)
+	}
+	for _, name := range FreeSymbols(e) {
+		if name != varName {
+			return RootIsolation{}, fmt.Errorf("certify: %s depends on %s", e, name)
+		}
+	}
+	if p, ok := ratPoly(e, varName); ok {
+		if len(p) == 0 {
+			return RootIsolation{}, fmt.Errorf("certify: %s is identically zero", e)
+		}
+		return sturmIsolate(p, lo.val, hi.val), nil
+	}
+	return intervalIsolate(e, varName, lo.val, hi.val), nil
+}
+
+// CountRealRoots returns the number of distinct real roots of the
+// polynomial e in [lo, hi], computed exactly with a Sturm sequence.
+func CountRealRoots(e Expr, varName string, lo, hi *Num) (int, error) {
+	if lo.val.Cmp(hi.val) > 0 {
+		return 0, fmt.Errorf("certify: empty interval [%s, %s]", lo, hi)
+	}
+	p, ok := ratPoly(e, varName)
+	if !ok {
+		return 0, fmt.Errorf("certify: %s is not a polynomial in %s with rational coefficients", e, varName)
+	}
+	if len(p) == 0 {
+		return 0, fmt.Errorf("certify: %s is identically zero", e)
+	}
+	return newSturm(p).count(lo.val, hi.val), nil
+}
+
+// ratPoly returns the coefficients of e in ascending degree, trimmed of
+// leading zeros, when e is a polynomial with rational coefficients.
+func ratPoly(e Expr, varName string) ([]*big.Rat, bool) {
+	cs := PolyCoeffs(e, varName)
+	if cs == nil {
+		return nil, false
+	}
+	p := make([]*big.Rat, Degree(e, varName)+1)
+	for i := range p {
+		p[i] = new(big.Rat)
+	}
+	for k, c := range cs {
+		n, ok := c.(*Num)
+		if !ok {
+			return nil, false
+		}
+		p[k].Set(n.val)
+	}
+	return trimPoly(p), true
+}
+
+func trimPoly(p []*big.Rat) []*big.Rat {
+	for len(p) > 0 && p[len(p)-1].Sign() == 0 {
+		p = p[:len(p)-1]
+	}
+	return p
+}
+
+func polyAt(p []*big.Rat, x *big.Rat) *big.Rat {
+	v := new(big.Rat)
+	for i := len(p) - 1; i >= 0; i-- {
+		v.Mul(v, x).Add(v, p[i])
+	}
+	return v
+}
+
+// polyDivMod returns the quotient and remainder of a / b.
+func polyDivMod(a, b []*big.Rat) (q, r []*big.Rat) {
+	r = make([]*big.Rat, len(a))
+	for i, c := range a {
+		r[i] = new(big.Rat).Set(c)
+	}
+	if len(a) < len(b) {
+		return nil, r
+	}
+	q = make([]*big.Rat, len(a)-len(b)+1)
+	lead := b[len(b)-1]
+	for k := len(q) - 1; k >= 0; k-- {
+		c := new(big.Rat).Quo(r[k+len(b)-1], lead)
+		q[k] = c
+		for j, bj := range b {
+			r[k+j].Sub(r[k+j], new(big.Rat).Mul(c, bj))
+		}
+	}
+	return q, trimPoly(r[:len(b)-1])
+}
+
+func polyDeriv(p []*big.Rat) []*big.Rat {
+	if len(p) <= 1 {
+		return nil
+	}
+	d := make([]*big.Rat, len(p)-1)
+	for i := range d {
+		d[i] = new(big.Rat).Mul(p[i+1], new(big.Rat).SetInt64(int64(i+1)))
+	}
+	return trimPoly(d)
+}
+
+// polyGCD returns the monic greatest common divisor of a and b, or nil
+// when both are zero.
+func polyGCD(a, b []*big.Rat) []*big.Rat {
+	for len(b) > 0 {
+		_, r := polyDivMod(a, b)
+		a, b = b, r
+	}
+	if len(a) == 0 {
+		return nil
+	}
+	lead := a[len(a)-1]
+	out := make([]*big.Rat, len(a))
+	for i, c := range a {
+		out[i] = new(big.Rat).Quo(c, lead)
+	}
+	return out
+}
+
+func polySub(a, b []*big.Rat) []*big.Rat {
+	out := make([]*big.Rat, max(len(a), len(b)))
+	for i := range out {
+		out[i] = new(big.Rat)
+		if i < len(a) {
+			out[i].Set(a[i])
+		}
+		if i < len(b) {
+			out[i].Sub(out[i], b[i])
+		}
+	}
+	return trimPoly(out)
+}
+
+func polyAdd(a, b []*big.Rat) []*big.Rat {
+	out := make([]*big.Rat, max(len(a), len(b)))
+	for i := range out {
+		out[i] = new(big.Rat)
+		if i < len(a) {
+			out[i].Add(out[i], a[i])
+		}
+		if i < len(b) {
+			out[i].Add(out[i], b[i])
+		}
+	}
+	return trimPoly(out)
+}
+
+func polyMul(a, b []*big.Rat) []*big.Rat {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	out := make([]*big.Rat, len(a)+len(b)-1)
+	for i := range out {
+		out[i] = new(big.Rat)
+	}
+	for i, x := range a {
+		for j, y := range b {
+			out[i+j].Add(out[i+j], new(big.Rat).Mul(x, y))
+		}
+	}
+	return trimPoly(out)
+}
+
+// polyInvMod returns s with s*a = 1 mod m and deg s < deg m, by the
+// extended Euclidean algorithm, or false when a and m are not coprime.
+func polyInvMod(a, m []*big.Rat) ([]*big.Rat, bool) {
+	_, r1 := polyDivMod(a, m)
+	r0 := m
+	var s0, s1 []*big.Rat = nil, []*big.Rat{big.NewRat(1, 1)}
+	for len(r1) > 1 {
+		q, r := polyDivMod(r0, r1)
+		r0, r1 = r1, r
+		s0, s1 = s1, polySub(s0, polyMul(q, s1))
+	}
+	if len(r1) == 0 {
+		return nil, false
+	}
+	inv := new(big.Rat).Inv(r1[0])
+	for _, c := range s1 {
+		c.Mul(c, inv)
+	}
+	_, s := polyDivMod(s1, m)
+	return s, true
+}
+
+// squareFree divides p by gcd(p, p'), leaving each root with multiplicity
+// one.
+func squareFree(p []*big.Rat) []*big.Rat {
+	q, _ := polyDivMod(p, polyGCD(p, polyDeriv(p)))
+	return q
+}
+
+// yun returns the square-free decomposition of the nonzero p by Yun's
+// algorithm: element i is the monic product of the factors of p of
+// multiplicity i+1, possibly 1.
+func yun(p []*big.Rat) [][]*big.Rat {
+	if len(p) <= 1 {
+		return nil
+	}
+	dp := polyDeriv(p)
+	g := polyGCD(p, dp)
+	b, _ := polyDivMod(p, g)
+	c, _ := polyDivMod(dp, g)
+	var out [][]*big.Rat
+	for len(b) > 1 {
+		d := polySub(c, polyDeriv(b))
+		a := polyGCD(b, d)
+		out = append(out, a)
+		b, _ = polyDivMod(b, a)
+		c, _ = polyDivMod(d, a)
+	}
+	return out
+}
+
+// primitivePoly scales the nonzero p to integer coefficients without a
+// common divisor and a positive leading coefficient.
+func primitivePoly(p []*big.Rat) []*big.Rat {
+	den, num := big.NewInt(1), new(big.Int)
+	for _, c := range p {
+		d := c.Denom()
+		den.Mul(den, new(big.Int).Quo(d, new(big.Int).GCD(nil, nil, den, d)))
+	}
+	out := make([]*big.Rat, len(p))
+	for i, c := range p {
+		out[i] = new(big.Rat).Mul(c, new(big.Rat).SetInt(den))
+		num.GCD(nil, nil, num, new(big.Int).Abs(out[i].Num()))
+	}
+	if p[len(p)-1].Sign() < 0 {
+		num.Neg(num)
+	}
+	for _, c := range out {
+		c.Quo(c, new(big.Rat).SetInt(num))
+	}
+	return out
+}
+
+// rationalRoots returns the distinct rational roots of the primitive
+// integer polynomial p in increasing order. By the rational root theorem
+// each is ±a/b with a dividing the lowest nonzero coefficient and b the
+// leading one; the search is skipped when either exceeds 2^40.
+func rationalRoots(p []*big.Rat) []*big.Rat {
+	var roots []*big.Rat
+	low := 0
+	for p[low].Sign() == 0 {
+		low++
+	}
+	if low > 0 {
+		roots = append(roots, new(big.Rat))
+	}
+	if len(p)-low <= 1 {
+		return roots
+	}
+	as, ok1 := divisors(p[low].Num())
+	bs, ok2 := divisors(p[len(p)-1].Num())
+	if !ok1 || !ok2 {
+		return roots
+	}
+	seen := map[string]bool{}
+	for _, a := range as {
+		for _, b := range bs {
+			for _, r := range []*big.Rat{new(big.Rat).SetFrac(a, b), new(big.Rat).SetFrac(new(big.Int).Neg(a), b)} {
+				if !seen[r.String()] && polyAt(p, r).Sign() == 0 {
+					roots = append(roots, r)
+				}
+				seen[r.String()] = true
+			}
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Cmp(roots[j]) < 0 })
+	return roots
+}
+
+// ratFactors returns the factors of the nonzero f for FactorList.
+func ratFactors(f []*big.Rat) []intPolyFactor {
+	var fs []intPolyFactor
+	for i, g := range yun(f) {
+		g = primitivePoly(g)
+		for _, r := range rationalRoots(g) {
+			// The root a/b gives the factor b*x - a.
+			lin := []*big.Rat{new(big.Rat).SetInt(new(big.Int).Neg(r.Num())), new(big.Rat).SetInt(r.Denom())}
+			fs = append(fs, intPolyFactor{lin, i + 1})
+			g, _ = polyDivMod(g, lin)
+		}
+		if len(g) > 1 {
+			for _, h := range kroneckerQuadratics(primitivePoly(g)) {
+				fs = append(fs, intPolyFactor{h, i + 1})
+			}
+		}
+	}
+	return fs
+}
+
+// kroneckerQuadratics splits the primitive integer polynomial g, which has
+// no rational roots, into the quadratic factors kroneckerQuadratic finds
+// and the primitive rest. A cubic rest is irreducible, having no linear
+// factor.
+func kroneckerQuadratics(g []*big.Rat) [][]*big.Rat {
+	var out [][]*big.Rat
+	for len(g) > 4 {
+		q := kroneckerQuadratic(g)
+		if q == nil {
+			break
+		}
+		out = append(out, q)
+		g, _ = polyDivMod(g, q)
+		g = primitivePoly(g)
+	}
+	return append(out, g)
+}
+
+// kroneckerMaxTrials bounds the candidate quadratics kroneckerQuadratic
+// tries.
+const kroneckerMaxTrials = 20000
+
+// kroneckerQuadratic returns a primitive quadratic factor of the integer
+// polynomial g without rational roots, or nil. A factor q = a*x^2 + b*x +
+// c is fixed by q(0), q(1) and q(-1), which divide g(0), g(1) and g(-1),
+// none of them 0; each choice of divisors, with q(0) > 0 as -q serves as
+// well, is interpolated and tried by division.
+func kroneckerQuadratic(g []*big.Rat) []*big.Rat {
+	var ds [3][]*big.Int
+	trials := 1
+	for i, x := range []int64{0, 1, -1} {
+		d, ok := divisors(polyAt(g, big.NewRat(x, 1)).Num())
+		if !ok {
+			return nil
+		}
+		ds[i] = d
+		if trials *= len(d); i > 0 {
+			trials *= 2
+		}
+	}
+	if trials > kroneckerMaxTrials {
+		return nil
+	}
+	two := big.NewRat(2, 1)
+	for _, q0 := range ds[0] {
+		for _, d1 := range ds[1] {
+			for _, d2 := range ds[2] {
+				for _, signs := range [][2]int{{1, 1}, {1, -1}, {-1, 1}, {-1, -1}} {
+					c := new(big.Rat).SetInt(q0)
+					q1 := new(big.Rat).SetInt(d1)
+					q2 := new(big.Rat).SetInt(d2)
+					if signs[0] < 0 {
+						q1.Neg(q1)
+					}
+					if signs[1] < 0 {
+						q2.Neg(q2)
+					}
+					// q(1) = a + b + c and q(-1) = a - b + c.
+					a := new(big.Rat).Sub(new(big.Rat).Quo(new(big.Rat).Add(q1, q2), two), c)
+					b := new(big.Rat).Quo(new(big.Rat).Sub(q1, q2), two)
+					if a.Sign() == 0 || !a.IsInt() || !b.IsInt() {
+						continue
+					}
+					q := []*big.Rat{c, b, a}
+					if _, r := polyDivMod(g, q); len(r) == 0 {
+						return primitivePoly(q)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// divisors returns the positive divisors of n, or false when |n| > 2^40.
+func divisors(n *big.Int) ([]*big.Int, bool) {
+	if n.CmpAbs(new(big.Int).Lsh(big.NewInt(1), 40)) > 0 {
+		return nil, false
+	}
+	m := new(big.Int).Abs(n).Int64()
+	var small, large []*big.Int
+	for d := int64(1); d*d <= m; d++ {
+		if m%d == 0 {
+			small = append(small, big.NewInt(d))
+			if d*d != m {
+				large = append(large, big.NewInt(m/d))
+			}
+		}
+	}
+	for i := len(large) - 1; i >= 0; i-- {
+		small = append(small, large[i])
+	}
+	return small, true
+}
+
+// ratPolyExpr builds the expression with coefficients p in varName.
+func ratPolyExpr(p []*big.Rat, varName string) Expr {
+	terms := make([]Expr, 0, len(p)+1)
+	for k, c := range p {
+		if c.Sign() != 0 {
+			terms = append(terms, &Mul{factors: []Expr{numRat(c), &Pow{base: S(varName), exp: N(int64(k))}}})
+		}
+	}
+	return (&Add{terms: append(terms, N(0))}).Simplify()
+}
+
+// sturm is the Sturm sequence of a square-free polynomial.
+type sturm [][]*big.Rat
+
+func newSturm(p []*big.Rat) sturm {
+	p = squareFree(p)
+	seq := sturm{p, polyDeriv(p)}
+	for len(seq[len(seq)-1]) > 0 {
+		_, r := polyDivMod(seq[len(seq)-2], seq[len(seq)-1])
+		for _, c := range r {
+			c.Neg(c)
+		}
+		seq = append(seq, r)
+	}
+	return seq[:len(seq)-1]
+}
+
+// changes counts the sign changes of the sequence at x, skipping zeros.
+func (s sturm) changes(x *big.Rat) int {
+	n, last := 0, 0
+	for _, p := range s {
+		sg := polyAt(p, x).Sign()
+		if sg == 0 {
+			continue
+		}
+		if last != 0 && sg != last {
+			n++
+		}
+		last = sg
+	}
+	return n
+}
+
+// count is the number of distinct roots in [a, b]. Since the polynomial is
+// square-free, changes(a) - changes(b) counts the roots in (a, b].
+func (s sturm) count(a, b *big.Rat) int {
+	n := s.changes(a) - s.changes(b)
+	if polyAt(s[0], a).Sign() == 0 {
+		n++
+	}
+	return n
+}
+
+func sturmIsolate(p []*big.Rat, lo, hi *big.Rat) RootIsolation {
+	s := newSturm(p)
+	minWidth := new(big.Rat).Sub(hi, lo)
+	minWidth.Quo(minWidth, new(big.Rat).SetInt64(1<<32))
+	var out RootIsolation
+	var split func(a, b *big.Rat, n int)
+	split = func(a, b *big.Rat, n int) {
+		switch {
+		case n == 0:
+			out.RootFree = append(out.RootFree, RootInterval{numRat(a), numRat(b)})
+			return
+		case n == 1:
+			r := refineRoot(s[0], a, b, minWidth)
+			out.Roots = append(out.Roots, r)
+			if r.Lo.val.Cmp(r.Hi.val) != 0 {
+				// The trimmed ends keep the sign of p at a and b.
+				if r.Lo.val.Cmp(a) > 0 {
+					out.RootFree = append(out.RootFree, RootInterval{numRat(a), r.Lo})
+				}
+				if r.Hi.val.Cmp(b) < 0 {
+					out.RootFree = append(out.RootFree, RootInterval{r.Hi, numRat(b)})
+				}
+			}
+			return
+		}
+		m := splitPoint(s[0], a, b)
+		left := s.count(a, m)
+		split(a, m, left)
+		split(m, b, n-left)
+	}
+	split(new(big.Rat).Set(lo), new(big.Rat).Set(hi), s.count(lo, hi))
+	return out
+}
+
+// splitPoint returns a point strictly inside (a, b) that is not a root of
+// p: the midpoint, or failing that a nearby fraction of the interval.
+func splitPoint(p []*big.Rat, a, b *big.Rat) *big.Rat {
+	w := new(big.Rat).Sub(b, a)
+	for den := int64(2); ; den++ {
+		for num := int64(1); num < den; num++ {
+			m := new(big.Rat).Mul(w, big.NewRat(num, den))
+			m.Add(m, a)
+			if polyAt(p, m).Sign() != 0 {
+				return m
+			}
+		}
+	}
+}
+
+// refineRoot narrows an interval holding exactly one root of the
+// square-free p by bisection on sign until it is at most minWidth wide or
+// the root is hit exactly.
+func refineRoot(p []*big.Rat, a, b, minWidth *big.Rat) RootInterval {
+	sa, sb := polyAt(p, a).Sign(), polyAt(p, b).Sign()
+	switch {
+	case sa == 0:
+		return RootInterval{numRat(a), numRat(a)}
+	case sb == 0:
+		return RootInterval{numRat(b), numRat(b)}
+	}
+	// A single simple root inside (a, b) means p changes sign.
+	half := big.NewRat(1, 2)
+	for w := new(big.Rat).Sub(b, a); w.Cmp(minWidth) > 0; w.Sub(b, a) {
+		m := new(big.Rat).Add(a, b)
+		m.Mul(m, half)
+		switch sm := polyAt(p, m).Sign(); {
+		case sm == 0:
+			return RootInterval{numRat(m), numRat(m)}
+		case sm == sa:
+			a = m
+		default:
+			b = m
+		}
+	}
+	return RootInterval{numRat(a), numRat(b)}
+}
+
+func intervalIsolate(e Expr, varName string, lo, hi *big.Rat) RootIsolation {
+	de := Diff(e, varName)
+	at := func(f Expr, a, b float64) (Interval, bool) {
+		v, err := EvalIn[Interval](f, IntervalDomain{}, map[string]Interval{varName: {a, b}})
+		return v, err == nil && !math.IsNaN(v.Lo) && !math.IsNaN(v.Hi)
+	}
+	// sign is the certified sign of e at x, or 0 if it is unknown.
+	sign := func(x float64) int {
+		v, ok := at(e, x, x)
+		switch {
+		case ok && v.Lo > 0:
+			return 1
+		case ok && v.Hi < 0:
+			return -1
+		}
+		return 0
+	}
+	// Round the endpoints outward so the bisected range covers [lo, hi].
+	a0, exact := lo.Float64()
+	if !exact {
+		a0 = down(a0)
+	}
+	b0, exact := hi.Float64()
+	if !exact {
+		b0 = up(b0)
+	}
+	minWidth := (b0 - a0) / (1 << 32)
+
+	type piece struct{ a, b float64 }
+	var roots, free, unresolved []piece
+	// Breadth first, so that a region where e cannot be enclosed does not
+	// use up the budget before the rest of the range is examined.
+	queue := []piece{{a0, b0}}
+	for depth := 0; len(queue) > 0; depth++ {
+		var next []piece
+		for _, p := range queue {
+			if fv, ok := at(e, p.a, p.b); ok && !fv.Contains(0) {
+				free = append(free, p)
+				continue
+			}
+			if dv, ok := at(de, p.a, p.b); ok && !dv.Contains(0) {
+				// e is strictly monotone on p.
+				sa, sb := sign(p.a), sign(p.b)
+				switch {
+				case sa != 0 && sa == sb:
+					free = append(free, p)
+					continue
+				case sa != 0 && sb == -sa:
+					a, b := p.a, p.b
+					for b-a > minWidth {
+						m := a + (b-a)/2
+						sm := sign(m)
+						if sm == 0 || m <= a || m >= b {
+							break
+						}
+						if sm == sa {
+							a = m
+						} else {
+							b = m
+						}
+					}
+					roots = append(roots, piece{a, b})
+					// The trimmed ends keep a certified sign.
+					if a > p.a {
+						free = append(free, piece{p.a, a})
+					}
+					if b < p.b {
+						free = append(free, piece{b, p.b})
+					}
+					continue
+				}
+			}
+			m := p.a + (p.b-p.a)/2
+			if depth == 40 || len(next) >= 1<<12 || m <= p.a || m >= p.b {
+				unresolved = append(unresolved, p)
+				continue
+			}
+			next = append(next, piece{p.a, m}, piece{m, p.b})
+		}
+		queue = next
+	}
+
+	// Report in order, merging adjacent root-free and unresolved pieces.
+	out := func(ps []piece, merge bool) []RootInterval {
+		sort.Slice(ps, func(i, j int) bool { return ps[i].a < ps[j].a })
+		var rs []RootInterval
+		for i, p := range ps {
+			if merge && i > 0 && ps[i-1].b == p.a {
+				rs[len(rs)-1].Hi = NFloat(p.b)
+				continue
+			}
+			rs = append(rs, RootInterval{NFloat(p.a), NFloat(p.b)})
+		}
+		return rs
+	}
+	return RootIsolation{Roots: out(roots, false), RootFree: out(free, true), Unresolved: out(unresolved, true)}
+}
+
+// ============================================================
+// Optimization
+// ============================================================
+
+// MinimizeOptions controls Minimize. Zero fields take their defaults.
+type MinimizeOptions struct {
+	// MaxIter bounds the number of BFGS iterations (default 200).
+	MaxIter int
+	// Tol is the gradient-norm (max-abs) convergence threshold (default 1e-8).
+	Tol float64
+}
+
+// MinimizeResult is the outcome of Minimize.
+type MinimizeResult struct {
+	X          []float64
+	Value      float64
+	Iterations int
+	Converged  bool
+}
+
+// Minimize finds a local minimum of e over the symbols syms starting from
+// x0. The gradient is derived symbolically once, then BFGS with a
+// backtracking line search runs on the numeric values. Every free symbol
+// of e must be listed in syms.
+func Minimize(e Expr, syms []string, x0 []float64, opts MinimizeOptions) (MinimizeResult, error) {
+	if len(syms) != len(x0) {
+		return MinimizeResult{}, fmt.Errorf("minimize: %d symbols but %d starting values", len(syms), len(x0))
+	}
+	if err := checkBound(e, syms); err != nil {
+		return MinimizeResult{}, fmt.Errorf("minimize: %w", err)
+	}
+	if opts.MaxIter <= 0 {
+		opts.MaxIter = 200
+	}
+	if opts.Tol <= 0 {
+		opts.Tol = 1e-8
+	}
+	e = e.Simplify()
+	grad := Gradient(e, syms...)
+	n := len(syms)
+	env := make(map[string]float64, n)
+	at := func(x []float64) map[string]float64 {
+		for i, s := range syms {
+			env[s] = x[i]
+		}
+		return env
+	}
+	f := func(x []float64) float64 {
+		v, ok := evalFloat(e, at(x))
+		if !ok || math.IsNaN(v) {
+			return math.Inf(1)
+		}
+		return v
+	}
+	gradAt := func(x []float64) []float64 {
+		g := make([]float64, n)
+		for i, d := range grad {
+			g[i], _ = evalFloat(d, at(x))
+		}
+		return g
+	}
+
+	x := append([]float64(nil), x0...)
+	fx, g := f(x), gradAt(x)
+	if math.IsInf(fx, 1) {
+		return MinimizeResult{}, fmt.Errorf("minimize: objective is undefined at the starting point")
+	}
+	h := identity(n)
+	res := MinimizeResult{}
+	for res.Iterations = 0; res.Iterations < opts.MaxIter; res.Iterations++ {
+		if maxAbs(g) < opts.Tol {
+			res.Converged = true
+			break
+		}
+		p := matVec(h, g)
+		for i := range p {
+			p[i] = -p[i]
+		}
+		slope := dot(g, p)
+		if slope >= 0 {
+			h = identity(n)
+			for i := range p {
+				p[i] = -g[i]
+			}
+			slope = -dot(g, g)
+		}
+		alpha, xn, fn := 1.0, make([]float64, n), 0.0
+		for {
+			for i := range x {
+				xn[i] = x[i] + alpha*p[i]
+			}
+			if fn = f(xn); fn <= fx+1e-4*alpha*slope || alpha < 1e-16 {
+				break
+			}
+			alpha /= 2
+		}
+		if alpha < 1e-16 {
+			break
+		}
+		gn := gradAt(xn)
+		s, yv := make([]float64, n), make([]float64, n)
+		for i := range s {
+			s[i], yv[i] = xn[i]-x[i], gn[i]-g[i]
+		}
+		if sy := dot(s, yv); sy > 1e-12 {
+			bfgsUpdate(h, s, yv, 1/sy)
+		}
+		x, fx, g = xn, fn, gn
+	}
+	res.X, res.Value = x, fx
+	return res, nil
+}
+
+// LagrangeCandidate is a stationary point of a Lagrangian.
+type LagrangeCandidate struct {
+	// Point holds the value of each optimization symbol.
+	Point map[string]float64
+	// Multipliers holds λ_i for constraint i.
+	Multipliers []float64
+	// Value is the objective at Point.
+	Value float64
+	// Exact holds the symbolic solution, keyed by symbol name and by
+	// lambda_1, lambda_2, ... for the multipliers, when the stationarity
+	// system could be solved exactly; otherwise it is nil.
+	Exact map[string]Expr
+}
+
+// LagrangeSolve finds candidate extrema of objective subject to
+// constraints[i] = 0 over syms. It forms the Lagrangian
+// L = f - Σ λ_i·g_i, differentiates it symbolically, and solves ∇L = 0:
+// by elimination when the system is linear in the symbols and
+// multipliers, and when it is polynomial through a lexicographic Gröbner
+// basis, solving for one variable at a time, so x*y on x^2 + y^2 = 1 has
+// the exact candidates (±√2/2, ±√2/2). Only when neither applies, because
+// the system is not polynomial, has infinitely many solutions, exceeds the
+// Gröbner budget or has roots of degree above 2 that are not rational, is
+// it solved numerically by Newton's method from a fixed set of starting
+// points, without Exact. Candidates are sorted by objective value.
+// Classifying them as minima or maxima is left to the caller.
+func LagrangeSolve(objective Expr, constraints []Expr, syms []string) ([]LagrangeCandidate, error) {
+	all := append([]string(nil), syms...)
+	lagr := []Expr{objective}
+	for i, g := range constraints {
+		l := fmt.Sprintf("lambda_%d", i+1)
+		all = append(all, l)
+		lagr = append(lagr, &Mul{factors: []Expr{N(-1), S(l), g}})
+	}
+	if err := checkBound(AddOf(append([]Expr{objective}, constraints...)...), syms); err != nil {
+		return nil, fmt.Errorf("lagrange: %w", err)
+	}
+	seen := map[string]bool{}
+	for _, s := range all {
+		if seen[s] {
+			return nil, fmt.Errorf("lagrange: duplicate symbol %q", s)
+		}
+		seen[s] = true
+	}
+	l := (&Add{terms: lagr}).Simplify()
+	eqs := make([]Expr, len(all))
+	for i, v := range all {
+		eqs[i] = Diff(l, v)
+	}
+	candidate := func(vals []float64, exact map[string]Expr) LagrangeCandidate {
+		c := LagrangeCandidate{Point: map[string]float64{}, Multipliers: append([]float64{}, vals[len(syms):]...), Exact: exact}
+		for i, s := range syms {
+			c.Point[s] = vals[i]
+		}
+		c.Value, _ = evalFloat(objective, c.Point)
+		return c
+	}
+
+	if sol, ok, err := solveLinearExact(eqs, all); err != nil {
+		return nil, fmt.Errorf("lagrange: %w", err)
+	} else if ok {
+		exact := map[string]Expr{}
+		vals := make([]float64, len(all))
+		for i, v := range all {
+			exact[v] = sol[i]
+			f, ok := evalFloat(sol[i], nil)
+			if !ok {
+				return nil, fmt.Errorf("lagrange: solution %s = %s is not numeric", v, sol[i])
+			}
+			vals[i] = f
+		}
+		return []LagrangeCandidate{candidate(vals, exact)}, nil
+	}
+
+	var out []LagrangeCandidate
+	if sols, ok := solvePolySystem(eqs, all); ok {
+		for _, exact := range sols {
+			vals := make([]float64, len(all))
+			for i, v := range all {
+				vals[i], _ = evalFloat(exact[v], nil)
+			}
+			out = append(out, candidate(vals, exact))
+		}
+	} else {
+		for _, r := range newtonRoots(eqs, all) {
+			out = append(out, candidate(r, nil))
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Value < out[j].Value })
+	return out, nil
+}
+
+// solvePolySystem returns the real solutions of the polynomial system
+// eqs = 0 in vars exactly. The lexicographic Gröbner basis with vars[0]
+// greatest is triangular when there are finitely many solutions, so the
+// variables are solved for from the last: each partial solution is
+// substituted into the elements whose greatest variable is the next one,
+// the one of least degree is solved by polySystemRoots, and the roots that
+// also make the others vanish are kept. It reports false when eqs are not
+// polynomials with rational coefficients, the basis exceeds its budget, a
+// variable is left undetermined, or a root cannot be written exactly.
+func solvePolySystem(eqs []Expr, vars []string) ([]map[string]Expr, bool) {
+	g, err := GroebnerBasis(eqs, vars)
+	if err != nil {
+		return nil, false
+	}
+	if len(g) == 1 && len(FreeSymbols(g[0])) == 0 {
+		// [1]: no common solution.
+		return nil, true
+	}
+	sols := []map[string]Expr{{}}
+	for i := len(vars) - 1; i >= 0; i-- {
+		var polys []Expr
+		for _, p := range g {
+			if !dependsOn(p, vars[i]) {
+				continue
+			}
+			earlier := false
+			for _, w := range vars[:i] {
+				earlier = earlier || dependsOn(p, w)
+			}
+			if !earlier {
+				polys = append(polys, p)
+			}
+		}
+		if len(polys) == 0 {
+			return nil, false
+		}
+		var next []map[string]Expr
+		for _, sol := range sols {
+			roots, ok := polySystemRoots(polys, vars[i], sol)
+			if !ok {
+				return nil, false
+			}
+			for _, r := range roots {
+				s := make(map[string]Expr, len(sol)+1)
+				for k, e := range sol {
+					s[k] = e
+				}
+				s[vars[i]] = r
+				next = append(next, s)
+			}
+		}
+		sols = next
+	}
+	return sols, true
+}
+
+// polySystemRoots returns the real roots in v common to polys with the
+// values sol substituted. The polynomial of least degree is solved, by
+// exactRealRoots when its coefficients are rational and by SolveLinear or
+// SolveQuadratic otherwise, and a root is kept, simplified by RadSimp,
+// when the others vanish at it, numerically, since radicals need not
+// simplify to an exact zero.
+func polySystemRoots(polys []Expr, v string, sol map[string]Expr) ([]Expr, bool) {
+	var qs []Expr
+	for _, p := range polys {
+		if q := RadSimp(SubMap(p, sol)); !isNumValue(q, 0) {
+			qs = append(qs, q)
+		}
+	}
+	if len(qs) == 0 {
+		return nil, false
+	}
+	best := 0
+	for i, q := range qs {
+		if Degree(q, v) < Degree(qs[best], v) {
+			best = i
+		}
+	}
+	q := qs[best]
+	var cands []Expr
+	switch cs, d := PolyCoeffs(q, v), Degree(q, v); {
+	case d == 0:
+		// A nonzero constant: no solution.
+		return nil, true
+	case d < 0:
+		return nil, false
+	default:
+		if p, ok := ratPoly(q, v); ok {
+			roots, err := exactRealRoots(p)
+			if err != nil {
+				return nil, false
+			}
+			cands = roots
+			break
+		}
+		coeff := func(k int) Expr {
+			if c, ok := cs[k]; ok {
+				return c
+			}
+			return N(0)
+		}
+		var res SolveResult
+		switch d {
+		case 1:
+			res = SolveLinear(coeff(1), coeff(0))
+		case 2:
+			res = SolveQuadratic(coeff(2), coeff(1), coeff(0))
+		default:
+			return nil, false
+		}
+		cands = res.Solutions
+	}
+	var out []Expr
+	for _, r := range cands {
+		x, ok := evalFloat(r, nil)
+		if !ok || math.IsNaN(x) || math.IsInf(x, 0) {
+			continue
+		}
+		common := true
+		for i, p := range qs {
+			if i == best {
+				continue
+			}
+			y, ok := evalFloat(p, map[string]float64{v: x})
+			common = common && ok && math.Abs(y) <= 1e-9*math.Max(1, math.Abs(x))
+		}
+		if common {
+			out = append(out, RadSimp(r))
+		}
+	}
+	return out, true
+}
+
+// solveLinearExact solves eqs[i] = 0 for vars by Gaussian elimination when
+// every equation is linear in vars. It reports false if the system is not
+// linear and an error if it is linear but singular.
+func solveLinearExact(eqs []Expr, vars []string) ([]Expr, bool, error) {
+	n := len(vars)
+	rows := make([][]Expr, len(eqs))
+	zero := map[string]Expr{}
+	for _, v := range vars {
+		zero[v] = N(0)
+	}
+	for i, e := range eqs {
+		row := make([]Expr, n+1)
+		for j, v := range vars {
+			c := Diff(e, v)
+			for _, w := range vars {
+				if dependsOn(c, w) {
+					return nil, false, nil
+				}
+			}
+			row[j] = c
+		}
+		rest := e
+		for _, v := range vars {
+			rest = rest.Sub(v, N(0))
+		}
+		row[n] = neg(rest).Simplify()
+		rows[i] = row
+	}
+	for col := 0; col < n; col++ {
+		p := -1
+		for r := col; r < len(rows); r++ {
+			if !isNumValue(rows[r][col], 0) {
+				p = r
+				break
+			}
+		}
+		if p < 0 {
+			return nil, true, fmt.Errorf("system is singular")
+		}
+		rows[col], rows[p] = rows[p], rows[col]
+		for r := range rows {
+			if r == col || isNumValue(rows[r][col], 0) {
+				continue
+			}
+			f := div(rows[r][col], rows[col][col])
+			for k := col; k <= n; k++ {
+				rows[r][k] = sub(rows[r][k], &Mul{factors: []Expr{f, rows[col][k]}}).Simplify()
+			}
+		}
+	}
+	sol := make([]Expr, n)
+	for i := range sol {
+		sol[i] = div(rows[i][n], rows[i][i]).Simplify()
+	}
+	return sol, true, nil
+}
+
+// newtonRoots runs Newton's method on eqs = 0 from deterministic
+// pseudo-random starting points in [-3, 3]^n and returns the distinct
+// roots found.
+func newtonRoots(eqs []Expr, vars []string) [][]float64 {
+	n := len(vars)
+	jac := make([][]Expr, len(eqs))
+	for i, e := range eqs {
+		jac[i] = make([]Expr, n)
+		for j, v := range vars {
+			jac[i][j] = Diff(e, v)
+		}
+	}
+	env := map[string]float64{}
+	eval := func(e Expr, z []float64) float64 {
+		for i, v := range vars {
+			env[v] = z[i]
+		}
+		f, ok := evalFloat(e, env)
+		if !ok {
+			return math.NaN()
+		}
+		return f
+	}
+	rng := rand.New(rand.NewSource(1))
+	var roots [][]float64
+	for start := 0; start < 64; start++ {
+		z := make([]float64, n)
+		for i := range z {
+			z[i] = rng.Float64()*6 - 3
+		}
+		for iter := 0; iter < 60; iter++ {
+			f := make([]float64, n)
+			for i, e := range eqs {
+				f[i] = eval(e, z)
+			}
+			if maxAbs(f) < 1e-12 {
+				break
+			}
+			j := make([][]float64, n)
+			for r := range j {
+				j[r] = make([]float64, n)
+				for c := range j[r] {
+					j[r][c] = eval(jac[r][c], z)
+				}
+			}
+			step, ok := solveDense(j, f)
+			if !ok {
+				break
+			}
+			for i := range z {
+				z[i] -= step[i]
+			}
+		}
+		f := make([]float64, n)
+		for i, e := range eqs {
+			f[i] = eval(e, z)
+		}
+		if !(maxAbs(f) < 1e-9) {
+			continue
+		}
+		dup := false
+		for _, r := range roots {
+			d := make([]float64, n)
+			for i := range d {
+				d[i] = r[i] - z[i]
+			}
+			if maxAbs(d) < 1e-6 {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			roots = append(roots, z)
+		}
+	}
+	return roots
+}
+
+// solveDense solves a·x = b by Gaussian elimination with partial pivoting.
+// a and b are overwritten.
+func solveDense(a [][]float64, b []float64) ([]float64, bool) {
+	n := len(b)
+	for col := 0; col < n; col++ {
+		p := col
+		for r := col + 1; r < n; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[p][col]) {
+				p = r
+			}
+		}
+		if math.Abs(a[p][col]) < 1e-300 || math.IsNaN(a[p][col]) {
+			return nil, false
+		}
+		a[col], a[p] = a[p], a[col]
+		b[col], b[p] = b[p], b[col]
+		for r := col + 1; r < n; r++ {
+			f := a[r][col] / a[col][col]
+			for k := col; k < n; k++ {
+				a[r][k] -= f * a[col][k]
+			}
+			b[r] -= f * b[col]
+		}
+	}
+	x := make([]float64, n)
+	for i := n - 1; i >= 0; i-- {
+		s := b[i]
+		for k := i + 1; k < n; k++ {
+			s -= a[i][k] * x[k]
+		}
+		x[i] = s / a[i][i]
+	}
+	return x, true
+}
+
+// LPRelation is the comparison in an LPConstraint.
+type LPRelation int
+
+const (
+	LPLessEq LPRelation = iota
+	LPGreaterEq
+	LPEqual
+)
+
+// LPConstraint is the linear constraint LHS Rel RHS.
+type LPConstraint struct {
+	LHS, RHS Expr
+	Rel      LPRelation
+}
+
+// LPResult is the optimum found by LinearProgram. X[i] is the value of
+// syms[i].
+type LPResult struct {
+	X     []*Num
+	Value *Num
+}
+
+// LinearProgram minimizes a linear objective over syms subject to linear
+// constraints. Linearity is checked symbolically: every coefficient must be
+// an exact rational. Variables are free unless a constraint bounds them, so
+// nonnegativity must be stated (x >= 0). The problem is solved exactly with
+// a two-phase simplex method using Bland's rule; to maximize, minimize the
+// negated objective. Infeasible and unbounded problems are reported as
+// errors.
+func LinearProgram(objective Expr, constraints []LPConstraint, syms []string) (LPResult, error) {
+	n := len(syms)
+	cost, k0, err := linearCoeffs(objective, syms)
+	if err != nil {
+		return LPResult{}, fmt.Errorf("lp: objective: %w", err)
+	}
+	// Each free variable x is split into x⁺ - x⁻ with both parts >= 0.
+	type row struct {
+		a   []*big.Rat
+		rhs *big.Rat
+		rel LPRelation
+	}
+	rows := make([]row, len(constraints))
+	for i, c := range constraints {
+		a, k, err := linearCoeffs(sub(c.LHS, c.RHS), syms)
+		if err != nil {
+			return LPResult{}, fmt.Errorf("lp: constraint %d: %w", i+1, err)
+		}
+		r := row{a: make([]*big.Rat, 2*n), rhs: k.Neg(k), rel: c.Rel}
+		for j := range a {
+			r.a[j] = a[j]
+			r.a[n+j] = new(big.Rat).Neg(a[j])
+		}
+		if r.rhs.Sign() < 0 {
+			for j := range r.a {
+				r.a[j].Neg(r.a[j])
+			}
+			r.rhs.Neg(r.rhs)
+			switch r.rel {
+			case LPLessEq:
+				r.rel = LPGreaterEq
+			case LPGreaterEq:
+				r.rel = LPLessEq
+			}
+		}
+		rows[i] = r
+	}
+
+	// Columns: split variables, one slack or surplus per inequality, one
+	// artificial per >= or = row.
+	m := len(rows)
+	nSlack, nArt := 0, 0
+	for _, r := range rows {
+		if r.rel != LPEqual {
+			nSlack++
+		}
+		if r.rel != LPLessEq {
+			nArt++
+		}
+	}
+	width := 2*n + nSlack + nArt
+	artStart := 2*n + nSlack
+	t := &simplexTableau{basis: make([]int, m)}
+	slack, art := 2*n, artStart
+	for i, r := range rows {
+		tr := make([]*big.Rat, width+1)
+		for j := range tr {
+			tr[j] = new(big.Rat)
+		}
+		for j, v := range r.a {
+			tr[j].Set(v)
+		}
+		tr[width].Set(r.rhs)
+		switch r.rel {
+		case LPLessEq:
+			tr[slack].SetInt64(1)
+			t.basis[i] = slack
+			slack++
+		case LPGreaterEq:
+			tr[slack].SetInt64(-1)
+			slack++
+			fallthrough
+		case LPEqual:
+			tr[art].SetInt64(1)
+			t.basis[i] = art
+			art++
+		}
+		t.rows = append(t.rows, tr)
+	}
+
+	if nArt > 0 {
+		c1 := make([]*big.Rat, width)
+		for j := range c1 {
+			c1[j] = new(big.Rat)
+			if j >= artStart {
+				c1[j].SetInt64(1)
+			}
+		}
+		t.minimize(c1, width)
+		if t.objective(c1).Sign() != 0 {
+			return LPResult{}, fmt.Errorf("lp: infeasible")
+		}
+		t.dropArtificials(artStart)
+	}
+	c2 := make([]*big.Rat, width)
+	for j := range c2 {
+		c2[j] = new(big.Rat)
+	}
+	for j, c := range cost {
+		c2[j].Set(c)
+		c2[n+j].Neg(c)
+	}
+	if !t.minimize(c2, artStart) {
+		return LPResult{}, fmt.Errorf("lp: unbounded")
+	}
+
+	vals := make([]*big.Rat, width)
+	for j := range vals {
+		vals[j] = new(big.Rat)
+	}
+	for i, b := range t.basis {
+		vals[b].Set(t.rows[i][width])
+	}
+	res := LPResult{X: make([]*Num, n)}
+	for j := range syms {
+		res.X[j] = numRat(new(big.Rat).Sub(vals[j], vals[n+j]))
+	}
+	res.Value = numRat(k0)
+	for j, c := range cost {
+		res.Value = numRat(new(big.Rat).Add(res.Value.val, new(big.Rat).Mul(c, res.X[j].val)))
+	}
+	return res, nil
+}
+
+// linearCoeffs writes e as Σ a_j·syms[j] + k with exact rational a_j and
+// k, or reports why it cannot.
+func linearCoeffs(e Expr, syms []string) ([]*big.Rat, *big.Rat, error) {
+	if err := checkBound(e, syms); err != nil {
+		return nil, nil, err
+	}
+	a := make([]*big.Rat, len(syms))
+	rest := e
+	for j, s := range syms {
+		d := Diff(e, s).Simplify()
+		c, ok := d.(*Num)
+		if !ok {
+			for _, w := range syms {
+				if dependsOn(d, w) {
+					return nil, nil, fmt.Errorf("%s is not linear in %s", e, s)
+				}
+			}
+			return nil, nil, fmt.Errorf("coefficient %s of %s is not rational", d, s)
+		}
+		a[j] = c.Rat()
+		rest = rest.Sub(s, N(0))
+	}
+	k, ok := rest.Simplify().(*Num)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s has a non-rational constant term", e)
+	}
+	return a, k.Rat(), nil
+}
+
+// simplexTableau is a dense tableau in canonical form: rows[i] holds the
+// constraint coefficients followed by the right-hand side, and column
+// basis[i] is the unit column of row i.
+type simplexTableau struct {
+	rows  [][]*big.Rat
+	basis []int
+}
+
+func (t *simplexTableau) objective(c []*big.Rat) *big.Rat {
+	z := new(big.Rat)
+	for i, b := range t.basis {
+		z.Add(z, new(big.Rat).Mul(c[b], t.rows[i][len(t.rows[i])-1]))
+	}
+	return z
+}
+
+// minimize pivots until no column below limit has a negative reduced cost
+// for c. It reports false if the objective is unbounded below.
+func (t *simplexTableau) minimize(c []*big.Rat, limit int) bool {
+	for {
+		enter := -1
+		for j := 0; j < limit && enter < 0; j++ {
+			r := new(big.Rat).Set(c[j])
+			for i, b := range t.basis {
+				r.Sub(r, new(big.Rat).Mul(c[b], t.rows[i][j]))
+			}
+			if r.Sign() < 0 {
+				enter = j
+			}
+		}
+		if enter < 0 {
+			return true
+		}
+		leave := -1
+		var best *big.Rat
+		for i, row := range t.rows {
+			if row[enter].Sign() <= 0 {
+				continue
+			}
+			q := new(big.Rat).Quo(row[len(row)-1], row[enter])
+			if leave < 0 || q.Cmp(best) < 0 || (q.Cmp(best) == 0 && t.basis[i] < t.basis[leave]) {
+				leave, best = i, q
+			}
+		}
+		if leave < 0 {
+			return false
+		}
+		t.pivot(leave, enter)
+	}
+}
+
+func (t *simplexTableau) pivot(r, c int) {
+	p := new(big.Rat).Set(t.rows[r][c])
+	for _, v := range t.rows[r] {
+		v.Quo(v, p)
+	}
+	for i, row := range t.rows {
+		if i == r || row[c].Sign() == 0 {
+			continue
+		}
+		f := new(big.Rat).Set(row[c])
+		for j, v := range row {
+			v.Sub(v, new(big.Rat).Mul(f, t.rows[r][j]))
+		}
+	}
+	t.basis[r] = c
+}
+
+// dropArtificials pivots zero-valued artificial columns out of the basis
+// after phase one, deleting rows that turn out to be redundant.
+func (t *simplexTableau) dropArtificials(artStart int) {
+	for i := 0; i < len(t.basis); i++ {
+		if t.basis[i] < artStart {
+			continue
+		}
+		enter := -1
+		for j := 0; j < artStart; j++ {
+			if t.rows[i][j].Sign() != 0 {
+				enter = j
+				break
+			}
+		}
+		if enter >= 0 {
+			t.pivot(i, enter)
+			continue
+		}
+		t.rows = append(t.rows[:i], t.rows[i+1:]...)
+		t.basis = append(t.basis[:i], t.basis[i+1:]...)
+		i--
+	}
+}
+
+// checkBound reports an error if e has free symbols outside syms.
+func checkBound(e Expr, syms []string) error {
+	bound := map[string]bool{}
+	for _, s := range syms {
+		bound[s] = true
+	}
+	for _, s := range FreeSymbols(e) {
+		if !bound[s] {
+			return fmt.Errorf("unbound symbol %q", s)
+		}
+	}
+	return nil
+}
+
+// bfgsUpdate sets h = (I - ρ s yᵀ) h (I - ρ y sᵀ) + ρ s sᵀ in place.
+func bfgsUpdate(h [][]float64, s, y []float64, rho float64) {
+	n := len(s)
+	hy := matVec(h, y)
+	yhy := dot(y, hy)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			h[i][j] += -rho*(hy[i]*s[j]+s[i]*hy[j]) + (rho*rho*yhy+rho)*s[i]*s[j]
+		}
+	}
+}
+
+func identity(n int) [][]float64 {
+	m := make([][]float64, n)
+	for i := range m {
+		m[i] = make([]float64, n)
+		m[i][i] = 1
+	}
+	return m
+}
+
+func matVec(m [][]float64, v []float64) []float64 {
+	out := make([]float64, len(m))
+	for i, row := range m {
+		out[i] = dot(row, v)
+	}
+	return out
+}
+
+func dot(a, b []float64) float64 {
+	s := 0.0
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+func maxAbs(v []float64) float64 {
+	m := 0.0
+	for _, x := range v {
+		m = math.Max(m, math.Abs(x))
+	}
+	return m
+}
+
+// ============================================================
+// Matrix
+// ============================================================
+
+// Matrix is a dense matrix of expressions.
+type Matrix struct {
+	rows [][]Expr
+}
+
+// NewMatrix returns the matrix with the given rows. Entries are simplified.
+// It is an error for the matrix to be empty or for the rows to differ in
+// length.
+func NewMatrix(rows [][]Expr) (Matrix, error) {
+	if len(rows) == 0 || len(rows[0]) == 0 {
+		return Matrix{}, fmt.Errorf("matrix: empty matrix")
+	}
+	out := make([][]Expr, len(rows))
+	for i, r := range rows {
+		if len(r) != len(rows[0]) {
+			return Matrix{}, fmt.Errorf("matrix: row %d has %d entries, want %d", i, len(r), len(rows[0]))
+		}
+		out[i] = make([]Expr, len(r))
+		for j, e := range r {
+			out[i][j] = e.Simplify()
+		}
+	}
+	return Matrix{rows: out}, nil
+}
+
+// Identity returns the n×n identity matrix, the matrix of entries δ(i, j).
+// It panics if n < 1.
+func Identity(n int) Matrix {
+	if n < 1 {
+		panic("gosymbol: Identity of size < 1")
+	}
+	return constMatrix(n, n, func(i, j int) Expr {
+		if i == j {
+			return N(1)
+		}
+		return N(0)
+	})
+}
+
+// ZeroMatrix returns the rows×cols zero matrix. It panics if either
+// dimension is less than 1.
+func ZeroMatrix(rows, cols int) Matrix {
+	if rows < 1 || cols < 1 {
+		panic("gosymbol: ZeroMatrix of size < 1")
+	}
+	return constMatrix(rows, cols, func(i, j int) Expr { return N(0) })
+}
+
+func constMatrix(rows, cols int, at func(i, j int) Expr) Matrix {
+	out := make([][]Expr, rows)
+	for i := range out {
+		out[i] = make([]Expr, cols)
+		for j := range out[i] {
+			out[i][j] = at(i, j)
+		}
+	}
+	return Matrix{rows: out}
+}
+
+// IsIdentity reports whether m is a square matrix with entries 1 on the
+// diagonal and 0 elsewhere.
+func (m Matrix) IsIdentity() bool {
+	if m.Rows() != m.Cols() {
+		return false
+	}
+	for i, r := range m.rows {
+		for j, e := range r {
+			want := 0.0
+			if i == j {
+				want = 1
+			}
+			if !isNumValue(e, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// IsZero reports whether every entry of m is 0.
+func (m Matrix) IsZero() bool {
+	for _, r := range m.rows {
+		for _, e := range r {
+			if !isNumValue(e, 0) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Add returns m + o with simplified entries. Adding a zero matrix returns
+// the other operand unchanged.
+func (m Matrix) Add(o Matrix) (Matrix, error) {
+	if m.Rows() != o.Rows() || m.Cols() != o.Cols() {
+		return Matrix{}, fmt.Errorf("matrix: cannot add %d×%d and %d×%d", m.Rows(), m.Cols(), o.Rows(), o.Cols())
+	}
+	switch {
+	case o.IsZero():
+		return m, nil
+	case m.IsZero():
+		return o, nil
+	}
+	return constMatrix(m.Rows(), m.Cols(), func(i, j int) Expr {
+		return (&Add{terms: []Expr{m.rows[i][j], o.rows[i][j]}}).Simplify()
+	}), nil
+}
+
+// Mul returns the matrix product m*o with simplified entries. Identity
+// factors are dropped and a zero factor gives the zero matrix without
+// multiplying out.
+func (m Matrix) Mul(o Matrix) (Matrix, error) {
+	if m.Cols() != o.Rows() {
+		return Matrix{}, fmt.Errorf("matrix: cannot multiply %d×%d by %d×%d", m.Rows(), m.Cols(), o.Rows(), o.Cols())
+	}
+	switch {
+	case m.IsIdentity():
+		return o, nil
+	case o.IsIdentity():
+		return m, nil
+	case m.IsZero(), o.IsZero():
+		return ZeroMatrix(m.Rows(), o.Cols()), nil
+	}
+	return constMatrix(m.Rows(), o.Cols(), func(i, j int) Expr {
+		terms := make([]Expr, m.Cols())
+		for k := range terms {
+			terms[k] = &Mul{factors: []Expr{m.rows[i][k], o.rows[k][j]}}
+		}
+		return (&Add{terms: terms}).Simplify()
+	}), nil
+}
+
+// Rows returns the number of rows.
+func (m Matrix) Rows() int { return len(m.rows) }
+
+// Cols returns the number of columns.
+func (m Matrix) Cols() int {
+	if len(m.rows) == 0 {
+		return 0
+	}
+	return len(m.rows[0])
+}
+
+// At returns the entry in row i, column j, counting from 0.
+func (m Matrix) At(i, j int) Expr { return m.rows[i][j] }
+
+// String renders the matrix as a grid with one row per line and the
+// entries of each column right-aligned, e.g.
+//
+//	[1    x]
+//	[0  2*y]
+func (m Matrix) String() string {
+	cells := make([][]string, len(m.rows))
+	width := make([]int, m.Cols())
+	for i, r := range m.rows {
+		cells[i] = make([]string, len(r))
+		for j, e := range r {
+			cells[i][j] = e.String()
+			width[j] = max(width[j], utf8.RuneCountInString(cells[i][j]))
+		}
+	}
+	lines := make([]string, len(cells))
+	for i, r := range cells {
+		for j, c := range r {
+			r[j] = strings.Repeat(" ", width[j]-utf8.RuneCountInString(c)) + c
+		}
+		lines[i] = "[" + strings.Join(r, "  ") + "]"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Inline renders the matrix on one line, row by row, e.g.
+// "[[1, x], [0, 2*y]]".
+func (m Matrix) Inline() string {
+	rs := make([]string, len(m.rows))
+	for i, r := range m.rows {
+		es := make([]string, len(r))
+		for j, e := range r {
+			es[j] = e.String()
+		}
+		rs[i] = "[" + strings.Join(es, ", ") + "]"
+	}
+	return "[" + strings.Join(rs, ", ") + "]"
+}
+
+// LaTeX renders the matrix in a pmatrix environment, with round
+// brackets.
+func (m Matrix) LaTeX() string { return m.LaTeXEnv("pmatrix") }
+
+// LaTeXEnv renders the matrix in the given amsmath environment, e.g.
+// "bmatrix" for square brackets, "vmatrix" for a determinant or "matrix"
+// for none: \begin{bmatrix} 1 & x \\ 0 & 2 y \end{bmatrix}.
+func (m Matrix) LaTeXEnv(env string) string {
+	rs := make([]string, len(m.rows))
+	for i, r := range m.rows {
+		es := make([]string, len(r))
+		for j, e := range r {
+			es[j] = e.LaTeX()
+		}
+		rs[i] = strings.Join(es, " & ")
+	}
+	return `\begin{` + env + `} ` + strings.Join(rs, ` \\ `) + ` \end{` + env + `}`
+}
+
+// MathML renders the matrix as a presentation MathML table in round
+// brackets, with entries written as by the function MathML.
+func (m Matrix) MathML() string {
+	var sb strings.Builder
+	sb.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML"><mrow><mo>(</mo><mtable>`)
+	for _, r := range m.rows {
+		sb.WriteString("<mtr>")
+		for _, e := range r {
+			sb.WriteString("<mtd>")
+			writeMathML(&sb, e)
+			sb.WriteString("</mtd>")
+		}
+		sb.WriteString("</mtr>")
+	}
+	sb.WriteString("</mtable><mo>)</mo></mrow></math>")
+	return sb.String()
+}
+
+// DetMethod selects the algorithm used by DetWith.
+type DetMethod int
+
+const (
+	// DetAuto picks a method from the size and entries of the matrix; see
+	// Matrix.DetMethod.
+	DetAuto DetMethod = iota
+	// DetCofactor expands along rows. It costs O(n!) but never divides,
+	// which suits tiny matrices and entries that are not polynomials.
+	DetCofactor
+	// DetBareiss is fraction-free elimination: each step divides exactly
+	// by the previous pivot, so entries stay polynomials of bounded size.
+	DetBareiss
+	// DetNumeric is Bareiss elimination on exact rationals, for matrices
+	// whose entries are all numbers.
+	DetNumeric
+)
+
+func (d DetMethod) String() string {
+	switch d {
+	case DetCofactor:
+		return "cofactor"
+	case DetBareiss:
+		return "bareiss"
+	case DetNumeric:
+		return "numeric"
+	}
+	return "auto"
+}
+
+// DetMethod reports the method Det uses for m: DetNumeric when every entry
+// is a number; DetCofactor up to 3×3, and up to 6×6 when the entries are
+// mostly independent (at least half as many distinct atoms, symbols or
+// non-polynomial subexpressions, as entries), since the determinant then
+// has close to n! terms and elimination only adds work; DetBareiss
+// otherwise.
+func (m Matrix) DetMethod() DetMethod {
+	var at polyAtoms
+	m.polys(&at)
+	n := m.Rows()
+	switch {
+	case len(at.atoms) == 0:
+		return DetNumeric
+	case n <= 3, n <= 6 && 2*len(at.atoms) >= n*m.Cols():
+		return DetCofactor
+	}
+	return DetBareiss
+}
+
+// Det returns the determinant of the square matrix m, expanded. The
+// determinant of the 0×0 matrix is 1, the empty product.
+func (m Matrix) Det() (Expr, error) { return m.DetWith(DetAuto) }
+
+// DetWith returns the determinant of m computed with the given method.
+// DetNumeric requires every entry to be a number.
+func (m Matrix) DetWith(method DetMethod) (Expr, error) {
+	if m.Rows() != m.Cols() {
+		return nil, fmt.Errorf("matrix: determinant of a %d×%d matrix", m.Rows(), m.Cols())
+	}
+	if m.Rows() == 0 {
+		return N(1), nil
+	}
+	if method == DetAuto {
+		method = m.DetMethod()
+	}
+	n := m.Rows()
+	switch method {
+	case DetCofactor:
+		return Expand(cofactorDet(m.rows)), nil
+	case DetNumeric:
+		a := make([][]*big.Rat, n)
+		for i, r := range m.rows {
+			a[i] = make([]*big.Rat, n)
+			for j, e := range r {
+				v, ok := e.(*Num)
+				if !ok {
+					return nil, fmt.Errorf("matrix: entry (%d, %d) = %s is not a number", i, j, e)
+				}
+				a[i][j] = v.Rat()
+			}
+		}
+		rank, sign := bareiss(a, ratField)
+		d := new(big.Rat)
+		if rank == n {
+			d.Set(a[n-1][n-1])
+			if sign < 0 {
+				d.Neg(d)
+			}
+		}
+		return numRat(d), nil
+	}
+	var at polyAtoms
+	a := m.polys(&at)
+	rank, sign := bareiss(a, mpField)
+	if rank < n {
+		return N(0), nil
+	}
+	d := a[n-1][n-1]
+	if sign < 0 {
+		d = mpSub(mpField.zero, d)
+	}
+	return at.toExpr(d), nil
+}
+
+// Echelon returns a fraction-free row echelon form of m, computed by
+// Bareiss elimination with row swaps, and the rank of m. Entries below
+// each pivot are zero; the last nonzero pivot equals the determinant, up
+// to sign, of the submatrix formed by the pivot rows and columns.
+func (m Matrix) Echelon() (Matrix, int) {
+	var at polyAtoms
+	a := m.polys(&at)
+	rank, _ := bareiss(a, mpField)
+	out := make([][]Expr, len(a))
+	for i, r := range a {
+		out[i] = make([]Expr, len(r))
+		for j, p := range r {
+			out[i][j] = at.toExpr(p)
+		}
+	}
+	return Matrix{rows: out}, rank
+}
+
+// Rank returns the rank of m.
+func (m Matrix) Rank() int {
+	_, r := m.Echelon()
+	return r
+}
+
+// Trace returns the sum of the diagonal entries of the square matrix m,
+// simplified.
+func (m Matrix) Trace() (Expr, error) {
+	if m.Rows() != m.Cols() {
+		return nil, fmt.Errorf("matrix: trace of a %d×%d matrix", m.Rows(), m.Cols())
+	}
+	terms := make([]Expr, m.Rows())
+	for i := range terms {
+		terms[i] = m.rows[i][i]
+	}
+	return (&Add{terms: terms}).Simplify(), nil
+}
+
+// Minor returns the determinant of the square matrix m with row i and
+// column j removed, expanded; that of a 1×1 matrix is 1.
+func (m Matrix) Minor(i, j int) (Expr, error) {
+	n := m.Rows()
+	if n != m.Cols() {
+		return nil, fmt.Errorf("matrix: minor of a %d×%d matrix", n, m.Cols())
+	}
+	if i < 0 || i >= n || j < 0 || j >= n {
+		return nil, fmt.Errorf("matrix: entry (%d, %d) outside a %d×%d matrix", i, j, n, n)
+	}
+	if n == 1 {
+		return N(1), nil
+	}
+	rows := make([][]Expr, 0, n-1)
+	for k, r := range m.rows {
+		if k != i {
+			rows = append(rows, append(append([]Expr{}, r[:j]...), r[j+1:]...))
+		}
+	}
+	return Matrix{rows: rows}.Det()
+}
+
+// Cofactor returns (-1)^(i+j) times Minor(i, j).
+func (m Matrix) Cofactor(i, j int) (Expr, error) {
+	d, err := m.Minor(i, j)
+	if err != nil || (i+j)%2 == 0 {
+		return d, err
+	}
+	return Expand(neg(d)), nil
+}
+
+// Adjugate returns the transpose of the matrix of cofactors of the square
+// matrix m, so that m*Adjugate() is Det() times the identity, and the
+// inverse of an invertible m is Adjugate()/Det().
+func (m Matrix) Adjugate() (Matrix, error) {
+	n := m.Rows()
+	if n != m.Cols() {
+		return Matrix{}, fmt.Errorf("matrix: adjugate of a %d×%d matrix", n, m.Cols())
+	}
+	out := make([][]Expr, n)
+	for i := range out {
+		out[i] = make([]Expr, n)
+	}
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			c, err := m.Cofactor(i, j)
+			if err != nil {
+				return Matrix{}, err
+			}
+			out[j][i] = c
+		}
+	}
+	return Matrix{rows: out}, nil
+}
+
+// Transpose returns the matrix with rows and columns exchanged.
+func (m Matrix) Transpose() Matrix {
+	return constMatrix(m.Cols(), m.Rows(), func(i, j int) Expr { return m.rows[j][i] })
+}
+
+// Inverse returns the inverse of the square matrix m, Adjugate()/Det(),
+// with each entry cancelled. It is an error for m to be singular, i.e.
+// for Det() to simplify to 0; a determinant that vanishes only for some
+// values of its symbols is not detected.
+func (m Matrix) Inverse() (Matrix, error) {
+	adj, err := m.Adjugate()
+	if err != nil {
+		return Matrix{}, fmt.Errorf("matrix: inverse of a %d×%d matrix", m.Rows(), m.Cols())
+	}
+	d, err := m.Det()
+	if err != nil {
+		return Matrix{}, err
+	}
+	if isNumValue(d.Simplify(), 0) {
+		return Matrix{}, fmt.Errorf("matrix: singular matrix")
+	}
+	inv := &Pow{base: d, exp: N(-1)}
+	return constMatrix(m.Rows(), m.Cols(), func(i, j int) Expr {
+		return Cancel(&Mul{factors: []Expr{adj.rows[i][j], inv}})
+	}), nil
+}
+
+// Eigen2x2 is the eigen-decomposition of a real 2×2 matrix [[a, b], [c,
+// d]] with possibly symbolic entries. Its eigenvalues are (t ∓ √D)/2 for
+// the trace t = a + d and the discriminant D = (a - d)^2 + 4*b*c: real and
+// distinct when D > 0, repeated when D = 0 and a complex conjugate pair
+// t/2 ∓ i*√(-D)/2 when D < 0. Since a formula for one sign of D is wrong
+// for the other, the parts below are Piecewise in the sign of D and, for
+// the eigenvectors, in which off-diagonal entries vanish; with numeric
+// entries they simplify to the single case that holds, and a symmetric
+// matrix, with b = c, has no complex case.
+type Eigen2x2 struct {
+	Trace, Det, Discriminant Expr
+	// ValueRe[k] + i*ValueIm[k] is the eigenvalue λk; λ1 ≤ λ2 when both
+	// are real, and λ1 has the negative imaginary part otherwise.
+	ValueRe, ValueIm [2]Expr
+	// VectorRe[k] + i*VectorIm[k] is an eigenvector of λk: (b, λk - a)
+	// when b ≠ 0, (λk - d, c) when c ≠ 0, and a unit vector of a diagonal
+	// matrix. A defective matrix, with D = 0 but not diagonal, has the
+	// same vector for both.
+	VectorRe, VectorIm [2][2]Expr
+}
+
+// Eigen2x2 returns the eigen-decomposition of the 2×2 matrix m, or an
+// error for any other shape.
+func (m Matrix) Eigen2x2() (Eigen2x2, error) {
+	if m.Rows() != 2 || m.Cols() != 2 {
+		return Eigen2x2{}, fmt.Errorf("matrix: Eigen2x2 of a %d×%d matrix", m.Rows(), m.Cols())
+	}
+	a, b, c, d := m.rows[0][0], m.rows[0][1], m.rows[1][0], m.rows[1][1]
+	t := (&Add{terms: []Expr{a, d}}).Simplify()
+	det, _ := m.Det()
+	disc := Expand(&Add{terms: []Expr{&Pow{base: sub(a, d), exp: N(2)}, &Mul{factors: []Expr{N(4), b, c}}}})
+	complexCase := Cond{disc, RelLt, N(0)}
+	half := func(e Expr) Expr { return &Mul{factors: []Expr{F(1, 2), e}} }
+	piece := func(cases []PieceCase, otherwise Expr) Expr { return PiecewiseOf(cases, otherwise).Simplify() }
+	// A symmetric matrix has D = (a - d)^2 + 4*b^2 >= 0, so it needs no
+	// complex case.
+	symmetric := StructEqual(b.Simplify(), c.Simplify())
+	ifComplex := func(v Expr) []PieceCase {
+		if symmetric {
+			return nil
+		}
+		return []PieceCase{{v, complexCase}}
+	}
+	zero, one := N(0), N(1)
+	r := Eigen2x2{Trace: t, Det: det, Discriminant: disc}
+	for k, s := range []int64{-1, 1} {
+		lambda := half(&Add{terms: []Expr{t, &Mul{factors: []Expr{N(s), SqrtOf(disc)}}}})
+		im := half(&Mul{factors: []Expr{N(s), SqrtOf(neg(disc))}})
+		r.ValueRe[k] = piece(ifComplex(half(t)), lambda)
+		r.ValueIm[k] = piece(ifComplex(im), zero)
+		// The diagonal case takes (1, 0) for the smaller of a and d.
+		diag := [2]Expr{one, zero}
+		if k == 1 {
+			diag = [2]Expr{zero, one}
+		}
+		byB := [2]Expr{b, sub(lambda, a)}
+		byC := [2]Expr{sub(lambda, d), c}
+		for i := range diag {
+			var cases []PieceCase
+			// D < 0 implies b*c < 0, so the complex case is (b, λk - a)
+			// and only its second component differs from the real one.
+			if i == 1 {
+				cases = ifComplex(sub(half(t), a))
+			}
+			cases = append(cases, PieceCase{byB[i], Cond{b, RelNe, zero}}, PieceCase{byC[i], Cond{c, RelNe, zero}}, PieceCase{diag[i], Cond{a, RelLe, d}})
+			r.VectorRe[k][i] = piece(cases, diag[1-i])
+		}
+		r.VectorIm[k] = [2]Expr{zero, piece(ifComplex(im), zero)}
+	}
+	return r, nil
+}
+
+// TraceProduct returns the trace of the product ms[0]*ms[1]*…, expanded,
+// without forming the full product. Since the trace is invariant under
+// cyclic permutation, the factors are rotated so that the intermediate
+// products are as small as possible, and of the last product only the
+// diagonal is computed: for column vectors u and v, TraceProduct(u, vᵀ)
+// multiplies the 1×n matrix vᵀ by u instead of forming the n×n matrix
+// u*vᵀ. It is an error for the shapes not to chain or the product not to
+// be square.
+func TraceProduct(ms ...Matrix) (Expr, error) {
+	if len(ms) == 0 {
+		return nil, fmt.Errorf("matrix: trace of an empty product")
+	}
+	for k := 1; k < len(ms); k++ {
+		if ms[k-1].Cols() != ms[k].Rows() {
+			return nil, fmt.Errorf("matrix: cannot multiply %d×%d by %d×%d", ms[k-1].Rows(), ms[k-1].Cols(), ms[k].Rows(), ms[k].Cols())
+		}
+	}
+	if ms[0].Rows() != ms[len(ms)-1].Cols() {
+		return nil, fmt.Errorf("matrix: trace of a %d×%d product", ms[0].Rows(), ms[len(ms)-1].Cols())
+	}
+	// Rotating to start at factor s makes the outer dimension, and so the
+	// size of every partial product's rows, that of ms[s].Rows().
+	best := 0
+	for s := range ms {
+		if ms[s].Rows() < ms[best].Rows() {
+			best = s
+		}
+	}
+	order := append(append([]Matrix{}, ms[best:]...), ms[:best]...)
+	p := order[0]
+	if len(order) == 1 {
+		t, _ := p.Trace()
+		return Expand(t), nil
+	}
+	for _, f := range order[1 : len(order)-1] {
+		var err error
+		if p, err = p.Mul(f); err != nil {
+			return nil, err
+		}
+	}
+	last := order[len(order)-1]
+	var terms []Expr
+	for i := 0; i < p.Rows(); i++ {
+		for k := 0; k < p.Cols(); k++ {
+			terms = append(terms, &Mul{factors: []Expr{p.rows[i][k], last.rows[k][i]}})
+		}
+	}
+	return Expand(&Add{terms: terms}), nil
+}
+
+// polys converts the entries of m to polynomials in shared atoms.
+func (m Matrix) polys(at *polyAtoms) [][]mpoly {
+	a := make([][]mpoly, len(m.rows))
+	for i, r := range m.rows {
+		a[i] = make([]mpoly, len(r))
+		for j, e := range r {
+			a[i][j] = at.toPoly(e)
+		}
+	}
+	return a
+}
+
+// field is the arithmetic bareiss needs. quo is only called when the
+// quotient is exact. Values are never modified in place.
+type field[T any] struct {
+	sub, mul, quo func(a, b T) T
+	isZero        func(a T) bool
+	zero, one     T
+}
+
+var ratField = field[*big.Rat]{
+	sub:    func(a, b *big.Rat) *big.Rat { return new(big.Rat).Sub(a, b) },
+	mul:    func(a, b *big.Rat) *big.Rat { return new(big.Rat).Mul(a, b) },
+	quo:    func(a, b *big.Rat) *big.Rat { return new(big.Rat).Quo(a, b) },
+	isZero: func(a *big.Rat) bool { return a.Sign() == 0 },
+	zero:   new(big.Rat),
+	one:    big.NewRat(1, 1),
+}
+
+// bareiss reduces a to row echelon form in place by fraction-free
+// elimination and returns its rank and the sign of the row permutation.
+// Each update a[i][j] = (p*a[i][j] - a[i][c]*a[r][j]) / prev divides
+// exactly by the previous pivot prev (Sylvester's identity).
+func bareiss[T any](a [][]T, f field[T]) (rank, sign int) {
+	sign = 1
+	prev := f.one
+	r := 0
+	for c := 0; r < len(a) && c < len(a[0]); c++ {
+		p := r
+		for p < len(a) && f.isZero(a[p][c]) {
+			p++
+		}
+		if p == len(a) {
+			continue
+		}
+		if p != r {
+			a[p], a[r] = a[r], a[p]
+			sign = -sign
+		}
+		for i := r + 1; i < len(a); i++ {
+			for j := c + 1; j < len(a[i]); j++ {
+				a[i][j] = f.quo(f.sub(f.mul(a[r][c], a[i][j]), f.mul(a[i][c], a[r][j])), prev)
+			}
+			a[i][c] = f.zero
+		}
+		prev = a[r][c]
+		r++
+	}
+	return r, sign
+}
+
+// cofactorDet expands the determinant along the first row, skipping zero
+// entries.
+func cofactorDet(a [][]Expr) Expr {
+	n := len(a)
+	if n == 1 {
+		return a[0][0]
+	}
+	var terms []Expr
+	for j, e := range a[0] {
+		if isNumValue(e, 0) {
+			continue
+		}
+		minor := make([][]Expr, n-1)
+		for i := range minor {
+			minor[i] = append(append([]Expr{}, a[i+1][:j]...), a[i+1][j+1:]...)
+		}
+		t := Expr(&Mul{factors: []Expr{e, cofactorDet(minor)}})
+		if j%2 == 1 {
+			t = neg(t)
+		}
+		terms = append(terms, t)
+	}
+	return (&Add{terms: append(terms, N(0))}).Simplify()
+}
+
+// mpoly is a sparse polynomial with rational coefficients in numbered
+// indeterminates, keyed by exponent vector. Values are never modified in
+// place once built.
+type mpoly map[string]mterm
+
+type mterm struct {
+	exp []int
+	c   *big.Rat
+}
+
+// expKey encodes an exponent vector, ignoring trailing zeros so that
+// vectors of different lengths compare equal.
+func expKey(exp []int) string {
+	n := len(exp)
+	for n > 0 && exp[n-1] == 0 {
+		n--
+	}
+	b := make([]byte, 0, 3*n)
+	for i := 0; i < n; i++ {
+		b = strconv.AppendInt(b, int64(exp[i]), 10)
+		b = append(b, ',')
+	}
+	return string(b)
+}
+
+func (p mpoly) addTerm(exp []int, c *big.Rat) {
+	k := expKey(exp)
+	if t, ok := p[k]; ok {
+		s := new(big.Rat).Add(t.c, c)
+		if s.Sign() == 0 {
+			delete(p, k)
+			return
+		}
+		p[k] = mterm{t.exp, s}
+		return
+	}
+	if c.Sign() != 0 {
+		p[k] = mterm{exp, c}
+	}
+}
+
+func mpConst(c *big.Rat) mpoly {
+	p := mpoly{}
+	p.addTerm(nil, c)
+	return p
+}
+
+func mpSub(a, b mpoly) mpoly {
+	out := make(mpoly, len(a)+len(b))
+	for k, t := range a {
+		out[k] = t
+	}
+	for _, t := range b {
+		out.addTerm(t.exp, new(big.Rat).Neg(t.c))
+	}
+	return out
+}
+
+func mpMul(a, b mpoly) mpoly {
+	out := make(mpoly, len(a)*len(b))
+	for _, s := range a {
+		for _, t := range b {
+			out.addTerm(expMul(s.exp, t.exp), new(big.Rat).Mul(s.c, t.c))
+		}
+	}
+	return out
+}
+
+func expMul(a, b []int) []int {
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	out := append([]int(nil), a...)
+	for i, e := range b {
+		out[i] += e
+	}
+	return out
+}
+
+func expAt(exp []int, i int) int {
+	if i < len(exp) {
+		return exp[i]
+	}
+	return 0
+}
+
+// expCmp orders exponent vectors lexicographically.
+func expCmp(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if x, y := expAt(a, i), expAt(b, i); x != y {
+			if x > y {
+				return 1
+			}
+			return -1
+		}
+	}
+	return 0
+}
+
+// lead returns the lexicographically greatest term of a nonzero p.
+func (p mpoly) lead() mterm {
+	var best mterm
+	first := true
+	for _, t := range p {
+		if first || expCmp(t.exp, best.exp) > 0 {
+			best, first = t, false
+		}
+	}
+	return best
+}
+
+// mpQuo returns a/b when b divides a exactly. The terms of the remainder
+// are visited in decreasing order through a heap: subtracting a multiple
+// of b only adds terms below the current leading term.
+func mpQuo(a, b mpoly) (mpoly, bool) {
+	if len(b) == 0 {
+		return nil, false
+	}
+	lb := b.lead()
+	q, r := mpoly{}, make(mpoly, len(a))
+	h := &expHeap{}
+	for k, t := range a {
+		r[k] = t
+		*h = append(*h, t.exp)
+	}
+	heap.Init(h)
+	for len(r) > 0 {
+		lr, ok := r[expKey(heap.Pop(h).([]int))]
+		if !ok {
+			continue
+		}
+		exp := make([]int, max(len(lr.exp), len(lb.exp)))
+		for i := range exp {
+			if exp[i] = expAt(lr.exp, i) - expAt(lb.exp, i); exp[i] < 0 {
+				return nil, false
+			}
+		}
+		c := new(big.Rat).Quo(lr.c, lb.c)
+		q.addTerm(exp, c)
+		for _, t := range b {
+			e := expMul(exp, t.exp)
+			if _, ok := r[expKey(e)]; !ok {
+				heap.Push(h, e)
+			}
+			r.addTerm(e, new(big.Rat).Neg(new(big.Rat).Mul(c, t.c)))
+		}
+	}
+	return q, true
+}
+
+// expHeap is a max-heap of exponent vectors.
+type expHeap [][]int
+
+func (h expHeap) Len() int            { return len(h) }
+func (h expHeap) Less(i, j int) bool  { return expCmp(h[i], h[j]) > 0 }
+func (h expHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expHeap) Push(x interface{}) { *h = append(*h, x.([]int)) }
+func (h *expHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+var mpField = field[mpoly]{
+	sub: mpSub,
+	mul: mpMul,
+	quo: func(a, b mpoly) mpoly {
+		q, ok := mpQuo(a, b)
+		if !ok {
+			panic("gosymbol: inexact Bareiss division")
+		}
+		return q
+	},
+	isZero: func(a mpoly) bool { return len(a) == 0 },
+	zero:   mpoly{},
+	one:    mpConst(big.NewRat(1, 1)),
+}
+
+// polyAtoms numbers the indeterminates of a family of mpolys. Symbols and
+// any subexpression that is not a polynomial, such as sin(x) or 1/x, are
+// atoms.
+type polyAtoms struct {
+	index map[string]int
+	atoms []Expr
+}
+
+func (at *polyAtoms) atom(e Expr) mpoly {
+	k := e.String()
+	i, ok := at.index[k]
+	if !ok {
+		if at.index == nil {
+			at.index = map[string]int{}
+		}
+		i = len(at.atoms)
+		at.index[k] = i
+		at.atoms = append(at.atoms, e)
+	}
+	exp := make([]int, i+1)
+	exp[i] = 1
+	return mpoly{expKey(exp): {exp, big.NewRat(1, 1)}}
+}
+
+func (at *polyAtoms) toPoly(e Expr) mpoly {
+	switch t := e.(type) {
+	case *Num:
+		return mpConst(t.Rat())
+	case *Add:
+		out := mpoly{}
+		for _, x := range t.terms {
+			for _, term := range at.toPoly(x) {
+				out.addTerm(term.exp, term.c)
+			}
+		}
+		return out
+	case *Mul:
+		out := mpConst(big.NewRat(1, 1))
+		for _, x := range t.factors {
+			out = mpMul(out, at.toPoly(x))
+		}
+		return out
+	case *Pow:
+		if n, ok := t.exp.(*Num); ok && n.IsInt() && n.Sign() > 0 && n.val.Num().IsInt64() && n.val.Num().Int64() <= 64 {
+			b := at.toPoly(t.base)
+			out := b
+			for i := int64(1); i < n.val.Num().Int64(); i++ {
+				out = mpMul(out, b)
+			}
+			return out
+		}
+	}
+	return at.atom(e)
+}
+
+func (at *polyAtoms) toExpr(p mpoly) Expr {
+	terms := make([]Expr, 0, len(p)+1)
+	for _, t := range p {
+		fs := []Expr{numRat(t.c)}
+		for i, k := range t.exp {
+			if k != 0 {
+				fs = append(fs, &Pow{base: at.atoms[i], exp: N(int64(k))})
+			}
+		}
+		terms = append(terms, &Mul{factors: fs})
+	}
+	return (&Add{terms: append(terms, N(0))}).Simplify()
+}
+
+// ============================================================
+// Gröbner bases
+// ============================================================
+
+// groebnerMaxReductions bounds the S-polynomial reductions of one basis
+// computation; lex bases can grow doubly exponentially.
+const groebnerMaxReductions = 5000
+
+// GroebnerBasis returns the reduced Gröbner basis of the ideal generated
+// by polys, each read as polys[i] = 0, in the lexicographic order with
+// the symbols of order greatest first and the remaining symbols after
+// them in sorted order. Each element is scaled to integer coefficients
+// without a common divisor and a positive leading coefficient, and the
+// elements are sorted by leading monomial, smallest first, so a
+// triangular system can be solved in order. A basis [1] means the
+// equations have no common solution. It is an error for an input not to
+// be a polynomial in its symbols with rational coefficients, or for the
+// computation to exceed its budget.
+func GroebnerBasis(polys []Expr, order []string) ([]Expr, error) {
+	at, ps, err := groebnerInput("groebner", polys, order)
+	if err != nil {
+		return nil, err
+	}
+	g, err := groebner(ps)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Expr, len(g))
+	for i, p := range g {
+		out[i] = at.toExpr(p)
+	}
+	return out, nil
+}
+
+// Eliminate returns generators of the elimination ideal: the polynomial
+// consequences of polys = 0 that do not involve elimSyms, as the elements
+// of a lex Gröbner basis with elimSyms greatest that are free of them. It
+// implicitizes parametric curves, e.g. x - t^2 and y - t^3 with t
+// eliminated give x^3 - y^2, and projects systems onto fewer unknowns
+// without resultants. The result is empty when no relation remains, and
+// [1] when polys = 0 has no solution. Errors are those of GroebnerBasis.
+func Eliminate(polys []Expr, elimSyms []string) ([]Expr, error) {
+	at, ps, err := groebnerInput("eliminate", polys, elimSyms)
+	if err != nil {
+		return nil, err
+	}
+	g, err := groebner(ps)
+	if err != nil {
+		return nil, err
+	}
+	var out []Expr
+	for _, p := range g {
+		free := true
+		for _, t := range p {
+			for i := range elimSyms {
+				free = free && expAt(t.exp, i) == 0
+			}
+		}
+		if free {
+			out = append(out, at.toExpr(p))
+		}
+	}
+	return out, nil
+}
+
+// groebnerInput converts polys to mpolys whose indeterminates are the
+// symbols first, in that order, followed by the other free symbols sorted.
+func groebnerInput(op string, polys []Expr, first []string) (*polyAtoms, []mpoly, error) {
+	at := &polyAtoms{}
+	for _, s := range first {
+		at.atom(S(s))
+	}
+	set := map[string]bool{}
+	for _, p := range polys {
+		for _, s := range FreeSymbols(p) {
+			set[s] = true
+		}
+	}
+	for _, s := range sortedNames(set) {
+		at.atom(S(s))
+	}
+	ps := make([]mpoly, 0, len(polys))
+	for _, e := range polys {
+		p := at.toPoly(StripMeta(e).Simplify())
+		for _, a := range at.atoms {
+			if _, ok := a.(*Sym); !ok {
+				return nil, nil, fmt.Errorf("%s: %s is not a polynomial", op, e)
+			}
+		}
+		if len(p) > 0 {
+			ps = append(ps, p)
+		}
+	}
+	return at, ps, nil
+}
+
+// groebner runs Buchberger's algorithm with the coprime leading monomial
+// criterion and returns the reduced basis, primitive and sorted.
+func groebner(ps []mpoly) ([]mpoly, error) {
+	var g []mpoly
+	for _, p := range ps {
+		g = append(g, mpMonic(p))
+	}
+	type pair struct{ i, j int }
+	var pairs []pair
+	for j := range g {
+		for i := 0; i < j; i++ {
+			pairs = append(pairs, pair{i, j})
+		}
+	}
+	for n := 0; len(pairs) > 0; n++ {
+		if n == groebnerMaxReductions {
+			return nil, fmt.Errorf("groebner: exceeded %d reductions", groebnerMaxReductions)
+		}
+		pr := pairs[0]
+		pairs = pairs[1:]
+		a, b := g[pr.i].lead(), g[pr.j].lead()
+		if expCoprime(a.exp, b.exp) {
+			continue
+		}
+		r := mpReduce(mpSPoly(g[pr.i], g[pr.j]), g)
+		if len(r) == 0 {
+			continue
+		}
+		g = append(g, mpMonic(r))
+		for i := 0; i < len(g)-1; i++ {
+			pairs = append(pairs, pair{i, len(g) - 1})
+		}
+	}
+	// Drop elements whose leading monomial another one divides, then
+	// reduce each by the rest.
+	var minimal []mpoly
+	for i, p := range g {
+		lp, keep := p.lead(), true
+		for j, q := range g {
+			lq := q.lead()
+			if j != i && expDivides(lq.exp, lp.exp) && (expCmp(lq.exp, lp.exp) != 0 || j < i) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			minimal = append(minimal, p)
+		}
+	}
+	out := make([]mpoly, len(minimal))
+	for i, p := range minimal {
+		rest := append(append([]mpoly(nil), minimal[:i]...), minimal[i+1:]...)
+		out[i] = mpPrimitive(mpReduce(p, rest))
+	}
+	sort.Slice(out, func(i, j int) bool { return expCmp(out[i].lead().exp, out[j].lead().exp) < 0 })
+	return out, nil
+}
+
+// mpReduce returns the remainder of p on division by the nonzero polys g:
+// no term of it is divisible by a leading monomial of g.
+func mpReduce(p mpoly, g []mpoly) mpoly {
+	p = mpSub(p, mpoly{}) // a copy, since terms are deleted below
+	r := mpoly{}
+	for len(p) > 0 {
+		lt := p.lead()
+		divided := false
+		for _, q := range g {
+			lq := q.lead()
+			if !expDivides(lq.exp, lt.exp) {
+				continue
+			}
+			m := mpoly{}
+			m.addTerm(expQuo(lt.exp, lq.exp), new(big.Rat).Quo(lt.c, lq.c))
+			p = mpSub(p, mpMul(m, q))
+			divided = true
+			break
+		}
+		if !divided {
+			r.addTerm(lt.exp, lt.c)
+			delete(p, expKey(lt.exp))
+		}
+	}
+	return r
+}
+
+// mpSPoly returns the S-polynomial of the nonzero a and b, whose leading
+// terms cancel.
+func mpSPoly(a, b mpoly) mpoly {
+	la, lb := a.lead(), b.lead()
+	l := make([]int, max(len(la.exp), len(lb.exp)))
+	for i := range l {
+		l[i] = max(expAt(la.exp, i), expAt(lb.exp, i))
+	}
+	ma, mb := mpoly{}, mpoly{}
+	ma.addTerm(expQuo(l, la.exp), new(big.Rat).Inv(la.c))
+	mb.addTerm(expQuo(l, lb.exp), new(big.Rat).Inv(lb.c))
+	return mpSub(mpMul(ma, a), mpMul(mb, b))
+}
+
+// mpMonic divides the nonzero p by its leading coefficient.
+func mpMonic(p mpoly) mpoly {
+	inv := new(big.Rat).Inv(p.lead().c)
+	out := make(mpoly, len(p))
+	for k, t := range p {
+		out[k] = mterm{t.exp, new(big.Rat).Mul(t.c, inv)}
+	}
+	return out
+}
+
+// mpPrimitive scales the nonzero p to integer coefficients without a
+// common divisor and a positive leading coefficient.
+func mpPrimitive(p mpoly) mpoly {
+	den, num := big.NewInt(1), new(big.Int)
+	for _, t := range p {
+		d := t.c.Denom()
+		den.Mul(den, new(big.Int).Quo(d, new(big.Int).GCD(nil, nil, den, d)))
+	}
+	for _, t := range p {
+		n := new(big.Rat).Mul(t.c, new(big.Rat).SetInt(den))
+		num.GCD(nil, nil, num, new(big.Int).Abs(n.Num()))
+	}
+	if p.lead().c.Sign() < 0 {
+		num.Neg(num)
+	}
+	scale := new(big.Rat).SetFrac(den, num)
+	out := make(mpoly, len(p))
+	for k, t := range p {
+		out[k] = mterm{t.exp, new(big.Rat).Mul(t.c, scale)}
+	}
+	return out
+}
+
+// isConst reports whether p is a constant, zero included.
+func (p mpoly) isConst() bool {
+	_, ok := p[expKey(nil)]
+	return len(p) == 0 || (len(p) == 1 && ok)
+}
+
+// mpGCD returns the primitive greatest common divisor of the nonzero a
+// and b. It divides a*b by their least common multiple, which generates
+// the intersection of the ideals (a) and (b): with t a new greatest
+// indeterminate, it is the element free of t in the lex Gröbner basis of
+// t*a and (1 - t)*b. It reports false when the basis exceeds its budget.
+func mpGCD(a, b mpoly) (mpoly, bool) {
+	if a.isConst() || b.isConst() {
+		return mpConst(big.NewRat(1, 1)), true
+	}
+	withT := func(p mpoly, k int) mpoly {
+		out := make(mpoly, len(p))
+		for _, t := range p {
+			out.addTerm(append([]int{k}, t.exp...), t.c)
+		}
+		return out
+	}
+	g, err := groebner([]mpoly{withT(a, 1), mpSub(withT(b, 0), withT(b, 1))})
+	if err != nil {
+		return nil, false
+	}
+	for _, p := range g {
+		lcm := mpoly{}
+		for _, t := range p {
+			if expAt(t.exp, 0) != 0 {
+				lcm = nil
+				break
+			}
+			var exp []int
+			if len(t.exp) > 0 {
+				exp = t.exp[1:]
+			}
+			lcm.addTerm(exp, t.c)
+		}
+		if lcm != nil {
+			q, ok := mpQuo(mpMul(a, b), lcm)
+			if !ok {
+				return nil, false
+			}
+			return mpPrimitive(q), true
+		}
+	}
+	return nil, false
+}
+
+// expDivides reports whether the monomial with exponents a divides the one
+// with exponents b.
+func expDivides(a, b []int) bool {
+	for i, e := range a {
+		if e > expAt(b, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// expQuo returns the exponents of the quotient of monomials b/a, where a
+// divides b.
+func expQuo(b, a []int) []int {
+	out := make([]int, max(len(a), len(b)))
+	for i := range out {
+		out[i] = expAt(b, i) - expAt(a, i)
+	}
+	return out
+}
+
+func expCoprime(a, b []int) bool {
+	for i, e := range a {
+		if e > 0 && expAt(b, i) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ============================================================
+// Finite fields — polynomials over GF(p)
+// ============================================================
+
+// GFPoly is a polynomial in one indeterminate over the prime field GF(p).
+// Coefficients are kept reduced to [0, p), lowest degree first, without
+// trailing zeros. Combining polynomials over different fields is an
+// error. The zero value is not usable; build polynomials with NewGFPoly
+// or GFPolyOf. A GFPoly is immutable.
+type GFPoly struct {
+	p *big.Int
+	c []*big.Int
+}
+
+// GFFactor is an irreducible monic factor of a GFPoly and its
+// multiplicity.
+type GFFactor struct {
+	Poly GFPoly
+	Mult int
+}
+
+// NewGFPoly returns the polynomial over GF(p) with coefficients coeffs,
+// lowest degree first, reduced modulo p. It is an error for p not to be
+// prime.
+func NewGFPoly(p *big.Int, coeffs []*big.Int) (GFPoly, error) {
+	if p == nil || p.Cmp(big.NewInt(2)) < 0 || !p.ProbablyPrime(20) {
+		return GFPoly{}, fmt.Errorf("gf: modulus %v is not prime", p)
+	}
+	p = new(big.Int).Set(p)
+	c := make([]*big.Int, len(coeffs))
+	for i, a := range coeffs {
+		c[i] = new(big.Int).Mod(a, p)
+	}
+	return GFPoly{p, gfTrim(c)}, nil
+}
+
+// GFPolyOf reads e as a polynomial in varName with rational coefficients
+// and reduces it modulo the prime p, so that (x^2 + 1)/2 over GF(5) is
+// 3*x^2 + 3. It is an error for e not to be such a polynomial, for a
+// denominator to be divisible by p, or for p not to be prime.
+func GFPolyOf(e Expr, varName string, p *big.Int) (GFPoly, error) {
+	rs, ok := ratPoly(StripMeta(e).Simplify(), varName)
+	if !ok {
+		return GFPoly{}, fmt.Errorf("gf: %v is not a polynomial in %s with rational coefficients", e, varName)
+	}
+	f, err := NewGFPoly(p, nil)
+	if err != nil {
+		return GFPoly{}, err
+	}
+	c := make([]*big.Int, len(rs))
+	for i, r := range rs {
+		inv := new(big.Int).ModInverse(r.Denom(), f.p)
+		if inv == nil {
+			return GFPoly{}, fmt.Errorf("gf: coefficient %v has no value modulo %v", r.RatString(), f.p)
+		}
+		c[i] = inv.Mul(inv, r.Num()).Mod(inv, f.p)
+	}
+	f.c = gfTrim(c)
+	return f, nil
+}
+
+// Modulus returns p.
+func (f GFPoly) Modulus() *big.Int { return new(big.Int).Set(f.p) }
+
+// Coeffs returns a copy of the coefficients, lowest degree first; the
+// zero polynomial has none.
+func (f GFPoly) Coeffs() []*big.Int {
+	out := make([]*big.Int, len(f.c))
+	for i, a := range f.c {
+		out[i] = new(big.Int).Set(a)
+	}
+	return out
+}
+
+// Degree returns the degree of f, or -1 for the zero polynomial.
+func (f GFPoly) Degree() int { return len(f.c) - 1 }
+
+// IsZero reports whether f is the zero polynomial.
+func (f GFPoly) IsZero() bool { return len(f.c) == 0 }
+
+// Lead returns the leading coefficient, 0 for the zero polynomial.
+func (f GFPoly) Lead() *big.Int {
+	if f.IsZero() {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(f.c[len(f.c)-1])
+}
+
+// Equal reports whether f and g are the same polynomial over the same
+// field.
+func (f GFPoly) Equal(g GFPoly) bool {
+	if f.p.Cmp(g.p) != 0 || len(f.c) != len(g.c) {
+		return false
+	}
+	for i, a := range f.c {
+		if a.Cmp(g.c[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Expr returns f as an expression in varName with coefficients in [0, p).
+func (f GFPoly) Expr(varName string) Expr {
+	rs := make([]*big.Rat, len(f.c))
+	for i, a := range f.c {
+		rs[i] = new(big.Rat).SetInt(a)
+	}
+	return ratPolyExpr(rs, varName)
+}
+
+// String returns e.g. "x^2 + 1 (mod 7)".
+func (f GFPoly) String() string {
+	return fmt.Sprintf("%v (mod %v)", f.Expr("x"), f.p)
+}
+
+// Eval returns f(a) modulo p.
+func (f GFPoly) Eval(a *big.Int) *big.Int {
+	out := new(big.Int)
+	for i := len(f.c) - 1; i >= 0; i-- {
+		out.Mul(out, a).Add(out, f.c[i]).Mod(out, f.p)
+	}
+	return out
+}
+
+func (f GFPoly) with(c []*big.Int) GFPoly { return GFPoly{f.p, gfTrim(c)} }
+
+func (f GFPoly) sameField(op string, g GFPoly) error {
+	if f.p.Cmp(g.p) != 0 {
+		return fmt.Errorf("gf: cannot %s polynomials over GF(%v) and GF(%v)", op, f.p, g.p)
+	}
+	return nil
+}
+
+// Add returns f + g.
+func (f GFPoly) Add(g GFPoly) (GFPoly, error) {
+	if err := f.sameField("add", g); err != nil {
+		return GFPoly{}, err
+	}
+	return f.with(gfAdd(f.p, f.c, g.c)), nil
+}
+
+// Sub returns f - g.
+func (f GFPoly) Sub(g GFPoly) (GFPoly, error) {
+	if err := f.sameField("subtract", g); err != nil {
+		return GFPoly{}, err
+	}
+	return f.with(gfSub(f.p, f.c, g.c)), nil
+}
+
+// Mul returns f*g.
+func (f GFPoly) Mul(g GFPoly) (GFPoly, error) {
+	if err := f.sameField("multiply", g); err != nil {
+		return GFPoly{}, err
+	}
+	return f.with(gfMul(f.p, f.c, g.c)), nil
+}
+
+// DivMod returns q and r with f = q*g + r and deg r < deg g. It is an
+// error for g to be zero.
+func (f GFPoly) DivMod(g GFPoly) (q, r GFPoly, err error) {
+	if err := f.sameField("divide", g); err != nil {
+		return GFPoly{}, GFPoly{}, err
+	}
+	if g.IsZero() {
+		return GFPoly{}, GFPoly{}, fmt.Errorf("gf: division by the zero polynomial")
+	}
+	qc, rc := gfDivMod(f.p, f.c, g.c)
+	return f.with(qc), f.with(rc), nil
+}
+
+// GCD returns the monic greatest common divisor of f and g, zero when
+// both are zero.
+func (f GFPoly) GCD(g GFPoly) (GFPoly, error) {
+	if err := f.sameField("take the gcd of", g); err != nil {
+		return GFPoly{}, err
+	}
+	return f.with(gfGCD(f.p, f.c, g.c)), nil
+}
+
+// PowMod returns f^n mod m for n >= 0. It is an error for m to be zero.
+func (f GFPoly) PowMod(n *big.Int, m GFPoly) (GFPoly, error) {
+	if err := f.sameField("reduce", m); err != nil {
+		return GFPoly{}, err
+	}
+	if m.IsZero() {
+		return GFPoly{}, fmt.Errorf("gf: division by the zero polynomial")
+	}
+	if n.Sign() < 0 {
+		return GFPoly{}, fmt.Errorf("gf: negative exponent %v", n)
+	}
+	return f.with(gfPowMod(f.p, f.c, n, m.c)), nil
+}
+
+// Monic returns f divided by its leading coefficient; zero stays zero.
+func (f GFPoly) Monic() GFPoly { return f.with(gfMonic(f.p, f.c)) }
+
+// Deriv returns the formal derivative of f.
+func (f GFPoly) Deriv() GFPoly { return f.with(gfDeriv(f.p, f.c)) }
+
+// IsIrreducible reports whether f has positive degree and no factor of
+// smaller positive degree, by Rabin's test: x^(p^n) = x mod f, and
+// x^(p^(n/q)) - x is coprime to f for every prime q dividing n = deg f.
+func (f GFPoly) IsIrreducible() bool {
+	n := f.Degree()
+	if n < 1 {
+		return false
+	}
+	m := gfMonic(f.p, f.c)
+	x := []*big.Int{new(big.Int), big.NewInt(1)}
+	// frob returns x^(p^k) mod m.
+	frob := func(k int) []*big.Int {
+		h := x
+		for i := 0; i < k; i++ {
+			h = gfPowMod(f.p, h, f.p, m)
+		}
+		return h
+	}
+	for _, q := range primeFactorsInt(n) {
+		if g := gfGCD(f.p, m, gfSub(f.p, frob(n/q), x)); len(g) != 1 {
+			return false
+		}
+	}
+	_, r := gfDivMod(f.p, gfSub(f.p, frob(n), x), m)
+	return len(r) == 0
+}
+
+// Factor returns the leading coefficient of f and its monic irreducible
+// factors with multiplicities, ordered by degree and then coefficients
+// from the highest degree down. The square-free parts are split by
+// distinct-degree factorization and then by Cantor–Zassenhaus, with a
+// fixed random seed so that the result is deterministic. It is an error
+// for f to be zero.
+func (f GFPoly) Factor() (*big.Int, []GFFactor, error) {
+	if f.IsZero() {
+		return nil, nil, fmt.Errorf("gf: cannot factor the zero polynomial")
+	}
+	rng := rand.New(rand.NewSource(1))
+	mult := map[string]int{}
+	polys := map[string][]*big.Int{}
+	for _, sf := range gfSquareFree(f.p, gfMonic(f.p, f.c)) {
+		for _, dd := range gfDistinctDegree(f.p, sf.poly) {
+			for _, g := range gfEqualDegree(f.p, dd.poly, dd.mult, rng) {
+				k := fmt.Sprint(g)
+				mult[k] += sf.mult
+				polys[k] = g
+			}
+		}
+	}
+	out := make([]GFFactor, 0, len(polys))
+	for k, g := range polys {
+		out = append(out, GFFactor{f.with(g), mult[k]})
+	}
+	sort.Slice(out, func(i, j int) bool { return gfLess(out[i].Poly.c, out[j].Poly.c) })
+	return f.Lead(), out, nil
+}
+
+// gfPart is a polynomial with a multiplicity, or with the degree of its
+// irreducible factors in distinct-degree factorization.
+type gfPart struct {
+	poly []*big.Int
+	mult int
+}
+
+// gfSquareFree returns the square-free decomposition of the monic f of
+// positive degree: monic square-free parts with their multiplicities. In
+// characteristic p a zero derivative means f is a p-th power, whose root
+// takes every p-th coefficient.
+func gfSquareFree(p *big.Int, f []*big.Int) []gfPart {
+	if len(f) <= 1 {
+		return nil
+	}
+	var out []gfPart
+	pthRoot := func(c []*big.Int) []*big.Int {
+		step := int(p.Int64())
+		r := make([]*big.Int, 0, len(c)/step+1)
+		for i := 0; i < len(c); i += step {
+			r = append(r, c[i])
+		}
+		return r
+	}
+	d := gfDeriv(p, f)
+	if len(d) == 0 {
+		for _, part := range gfSquareFree(p, pthRoot(f)) {
+			out = append(out, gfPart{part.poly, part.mult * int(p.Int64())})
+		}
+		return out
+	}
+	c := gfGCD(p, f, d)
+	w, _ := gfDivMod(p, f, c)
+	for i := 1; len(w) > 1; i++ {
+		y := gfGCD(p, w, c)
+		if fac, _ := gfDivMod(p, w, y); len(fac) > 1 {
+			out = append(out, gfPart{fac, i})
+		}
+		w = y
+		c, _ = gfDivMod(p, c, y)
+	}
+	if len(c) > 1 {
+		for _, part := range gfSquareFree(p, pthRoot(c)) {
+			out = append(out, gfPart{part.poly, part.mult * int(p.Int64())})
+		}
+	}
+	return out
+}
+
+// gfDistinctDegree splits the monic square-free f into products of its
+// irreducible factors of equal degree, returned with that degree.
+func gfDistinctDegree(p *big.Int, f []*big.Int) []gfPart {
+	var out []gfPart
+	x := []*big.Int{new(big.Int), big.NewInt(1)}
+	h := x
+	for d := 1; 2*d <= len(f)-1; d++ {
+		h = gfPowMod(p, h, p, f)
+		if g := gfGCD(p, f, gfSub(p, h, x)); len(g) > 1 {
+			out = append(out, gfPart{g, d})
+			f, _ = gfDivMod(p, f, g)
+			_, h = gfDivMod(p, h, f)
+		}
+	}
+	if len(f) > 1 {
+		out = append(out, gfPart{f, len(f) - 1})
+	}
+	return out
+}
+
+// gfEqualDegree splits the monic square-free f, a product of irreducible
+// factors of degree d, by Cantor–Zassenhaus: for a random a, gcd(f,
+// a^((p^d-1)/2) - 1) is a proper factor about half the time. For p = 2
+// the trace a + a^2 + ... + a^(2^(d-1)) takes the place of the power.
+func gfEqualDegree(p *big.Int, f []*big.Int, d int, rng *rand.Rand) [][]*big.Int {
+	n := len(f) - 1
+	if n <= d {
+		return [][]*big.Int{f}
+	}
+	one := []*big.Int{big.NewInt(1)}
+	e := new(big.Int).Exp(p, big.NewInt(int64(d)), nil)
+	e.Sub(e, big.NewInt(1)).Rsh(e, 1)
+	for {
+		a := make([]*big.Int, n)
+		for i := range a {
+			a[i] = new(big.Int).Rand(rng, p)
+		}
+		a = gfTrim(a)
+		if len(a) <= 1 {
+			continue
+		}
+		var b []*big.Int
+		if p.Cmp(big.NewInt(2)) == 0 {
+			t := a
+			b = a
+			for i := 1; i < d; i++ {
+				t = gfPowMod(p, t, p, f)
+				b = gfAdd(p, b, t)
+			}
+		} else {
+			b = gfSub(p, gfPowMod(p, a, e, f), one)
+		}
+		g := gfGCD(p, f, b)
+		if len(g) > 1 && len(g) < len(f) {
+			q, _ := gfDivMod(p, f, g)
+			return append(gfEqualDegree(p, g, d, rng), gfEqualDegree(p, q, d, rng)...)
+		}
+	}
+}
+
+// gfLess orders polynomials by degree, then by coefficients from the
+// highest degree down.
+func gfLess(a, b []*big.Int) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		if c := a[i].Cmp(b[i]); c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+// primeFactorsInt returns the distinct prime factors of n > 0 in
+// increasing order.
+func primeFactorsInt(n int) []int {
+	var out []int
+	for q := 2; q*q <= n; q++ {
+		if n%q == 0 {
+			out = append(out, q)
+			for n%q == 0 {
+				n /= q
+			}
+		}
+	}
+	if n > 1 {
+		out = append(out, n)
+	}
+	return out
+}
+
+func gfTrim(c []*big.Int) []*big.Int {
+	for len(c) > 0 && c[len(c)-1].Sign() == 0 {
+		c = c[:len(c)-1]
+	}
+	return c
+}
+
+func gfAdd(p *big.Int, a, b []*big.Int) []*big.Int {
+	out := make([]*big.Int, max(len(a), len(b)))
+	for i := range out {
+		out[i] = new(big.Int)
+		if i < len(a) {
+			out[i].Add(out[i], a[i])
+		}
+		if i < len(b) {
+			out[i].Add(out[i], b[i])
+		}
+		out[i].Mod(out[i], p)
+	}
+	return gfTrim(out)
+}
+
+func gfSub(p *big.Int, a, b []*big.Int) []*big.Int {
+	nb := make([]*big.Int, len(b))
+	for i, c := range b {
+		nb[i] = new(big.Int).Neg(c)
+	}
+	return gfAdd(p, a, nb)
+}
+
+func gfMul(p *big.Int, a, b []*big.Int) []*big.Int {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	out := make([]*big.Int, len(a)+len(b)-1)
+	for i := range out {
+		out[i] = new(big.Int)
+	}
+	t := new(big.Int)
+	for i, x := range a {
+		for j, y := range b {
+			out[i+j].Add(out[i+j], t.Mul(x, y))
+		}
+	}
+	for _, c := range out {
+		c.Mod(c, p)
+	}
+	return gfTrim(out)
+}
+
+// gfDivMod divides a by the nonzero b.
+func gfDivMod(p *big.Int, a, b []*big.Int) (q, r []*big.Int) {
+	r = make([]*big.Int, len(a))
+	for i, c := range a {
+		r[i] = new(big.Int).Set(c)
+	}
+	if len(a) < len(b) {
+		return nil, r
+	}
+	inv := new(big.Int).ModInverse(b[len(b)-1], p)
+	q = make([]*big.Int, len(a)-len(b)+1)
+	t := new(big.Int)
+	for k := len(q) - 1; k >= 0; k-- {
+		c := new(big.Int).Mul(r[k+len(b)-1], inv)
+		q[k] = c.Mod(c, p)
+		for j, y := range b {
+			r[k+j].Sub(r[k+j], t.Mul(c, y)).Mod(r[k+j], p)
+		}
+	}
+	return gfTrim(q), gfTrim(r)
+}
+
+func gfMonic(p *big.Int, a []*big.Int) []*big.Int {
+	if len(a) == 0 {
+		return nil
+	}
+	inv := new(big.Int).ModInverse(a[len(a)-1], p)
+	out := make([]*big.Int, len(a))
+	for i, c := range a {
+		out[i] = new(big.Int).Mul(c, inv)
+		out[i].Mod(out[i], p)
+	}
+	return out
+}
+
+func gfGCD(p *big.Int, a, b []*big.Int) []*big.Int {
+	for len(b) > 0 {
+		_, r := gfDivMod(p, a, b)
+		a, b = b, r
+	}
+	return gfMonic(p, a)
+}
+
+// gfPowMod returns a^n mod the nonzero m by repeated squaring.
+func gfPowMod(p *big.Int, a []*big.Int, n *big.Int, m []*big.Int) []*big.Int {
+	_, out := gfDivMod(p, []*big.Int{big.NewInt(1)}, m)
+	_, base := gfDivMod(p, a, m)
+	for i := n.BitLen() - 1; i >= 0; i-- {
+		_, out = gfDivMod(p, gfMul(p, out, out), m)
+		if n.Bit(i) == 1 {
+			_, out = gfDivMod(p, gfMul(p, out, base), m)
+		}
+	}
+	return out
+}
+
+func gfDeriv(p *big.Int, a []*big.Int) []*big.Int {
+	if len(a) <= 1 {
+		return nil
+	}
+	out := make([]*big.Int, len(a)-1)
+	for i := range out {
+		out[i] = new(big.Int).Mul(a[i+1], big.NewInt(int64(i+1)))
+		out[i].Mod(out[i], p)
+	}
+	return gfTrim(out)
+}
+
+// ============================================================
+// Logic — propositional formulas and satisfiability
+// ============================================================
+
+// Bool is a propositional formula over named boolean symbols, built with
+// BoolVar, BoolConst, Not, And, Or, Implies and Iff. TruthTable tabulates
+// it, and Satisfiable, IsTautology and IsContradiction decide it, so that
+// the case splits of a solver or a set of assumptions can be checked
+// mechanically.
+type Bool interface {
+	// String returns the formula with ! for not, & for and, | for or,
+	// -> for implication and <-> for equivalence, e.g. "a & !b -> c".
+	String() string
+	holds(env map[string]bool) bool
+}
+
+type boolVar struct{ name string }
+
+type boolConst struct{ value bool }
+
+type boolNot struct{ a Bool }
+
+// boolOp is a connective: "&" and "|" with any number of arguments, "->"
+// and "<->" with two.
+type boolOp struct {
+	op   string
+	args []Bool
+}
+
+// BoolVar returns the boolean symbol name.
+func BoolVar(name string) Bool { return boolVar{name} }
+
+// BoolConst returns the constant true or false.
+func BoolConst(value bool) Bool { return boolConst{value} }
+
+// Not returns ¬a.
+func Not(a Bool) Bool { return boolNot{a} }
+
+// And returns the conjunction of args, which is true when args is empty.
+func And(args ...Bool) Bool { return boolOp{"&", append([]Bool(nil), args...)} }
+
+// Or returns the disjunction of args, which is false when args is empty.
+func Or(args ...Bool) Bool { return boolOp{"|", append([]Bool(nil), args...)} }
+
+// Implies returns a → b.
+func Implies(a, b Bool) Bool { return boolOp{"->", []Bool{a, b}} }
+
+// Iff returns a ↔ b.
+func Iff(a, b Bool) Bool { return boolOp{"<->", []Bool{a, b}} }
+
+func (v boolVar) String() string                 { return v.name }
+func (v boolVar) holds(env map[string]bool) bool { return env[v.name] }
+
+func (c boolConst) String() string {
+	if c.value {
+		return "true"
+	}
+	return "false"
+}
+func (c boolConst) holds(map[string]bool) bool { return c.value }
+
+func (n boolNot) String() string {
+	if _, ok := n.a.(boolOp); ok {
+		return "!(" + n.a.String() + ")"
+	}
+	return "!" + n.a.String()
+}
+func (n boolNot) holds(env map[string]bool) bool { return !n.a.holds(env) }
+
+// boolPrec ranks the connectives from loosest to tightest binding.
+var boolPrec = map[string]int{"<->": 1, "->": 2, "|": 3, "&": 4}
+
+func (o boolOp) String() string {
+	if len(o.args) == 0 {
+		return BoolConst(o.op == "&").String()
+	}
+	parts := make([]string, len(o.args))
+	for i, a := range o.args {
+		parts[i] = a.String()
+		// Implication groups to the right, so only its left side needs
+		// parentheses for another implication.
+		if c, ok := a.(boolOp); ok && len(c.args) > 0 && (boolPrec[c.op] < boolPrec[o.op] || boolPrec[c.op] == boolPrec[o.op] && (o.op == "<->" || o.op == "->" && i == 0)) {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " "+o.op+" ")
+}
+
+func (o boolOp) holds(env map[string]bool) bool {
+	switch o.op {
+	case "->":
+		return !o.args[0].holds(env) || o.args[1].holds(env)
+	case "<->":
+		return o.args[0].holds(env) == o.args[1].holds(env)
+	}
+	for _, a := range o.args {
+		if a.holds(env) != (o.op == "&") {
+			return o.op != "&"
+		}
+	}
+	return o.op == "&"
+}
+
+// BoolVars returns the names of the boolean symbols of f, sorted.
+func BoolVars(f Bool) []string {
+	seen := map[string]struct{}{}
+	var walk func(Bool)
+	walk = func(f Bool) {
+		switch t := f.(type) {
+		case boolVar:
+			seen[t.name] = struct{}{}
+		case boolNot:
+			walk(t.a)
+		case boolOp:
+			for _, a := range t.args {
+				walk(a)
+			}
+		}
+	}
+	walk(f)
+	return sortedNames(seen)
+}
+
+// maxTruthTableVars bounds the symbols of a formula TruthTable accepts,
+// and so the table at 2^16 rows.
+const maxTruthTableVars = 16
+
+// TruthRow is one row of a truth table: the value of the formula under
+// the assignment.
+type TruthRow struct {
+	Assignment map[string]bool
+	Value      bool
+}
+
+// TruthTable evaluates f under every assignment of its symbols, in the
+// order of counting in binary with false as 0 and the symbols of BoolVars
+// from the most significant digit down, so the first row assigns false to
+// all of them. It fails for more than 16 symbols.
+func TruthTable(f Bool) ([]TruthRow, error) {
+	vars := BoolVars(f)
+	if len(vars) > maxTruthTableVars {
+		return nil, fmt.Errorf("truth table of %d symbols exceeds the limit of %d", len(vars), maxTruthTableVars)
+	}
+	rows := make([]TruthRow, 1<<len(vars))
+	for r := range rows {
+		env := make(map[string]bool, len(vars))
+		for i, v := range vars {
+			env[v] = r>>(len(vars)-1-i)&1 == 1
+		}
+		rows[r] = TruthRow{Assignment: env, Value: f.holds(env)}
+	}
+	return rows, nil
+}
+
+// Satisfiable reports whether some assignment of the symbols of f makes
+// it true, returning one such assignment of every symbol. It converts f to
+// clauses by the Tseitin transformation, which adds a variable per
+// connective instead of expanding, and searches them with DPLL: unit
+// propagation, then branching on the first unassigned variable.
+func Satisfiable(f Bool) (model map[string]bool, ok bool) {
+	vars := BoolVars(f)
+	c := &cnf{index: map[string]int{}}
+	for _, v := range vars {
+		c.index[v] = c.newVar()
+	}
+	c.clauses = append(c.clauses, []int{c.lit(f)})
+	assign := make([]int8, c.nvars+1)
+	if !dpll(c.clauses, assign) {
+		return nil, false
+	}
+	model = make(map[string]bool, len(vars))
+	for _, v := range vars {
+		model[v] = assign[c.index[v]] > 0
+	}
+	return model, true
+}
+
+// IsTautology reports whether f holds under every assignment.
+func IsTautology(f Bool) bool {
+	_, ok := Satisfiable(Not(f))
+	return !ok
+}
+
+// IsContradiction reports whether f holds under no assignment.
+func IsContradiction(f Bool) bool {
+	_, ok := Satisfiable(f)
+	return !ok
+}
+
+// cnf accumulates the clauses of a Tseitin transformation. Variables are
+// numbered from 1; a literal is a variable or its negation.
+type cnf struct {
+	index   map[string]int
+	nvars   int
+	clauses [][]int
+}
+
+func (c *cnf) newVar() int {
+	c.nvars++
+	return c.nvars
+}
+
+// lit returns a literal equivalent to f under the clauses it adds.
+func (c *cnf) lit(f Bool) int {
+	switch t := f.(type) {
+	case boolVar:
+		return c.index[t.name]
+	case boolConst:
+		g := c.newVar()
+		if t.value {
+			c.clauses = append(c.clauses, []int{g})
+		} else {
+			c.clauses = append(c.clauses, []int{-g})
+		}
+		return g
+	case boolNot:
+		return -c.lit(t.a)
+	}
+	o := f.(boolOp)
+	ls := make([]int, len(o.args))
+	for i, a := range o.args {
+		ls[i] = c.lit(a)
+	}
+	g := c.newVar()
+	switch o.op {
+	case "&", "|":
+		// For "|" the clauses of "&" apply to the negated literals.
+		s := 1
+		if o.op == "|" {
+			s = -1
+		}
+		all := []int{s * g}
+		for _, l := range ls {
+			c.clauses = append(c.clauses, []int{-s * g, s * l})
+			all = append(all, -s*l)
+		}
+		c.clauses = append(c.clauses, all)
+	case "->":
+		a, b := ls[0], ls[1]
+		c.clauses = append(c.clauses, []int{-g, -a, b}, []int{g, a}, []int{g, -b})
+	case "<->":
+		a, b := ls[0], ls[1]
+		c.clauses = append(c.clauses, []int{-g, -a, b}, []int{-g, a, -b}, []int{g, a, b}, []int{g, -a, -b})
+	}
+	return g
+}
+
+// dpll decides the clauses under the partial assignment assign, indexed by
+// variable with 1 for true, -1 for false and 0 for unassigned, and
+// completes assign when they are satisfiable.
+func dpll(clauses [][]int, assign []int8) bool {
+	value := func(l int) int8 {
+		if l > 0 {
+			return assign[l]
+		}
+		return -assign[-l]
+	}
+	set := func(l int) {
+		if l > 0 {
+			assign[l] = 1
+		} else {
+			assign[-l] = -1
+		}
+	}
+	saved := append([]int8(nil), assign...)
+	for changed := true; changed; {
+		changed = false
+		for _, cl := range clauses {
+			free, unit := 0, 0
+			sat := false
+			for _, l := range cl {
+				switch value(l) {
+				case 1:
+					sat = true
+				case 0:
+					free, unit = free+1, l
+				}
+			}
+			switch {
+			case sat:
+			case free == 0:
+				copy(assign, saved)
+				return false
+			case free == 1:
+				set(unit)
+				changed = true
+			}
+		}
+	}
+	for v := 1; v < len(assign); v++ {
+		if assign[v] != 0 {
+			continue
+		}
+		for _, l := range []int{v, -v} {
+			set(l)
+			if dpll(clauses, assign) {
+				return true
+			}
+			assign[v] = 0
+		}
+		copy(assign, saved)
+		return false
+	}
+	return true
+}
+
+// ============================================================
+// Sets — unions of real intervals
+// ============================================================
+
+// Span is the interval of reals from Lo to Hi, each end open or closed.
+// Infinite ends are Inf and -Inf and are always open; a Span with
+// Lo = Hi and both ends closed is a single point.
+type Span struct {
+	Lo, Hi         Expr
+	LoOpen, HiOpen bool
+}
+
+// RealSet is a set of reals stored as a union of disjoint spans in
+// increasing order, such as the solution set of an inequality or the
+// domain of a function. The endpoints may be symbolic, as long as every
+// comparison the operations need is decidable: a and a + 1 compare, a
+// and 1 do not, and the operations report an error then.
+type RealSet struct {
+	spans []Span
+}
+
+// EmptySet returns the empty set.
+func EmptySet() RealSet { return RealSet{} }
+
+// Reals returns the whole real line.
+func Reals() RealSet {
+	return RealSet{spans: []Span{{Lo: neg(Inf).Simplify(), Hi: Inf, LoOpen: true, HiOpen: true}}}
+}
+
+// SetOf returns the union of spans. Empty spans are dropped and
+// overlapping or touching ones merged.
+func SetOf(spans ...Span) (RealSet, error) {
+	var out []Span
+	for _, s := range spans {
+		s = Span{s.Lo.Simplify(), s.Hi.Simplify(), s.LoOpen || infSign(s.Lo) != 0, s.HiOpen || infSign(s.Hi) != 0}
+		c, err := cmpEnds(s.Lo, s.Hi)
+		if err != nil {
+			return RealSet{}, err
+		}
+		if c < 0 || c == 0 && !s.LoOpen && !s.HiOpen {
+			out = append(out, s)
+		}
+	}
+	var err error
+	sort.SliceStable(out, func(i, j int) bool {
+		c, e := cmpEnds(out[i].Lo, out[j].Lo)
+		if e != nil && err == nil {
+			err = e
+		}
+		return c < 0 || c == 0 && !out[i].LoOpen && out[j].LoOpen
+	})
+	if err != nil {
+		return RealSet{}, err
+	}
+	merged := out[:0]
+	for _, s := range out {
+		if k := len(merged) - 1; k >= 0 {
+			last := &merged[k]
+			c, err := cmpEnds(last.Hi, s.Lo)
+			if err != nil {
+				return RealSet{}, err
+			}
+			if c > 0 || c == 0 && (!last.HiOpen || !s.LoOpen) {
+				if c, err = cmpEnds(s.Hi, last.Hi); err != nil {
+					return RealSet{}, err
+				}
+				if c > 0 || c == 0 && !s.HiOpen {
+					last.Hi, last.HiOpen = s.Hi, s.HiOpen
+				}
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+	return RealSet{spans: merged}, nil
+}
+
+// infSign is 1 for Inf, -1 for -Inf and 0 for anything else.
+func infSign(e Expr) int {
+	switch e.String() {
+	case "oo":
+		return 1
+	case "-oo":
+		return -1
+	}
+	return 0
+}
+
+// cmpEnds compares two endpoints, or fails when their order depends on
+// the values of symbols.
+func cmpEnds(a, b Expr) (int, error) {
+	if sa, sb := infSign(a), infSign(b); sa != 0 || sb != 0 {
+		if sa == sb {
+			return 0, nil
+		}
+		if sa < sb {
+			return -1, nil
+		}
+		return 1, nil
+	}
+	for _, c := range []struct {
+		op   RelOp
+		sign int
+	}{{RelEq, 0}, {RelLt, -1}, {RelGt, 1}} {
+		if holds, known := decideExpanded(Cond{a, c.op, b}); known && holds {
+			return c.sign, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot order %s and %s", a, b)
+}
+
+// decideExpanded is Cond.Decide applied to the expanded difference of the
+// sides, so that a < a + 1 is decided.
+func decideExpanded(c Cond) (holds, known bool) {
+	return Cond{Expand(sub(c.Lhs, c.Rhs)), c.Op, N(0)}.Decide()
+}
+
+// Spans returns a copy of the spans of s in increasing order.
+func (s RealSet) Spans() []Span { return append([]Span(nil), s.spans...) }
+
+// IsEmpty reports whether s has no elements.
+func (s RealSet) IsEmpty() bool { return len(s.spans) == 0 }
+
+// Union returns s ∪ t.
+func (s RealSet) Union(t RealSet) (RealSet, error) {
+	return SetOf(append(s.Spans(), t.spans...)...)
+}
+
+// Intersect returns s ∩ t.
+func (s RealSet) Intersect(t RealSet) (RealSet, error) {
+	var out []Span
+	for _, a := range s.spans {
+		for _, b := range t.spans {
+			lo, loOpen := a.Lo, a.LoOpen
+			c, err := cmpEnds(a.Lo, b.Lo)
+			if err != nil {
+				return RealSet{}, err
+			}
+			if c < 0 || c == 0 && b.LoOpen {
+				lo, loOpen = b.Lo, b.LoOpen
+			}
+			hi, hiOpen := a.Hi, a.HiOpen
+			if c, err = cmpEnds(a.Hi, b.Hi); err != nil {
+				return RealSet{}, err
+			}
+			if c > 0 || c == 0 && b.HiOpen {
+				hi, hiOpen = b.Hi, b.HiOpen
+			}
+			out = append(out, Span{lo, hi, loOpen, hiOpen})
+		}
+	}
+	return SetOf(out...)
+}
+
+// Complement returns the reals not in s.
+func (s RealSet) Complement() (RealSet, error) {
+	lo, loOpen := neg(Inf).Simplify(), true
+	var out []Span
+	for _, sp := range s.spans {
+		out = append(out, Span{lo, sp.Lo, loOpen, !sp.LoOpen})
+		lo, loOpen = sp.Hi, !sp.HiOpen
+	}
+	return SetOf(append(out, Span{lo, Inf, loOpen, true})...)
+}
+
+// Measure returns the total length of s, Inf when a span is unbounded.
+func (s RealSet) Measure() Expr {
+	terms := []Expr{N(0)}
+	for _, sp := range s.spans {
+		if infSign(sp.Lo) != 0 || infSign(sp.Hi) != 0 {
+			return Inf
+		}
+		terms = append(terms, sub(sp.Hi, sp.Lo))
+	}
+	return (&Add{terms: terms}).Simplify()
+}
+
+// Contains reports whether x lies in s. known is false when that depends
+// on the values of symbols.
+func (s RealSet) Contains(x Expr) (holds, known bool) {
+	known = true
+	for _, sp := range s.spans {
+		in, decided := true, true
+		for _, c := range sp.conds(x) {
+			h, k := decideExpanded(c)
+			if k && !h {
+				in = false
+				break
+			}
+			decided = decided && k
+		}
+		switch {
+		case !in:
+		case decided:
+			return true, true
+		default:
+			known = false
+		}
+	}
+	return false, known
+}
+
+// conds returns the conditions on x of lying in sp, omitting infinite
+// ends.
+func (sp Span) conds(x Expr) []Cond {
+	var out []Cond
+	if infSign(sp.Lo) == 0 {
+		op := RelGe
+		if sp.LoOpen {
+			op = RelGt
+		}
+		out = append(out, Cond{x, op, sp.Lo})
+	}
+	if infSign(sp.Hi) == 0 {
+		op := RelLe
+		if sp.HiOpen {
+			op = RelLt
+		}
+		out = append(out, Cond{x, op, sp.Hi})
+	}
+	return out
+}
+
+// Indicator returns the expression that is 1 where x lies in s and 0
+// elsewhere: a sum over the spans, which are disjoint, of Relational
+// nodes such as the chain 0 <= x <= 3.
+func (s RealSet) Indicator(x Expr) Expr {
+	terms := []Expr{N(0)}
+	for _, sp := range s.spans {
+		terms = append(terms, sp.relation(x))
+	}
+	return (&Add{terms: terms}).Simplify()
+}
+
+// relation returns the condition that x lies in sp: x = a for a point, a
+// chain such as 0 <= x < 1 for a bounded span, and a single comparison or
+// 1 otherwise.
+func (sp Span) relation(x Expr) Expr {
+	conds := sp.conds(x)
+	switch {
+	case len(conds) == 0:
+		return N(1)
+	case len(conds) == 1:
+		return conds[0].Relation()
+	case sp.Lo.Equal(sp.Hi):
+		return Rel(x, RelEq, sp.Lo)
+	}
+	lo := RelLe
+	if sp.LoOpen {
+		lo = RelLt
+	}
+	return Chain([]Expr{sp.Lo, x, sp.Hi}, lo, conds[1].Op)
+}
+
+// Sub substitutes value for varName in the endpoints and renormalizes.
+func (s RealSet) Sub(varName string, value Expr) (RealSet, error) {
+	out := make([]Span, len(s.spans))
+	for i, sp := range s.spans {
+		out[i] = Span{sp.Lo.Sub(varName, value), sp.Hi.Sub(varName, value), sp.LoOpen, sp.HiOpen}
+	}
+	return SetOf(out...)
+}
+
+// String returns e.g. "[0, 1) ∪ (2, oo)", or "{}" for the empty set.
+func (s RealSet) String() string {
+	if len(s.spans) == 0 {
+		return "{}"
+	}
+	parts := make([]string, len(s.spans))
+	for i, sp := range s.spans {
+		parts[i] = sp.String()
+	}
+	return strings.Join(parts, " ∪ ")
+}
+
+// LaTeX returns e.g. `[0, 1) \cup (2, \infty)`.
+func (s RealSet) LaTeX() string {
+	if len(s.spans) == 0 {
+		return `\emptyset`
+	}
+	parts := make([]string, len(s.spans))
+	for i, sp := range s.spans {
+		parts[i] = sp.brackets(sp.Lo.LaTeX() + ", " + sp.Hi.LaTeX())
+	}
+	return strings.Join(parts, ` \cup `)
+}
+
+// String returns e.g. "[0, 1)", or "{a}" for a single point.
+func (sp Span) String() string {
+	if !sp.LoOpen && !sp.HiOpen && sp.Lo.String() == sp.Hi.String() {
+		return "{" + sp.Lo.String() + "}"
+	}
+	return sp.brackets(sp.Lo.String() + ", " + sp.Hi.String())
+}
+
+func (sp Span) brackets(inner string) string {
+	l, r := "[", "]"
+	if sp.LoOpen {
+		l = "("
+	}
+	if sp.HiOpen {
+		r = ")"
+	}
+	return l + inner + r
+}
+
+// SolveInequality returns the set of x where rel holds. rel is a
+// Relational, possibly a chain such as 0 < x^2 - 1 <= 3, whose links are
+// polynomials in x with rational coefficients; the solution sets of the
+// links are intersected. It fails when a link has a real root that is
+// neither rational nor a root of a quadratic factor.
+func SolveInequality(rel Expr, x string) (RealSet, error) {
+	r, ok := rel.(*Relational)
+	if !ok {
+		return RealSet{}, fmt.Errorf("SolveInequality: %s is not a comparison", rel)
+	}
+	out := Reals()
+	for _, c := range r.Links() {
+		d := Expand(sub(c.Lhs, c.Rhs))
+		p, ok := ratPoly(d, x)
+		if !ok {
+			return RealSet{}, fmt.Errorf("SolveInequality: %s is not a polynomial in %s with rational coefficients", d, x)
+		}
+		s, err := polySignSet(p, c.Op)
+		if err != nil {
+			return RealSet{}, fmt.Errorf("SolveInequality: %s: %w", c, err)
+		}
+		if out, err = out.Intersect(s); err != nil {
+			return RealSet{}, err
+		}
+	}
+	return out, nil
+}
+
+// polySignSet returns the set where p compares to 0 as op requires, by
+// the sign of p between and at its real roots.
+func polySignSet(p []*big.Rat, op RelOp) (RealSet, error) {
+	if len(p) == 0 {
+		if op.holds(0) {
+			return Reals(), nil
+		}
+		return EmptySet(), nil
+	}
+	roots, err := exactRealRoots(p)
+	if err != nil {
+		return RealSet{}, err
+	}
+	vals := make([]float64, len(roots))
+	for i, r := range roots {
+		vals[i], _ = evalFloat(r, nil)
+	}
+	at := func(v float64) int {
+		q := new(big.Rat)
+		q.SetFloat64(v)
+		return polyAt(p, q).Sign()
+	}
+	var spans []Span
+	lo, loVal := neg(Inf).Simplify(), math.Inf(-1)
+	for i := 0; i <= len(roots); i++ {
+		hi, hiVal := Expr(Inf), math.Inf(1)
+		if i < len(roots) {
+			hi, hiVal = roots[i], vals[i]
+		}
+		var mid float64
+		switch {
+		case math.IsInf(loVal, 0) && math.IsInf(hiVal, 0):
+			mid = 0
+		case math.IsInf(loVal, 0):
+			mid = hiVal - 1
+		case math.IsInf(hiVal, 0):
+			mid = loVal + 1
+		default:
+			mid = (loVal + hiVal) / 2
+		}
+		if op.holds(at(mid)) {
+			spans = append(spans, Span{lo, hi, true, true})
+		}
+		if i < len(roots) && op.holds(0) {
+			spans = append(spans, Span{hi, hi, false, false})
+		}
+		lo, loVal = hi, hiVal
+	}
+	return SetOf(spans...)
+}
+
+// exactRealRoots returns the distinct real roots of the nonzero p in
+// increasing order: its rational roots and those of a remaining quadratic
+// factor. It fails when a factor of higher degree has real roots.
+func exactRealRoots(p []*big.Rat) ([]Expr, error) {
+	if len(p) == 1 {
+		return nil, nil
+	}
+	sf := primitivePoly(squareFree(p))
+	var roots []Expr
+	rest := sf
+	for _, r := range rationalRoots(sf) {
+		roots = append(roots, numRat(r))
+		rest, _ = polyDivMod(rest, []*big.Rat{new(big.Rat).Neg(r), big.NewRat(1, 1)})
+	}
+	switch deg := len(rest) - 1; {
+	case deg == 2:
+		if res := SolveQuadratic(numRat(rest[2]), numRat(rest[1]), numRat(rest[0])); res.Error == "" {
+			roots = append(roots, res.Solutions...)
+		}
+	case deg > 2:
+		bound := new(big.Rat)
+		for _, c := range rest[:deg] {
+			if q := new(big.Rat).Abs(new(big.Rat).Quo(c, rest[deg])); q.Cmp(bound) > 0 {
+				bound = q
+			}
+		}
+		bound.Add(bound, big.NewRat(1, 1))
+		if newSturm(rest).count(new(big.Rat).Neg(bound), bound) > 0 {
+			return nil, fmt.Errorf("irrational real roots of a degree-%d factor are not supported", deg)
+		}
+	}
+	sort.SliceStable(roots, func(i, j int) bool {
+		a, _ := evalFloat(roots[i], nil)
+		b, _ := evalFloat(roots[j], nil)
+		return a < b
+	})
+	return roots, nil
+}
+
+// ============================================================
+// Equation
+// ============================================================
+
+// Equation represents LHS = RHS.
+type Equation struct {
+	LHS Expr
+	RHS Expr
+}
+
+// Eq returns the equation lhs = rhs. Relation turns it into an
+// expression node, like Lt, Le, Gt and Ge for the inequalities.
+func Eq(lhs, rhs Expr) *Equation { return &Equation{LHS: lhs, RHS: rhs} }
+
+// Relation returns eq as the Relational expression LHS = RHS.
+func (eq *Equation) Relation() Expr { return Rel(eq.LHS, RelEq, eq.RHS) }
+
+// String returns "lhs = rhs".
+func (eq *Equation) String() string { return eq.LHS.String() + " = " + eq.RHS.String() }
+
+// LaTeX returns the LaTeX form "lhs = rhs".
+func (eq *Equation) LaTeX() string { return eq.LHS.LaTeX() + " = " + eq.RHS.LaTeX() }
+
+// Residual returns LHS - RHS, simplified, so the equation reads Residual = 0.
+func (eq *Equation) Residual() Expr { return sub(eq.LHS, eq.RHS).Simplify() }
+
+// Isolate rearranges eq into target = rhs, where target is any
+// subexpression, e.g. n*R in P*V = n*R*T gives n*R = P*V/T. Occurrences of
+// target are found after simplification; a product or sum target also
+// matches inside a larger product or sum that contains all its factors or
+// terms. When symbols of target remain elsewhere, Isolate instead solves
+// target = t for one of them and substitutes, so that 2*x + 2*y = 4 gives
+// x + y = 2. The result must be linear in target or in its reciprocal.
+// conds are the conditions, as in SolveResult, under which the
+// coefficient of target is nonzero.
+func Isolate(eq *Equation, target Expr) (iso *Equation, conds []Cond, err error) {
+	target = target.Simplify()
+	syms := FreeSymbols(target)
+	if len(syms) == 0 {
+		return nil, nil, fmt.Errorf("cannot isolate %s: it has no symbols", target)
+	}
+	res := eq.Residual()
+	name := "t"
+	for k := 1; dependsOn(res, name) || dependsOn(target, name); k++ {
+		name = fmt.Sprintf("t_%d", k)
+	}
+	t := S(name)
+	leftover := func(e Expr) string {
+		for _, s := range syms {
+			if dependsOn(e, s) {
+				return s
+			}
+		}
+		return ""
+	}
+	r := replaceSubexpr(res, target, t).Simplify()
+	if s := leftover(r); s != "" {
+		if r = eliminateVia(res, target, t, syms); r == nil {
+			return nil, nil, fmt.Errorf("cannot isolate %s: %s also appears outside it", target, s)
+		}
+	}
+	if !dependsOn(r, name) {
+		return nil, nil, fmt.Errorf("cannot isolate %s: it does not occur in %s", target, eq)
+	}
+	cs := PolyCoeffs(r, name)
+	if cs == nil {
+		r = Expand(&Mul{factors: []Expr{r, t}})
+		cs = PolyCoeffs(r, name)
+	}
+	if cs == nil || Degree(r, name) != 1 {
+		return nil, nil, fmt.Errorf("cannot isolate %s: equation is not linear in it", target)
+	}
+	c0, ok := cs[0]
+	if !ok {
+		c0 = N(0)
+	}
+	sol := SolveLinear(cs[1], c0)
+	if sol.Error != "" {
+		return nil, nil, fmt.Errorf("cannot isolate %s: %s", target, sol.Error)
+	}
+	return Eq(target, sol.Solutions[0]), sol.Conditions, nil
+}
+
+// eliminateVia rewrites the residual res in terms of t = target by solving
+// target = t for a symbol of target in which it is linear. It returns nil
+// when no choice removes every symbol of target.
+func eliminateVia(res, target Expr, t *Sym, syms []string) Expr {
+	for _, s := range syms {
+		cs := PolyCoeffs(target, s)
+		if cs == nil || Degree(target, s) != 1 || dependsOn(cs[1], s) {
+			continue
+		}
+		c0 := cs[0]
+		if c0 == nil {
+			c0 = N(0)
+		}
+		r := Expand(res.Sub(s, div(sub(t, c0), cs[1])))
+		clean := true
+		for _, s := range syms {
+			clean = clean && !dependsOn(r, s)
+		}
+		if clean {
+			return r
+		}
+	}
+	return nil
+}
+
+// replaceSubexpr replaces each subexpression of e that prints like target
+// by t. A product target also replaces its factors within a larger
+// product, a sum target its terms within a larger sum, and a power target
+// b^k the power b^m, or b itself, when m/k is an integer. Inside an Integral whose
+// variable target involves, only the limits are searched.
+func replaceSubexpr(e, target, t Expr) Expr {
+	if e.String() == target.String() {
+		return t
+	}
+	all := func(es []Expr) []Expr {
+		out := make([]Expr, len(es))
+		for i, x := range es {
+			out[i] = replaceSubexpr(x, target, t)
+		}
+		return out
+	}
+	switch tt := target.(type) {
+	case *Mul:
+		if m, ok := e.(*Mul); ok {
+			if rest, ok := removeAll(m.factors, tt.factors); ok {
+				return &Mul{factors: append(all(rest), t)}
+			}
+		}
+	case *Add:
+		if a, ok := e.(*Add); ok {
+			if rest, ok := removeAll(a.terms, tt.terms); ok {
+				return &Add{terms: append(all(rest), t)}
+			}
+		}
+	case *Pow:
+		base, exp := e, Expr(N(1))
+		if p, ok := e.(*Pow); ok {
+			base, exp = p.base, p.exp
+		}
+		m, ok1 := exp.(*Num)
+		k, ok2 := tt.exp.(*Num)
+		if ok1 && ok2 && k.Sign() != 0 && base.String() == tt.base.String() {
+			if q := new(big.Rat).Quo(m.val, k.val); q.IsInt() {
+				return &Pow{base: t, exp: numRat(q)}
+			}
+		}
+	}
+	if b, ok := e.(binder); ok {
+		if v, body, rest := b.binding(); dependsOn(target, v) {
+			out := make([]Expr, len(rest))
+			for i, r := range rest {
+				out[i] = replaceSubexpr(r, target, t)
+			}
+			return b.rebind(v, body, out)
+		}
+	}
+	_, children := labeledChildren(e)
+	if len(children) == 0 {
+		return e
+	}
+	out := make([]Expr, len(children))
+	for i, c := range children {
+		out[i] = replaceSubexpr(c, target, t)
+	}
+	return withChildren(e, out)
+}
+
+// removeAll returns have without one occurrence of each element of want,
+// compared by printed form, or false when have lacks one of them.
+func removeAll(have, want []Expr) ([]Expr, bool) {
+	rest := append([]Expr(nil), have...)
+	for _, w := range want {
+		i := 0
+		for i < len(rest) && rest[i].String() != w.String() {
+			i++
+		}
+		if i == len(rest) {
+			return nil, false
+		}
+		rest = append(rest[:i], rest[i+1:]...)
+	}
+	return rest, true
+}
+
+// ============================================================
+// Formulas — physical formula database
+// ============================================================
+
+// Formula is a named physical law, such as Ohm's law V = I*R, whose
+// symbols carry SI units. In Eq every symbol is Annotated with its unit,
+// so CheckDimensions can verify the law and printing shows the plain
+// equation.
+type Formula struct {
+	Name        string // e.g. "ohms_law"
+	Category    string // e.g. "kinematics", "circuits", "thermodynamics"
+	Description string
+	Eq          *Equation
+	// Units maps each symbol to its SI unit, e.g. "m/s^2"; "1" marks a
+	// dimensionless quantity.
+	Units map[string]string
+	// Constants gives values, in the same units, for symbols that are
+	// physical constants, such as the gas constant R. SolveFormula uses
+	// them unless the caller supplies the symbol.
+	Constants map[string]Expr
+}
+
+// FormulaSolution is the value of a formula's unknown found by
+// SolveFormula.
+type FormulaSolution struct {
+	Unknown   string
+	Unit      string
+	Solutions []Expr // one value, or both roots of a quadratic
+	// Conditions are the assumptions under which the solutions hold, as in
+	// SolveResult.
+	Conditions []Cond
+}
+
+var (
+	formulaMu       sync.RWMutex
+	formulaRegistry = map[string]*Formula{}
+)
+
+// dim is a physical dimension: the exponents of the SI base units m, kg,
+// s, A, K, mol and cd.
+type dim [7]int
+
+var baseUnitNames = [...]string{"m", "kg", "s", "A", "K", "mol", "cd"}
+
+// unitDims holds the SI base and derived units accepted in unit strings.
+var unitDims = map[string]dim{
+	"m": {1}, "kg": {0, 1}, "s": {0, 0, 1}, "A": {0, 0, 0, 1}, "K": {0, 0, 0, 0, 1}, "mol": {0, 0, 0, 0, 0, 1}, "cd": {0, 0, 0, 0, 0, 0, 1},
+	"Hz": {0, 0, -1}, "N": {1, 1, -2}, "Pa": {-1, 1, -2}, "J": {2, 1, -2}, "W": {2, 1, -3},
+	"C": {0, 0, 1, 1}, "V": {2, 1, -3, -1}, "ohm": {2, 1, -3, -2}, "F": {-2, -1, 4, 2}, "H": {2, 1, -2, -2},
+}
+
+func (d dim) String() string {
+	var parts []string
+	for i, k := range d {
+		switch {
+		case k == 1:
+			parts = append(parts, baseUnitNames[i])
+		case k != 0:
+			parts = append(parts, fmt.Sprintf("%s^%d", baseUnitNames[i], k))
+		}
+	}
+	if len(parts) == 0 {
+		return "1"
+	}
+	return strings.Join(parts, "*")
+}
+
+// scaled returns d raised to the power r, failing when an exponent would
+// not be an integer.
+func (d dim) scaled(r *big.Rat) (dim, bool) {
+	var out dim
+	for i, k := range d {
+		v := new(big.Rat).Mul(r, big.NewRat(int64(k), 1))
+		if !v.IsInt() {
+			return dim{}, false
+		}
+		out[i] = int(v.Num().Int64())
+	}
+	return out, true
+}
+
+func (d dim) plus(o dim) dim {
+	for i := range d {
+		d[i] += o[i]
+	}
+	return d
+}
+
+// unitDim returns the dimension of a unit string such as "kg*m/s^2" or
+// "J/(mol*K)", written with the names in unitDims.
+func unitDim(unit string) (dim, error) {
+	e, err := Parse(unit)
+	if err != nil {
+		return dim{}, fmt.Errorf("unit %q: %v", unit, err)
+	}
+	var walk func(Expr) (dim, error)
+	walk = func(e Expr) (dim, error) {
+		switch t := e.(type) {
+		case *Num:
+			return dim{}, nil
+		case *Sym:
+			if d, ok := unitDims[t.name]; ok {
+				return d, nil
+			}
+			return dim{}, fmt.Errorf("unit %q: unknown unit %s", unit, t.name)
+		case *Mul:
+			var d dim
+			for _, f := range t.factors {
+				fd, err := walk(f)
+				if err != nil {
+					return dim{}, err
+				}
+				d = d.plus(fd)
+			}
+			return d, nil
+		case *Pow:
+			n, ok := t.exp.(*Num)
+			if !ok {
+				break
+			}
+			bd, err := walk(t.base)
+			if err != nil {
+				return dim{}, err
+			}
+			if d, ok := bd.scaled(n.val); ok {
+				return d, nil
+			}
+		}
+		return dim{}, fmt.Errorf("unit %q: unsupported form %s", unit, e)
+	}
+	return walk(e)
+}
+
+// CheckDimensions verifies that both sides of eq have the same physical
+// dimension, taking the unit of each symbol from its Annotated Meta.Unit.
+// Terms of a sum must agree, exponents and function arguments must be
+// dimensionless except that abs keeps the dimension of its argument, and
+// fractional powers must give integer exponents, as in sqrt(m^2).
+func CheckDimensions(eq *Equation) error {
+	l, err := dimOf(eq.LHS)
+	if err != nil {
+		return err
+	}
+	r, err := dimOf(eq.RHS)
+	if err != nil {
+		return err
+	}
+	if l != r {
+		return fmt.Errorf("dimension mismatch: %s has dimension %s, %s has %s", eq.LHS, l, eq.RHS, r)
+	}
+	return nil
+}
+
+func dimOf(e Expr) (dim, error) {
+	switch t := e.(type) {
+	case *Num, *Const:
+		return dim{}, nil
+	case *Annotated:
+		if t.meta.Unit != "" {
+			return unitDim(t.meta.Unit)
+		}
+		return dimOf(t.expr)
+	case *Sym:
+		return dim{}, fmt.Errorf("symbol %s has no unit", t.name)
+	case *Add:
+		var d dim
+		for i, term := range t.terms {
+			td, err := dimOf(term)
+			if err != nil {
+				return dim{}, err
+			}
+			if i > 0 && td != d {
+				return dim{}, fmt.Errorf("dimension mismatch: cannot add %s (%s) to %s (%s)", term, td, t.terms[0], d)
+			}
+			d = td
+		}
+		return d, nil
+	case *Mul:
+		var d dim
+		for _, f := range t.factors {
+			fd, err := dimOf(f)
+			if err != nil {
+				return dim{}, err
+			}
+			d = d.plus(fd)
+		}
+		return d, nil
+	case *Pow:
+		bd, err := dimOf(t.base)
+		if err != nil {
+			return dim{}, err
+		}
+		if ed, err := dimOf(t.exp); err != nil {
+			return dim{}, err
+		} else if ed != (dim{}) {
+			return dim{}, fmt.Errorf("dimension mismatch: exponent %s has dimension %s", t.exp, ed)
+		}
+		if bd == (dim{}) {
+			return bd, nil
+		}
+		if n, ok := t.exp.(*Num); ok {
+			if d, ok := bd.scaled(n.val); ok {
+				return d, nil
+			}
+		}
+		return dim{}, fmt.Errorf("dimension mismatch: %s raised to %s", bd, t.exp)
+	case *Func:
+		var ad dim
+		for i, a := range t.args {
+			d, err := dimOf(a)
+			if err != nil {
+				return dim{}, err
+			}
+			if i > 0 && d != ad {
+				return dim{}, fmt.Errorf("dimension mismatch: arguments of %s have dimensions %s and %s", t.name, ad, d)
+			}
+			ad = d
+		}
+		switch t.name {
+		case "abs", "max", "min":
+			return ad, nil
+		case "atan2":
+			return dim{}, nil
+		}
+		if ad != (dim{}) {
+			return dim{}, fmt.Errorf("dimension mismatch: argument of %s has dimension %s", t.name, ad)
+		}
+		return ad, nil
+	}
+	return dim{}, fmt.Errorf("cannot determine the dimension of %s", e)
+}
+
+// RegisterFormula adds f to the formula database used by LookupFormula,
+// SolveFormula and the formula MCP tools. The name must be a new
+// identifier, every unit must parse, and the equation must pass
+// CheckDimensions. Eq may be given with plain symbols; the stored copy has
+// each symbol annotated with its unit.
+func RegisterFormula(f Formula) error {
+	if !isIdentifier(f.Name) {
+		return fmt.Errorf("invalid formula name %q", f.Name)
+	}
+	if f.Eq == nil {
+		return fmt.Errorf("formula %q: Eq is required", f.Name)
+	}
+	lhs, rhs := StripMeta(f.Eq.LHS).Simplify(), StripMeta(f.Eq.RHS).Simplify()
+	for _, s := range FreeSymbols(sub(lhs, rhs)) {
+		u, ok := f.Units[s]
+		if !ok {
+			return fmt.Errorf("formula %q: symbol %s has no unit", f.Name, s)
+		}
+		q := Annotate(S(s), Meta{Unit: u})
+		lhs, rhs = lhs.Sub(s, q), rhs.Sub(s, q)
+	}
+	eq := Eq(lhs, rhs)
+	if err := CheckDimensions(eq); err != nil {
+		return fmt.Errorf("formula %q: %v", f.Name, err)
+	}
+	for s := range f.Constants {
+		if _, ok := f.Units[s]; !ok {
+			return fmt.Errorf("formula %q: constant %s is not a symbol of the formula", f.Name, s)
+		}
+	}
+	g := f
+	g.Eq = eq
+	g.Units = copyMap(f.Units)
+	g.Constants = copyMap(f.Constants)
+	formulaMu.Lock()
+	defer formulaMu.Unlock()
+	if _, ok := formulaRegistry[f.Name]; ok {
+		return fmt.Errorf("formula %q already registered", f.Name)
+	}
+	formulaRegistry[f.Name] = &g
+	return nil
+}
+
+func copyMap[V any](m map[string]V) map[string]V {
+	out := make(map[string]V, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// LookupFormula returns the registered formula name.
+func LookupFormula(name string) (Formula, bool) {
+	formulaMu.RLock()
+	defer formulaMu.RUnlock()
+	f, ok := formulaRegistry[name]
+	if !ok {
+		return Formula{}, false
+	}
+	g := *f
+	g.Units, g.Constants = copyMap(f.Units), copyMap(f.Constants)
+	return g, true
+}
+
+// RegisteredFormulas returns the names of the registered formulas in
+// category, or of all formulas when category is empty, sorted.
+func RegisteredFormulas(category string) []string {
+	formulaMu.RLock()
+	defer formulaMu.RUnlock()
+	var out []string
+	for name, f := range formulaRegistry {
+		if category == "" || f.Category == category {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SolveFormula solves the registered formula name for its one symbol not
+// given in knowns, after substituting knowns and the formula's constants.
+// Known values are taken to be in the symbol's SI unit; a value Annotated
+// with a Unit must have the same dimension. Equations linear in the
+// unknown or its reciprocal are rearranged with Isolate, and quadratic
+// ones give both roots.
+func SolveFormula(name string, knowns map[string]Expr) (FormulaSolution, error) {
+	f, ok := LookupFormula(name)
+	if !ok {
+		return FormulaSolution{}, fmt.Errorf("unknown formula %q", name)
+	}
+	lhs, rhs := StripMeta(f.Eq.LHS), StripMeta(f.Eq.RHS)
+	for _, s := range sortedNames(knowns) {
+		u, ok := f.Units[s]
+		if !ok {
+			return FormulaSolution{}, fmt.Errorf("formula %q has no symbol %s", name, s)
+		}
+		v := knowns[s]
+		if m, ok := MetaOf(v); ok && m.Unit != "" {
+			got, err := unitDim(m.Unit)
+			if err != nil {
+				return FormulaSolution{}, err
+			}
+			if want, _ := unitDim(u); got != want {
+				return FormulaSolution{}, fmt.Errorf("known %s: unit %s has dimension %s, want %s (%s)", s, m.Unit, got, u, want)
+			}
+		}
+		v = StripMeta(v)
+		lhs, rhs = lhs.Sub(s, v), rhs.Sub(s, v)
+	}
+	for s, v := range f.Constants {
+		if _, ok := knowns[s]; !ok {
+			lhs, rhs = lhs.Sub(s, v), rhs.Sub(s, v)
+		}
+	}
+	eq := Eq(lhs, rhs)
+	var unknowns []string
+	for _, s := range sortedNames(f.Units) {
+		if dependsOn(sub(lhs, rhs), s) {
+			unknowns = append(unknowns, s)
+		}
+	}
+	if len(unknowns) != 1 {
+		return FormulaSolution{}, fmt.Errorf("formula %q: need exactly one unknown, have %d (%s)", name, len(unknowns), strings.Join(unknowns, ", "))
+	}
+	x := unknowns[0]
+	out := FormulaSolution{Unknown: x, Unit: f.Units[x]}
+	if iso, conds, err := Isolate(eq, S(x)); err == nil {
+		out.Solutions, out.Conditions = []Expr{iso.RHS}, conds
+		return out, nil
+	}
+	_, r := SolveSteps(eq, x)
+	if r.Error != "" {
+		return FormulaSolution{}, fmt.Errorf("formula %q: cannot solve for %s: %s", name, x, r.Error)
+	}
+	out.Solutions, out.Conditions = r.Solutions, r.Conditions
+	return out, nil
+}
+
+func init() {
+	parse := func(s string) Expr {
+		e, err := Parse(s)
+		if err != nil {
+			panic(err)
+		}
+		return e
+	}
+	gravity, gas := parse("9.80665"), parse("8.314462618")
+	for _, f := range []struct {
+		name, category, description, eq string
+		units                           map[string]string
+		constants                       map[string]Expr
+	}{
+		{"velocity", "kinematics", "Velocity under constant acceleration", "v = u + a*t",
+			map[string]string{"v": "m/s", "u": "m/s", "a": "m/s^2", "t": "s"}, nil},
+		{"displacement", "kinematics", "Displacement under constant acceleration", "s = u*t + 1/2*a*t^2",
+			map[string]string{"s": "m", "u": "m/s", "a": "m/s^2", "t": "s"}, nil},
+		{"velocity_displacement", "kinematics", "Velocity after a displacement under constant acceleration", "v^2 = u^2 + 2*a*s",
+			map[string]string{"v": "m/s", "u": "m/s", "a": "m/s^2", "s": "m"}, nil},
+		{"newtons_second_law", "kinematics", "Force on a mass", "F = m*a",
+			map[string]string{"F": "N", "m": "kg", "a": "m/s^2"}, nil},
+		{"kinetic_energy", "kinematics", "Kinetic energy of a moving mass", "E_k = 1/2*m*v^2",
+			map[string]string{"E_k": "J", "m": "kg", "v": "m/s"}, nil},
+		{"potential_energy", "kinematics", "Gravitational potential energy near the Earth's surface", "E_p = m*g*h",
+			map[string]string{"E_p": "J", "m": "kg", "g": "m/s^2", "h": "m"}, map[string]Expr{"g": gravity}},
+		{"ohms_law", "circuits", "Voltage across a resistor", "V = I*R",
+			map[string]string{"V": "V", "I": "A", "R": "ohm"}, nil},
+		{"electric_power", "circuits", "Power dissipated by a current", "P = V*I",
+			map[string]string{"P": "W", "V": "V", "I": "A"}, nil},
+		{"capacitor_charge", "circuits", "Charge stored on a capacitor", "Q = C*V",
+			map[string]string{"Q": "C", "C": "F", "V": "V"}, nil},
+		{"series_resistance", "circuits", "Two resistors in series", "R = R_1 + R_2",
+			map[string]string{"R": "ohm", "R_1": "ohm", "R_2": "ohm"}, nil},
+		{"parallel_resistance", "circuits", "Two resistors in parallel", "1/R = 1/R_1 + 1/R_2",
+			map[string]string{"R": "ohm", "R_1": "ohm", "R_2": "ohm"}, nil},
+		{"ideal_gas", "thermodynamics", "Ideal gas law", "P*V = n*R*T",
+			map[string]string{"P": "Pa", "V": "m^3", "n": "mol", "R": "J/(mol*K)", "T": "K"}, map[string]Expr{"R": gas}},
+		{"sensible_heat", "thermodynamics", "Heat to change the temperature of a mass", "Q = m*c*dT",
+			map[string]string{"Q": "J", "m": "kg", "c": "J/(kg*K)", "dT": "K"}, nil},
+		{"first_law", "thermodynamics", "First law of thermodynamics", "dU = Q - W",
+			map[string]string{"dU": "J", "Q": "J", "W": "J"}, nil},
+		{"carnot_efficiency", "thermodynamics", "Efficiency of a Carnot engine", "eta = 1 - T_c/T_h",
+			map[string]string{"eta": "1", "T_c": "K", "T_h": "K"}, nil},
+	} {
+		parts := strings.SplitN(f.eq, " = ", 2)
+		eq := Eq(parse(parts[0]), parse(parts[1]))
+		if err := RegisterFormula(Formula{Name: f.name, Category: f.category, Description: f.description, Eq: eq, Units: f.units, Constants: f.constants}); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// ============================================================
+// Worked steps
+// ============================================================
+
+// Step is one rule application in a worked derivation: the rule named by
+// Rule turned Before into After. LaTeX renders the step as an equation.
+type Step struct {
+	Rule   string
+	Before Expr
+	After  Expr
+	LaTeX  string
+}
+
+// String returns "rule: before -> after".
+func (s Step) String() string { return fmt.Sprintf("%s: %s -> %s", s.Rule, s.Before, s.After) }
+
+// DiffSteps differentiates e with respect to varName and returns the rule
+// applied at each subexpression, innermost first; the final step's After is
+// Diff(e, varName). Rules are "constant", "identity", "sum", "constant
+// multiple", "product", "quotient", "power", "exponential", "logarithmic"
+// and "chain"; a function applied directly to the variable is reported
+// under its own name, e.g. "sin", and an undefined one as "function".
+func DiffSteps(e Expr, varName string) []Step {
+	var steps []Step
+	diffSteps(e.Simplify(), varName, &steps)
+	return steps
+}
+
+func diffSteps(e Expr, v string, steps *[]Step) {
+	recurse := func(children ...Expr) {
+		for _, c := range children {
+			if dependsOn(c, v) {
+				diffSteps(c, v, steps)
+			}
+		}
+	}
+	var rule string
+	switch t := e.(type) {
+	case *Sym:
+		rule = "constant"
+		if t.name == v {
+			rule = "identity"
+		}
+	case *Add:
+		rule = "sum"
+		recurse(t.terms...)
+	case *Mul:
+		var dep []Expr
+		for _, f := range t.factors {
+			if dependsOn(f, v) {
+				dep = append(dep, f)
+			}
+		}
+		switch {
+		case len(dep) == 0:
+			rule = "constant"
+		case len(dep) == 1:
+			rule = "constant multiple"
+			recurse(dep...)
+		case len(dep) == 2 && isReciprocal(dep[0]) != isReciprocal(dep[1]):
+			rule = "quotient"
+			num, den := dep[0], dep[1]
+			if isReciprocal(num) {
+				num, den = den, num
+			}
+			recurse(num, den.(*Pow).base)
+		default:
+			rule = "product"
+			recurse(dep...)
+		}
+	case *Pow:
+		baseDep, expDep := dependsOn(t.base, v), dependsOn(t.exp, v)
+		switch {
+		case !baseDep && !expDep:
+			rule = "constant"
+		case !expDep:
+			rule = "power"
+		case !baseDep:
+			rule = "exponential"
+		default:
+			rule = "logarithmic"
+		}
+		if (baseDep && !isSym(t.base, v)) || (expDep && !isSym(t.exp, v)) {
+			rule = "chain (" + rule + ")"
+			recurse(t.base, t.exp)
+		}
+	case *Func:
+		rule = "constant"
+		if dependsOn(t, v) {
+			rule = t.name
+			if len(t.args) > 1 || !isSym(t.args[0], v) {
+				rule = "chain (" + t.name + ")"
+				recurse(t.args...)
+			}
+		}
+	case *UndefFunc:
+		rule = "constant"
+		if dependsOn(t.arg, v) {
+			rule = "function"
+			if !isSym(t.arg, v) {
+				rule = "chain (function)"
+				recurse(t.arg)
+			}
+		}
+	default:
+		rule = "constant"
+	}
+	after := e.Diff(v).Simplify()
+	tex := fmt.Sprintf(`\frac{d}{d%s}\left[%s\right] = %s`, S(v).LaTeX(), e.LaTeX(), after.LaTeX())
+	*steps = append(*steps, Step{Rule: rule, Before: e, After: after, LaTeX: tex})
+}
+
+// IntegrateSteps integrates e like Integrate and returns the rule applied
+// at each subexpression, innermost first; the final step's After is the
+// antiderivative. Rules are "constant", "power", "reciprocal",
+// "exponential", "sum", "constant multiple", "derivative" for f'(x) and
+// the name of the integrated function (e.g. "sin"), with "linear substitution (rule)" when the rule is
+// applied to a*x + b rather than x itself. If the antiderivative was found
+// only after expansion, the first step is "expand". It reports false when
+// Integrate would.
+func IntegrateSteps(e Expr, varName string) ([]Step, bool) {
+	_, steps, ok := integrateTraced(e, varName, true)
+	return steps, ok
+}
+
+// SimplifySteps simplifies e bottom-up and records each subexpression
+// rewrite, naming the rule that fired (e.g. "combine like terms",
+// "multiply constants", "power of a power", "pythagorean identity"). Each
+// step's Before already has simplified children, and the final step's After
+// equals e.Simplify(). An already simplified expression yields no steps.
+func SimplifySteps(e Expr) []Step {
+	var steps []Step
+	simplifySteps(e, &steps)
+	return steps
+}
+
+func simplifySteps(e Expr, steps *[]Step) Expr {
+	each := func(es []Expr) []Expr {
+		out := make([]Expr, len(es))
+		for i, c := range es {
+			out[i] = simplifySteps(c, steps)
+		}
+		return out
+	}
+	switch t := e.(type) {
+	case *Add:
+		e = &Add{terms: each(t.terms)}
+	case *Mul:
+		e = &Mul{factors: each(t.factors)}
+	case *Pow:
+		e = &Pow{base: simplifySteps(t.base, steps), exp: simplifySteps(t.exp, steps)}
+	case *Func:
+		e = &Func{name: t.name, args: each(t.args)}
+	}
+	after := e.Simplify()
+	if after.String() != e.String() {
+		*steps = append(*steps, Step{Rule: simplifyRule(e), Before: e, After: after, LaTeX: e.LaTeX() + " = " + after.LaTeX()})
+	}
+	return after
+}
+
+// simplifyRule names the main rewrite Simplify applies to e, whose
+// children are already simplified.
+func simplifyRule(e Expr) string {
+	countNums := func(es []Expr) (n int, zero, one bool) {
+		for _, x := range es {
+			if num, ok := x.(*Num); ok {
+				n++
+				zero = zero || num.IsZero()
+				one = one || num.IsOne()
+			}
+		}
+		return
+	}
+	switch t := e.(type) {
+	case *Add:
+		seen := map[string]bool{}
+		like := false
+		for _, term := range t.terms {
+			if _, ok := term.(*Add); ok {
+				return "flatten sum"
+			}
+			if _, ok := term.(*Num); ok {
+				continue
+			}
+			_, rest := splitCoeff(term)
+			k := rest.String()
+			like = like || seen[k]
+			seen[k] = true
+		}
+		for k := range seen {
+			if strings.HasPrefix(k, "sin(") && strings.HasSuffix(k, ")^2") && seen["cos"+k[3:]] {
+				return "pythagorean identity"
+			}
+		}
+		n, zero, _ := countNums(t.terms)
+		switch {
+		case like:
+			return "combine like terms"
+		case n > 1 || zero:
+			return "add constants"
+		}
+		return "reorder terms"
+	case *Mul:
+		seen := map[string]bool{}
+		collect := false
+		for _, f := range t.factors {
+			if _, ok := f.(*Mul); ok {
+				return "flatten product"
+			}
+			if _, ok := f.(*Num); ok {
+				continue
+			}
+			b, _ := asPow(f)
+			collect = collect || seen[b.String()]
+			seen[b.String()] = true
+		}
+		n, zero, one := countNums(t.factors)
+		switch {
+		case zero:
+			return "zero product"
+		case collect:
+			return "collect powers"
+		case n > 1:
+			return "multiply constants"
+		case one:
+			return "drop unit factor"
+		}
+		return "reorder factors"
+	case *Pow:
+		bn, baseNum := t.base.(*Num)
+		en, expNum := t.exp.(*Num)
+		switch {
+		case expNum && en.IsZero():
+			return "zero exponent"
+		case expNum && en.IsOne():
+			return "unit exponent"
+		case baseNum && bn.IsOne():
+			return "power of one"
+		case baseNum && bn.IsZero():
+			return "power of zero"
+		case baseNum && expNum:
+			return "evaluate power"
+		}
+		switch t.base.(type) {
+		case *Pow:
+			return "power of a power"
+		case *Mul:
+			return "distribute exponent"
+		}
+		return "simplify power"
+	case *Func:
+		return "evaluate " + t.name
+	}
+	return "simplify"
+}
+
+// SolveStep is one algebraic manipulation in a worked solution.
+type SolveStep struct {
+	Rule  string
+	Text  string
+	LaTeX string
+}
+
+// String returns "rule: text".
+func (s SolveStep) String() string { return s.Rule + ": " + s.Text }
+
+// SolveSteps solves eq for varName when it is a linear or quadratic
+// polynomial equation, returning the manipulations ("move terms",
+// "subtract constant", "divide by coefficient", "identify coefficients",
+// "discriminant", "quadratic formula", "solution"), whose last step states
+// the solutions when there are any, along with the result
+// SolveLinear or SolveQuadratic would give. Other equations produce a
+// result with Error set.
+func SolveSteps(eq *Equation, varName string) ([]SolveStep, SolveResult) {
+	var steps []SolveStep
+	addEq := func(rule string, lhs, rhs Expr) {
+		e := Eq(lhs, rhs)
+		steps = append(steps, SolveStep{Rule: rule, Text: e.String(), LaTeX: e.LaTeX()})
+	}
+	x := S(varName)
+	res := eq.Residual()
+	if !isNumValue(eq.RHS.Simplify(), 0) || eq.LHS.String() != res.String() {
+		addEq("move terms", res, N(0))
+	}
+	coeffs := PolyCoeffs(res, varName)
+	deg := Degree(res, varName)
+	coeff := func(k int) Expr {
+		if c, ok := coeffs[k]; ok {
+			return c
+		}
+		return N(0)
+	}
+	switch deg {
+	case 0:
+		if isNumValue(res, 0) {
+			return steps, SolveResult{Error: "no unique solution: equation holds for every value"}
+		}
+		return steps, SolveResult{Error: "no solution: equation is a contradiction"}
+	case 1:
+		a, b := coeff(1), coeff(0)
+		ax := (&Mul{factors: []Expr{a, x}}).Simplify()
+		if !isNumValue(b, 0) {
+			addEq("subtract constant", ax, neg(b).Simplify())
+		}
+		r := SolveLinear(a, b)
+		switch {
+		case !isNumValue(a, 1):
+			addEq("divide by coefficient", x, r.Solutions[0])
+		case isNumValue(b, 0):
+			addEq("solution", x, r.Solutions[0])
+		}
+		return steps, r
+	case 2:
+		a, b, c := coeff(2), coeff(1), coeff(0)
+		steps = append(steps, SolveStep{
+			Rule:  "identify coefficients",
+			Text:  fmt.Sprintf("a = %s, b = %s, c = %s", a, b, c),
+			LaTeX: fmt.Sprintf("a = %s,\\ b = %s,\\ c = %s", a.LaTeX(), b.LaTeX(), c.LaTeX()),
+		})
+		disc := sub(&Pow{base: b, exp: N(2)}, &Mul{factors: []Expr{N(4), a, c}}).Simplify()
+		steps = append(steps, SolveStep{
+			Rule:  "discriminant",
+			Text:  "b^2 - 4*a*c = " + disc.String(),
+			LaTeX: `\Delta = b^{2} - 4ac = ` + disc.LaTeX(),
+		})
+		r := SolveQuadratic(a, b, c)
+		if r.Error != "" {
+			return steps, r
+		}
+		mb, root, twoA := neg(b).Simplify(), SqrtOf(disc).Simplify(), (&Mul{factors: []Expr{N(2), a}}).Simplify()
+		steps = append(steps, SolveStep{
+			Rule:  "quadratic formula",
+			Text:  fmt.Sprintf("%s = (%s ± %s)/%s", varName, mb, root, twoA),
+			LaTeX: fmt.Sprintf(`%s = \frac{%s \pm %s}{%s}`, x.LaTeX(), mb.LaTeX(), root.LaTeX(), twoA.LaTeX()),
+		})
+		text := make([]string, len(r.Solutions))
+		tex := make([]string, len(r.Solutions))
+		for i, s := range r.Solutions {
+			text[i] = Eq(x, s).String()
+			tex[i] = Eq(x, s).LaTeX()
+		}
+		steps = append(steps, SolveStep{Rule: "solution", Text: strings.Join(text, " or "), LaTeX: strings.Join(tex, `\ \text{or}\ `)})
+		return steps, r
+	}
+	return steps, SolveResult{Error: fmt.Sprintf("unsupported equation: %s is not a linear or quadratic polynomial in %s", res, varName)}
+}
+
+// isReciprocal reports whether e is u^-1.
+func isReciprocal(e Expr) bool {
+	p, ok := e.(*Pow)
+	if !ok {
+		return false
+	}
+	n, ok := p.exp.(*Num)
+	return ok && n.val.Cmp(big.NewRat(-1, 1)) == 0
+}
+
+func isSym(e Expr, name string) bool {
+	s, ok := e.(*Sym)
+	return ok && s.name == name
+}
+
+// ============================================================
+// Structural diff
+// ============================================================
+
+// TreeDiff is one point where two expression trees diverge. Path locates
+// the differing subtrees using the field names of the JSON encoding, e.g.
+// "terms[1].exp"; it is empty when the roots themselves differ.
+type TreeDiff struct {
+	Path  string
+	Left  Expr
+	Right Expr
+}
+
+// String returns "path: left | right", with "nil" for a missing tree.
+func (d TreeDiff) String() string {
+	path := d.Path
+	if path == "" {
+		path = "(root)"
+	}
+	side := func(e Expr) string {
+		if e == nil {
+			return "nil"
+		}
+		return e.String()
+	}
+	return fmt.Sprintf("%s: %s | %s", path, side(d.Left), side(d.Right))
+}
+
+// DiffTrees compares a and b node by node and returns the outermost
+// subtrees that differ, in depth-first order. Nodes of the same kind with
+// the same number of children are compared child by child; anything else
+// (different node kinds, function names, numbers, symbols or arity) is
+// reported as a single difference. The comparison is purely structural:
+// simplify both sides first to ignore differences in canonical form. A
+// nil tree matches only another nil tree.
+func DiffTrees(a, b Expr) []TreeDiff {
+	var out []TreeDiff
+	diffTrees("", a, b, &out)
+	return out
+}
+
+func diffTrees(path string, a, b Expr, out *[]TreeDiff) {
+	if a == nil || b == nil {
+		if a != nil || b != nil {
+			*out = append(*out, TreeDiff{Path: path, Left: a, Right: b})
+		}
+		return
+	}
+	labels, ca := labeledChildren(a)
+	_, cb := labeledChildren(b)
+	same := a.exprType() == b.exprType() && len(ca) == len(cb)
+	if same && len(ca) == 0 {
+		same = a.String() == b.String()
+	}
+	if fa, ok := a.(*Func); ok && same {
+		same = fa.name == b.(*Func).name
+	}
+	if !same {
+		*out = append(*out, TreeDiff{Path: path, Left: a, Right: b})
+		return
+	}
+	for i := range ca {
+		p := labels[i]
+		if path != "" {
+			p = path + "." + p
+		}
+		diffTrees(p, ca[i], cb[i], out)
+	}
+}
+
+// StructEqual reports whether a and b are the same tree: the same node
+// kinds, names, numbers and operators, with children in the same order.
+// Unlike Equal it does not simplify, so x + y and y + x differ; it is
+// cheap enough to use when memoizing. Annotations are ignored, as in
+// Equal. Bound variables are compared by the binder that binds them, as
+// de Bruijn indices, so sum(k, k, 1, n) and sum(j, j, 1, n) are the same
+// tree.
+func StructEqual(a, b Expr) bool { return structEqual(a, b, nil, nil) }
+
+// structEqual is StructEqual within binders of the variables va in a and
+// vb in b, innermost last.
+func structEqual(a, b Expr, va, vb []string) bool {
+	a, b = bare(a), bare(b)
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if a == b && len(va) == 0 && len(vb) == 0 {
+		return true
+	}
+	if sa, ok := a.(*Sym); ok {
+		sb, ok := b.(*Sym)
+		if !ok {
+			return false
+		}
+		i, j := boundIndex(va, sa.name), boundIndex(vb, sb.name)
+		if i >= 0 || j >= 0 {
+			return i == j
+		}
+		return sa.name == sb.name
+	}
+	if ba, ok := a.(binder); ok {
+		bb, ok := b.(binder)
+		if !ok || a.exprType() != b.exprType() {
+			return false
+		}
+		ka, bodyA, restA := ba.binding()
+		kb, bodyB, restB := bb.binding()
+		if len(restA) != len(restB) {
+			return false
+		}
+		for i := range restA {
+			if !structEqual(restA[i], restB[i], va, vb) {
+				return false
+			}
+		}
+		return structEqual(bodyA, bodyB, append(va[:len(va):len(va)], ka), append(vb[:len(vb):len(vb)], kb))
+	}
+	if nodeKey(a) != nodeKey(b) {
+		return false
+	}
+	_, ca := labeledChildren(a)
+	_, cb := labeledChildren(b)
+	if len(ca) != len(cb) {
+		return false
+	}
+	for i := range ca {
+		if !structEqual(ca[i], cb[i], va, vb) {
+			return false
+		}
+	}
+	return true
+}
+
+// boundIndex returns the de Bruijn index of name among the bound
+// variables vs, innermost last: 0 for the innermost binder of name, and -1
+// when name is free.
+func boundIndex(vs []string, name string) int {
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i] == name {
+			return len(vs) - 1 - i
+		}
+	}
+	return -1
+}
+
+// Hash returns a structural hash of e, consistent with StructEqual: equal
+// trees hash alike. The value is stable across runs and builds, so it can
+// key persistent caches, but it does not identify expressions that are
+// only equal after simplification. Like StructEqual it does not depend on
+// the names of bound variables.
+func Hash(e Expr) uint64 {
+	h := fnv.New64a()
+	var walk func(Expr, []string)
+	walk = func(e Expr, vs []string) {
+		e = bare(e)
+		if e == nil {
+			h.Write([]byte{0})
+			return
+		}
+		if s, ok := e.(*Sym); ok {
+			if i := boundIndex(vs, s.name); i >= 0 {
+				fmt.Fprintf(h, "bound:%d/0()", i)
+				return
+			}
+		}
+		if b, ok := e.(binder); ok {
+			v, body, rest := b.binding()
+			fmt.Fprintf(h, "%s/%d(", e.exprType(), len(rest)+1)
+			for _, c := range rest {
+				walk(c, vs)
+			}
+			walk(body, append(vs[:len(vs):len(vs)], v))
+			h.Write([]byte{')'})
+			return
+		}
+		_, cs := labeledChildren(e)
+		fmt.Fprintf(h, "%s/%d(", nodeKey(e), len(cs))
+		for _, c := range cs {
+			walk(c, vs)
+		}
+		h.Write([]byte{')'})
+	}
+	walk(e, nil)
+	return h.Sum64()
+}
+
+// EquivN reports whether a and b are probably equal as functions of
+// their free symbols: it evaluates both at trials pseudo-random points in
+// [-3, 3] and compares within a relative tolerance of 1e-9. Points where
+// either side is undefined or not real, such as ln(x) for x < 0, are
+// skipped, and at least one point must remain. It catches equivalences
+// that Equal misses, like x*(x + 1) and x^2 + x, but a true result is
+// evidence, not proof. The points are the same on every call; trials < 1
+// means 20.
+func EquivN(a, b Expr, trials int) bool {
+	if StructEqual(a, b) {
+		return true
+	}
+	if trials < 1 {
+		trials = 20
+	}
+	set := map[string]bool{}
+	for _, e := range []Expr{a, b} {
+		for _, s := range FreeSymbols(e) {
+			set[s] = true
+		}
+	}
+	syms := sortedNames(set)
+	rng := rand.New(rand.NewSource(1))
+	env := make(map[string]float64, len(syms))
+	checked := 0
+	for k := 0; k < trials; k++ {
+		for _, s := range syms {
+			env[s] = rng.Float64()*6 - 3
+		}
+		u, ok1 := evalFloat(a, env)
+		v, ok2 := evalFloat(b, env)
+		if !ok1 || !ok2 || math.IsNaN(u) || math.IsNaN(v) || math.IsInf(u, 0) || math.IsInf(v, 0) {
+			continue
+		}
+		if math.Abs(u-v) > 1e-9*math.Max(1, math.Max(math.Abs(u), math.Abs(v))) {
+			return false
+		}
+		checked++
+	}
+	return checked > 0
+}
+
+// fingerprintPoints is the number of points at which Fingerprint probes
+// an expression.
+const fingerprintPoints = 8
+
+// Fingerprint returns an identifier for the function e computes, so that
+// problems phrased differently, such as (x + 1)^2 and x^2 + 2*x + 1, or
+// sin(x)^2 + cos(x)^2 and 1, get the same value. It simplifies e and
+// probes it at fingerprintPoints rational points, each symbol taking
+// values in [-3, 3] derived from its name, and hashes the values rounded
+// to 10 significant digits. Values are computed exactly where
+// substitution gives a rational, and in float64 otherwise; undefined
+// values count as NaN. Like EquivN it is evidence, not proof: different
+// functions collide only if they agree at every probe, and equal ones
+// differ only if float64 rounding straddles the tenth digit. The value is
+// stable across runs and builds.
+func Fingerprint(e Expr) uint64 {
+	e = e.Simplify()
+	syms := FreeSymbols(e)
+	h := fnv.New64a()
+	for i := 0; i < fingerprintPoints; i++ {
+		x := e
+		env := make(map[string]float64, len(syms))
+		for _, s := range syms {
+			r := fingerprintPoint(s, i)
+			x = x.Sub(s, numRat(r))
+			env[s], _ = r.Float64()
+		}
+		v := math.NaN()
+		if n, ok := x.Simplify().(*Num); ok {
+			v, _ = n.val.Float64()
+		} else if f, ok := evalFloat(e, env); ok {
+			v = f
+		}
+		if v == 0 {
+			v = 0 // fold -0
+		}
+		fmt.Fprintf(h, "%s;", strconv.FormatFloat(v, 'g', 10, 64))
+	}
+	return h.Sum64()
+}
+
+// fingerprintPoint returns the value of the symbol name at probe i.
+func fingerprintPoint(name string, i int) *big.Rat {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", name, i)
+	dens := [fingerprintPoints]int64{97, 89, 83, 79, 73, 71, 67, 61}
+	num := int64(h.Sum64()%601) - 300
+	return big.NewRat(num, dens[i])
+}
+
+// CountOps returns the number of operations in e: n - 1 for a sum of n
+// terms or a product of n factors, one for each power, function
+// application, integral, delta and comparison, one per case of a
+// Piecewise, and one for the division in a non-integer rational. So
+// x*(x + 1) has 2 and x^2 + x has 2, while 1/3*x + 1 has 3. Annotations
+// are not counted.
+func CountOps(e Expr) int {
+	e = bare(e)
+	n := 0
+	switch t := e.(type) {
+	case *Num:
+		if !t.val.IsInt() {
+			n = 1
+		}
+	case *Add:
+		n = len(t.terms) - 1
+	case *Mul:
+		n = len(t.factors) - 1
+	case *Pow, *Func, *UndefFunc, *Integral, *Sum, *Product, *Delta:
+		n = 1
+	case *Relational:
+		n = len(t.ops)
+	case *Piecewise:
+		n = len(t.cases)
+	}
+	_, cs := labeledChildren(e)
+	for _, c := range cs {
+		n += CountOps(c)
+	}
+	return n
+}
+
+// Complexity returns the size of e as the number of nodes in its tree,
+// counting a non-integer rational as two, its numerator and denominator.
+// Annotations are not counted. Of two equal expressions the one with the
+// smaller Complexity is usually the simpler to read and to evaluate, and
+// resource limits can use it to bound the size of inputs.
+func Complexity(e Expr) int {
+	e = bare(e)
+	if n, ok := e.(*Num); ok && !n.val.IsInt() {
+		return 2
+	}
+	size := 1
+	_, cs := labeledChildren(e)
+	for _, c := range cs {
+		size += Complexity(c)
+	}
+	return size
+}
+
+// DAGSize returns the number of distinct nodes of e, identified by
+// pointer. It is at most Complexity(e), which counts a node once per path
+// to it, and much smaller for expressions that share subtrees: thirty
+// levels of e = e*e have DAGSize 31 but more than a billion tree nodes.
+func DAGSize(e Expr) int {
+	seen := map[Expr]bool{}
+	var walk func(Expr)
+	walk = func(e Expr) {
+		if seen[e] {
+			return
+		}
+		seen[e] = true
+		_, cs := labeledChildren(e)
+		for _, c := range cs {
+			walk(c)
+		}
+	}
+	walk(e)
+	return len(seen)
+}
+
+// StringShared prints e without expanding shared subtrees. Each composite
+// node reachable along more than one path is printed once, on its own
+// line "t1 = ...", and referred to by name afterwards; the last line is e
+// itself. Names avoid the symbols of e, and definitions come before their
+// uses, so x*x with x = y*y prints as "t1 = y*y\nt1*t1". Without sharing
+// the result is e.String().
+func StringShared(e Expr) string {
+	refs := map[Expr]int{}
+	var order []Expr
+	syms := map[string]bool{}
+	var count func(Expr)
+	count = func(e Expr) {
+		if refs[e]++; refs[e] > 1 {
+			return
+		}
+		if s, ok := e.(*Sym); ok {
+			syms[s.name] = true
+		}
+		_, cs := labeledChildren(e)
+		for _, c := range cs {
+			count(c)
+		}
+		order = append(order, e)
+	}
+	count(e)
+
+	prefix := tempPrefix(syms)
+	names := map[Expr]Expr{}
+	var named func(Expr) Expr
+	named = func(e Expr) Expr {
+		if n, ok := names[e]; ok {
+			return n
+		}
+		_, cs := labeledChildren(e)
+		if len(cs) == 0 {
+			return e
+		}
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = named(c)
+		}
+		return withChildren(e, out)
+	}
+	var lines []string
+	for _, n := range order {
+		if _, cs := labeledChildren(n); refs[n] > 1 && len(cs) > 0 {
+			name := fmt.Sprintf("%s%d", prefix, len(lines)+1)
+			lines = append(lines, name+" = "+named(n).String())
+			names[n] = S(name)
+		}
+	}
+	return strings.Join(append(lines, named(e).String()), "\n")
+}
+
+// tempPrefix returns the prefix p of the temporaries p1, p2, … that
+// StringShared and CSE introduce: "t", with underscores appended until no
+// name in syms is p followed by digits.
+func tempPrefix(syms map[string]bool) string {
+	prefix := "t"
+	for taken := true; taken; {
+		taken = false
+		for s := range syms {
+			rest := strings.TrimPrefix(s, prefix)
+			if rest != s && rest != "" && strings.Trim(rest, "0123456789") == "" {
+				prefix, taken = prefix+"_", true
+				break
+			}
+		}
+	}
+	return prefix
+}
+
+// Assignment is one step "Name = Value" of a straight-line program, as
+// returned by CSE.
+type Assignment struct {
+	Name  string
+	Value Expr
+}
+
+// String returns e.g. "t1 = x + 1".
+func (a Assignment) String() string { return a.Name + " = " + a.Value.String() }
+
+// CSE eliminates common subexpressions from exprs: every composite
+// subtree that occurs more than once, structurally as in StructEqual, is
+// computed once by an assignment to a temporary t1, t2, … and referred to
+// by name afterwards. Assignments come before their uses and may refer to
+// earlier temporaries; the names avoid the symbols of exprs as in
+// StringShared. Substituting the assignments back in reverse order gives
+// exprs again, without their annotations.
+//
+// Only whole subtrees are shared, so x + y is not found in x + y + z, and
+// the bodies and limits of integrals, sums, products and lambdas are not
+// searched:
+// their parts may depend on the bound variable. A subtree that only occurs
+// inside occurrences of a larger shared one is left there, so sin(x + 1)
+// used twice gives the single temporary t1 = sin(x + 1).
+func CSE(exprs ...Expr) (assignments []Assignment, reduced []Expr) {
+	ids := map[string]int{}
+	idOf := map[Expr]int{}
+	syms := map[string]bool{}
+	var intern func(Expr) int
+	intern = func(e Expr) int {
+		if id, ok := idOf[e]; ok {
+			return id
+		}
+		if s, ok := e.(*Sym); ok {
+			syms[s.name] = true
+		}
+		_, cs := labeledChildren(e)
+		key := nodeKey(e) + "("
+		for _, c := range cs {
+			key += strconv.Itoa(intern(c)) + ","
+		}
+		id, ok := ids[key]
+		if !ok {
+			id = len(ids)
+			ids[key] = id
+		}
+		idOf[e] = id
+		return id
+	}
+	stripped := make([]Expr, len(exprs))
+	for i, e := range exprs {
+		stripped[i] = StripMeta(e)
+		intern(stripped[i])
+	}
+
+	refs := map[int]int{}
+	var order []Expr
+	var count func(Expr)
+	count = func(e Expr) {
+		id := idOf[e]
+		if refs[id]++; refs[id] > 1 {
+			return
+		}
+		if _, ok := e.(binder); !ok {
+			_, cs := labeledChildren(e)
+			for _, c := range cs {
+				count(c)
+			}
+		}
+		order = append(order, e)
+	}
+	for _, e := range stripped {
+		count(e)
+	}
+
+	prefix := tempPrefix(syms)
+	names := map[int]Expr{}
+	var rebuild func(Expr) Expr
+	rebuild = func(e Expr) Expr {
+		if n, ok := names[idOf[e]]; ok {
+			return n
+		}
+		_, cs := labeledChildren(e)
+		if _, ok := e.(binder); ok || len(cs) == 0 {
+			return e
+		}
+		out := make([]Expr, len(cs))
+		for i, c := range cs {
+			out[i] = rebuild(c)
+		}
+		return withChildren(e, out)
+	}
+	for _, n := range order {
+		if _, cs := labeledChildren(n); refs[idOf[n]] > 1 && len(cs) > 0 {
+			name := fmt.Sprintf("%s%d", prefix, len(assignments)+1)
+			assignments = append(assignments, Assignment{name, rebuild(n)})
+			names[idOf[n]] = S(name)
+		}
+	}
+	reduced = make([]Expr, len(stripped))
+	for i, e := range stripped {
+		reduced[i] = rebuild(e)
+	}
+	return assignments, reduced
+}
+
+// nodeKey identifies the node e apart from its children: its kind and
+// the names, numbers and operators it carries.
+func nodeKey(e Expr) string {
+	key := e.exprType()
+	switch t := e.(type) {
+	case *Num:
+		return key + ":" + t.val.RatString()
+	case *Sym:
+		return key + ":" + t.name
+	case *Const:
+		return key + ":" + t.name
+	case *WildSym:
+		return key + ":" + t.name + "!" + strings.Join(t.exclude, ",")
+	case *Func:
+		return key + ":" + t.name
+	case *UndefFunc:
+		return fmt.Sprintf("%s:%s'%d", key, t.name, t.order)
+	case *Integral:
+		return key + ":" + t.v
+	case *Sum:
+		return key + ":" + t.k
+	case *Product:
+		return key + ":" + t.k
+	case *Lambda:
+		return key + ":" + t.v
+	case *Piecewise:
+		for _, c := range t.cases {
+			key += ":" + c.Cond.Op.String()
+		}
+		return key
+	case *Relational:
+		for _, op := range t.ops {
+			key += ":" + op.String()
+		}
+		return key
+	case *Add, *Mul, *Pow, *Delta:
+		return key
+	}
+	return key + ":" + e.String()
+}
+
+// labeledChildren returns the children of e with their JSON field labels.
+func labeledChildren(e Expr) ([]string, []Expr) {
+	indexed := func(field string, es []Expr) ([]string, []Expr) {
+		labels := make([]string, len(es))
+		for i := range es {
+			labels[i] = fmt.Sprintf("%s[%d]", field, i)
+		}
+		return labels, es
+	}
+	switch t := e.(type) {
+	case *Add:
+		return indexed("terms", t.terms)
+	case *Mul:
+		return indexed("factors", t.factors)
+	case *Pow:
+		return []string{"base", "exp"}, []Expr{t.base, t.exp}
+	case *Func:
+		if len(t.args) > 1 {
+			return indexed("args", t.args)
+		}
+		return []string{"arg"}, []Expr{t.args[0]}
+	case *UndefFunc:
+		return []string{"arg"}, []Expr{t.arg}
+	case *Integral:
+		return []string{"integrand", "lo", "hi"}, []Expr{t.integrand, t.lo, t.hi}
+	case *Sum:
+		return []string{"term", "lo", "hi"}, []Expr{t.term, t.lo, t.hi}
+	case *Product:
+		return []string{"term", "lo", "hi"}, []Expr{t.term, t.lo, t.hi}
+	case *Lambda:
+		return []string{"body"}, []Expr{t.body}
+	case *Annotated:
+		return []string{"expr"}, []Expr{t.expr}
+	case *Piecewise:
+		var labels []string
+		var es []Expr
+		for i, c := range t.cases {
+			labels = append(labels, fmt.Sprintf("cases[%d].value", i), fmt.Sprintf("cases[%d].lhs", i), fmt.Sprintf("cases[%d].rhs", i))
+			es = append(es, c.Value, c.Cond.Lhs, c.Cond.Rhs)
+		}
+		return append(labels, "otherwise"), append(es, t.otherwise)
+	case *Delta:
+		return []string{"i", "j"}, []Expr{t.i, t.j}
+	case *Relational:
+		if len(t.ops) == 1 {
+			return []string{"lhs", "rhs"}, []Expr{t.sides[0], t.sides[1]}
+		}
+		labels := make([]string, len(t.sides))
+		for i := range labels {
+			labels[i] = fmt.Sprintf("sides[%d]", i)
+		}
+		return labels, append([]Expr(nil), t.sides...)
+	}
+	return nil, nil
+}
+
+// withChildren returns a copy of e with its children, in the order of
+// labeledChildren, replaced by cs.
+func withChildren(e Expr, cs []Expr) Expr {
+	switch t := e.(type) {
+	case *Add:
+		return &Add{terms: cs}
+	case *Mul:
+		return &Mul{factors: cs}
+	case *Pow:
+		return &Pow{base: cs[0], exp: cs[1]}
+	case *Func:
+		return &Func{name: t.name, args: append([]Expr(nil), cs...)}
+	case *UndefFunc:
+		return &UndefFunc{name: t.name, order: t.order, arg: cs[0]}
+	case *Integral:
+		return &Integral{integrand: cs[0], v: t.v, lo: cs[1], hi: cs[2]}
+	case *Sum:
+		return &Sum{term: cs[0], k: t.k, lo: cs[1], hi: cs[2]}
+	case *Product:
+		return &Product{term: cs[0], k: t.k, lo: cs[1], hi: cs[2]}
+	case *Lambda:
+		return &Lambda{v: t.v, body: cs[0]}
+	case *Annotated:
+		return &Annotated{expr: cs[0], meta: t.meta}
+	case *Piecewise:
+		cases := make([]PieceCase, len(t.cases))
+		for i, c := range t.cases {
+			cases[i] = PieceCase{cs[3*i], Cond{cs[3*i+1], c.Cond.Op, cs[3*i+2]}}
+		}
+		return &Piecewise{cases: cases, otherwise: cs[len(cs)-1]}
+	case *Delta:
+		return &Delta{i: cs[0], j: cs[1]}
+	case *Relational:
+		return &Relational{sides: cs, ops: t.ops}
+	}
+	return e
+}
+
+// ============================================================
+// Validation
+// ============================================================
+
+// ValidationError is a problem found by Validate. Path locates the
+// offending subtree as in TreeDiff, e.g. "terms[1].arg"; it is empty for
+// the root.
+type ValidationError struct {
+	Path    string
+	Problem string
+}
+
+func (e *ValidationError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "(root)"
+	}
+	return "invalid expression at " + path + ": " + e.Problem
+}
+
+// Validate checks that e is a well-formed tree and returns a
+// *ValidationError for the first problem in pre-order, or nil. It catches
+// trees that the constructors and FromJSON accept but that fail later
+// inside Simplify, Eval or String:
+//
+//   - nil children, including typed nil pointers and zero-value nodes
+//     such as &Num{};
+//   - sums and products without operands, and relations without two sides
+//     and a valid operator between each pair;
+//   - symbol, wildcard, undefined-function and integration-variable names
+//     that are not identifiers, e.g. "--x" or "x y", and variables named
+//     pi, e or oo, which would print as those constants;
+//   - functions that are not registered or have the wrong number of
+//     arguments;
+//   - constants other than pi, e and oo, or with a NaN value.
+func Validate(e Expr) error { return validate("", e) }
+
+func validate(path string, e Expr) error {
+	bad := func(format string, args ...interface{}) error {
+		return &ValidationError{Path: path, Problem: fmt.Sprintf(format, args...)}
+	}
+	ident := func(kind, name string) error {
+		if !isIdentifier(name) {
+			return bad("%s name %q is not an identifier", kind, name)
+		}
+		// A variable named like a constant prints as the constant, so
+		// Parse would not read it back.
+		if _, ok := constants[name]; ok && kind != "function" && kind != "wildcard" {
+			return bad("%s name %q is the constant %s", kind, name, name)
+		}
+		return nil
+	}
+	if isNilExpr(e) {
+		return bad("nil expression")
+	}
+	var err error
+	switch t := e.(type) {
+	case *Num:
+		if t.val == nil {
+			err = bad("number without a value")
+		}
+	case *Sym:
+		err = ident("symbol", t.name)
+	case *WildSym:
+		err = ident("wildcard", t.name)
+	case *Const:
+		switch c, ok := constants[t.name]; {
+		case !ok:
+			err = bad("unknown constant %q", t.name)
+		case t.val != c.val:
+			err = bad("constant %s has value %v", t.name, t.val)
+		}
+	case *Add:
+		if len(t.terms) == 0 {
+			err = bad("sum without terms")
+		}
+	case *Mul:
+		if len(t.factors) == 0 {
+			err = bad("product without factors")
+		}
+	case *Func:
+		switch d := lookupFunc(t.name); {
+		case d == nil:
+			err = bad("unknown function %q", t.name)
+		case len(t.args) != d.arity():
+			err = bad("%s takes %d arguments, got %d", t.name, d.arity(), len(t.args))
+		}
+	case *UndefFunc:
+		if err = ident("function", t.name); err == nil && t.order < 0 {
+			err = bad("negative derivative order %d", t.order)
+		}
+	case *Integral:
+		err = ident("integration variable", t.v)
+	case *Sum:
+		err = ident("summation index", t.k)
+	case *Product:
+		err = ident("product index", t.k)
+	case *Lambda:
+		err = ident("lambda variable", t.v)
+	case *Piecewise:
+		for i, c := range t.cases {
+			if c.Cond.Op < RelEq || c.Cond.Op > RelGe {
+				err = bad("cases[%d]: invalid operator %d", i, c.Cond.Op)
+				break
+			}
+		}
+	case *Relational:
+		if len(t.sides) < 2 || len(t.ops) != len(t.sides)-1 {
+			return bad("relation with %d sides and %d operators", len(t.sides), len(t.ops))
+		}
+		for i, op := range t.ops {
+			if op < RelEq || op > RelGe {
+				err = bad("invalid operator %d after side %d", op, i)
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	labels, children := labeledChildren(e)
+	for i, c := range children {
+		p := labels[i]
+		if path != "" {
+			p = path + "." + p
+		}
+		if err := validate(p, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isNilExpr reports whether e is nil or a nil pointer of a node type.
+func isNilExpr(e Expr) bool {
+	switch t := e.(type) {
+	case nil:
+		return true
+	case *Num:
+		return t == nil
+	case *Sym:
+		return t == nil
+	case *Const:
+		return t == nil
+	case *Add:
+		return t == nil
+	case *Mul:
+		return t == nil
+	case *Pow:
+		return t == nil
+	case *Func:
+		return t == nil
+	case *UndefFunc:
+		return t == nil
+	case *Integral:
+		return t == nil
+	case *Sum:
+		return t == nil
+	case *Product:
+		return t == nil
+	case *Lambda:
+		return t == nil
+	case *Piecewise:
+		return t == nil
+	case *Delta:
+		return t == nil
+	case *Relational:
+		return t == nil
+	case *WildSym:
+		return t == nil
+	case *Annotated:
+		return t == nil
+	}
+	return false
+}
+
+// ============================================================
+// Parser
+// ============================================================
+
+// ParseError describes a syntax error in parser input. Parse,
+// ParseWithRecovery and ParseRPN fill in Line and Col, which Error reports
+// as "parse error at column 7: unexpected \")\"" (with the line for
+// multi-line input); errors without them report the byte offset.
+type ParseError struct {
+	Pos  int    // byte offset of the error in the input
+	Msg  string // description of the problem
+	Line int    // 1-based line of Pos, or 0 if unknown
+	Col  int    // 1-based column of Pos in runes, or 0 if unknown
+}
+
+func (e *ParseError) Error() string {
+	switch {
+	case e.Line == 0:
+		return fmt.Sprintf("parse error at position %d: %s", e.Pos, e.Msg)
+	case e.Line == 1:
+		return fmt.Sprintf("parse error at column %d: %s", e.Col, e.Msg)
+	}
+	return fmt.Sprintf("parse error at line %d, column %d: %s", e.Line, e.Col, e.Msg)
+}
+
+// locate sets Line and Col from Pos within input.
+func (e *ParseError) locate(input string) {
+	pos := min(max(e.Pos, 0), len(input))
+	start := strings.LastIndexByte(input[:pos], '\n') + 1
+	e.Line = 1 + strings.Count(input[:start], "\n")
+	e.Col = 1 + utf8.RuneCountInString(input[start:pos])
+}
+
+// located fills in the line and column of err when it is a *ParseError.
+func located(input string, err error) error {
+	if pe, ok := err.(*ParseError); ok {
+		pe.locate(input)
+	}
+	return err
+}
+
+// Limits on parser input. Longer inputs are rejected before tokenizing,
+// and parentheses, function calls and unary signs may nest at most
+// MaxParseDepth deep, so adversarial input cannot exhaust the stack.
+// Decimal exponents are limited to ±1000 for the same reason.
+const (
+	MaxParseLen   = 1 << 16
+	MaxParseDepth = 256
+)
+
+func checkParseLen(input string) *ParseError {
+	if len(input) > MaxParseLen {
+		return &ParseError{Pos: MaxParseLen, Msg: fmt.Sprintf("input longer than %d bytes", MaxParseLen)}
+	}
+	return nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNum
+	tokIdent
+	tokOp
+	tokBad // malformed literal, already reported (recovery mode only)
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// Parse parses an infix expression such as "3*x^2 + sin(x)/2".
+//
+// Numbers may be integers, decimals (2.5, .5) or use scientific notation
+// (1e-3, 2.5E6); all are converted to exact rationals. Supported operators
+// are + - * / ^ with the usual precedence; ^ is right-associative.
+//
+// Malformed input returns a *ParseError locating the problem, e.g.
+// "parse error at column 4: expected \")\", found end of input".
+func Parse(input string) (_ Expr, err error) {
+	return parseWith(input, nil)
+}
+
+// ParseWithFunctions is Parse that also reads each of names as an unknown
+// function, as if declared with Function, for this call only: f(x), f'(x)
+// and Derivative(f(x), (x, 4)) then parse, and nothing is declared for
+// later calls. It is an error for a name not to be an identifier or to
+// name a registered function.
+func ParseWithFunctions(input string, names []string) (Expr, error) {
+	funcs := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !isIdentifier(name) || name == "sqrt" || lookupFunc(name) != nil {
+			return nil, fmt.Errorf("function: %q is not a free function name", name)
+		}
+		funcs[name] = true
+	}
+	return parseWith(input, funcs)
+}
+
+func parseWith(input string, funcs map[string]bool) (_ Expr, err error) {
+	defer func() { err = located(input, err) }()
+	if err := checkParseLen(input); err != nil {
+		return nil, err
+	}
+	p := &parser{funcs: funcs}
+	toks, err := p.tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p.toks = toks
+	e, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return e, nil
+}
+
+// ParseHole is the name of the symbol ParseWithRecovery substitutes for
+// operands it could not parse.
+const ParseHole = "?"
+
+// ParseErrors is a list of parse errors ordered by position.
+type ParseErrors []*ParseError
+
+func (es ParseErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParseWithRecovery parses input like Parse but does not stop at the first
+// error. Every syntax error is recorded and parsing resumes at the next
+// token; operands that could not be parsed are replaced by the symbol
+// ParseHole. It always returns a (possibly partial) expression, and the
+// errors are nil only if input is well formed.
+func ParseWithRecovery(input string) (Expr, ParseErrors) {
+	if err := checkParseLen(input); err != nil {
+		err.locate(input)
+		return S(ParseHole), ParseErrors{err}
+	}
+	p := &parser{recovering: true}
+	p.toks, _ = p.tokenize(input)
+	e, _ := p.parseRelation()
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		p.fail(t.pos, fmt.Sprintf("unexpected %q", t.text))
+		if p.peek().kind != tokEOF {
+			// Keep parsing for diagnostics; the trailing expression is dropped.
+			p.parseRelation()
+		}
+	}
+	if len(p.errs) == 0 {
+		return e, nil
+	}
+	sort.SliceStable(p.errs, func(i, j int) bool { return p.errs[i].Pos < p.errs[j].Pos })
+	var out ParseErrors
+	for _, err := range p.errs {
+		if len(out) > 0 && out[len(out)-1].Pos == err.Pos {
+			continue
+		}
+		err.locate(input)
+		out = append(out, err)
+	}
+	return e, out
+}
+
+func (p *parser) tokenize(s string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isDigit(c) || (c == '.' && i+1 < len(s) && isDigit(s[i+1])):
+			j, err := scanNumber(s, i)
+			if err != nil {
+				if !p.recovering {
+					return nil, err
+				}
+				p.errs = append(p.errs, err.(*ParseError))
+				toks = append(toks, token{kind: tokBad, text: s[i:j], pos: i})
+			} else {
+				toks = append(toks, token{kind: tokNum, text: s[i:j], pos: i})
+			}
+			i = j
+		case identLen(s, i, false) > 0:
+			j := i
+			for j < len(s) && identLen(s, j, true) > 0 {
+				j += identLen(s, j, true)
+			}
+			toks = append(toks, token{kind: tokIdent, text: s[i:j], pos: i})
+			i = j
+		case strings.IndexByte("+-*/^(),[]'", c) >= 0:
+			toks = append(toks, token{kind: tokOp, text: string(c), pos: i})
+			i++
+		case strings.HasPrefix(s[i:], "°"):
+			toks = append(toks, token{kind: tokOp, text: "°", pos: i})
+			i += len("°")
+		case strings.IndexByte("=<>!", c) >= 0 && (c != '!' || strings.HasPrefix(s[i:], "!=")):
+			n := 1
+			if c != '=' && i+1 < len(s) && s[i+1] == '=' {
+				n = 2
+			}
+			toks = append(toks, token{kind: tokOp, text: s[i : i+n], pos: i})
+			i += n
+		default:
+			r, n := utf8.DecodeRuneInString(s[i:])
+			msg := fmt.Sprintf("unexpected character %q", r)
+			if r == utf8.RuneError && n == 1 {
+				msg = "invalid UTF-8"
+			}
+			err := &ParseError{Pos: i, Msg: msg}
+			if !p.recovering {
+				return nil, err
+			}
+			p.errs = append(p.errs, err)
+			i += n
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(s)}), nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// identLen returns the byte length of the identifier character at s[i], or
+// 0 if there is none. Non-ASCII letters are decoded as UTF-8 so that a name
+// is never split inside a rune; digits count only when digits is set.
+func identLen(s string, i int, digits bool) int {
+	if c := s[i]; c < utf8.RuneSelf {
+		if c == '_' || unicode.IsLetter(rune(c)) || digits && isDigit(c) {
+			return 1
+		}
+		return 0
+	}
+	if r, n := utf8.DecodeRuneInString(s[i:]); unicode.IsLetter(r) {
+		return n
+	}
+	return 0
+}
+
+// scanNumber returns the end of the numeric literal starting at i:
+// digits [ "." digits ] [ ("e"|"E") ["+"|"-"] digits ]. On error the
+// returned offset is the end of the malformed literal.
+func scanNumber(s string, i int) (int, error) {
+	start := i
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j >= len(s) || !isDigit(s[j]) {
+			return j, &ParseError{Pos: start, Msg: fmt.Sprintf("malformed number %q: missing exponent digits", s[start:j])}
+		}
+		digits := j
+		for j < len(s) && isDigit(s[j]) {
+			j++
+		}
+		if exp := strings.TrimLeft(s[digits:j], "0"); len(exp) > 4 || len(exp) == 4 && exp > "1000" {
+			return j, &ParseError{Pos: start, Msg: fmt.Sprintf("malformed number %q: exponent out of range", s[start:j])}
+		}
+		i = j
+	}
+	if i < len(s) && (s[i] == '.' || identLen(s, i, true) > 0) {
+		j := i
+		for j < len(s) && (s[j] == '.' || identLen(s, j, true) > 0) {
+			j += max(identLen(s, j, true), 1)
+		}
+		return j, &ParseError{Pos: start, Msg: fmt.Sprintf("malformed number %q", s[start:j])}
+	}
+	return i, nil
+}
+
+type parser struct {
+	toks       []token
+	pos        int
+	depth      int
+	recovering bool
+	errs       []*ParseError
+	funcs      map[string]bool // unknown functions named for this parse
+}
+
+// unknownFunc reports whether name is read as an unknown function: one
+// declared with Function or named for this parse, and not registered.
+func (p *parser) unknownFunc(name string) bool {
+	return name != "sqrt" && lookupFunc(name) == nil && (p.funcs[name] || isDeclaredFunction(name))
+}
+
+// fail reports a syntax error at pos. In recovery mode the error is
+// recorded and a ParseHole symbol stands in for the missing operand;
+// otherwise the error is returned.
+func (p *parser) fail(pos int, msg string) (Expr, error) {
+	err := &ParseError{Pos: pos, Msg: msg}
+	if !p.recovering {
+		return nil, err
+	}
+	p.errs = append(p.errs, err)
+	return S(ParseHole), nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+// relation := expr { relop expr }
+func (p *parser) parseRelation() (Expr, error) {
+	first, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	sides := []Expr{first}
+	var ops []RelOp
+	for {
+		t := p.peek()
+		op, ok := relOpNamed(t.text)
+		if t.kind != tokOp || !ok {
+			break
+		}
+		p.next()
+		s, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		sides, ops = append(sides, s), append(ops, op)
+	}
+	if len(ops) == 0 {
+		return first, nil
+	}
+	return Chain(sides, ops...), nil
+}
+
+// expr := term { ("+" | "-") term }
+func (p *parser) parseExpr() (Expr, error) {
+	first, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	terms := []Expr{first}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.next().text
+		t, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if op == "-" {
+			t = Neg(t)
+		}
+		terms = append(terms, t)
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return &Add{terms: terms}, nil
+}
+
+// term := unary { ("*" | "/") unary }
+func (p *parser) parseTerm() (Expr, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	factors := []Expr{first}
+	for p.isOp("*") || p.isOp("/") {
+		op := p.next().text
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "/" {
+			last := len(factors) - 1
+			if q, ok := quotient(factors[last], f); ok {
+				factors[last] = q
+				continue
+			}
+			f = &Pow{base: f, exp: N(-1)}
+		}
+		factors = append(factors, f)
+	}
+	if len(factors) == 1 {
+		return factors[0], nil
+	}
+	// A leading sign binds to the first factor, so "-x*y" arrives as
+	// (-1*x)*y; splice it back into one product as Mul.String printed it.
+	if m, ok := factors[0].(*Mul); ok && len(m.factors) == 2 && isNumValue(m.factors[0], -1) {
+		factors = append([]Expr{m.factors[0], m.factors[1]}, factors[1:]...)
+	}
+	return &Mul{factors: factors}, nil
+}
+
+// quotient folds a division of two numbers into one rational, so that the
+// printed coefficient 1/3 parses back as a single Num.
+func quotient(a, b Expr) (Expr, bool) {
+	n, ok1 := a.(*Num)
+	d, ok2 := b.(*Num)
+	if !ok1 || !ok2 || d.IsZero() {
+		return nil, false
+	}
+	return numRat(new(big.Rat).Quo(n.val, d.val)), true
+}
+
+// unary := ("-" | "+") unary | power
+//
+// Unary minus binds looser than ^, so -x^2 is -(x^2), but it may appear
+// after any binary operator: 2*-3, x^-1 and --x are all accepted. Unary
+// plus may not follow an operator, so that a doubled key such as x++2 or
+// 2*+3 is an error rather than silently x + 2; +x and (+x) are accepted.
+func (p *parser) parseUnary() (Expr, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > MaxParseDepth {
+		t := p.peek()
+		p.pos = len(p.toks) - 1 // give up on the rest of the input
+		return p.fail(t.pos, fmt.Sprintf("expression nested more than %d deep", MaxParseDepth))
+	}
+	if p.isOp("+") && p.pos > 0 {
+		switch prev := p.toks[p.pos-1]; prev.text {
+		case "+", "-", "*", "/", "^":
+			if prev.kind == tokOp {
+				return p.fail(p.peek().pos, `unexpected "+" after "`+prev.text+`"`)
+			}
+		}
+	}
+	if p.isOp("-") || p.isOp("+") {
+		op := p.next().text
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "-" {
+			return Neg(e), nil
+		}
+		return e, nil
+	}
+	return p.parsePower()
+}
+
+// power := atom [ "°" ] [ "^" unary ]
+func (p *parser) parsePower() (Expr, error) {
+	base, err := p.parseAtom()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("°") {
+		p.next()
+		base = Deg(base)
+	}
+	if p.isOp("^") {
+		p.next()
+		exp, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Pow{base: base, exp: exp}, nil
+	}
+	return base, nil
+}
+
+// atom := number | ident [ "'"... ] [ "(" expr ")" ] | "(" expr ")"
+func (p *parser) parseAtom() (Expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNum:
+		p.next()
+		return parseNum(t)
+	case tokBad:
+		p.next()
+		return S(ParseHole), nil
+	case tokIdent:
+		p.next()
+		order := 0
+		for p.isOp("'") {
+			p.next()
+			order++
+		}
+		if order > 0 {
+			// f'(x), for an unknown function declared with Function.
+			if !p.unknownFunc(t.text) {
+				return p.fail(t.pos, fmt.Sprintf("%q is not an unknown function declared with Function", t.text))
+			}
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			return p.parseUndefFunc(t, order)
+		}
+		if !p.isOp("(") {
+			if c, ok := constants[t.text]; ok {
+				return c, nil
+			}
+			return S(t.text), nil
+		}
+		p.next()
+		if t.text == "piecewise" {
+			return p.parsePiecewise()
+		}
+		if t.text == "KroneckerDelta" {
+			return p.parseDelta()
+		}
+		if t.text == "Wild" {
+			return p.parseWild()
+		}
+		if t.text == "det" || t.text == "trace" {
+			return p.parseMatrixScalar(t)
+		}
+		if t.text == "Derivative" && !p.unknownFunc(t.text) {
+			return p.parseDerivative()
+		}
+		if t.text == "Lambda" && !p.unknownFunc(t.text) {
+			return p.parseLambda()
+		}
+		if p.unknownFunc(t.text) {
+			return p.parseUndefFunc(t, 0)
+		}
+		arg, err := p.parseRelation()
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "integrate" && p.isOp(",") {
+			return p.parseIntegral(arg)
+		}
+		if (t.text == "sum" || t.text == "product") && p.isOp(",") {
+			return p.parseIndexed(t.text, arg)
+		}
+		args := []Expr{arg}
+		for p.isOp(",") {
+			p.next()
+			a, err := p.parseRelation()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a)
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		e, err := parseCall(t, args)
+		if err != nil {
+			return p.fail(t.pos, err.(*ParseError).Msg)
+		}
+		return e, nil
+	case tokOp:
+		if t.text == "(" {
+			p.next()
+			e, err := p.parseRelation()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return e, nil
+		}
+		if t.text == "[" {
+			return p.fail(t.pos, "matrix where an expression is expected; use det or trace, or ParseMatrix")
+		}
+		// Leave closing parentheses and binary operators for the caller
+		// so that recovery can resynchronize on them.
+		if t.text == "," {
+			p.next()
+		}
+		return p.fail(t.pos, fmt.Sprintf("unexpected %q", t.text))
+	}
+	return p.fail(t.pos, "unexpected end of input")
+}
+
+// parseIntegral reads the rest of integrate(f, v, lo, hi) after f, the
+// form Integral.String prints.
+func (p *parser) parseIntegral(f Expr) (Expr, error) {
+	v, limits, err := p.parseBinding("integration variable")
+	if err != nil {
+		return nil, err
+	}
+	return IntegralOf(f, v, limits[0], limits[1]), nil
+}
+
+// parseLambda reads the rest of Lambda(v, body) after the opening
+// parenthesis, the form Lambda.String prints.
+func (p *parser) parseLambda() (Expr, error) {
+	v := p.peek()
+	if v.kind != tokIdent {
+		return p.fail(v.pos, "expected lambda variable")
+	}
+	p.next()
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	body, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return LambdaOf(v.text, body), nil
+}
+
+// parseIndexed reads the rest of sum(f, k, lo, hi) or product(f, k, lo,
+// hi) after f, the forms Sum.String and Product.String print.
+func (p *parser) parseIndexed(name string, f Expr) (Expr, error) {
+	k, limits, err := p.parseBinding(name + " index")
+	if err != nil {
+		return nil, err
+	}
+	if name == "sum" {
+		return SumOf(f, k, limits[0], limits[1]), nil
+	}
+	return ProductOf(f, k, limits[0], limits[1]), nil
+}
+
+// parseBinding reads ", v, lo, hi)", the bound variable and limits of a
+// binder; what names the variable in errors.
+func (p *parser) parseBinding(what string) (string, [2]Expr, error) {
+	var limits [2]Expr
+	if err := p.expect(","); err != nil {
+		return "", limits, err
+	}
+	v := p.peek()
+	if v.kind != tokIdent {
+		_, err := p.fail(v.pos, "expected "+what)
+		return "", limits, err
+	}
+	p.next()
+	for i := range limits {
+		if err := p.expect(","); err != nil {
+			return "", limits, err
+		}
+		e, err := p.parseExpr()
+		if err != nil {
+			return "", limits, err
+		}
+		limits[i] = e
+	}
+	if err := p.expect(")"); err != nil {
+		return "", limits, err
+	}
+	return v.text, limits, nil
+}
+
+// parsePiecewise reads the rest of
+// piecewise((v1, c1), ..., (v, otherwise)) after the opening parenthesis,
+// the form Piecewise.String prints. Each condition is expr relop expr.
+func (p *parser) parsePiecewise() (Expr, error) {
+	var cases []PieceCase
+	for {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		value, err := p.parseRelation()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t.kind == tokIdent && t.text == "otherwise" && p.toks[p.pos+1].text == ")" {
+			p.next()
+			p.next()
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return PiecewiseOf(cases, value), nil
+		}
+		cond, err := p.parseRelation()
+		if err != nil {
+			return nil, err
+		}
+		r, ok := cond.(*Relational)
+		if !ok {
+			t := p.peek()
+			return p.fail(t.pos, fmt.Sprintf("expected comparison, found %q", t.text))
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		cases = append(cases, PieceCase{value, r.Cond()})
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseDelta reads the rest of KroneckerDelta(i, j) after the opening
+// parenthesis.
+func (p *parser) parseDelta() (Expr, error) {
+	var idx [2]Expr
+	for k := range idx {
+		if k > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		idx[k] = e
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return KroneckerDelta(idx[0], idx[1]), nil
+}
+
+// parseWild reads the rest of Wild(a) or Wild(a, x, ...) after the
+// opening parenthesis.
+func (p *parser) parseWild() (Expr, error) {
+	var names []string
+	for len(names) == 0 || p.isOp(",") {
+		if len(names) > 0 {
+			p.next()
+		}
+		t := p.peek()
+		if t.kind != tokIdent {
+			return p.fail(t.pos, "Wild: expected a name")
+		}
+		p.next()
+		names = append(names, t.text)
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return Wild(names[0], names[1:]...), nil
+}
+
+// ParseMatrix parses a matrix-valued expression: a literal such as
+// "[[1, x], [y, 2]]", whose rows are lists of entries, or "[x, y, z]",
+// read as a column vector; inv(m), transpose(m) and adjugate(m); and sums
+// and products of these, with the usual precedence. Entries are any
+// expressions Parse accepts and are simplified. Parse itself reads det(m)
+// and trace(m) of such a value, so "det([[a, b], [c, d]])" parses as
+// a*d - b*c. Shape errors, such as adding a 2×2 to a 3×3 matrix, are
+// *ParseErrors located at the operator.
+func ParseMatrix(input string) (_ Matrix, err error) {
+	defer func() { err = located(input, err) }()
+	if err := checkParseLen(input); err != nil {
+		return Matrix{}, err
+	}
+	p := &parser{}
+	toks, err := p.tokenize(input)
+	if err != nil {
+		return Matrix{}, err
+	}
+	p.toks = toks
+	m, err := p.parseMatrix()
+	if err != nil {
+		return Matrix{}, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return Matrix{}, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return m, nil
+}
+
+// matrixFail is fail for matrix values; in recovery mode a 1×1 matrix
+// holding ParseHole stands in for the value.
+func (p *parser) matrixFail(pos int, msg string) (Matrix, error) {
+	if _, err := p.fail(pos, msg); err != nil {
+		return Matrix{}, err
+	}
+	return Matrix{rows: [][]Expr{{S(ParseHole)}}}, nil
+}
+
+// matrix := mterm { "+" mterm }
+func (p *parser) parseMatrix() (Matrix, error) {
+	m, err := p.parseMatrixTerm()
+	for err == nil && p.isOp("+") {
+		t := p.next()
+		var o Matrix
+		if o, err = p.parseMatrixTerm(); err == nil {
+			if m, err = m.Add(o); err != nil {
+				m, err = p.matrixFail(t.pos, err.Error())
+			}
+		}
+	}
+	return m, err
+}
+
+// mterm := mfactor { "*" mfactor }
+func (p *parser) parseMatrixTerm() (Matrix, error) {
+	m, err := p.parseMatrixFactor()
+	for err == nil && p.isOp("*") {
+		t := p.next()
+		var o Matrix
+		if o, err = p.parseMatrixFactor(); err == nil {
+			if m, err = m.Mul(o); err != nil {
+				m, err = p.matrixFail(t.pos, err.Error())
+			}
+		}
+	}
+	return m, err
+}
+
+// mfactor := "[" row { "," row } "]" | "[" expr { "," expr } "]"
+//
+//	| ("inv" | "transpose" | "adjugate") "(" matrix ")" | "(" matrix ")"
+func (p *parser) parseMatrixFactor() (Matrix, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	t := p.peek()
+	if p.depth > MaxParseDepth {
+		p.pos = len(p.toks) - 1
+		return p.matrixFail(t.pos, fmt.Sprintf("expression nested more than %d deep", MaxParseDepth))
+	}
+	switch {
+	case p.isOp("["):
+		return p.parseMatrixLiteral()
+	case p.isOp("("):
+		p.next()
+		m, err := p.parseMatrix()
+		if err == nil {
+			err = p.expect(")")
+		}
+		return m, err
+	case t.kind == tokIdent && (t.text == "inv" || t.text == "transpose" || t.text == "adjugate"):
+		p.next()
+		if err := p.expect("("); err != nil {
+			return Matrix{}, err
+		}
+		m, err := p.parseMatrix()
+		if err == nil {
+			err = p.expect(")")
+		}
+		if err != nil {
+			return Matrix{}, err
+		}
+		switch t.text {
+		case "inv":
+			m, err = m.Inverse()
+		case "transpose":
+			m = m.Transpose()
+		default:
+			m, err = m.Adjugate()
+		}
+		if err != nil {
+			return p.matrixFail(t.pos, err.Error())
+		}
+		return m, nil
+	case t.kind == tokEOF:
+		return p.matrixFail(t.pos, "expected a matrix, found end of input")
+	case t.kind != tokOp:
+		p.next()
+	}
+	return p.matrixFail(t.pos, fmt.Sprintf("expected a matrix, found %q", t.text))
+}
+
+// parseMatrixLiteral reads "[[a, b], [c, d]]" as a matrix and "[a, b]"
+// as a column vector.
+func (p *parser) parseMatrixLiteral() (Matrix, error) {
+	open := p.next()
+	nested := p.isOp("[")
+	var rows [][]Expr
+	for {
+		var row []Expr
+		if nested {
+			if err := p.expect("["); err != nil {
+				return Matrix{}, err
+			}
+			for {
+				e, err := p.parseRelation()
+				if err != nil {
+					return Matrix{}, err
+				}
+				row = append(row, e)
+				if !p.isOp(",") {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect("]"); err != nil {
+				return Matrix{}, err
+			}
+		} else {
+			e, err := p.parseRelation()
+			if err != nil {
+				return Matrix{}, err
+			}
+			row = []Expr{e}
+		}
+		rows = append(rows, row)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect("]"); err != nil {
+		return Matrix{}, err
+	}
+	m, err := NewMatrix(rows)
+	if err != nil {
+		return p.matrixFail(open.pos, err.Error())
+	}
+	return m, nil
+}
+
+// parseMatrixScalar reads the rest of det(m) or trace(m) after the
+// opening parenthesis.
+func (p *parser) parseMatrixScalar(t token) (Expr, error) {
+	m, err := p.parseMatrix()
+	if err == nil {
+		err = p.expect(")")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e Expr
+	if t.text == "det" {
+		e, err = m.Det()
+	} else {
+		e, err = m.Trace()
+	}
+	if err != nil {
+		return p.fail(t.pos, err.Error())
+	}
+	return e, nil
+}
+
+func (p *parser) expect(op string) error {
+	t := p.peek()
+	if t.kind == tokOp && t.text == op {
+		p.next()
+		return nil
+	}
+	var err error
+	if t.kind == tokEOF {
+		_, err = p.fail(t.pos, fmt.Sprintf("expected %q, found end of input", op))
+	} else {
+		_, err = p.fail(t.pos, fmt.Sprintf("expected %q, found %q", op, t.text))
+	}
+	return err
+}
+
+// parseUndefFunc reads the argument and closing parenthesis of the
+// unknown function name differentiated order times.
+func (p *parser) parseUndefFunc(name token, order int) (Expr, error) {
+	arg, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp(",") {
+		return p.fail(name.pos, fmt.Sprintf("unknown function %q takes 1 argument", name.text))
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &UndefFunc{name: name.text, order: order, arg: arg}, nil
+}
+
+// parseDerivative reads the rest of Derivative(f(u), (u, n)), the n-th
+// derivative of the unknown function f with respect to its argument u.
+func (p *parser) parseDerivative() (Expr, error) {
+	at := p.peek().pos
+	e, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+	u, ok := e.(*UndefFunc)
+	if !ok || u.order != 0 {
+		return p.fail(at, "Derivative takes an unknown function such as f(x)")
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	at = p.peek().pos
+	v, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+	if v.String() != u.arg.String() {
+		return p.fail(at, fmt.Sprintf("Derivative of %s must be with respect to %s", u, u.arg))
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	n, ok := new(big.Int).SetString(t.text, 10)
+	if t.kind != tokNum || !ok || n.Sign() <= 0 || n.Cmp(big.NewInt(maxFunctionOrder)) > 0 {
+		return p.fail(t.pos, fmt.Sprintf("Derivative order must be an integer from 1 to %d", maxFunctionOrder))
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return &UndefFunc{name: u.name, order: int(n.Int64()), arg: u.arg}, nil
+}
+
+// parseNum converts a numeric literal to an exact rational.
+func parseNum(t token) (Expr, error) {
+	r, ok := new(big.Rat).SetString(t.text)
+	if !ok {
+		return nil, &ParseError{Pos: t.pos, Msg: fmt.Sprintf("malformed number %q", t.text)}
+	}
+	return numRat(r), nil
+}
+
+// parseCall builds the function application name(arg) from the registry.
+func parseCall(name token, args []Expr) (Expr, error) {
+	want := 1
+	if name.text != "sqrt" {
+		def := lookupFunc(name.text)
+		if def == nil {
+			return nil, &ParseError{Pos: name.pos, Msg: fmt.Sprintf("unknown function %q", name.text)}
+		}
+		want = def.arity()
+	}
+	if len(args) != want {
+		return nil, &ParseError{Pos: name.pos, Msg: fmt.Sprintf("function %q takes %d argument(s), got %d", name.text, want, len(args))}
+	}
+	if name.text == "sqrt" {
+		return SqrtOf(args[0]), nil
+	}
+	return &Func{name: name.text, args: args}, nil
+}
+
+// ============================================================
+// MathML input
+// ============================================================
+
+// mathNode is an element of a decoded MathML document. Text holds the
+// character data between children: Text[i] precedes Children[i].
+type mathNode struct {
+	name     string
+	attrs    map[string]string
+	children []*mathNode
+	text     []string
+}
+
+func (n *mathNode) content() string { return strings.TrimSpace(strings.Join(n.text, "")) }
+
+// ParseMathML converts a MathML fragment into an expression. Both
+// presentation markup (<mi>, <mn>, <mo>, <mrow>, <msup>, <mfrac>, <msqrt>,
+// ...) as emitted by word processors and browsers, and content markup
+// (<apply>, <ci>, <cn>, <plus/>, <times/>, ...) are accepted; the outer
+// <math> element is optional.
+func ParseMathML(src string) (Expr, error) {
+	root, err := decodeMathML(src)
+	if err != nil {
+		return nil, err
+	}
+	if isContentMathML(root) {
+		e, err := contentExpr(root)
+		if err != nil {
+			return nil, fmt.Errorf("mathml: %w", err)
+		}
+		return e, nil
+	}
+	var toks []token
+	if err := presentationTokens(root, &toks); err != nil {
+		return nil, fmt.Errorf("mathml: %w", err)
+	}
+	toks = insertImplicitTimes(toks)
+	p := &parser{toks: append(toks, token{kind: tokEOF})}
+	e, err := p.parseRelation()
+	if err == nil && p.peek().kind != tokEOF {
+		err = fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mathml: %w", err)
+	}
+	return e, nil
+}
+
+func decodeMathML(src string) (*mathNode, error) {
+	dec := xml.NewDecoder(strings.NewReader(src))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	var stack []*mathNode
+	var root *mathNode
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mathml: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &mathNode{name: t.Name.Local, attrs: map[string]string{}, text: []string{""}}
+			for _, a := range t.Attr {
+				n.attrs[a.Name.Local] = a.Value
+			}
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, fmt.Errorf("mathml: multiple root elements")
+				}
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+				parent.text = append(parent.text, "")
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("mathml: unbalanced </%s>", t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				n := stack[len(stack)-1]
+				n.text[len(n.text)-1] += string(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("mathml: empty document")
+	}
+	if len(stack) != 0 {
+		return nil, fmt.Errorf("mathml: unclosed <%s>", stack[len(stack)-1].name)
+	}
+	return root, nil
+}
+
+func isContentMathML(n *mathNode) bool {
+	switch n.name {
+	case "apply", "ci", "cn", "csymbol":
+		return true
+	}
+	for _, c := range n.children {
+		if isContentMathML(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// mathMLIdentifiers maps Unicode identifiers to the parser's names.
+var mathMLIdentifiers = map[string]string{
+	"α": "alpha", "β": "beta", "γ": "gamma", "δ": "delta", "ε": "epsilon",
+	"ζ": "zeta", "η": "eta", "θ": "theta", "ι": "iota", "κ": "kappa",
+	"λ": "lambda", "μ": "mu", "ν": "nu", "ξ": "xi", "π": "pi", "ρ": "rho",
+	"σ": "sigma", "τ": "tau", "υ": "upsilon", "φ": "phi", "ϕ": "phi",
+	"χ": "chi", "ψ": "psi", "ω": "omega", "Γ": "Gamma", "Δ": "Delta",
+	"Θ": "Theta", "Λ": "Lambda", "Ξ": "Xi", "Π": "Pi", "Σ": "Sigma",
+	"Φ": "Phi", "Ψ": "Psi", "Ω": "Omega", "ⅇ": "e",
+}
+
+func mathMLName(s string) (string, error) {
+	if n, ok := mathMLIdentifiers[s]; ok {
+		return n, nil
+	}
+	if !isIdentifier(s) {
+		return "", fmt.Errorf("unsupported identifier %q", s)
+	}
+	return s, nil
+}
+
+// mathMLOperators maps presentation operators to parser operators. An
+// empty value marks operators that generate no token.
+var mathMLOperators = map[string]string{
+	"+": "+", "-": "-", "−": "-", "*": "*", "×": "*", "·": "*", "⋅": "*",
+	"⁢": "*", "/": "/", "÷": "/", "^": "^", "(": "(", ")": ")",
+	"[": "(", "]": ")", "{": "(", "}": ")", ",": ",", "⁡": "",
+	"=": "=", "≠": "!=", "<": "<", "≤": "<=", ">": ">", "≥": ">=",
+}
+
+func opToken(text string) token { return token{kind: tokOp, text: text} }
+
+// presentationTokens flattens presentation markup into parser tokens.
+func presentationTokens(n *mathNode, out *[]token) error {
+	group := func(c *mathNode) error {
+		*out = append(*out, opToken("("))
+		if err := presentationTokens(c, out); err != nil {
+			return err
+		}
+		*out = append(*out, opToken(")"))
+		return nil
+	}
+	arity := func(k int) error {
+		if len(n.children) != k {
+			return fmt.Errorf("<%s> expects %d children, got %d", n.name, k, len(n.children))
+		}
+		return nil
+	}
+	switch n.name {
+	case "math", "mrow", "mstyle", "mpadded", "semantics":
+		if n.name == "semantics" && len(n.children) > 0 {
+			return presentationTokens(n.children[0], out)
+		}
+		return rowTokens(n.children, out)
+	case "mi":
+		name, err := mathMLName(n.content())
+		if err != nil {
+			return err
+		}
+		*out = append(*out, token{kind: tokIdent, text: name})
+	case "mn":
+		text := n.content()
+		if end, err := scanNumber(text, 0); err != nil || end != len(text) {
+			return fmt.Errorf("malformed number %q", text)
+		}
+		*out = append(*out, token{kind: tokNum, text: text})
+	case "mo":
+		text := n.content()
+		t, ok := mathMLOperators[text]
+		if !ok {
+			return fmt.Errorf("unsupported operator %q", text)
+		}
+		if t != "" {
+			*out = append(*out, opToken(t))
+		}
+	case "mfenced":
+		*out = append(*out, opToken("("))
+		if err := rowTokens(n.children, out); err != nil {
+			return err
+		}
+		*out = append(*out, opToken(")"))
+	case "msup", "mfrac":
+		if err := arity(2); err != nil {
+			return err
+		}
+		*out = append(*out, opToken("("))
+		if err := group(n.children[0]); err != nil {
+			return err
+		}
+		if n.name == "msup" {
+			*out = append(*out, opToken("^"))
+		} else {
+			*out = append(*out, opToken("/"))
+		}
+		if err := group(n.children[1]); err != nil {
+			return err
+		}
+		*out = append(*out, opToken(")"))
+	case "msqrt":
+		*out = append(*out, token{kind: tokIdent, text: "sqrt"}, opToken("("))
+		if err := rowTokens(n.children, out); err != nil {
+			return err
+		}
+		*out = append(*out, opToken(")"))
+	case "mroot":
+		if err := arity(2); err != nil {
+			return err
+		}
+		*out = append(*out, opToken("("))
+		if err := group(n.children[0]); err != nil {
+			return err
+		}
+		*out = append(*out, opToken("^"), opToken("("), token{kind: tokNum, text: "1"}, opToken("/"))
+		if err := group(n.children[1]); err != nil {
+			return err
+		}
+		*out = append(*out, opToken(")"), opToken(")"))
+	case "msub", "msubsup":
+		if n.name == "msub" {
+			if err := arity(2); err != nil {
+				return err
+			}
+		} else if err := arity(3); err != nil {
+			return err
+		}
+		base, sub := n.children[0], n.children[1]
+		if base.name != "mi" || (sub.name != "mi" && sub.name != "mn") {
+			return fmt.Errorf("<%s> supports only identifier subscripts", n.name)
+		}
+		name, err := mathMLName(base.content() + "_" + sub.content())
+		if err != nil {
+			return err
+		}
+		if n.name == "msub" {
+			*out = append(*out, token{kind: tokIdent, text: name})
+			return nil
+		}
+		*out = append(*out, opToken("("), token{kind: tokIdent, text: name}, opToken("^"))
+		if err := group(n.children[2]); err != nil {
+			return err
+		}
+		*out = append(*out, opToken(")"))
+	case "mspace", "annotation", "annotation-xml", "none":
+	default:
+		return fmt.Errorf("unsupported element <%s>", n.name)
+	}
+	return nil
+}
+
+// rowTokens emits the tokens of a row of siblings. A function name followed
+// by a bare (unparenthesized) argument, as in <mi>sin</mi><mo>&#x2061;</mo>
+// <mi>x</mi>, gets explicit call parentheses.
+func rowTokens(children []*mathNode, out *[]token) error {
+	for i := 0; i < len(children); i++ {
+		c := children[i]
+		if c.name == "mi" && isFuncName(c.content()) {
+			*out = append(*out, token{kind: tokIdent, text: c.content()})
+			j := i + 1
+			if j < len(children) && children[j].name == "mo" && children[j].content() == "⁡" {
+				j++
+			}
+			if j < len(children) && !(children[j].name == "mo" && children[j].content() == "(") && !parenRow(children[j]) {
+				*out = append(*out, opToken("("))
+				if err := presentationTokens(children[j], out); err != nil {
+					return err
+				}
+				*out = append(*out, opToken(")"))
+				i = j
+			}
+			continue
+		}
+		if err := presentationTokens(c, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parenRow reports whether n is an <mrow> enclosed in one pair of
+// parentheses, such as the argument list (x, 2) of a function call.
+func parenRow(n *mathNode) bool {
+	if n.name != "mrow" || len(n.children) < 2 {
+		return false
+	}
+	depth := 0
+	for i, c := range n.children {
+		if c.name == "mo" && c.content() == "(" {
+			depth++
+		} else if c.name == "mo" && c.content() == ")" {
+			depth--
+		}
+		if (depth == 0) != (i == len(n.children)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+func isFuncName(name string) bool { return name == "sqrt" || lookupFunc(name) != nil }
+
+// insertImplicitTimes adds "*" between juxtaposed operands such as 2x or
+// x(y+1), leaving function calls f(x) alone.
+func insertImplicitTimes(toks []token) []token {
+	var out []token
+	for i, t := range toks {
+		if i > 0 {
+			prev := toks[i-1]
+			endsOperand := prev.kind == tokNum || prev.kind == tokIdent || (prev.kind == tokOp && prev.text == ")")
+			startsOperand := t.kind == tokNum || t.kind == tokIdent || (t.kind == tokOp && t.text == "(")
+			isCall := prev.kind == tokIdent && isFuncName(prev.text) && t.kind == tokOp && t.text == "("
+			if endsOperand && startsOperand && !isCall {
+				out = append(out, opToken("*"))
+			}
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// contentOperators maps content MathML operator elements to function names.
+var contentOperators = map[string]string{
+	"sin": "sin", "cos": "cos", "tan": "tan", "exp": "exp", "ln": "ln",
+	"abs": "abs", "arcsin": "asin", "arccos": "acos", "arctan": "atan",
+	"sinh": "sinh", "cosh": "cosh", "tanh": "tanh",
+}
+
+// contentExpr converts content markup into an expression.
+func contentExpr(n *mathNode) (Expr, error) {
+	switch n.name {
+	case "math", "semantics", "mrow":
+		var kids []*mathNode
+		for _, c := range n.children {
+			if c.name != "annotation" && c.name != "annotation-xml" {
+				kids = append(kids, c)
+			}
+		}
+		if len(kids) != 1 {
+			return nil, fmt.Errorf("<%s> must contain exactly one expression", n.name)
+		}
+		return contentExpr(kids[0])
+	case "cn":
+		return contentNumber(n)
+	case "ci", "csymbol":
+		name, err := mathMLName(n.content())
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := constants[name]; ok {
+			return c, nil
+		}
+		return S(name), nil
+	case "pi":
+		return Pi, nil
+	case "exponentiale":
+		return E, nil
+	case "apply":
+		return contentApply(n)
+	}
+	return nil, fmt.Errorf("unsupported element <%s>", n.name)
+}
+
+func contentNumber(n *mathNode) (Expr, error) {
+	parts := make([]string, len(n.text))
+	for i, t := range n.text {
+		parts[i] = strings.TrimSpace(t)
+	}
+	num := func(s string) (*big.Rat, error) {
+		if end, err := scanNumber(s, 0); err != nil || end != len(s) || s == "" {
+			return nil, fmt.Errorf("malformed number %q", s)
+		}
+		r, _ := new(big.Rat).SetString(s)
+		return r, nil
+	}
+	switch n.attrs["type"] {
+	case "rational", "e-notation":
+		if len(n.children) != 1 || n.children[0].name != "sep" {
+			return nil, fmt.Errorf("<cn type=%q> needs a <sep/>", n.attrs["type"])
+		}
+		a, err := num(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := num(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if n.attrs["type"] == "rational" {
+			if b.Sign() == 0 {
+				return nil, fmt.Errorf("rational with zero denominator")
+			}
+			return numRat(a.Quo(a, b)), nil
+		}
+		if !b.IsInt() || !b.Num().IsInt64() || b.Num().Int64() > maxExactExponent || b.Num().Int64() < -maxExactExponent {
+			return nil, fmt.Errorf("unsupported exponent %s", parts[1])
+		}
+		p, _ := ratPow(big.NewRat(10, 1), b)
+		return numRat(a.Mul(a, p)), nil
+	}
+	r, err := num(n.content())
+	if err != nil {
+		return nil, err
+	}
+	return numRat(r), nil
+}
+
+func contentApply(n *mathNode) (Expr, error) {
+	if len(n.children) == 0 {
+		return nil, fmt.Errorf("empty <apply>")
+	}
+	head := n.children[0]
+	var args []Expr
+	var degree, logbase Expr
+	for _, c := range n.children[1:] {
+		switch c.name {
+		case "degree", "logbase":
+			if len(c.children) != 1 {
+				return nil, fmt.Errorf("<%s> must contain one expression", c.name)
+			}
+			q, err := contentExpr(c.children[0])
+			if err != nil {
+				return nil, err
+			}
+			if c.name == "degree" {
+				degree = q
+			} else {
+				logbase = q
+			}
+			continue
+		}
+		a, err := contentExpr(c)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+	}
+	need := func(k int) error {
+		if len(args) != k {
+			return fmt.Errorf("<%s/> expects %d arguments, got %d", head.name, k, len(args))
+		}
+		return nil
+	}
+	switch head.name {
+	case "plus":
+		if len(args) == 0 {
+			return N(0), nil
+		}
+		return &Add{terms: args}, nil
+	case "times":
+		if len(args) == 0 {
+			return N(1), nil
+		}
+		return &Mul{factors: args}, nil
+	case "minus":
+		switch len(args) {
+		case 1:
+			return Neg(args[0]), nil
+		case 2:
+			return sub(args[0], args[1]), nil
+		}
+		return nil, fmt.Errorf("<minus/> expects 1 or 2 arguments, got %d", len(args))
+	case "divide":
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		return div(args[0], args[1]), nil
+	case "power":
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		return &Pow{base: args[0], exp: args[1]}, nil
+	case "root":
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		if degree == nil {
+			return SqrtOf(args[0]), nil
+		}
+		return &Pow{base: args[0], exp: &Pow{base: degree, exp: N(-1)}}, nil
+	case "eq", "neq", "lt", "leq", "gt", "geq":
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		ops := map[string]RelOp{"eq": RelEq, "neq": RelNe, "lt": RelLt, "leq": RelLe, "gt": RelGt, "geq": RelGe}
+		return Rel(args[0], ops[head.name], args[1]), nil
+	case "log":
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		if logbase == nil {
+			logbase = N(10)
+		}
+		return LogOf(args[0], logbase), nil
+	case "ci", "csymbol":
+		name := head.content()
+		if lookupFunc(name) == nil {
+			return nil, fmt.Errorf("unknown function %q", name)
+		}
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		return &Func{name: name, args: []Expr{args[0]}}, nil
+	}
+	if name, ok := contentOperators[head.name]; ok {
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		return &Func{name: name, args: []Expr{args[0]}}, nil
+	}
+	return nil, fmt.Errorf("unsupported operator <%s/>", head.name)
+}
+
+// ============================================================
+// MathML output
+// ============================================================
+
+// MathML renders e as presentation MathML inside a <math> element, in the
+// layout LaTeX uses: sums with explicit minus signs, fractions for
+// rational numbers, <msup> and <msqrt> for powers and function calls with
+// an apply-function operator. ParseMathML reads the result back for
+// expressions built from numbers, symbols, sums, products, powers and
+// registered functions.
+func MathML(e Expr) string {
+	var sb strings.Builder
+	sb.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML">`)
+	writeMathML(&sb, e)
+	sb.WriteString("</math>")
+	return sb.String()
+}
+
+// mathMLGreek maps Greek letter names to their characters, the inverse of
+// mathMLIdentifiers.
+var mathMLGreek = func() map[string]string {
+	out := map[string]string{}
+	for r, name := range mathMLIdentifiers {
+		if _, ok := out[name]; !ok && r != "ϕ" && r != "ⅇ" {
+			out[name] = r
+		}
+	}
+	return out
+}()
+
+func mlEscape(s string) string {
+	var sb strings.Builder
+	_ = xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
+
+func writeMathML(sb *strings.Builder, e Expr) {
+	el := func(tag, text string) { sb.WriteString("<" + tag + ">" + mlEscape(text) + "</" + tag + ">") }
+	paren := func(e Expr) {
+		sb.WriteString("<mrow><mo>(</mo>")
+		writeMathML(sb, e)
+		sb.WriteString("<mo>)</mo></mrow>")
+	}
+	switch t := e.(type) {
+	case *Annotated:
+		writeMathML(sb, t.expr)
+	case *Num:
+		num := new(big.Int).Set(t.val.Num())
+		if t.val.IsInt() && num.Sign() >= 0 {
+			el("mn", num.String())
+			return
+		}
+		sb.WriteString("<mrow>")
+		if num.Sign() < 0 {
+			el("mo", "-")
+			num.Neg(num)
+		}
+		if t.val.IsInt() {
+			el("mn", num.String())
+		} else {
+			sb.WriteString("<mfrac>")
+			el("mn", num.String())
+			el("mn", t.val.Denom().String())
+			sb.WriteString("</mfrac>")
+		}
+		sb.WriteString("</mrow>")
+	case *Sym:
+		name, sub := t.name, ""
+		if i := strings.Index(name, "_"); i > 0 && i < len(name)-1 {
+			name, sub = name[:i], name[i+1:]
+		}
+		if g, ok := mathMLGreek[name]; ok && sub == "" {
+			name = g
+		}
+		if sub == "" {
+			el("mi", name)
+			return
+		}
+		sb.WriteString("<msub>")
+		el("mi", name)
+		if _, err := strconv.Atoi(sub); err == nil {
+			el("mn", sub)
+		} else {
+			el("mi", sub)
+		}
+		sb.WriteString("</msub>")
+	case *Const:
+		switch t {
+		case Pi:
+			el("mi", "π")
+		case E:
+			el("mi", "ⅇ")
+		case Inf:
+			el("mi", "∞")
+		default:
+			el("mi", t.name)
+		}
+	case *Add:
+		sb.WriteString("<mrow>")
+		for i, term := range t.terms {
+			if pos, ok := negatedTerm(term); ok && i > 0 {
+				el("mo", "-")
+				if _, sum := pos.(*Add); sum {
+					paren(pos)
+				} else {
+					writeMathML(sb, pos)
+				}
+				continue
+			}
+			if i > 0 {
+				el("mo", "+")
+			}
+			writeMathML(sb, term)
+		}
+		sb.WriteString("</mrow>")
+	case *Mul:
+		sb.WriteString("<mrow>")
+		fs := t.factors
+		if len(fs) > 1 && isNumValue(fs[0], -1) {
+			fs = fs[1:]
+			el("mo", "-")
+		}
+		for i, f := range fs {
+			if i > 0 {
+				el("mo", "⁢")
+			}
+			switch v := bare(f).(type) {
+			case *Add:
+				paren(f)
+			case *Num:
+				if i > 0 && v.Sign() < 0 {
+					paren(f)
+				} else {
+					writeMathML(sb, f)
+				}
+			default:
+				writeMathML(sb, f)
+			}
+		}
+		sb.WriteString("</mrow>")
+	case *Pow:
+		if isNumValue(t.exp, 0.5) {
+			sb.WriteString("<msqrt>")
+			writeMathML(sb, t.base)
+			sb.WriteString("</msqrt>")
+			return
+		}
+		sb.WriteString("<msup>")
+		if powBaseNeedsParens(t.base) {
+			paren(t.base)
+		} else {
+			writeMathML(sb, t.base)
+		}
+		writeMathML(sb, t.exp)
+		sb.WriteString("</msup>")
+	case *Func:
+		sb.WriteString("<mrow>")
+		el("mi", t.name)
+		el("mo", "⁡")
+		sb.WriteString("<mrow><mo>(</mo>")
+		for i, a := range t.args {
+			if i > 0 {
+				el("mo", ",")
+			}
+			writeMathML(sb, a)
+		}
+		sb.WriteString("<mo>)</mo></mrow></mrow>")
+	case *Integral:
+		sb.WriteString("<mrow><msubsup><mo>∫</mo>")
+		writeMathML(sb, t.lo)
+		writeMathML(sb, t.hi)
+		sb.WriteString("</msubsup>")
+		writeMathML(sb, t.integrand)
+		sb.WriteString("<mo>⁢</mo><mi>d</mi>")
+		writeMathML(sb, S(t.v))
+		sb.WriteString("</mrow>")
+	case *Sum, *Product:
+		k, term, rest := t.(binder).binding()
+		op := "∑"
+		if _, ok := t.(*Product); ok {
+			op = "∏"
+		}
+		sb.WriteString("<mrow><munderover><mo>" + op + "</mo><mrow>")
+		writeMathML(sb, S(k))
+		el("mo", "=")
+		writeMathML(sb, rest[0])
+		sb.WriteString("</mrow>")
+		writeMathML(sb, rest[1])
+		sb.WriteString("</munderover>")
+		writeMathML(sb, term)
+		sb.WriteString("</mrow>")
+	case *Piecewise:
+		sb.WriteString("<mrow><mo>{</mo><mtable>")
+		for _, c := range t.cases {
+			sb.WriteString("<mtr><mtd>")
+			writeMathML(sb, c.Value)
+			sb.WriteString("</mtd><mtd><mtext>if </mtext>")
+			if r, ok := c.Cond.chain(); ok {
+				writeMathML(sb, r)
+			} else {
+				writeMathML(sb, c.Cond.Lhs)
+				el("mo", relOpMathML[c.Cond.Op])
+				writeMathML(sb, c.Cond.Rhs)
+			}
+			sb.WriteString("</mtd></mtr>")
+		}
+		sb.WriteString("<mtr><mtd>")
+		writeMathML(sb, t.otherwise)
+		sb.WriteString("</mtd><mtd><mtext>otherwise</mtext></mtd></mtr></mtable></mrow>")
+	case *Delta:
+		sb.WriteString("<msub><mi>δ</mi><mrow>")
+		writeMathML(sb, t.i)
+		el("mo", ",")
+		writeMathML(sb, t.j)
+		sb.WriteString("</mrow></msub>")
+	case *Relational:
+		sb.WriteString("<mrow>")
+		for i, s := range t.sides {
+			if i > 0 {
+				el("mo", relOpMathML[t.ops[i-1]])
+			}
+			writeMathML(sb, s)
+		}
+		sb.WriteString("</mrow>")
+	case *WildSym:
+		sb.WriteString("<msub>")
+		el("mi", t.name)
+		el("mo", "*")
+		sb.WriteString("</msub>")
+	case *UndefFunc:
+		sb.WriteString("<mrow>")
+		if t.order > 0 {
+			sb.WriteString("<msup>")
+			el("mi", t.name)
+			el("mo", strings.Repeat("′", t.order))
+			sb.WriteString("</msup>")
+		} else {
+			el("mi", t.name)
+		}
+		el("mo", "⁡")
+		paren(t.arg)
+		sb.WriteString("</mrow>")
+	default:
+		el("mtext", e.String())
+	}
+}
+
+// ============================================================
+// RPN (postfix) input and output
+// ============================================================
+
+// ParseRPN parses a whitespace-separated postfix expression such as
+// "x 2 ^ 3 x * +". Operands are numbers (integers, decimals, scientific
+// literals and signed fractions like -3/4) and identifiers; the binary
+// operators are + - * / ^, "neg" negates the top of the stack, and any
+// registered function name (or sqrt) is applied to it. Since RPN has no
+// precedence or grouping, it is a safe format for machine-generated input.
+// Errors are *ParseError values carrying the byte offset of the token.
+func ParseRPN(input string) (_ Expr, err error) {
+	defer func() { err = located(input, err) }()
+	if err := checkParseLen(input); err != nil {
+		return nil, err
+	}
+	var stack []Expr
+	i := 0
+	for {
+		for i < len(input) && unicode.IsSpace(rune(input[i])) {
+			i++
+		}
+		if i == len(input) {
+			break
+		}
+		start := i
+		for i < len(input) && !unicode.IsSpace(rune(input[i])) {
+			i++
+		}
+		word := input[start:i]
+		pop := func(k int) ([]Expr, error) {
+			if len(stack) < k {
+				return nil, &ParseError{Pos: start, Msg: fmt.Sprintf("%q needs %d operand(s), stack has %d", word, k, len(stack))}
+			}
+			args := stack[len(stack)-k:]
+			stack = stack[:len(stack)-k]
+			return args, nil
+		}
+		switch {
+		case len(word) == 1 && strings.IndexByte("+-*/^", word[0]) >= 0:
+			args, err := pop(2)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, rpnBinary(word[0], args[0], args[1]))
+		case word == "neg":
+			args, err := pop(1)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, Neg(args[0]))
+		case isRPNNumber(word):
+			n, err := parseRPNNumber(word, start)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, n)
+		case constants[word] != nil:
+			stack = append(stack, constants[word])
+		case isIdentifier(word):
+			if !isFuncName(word) {
+				stack = append(stack, S(word))
+				continue
+			}
+			k := 1
+			if def := lookupFunc(word); def != nil {
+				k = def.arity()
+			}
+			args, err := pop(k)
+			if err != nil {
+				return nil, err
+			}
+			f, err := parseCall(token{kind: tokIdent, text: word, pos: start}, append([]Expr(nil), args...))
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, f)
+		default:
+			return nil, &ParseError{Pos: start, Msg: fmt.Sprintf("unexpected token %q", word)}
+		}
+	}
+	switch len(stack) {
+	case 0:
+		return nil, &ParseError{Pos: len(input), Msg: "empty expression"}
+	case 1:
+		return stack[0], nil
+	}
+	return nil, &ParseError{Pos: len(input), Msg: fmt.Sprintf("%d values left on the stack, want 1", len(stack))}
+}
+
+// rpnBinary applies a binary RPN operator. Repeated + and * extend the
+// left operand's sum or product so that ToRPN output parses back to the
+// same n-ary node.
+func rpnBinary(op byte, a, b Expr) Expr {
+	switch op {
+	case '+':
+		if s, ok := a.(*Add); ok {
+			return &Add{terms: append(append([]Expr{}, s.terms...), b)}
+		}
+		return &Add{terms: []Expr{a, b}}
+	case '*':
+		if m, ok := a.(*Mul); ok {
+			return &Mul{factors: append(append([]Expr{}, m.factors...), b)}
+		}
+		return &Mul{factors: []Expr{a, b}}
+	case '-':
+		return sub(a, b)
+	case '/':
+		return div(a, b)
+	}
+	return &Pow{base: a, exp: b}
+}
+
+func isRPNNumber(word string) bool {
+	if word[0] == '-' || word[0] == '+' {
+		word = word[1:]
+	}
+	return word != "" && (isDigit(word[0]) || word[0] == '.')
+}
+
+// parseRPNNumber reads [sign] literal [ "/" literal ] as an exact rational.
+func parseRPNNumber(word string, pos int) (Expr, error) {
+	body := word
+	if body[0] == '-' || body[0] == '+' {
+		body = body[1:]
+	}
+	parts := strings.Split(body, "/")
+	if len(parts) > 2 {
+		return nil, &ParseError{Pos: pos, Msg: fmt.Sprintf("malformed number %q", word)}
+	}
+	vals := make([]*big.Rat, len(parts))
+	for k, part := range parts {
+		end, err := scanNumber(part, 0)
+		r, ok := new(big.Rat).SetString(part)
+		if err != nil || end != len(part) || !ok {
+			return nil, &ParseError{Pos: pos, Msg: fmt.Sprintf("malformed number %q", word)}
+		}
+		vals[k] = r
+	}
+	r := vals[0]
+	if len(vals) == 2 {
+		if vals[1].Sign() == 0 {
+			return nil, &ParseError{Pos: pos, Msg: fmt.Sprintf("zero denominator in %q", word)}
+		}
+		r.Quo(r, vals[1])
+	}
+	if word[0] == '-' {
+		r.Neg(r)
+	}
+	return numRat(r), nil
+}
+
+// ToRPN renders e in the postfix form read by ParseRPN. Numbers are written
+// as exact (possibly signed, fractional) literals, so ParseRPN(ToRPN(e))
+// reproduces e. The format has only numbers, symbols, constants, + * ^ and
+// functions; it is an error for e to contain other nodes, such as
+// relations, Piecewise, sums, integrals or undefined functions.
+func ToRPN(e Expr) (string, error) {
+	var b strings.Builder
+	if err := writeRPN(&b, e); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func writeRPN(b *strings.Builder, e Expr) error {
+	word := func(s string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(s)
+	}
+	nary := func(args []Expr, op string) error {
+		for i, a := range args {
+			if err := writeRPN(b, a); err != nil {
+				return err
+			}
+			if i > 0 {
+				word(op)
+			}
+		}
+		return nil
+	}
+	switch v := e.(type) {
+	case *Num:
+		word(v.val.RatString())
+	case *Sym:
+		word(v.name)
+	case *Const:
+		word(v.name)
+	case *Add:
+		return nary(v.terms, "+")
+	case *Mul:
+		return nary(v.factors, "*")
+	case *Pow:
+		if err := nary([]Expr{v.base, v.exp}, "^"); err != nil {
+			return err
+		}
+	case *Func:
+		for _, a := range v.args {
+			if err := writeRPN(b, a); err != nil {
+				return err
+			}
+		}
+		word(v.name)
+	case *Annotated:
+		return writeRPN(b, v.expr)
+	default:
+		return fmt.Errorf("rpn: %s has no postfix form", e)
+	}
+	return nil
+}
+
+// ============================================================
+// Serialization
+// ============================================================
+
+// ToJSON serializes e as a JSON expression tree.
+func ToJSON(e Expr) (string, error) {
+	b, err := json.Marshal(e.toJSON())
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// FromJSON builds an expression from a decoded JSON expression tree.
+func FromJSON(m map[string]interface{}) (Expr, error) {
+	typ, _ := m["type"].(string)
+	switch typ {
+	case "num":
+		switch v := m["value"].(type) {
+		case string:
+			r, ok := new(big.Rat).SetString(v)
+			if !ok {
+				return nil, fmt.Errorf("invalid num value %q", v)
+			}
+			return numRat(r), nil
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("invalid num value %v", v)
+			}
+			return NFloat(v), nil
+		}
+		return nil, fmt.Errorf("num: missing value")
+	case "sym":
+		name, _ := m["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("sym: missing name")
+		}
+		return S(name), nil
+	case "const":
+		name, _ := m["name"].(string)
+		c, ok := constants[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown constant %q", name)
+		}
+		return c, nil
+	case "add", "mul":
+		key := "terms"
+		if typ == "mul" {
+			key = "factors"
+		}
+		raw, ok := m[key].([]interface{})
+		if !ok || len(raw) == 0 {
+			return nil, fmt.Errorf("%s: missing %s", typ, key)
+		}
+		args := make([]Expr, len(raw))
+		for i, r := range raw {
+			child, ok := r.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: %s[%d] is not an expression", typ, key, i)
+			}
+			e, err := FromJSON(child)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = e
+		}
+		if typ == "add" {
+			return &Add{terms: args}, nil
+		}
+		return &Mul{factors: args}, nil
+	case "pow":
+		base, err := childJSON(m, "base")
+		if err != nil {
+			return nil, err
+		}
+		exp, err := childJSON(m, "exp")
+		if err != nil {
+			return nil, err
+		}
+		return &Pow{base: base, exp: exp}, nil
+	case "func":
+		name, _ := m["name"].(string)
+		if name == "sqrt" {
+			arg, err := childJSON(m, "arg")
+			if err != nil {
+				return nil, err
+			}
+			return SqrtOf(arg), nil
+		}
+		def := lookupFunc(name)
+		if def == nil {
+			return nil, fmt.Errorf("func: unknown function %q", name)
+		}
+		if def.arity() == 1 {
+			arg, err := childJSON(m, "arg")
+			if err != nil {
+				return nil, err
+			}
+			return &Func{name: name, args: []Expr{arg}}, nil
+		}
+		raw, _ := m["args"].([]interface{})
+		if len(raw) != def.arity() {
+			return nil, fmt.Errorf("func: %s takes %d arguments, got %d", name, def.arity(), len(raw))
+		}
+		args := make([]Expr, len(raw))
+		for i, r := range raw {
+			child, ok := r.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("func: args[%d] is not an expression", i)
+			}
+			e, err := FromJSON(child)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = e
+		}
+		return &Func{name: name, args: args}, nil
+	case "integral":
+		v, _ := m["var"].(string)
+		if v == "" {
+			return nil, fmt.Errorf("integral: missing var")
+		}
+		var parts [3]Expr
+		for k, key := range []string{"integrand", "lo", "hi"} {
+			e, err := childJSON(m, key)
+			if err != nil {
+				return nil, err
+			}
+			parts[k] = e
+		}
+		return &Integral{integrand: parts[0], v: v, lo: parts[1], hi: parts[2]}, nil
+	case "sum", "product":
+		k, _ := m["index"].(string)
+		if k == "" {
+			return nil, fmt.Errorf("%s: missing index", typ)
+		}
+		var parts [3]Expr
+		for i, key := range []string{"term", "lo", "hi"} {
+			e, err := childJSON(m, key)
+			if err != nil {
+				return nil, err
+			}
+			parts[i] = e
+		}
+		if typ == "sum" {
+			return &Sum{term: parts[0], k: k, lo: parts[1], hi: parts[2]}, nil
+		}
+		return &Product{term: parts[0], k: k, lo: parts[1], hi: parts[2]}, nil
+	case "lambda":
+		v, _ := m["var"].(string)
+		if v == "" {
+			return nil, fmt.Errorf("lambda: missing var")
+		}
+		body, err := childJSON(m, "body")
+		if err != nil {
+			return nil, err
+		}
+		return &Lambda{v: v, body: body}, nil
+	case "wild":
+		name, _ := m["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("wild: missing name")
+		}
+		raw, _ := m["exclude"].([]interface{})
+		exclude := make([]string, len(raw))
+		for i, r := range raw {
+			s, ok := r.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("wild: exclude[%d]: expected a symbol name", i)
+			}
+			exclude[i] = s
+		}
+		return Wild(name, exclude...), nil
+	case "function":
+		name, _ := m["name"].(string)
+		if !isIdentifier(name) || name == "sqrt" || lookupFunc(name) != nil {
+			return nil, fmt.Errorf("function: %q is not a free function name", name)
+		}
+		order, ok := m["order"].(float64)
+		if _, set := m["order"]; set && (!ok || order < 0 || order > maxFunctionOrder || order != math.Trunc(order)) {
+			return nil, fmt.Errorf("function: order must be an integer from 0 to %d", maxFunctionOrder)
+		}
+		arg, err := childJSON(m, "arg")
+		if err != nil {
+			return nil, err
+		}
+		return &UndefFunc{name: name, order: int(order), arg: arg}, nil
+	case "delta":
+		i, err := childJSON(m, "i")
+		if err != nil {
+			return nil, err
+		}
+		j, err := childJSON(m, "j")
+		if err != nil {
+			return nil, err
+		}
+		return KroneckerDelta(i, j), nil
+	case "relational":
+		if raw, ok := m["sides"].([]interface{}); ok {
+			rawOps, _ := m["ops"].([]interface{})
+			if len(raw) < 3 || len(rawOps) != len(raw)-1 {
+				return nil, fmt.Errorf("relational: %d sides need %d ops, got %d", len(raw), len(raw)-1, len(rawOps))
+			}
+			sides := make([]Expr, len(raw))
+			for i, r := range raw {
+				sm, ok := r.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("relational: side %d is not an object", i)
+				}
+				s, err := FromJSON(sm)
+				if err != nil {
+					return nil, err
+				}
+				sides[i] = s
+			}
+			ops := make([]RelOp, len(rawOps))
+			for i, r := range rawOps {
+				op, ok := relOpNamed(r)
+				if !ok {
+					return nil, fmt.Errorf("relational: unknown op %v", r)
+				}
+				ops[i] = op
+			}
+			return Chain(sides, ops...), nil
+		}
+		lhs, err := childJSON(m, "lhs")
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := childJSON(m, "rhs")
+		if err != nil {
+			return nil, err
+		}
+		op, ok := relOpNamed(m["op"])
+		if !ok {
+			return nil, fmt.Errorf("relational: unknown op %v", m["op"])
+		}
+		return Rel(lhs, op, rhs), nil
+	case "piecewise":
+		raw, _ := m["cases"].([]interface{})
+		cases := make([]PieceCase, len(raw))
+		for i, r := range raw {
+			c, ok := r.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("piecewise: case %d is not an object", i)
+			}
+			var parts [3]Expr
+			for k, key := range []string{"value", "lhs", "rhs"} {
+				sub, ok := c[key].(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("piecewise: case %d: missing %s", i, key)
+				}
+				e, err := FromJSON(sub)
+				if err != nil {
+					return nil, err
+				}
+				parts[k] = e
+			}
+			op, ok := relOpNamed(c["op"])
+			if !ok {
+				return nil, fmt.Errorf("piecewise: case %d: unknown op %v", i, c["op"])
+			}
+			cases[i] = PieceCase{parts[0], Cond{parts[1], op, parts[2]}}
+		}
+		otherwise, err := childJSON(m, "otherwise")
+		if err != nil {
+			return nil, err
+		}
+		return PiecewiseOf(cases, otherwise), nil
+	case "annotated":
+		inner, err := childJSON(m, "expr")
+		if err != nil {
+			return nil, err
+		}
+		var meta Meta
+		if raw, ok := m["meta"]; ok {
+			b, _ := json.Marshal(raw)
+			if err := json.Unmarshal(b, &meta); err != nil {
+				return nil, fmt.Errorf("annotated: meta: %w", err)
+			}
+		}
+		return &Annotated{expr: inner, meta: meta}, nil
+	}
+	return nil, fmt.Errorf("unknown expression type %q", typ)
+}
+
+func childJSON(m map[string]interface{}, key string) (Expr, error) {
+	sub, ok := m[key].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: missing %s", m["type"], key)
+	}
+	return FromJSON(sub)
+}
+
+// ============================================================
+// Expression store
+// ============================================================
+
+// ExprStore is a content-addressable set of expressions. Each expression
+// is stored in simplified form under an ID derived from a hash of its JSON
+// encoding, so structurally identical expressions share one entry and can
+// be referenced by a short, stable ID. An ExprStore is safe for concurrent
+// use.
+type ExprStore struct {
+	mu  sync.RWMutex
+	m   map[string]Expr
+	dir string
+}
+
+// exprIDLen is the number of hex digits of the SHA-256 hash used as an ID.
+const exprIDLen = 16
+
+// NewExprStore returns an empty in-memory store.
+func NewExprStore() *ExprStore { return &ExprStore{m: map[string]Expr{}} }
+
+// OpenExprStore returns a store persisted in dir, one <id>.json file per
+// expression, creating the directory if needed. Entries written by earlier
+// processes are loaded on first access.
+func OpenExprStore(dir string) (*ExprStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &ExprStore{m: map[string]Expr{}, dir: dir}, nil
+}
+
+// ExprID returns the ID under which an ExprStore files e.
+func ExprID(e Expr) string {
+	id, _ := exprID(e.Simplify())
+	return id
+}
+
+func exprID(e Expr) (string, []byte) {
+	b, err := json.Marshal(e.toJSON())
+	if err != nil {
+		panic(fmt.Sprintf("gosymbol: marshal expression: %v", err))
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])[:exprIDLen], b
+}
+
+// Put stores e (simplified) and returns its ID. Storing an expression that
+// is already present is a no-op. The error is non-nil only if writing to
+// disk fails.
+func (s *ExprStore) Put(e Expr) (string, error) {
+	e = e.Simplify()
+	id, data := exprID(e)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[id]; ok {
+		return id, nil
+	}
+	if s.dir != "" {
+		if err := writeFileAtomic(filepath.Join(s.dir, id+".json"), data); err != nil {
+			return "", err
+		}
+	}
+	s.m[id] = e
+	return id, nil
+}
+
+// Get returns the expression stored under id. An entry on disk whose
+// content does not hash to id is treated as missing.
+func (s *ExprStore) Get(id string) (Expr, bool) {
+	s.mu.RLock()
+	e, ok := s.m[id]
+	s.mu.RUnlock()
+	if ok || s.dir == "" || !isExprID(id) {
+		return e, ok
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, id+".json"))
+	if err != nil {
+		return nil, false
+	}
+	// A file edited or renamed since Put no longer hashes to its ID.
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:])[:exprIDLen] != id {
+		return nil, false
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, false
+	}
+	if e, err = FromJSON(m); err != nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	s.m[id] = e
+	s.mu.Unlock()
+	return e, true
+}
+
+// Len returns the number of expressions held in memory.
+func (s *ExprStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.m)
+}
+
+// isExprID reports whether id has the shape of an ID, which keeps Get from
+// reading arbitrary paths.
+func isExprID(id string) bool {
+	if len(id) != exprIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if !isDigit(id[i]) && (id[i] < 'a' || id[i] > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ============================================================
+// Worksheets
+// ============================================================
+
+// worksheetFormat tags the JSON encoding of a Worksheet.
+const worksheetFormat = "gosymbol-worksheet"
+
+// WorksheetEntry is one named input of a Worksheet and its result.
+type WorksheetEntry struct {
+	Name   string
+	Input  string
+	Result Expr
+}
+
+// Worksheet is a sequence of named inputs and their results, as typed in
+// an interactive session. Inputs may refer to the names of earlier
+// entries. A worksheet saves to and loads from JSON, so a session can be
+// resumed or shared:
+//
+//	{"format": "gosymbol-worksheet", "version": 1, "entries": [
+//	    {"name": "f", "input": "x^2 + 1", "result": <EXPR>, "string": "x^2 + 1"}, ...]}
+//
+// A Worksheet is not safe for concurrent use.
+type Worksheet struct {
+	entries []WorksheetEntry
+}
+
+// NewWorksheet returns an empty worksheet.
+func NewWorksheet() *Worksheet { return &Worksheet{} }
+
+// Eval parses input, replaces the names of earlier entries by their
+// results, simplifies, and records the result under name. An empty name
+// becomes out1, out2, … by position. Names are replaced by the results
+// they have when input is evaluated, so redefining a name, which adds an
+// entry, affects only later inputs.
+func (w *Worksheet) Eval(name, input string) (Expr, error) {
+	if name == "" {
+		name = fmt.Sprintf("out%d", len(w.entries)+1)
+	}
+	if !isVariableName(name) {
+		return nil, fmt.Errorf("worksheet: invalid name %q", name)
+	}
+	e, err := Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	defs := map[string]Expr{}
+	for _, s := range FreeSymbols(e) {
+		if r, ok := w.Lookup(s); ok {
+			defs[s] = r
+		}
+	}
+	r := SubMap(e, defs)
+	w.entries = append(w.entries, WorksheetEntry{Name: name, Input: input, Result: r})
+	return r, nil
+}
+
+// Lookup returns the result of the newest entry named name.
+func (w *Worksheet) Lookup(name string) (Expr, bool) {
+	for i := len(w.entries) - 1; i >= 0; i-- {
+		if w.entries[i].Name == name {
+			return w.entries[i].Result, true
+		}
+	}
+	return nil, false
+}
+
+// Entries returns a copy of the entries in order.
+func (w *Worksheet) Entries() []WorksheetEntry { return append([]WorksheetEntry(nil), w.entries...) }
+
+func (w *Worksheet) toJSON() map[string]interface{} {
+	entries := make([]interface{}, len(w.entries))
+	for i, en := range w.entries {
+		entries[i] = map[string]interface{}{
+			"name": en.Name, "input": en.Input, "result": en.Result.toJSON(), "string": en.Result.String(),
+		}
+	}
+	return map[string]interface{}{"format": worksheetFormat, "version": 1, "entries": entries}
+}
+
+// worksheetFromJSON decodes the JSON form of a worksheet. An entry without a
+// result is evaluated from its input.
+func worksheetFromJSON(m map[string]interface{}) (*Worksheet, error) {
+	if f, _ := m["format"].(string); f != worksheetFormat {
+		return nil, fmt.Errorf("worksheet: format %q, want %q", m["format"], worksheetFormat)
+	}
+	if v := fmt.Sprint(m["version"]); v != "1" {
+		return nil, fmt.Errorf("worksheet: unsupported version %v", m["version"])
+	}
+	raw, _ := m["entries"].([]interface{})
+	w := NewWorksheet()
+	for i, r := range raw {
+		en, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("worksheet: entry %d is not an object", i)
+		}
+		name, _ := en["name"].(string)
+		input, _ := en["input"].(string)
+		res, ok := en["result"].(map[string]interface{})
+		if !ok {
+			if _, err := w.Eval(name, input); err != nil {
+				return nil, fmt.Errorf("worksheet: entry %d: %w", i, err)
+			}
+			continue
+		}
+		e, err := FromJSON(res)
+		if err != nil {
+			return nil, fmt.Errorf("worksheet: entry %d: %w", i, err)
+		}
+		if !isVariableName(name) {
+			return nil, fmt.Errorf("worksheet: entry %d: invalid name %q", i, name)
+		}
+		w.entries = append(w.entries, WorksheetEntry{Name: name, Input: input, Result: e})
+	}
+	return w, nil
+}
+
+// MarshalJSON encodes w in the worksheet format.
+func (w *Worksheet) MarshalJSON() ([]byte, error) { return json.Marshal(w.toJSON()) }
+
+// UnmarshalJSON replaces w with the decoded worksheet.
+func (w *Worksheet) UnmarshalJSON(b []byte) error {
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	d, err := worksheetFromJSON(m)
+	if err != nil {
+		return err
+	}
+	*w = *d
+	return nil
+}
+
+// Save writes w to the file path, replacing it atomically.
+func (w *Worksheet) Save(path string) error {
+	b, err := json.MarshalIndent(w.toJSON(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(b, '\n'))
+}
+
+// LoadWorksheet reads a worksheet saved by Save.
+func LoadWorksheet(path string) (*Worksheet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	w := NewWorksheet()
+	if err := w.UnmarshalJSON(b); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// ============================================================
+// AI / MCP interface
+// ============================================================
+
+// ToolRequest is a tool invocation from an AI agent.
+type ToolRequest struct {
+	Tool   string                 `json:"tool"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// ToolResponse is the result of a tool invocation.
+type ToolResponse struct {
+	Result interface{} `json:"result"`
+	String string      `json:"string"`
+	LaTeX  string      `json:"latex"`
+	Error  string      `json:"error"`
+	// Partial is set when a budgeted tool such as simplify stopped early;
+	// Result is then the best value found so far.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// HandleToolCall dispatches an MCP-style tool call. Expression parameters
+// may be JSON expression trees or infix strings accepted by Parse. Every
+// tool also accepts an "assumptions" param in the JSON form of
+// Assumptions, and then runs as Engine.HandleToolCall of an engine with
+// those assumptions, and a "functions" param listing names that its
+// strings read as unknown functions, as ParseWithFunctions does.
+func HandleToolCall(req ToolRequest) (resp ToolResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp = ToolResponse{Error: fmt.Sprintf("internal error: %v", r)}
+		}
+	}()
+	p := req.Params
+	if raw, ok := p["assumptions"]; ok && raw != nil {
+		en, err := NewEngine(EngineConfig{})
+		if err != nil {
+			return errResponse(err)
+		}
+		return en.HandleToolCall(req)
+	}
+	switch req.Tool {
+	case "simplify":
+		e, err := exprParam(p, "expr")
+		if err != nil {
+			return errResponse(err)
+		}
+		var b SimplifyBudget
+		iterations := 0
+		for _, name := range []string{"max_nodes", "timeout_ms", "max_iterations"} {
+			f, err := numberParam(p, name, 0)
+			if err != nil {
+				return errResponse(err)
+			}
+			if f < 0 || f != math.Trunc(f) || f > 1e12 {
+				return ToolResponse{Error: fmt.Sprintf("param %s: expected a non-negative integer", name)}
+			}
+			switch name {
+			case "max_nodes":
+				b.MaxNodes = int(f)
+			case "timeout_ms":
+				b.Timeout = time.Duration(f) * time.Millisecond
+			default:
+				iterations = int(f)
+			}
+		}
+		if _, ok := p["strategies"]; ok {
+			strategies, err := strListParam(p, "strategies")
+			if err != nil {
+				return errResponse(err)
+			}
+			r, partial, err := SimplifyWith(e, SimplifyOpts{Strategies: strategies, MaxIterations: iterations, Timeout: b.Timeout})
+			if err != nil {
+				return errResponse(err)
+			}
+			resp := exprResponse(r)
+			resp.Partial = partial
+			return resp
+		}
+		r, partial := SimplifyBudgeted(e, b)
+		resp := exprResponse(r)
+		resp.Partial = partial
+		return resp
+	case "diff":
+		e, v, err := exprVarParams(p)
+		if err != nil {
+			return errResponse(err)
+		}
+		return exprResponse(Diff(e, v))
+	case "diff_steps":
+		e, v, err := exprVarParams(p)
+		if err != nil {
+			return errResponse(err)
+		}
+		return stepsResponse(DiffSteps(e, v))
+	case "integrate":
+		e, v, err := exprVarParams(p)
+		if err != nil {
+			return errResponse(err)
+		}
+		r, ok := Integrate(e, v)
+		if !ok {
+			return ToolResponse{Error: "integration failed: unsupported form"}
+		}
+		return exprResponse(r)
+	case "integrate_steps":
+		e, v, err := exprVarParams(p)
+		if err != nil {
+			return errResponse(err)
+		}
+		steps, ok := IntegrateSteps(e, v)
+		if !ok {
+			return ToolResponse{Error: "integration failed: unsupported form"}
+		}
+		return stepsResponse(steps)
+	case "simplify_steps":
+		e, err := exprParam(p, "expr")
+		if err != nil {
+			return errResponse(err)
+		}
+		return stepsResponse(SimplifySteps(e))
+	case "expand":
+		e, err := exprParam(p, "expr")
+		if err != nil {
+			return errResponse(err)
+		}
+		r, err := ExpandChecked(e)
+		if err != nil {
+			return errResponse(err)
+		}
+		return exprResponse(r)
+	case "factor":
+		e, err := exprParam(p, "expr")
+		if err != nil {
+			return errResponse(err)
+		}
+		if d := polyDegreeBound(e); d > MaxFactorDegree {
+			return errResponse(fmt.Errorf("factor: degree %d exceeds the limit %d", d, MaxFactorDegree))
+		}
+		return exprResponse(Factor(e))
+	case "substitute":
+		e, v, err := exprVarParams(p)
+		if err != nil {
+			return errResponse(err)
+		}
+		val, err := exprParam(p, "value")
+		if err != nil {
+			return errResponse(err)
+		}
+		return exprResponse(Sub(e, v, val))
+	case "to_latex":
+		e, err := exprParam(p, "expr")
+		if err != nil {
+			return errResponse(err)
+		}
+		return ToolResponse{Result: e.LaTeX(), String: e.String(), LaTeX: e.LaTeX()}
+	case "free_symbols":
+		e, err := exprParam(p, "expr")
+		if err != nil {
+			return errResponse(err)
+		}
+		names := FreeSymbols(e)
+		return ToolResponse{Result: names, String: strings.Join(names, ", ")}
+	case "fingerprint":
+		e, err := exprParam(p, "expr")
+		if err != nil {
+			return errResponse(err)
+		}
+		fp := fmt.Sprintf("%016x", Fingerprint(e))
+		return ToolResponse{Result: fp, String: fp}
+	case "degree":
+		e, v, err := exprVarParams(p)
+		if err != nil {
+			return errResponse(err)
+		}
+		d := Degree(e, v)
+		if d < 0 {
+			return ToolResponse{Error: fmt.Sprintf("not a polynomial in %s", v)}
+		}
+		return ToolResponse{Result: d, String: fmt.Sprint(d)}
+	case "solve_linear":
+		a, err := exprParam(p, "a")
+		if err != nil {
+			return errResponse(err)
+		}
+		b, err := exprParam(p, "b")
+		if err != nil {
+			return errResponse(err)
+		}
+		return solveResponse(SolveLinear(a, b))
+	case "solve_quadratic":
+		a, err := exprParam(p, "a")
+		if err != nil {
+			return errResponse(err)
+		}
+		b, err := exprParam(p, "b")
+		if err != nil {
+			return errResponse(err)
+		}
+		c, err := exprParam(p, "c")
+		if err != nil {
+			return errResponse(err)
+		}
+		return solveResponse(SolveQuadratic(a, b, c))
+	case "solve_steps":
+		eq, v, err := solveStepsParams(p)
+		if err != nil {
+			return errResponse(err)
+		}
+		return solveStepsResponse(SolveSteps(eq, v))
+	case "list_formulas":
+		category, _ := p["category"].(string)
+		names := RegisteredFormulas(category)
+		out := make([]map[string]interface{}, len(names))
+		for i, name := range names {
+			f, _ := LookupFormula(name)
+			out[i] = map[string]interface{}{
+				"name": f.Name, "category": f.Category, "description": f.Description,
+				"equation": f.Eq.String(), "units": f.Units,
+			}
+		}
+		return ToolResponse{Result: out, String: strings.Join(names, ", ")}
+	case "solve_formula":
+		name, err := strParam(p, "name")
+		if err != nil {
+			return errResponse(err)
+		}
+		raw, _ := p["knowns"].(map[string]interface{})
+		funcs, err := functionsParam(p)
+		if err != nil {
+			return errResponse(err)
+		}
+		knowns := make(map[string]Expr, len(raw))
+		for k := range raw {
+			if knowns[k], err = exprValue(raw[k], k, funcs); err != nil {
+				return errResponse(fmt.Errorf("knowns: %v", err))
+			}
+		}
+		sol, err := SolveFormula(name, knowns)
+		if err != nil {
+			return errResponse(err)
+		}
+		resp := solveResponse(SolveResult{Solutions: sol.Solutions, ExactForm: true, Conditions: sol.Conditions})
+		resp.Result = map[string]interface{}{"unknown": sol.Unknown, "unit": sol.Unit, "solutions": resp.Result}
+		resp.String = sol.Unknown + " = " + resp.String
+		resp.LaTeX = S(sol.Unknown).LaTeX() + " = " + resp.LaTeX
+		return resp
+	case "solve_system":
+		eqs, err := equationsParam(p, "equations")
+		if err != nil {
+			return errResponse(err)
+		}
+		vars, err := strListParam(p, "vars")
+		if err != nil {
+			return errResponse(err)
+		}
+		sol, err := SolveLinearSystem(eqs, vars)
+		if err != nil {
+			return errResponse(err)
+		}
+		out := make(map[string]interface{}, len(vars))
+		strs := make([]string, len(vars))
+		tex := make([]string, len(vars))
+		for i, v := range vars {
+			out[v] = sol[i].toJSON()
+			strs[i] = v + " = " + sol[i].String()
+			tex[i] = S(v).LaTeX() + " = " + sol[i].LaTeX()
+		}
+		return ToolResponse{Result: out, String: strings.Join(strs, ", "), LaTeX: strings.Join(tex, `,\ `)}
+	case "groebner":
+		eqs, err := equationsParam(p, "polys")
+		if err != nil {
+			return errResponse(err)
+		}
+		var order []string
+		if _, ok := p["order"]; ok {
+			if order, err = strListParam(p, "order"); err != nil {
+				return errResponse(err)
+			}
+		}
+		polys := make([]Expr, len(eqs))
+		for i, eq := range eqs {
+			polys[i] = eq.Residual()
+		}
+		g, err := GroebnerBasis(polys, order)
+		if err != nil {
+			return errResponse(err)
+		}
+		return listResponse(g)
+	case "matrix":
+		return matrixTool(p)
+	case "store":
+		return storeTool(defaultStore, p)
+	case "recall":
+		return recallTool(defaultStore, p)
+	case "worksheet_eval":
+		w := NewWorksheet()
+		if raw, ok := p["worksheet"]; ok && raw != nil {
+			m, ok := raw.(map[string]interface{})
+			if !ok {
+				return ToolResponse{Error: "param worksheet: expected an object"}
+			}
+			var err error
+			if w, err = worksheetFromJSON(m); err != nil {
+				return errResponse(err)
+			}
+		}
+		input, err := strParam(p, "input")
+		if err != nil {
+			return errResponse(err)
+		}
+		name, _ := p["name"].(string)
+		r, err := w.Eval(name, input)
+		if err != nil {
+			return errResponse(err)
+		}
+		name = w.entries[len(w.entries)-1].Name
+		return ToolResponse{
+			Result: map[string]interface{}{"name": name, "result": r.toJSON(), "worksheet": w.toJSON()},
+			String: name + " = " + r.String(),
+			LaTeX:  S(name).LaTeX() + " = " + r.LaTeX(),
+		}
+	case "taylor":
+		return taylorTool(p, nil)
+	case "find_root":
+		return findRootTool(p, nil)
+	case "ode_solve":
+		return odeTool(p, nil)
+	}
+	return ToolResponse{Error: fmt.Sprintf("unknown tool: %q", req.Tool)}
+}
+
+// matrixTool applies op to the matrix a, and b for add and mul. Matrix
+// results are reported as rows of JSON expressions, with the inline form
+// as the string.
+// defaultStore backs the store and recall tools of HandleToolCall.
+var defaultStore = NewExprStore()
+
+func storeTool(s *ExprStore, p map[string]interface{}) ToolResponse {
+	e, err := exprParam(p, "expr")
+	if err != nil {
+		return errResponse(err)
+	}
+	id, err := s.Put(e)
+	if err != nil {
+		return errResponse(fmt.Errorf("store: %w", err))
+	}
+	return ToolResponse{Result: id, String: id}
+}
+
+func recallTool(s *ExprStore, p map[string]interface{}) ToolResponse {
+	id, err := strParam(p, "id")
+	if err != nil {
+		return errResponse(err)
+	}
+	e, ok := s.Get(id)
+	if !ok {
+		return ToolResponse{Error: fmt.Sprintf("recall: no expression stored under %q", id)}
+	}
+	return exprResponse(e)
+}
+
+func matrixTool(p map[string]interface{}) ToolResponse {
+	op, err := strParam(p, "op")
+	if err != nil {
+		return errResponse(err)
+	}
+	a, err := matrixParam(p, "a")
+	if err != nil {
+		return errResponse(err)
+	}
+	var r interface{}
+	switch op {
+	case "add", "mul":
+		b, err := matrixParam(p, "b")
+		if err != nil {
+			return errResponse(err)
+		}
+		if op == "add" {
+			r, err = a.Add(b)
+		} else {
+			r, err = a.Mul(b)
+		}
+		if err != nil {
+			return errResponse(err)
+		}
+	case "det", "trace":
+		var e Expr
+		if op == "det" {
+			e, err = a.Det()
+		} else {
+			e, err = a.Trace()
+		}
+		if err != nil {
+			return errResponse(err)
+		}
+		r = e
+	case "adjugate":
+		if r, err = a.Adjugate(); err != nil {
+			return errResponse(err)
+		}
+	case "inverse":
+		if r, err = a.Inverse(); err != nil {
+			return errResponse(err)
+		}
+	case "transpose":
+		r = a.Transpose()
+	case "echelon":
+		r, _ = a.Echelon()
+	case "rank":
+		rank := a.Rank()
+		return ToolResponse{Result: rank, String: fmt.Sprint(rank), LaTeX: fmt.Sprint(rank)}
+	case "eigen":
+		eig, err := a.Eigen2x2()
+		if err != nil {
+			return errResponse(err)
+		}
+		return eigenResponse(eig)
+	default:
+		return ToolResponse{Error: fmt.Sprintf("param op: unknown matrix operation %q", op)}
+	}
+	if e, ok := r.(Expr); ok {
+		return exprResponse(e)
+	}
+	m := r.(Matrix)
+	rows := make([]interface{}, m.Rows())
+	for i := range rows {
+		rows[i] = exprsJSON(m.rows[i])
+	}
+	return ToolResponse{Result: rows, String: m.Inline(), LaTeX: m.LaTeX()}
+}
+
+// eigenResponse reports eig as {"values": [{"re", "im"}, …], "vectors":
+// [{"re": [x, y], "im": [x, y]}, …]}, with one "λk = …, vk = (…)" line per
+// eigenvalue as the string.
+func eigenResponse(eig Eigen2x2) ToolResponse {
+	complexStr := func(re, im Expr) string {
+		switch {
+		case isNumValue(im, 0):
+			return re.String()
+		case isNumValue(re, 0):
+			return "(" + im.String() + ")*i"
+		}
+		return re.String() + " + (" + im.String() + ")*i"
+	}
+	values := make([]interface{}, 2)
+	vectors := make([]interface{}, 2)
+	lines := make([]string, 2)
+	for k := range values {
+		re, im := eig.VectorRe[k], eig.VectorIm[k]
+		values[k] = map[string]interface{}{"re": eig.ValueRe[k].toJSON(), "im": eig.ValueIm[k].toJSON()}
+		vectors[k] = map[string]interface{}{"re": exprsJSON(re[:]), "im": exprsJSON(im[:])}
+		lines[k] = fmt.Sprintf("λ%d = %s, v%d = (%s, %s)", k+1, complexStr(eig.ValueRe[k], eig.ValueIm[k]), k+1,
+			complexStr(re[0], im[0]), complexStr(re[1], im[1]))
+	}
+	result := map[string]interface{}{"values": values, "vectors": vectors, "discriminant": eig.Discriminant.toJSON()}
+	return ToolResponse{Result: result, String: strings.Join(lines, "\n")}
+}
+
+// HandleToolCallStream is HandleToolCall for transports that can deliver
+// partial results. For taylor, find_root and ode_solve it calls emit with
+// the running result after each term, iteration or step; when emit returns
+// false the computation stops and the last partial result is returned.
+// Other tools are answered by HandleToolCall without calling emit.
+func HandleToolCallStream(req ToolRequest, emit func(ToolResponse) bool) (resp ToolResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp = ToolResponse{Error: fmt.Sprintf("internal error: %v", r)}
+		}
+	}()
+	switch req.Tool {
+	case "taylor":
+		return taylorTool(req.Params, emit)
+	case "find_root":
+		return findRootTool(req.Params, emit)
+	case "ode_solve":
+		return odeTool(req.Params, emit)
+	}
+	return HandleToolCall(req)
+}
+
+// The streaming tools take an optional emit, called with each partial
+// result.
+
+func taylorTool(p map[string]interface{}, emit func(ToolResponse) bool) ToolResponse {
+	e, v, err := exprVarParams(p)
+	if err != nil {
+		return errResponse(err)
+	}
+	var around Expr = N(0)
+	if _, ok := p["around"]; ok {
+		if around, err = exprParam(p, "around"); err != nil {
+			return errResponse(err)
+		}
+	}
+	order, err := intParam(p, "order", 5)
+	if err != nil {
+		return errResponse(err)
+	}
+	var yield func(int, Expr) bool
+	if emit != nil {
+		yield = func(_ int, partial Expr) bool { return emit(exprResponse(partial)) }
+	}
+	return exprResponse(taylorTerms(e, v, around, order, yield))
+}
+
+// findRootTool reports {iteration, x, residual}.
+func findRootTool(p map[string]interface{}, emit func(ToolResponse) bool) ToolResponse {
+	e, v, err := exprVarParams(p)
+	if err != nil {
+		return errResponse(err)
+	}
+	x0, err := numberParam(p, "x0", 0)
+	if err != nil {
+		return errResponse(err)
+	}
+	var last ToolResponse
+	err = newtonIterate(e, v, x0, func(iter int, x, fx float64) bool {
+		s := strconv.FormatFloat(x, 'g', -1, 64)
+		last = ToolResponse{
+			Result: map[string]interface{}{"iteration": iter, "x": x, "residual": fx},
+			String: s,
+			LaTeX:  s,
+		}
+		return emit == nil || emit(last)
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	return last
+}
+
+// odeTool reports the solution as [{t, y}] with y(t1) as the string; each
+// partial is a single {step, t, y}.
+func odeTool(p map[string]interface{}, emit func(ToolResponse) bool) ToolResponse {
+	f, err := exprParam(p, "expr")
+	if err != nil {
+		return errResponse(err)
+	}
+	t, y := "t", "y"
+	if _, ok := p["t"]; ok {
+		if t, err = strParam(p, "t"); err != nil {
+			return errResponse(err)
+		}
+	}
+	if _, ok := p["y"]; ok {
+		if y, err = strParam(p, "y"); err != nil {
+			return errResponse(err)
+		}
+	}
+	var nums [3]float64
+	for i, name := range []string{"t0", "y0", "t1"} {
+		if nums[i], err = numberParam(p, name, math.NaN()); err != nil {
+			return errResponse(err)
+		}
+	}
+	steps, err := intParam(p, "steps", 100)
+	if err != nil {
+		return errResponse(err)
+	}
+	pts := []map[string]float64{{"t": nums[0], "y": nums[1]}}
+	err = rk4Iterate(f, t, y, nums[0], nums[1], nums[2], steps, func(k int, pt ODEPoint) bool {
+		pts = append(pts, map[string]float64{"t": pt.T, "y": pt.Y})
+		if emit == nil {
+			return true
+		}
+		s := strconv.FormatFloat(pt.Y, 'g', -1, 64)
+		return emit(ToolResponse{Result: map[string]interface{}{"step": k, "t": pt.T, "y": pt.Y}, String: s, LaTeX: s})
+	})
+	if err != nil {
+		return errResponse(err)
+	}
+	s := strconv.FormatFloat(pts[len(pts)-1]["y"], 'g', -1, 64)
+	return ToolResponse{Result: pts, String: s, LaTeX: s}
+}
+
+func errResponse(err error) ToolResponse { return ToolResponse{Error: err.Error()} }
+
+func exprResponse(e Expr) ToolResponse {
+	return ToolResponse{Result: e.toJSON(), String: e.String(), LaTeX: e.LaTeX()}
+}
+
+// stepsResponse reports each step as {rule, before, after, latex}; String
+// has one step per line and LaTeX joins the steps with line breaks.
+func stepsResponse(steps []Step) ToolResponse {
+	out := make([]map[string]string, len(steps))
+	strs := make([]string, len(steps))
+	tex := make([]string, len(steps))
+	for i, st := range steps {
+		out[i] = map[string]string{"rule": st.Rule, "before": st.Before.String(), "after": st.After.String(), "latex": st.LaTeX}
+		strs[i] = st.String()
+		tex[i] = st.LaTeX
+	}
+	return ToolResponse{Result: out, String: strings.Join(strs, "\n"), LaTeX: strings.Join(tex, ` \\ `)}
+}
+
+// solveStepsResponse reports {steps: [{rule, text, latex}], solutions}.
+// The steps are included even when solving fails.
+func solveStepsResponse(steps []SolveStep, r SolveResult) ToolResponse {
+	out := make([]map[string]string, len(steps))
+	strs := make([]string, len(steps))
+	tex := make([]string, len(steps))
+	for i, st := range steps {
+		out[i] = map[string]string{"rule": st.Rule, "text": st.Text, "latex": st.LaTeX}
+		strs[i] = st.String()
+		tex[i] = st.LaTeX
+	}
+	return ToolResponse{
+		Result: map[string]interface{}{"steps": out, "solutions": exprsJSON(r.Solutions)},
+		String: strings.Join(strs, "\n"),
+		LaTeX:  strings.Join(tex, ` \\ `),
+		Error:  r.Error,
+	}
+}
+
+// listResponse reports the expressions as a JSON array, joined by commas
+// in String and LaTeX.
+func listResponse(es []Expr) ToolResponse {
+	strs := make([]string, len(es))
+	tex := make([]string, len(es))
+	for i, e := range es {
+		strs[i], tex[i] = e.String(), e.LaTeX()
+	}
+	return ToolResponse{Result: exprsJSON(es), String: strings.Join(strs, ", "), LaTeX: strings.Join(tex, ", ")}
+}
+
+func solveResponse(r SolveResult) ToolResponse {
+	if r.Error != "" {
+		return ToolResponse{Error: r.Error}
+	}
+	strs := make([]string, len(r.Solutions))
+	tex := make([]string, len(r.Solutions))
+	for i, s := range r.Solutions {
+		strs[i] = s.String()
+		tex[i] = s.LaTeX()
+	}
+	str, latex := strings.Join(strs, ", "), strings.Join(tex, ", ")
+	if len(r.Conditions) > 0 {
+		cs := make([]string, len(r.Conditions))
+		ctex := make([]string, len(r.Conditions))
+		for i, c := range r.Conditions {
+			cs[i], ctex[i] = c.String(), c.LaTeX()
+		}
+		str += " if " + strings.Join(cs, " and ")
+		latex += `\quad \text{if } ` + strings.Join(ctex, `,\ `)
+	}
+	return ToolResponse{Result: exprsJSON(r.Solutions), String: str, LaTeX: latex}
+}
+
+// solveStepsParams reads the equation lhs = rhs, with rhs 0 by default,
+// and the variable of a solve_steps call.
+func solveStepsParams(p map[string]interface{}) (*Equation, string, error) {
+	lhs, err := exprParam(p, "lhs")
+	if err != nil {
+		return nil, "", err
+	}
+	var rhs Expr = N(0)
+	if _, ok := p["rhs"]; ok {
+		if rhs, err = exprParam(p, "rhs"); err != nil {
+			return nil, "", err
+		}
+	}
+	v, err := strParam(p, "var")
+	if err != nil {
+		return nil, "", err
+	}
+	return Eq(lhs, rhs), v, nil
+}
+
+// assumptionsParam decodes the assumptions param of a tool call.
+func assumptionsParam(raw interface{}) (Assumptions, error) {
+	var a Assumptions
+	b, err := json.Marshal(raw)
+	if err == nil {
+		err = json.Unmarshal(b, &a)
+	}
+	if err != nil {
+		return Assumptions{}, fmt.Errorf("param assumptions: %w", err)
+	}
+	return a, nil
+}
+
+func exprParam(p map[string]interface{}, name string) (Expr, error) {
+	funcs, err := functionsParam(p)
+	if err != nil {
+		return nil, err
+	}
+	return exprValue(p[name], name, funcs)
+}
+
+// functionsParam reads the "functions" param, the names a call reads as
+// unknown functions when parsing its infix strings.
+func functionsParam(p map[string]interface{}) ([]string, error) {
+	raw, ok := p["functions"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	return strListParam(p, "functions")
+}
+
+// exprValue reads the value raw of the expression param name, parsing
+// strings with funcs as unknown functions.
+func exprValue(raw interface{}, name string, funcs []string) (Expr, error) {
+	if raw == nil {
+		return nil, fmt.Errorf("missing param: %s", name)
+	}
+	switch v := raw.(type) {
+	case string:
+		return ParseWithFunctions(v, funcs)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("param %s: invalid number", name)
+		}
+		return NFloat(v), nil
+	case map[string]interface{}:
+		e, err := FromJSON(v)
+		if err == nil {
+			err = Validate(e)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("param %s: expected expression", name)
+}
+
+// listParam reads the array param name, or fails when it is missing or
+// empty.
+func listParam(p map[string]interface{}, name string) ([]interface{}, error) {
+	raw, ok := p[name]
+	if !ok || raw == nil {
+		return nil, fmt.Errorf("missing param: %s", name)
+	}
+	list, ok := raw.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("param %s: expected a non-empty array", name)
+	}
+	return list, nil
+}
+
+// equationsParam reads an array of equations: "lhs = rhs" strings,
+// {"type": "relational", ...} trees with op "=", or expressions meaning
+// expr = 0.
+func equationsParam(p map[string]interface{}, name string) ([]*Equation, error) {
+	list, err := listParam(p, name)
+	if err != nil {
+		return nil, err
+	}
+	funcs, err := functionsParam(p)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Equation, len(list))
+	for i, raw := range list {
+		key := fmt.Sprintf("%s[%d]", name, i)
+		e, err := exprValue(raw, key, funcs)
+		if err != nil {
+			return nil, err
+		}
+		if r, ok := e.(*Relational); ok {
+			if len(r.ops) != 1 || r.ops[0] != RelEq {
+				return nil, fmt.Errorf("param %s: %s is not an equation", key, r)
+			}
+			out[i] = Eq(r.Lhs(), r.Rhs())
+			continue
+		}
+		out[i] = Eq(e, N(0))
+	}
+	return out, nil
+}
+
+func strListParam(p map[string]interface{}, name string) ([]string, error) {
+	list, err := listParam(p, name)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, len(list))
+	for i, raw := range list {
+		s, ok := raw.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("param %s[%d]: expected a string", name, i)
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+// matrixParam reads a matrix given as an array of rows, each an array of
+// expressions, or as a string that ParseMatrix accepts.
+func matrixParam(p map[string]interface{}, name string) (Matrix, error) {
+	if s, ok := p[name].(string); ok {
+		m, err := ParseMatrix(s)
+		if err != nil {
+			return Matrix{}, fmt.Errorf("param %s: %v", name, err)
+		}
+		return m, nil
+	}
+	list, err := listParam(p, name)
+	if err != nil {
+		return Matrix{}, err
+	}
+	funcs, err := functionsParam(p)
+	if err != nil {
+		return Matrix{}, err
+	}
+	rows := make([][]Expr, len(list))
+	for i, raw := range list {
+		row, ok := raw.([]interface{})
+		if !ok {
+			return Matrix{}, fmt.Errorf("param %s[%d]: expected an array", name, i)
+		}
+		rows[i] = make([]Expr, len(row))
+		for j, cell := range row {
+			key := fmt.Sprintf("%s[%d][%d]", name, i, j)
+			if rows[i][j], err = exprValue(cell, key, funcs); err != nil {
+				return Matrix{}, err
+			}
+		}
+	}
+	m, err := NewMatrix(rows)
+	if err != nil {
+		return Matrix{}, fmt.Errorf("param %s: %v", name, err)
+	}
+	return m, nil
+}
+
+func exprVarParams(p map[string]interface{}) (Expr, string, error) {
+	e, err := exprParam(p, "expr")
+	if err != nil {
+		return nil, "", err
+	}
+	v, err := strParam(p, "var")
+	if err != nil {
+		return nil, "", err
+	}
+	return e, v, nil
+}
+
+// numberParam reads a number or a constant expression such as "pi/2". A
+// missing param gives def, or an error when def is NaN.
+func numberParam(p map[string]interface{}, name string, def float64) (float64, error) {
+	if raw, ok := p[name]; !ok || raw == nil {
+		if math.IsNaN(def) {
+			return 0, fmt.Errorf("missing param: %s", name)
+		}
+		return def, nil
+	}
+	e, err := exprParam(p, name)
+	if err != nil {
+		return 0, err
+	}
+	f, ok := evalFloat(e, nil)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("param %s: expected a number", name)
+	}
+	return f, nil
+}
+
+func strParam(p map[string]interface{}, name string) (string, error) {
+	s, ok := p[name].(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("missing param: %s", name)
+	}
+	return s, nil
+}
+
+func intParam(p map[string]interface{}, name string, def int) (int, error) {
+	raw, ok := p[name]
+	if !ok || raw == nil {
+		return def, nil
+	}
+	f, ok := raw.(float64)
+	if !ok || f != math.Trunc(f) || f < 0 || f > 1000 {
+		return 0, fmt.Errorf("param %s: expected a non-negative integer", name)
+	}
+	return int(f), nil
+}
+
+func sortedNames[V any](set map[string]V) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// toolSpec describes one MCP tool for MCPToolSpec.
+type toolSpec struct {
+	Name        string
+	Description string
+	Params      []toolParam
+}
+
+type toolParam struct {
+	Name        string
+	Type        string // "expr", "string", "integer", "number", "object", "expr[]", "string[]" or "matrix"
+	Description string
+	Optional    bool
+}
+
+var toolSpecs = []toolSpec{
+	{"simplify", "Simplify an expression: combine like terms, evaluate constants, apply identities.",
+		[]toolParam{{"expr", "expr", "Expression to simplify", false},
+			{"max_nodes", "integer", "Stop after simplifying this many subexpressions (default unlimited)", true},
+			{"timeout_ms", "integer", "Stop after this many milliseconds (default unlimited)", true},
+			{"strategies", "string[]", "Rewrites to apply in order on each pass: simplify, expand, factor, together, cancel, ratsimp, apart, trigsimp, trigexpand, logexpand, logcombine, radsimp", true},
+			{"max_iterations", "integer", "Passes over strategies before stopping (default 10)", true}}},
+	{"diff", "Differentiate an expression with respect to a variable.",
+		[]toolParam{{"expr", "expr", "Expression to differentiate", false}, {"var", "string", "Variable name", false}}},
+	{"diff_steps", "Differentiate step by step, listing the rule applied to each subexpression.",
+		[]toolParam{{"expr", "expr", "Expression to differentiate", false}, {"var", "string", "Variable name", false}}},
+	{"integrate", "Rule-based symbolic integration (antiderivative).",
+		[]toolParam{{"expr", "expr", "Integrand", false}, {"var", "string", "Variable of integration", false}}},
+	{"integrate_steps", "Integrate step by step, listing the rule applied to each subexpression.",
+		[]toolParam{{"expr", "expr", "Integrand", false}, {"var", "string", "Variable of integration", false}}},
+	{"simplify_steps", "Simplify step by step, listing each rewrite rule that fired.",
+		[]toolParam{{"expr", "expr", "Expression to simplify", false}}},
+	{"expand", "Expand products and integer powers of sums; a power of more than 1000 terms is an error.",
+		[]toolParam{{"expr", "expr", "Expression to expand", false}}},
+	{"factor", "Factor a polynomial in one variable over the rationals.",
+		[]toolParam{{"expr", "expr", "Expression to factor", false}}},
+	{"substitute", "Replace a variable with a value or sub-expression.",
+		[]toolParam{{"expr", "expr", "Expression", false}, {"var", "string", "Variable to replace", false}, {"value", "expr", "Replacement", false}}},
+	{"to_latex", "Render an expression as LaTeX.",
+		[]toolParam{{"expr", "expr", "Expression to render", false}}},
+	{"free_symbols", "List the variable names in an expression, sorted.",
+		[]toolParam{{"expr", "expr", "Expression", false}}},
+	{"fingerprint", "Identifier of the function an expression computes, equal for equivalent forms such as (x+1)^2 and x^2+2*x+1; use it to detect duplicate problems.",
+		[]toolParam{{"expr", "expr", "Expression", false}}},
+	{"degree", "Polynomial degree of an expression in a variable.",
+		[]toolParam{{"expr", "expr", "Polynomial", false}, {"var", "string", "Variable name", false}}},
+	{"solve_linear", "Solve a*x + b = 0 for x.",
+		[]toolParam{{"a", "expr", "Coefficient of x", false}, {"b", "expr", "Constant term", false}}},
+	{"solve_quadratic", "Solve a*x^2 + b*x + c = 0 for x.",
+		[]toolParam{{"a", "expr", "Coefficient of x^2", false}, {"b", "expr", "Coefficient of x", false}, {"c", "expr", "Constant term", false}}},
+	{"solve_steps", "Solve a linear or quadratic equation lhs = rhs for a variable, showing each algebraic step.",
+		[]toolParam{{"lhs", "expr", "Left-hand side", false}, {"rhs", "expr", "Right-hand side (default 0)", true}, {"var", "string", "Variable to solve for", false}}},
+	{"list_formulas", "List the physical formulas (kinematics, circuits, thermodynamics) with their symbols' SI units.",
+		[]toolParam{{"category", "string", "Only formulas in this category", true}}},
+	{"solve_formula", "Solve a named physical formula for its one unknown symbol, given the other symbols' values in SI units.",
+		[]toolParam{{"name", "string", "Formula name from list_formulas", false},
+			{"knowns", "object", "Values of the known symbols, e.g. {\"V\": 12, \"R\": \"4\"}", false}}},
+	{"solve_system", "Solve a square system of linear equations exactly; each solution is returned as a JSON tree and a string.",
+		[]toolParam{{"equations", "expr[]", "Equations such as \"x + y = 3\", or expressions equal to 0", false},
+			{"vars", "string[]", "Unknowns, one per equation", false}}},
+	{"groebner", "Reduced lex Gröbner basis of polynomial equations, for solving or simplifying nonlinear systems.",
+		[]toolParam{{"polys", "expr[]", "Equations such as \"x^2 + y^2 = 1\", or polynomials equal to 0", false},
+			{"order", "string[]", "Symbols from greatest to smallest (default sorted)", true}}},
+	{"matrix", "Matrix arithmetic and invariants: add, mul, det, trace, rank, adjugate, inverse, transpose, echelon or the eigen-decomposition of a 2×2 matrix.",
+		[]toolParam{{"op", "string", "Operation: add, mul, det, trace, rank, adjugate, inverse, transpose, echelon or eigen", false},
+			{"a", "matrix", "Matrix as an array of rows or a string", false}, {"b", "matrix", "Second matrix, for add and mul", true}}},
+	{"store", "Store an expression on the server and return its ID, a short hash of its simplified form, to pass to recall instead of the full tree.",
+		[]toolParam{{"expr", "expr", "Expression to store", false}}},
+	{"recall", "Return the expression stored under an ID returned by store.",
+		[]toolParam{{"id", "string", "ID returned by store", false}}},
+	{"worksheet_eval", "Evaluate an input in a worksheet, a saved session of named results that later inputs can refer to; returns the updated worksheet to pass to the next call.",
+		[]toolParam{{"input", "string", "Expression, using the names of earlier entries", false},
+			{"name", "string", "Name for the result (default out1, out2, …)", true},
+			{"worksheet", "object", "Worksheet returned by an earlier call (default empty)", true}}},
+	{"taylor", "Taylor series of an expression around a point.",
+		[]toolParam{{"expr", "expr", "Expression", false}, {"var", "string", "Variable name", false},
+			{"around", "expr", "Expansion point (default 0)", true}, {"order", "integer", "Highest power (default 5)", true}}},
+	{"find_root", "Find a root of expr = 0 by Newton's method; streams each iterate.",
+		[]toolParam{{"expr", "expr", "Expression", false}, {"var", "string", "Variable name", false},
+			{"x0", "number", "Starting point (default 0)", true}}},
+	{"ode_solve", "Integrate dy/dt = expr numerically (Runge-Kutta 4); streams each step.",
+		[]toolParam{{"expr", "expr", "Right-hand side f(t, y)", false}, {"t0", "number", "Initial time", false},
+			{"y0", "number", "Initial value", false}, {"t1", "number", "Final time", false},
+			{"steps", "integer", "Number of steps (default 100)", true},
+			{"t", "string", "Independent variable (default t)", true}, {"y", "string", "Dependent variable (default y)", true}}},
+}
+
+// MCPToolSpec returns the JSON schema of all tools accepted by
+// HandleToolCall, suitable for registering with an agent framework.
+func MCPToolSpec() string {
+	exprSchema := map[string]interface{}{
+		"description": "Expression as a JSON tree ({\"type\": ...}) or an infix string",
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "object"},
+			map[string]interface{}{"type": "string"},
+		},
+	}
+	tools := make([]interface{}, 0, len(toolSpecs))
+	for _, t := range toolSpecs {
+		props := map[string]interface{}{}
+		required := []string{}
+		for _, p := range t.Params {
+			var schema map[string]interface{}
+			switch p.Type {
+			case "expr":
+				schema = map[string]interface{}{}
+				for k, v := range exprSchema {
+					schema[k] = v
+				}
+				schema["description"] = p.Description + ". " + exprSchema["description"].(string)
+			case "expr[]":
+				schema = map[string]interface{}{"type": "array", "items": exprSchema, "description": p.Description}
+			case "string[]":
+				schema = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "description": p.Description}
+			case "matrix":
+				schema = map[string]interface{}{
+					"oneOf": []interface{}{
+						map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "array", "items": exprSchema}},
+						map[string]interface{}{"type": "string"},
+					},
+					"description": p.Description + `. Entries are JSON trees, infix strings or numbers; a string such as "[[1, x], [y, 2]]" or "inv([[1, 2], [3, 4]])" is read by ParseMatrix`,
+				}
+			default:
+				schema = map[string]interface{}{"type": p.Type, "description": p.Description}
+			}
+			props[p.Name] = schema
+			if !p.Optional {
+				required = append(required, p.Name)
+			}
+		}
+		props["assumptions"] = map[string]interface{}{
+			"type":        "object",
+			"description": `Assumptions about symbols for this call, e.g. {"symbols": {"x": ["positive"], "n": ["natural"]}, "relations": ["0 <= t <= 1"]}; properties are positive, negative, nonnegative, nonpositive, integer and natural (a positive integer)`,
+		}
+		props["functions"] = map[string]interface{}{
+			"type":        "array",
+			"items":       map[string]interface{}{"type": "string"},
+			"description": `Names that infix strings in this call read as unknown functions, so "f'(x)" and "Derivative(f(x), (x, 4))" parse`,
+		}
+		tools = append(tools, map[string]interface{}{
+			"name":        t.Name,
+			"description": t.Description,
+			"inputSchema": map[string]interface{}{
+				"type":       "object",
+				"properties": props,
+				"required":   required,
+			},
+		})
+	}
+	b, _ := json.MarshalIndent(map[string]interface{}{"tools": tools}, "", "  ")
+	return string(b)
+}
+
+// ============================================================
+// Provenance
+// ============================================================
+
+// provenanceFormat tags the JSON encoding of a Recorder's log.
+const provenanceFormat = "gosymbol-provenance"
+
+// ProvenanceStep is one tool call recorded by a Recorder.
+type ProvenanceStep struct {
+	Seq  int    `json:"seq"`
+	Tool string `json:"tool"`
+	// Params are the parameters as JSON values, options included.
+	Params map[string]interface{} `json:"params"`
+	// Inputs maps a parameter to the Seq of the earlier step whose result
+	// it repeats, linking the steps into an operation graph.
+	Inputs   map[string]int `json:"inputs,omitempty"`
+	Response ToolResponse   `json:"response"`
+	// Digest is a SHA-256 prefix of the JSON encoding of Response.
+	Digest string `json:"digest"`
+	// Stopped is the number of partial results after which the client
+	// stopped a streamed call, and 0 for a call that ran to the end.
+	Stopped int `json:"stopped,omitempty"`
+}
+
+// Recorder handles tool calls and records them, so that a session can be
+// exported, audited and recomputed later with Replay. Recording is opt-in:
+// wrap the handler whose results should be reproducible, e.g.
+//
+//	rec := NewRecorder(engine.HandleToolCall)
+//	resp := rec.HandleToolCall(req)
+//	log, _ := rec.Export()
+//
+// The exported log has the form
+//
+//	{"format": "gosymbol-provenance", "version": 1, "steps": [
+//	    {"seq": 1, "tool": "diff", "params": {...}, "response": {...}, "digest": "…"}, ...]}
+//
+// A parameter whose JSON value equals an earlier result, as a tree or as
+// its string form, is linked to the latest step that returned it. A
+// Recorder is safe for concurrent use.
+type Recorder struct {
+	stream   func(ToolRequest, func(ToolResponse) bool) ToolResponse
+	mu       sync.Mutex
+	steps    []ProvenanceStep
+	produced map[string]int
+}
+
+// NewRecorder returns a Recorder that handles calls with handle, or with
+// HandleToolCall when handle is nil.
+func NewRecorder(handle func(ToolRequest) ToolResponse) *Recorder {
+	if handle == nil {
+		return NewStreamRecorder(nil)
+	}
+	stream := func(req ToolRequest, _ func(ToolResponse) bool) ToolResponse { return handle(req) }
+	return &Recorder{stream: stream, produced: map[string]int{}}
+}
+
+// NewStreamRecorder returns a Recorder that handles calls with stream, or
+// with HandleToolCallStream when stream is nil, such as
+// Engine.HandleToolCallStream. Its HandleToolCall streams nothing.
+func NewStreamRecorder(stream func(ToolRequest, func(ToolResponse) bool) ToolResponse) *Recorder {
+	if stream == nil {
+		stream = HandleToolCallStream
+	}
+	return &Recorder{stream: stream, produced: map[string]int{}}
+}
+
+// HandleToolCall handles req and records the call. The parameters are
+// passed on as their JSON values, so a replay sees exactly what was
+// recorded. Responses that cannot be encoded as JSON, which a server could
+// not send either, are returned but not recorded.
+func (r *Recorder) HandleToolCall(req ToolRequest) ToolResponse {
+	return r.HandleToolCallStream(req, nil)
+}
+
+// HandleToolCallStream handles req as HandleToolCallStream does, passing
+// partial results to emit, and records the call with its final response,
+// as HandleToolCall does, noting when emit stopped it. A Recorder from
+// NewRecorder emits nothing.
+func (r *Recorder) HandleToolCallStream(req ToolRequest, emit func(ToolResponse) bool) ToolResponse {
+	params, err := jsonParams(req.Params)
+	if err != nil {
+		return errResponse(err)
+	}
+	stopped, count := 0, emit
+	if emit != nil {
+		n := 0
+		count = func(partial ToolResponse) bool {
+			n++
+			if !emit(partial) {
+				stopped = n
+				return false
+			}
+			return true
+		}
+	}
+	resp := r.stream(ToolRequest{Tool: req.Tool, Params: params}, count)
+	digest, err := responseDigest(resp)
+	if err != nil {
+		return resp
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	step := ProvenanceStep{Seq: len(r.steps) + 1, Tool: req.Tool, Params: params, Response: resp, Digest: digest, Stopped: stopped}
+	for name, v := range params {
+		if key, ok := producedKey(v); ok {
+			if seq, ok := r.produced[key]; ok {
+				if step.Inputs == nil {
+					step.Inputs = map[string]int{}
+				}
+				step.Inputs[name] = seq
+			}
+		}
+	}
+	if resp.Error == "" {
+		for _, v := range []interface{}{resp.Result, resp.String} {
+			if key, ok := producedKey(v); ok {
+				r.produced[key] = step.Seq
+			}
+		}
+	}
+	r.steps = append(r.steps, step)
+	return resp
+}
+
+// Steps returns the recorded steps, oldest first.
+func (r *Recorder) Steps() []ProvenanceStep {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ProvenanceStep(nil), r.steps...)
+}
+
+// Export returns the recorded steps as an indented JSON log.
+func (r *Recorder) Export() ([]byte, error) {
+	steps := r.Steps()
+	if steps == nil {
+		steps = []ProvenanceStep{}
+	}
+	return json.MarshalIndent(map[string]interface{}{"format": provenanceFormat, "version": 1, "steps": steps}, "", "  ")
+}
+
+// Replay recomputes the steps of a log written by Recorder.Export with
+// handle, or with HandleToolCall when handle is nil, and returns them. It
+// is an error for the log to be malformed, for a recorded response not to
+// match its digest, or for a recomputed response to differ from the
+// recorded one; the returned steps then end with the offending one. A
+// stopped stream is recomputed by HandleToolCallStream, stopped after as
+// many partial results, when handle is nil; a handle that does not stop
+// computes the whole result, which differs.
+func Replay(data []byte, handle func(ToolRequest) ToolResponse) ([]ProvenanceStep, error) {
+	stream := HandleToolCallStream
+	if handle != nil {
+		stream = func(req ToolRequest, _ func(ToolResponse) bool) ToolResponse { return handle(req) }
+	}
+	var log struct {
+		Format  string           `json:"format"`
+		Version int              `json:"version"`
+		Steps   []ProvenanceStep `json:"steps"`
+	}
+	if err := json.Unmarshal(data, &log); err != nil {
+		return nil, fmt.Errorf("replay: %w", err)
+	}
+	if log.Format != provenanceFormat {
+		return nil, fmt.Errorf("replay: format %q, want %q", log.Format, provenanceFormat)
+	}
+	if log.Version != 1 {
+		return nil, fmt.Errorf("replay: unsupported version %d", log.Version)
+	}
+	var out []ProvenanceStep
+	for _, s := range log.Steps {
+		if d, err := responseDigest(s.Response); err != nil || d != s.Digest {
+			return append(out, s), fmt.Errorf("replay: step %d (%s): recorded response does not match its digest", s.Seq, s.Tool)
+		}
+		recorded := s
+		var emit func(ToolResponse) bool
+		if s.Stopped > 0 {
+			emit = stopAfter(s.Stopped)
+		}
+		resp := stream(ToolRequest{Tool: s.Tool, Params: s.Params}, emit)
+		d, err := responseDigest(resp)
+		if err != nil {
+			return append(out, s), fmt.Errorf("replay: step %d (%s): %w", s.Seq, s.Tool, err)
+		}
+		s.Response, s.Digest = resp, d
+		out = append(out, s)
+		if d != recorded.Digest {
+			return out, fmt.Errorf("replay: step %d (%s): got %s, recorded %s", s.Seq, s.Tool, responseSummary(resp), responseSummary(recorded.Response))
+		}
+	}
+	return out, nil
+}
+
+// stopAfter returns an emit that stops a stream at its n-th partial
+// result.
+func stopAfter(n int) func(ToolResponse) bool {
+	return func(ToolResponse) bool {
+		n--
+		return n > 0
+	}
+}
+
+// jsonParams returns params as plain JSON values, as a server decodes
+// them.
+func jsonParams(params map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
+
+// responseDigest hashes the canonical JSON encoding of resp: it is decoded
+// to plain values and encoded again, so that a response read back from a
+// log hashes like the one that was recorded.
+func responseDigest(resp ToolResponse) (string, error) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return "", err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return "", err
+	}
+	if b, err = json.Marshal(v); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])[:exprIDLen], nil
+}
+
+// producedKey returns the key under which a Recorder links the value v,
+// which must be an expression in string or JSON tree form.
+func producedKey(v interface{}) (string, bool) {
+	switch v.(type) {
+	case string, map[string]interface{}:
+		b, err := json.Marshal(v)
+		if err != nil || string(b) == `""` {
+			return "", false
+		}
+		return string(b), true
+	}
+	return "", false
+}
+
+// responseSummary describes resp in a Replay error.
+func responseSummary(resp ToolResponse) string {
+	switch {
+	case resp.Error != "":
+		return "error " + strconv.Quote(resp.Error)
+	case resp.String != "":
+		return strconv.Quote(resp.String)
+	}
+	b, _ := json.Marshal(resp.Result)
+	return string(b)
+}
+
+// ============================================================
+// Engine
+// ============================================================
+
+// EngineConfig configures an Engine. The zero value means no limits, no
+// cache, 53-bit Evalf and no assumptions.
+type EngineConfig struct {
+	// Budget bounds the work of each Simplify, as in SimplifyBudgeted.
+	Budget SimplifyBudget
+	// MaxComplexity is the largest Complexity accepted for an input; 0
+	// means no limit.
+	MaxComplexity int
+	// MaxDegree is the largest polynomial degree accepted for an input,
+	// bounded from its sums, products and integer powers without
+	// expanding, so that a short input such as x^100000 + 1 cannot start
+	// a dense polynomial computation; 0 means no limit.
+	MaxDegree int
+	// Prec is the precision in bits of Evalf; 0 means 53.
+	Prec uint
+	// CacheSize is the number of simplified results remembered, oldest
+	// evicted first; 0 disables the cache.
+	CacheSize int
+	// Functions, when non-nil, lists the registered functions the engine
+	// accepts in its inputs. Built-in functions are always accepted.
+	Functions []string
+	// Assumptions are comparisons taken to hold, each in a single symbol
+	// and solvable by SolveInequality, e.g. x > 0 or 0 <= t <= 1.
+	Assumptions []Expr
+	// Integers lists the symbols taken to be integers, such as indices
+	// and counts.
+	Integers []string
+	// Degrees makes Parse and the expression params of HandleToolCall
+	// read angles in degrees, as DegreeMode does.
+	Degrees bool
+	// Store holds the expressions of the store and recall tools; nil
+	// means the process-wide store that HandleToolCall uses.
+	Store *ExprStore
+}
+
+// Engine is an isolated instance of the library's top-level API with its
+// own limits, cache and assumptions, so that engines with different
+// settings, e.g. one per tenant of a service, can share a process. Its
+// methods check each input against MaxComplexity and Functions and
+// decide comparisons and Piecewise conditions in their results under the
+// assumptions. The function registry and SetAutoSimplify remain
+// process-wide. An Engine is safe for concurrent use.
+type Engine struct {
+	cfg     EngineConfig
+	allowed map[string]bool
+	assumed map[string]RealSet
+	integer map[string]bool
+
+	mu           sync.Mutex
+	cache        map[uint64][]engineCacheEntry
+	order        []uint64
+	hits, misses int
+}
+
+type engineCacheEntry struct{ in, out Expr }
+
+// NewEngine returns an engine with configuration cfg. It is an error for
+// an assumption not to be a comparison in one symbol that
+// SolveInequality can solve, for an entry of Integers not to be an
+// identifier, or for the assumptions to contradict each other.
+func NewEngine(cfg EngineConfig) (*Engine, error) {
+	en := &Engine{cfg: cfg, assumed: map[string]RealSet{}, integer: map[string]bool{}, cache: map[uint64][]engineCacheEntry{}}
+	en.cfg.Functions = append([]string(nil), cfg.Functions...)
+	en.cfg.Assumptions = append([]Expr(nil), cfg.Assumptions...)
+	en.cfg.Integers = append([]string(nil), cfg.Integers...)
+	for _, name := range cfg.Integers {
+		if !isIdentifier(name) {
+			return nil, fmt.Errorf("engine: invalid integer symbol %q", name)
+		}
+		en.integer[name] = true
+	}
+	if cfg.Functions != nil {
+		en.allowed = map[string]bool{}
+		for _, f := range cfg.Functions {
+			en.allowed[f] = true
+		}
+	}
+	for _, a := range cfg.Assumptions {
+		syms := FreeSymbols(a)
+		if len(syms) != 1 {
+			return nil, fmt.Errorf("engine: assumption %s must involve exactly one symbol", a)
+		}
+		s, err := SolveInequality(a.Simplify(), syms[0])
+		if err != nil {
+			return nil, fmt.Errorf("engine: assumption %s: %w", a, err)
+		}
+		if old, ok := en.assumed[syms[0]]; ok {
+			if s, err = old.Intersect(s); err != nil {
+				return nil, fmt.Errorf("engine: assumption %s: %w", a, err)
+			}
+		}
+		en.assumed[syms[0]] = s
+	}
+	for name, s := range en.assumed {
+		if en.integer[name] {
+			s = integerHull(s)
+		}
+		if s.IsEmpty() {
+			return nil, fmt.Errorf("engine: assumptions on %s are contradictory", name)
+		}
+	}
+	return en, nil
+}
+
+// integerHull shrinks each span of s with numeric ends to the closed span
+// between the first and last integers in it, dropping spans without one,
+// so that x > 0 becomes x >= 1 for an integer x. Spans with symbolic ends
+// are kept.
+func integerHull(s RealSet) RealSet {
+	var out []Span
+	for _, sp := range s.spans {
+		lo, ok1 := sp.Lo.(*Num)
+		hi, ok2 := sp.Hi.(*Num)
+		if ok1 {
+			q := ratCeil(lo.val)
+			if sp.LoOpen && lo.val.IsInt() {
+				q.Add(q, big.NewInt(1))
+			}
+			sp.Lo, sp.LoOpen = numRat(new(big.Rat).SetInt(q)), false
+		}
+		if ok2 {
+			q := ratFloor(hi.val)
+			if sp.HiOpen && hi.val.IsInt() {
+				q.Sub(q, big.NewInt(1))
+			}
+			sp.Hi, sp.HiOpen = numRat(new(big.Rat).SetInt(q)), false
+		}
+		if ok1 && ok2 && sp.Lo.(*Num).val.Cmp(sp.Hi.(*Num).val) > 0 {
+			continue
+		}
+		out = append(out, sp)
+	}
+	return RealSet{spans: out}
+}
+
+// ratFloor and ratCeil round r down and up to an integer.
+func ratFloor(r *big.Rat) *big.Int { return new(big.Int).Div(r.Num(), r.Denom()) }
+func ratCeil(r *big.Rat) *big.Int  { return new(big.Int).Neg(ratFloor(new(big.Rat).Neg(r))) }
+
+// Config returns a copy of the engine's configuration.
+func (en *Engine) Config() EngineConfig {
+	cfg := en.cfg
+	cfg.Functions = append([]string(nil), cfg.Functions...)
+	cfg.Assumptions = append([]Expr(nil), cfg.Assumptions...)
+	cfg.Integers = append([]string(nil), cfg.Integers...)
+	return cfg
+}
+
+// Assumed returns the set of values that the assumptions allow for the
+// symbol name, or false when it has none.
+func (en *Engine) Assumed(name string) (RealSet, bool) {
+	s, ok := en.assumed[name]
+	return s, ok
+}
+
+// Assumptions is a set of assumptions about symbols that serializes to
+// JSON, so that a client can declare them once and attach them to an
+// Engine, to the MCP server or to a single tool call:
+//
+//	{"symbols": {"x": ["positive", "integer"], "n": ["natural"]}, "relations": ["0 <= t <= 1"]}
+//
+// Symbols gives properties of single symbols: positive, negative,
+// nonnegative, nonpositive, integer, and natural, which as in SymPy means
+// a positive integer. Relations are comparisons in one symbol, as in
+// EngineConfig.Assumptions; they serialize as the strings Parse reads.
+type Assumptions struct {
+	Symbols   map[string][]string
+	Relations []Expr
+}
+
+// symbolProperties maps the properties of Assumptions.Symbols, other than
+// integer, to the comparison they assert about the symbol x.
+var symbolProperties = map[string]func(x Expr) Expr{
+	"positive":    func(x Expr) Expr { return Gt(x, N(0)) },
+	"negative":    func(x Expr) Expr { return Lt(x, N(0)) },
+	"nonnegative": func(x Expr) Expr { return Ge(x, N(0)) },
+	"nonpositive": func(x Expr) Expr { return Le(x, N(0)) },
+	"natural":     func(x Expr) Expr { return Ge(x, N(1)) },
+}
+
+// config returns cfg with the assumptions a added: each property becomes
+// a comparison, and integer and natural symbols join Integers.
+func (a Assumptions) config(cfg EngineConfig) (EngineConfig, error) {
+	cfg.Assumptions = append(append([]Expr(nil), cfg.Assumptions...), a.Relations...)
+	cfg.Integers = append([]string(nil), cfg.Integers...)
+	for _, name := range sortedNames(a.Symbols) {
+		if !isIdentifier(name) {
+			return cfg, fmt.Errorf("invalid symbol %q", name)
+		}
+		for _, p := range a.Symbols[name] {
+			rel, ok := symbolProperties[p]
+			switch {
+			case ok:
+				cfg.Assumptions = append(cfg.Assumptions, rel(S(name)))
+			case p != "integer":
+				return cfg, fmt.Errorf("unknown property %q of %s", p, name)
+			}
+			if p == "integer" || p == "natural" {
+				cfg.Integers = append(cfg.Integers, name)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// MarshalJSON encodes a in the form shown on Assumptions.
+func (a Assumptions) MarshalJSON() ([]byte, error) {
+	symbols := a.Symbols
+	if symbols == nil {
+		symbols = map[string][]string{}
+	}
+	rels := make([]string, len(a.Relations))
+	for i, r := range a.Relations {
+		rels[i] = r.String()
+	}
+	return json.Marshal(map[string]interface{}{"symbols": symbols, "relations": rels})
+}
+
+// UnmarshalJSON replaces a with the decoded assumptions. It is an error
+// for a relation not to parse or for a property to be unknown.
+func (a *Assumptions) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Symbols   map[string][]string `json:"symbols"`
+		Relations []string            `json:"relations"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	out := Assumptions{Symbols: raw.Symbols}
+	for _, s := range raw.Relations {
+		r, err := Parse(s)
+		if err != nil {
+			return fmt.Errorf("relation %q: %w", s, err)
+		}
+		out.Relations = append(out.Relations, r)
+	}
+	if _, err := out.config(EngineConfig{}); err != nil {
+		return err
+	}
+	*a = out
+	return nil
+}
+
+// Assumptions returns the engine's assumptions for export: the
+// comparisons of its configuration as Relations, and its Integers with
+// the property integer. WithAssumptions reads them back.
+func (en *Engine) Assumptions() Assumptions {
+	a := Assumptions{Relations: append([]Expr(nil), en.cfg.Assumptions...)}
+	for _, name := range en.cfg.Integers {
+		if a.Symbols == nil {
+			a.Symbols = map[string][]string{}
+		}
+		a.Symbols[name] = []string{"integer"}
+	}
+	return a
+}
+
+// WithAssumptions returns a new engine with the configuration of en and
+// the assumptions a in addition to its own, or the error NewEngine
+// reports for them. The new engine starts with an empty cache.
+func (en *Engine) WithAssumptions(a Assumptions) (*Engine, error) {
+	cfg, err := a.config(en.Config())
+	if err != nil {
+		return nil, fmt.Errorf("engine: %w", err)
+	}
+	return NewEngine(cfg)
+}
+
+// checkToolParam checks the expressions in param tp of a call to tool
+// against the engine's limits and, in degree mode, rewrites them in
+// place as DegreeMode does. Malformed params are left for the tool to
+// report.
+func (en *Engine) checkToolParam(tool string, params map[string]interface{}, tp toolParam) error {
+	funcs, err := functionsParam(params)
+	if err != nil {
+		return err
+	}
+	checked := func(e Expr) (interface{}, error) {
+		if err := en.check(e); err != nil {
+			return nil, err
+		}
+		if en.cfg.Degrees {
+			e = DegreeMode(e)
+		}
+		return e.toJSON(), nil
+	}
+	switch {
+	case tp.Type == "expr":
+		e, err := exprParam(params, tp.Name)
+		if err != nil {
+			return err
+		}
+		out, err := checked(e)
+		if err == nil && en.cfg.Degrees {
+			params[tp.Name] = out
+		}
+		return err
+	case tp.Type == "expr[]":
+		list, ok := params[tp.Name].([]interface{})
+		if !ok {
+			return nil
+		}
+		out := make([]interface{}, len(list))
+		for i, raw := range list {
+			key := fmt.Sprintf("%s[%d]", tp.Name, i)
+			e, err := exprValue(raw, key, funcs)
+			if err != nil {
+				return err
+			}
+			if out[i], err = checked(e); err != nil {
+				return err
+			}
+		}
+		if en.cfg.Degrees {
+			params[tp.Name] = out
+		}
+	case tp.Type == "matrix":
+		m, err := matrixParam(params, tp.Name)
+		if err != nil {
+			return err
+		}
+		out := make([]interface{}, m.Rows())
+		for i, row := range m.rows {
+			cells := make([]interface{}, len(row))
+			for j, c := range row {
+				if cells[j], err = checked(c); err != nil {
+					return err
+				}
+			}
+			out[i] = cells
+		}
+		if en.cfg.Degrees {
+			params[tp.Name] = out
+		}
+	case tool == "solve_formula" && tp.Name == "knowns":
+		// Values are read as expressions; the map is copied so that the
+		// caller's request is left as it was.
+		raw, ok := params[tp.Name].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		out := make(map[string]interface{}, len(raw))
+		for _, k := range sortedNames(raw) {
+			e, err := exprValue(raw[k], k, funcs)
+			if err != nil {
+				return fmt.Errorf("knowns: %v", err)
+			}
+			if out[k], err = checked(e); err != nil {
+				return err
+			}
+		}
+		if en.cfg.Degrees {
+			params[tp.Name] = out
+		}
+	case tool == "worksheet_eval" && tp.Name == "input":
+		// The input is recorded as written, so it is checked but not
+		// rewritten.
+		s, ok := params[tp.Name].(string)
+		if !ok {
+			return nil
+		}
+		e, err := Parse(s)
+		if err != nil {
+			return err
+		}
+		return en.check(e)
+	}
+	return nil
+}
+
+// check reports an error when e exceeds the engine's limits.
+func (en *Engine) check(e Expr) error {
+	if en.cfg.MaxComplexity > 0 {
+		if c := Complexity(e); c > en.cfg.MaxComplexity {
+			return fmt.Errorf("engine: expression complexity %d exceeds the limit %d", c, en.cfg.MaxComplexity)
+		}
+	}
+	if en.cfg.MaxDegree > 0 {
+		if d := polyDegreeBound(e); d > en.cfg.MaxDegree {
+			return fmt.Errorf("engine: polynomial degree %d exceeds the limit %d", d, en.cfg.MaxDegree)
+		}
+	}
+	if en.allowed == nil {
+		return nil
+	}
+	var err error
+	var walk func(Expr)
+	walk = func(e Expr) {
+		if f, ok := e.(*Func); ok && err == nil && !builtinFuncs[f.name] && lookupFunc(f.name) != nil && !en.allowed[f.name] {
+			err = fmt.Errorf("engine: function %q is not enabled", f.name)
+		}
+		_, cs := labeledChildren(e)
+		for _, c := range cs {
+			walk(c)
+		}
+	}
+	walk(e)
+	return err
+}
+
+// Parse is Parse restricted to the engine's limits.
+func (en *Engine) Parse(s string) (Expr, error) {
+	e, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := en.check(e); err != nil {
+		return nil, err
+	}
+	if en.cfg.Degrees {
+		e = DegreeMode(e)
+	}
+	return e, nil
+}
+
+// Simplify simplifies e within the engine's budget, then decides the
+// comparisons in it under the assumptions. partial is true when the
+// budget ran out, as in SimplifyBudgeted; partial results are not cached.
+func (en *Engine) Simplify(e Expr) (r Expr, partial bool, err error) {
+	if err := en.check(e); err != nil {
+		return nil, false, err
+	}
+	h := Hash(e)
+	if r, ok := en.cached(h, e); ok {
+		return r, false, nil
+	}
+	r, partial = SimplifyBudgeted(e, en.cfg.Budget)
+	r = en.refine(r)
+	if !partial {
+		en.store(h, e, r)
+	}
+	return r, partial, nil
+}
+
+// Diff is Diff with the engine's limits and assumptions.
+func (en *Engine) Diff(e Expr, varName string, more ...string) (Expr, error) {
+	if err := en.check(e); err != nil {
+		return nil, err
+	}
+	return en.refine(Diff(e, varName, more...)), nil
+}
+
+// Integrate is Integrate with the engine's limits and assumptions. It is
+// an error for no antiderivative to be found.
+func (en *Engine) Integrate(e Expr, varName string) (Expr, error) {
+	if err := en.check(e); err != nil {
+		return nil, err
+	}
+	r, ok := Integrate(e, varName)
+	if !ok {
+		return nil, fmt.Errorf("engine: no antiderivative of %s found", e)
+	}
+	return en.refine(r), nil
+}
+
+// Expand is Expand with the engine's limits and assumptions.
+func (en *Engine) Expand(e Expr) (Expr, error) {
+	if err := en.check(e); err != nil {
+		return nil, err
+	}
+	return en.refine(Expand(e)), nil
+}
+
+// LogExpand is LogExpand with the engine's limits, treating the symbols
+// that the assumptions make positive as positive.
+func (en *Engine) LogExpand(e Expr) (Expr, error) {
+	if err := en.check(e); err != nil {
+		return nil, err
+	}
+	return en.refine(LogExpand(e, en.positiveSymbols()...)), nil
+}
+
+// LogCombine is LogCombine with the engine's limits, treating the symbols
+// that the assumptions make positive as positive.
+func (en *Engine) LogCombine(e Expr) (Expr, error) {
+	if err := en.check(e); err != nil {
+		return nil, err
+	}
+	return en.refine(LogCombine(e, en.positiveSymbols()...)), nil
+}
+
+// RadSimp is RadSimp with the engine's limits, treating the symbols that
+// the assumptions make positive as positive.
+func (en *Engine) RadSimp(e Expr) (Expr, error) {
+	if err := en.check(e); err != nil {
+		return nil, err
+	}
+	return en.refine(RadSimp(e, en.positiveSymbols()...)), nil
+}
+
+// positiveSymbols returns the symbols that the assumptions make positive.
+func (en *Engine) positiveSymbols() []string {
+	var out []string
+	for name := range en.assumed {
+		if holds, known := en.decide(Gt(S(name), N(0)).(*Relational)); holds && known {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// Sub is Sub with the engine's limits and assumptions.
+func (en *Engine) Sub(e Expr, varName string, value Expr) (Expr, error) {
+	for _, x := range []Expr{e, value} {
+		if err := en.check(x); err != nil {
+			return nil, err
+		}
+	}
+	return en.refine(Sub(e, varName, value)), nil
+}
+
+// SolveInequality is SolveInequality restricted to the values the
+// assumptions allow for x.
+func (en *Engine) SolveInequality(rel Expr, x string) (RealSet, error) {
+	if err := en.check(rel); err != nil {
+		return RealSet{}, err
+	}
+	s, err := SolveInequality(rel, x)
+	if err != nil {
+		return RealSet{}, err
+	}
+	if a, ok := en.assumed[x]; ok {
+		return s.Intersect(a)
+	}
+	return s, nil
+}
+
+// SolveSteps is SolveSteps with the engine's limits, keeping only the
+// solutions the assumptions allow for x: those in the set Assumed(x)
+// returns, and for an integer x those that are not fractions. When some
+// are dropped, a final "assumptions" step states the ones that remain.
+func (en *Engine) SolveSteps(eq *Equation, x string) ([]SolveStep, SolveResult, error) {
+	for _, e := range []Expr{eq.LHS, eq.RHS} {
+		if err := en.check(e); err != nil {
+			return nil, SolveResult{}, err
+		}
+	}
+	steps, r := SolveSteps(eq, x)
+	if r.Error != "" {
+		return steps, r, fmt.Errorf("engine: %s", r.Error)
+	}
+	var kept []Expr
+	text, tex := []string{}, []string{}
+	for _, s := range r.Solutions {
+		s = en.refine(s)
+		if n, ok := s.(*Num); ok && en.integer[x] && !n.val.IsInt() {
+			continue
+		}
+		if a, ok := en.assumed[x]; ok {
+			if in, known := a.Contains(s); known && !in {
+				continue
+			}
+		}
+		kept = append(kept, s)
+		text, tex = append(text, Eq(S(x), s).String()), append(tex, Eq(S(x), s).LaTeX())
+	}
+	if len(kept) < len(r.Solutions) {
+		st := SolveStep{Rule: "assumptions", Text: strings.Join(text, " or "), LaTeX: strings.Join(tex, `\ \text{or}\ `)}
+		if len(kept) == 0 {
+			st.Text, st.LaTeX = "no solution", `\text{no solution}`
+		}
+		steps = append(steps, st)
+	}
+	r.Solutions = kept
+	return steps, r, nil
+}
+
+// Evalf evaluates e with *big.Float arithmetic at the engine's precision,
+// as EvalIn with BigFloatDomain.
+func (en *Engine) Evalf(e Expr, env map[string]*big.Float) (*big.Float, error) {
+	if err := en.check(e); err != nil {
+		return nil, err
+	}
+	return EvalIn[*big.Float](e, BigFloatDomain{Prec: en.cfg.Prec}, env)
+}
+
+// HandleToolCall is HandleToolCall with the engine's limits and
+// assumptions: expression params that exceed the limits are rejected,
+// simplify runs within the engine's budget unless the call sets a smaller
+// one, a result that is one expression is refined as the engine's
+// methods refine theirs, and solve_steps keeps the solutions that
+// SolveSteps keeps. An "assumptions" param adds to the engine's
+// assumptions for this call only.
+func (en *Engine) HandleToolCall(req ToolRequest) ToolResponse {
+	return en.HandleToolCallStream(req, nil)
+}
+
+// HandleToolCallStream is HandleToolCallStream with the engine's limits
+// and assumptions, as in Engine.HandleToolCall. Partial results are passed
+// to emit as the tool produces them; only the final result is refined.
+func (en *Engine) HandleToolCallStream(req ToolRequest, emit func(ToolResponse) bool) ToolResponse {
+	params := make(map[string]interface{}, len(req.Params))
+	for k, v := range req.Params {
+		params[k] = v
+	}
+	if raw, ok := params["assumptions"]; ok {
+		delete(params, "assumptions")
+		if raw != nil {
+			a, err := assumptionsParam(raw)
+			if err != nil {
+				return errResponse(err)
+			}
+			call, err := en.WithAssumptions(a)
+			if err != nil {
+				return errResponse(err)
+			}
+			return call.HandleToolCallStream(ToolRequest{Tool: req.Tool, Params: params}, emit)
+		}
+	}
+	for _, spec := range toolSpecs {
+		if spec.Name != req.Tool {
+			continue
+		}
+		for _, tp := range spec.Params {
+			if raw, ok := params[tp.Name]; ok && raw != nil {
+				if err := en.checkToolParam(req.Tool, params, tp); err != nil {
+					return errResponse(err)
+				}
+			}
+		}
+	}
+	if req.Tool == "simplify" {
+		limits := map[string]float64{
+			"max_nodes":  float64(en.cfg.Budget.MaxNodes),
+			"timeout_ms": float64(en.cfg.Budget.Timeout / time.Millisecond),
+		}
+		for name, limit := range limits {
+			if limit <= 0 {
+				continue
+			}
+			if f, ok := params[name].(float64); !ok || f <= 0 || f > limit {
+				params[name] = limit
+			}
+		}
+	}
+	if en.cfg.Store != nil {
+		switch req.Tool {
+		case "store":
+			return storeTool(en.cfg.Store, params)
+		case "recall":
+			return recallTool(en.cfg.Store, params)
+		}
+	}
+	if len(en.assumed) == 0 && len(en.integer) == 0 {
+		return HandleToolCallStream(ToolRequest{Tool: req.Tool, Params: params}, emit)
+	}
+	if req.Tool == "solve_steps" {
+		eq, v, err := solveStepsParams(params)
+		if err != nil {
+			return errResponse(err)
+		}
+		steps, r, err := en.SolveSteps(eq, v)
+		if err != nil && r.Error == "" {
+			return errResponse(err)
+		}
+		return solveStepsResponse(steps, r)
+	}
+	resp := HandleToolCallStream(ToolRequest{Tool: req.Tool, Params: params}, emit)
+	m, ok := resp.Result.(map[string]interface{})
+	if _, typed := m["type"]; !ok || !typed || resp.Error != "" {
+		return resp
+	}
+	e, err := FromJSON(m)
+	if err != nil {
+		return resp
+	}
+	if r := en.refine(e); !StructEqual(r, e) {
+		partial := resp.Partial
+		resp = exprResponse(r)
+		resp.Partial = partial
+	}
+	return resp
+}
+
+// CacheStats returns the number of Simplify calls answered from the cache
+// and the number that were not.
+func (en *Engine) CacheStats() (hits, misses int) {
+	en.mu.Lock()
+	defer en.mu.Unlock()
+	return en.hits, en.misses
+}
+
+func (en *Engine) cached(h uint64, e Expr) (Expr, bool) {
+	if en.cfg.CacheSize <= 0 {
+		return nil, false
+	}
+	en.mu.Lock()
+	defer en.mu.Unlock()
+	for _, c := range en.cache[h] {
+		if StructEqual(c.in, e) {
+			en.hits++
+			return c.out, true
+		}
+	}
+	en.misses++
+	return nil, false
+}
+
+func (en *Engine) store(h uint64, in, out Expr) {
+	if en.cfg.CacheSize <= 0 {
+		return
+	}
+	en.mu.Lock()
+	defer en.mu.Unlock()
+	for _, c := range en.cache[h] {
+		if StructEqual(c.in, in) {
+			return
+		}
+	}
+	en.cache[h] = append(en.cache[h], engineCacheEntry{in, out})
+	en.order = append(en.order, h)
+	for len(en.order) > en.cfg.CacheSize {
+		old := en.order[0]
+		en.order = en.order[1:]
+		if es := en.cache[old]; len(es) > 1 {
+			en.cache[old] = es[1:]
+		} else {
+			delete(en.cache, old)
+		}
+	}
+}
+
+// refine replaces the comparisons in e, and the Piecewise conditions,
+// that the assumptions decide by 1 or 0, combines (x^a)^b into x^(a*b)
+// when x is assumed nonnegative or b is an integer, evaluates sin, cos
+// and tan at integer multiples of pi and powers of -1 with even or odd
+// exponents, and simplifies what changed.
+func (en *Engine) refine(e Expr) Expr {
+	if len(en.assumed) == 0 && len(en.integer) == 0 {
+		return e
+	}
+	r := en.refineNode(e)
+	if StructEqual(r, e) {
+		return e
+	}
+	return r.Simplify()
+}
+
+func (en *Engine) refineNode(e Expr) Expr {
+	switch t := e.(type) {
+	case *Relational:
+		if holds, known := en.decide(t); known {
+			if holds {
+				return N(1)
+			}
+			return N(0)
+		}
+		return t
+	case *Piecewise:
+		cases := make([]PieceCase, len(t.cases))
+		for i, c := range t.cases {
+			cond := c.Cond
+			if r, ok := cond.Relation().(*Relational); ok {
+				if holds, known := en.decide(r); known {
+					cond = Cond{N(0), RelNe, N(0)}
+					if holds {
+						cond.Op = RelEq
+					}
+				}
+			}
+			cases[i] = PieceCase{en.refineNode(c.Value), cond}
+		}
+		return &Piecewise{cases: cases, otherwise: en.refineNode(t.otherwise)}
+	case *Pow:
+		b, x := en.refineNode(t.base), en.refineNode(t.exp)
+		if isNumValue(b, -1) {
+			switch {
+			case en.integerValued(div(x, N(2)).Simplify()):
+				return N(1)
+			case en.integerValued(div(sub(x, N(1)), N(2)).Simplify()):
+				return N(-1)
+			}
+		}
+		if inner, ok := b.(*Pow); ok {
+			if en.integerValued(x) {
+				return en.refineNode(&Pow{base: inner.base, exp: &Mul{factors: []Expr{inner.exp, x}}})
+			}
+			if s, ok := inner.base.(*Sym); ok {
+				if holds, known := en.decide(Ge(s, N(0)).(*Relational)); holds && known {
+					return &Pow{base: s, exp: &Mul{factors: []Expr{inner.exp, x}}}
+				}
+			}
+		}
+		return &Pow{base: b, exp: x}
+	case *Func:
+		f := t.mapArgs(en.refineNode)
+		if len(f.args) == 1 && (f.name == "sin" || f.name == "cos" || f.name == "tan") {
+			if k := div(f.args[0], Pi).Simplify(); en.integerValued(k) {
+				if f.name == "cos" {
+					return en.refineNode(&Pow{base: N(-1), exp: k})
+				}
+				return N(0)
+			}
+		}
+		return f
+	}
+	_, cs := labeledChildren(e)
+	if len(cs) == 0 {
+		return e
+	}
+	out := make([]Expr, len(cs))
+	for i, c := range cs {
+		out[i] = en.refineNode(c)
+	}
+	return withChildren(e, out)
+}
+
+// integerValued reports whether e is an integer for all values of the
+// symbols in Integers: an integer, one of those symbols, or a sum,
+// product or nonnegative integer power of such.
+func (en *Engine) integerValued(e Expr) bool {
+	all := func(es []Expr) bool {
+		for _, x := range es {
+			if !en.integerValued(x) {
+				return false
+			}
+		}
+		return true
+	}
+	switch t := bare(e).(type) {
+	case *Num:
+		return t.val.IsInt()
+	case *Sym:
+		return en.integer[t.name]
+	case *Add:
+		return all(t.terms)
+	case *Mul:
+		return all(t.factors)
+	case *Pow:
+		n, ok := t.exp.(*Num)
+		return ok && n.val.IsInt() && n.val.Sign() >= 0 && en.integerValued(t.base)
+	}
+	return false
+}
+
+// decide reports whether r holds for all values the assumptions allow,
+// or for none, when r is in a single assumed symbol.
+func (en *Engine) decide(r *Relational) (holds, known bool) {
+	syms := FreeSymbols(r)
+	if len(syms) != 1 {
+		return false, false
+	}
+	a, ok := en.assumed[syms[0]]
+	if !ok {
+		return false, false
+	}
+	if en.integer[syms[0]] {
+		a = integerHull(a)
+	}
+	s, err := SolveInequality(r, syms[0])
+	if err != nil {
+		return false, false
+	}
+	if in, err := a.Intersect(s); err == nil && in.IsEmpty() {
+		return false, true
+	}
+	c, err := s.Complement()
+	if err != nil {
+		return false, false
+	}
+	if out, err := a.Intersect(c); err == nil && out.IsEmpty() {
+		return true, true
+	}
+	return false, false
+}
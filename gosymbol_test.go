@@ -0,0 +1,5710 @@
+package gosymbol_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/njchilds90/gosymbol"
+)
+
+var (
+	x = gosymbol.S("x")
+	y = gosymbol.S("y")
+)
+
+func assertStr(t *testing.T, got gosymbol.Expr, want string) {
+	t.Helper()
+	if got == nil {
+		t.Fatalf("got nil expression, want %q", want)
+	}
+	if s := got.String(); s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+}
+
+func mustParse(t testing.TB, s string) gosymbol.Expr {
+	t.Helper()
+	e, err := gosymbol.Parse(s)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", s, err)
+	}
+	return e
+}
+
+// ------------------------------------------------------------
+// Num
+// ------------------------------------------------------------
+
+func TestNumString(t *testing.T) {
+	assertStr(t, gosymbol.N(42), "42")
+	assertStr(t, gosymbol.N(-7), "-7")
+	assertStr(t, gosymbol.F(1, 3), "1/3")
+	assertStr(t, gosymbol.F(2, 4), "1/2")
+	assertStr(t, gosymbol.F(-3, 6), "-1/2")
+	assertStr(t, gosymbol.F(6, 3), "2")
+}
+
+func TestNumZeroDenominatorPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("F(1, 0) did not panic")
+		}
+	}()
+	gosymbol.F(1, 0)
+}
+
+func TestNumArithmetic(t *testing.T) {
+	assertStr(t, gosymbol.AddOf(gosymbol.F(1, 3), gosymbol.F(1, 6)).Simplify(), "1/2")
+	assertStr(t, gosymbol.MulOf(gosymbol.F(2, 3), gosymbol.F(3, 4)).Simplify(), "1/2")
+	assertStr(t, gosymbol.PowOf(gosymbol.F(2, 3), gosymbol.N(-2)).Simplify(), "9/4")
+	assertStr(t, gosymbol.AddOf(gosymbol.N(1), gosymbol.N(-1)).Simplify(), "0")
+}
+
+func TestNumStaysExact(t *testing.T) {
+	// 1/3 must not decay to 0.333…: three thirds are exactly one, through
+	// construction, parsing and symbolic simplification alike.
+	third := gosymbol.F(1, 3)
+	assertStr(t, gosymbol.AddOf(third, third, third), "1")
+	assertStr(t, mustParse(t, "1/3 + 1/3 + 1/3").Simplify(), "1")
+	assertStr(t, mustParse(t, "(1/3)*x + (2/3)*x").Simplify(), "x")
+	assertStr(t, gosymbol.PowOf(third, gosymbol.N(40)).Simplify(), "1/12157665459056928801")
+
+	huge, _ := new(big.Rat).SetString("123456789012345678901234567891/2")
+	n := gosymbol.NRat(huge)
+	huge.SetInt64(0)
+	assertStr(t, n, "123456789012345678901234567891/2")
+	assertStr(t, gosymbol.MulOf(n, gosymbol.N(2)).Simplify(), "123456789012345678901234567891")
+
+	// Conversion to float happens only at evaluation.
+	if v, err := gosymbol.EvalT(third, map[string]float64{}); err != nil || v != 1.0/3 {
+		t.Errorf("EvalT(1/3) = %v, %v", v, err)
+	}
+}
+
+func TestNFloat(t *testing.T) {
+	if got := gosymbol.NFloat(0.5).Float64(); got != 0.5 {
+		t.Errorf("NFloat(0.5) = %v", got)
+	}
+}
+
+// ------------------------------------------------------------
+// Simplify
+// ------------------------------------------------------------
+
+func TestAutoSimplify(t *testing.T) {
+	if !gosymbol.AutoSimplify() {
+		t.Fatal("auto simplification should be on by default")
+	}
+	assertStr(t, gosymbol.AddOf(x, gosymbol.N(0)), "x")
+	assertStr(t, gosymbol.MulOf(gosymbol.N(1), x), "x")
+	assertStr(t, gosymbol.MulOf(gosymbol.N(0), x), "0")
+	assertStr(t, gosymbol.PowOf(x, gosymbol.N(1)), "x")
+	assertStr(t, gosymbol.PowOf(x, gosymbol.N(0)), "1")
+	assertStr(t, gosymbol.PowOf(gosymbol.N(2), gosymbol.N(3)), "8")
+	assertStr(t, gosymbol.AddOf(gosymbol.N(2), y, gosymbol.AddOf(x, gosymbol.N(3))), "y + x + 5")
+	assertStr(t, gosymbol.MulOf(gosymbol.N(2), x, gosymbol.MulOf(gosymbol.N(3), y)), "6*x*y")
+
+	e := mustParse(t, "x^3*sin(x)")
+	light := e.Diff("x").String()
+	prev := gosymbol.SetAutoSimplify(false)
+	defer gosymbol.SetAutoSimplify(prev)
+	raw := e.Diff("x").String()
+	if len(light) >= len(raw) {
+		t.Errorf("light Diff %q not smaller than raw %q", light, raw)
+	}
+	assertStr(t, gosymbol.AddOf(x, gosymbol.N(0)), "x + 0")
+	assertStr(t, gosymbol.PowOf(x, gosymbol.N(1)), "x^1")
+}
+
+func TestSimplifyLikeTerms(t *testing.T) {
+	assertStr(t, gosymbol.AddOf(x, x, gosymbol.N(2)).Simplify(), "2*x + 2")
+	assertStr(t, gosymbol.AddOf(gosymbol.MulOf(gosymbol.N(2), x), gosymbol.MulOf(gosymbol.N(3), x)).Simplify(), "5*x")
+	assertStr(t, gosymbol.AddOf(x, gosymbol.MulOf(gosymbol.N(-1), x)).Simplify(), "0")
+	// Terms match by their non-numeric factors in canonical order, and
+	// rational coefficients add exactly.
+	assertStr(t, mustParse(t, "x*y + y*x").Simplify(), "2*x*y")
+	assertStr(t, mustParse(t, "2*x*y - 3*y*x").Simplify(), "-x*y")
+	assertStr(t, mustParse(t, "x/2 + x/3").Simplify(), "5/6*x")
+	assertStr(t, mustParse(t, "2*sin(x) + 3*sin(x)").Simplify(), "5*sin(x)")
+	assertStr(t, mustParse(t, "a*x + b*x").Simplify(), "a*x + b*x")
+	// Numeric multiples of sums are distributed before terms collect.
+	assertStr(t, mustParse(t, "x - (x + 1)").Simplify(), "-1")
+	assertStr(t, mustParse(t, "x + (y - (x + y))").Simplify(), "0")
+	assertStr(t, mustParse(t, "2*(x + 1) - 2*x").Simplify(), "2")
+	assertStr(t, mustParse(t, "y - 3*(x - y)/2").Simplify(), "-3/2*x + 5/2*y")
+}
+
+func TestSimplifyMulCollectsPowers(t *testing.T) {
+	assertStr(t, gosymbol.MulOf(x, gosymbol.N(2), x).Simplify(), "2*x^2")
+	assertStr(t, gosymbol.MulOf(gosymbol.PowOf(x, gosymbol.N(2)), gosymbol.PowOf(x, gosymbol.N(3))).Simplify(), "x^5")
+	assertStr(t, gosymbol.MulOf(x, gosymbol.PowOf(x, gosymbol.N(-1))).Simplify(), "1")
+	assertStr(t, gosymbol.MulOf(gosymbol.N(0), x).Simplify(), "0")
+}
+
+func TestSimplifyFlattensNested(t *testing.T) {
+	// Nested sums and products, as built left to right by the parser or by
+	// repeated AddOf and MulOf calls, flatten into one n-ary node.
+	two := gosymbol.N(2)
+	assertStr(t, gosymbol.AddOf(gosymbol.AddOf(x, two), x).Simplify(), "2*x + 2")
+	assertStr(t, gosymbol.MulOf(gosymbol.MulOf(x, two), x).Simplify(), "2*x^2")
+	assertStr(t, mustParse(t, "x + 2 + x").Simplify(), "2*x + 2")
+	assertStr(t, mustParse(t, "x*2*x").Simplify(), "2*x^2")
+	s := mustParse(t, "((a + b) + (c + (d + a)))").Simplify().(*gosymbol.Add)
+	for _, term := range s.Terms() {
+		if _, nested := term.(*gosymbol.Add); nested {
+			t.Errorf("%s has nested sum %s", s, term)
+		}
+	}
+	assertStr(t, s, "2*a + b + c + d")
+}
+
+func TestSimplifyFoldsConstants(t *testing.T) {
+	// Numeric operands fold wherever they sit among the flattened terms or
+	// factors, both in the constructors and in Simplify.
+	two, three := gosymbol.N(2), gosymbol.N(3)
+	assertStr(t, gosymbol.AddOf(two, x, three), "x + 5")
+	assertStr(t, gosymbol.MulOf(two, x, three), "6*x")
+	assertStr(t, gosymbol.MulOf(two, gosymbol.MulOf(x, three)), "6*x")
+	assertStr(t, mustParse(t, "2 + x + 3").Simplify(), "x + 5")
+	assertStr(t, mustParse(t, "(2 + x) + (3 + y)").Simplify(), "x + y + 5")
+	assertStr(t, mustParse(t, "2*x*3*y*(1/6)").Simplify(), "x*y")
+	assertStr(t, mustParse(t, "sin(2 + x + 3)*2*x*3").Simplify(), "6*x*sin(x + 5)")
+	assertStr(t, mustParse(t, "2^(1/2)*x*2^(1/2)").Simplify(), "2*x")
+}
+
+func TestSimplifyDeterministicOrder(t *testing.T) {
+	a := gosymbol.AddOf(y, x, gosymbol.N(1)).Simplify().String()
+	b := gosymbol.AddOf(gosymbol.N(1), x, y).Simplify().String()
+	if a != b || a != "x + y + 1" {
+		t.Errorf("got %q and %q, want both %q", a, b, "x + y + 1")
+	}
+	assertStr(t, gosymbol.MulOf(y, x).Simplify(), "x*y")
+}
+
+func TestSimplifyPow(t *testing.T) {
+	assertStr(t, gosymbol.PowOf(x, gosymbol.N(0)).Simplify(), "1")
+	assertStr(t, gosymbol.PowOf(x, gosymbol.N(1)).Simplify(), "x")
+	assertStr(t, gosymbol.PowOf(gosymbol.N(1), x).Simplify(), "1")
+	assertStr(t, gosymbol.PowOf(gosymbol.N(2), gosymbol.N(10)).Simplify(), "1024")
+	assertStr(t, gosymbol.SqrtOf(gosymbol.N(4)).Simplify(), "2")
+	assertStr(t, gosymbol.SqrtOf(gosymbol.F(1, 4)).Simplify(), "1/2")
+	assertStr(t, gosymbol.SqrtOf(gosymbol.N(2)).Simplify(), "2^(1/2)")
+	assertStr(t, gosymbol.PowOf(gosymbol.PowOf(x, gosymbol.N(2)), gosymbol.N(3)).Simplify(), "x^6")
+	assertStr(t, gosymbol.PowOf(gosymbol.MulOf(gosymbol.N(2), x), gosymbol.N(2)).Simplify(), "4*x^2")
+}
+
+func TestSimplifyPowerRules(t *testing.T) {
+	for in, want := range map[string]string{
+		"x^a*x^b":      "x^(a + b)",
+		"x^a/x^b":      "x^(a - b)",
+		"x^a*x^-a":     "1",
+		"x^(a + 1)/x":  "x^a",
+		"(x^a)^2":      "x^(2*a)",
+		"(x^(1/2))^a":  "x^(1/2*a)",
+		"(2^a)^b":      "2^(a*b)",
+		"(x^a)^b":      "(x^a)^b",
+		"(x^2)^(1/2)":  "(x^2)^(1/2)",
+		"x*x^-1*y^-1":  "y^-1",
+		"(x^-1)^(1/2)": "(x^-1)^(1/2)",
+	} {
+		assertStr(t, mustParse(t, in).Simplify(), want)
+	}
+
+	// (x^a)^b = x^(a*b) needs x >= 0, which the Engine's assumptions supply.
+	en, err := gosymbol.NewEngine(gosymbol.EngineConfig{Assumptions: []gosymbol.Expr{mustParse(t, "x >= 0")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for in, want := range map[string]string{"(x^a)^b": "x^(a*b)", "sqrt(x^2)": "x", "(y^2)^(1/2)": "(y^2)^(1/2)"} {
+		r, _, err := en.Simplify(mustParse(t, in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStr(t, r, want)
+	}
+}
+
+func TestSimplifyFuncSpecialValues(t *testing.T) {
+	zero := gosymbol.N(0)
+	assertStr(t, gosymbol.SinOf(zero).Simplify(), "0")
+	assertStr(t, gosymbol.CosOf(zero).Simplify(), "1")
+	assertStr(t, gosymbol.ExpOf(zero).Simplify(), "1")
+	assertStr(t, gosymbol.LnOf(gosymbol.N(1)).Simplify(), "0")
+	assertStr(t, gosymbol.AbsOf(gosymbol.N(-3)).Simplify(), "3")
+}
+
+func TestSimplifyExactTrig(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"sin(pi/6)", "1/2"},
+		{"cos(pi/4)", "1/2*2^(1/2)"},
+		{"sin(pi/3)", "1/2*3^(1/2)"},
+		{"sin(pi)", "0"},
+		{"cos(pi)", "-1"},
+		{"cos(2*pi)", "1"},
+		{"sin(-pi/3)", "-1/2*3^(1/2)"},
+		{"cos(5*pi/6)", "-1/2*3^(1/2)"},
+		{"sin(7*pi/4)", "-1/2*2^(1/2)"},
+		{"sin(13*pi/6)", "1/2"},
+		{"tan(pi/6)", "1/3*3^(1/2)"},
+		{"tan(pi/3)", "3^(1/2)"},
+		{"tan(3*pi/4)", "-1"},
+		{"tan(pi/2)", "tan(1/2*pi)"},
+		{"sin(pi/5)", "sin(1/5*pi)"},
+		{"sin(pi/6)^2 + cos(pi/6)^2", "1"},
+	}
+	for _, c := range cases {
+		assertStr(t, mustParse(t, c.in).Simplify(), c.want)
+	}
+}
+
+func TestPi(t *testing.T) {
+	assertStr(t, gosymbol.Diff(mustParse(t, "pi*x^2"), "x"), "2*x*pi")
+	if len(gosymbol.FreeSymbols(mustParse(t, "pi*x"))) != 1 {
+		t.Error("pi should not be a free symbol")
+	}
+	v, ok := gosymbol.MulOf(gosymbol.N(2), gosymbol.Pi).Eval()
+	if !ok || math.Abs(v.Float64()-2*math.Pi) > 1e-15 {
+		t.Errorf("Eval(2*pi) = %v, %v", v, ok)
+	}
+	if got := gosymbol.Pi.LaTeX(); got != `\pi` {
+		t.Errorf("LaTeX = %q", got)
+	}
+	assertStr(t, gosymbol.Sub(mustParse(t, "pi + x"), "pi", gosymbol.N(3)), "x + pi")
+	if v, ok := mustParse(t, "sin(pi)").Eval(); !ok || !v.IsZero() {
+		t.Errorf("sin(pi) = %v, want exactly 0", v)
+	}
+}
+
+func TestE(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"e", "e"},
+		{"ln(e)", "1"},
+		{"ln(e^3)", "3"},
+		{"ln(exp(x))", "x"},
+		{"exp(1)", "e"},
+		{"e^x", "exp(x)"},
+		{"e*e", "exp(2)"},
+		{"lambertw(e)", "1"},
+	}
+	for _, c := range cases {
+		assertStr(t, mustParse(t, c.in).Simplify(), c.want)
+	}
+	if len(gosymbol.FreeSymbols(mustParse(t, "e*x"))) != 1 {
+		t.Error("e should not be a free symbol")
+	}
+	assertStr(t, gosymbol.Diff(mustParse(t, "e^x + e*x"), "x"), "e + exp(x)")
+	if v, ok := gosymbol.E.Eval(); !ok || v.Float64() != math.E {
+		t.Errorf("Eval(e) = %v", v)
+	}
+	F, _ := gosymbol.Integrate(mustParse(t, "e^(2*x)"), "x")
+	assertStr(t, F, "1/2*exp(2*x)")
+	e, err := gosymbol.ParseMathML(`<math><msup><mi>ⅇ</mi><mi>x</mi></msup></math>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, e.Simplify(), "exp(x)")
+	// erf' carries the exact factor 2/sqrt(pi).
+	assertStr(t, gosymbol.Diff(mustParse(t, "erf(x)"), "x"), "2*exp(-x^2)*pi^(-1/2)")
+}
+
+func TestSimplifyPythagorean(t *testing.T) {
+	e := gosymbol.AddOf(gosymbol.PowOf(gosymbol.SinOf(x), gosymbol.N(2)), gosymbol.PowOf(gosymbol.CosOf(x), gosymbol.N(2)))
+	assertStr(t, e.Simplify(), "1")
+	assertStr(t, mustParse(t, "9*sin(2*x)^2 + 9*cos(2*x)^2 + x").Simplify(), "x + 9")
+	assertStr(t, mustParse(t, "2*sin(x)^2 + cos(x)^2").Simplify(), "cos(x)^2 + 2*sin(x)^2")
+}
+
+func TestSimplifyAbsGamma(t *testing.T) {
+	assertStr(t, mustParse(t, "abs(1 - x) - abs(x - 1)").Simplify(), "0")
+	assertStr(t, mustParse(t, "abs(-3*x)").Simplify(), "abs(3*x)")
+	assertStr(t, mustParse(t, "gamma(5)").Simplify(), "24")
+	assertStr(t, mustParse(t, "gamma(1/2)").Simplify(), "gamma(1/2)")
+}
+
+func TestSimplifyBudgeted(t *testing.T) {
+	e := mustParse(t, "(x + x)*(y + 2*y) + sin(0)*x")
+	for _, c := range []struct {
+		maxNodes int
+		want     string
+		partial  bool
+	}{
+		{0, "6*x*y", false},
+		{1, "(x + x)*(y + 2*y) + sin(0)*x", true},
+		{6, "2*x*(y + 2*y) + sin(0)*x", true},
+		{10, "6*x*y + sin(0)*x", true},
+		{14, "6*x*y", false},
+	} {
+		got, partial := gosymbol.SimplifyBudgeted(e, gosymbol.SimplifyBudget{MaxNodes: c.maxNodes})
+		if got.String() != c.want || partial != c.partial {
+			t.Errorf("MaxNodes %d: got %s, partial %v; want %s, %v", c.maxNodes, got, partial, c.want, c.partial)
+		}
+		env := map[string]float64{"x": 1.5, "y": -2}
+		if v, err := gosymbol.EvalT(got, env); err != nil || math.Abs(v+18) > 1e-12 {
+			t.Errorf("MaxNodes %d: %s evaluates to %v, %v; want -18", c.maxNodes, got, v, err)
+		}
+	}
+
+	terms := make([]gosymbol.Expr, 2000)
+	for i := range terms {
+		terms[i] = gosymbol.MulOf(gosymbol.N(int64(i)), gosymbol.PowOf(x, gosymbol.N(int64(i%7))))
+	}
+	if _, partial := gosymbol.SimplifyBudgeted(gosymbol.AddOf(terms...), gosymbol.SimplifyBudget{Timeout: time.Nanosecond}); !partial {
+		t.Error("1ns timeout: want partial result")
+	}
+
+	resp := toolCall(t, "simplify", `{"expr": "(x + x)*(y + 2*y)", "max_nodes": 4}`)
+	if resp.Error != "" || !resp.Partial || resp.String != "2*x*(y + 2*y)" {
+		t.Errorf("simplify tool with max_nodes: got %+v", resp)
+	}
+	if resp := toolCall(t, "simplify", `{"expr": "x + x", "timeout_ms": 1000}`); resp.Partial || resp.String != "2*x" {
+		t.Errorf("simplify tool with timeout_ms: got %+v", resp)
+	}
+}
+
+func TestSimplifyWith(t *testing.T) {
+	for _, c := range []struct {
+		in         string
+		strategies []string
+		want       string
+	}{
+		{"x + x", nil, "2*x"},
+		{"(x^2 - 1)/(x - 1)", []string{"ratsimp"}, "x + 1"},
+		{"sin(x)^2 + cos(x)^2 + (x + 1)^2", []string{"trigsimp", "expand"}, "x^2 + 2*x + 2"},
+		{"sin(2*x)", []string{"trigexpand"}, "2*cos(x)*sin(x)"},
+		{"(x + 1)^2", []string{"expand", "factor"}, "(x + 1)^2"},
+	} {
+		got, partial, err := gosymbol.SimplifyWith(mustParse(t, c.in), gosymbol.SimplifyOpts{Strategies: c.strategies})
+		if err != nil || partial || got.String() != c.want {
+			t.Errorf("SimplifyWith(%s, %v) = %v, %v, %v; want %s", c.in, c.strategies, got, partial, err, c.want)
+		}
+	}
+
+	e := mustParse(t, "(x + 1)^2")
+	if got, partial, _ := gosymbol.SimplifyWith(e, gosymbol.SimplifyOpts{Strategies: []string{"expand"}, MaxIterations: 1}); !partial || got.String() != "x^2 + 2*x + 1" {
+		t.Errorf("MaxIterations 1: got %v, partial %v", got, partial)
+	}
+	if _, _, err := gosymbol.SimplifyWith(e, gosymbol.SimplifyOpts{Strategies: []string{"bogus"}}); err == nil || !strings.Contains(err.Error(), `"bogus"`) {
+		t.Errorf("unknown strategy: got error %v", err)
+	}
+	terms := make([]gosymbol.Expr, 2000)
+	for i := range terms {
+		terms[i] = gosymbol.MulOf(gosymbol.N(int64(i)), gosymbol.PowOf(x, gosymbol.N(int64(i%7))))
+	}
+	if _, partial, _ := gosymbol.SimplifyWith(gosymbol.AddOf(terms...), gosymbol.SimplifyOpts{Timeout: time.Nanosecond}); !partial {
+		t.Error("1ns timeout: want partial result")
+	}
+
+	if resp := toolCall(t, "simplify", `{"expr": "(x^2 - 1)/(x - 1)", "strategies": ["cancel"]}`); resp.Error != "" || resp.String != "x + 1" {
+		t.Errorf("simplify tool with strategies: got %+v", resp)
+	}
+	if resp := toolCall(t, "simplify", `{"expr": "x", "strategies": ["bogus"]}`); !strings.Contains(resp.Error, "unknown strategy") {
+		t.Errorf("simplify tool with unknown strategy: got %+v", resp)
+	}
+}
+
+func TestSimplifySearch(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"(sin(x) + cos(x))^2 - 2*sin(x)*cos(x)", "1"},
+		{"(x + 1)^2 - (x - 1)^2", "4*x"},
+		{"x^2 + 2*x + 1", "(x + 1)^2"},
+		{"(x^2 - 1)/(x - 1) + sin(x)^2 + cos(x)^2", "x + 2"},
+		{"ln(2) + ln(x)", "ln(2) + ln(x)"},
+	} {
+		e := mustParse(t, c.in)
+		got, err := gosymbol.SimplifySearch(e, gosymbol.SearchOpts{Seed: 1})
+		if err != nil || got.String() != c.want {
+			t.Errorf("SimplifySearch(%s) = %v, %v; want %s", c.in, got, err, c.want)
+		}
+		if again, _ := gosymbol.SimplifySearch(e, gosymbol.SearchOpts{Seed: 1}); again.String() != got.String() {
+			t.Errorf("SimplifySearch(%s) is not reproducible: %s then %s", c.in, got, again)
+		}
+	}
+
+	// A cost that prefers expanded forms leads the search away from factors.
+	terms := func(e gosymbol.Expr) int {
+		if a, ok := e.(*gosymbol.Add); ok {
+			return -len(a.Terms())
+		}
+		return 0
+	}
+	got, _ := gosymbol.SimplifySearch(mustParse(t, "(x + 1)^2"), gosymbol.SearchOpts{Cost: terms, Strategies: []string{"expand", "factor"}})
+	assertStr(t, got, "x^2 + 2*x + 1")
+	if _, err := gosymbol.SimplifySearch(x, gosymbol.SearchOpts{Strategies: []string{"bogus"}}); err == nil {
+		t.Error("unknown strategy: want error")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	if !gosymbol.AddOf(x, y).Equal(gosymbol.AddOf(y, x)) {
+		t.Error("x + y should equal y + x")
+	}
+	if gosymbol.AddOf(x, y).Equal(gosymbol.MulOf(x, y)) {
+		t.Error("x + y should not equal x*y")
+	}
+}
+
+// ------------------------------------------------------------
+// Printing
+// ------------------------------------------------------------
+
+func TestString(t *testing.T) {
+	expr := gosymbol.AddOf(gosymbol.MulOf(gosymbol.N(3), gosymbol.PowOf(x, gosymbol.N(2))), gosymbol.N(1))
+	assertStr(t, expr.Simplify(), "3*x^2 + 1")
+	assertStr(t, gosymbol.MulOf(gosymbol.N(2), gosymbol.AddOf(x, gosymbol.N(1))).Simplify(), "2*(x + 1)")
+	assertStr(t, gosymbol.PowOf(gosymbol.AddOf(x, gosymbol.N(1)), gosymbol.N(2)), "(x + 1)^2")
+	assertStr(t, gosymbol.SqrtOf(x), "x^(1/2)")
+}
+
+func TestLaTeX(t *testing.T) {
+	cases := []struct {
+		e    gosymbol.Expr
+		want string
+	}{
+		{gosymbol.F(1, 3), `\frac{1}{3}`},
+		{gosymbol.F(-1, 3), `-\frac{1}{3}`},
+		{gosymbol.PowOf(x, gosymbol.N(2)), `x^{2}`},
+		{gosymbol.SinOf(x), `\sin\left(x\right)`},
+		{gosymbol.ExpOf(x), `e^{x}`},
+		{gosymbol.AbsOf(x), `\left|x\right|`},
+		{gosymbol.SqrtOf(x), `\sqrt{x}`},
+		{gosymbol.S("alpha"), `\alpha`},
+		{gosymbol.S("x_1"), `x_{1}`},
+		{gosymbol.AddOf(gosymbol.MulOf(gosymbol.N(3), gosymbol.PowOf(x, gosymbol.N(2))), gosymbol.N(1)), `3 x^{2} + 1`},
+		// A negative factor after the first is parenthesized.
+		{mustParse(t, "2*-3"), `2 \left(-3\right)`},
+		{mustParse(t, "x*(-1)"), `x \left(-1\right)`},
+		{mustParse(t, "x*(-1/2)*y"), `x \left(-\frac{1}{2}\right) y`},
+		{mustParse(t, "-2*x"), `-2 x`},
+	}
+	for _, c := range cases {
+		if got := gosymbol.LaTeX(c.e); got != c.want {
+			t.Errorf("LaTeX(%s) = %q, want %q", c.e, got, c.want)
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// Substitution and evaluation
+// ------------------------------------------------------------
+
+func TestSub(t *testing.T) {
+	expr := gosymbol.AddOf(gosymbol.MulOf(gosymbol.N(3), gosymbol.PowOf(x, gosymbol.N(2))), gosymbol.N(1))
+	assertStr(t, gosymbol.Sub(expr, "x", gosymbol.N(2)), "13")
+	assertStr(t, gosymbol.Sub(expr, "x", y), "3*y^2 + 1")
+	assertStr(t, gosymbol.Sub(expr, "z", y), "3*x^2 + 1")
+}
+
+func TestSubExpr(t *testing.T) {
+	u := gosymbol.S("u")
+	cases := []struct{ e, target, want string }{
+		{"sin(x)^2 + sin(x)", "sin(x)", "u^2 + u"},
+		{"cos(x)*sin(x)^3", "sin(x)", "u^3*cos(x)"},
+		{"x^4 + x^2 + 1", "x^2", "u^2 + u + 1"},
+		{"x^3", "x^2", "x^3"},
+		{"1/(x^2 + 1) + x^-2", "x^2", "(u + 1)^-1 + u^-1"},
+		{"x + sqrt(x)", "sqrt(x)", "u^2 + u"},
+		{"2*x*y + 3", "x*y", "2*u + 3"},
+		{"exp(x + 1) + x + 1 + y", "x + 1", "u + y + exp(u)"},
+		{"x^2 + y", "x", "u^2 + y"},
+		// The bound x of the integrand is not the free x of the limit.
+		{"integrate(exp(-x^2)*sin(x), x, 0, sin(x))", "sin(x)", "integrate(exp(-x^2)*sin(x), x, 0, u)"},
+	}
+	for _, c := range cases {
+		assertStr(t, gosymbol.SubExpr(mustParse(t, c.e), mustParse(t, c.target), u), c.want)
+	}
+}
+
+func TestEval(t *testing.T) {
+	v, ok := gosymbol.AddOf(gosymbol.F(1, 2), gosymbol.F(1, 3)).Eval()
+	if !ok || v.String() != "5/6" {
+		t.Errorf("Eval = %v, %v", v, ok)
+	}
+	if _, ok := gosymbol.AddOf(x, gosymbol.N(1)).Eval(); ok {
+		t.Error("Eval of x + 1 should fail")
+	}
+	v, ok = gosymbol.SinOf(gosymbol.N(1)).Eval()
+	if !ok || math.Abs(v.Float64()-math.Sin(1)) > 1e-15 {
+		t.Errorf("Eval(sin(1)) = %v, %v", v, ok)
+	}
+	if _, ok := gosymbol.LnOf(gosymbol.N(-1)).Eval(); ok {
+		t.Error("Eval of ln(-1) should fail")
+	}
+}
+
+func TestEvalT(t *testing.T) {
+	e := mustParse(t, "3*x^2 + sin(x) + 1/2")
+	want := 3*2.0*2.0 + math.Sin(2) + 0.5
+	f64, err := gosymbol.EvalT(e, map[string]float64{"x": 2})
+	if err != nil || math.Abs(f64-want) > 1e-12 {
+		t.Errorf("EvalT[float64] = %v, %v", f64, err)
+	}
+	f32, err := gosymbol.EvalT(e, map[string]float32{"x": 2})
+	if err != nil || math.Abs(float64(f32)-want) > 1e-5 {
+		t.Errorf("EvalT[float32] = %v, %v", f32, err)
+	}
+	c, err := gosymbol.EvalT(mustParse(t, "ln(z) + sqrt(z)"), map[string]complex128{"z": -1})
+	if err != nil || cmplx.Abs(c-complex(0, math.Pi+1)) > 1e-12 {
+		t.Errorf("EvalT[complex128] = %v, %v", c, err)
+	}
+	c64, err := gosymbol.EvalT(mustParse(t, "exp(z)"), map[string]complex64{"z": complex(0, float32(math.Pi))})
+	if err != nil || cmplx.Abs(complex128(c64)+1) > 1e-6 {
+		t.Errorf("EvalT[complex64] = %v, %v", c64, err)
+	}
+	if _, err := gosymbol.EvalT(mustParse(t, "gamma(z)"), map[string]complex128{"z": 1i}); err == nil {
+		t.Error("gamma of a complex argument should fail")
+	}
+	if _, err := gosymbol.EvalT(e, map[string]float64{}); err == nil {
+		t.Error("unbound symbol should fail")
+	}
+}
+
+// applyCounter is float64 arithmetic that counts function applications.
+type applyCounter struct{ calls int }
+
+func (*applyCounter) FromRat(r *big.Rat) float64  { f, _ := r.Float64(); return f }
+func (*applyCounter) FromFloat(f float64) float64 { return f }
+func (*applyCounter) Add(a, b float64) float64    { return a + b }
+func (*applyCounter) Mul(a, b float64) float64    { return a * b }
+func (*applyCounter) Pow(a, b float64) (float64, error) {
+	return math.Pow(a, b), nil
+}
+func (c *applyCounter) Apply(name string, x float64) (float64, error) {
+	c.calls++
+	return gosymbol.EvalT(gosymbol.FuncOf(name, gosymbol.S("v")), map[string]float64{"v": x})
+}
+
+func TestEvalShared(t *testing.T) {
+	defer gosymbol.SetAutoSimplify(gosymbol.SetAutoSimplify(false))
+	// Sixty levels of e = e + e share one node per level; the expanded
+	// tree has 2^60 leaves.
+	var e gosymbol.Expr = gosymbol.SinOf(x)
+	for i := 0; i < 60; i++ {
+		e = gosymbol.AddOf(e, e)
+	}
+	env := map[string]float64{"x": 0.5}
+	v, err := gosymbol.EvalTShared(e, env)
+	if want := math.Ldexp(math.Sin(0.5), 60); err != nil || math.Abs(v-want) > 1e-9*want {
+		t.Errorf("EvalTShared = %v, %v, want %v", v, err, want)
+	}
+
+	c := &applyCounter{}
+	if _, err := gosymbol.EvalInShared[float64](e, c, env); err != nil || c.calls != 1 {
+		t.Errorf("EvalInShared applied sin %d times (err %v), want once", c.calls, err)
+	}
+
+	d := gosymbol.DiffN(mustParse(t, "sin(x)*exp(x)*ln(x + 2)"), "x", 3)
+	want, _ := gosymbol.EvalT(d, env)
+	if got, err := gosymbol.EvalTShared(d, env); err != nil || got != want {
+		t.Errorf("EvalTShared(third derivative) = %v, %v, want %v", got, err, want)
+	}
+	if _, err := gosymbol.EvalTShared(d, map[string]float64{}); err == nil {
+		t.Error("unbound symbol should fail")
+	}
+}
+
+func TestSharedDAG(t *testing.T) {
+	defer gosymbol.SetAutoSimplify(gosymbol.SetAutoSimplify(false))
+	// Iterated squaring: thirty levels of e = e*e expand to 2^30 factors.
+	var e gosymbol.Expr = x
+	for i := 0; i < 30; i++ {
+		e = gosymbol.MulOf(e, e)
+	}
+	if n := gosymbol.DAGSize(e); n != 31 {
+		t.Errorf("DAGSize = %d, want 31", n)
+	}
+	assertStr(t, gosymbol.SimplifyShared(e), "x^1073741824")
+	assertStr(t, gosymbol.DiffShared(e, "x"), "1073741824*x^1073741823")
+	assertStr(t, gosymbol.DiffShared(e, "y"), "0")
+
+	// sin(u)*u + u with u shared at every level does not collapse.
+	var u gosymbol.Expr = gosymbol.AddOf(x, y)
+	for i := 0; i < 3; i++ {
+		u = gosymbol.AddOf(gosymbol.MulOf(gosymbol.SinOf(u), u), u)
+	}
+	env := map[string]float64{"x": 0.3, "y": -1.1}
+	want, _ := gosymbol.EvalT(gosymbol.Diff(u, "x"), env)
+	if got, err := gosymbol.EvalTShared(gosymbol.DiffShared(u, "x"), env); err != nil || math.Abs(got-want) > 1e-12 {
+		t.Errorf("DiffShared at %v = %v, %v, want %v", env, got, err, want)
+	}
+	assertStr(t, gosymbol.SimplifyShared(u), gosymbol.Simplify(u).String())
+
+	sq := gosymbol.MulOf(x, x)
+	if got, want := gosymbol.StringShared(gosymbol.MulOf(sq, sq)), "t1 = x*x\nt1*t1"; got != want {
+		t.Errorf("StringShared = %q, want %q", got, want)
+	}
+	t1 := gosymbol.MulOf(gosymbol.S("t1"), gosymbol.S("t1"))
+	if got, want := gosymbol.StringShared(gosymbol.AddOf(t1, t1)), "t_1 = t1*t1\nt_1 + t_1"; got != want {
+		t.Errorf("StringShared = %q, want %q", got, want)
+	}
+	if got := gosymbol.StringShared(e); strings.Count(got, "\n") != 29 || !strings.HasSuffix(got, "t29*t29") {
+		t.Errorf("StringShared(iterated square) = %q", got)
+	}
+	if got := gosymbol.StringShared(u); !strings.HasPrefix(got, "t1 = x + y\n") {
+		t.Errorf("StringShared = %q", got)
+	}
+}
+
+func TestCSE(t *testing.T) {
+	for _, c := range []struct {
+		in          []string
+		assignments string
+		reduced     string
+	}{
+		{[]string{"sin(x + 1)*cos(x + 1) + (x + 1)^2"}, "[t1 = x + 1]", "[sin(t1)*cos(t1) + t1^2]"},
+		{[]string{"sin(x + 1)", "exp(y*sin(x + 1))"}, "[t1 = sin(x + 1)]", "[t1 exp(y*t1)]"},
+		{[]string{"exp(x*y)*(x*y + 1)", "ln(x*y + 1)"}, "[t1 = x*y t2 = t1 + 1]", "[exp(t1)*t2 ln(t2)]"},
+		{[]string{"t1*t2 + x*y", "(x*y)^2"}, "[t_1 = x*y]", "[t1*t2 + t_1 t_1^2]"},
+		{[]string{"x + y + z", "x + y"}, "[]", "[x + y + z x + y]"},
+		{[]string{"integrate(k*(x - 1), k, 0, 1) + integrate(k*(x - 1), k, 0, 1)*y"},
+			"[t1 = integrate(k*(x - 1), k, 0, 1)]", "[t1 + t1*y]"},
+		{[]string{"sum(k*(x - 1), k, 1, n) + (x - 1)^2"}, "[]", "[sum(k*(x - 1), k, 1, n) + (x - 1)^2]"},
+	} {
+		var es []gosymbol.Expr
+		for _, s := range c.in {
+			es = append(es, mustParse(t, s))
+		}
+		as, red := gosymbol.CSE(es...)
+		if got := fmt.Sprint(as); got != c.assignments {
+			t.Errorf("CSE(%v) assignments = %s, want %s", c.in, got, c.assignments)
+		}
+		if got := fmt.Sprint(red); got != c.reduced {
+			t.Errorf("CSE(%v) reduced = %s, want %s", c.in, got, c.reduced)
+		}
+		for i, r := range red {
+			for j := len(as) - 1; j >= 0; j-- {
+				r = r.Sub(as[j].Name, as[j].Value)
+			}
+			if !r.Equal(es[i]) {
+				t.Errorf("CSE(%v): %s does not substitute back, got %s", c.in, red[i], r)
+			}
+		}
+	}
+	// Pointer sharing is found as well, and annotations are dropped.
+	sq := gosymbol.Annotate(mustParse(t, "x + 1"), gosymbol.Meta{Label: "s"})
+	as, red := gosymbol.CSE(gosymbol.MulOf(gosymbol.SinOf(sq), gosymbol.CosOf(sq)))
+	if fmt.Sprint(as, red) != "[t1 = x + 1] [sin(t1)*cos(t1)]" || len(gosymbol.Annotations(as[0].Value)) != 0 {
+		t.Errorf("CSE(annotated) = %v %v", as, red)
+	}
+}
+
+func BenchmarkDiffShared(b *testing.B) {
+	defer gosymbol.SetAutoSimplify(gosymbol.SetAutoSimplify(false))
+	var e gosymbol.Expr = gosymbol.SinOf(x)
+	for i := 0; i < 40; i++ {
+		e = gosymbol.MulOf(e, e)
+	}
+	for i := 0; i < b.N; i++ {
+		gosymbol.DiffShared(e, "x")
+	}
+}
+
+func TestEvalInBigFloat(t *testing.T) {
+	d := gosymbol.BigFloatDomain{Prec: 200}
+	v, err := gosymbol.EvalIn[*big.Float](mustParse(t, "(x + 1/3)^3 - sqrt(2)"), d, map[string]*big.Float{"x": d.FromRat(big.NewRat(2, 3))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := new(big.Float).SetPrec(200).Sqrt(new(big.Float).SetPrec(200).SetInt64(2))
+	want.Sub(new(big.Float).SetPrec(200).SetInt64(1), want)
+	if diff := new(big.Float).Sub(v, want); diff.Sign() != 0 && diff.MantExp(nil) > -190 {
+		t.Errorf("got %s, want %s", v.Text('g', 50), want.Text('g', 50))
+	}
+	if _, err := gosymbol.EvalIn[*big.Float](mustParse(t, "x^-1"), d, map[string]*big.Float{"x": d.FromFloat(0)}); err == nil {
+		t.Error("1/0 should fail")
+	}
+}
+
+func TestFreeSymbols(t *testing.T) {
+	syms := gosymbol.FreeSymbols(gosymbol.AddOf(y, gosymbol.SinOf(x), gosymbol.N(3)))
+	if fmt.Sprint(syms) != "[x y]" {
+		t.Errorf("got %v, want [x y]", syms)
+	}
+	if len(gosymbol.FreeSymbols(gosymbol.N(1))) != 0 {
+		t.Error("constant should have no free symbols")
+	}
+	pw := mustParse(t, "piecewise((a, n = -1), (KroneckerDelta(i, j), otherwise))")
+	if got := fmt.Sprint(gosymbol.FreeSymbols(pw)); got != "[a i j n]" {
+		t.Errorf("piecewise: got %v", got)
+	}
+}
+
+func TestWalkAndChildren(t *testing.T) {
+	e := mustParse(t, "x*sin(y + 1) + integrate(s^2, s, 0, x)")
+	var visited []string
+	gosymbol.Walk(e, func(n gosymbol.Expr) bool {
+		visited = append(visited, n.String())
+		_, isFunc := n.(*gosymbol.Func)
+		return !isFunc
+	})
+	want := []string{"x*sin(y + 1) + integrate(s^2, s, 0, x)", "x*sin(y + 1)", "x", "sin(y + 1)",
+		"integrate(s^2, s, 0, x)", "s^2", "s", "2", "0", "x"}
+	if strings.Join(visited, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Walk visited\n%s\nwant\n%s", strings.Join(visited, "; "), strings.Join(want, "; "))
+	}
+
+	cs := gosymbol.Children(e)
+	if len(cs) != 2 {
+		t.Fatalf("Children = %v", cs)
+	}
+	cs[0] = gosymbol.N(0)
+	assertStr(t, gosymbol.Children(e)[0], "x*sin(y + 1)")
+	for _, leaf := range []gosymbol.Expr{x, gosymbol.N(2), gosymbol.Pi} {
+		if cs := gosymbol.Children(leaf); len(cs) != 0 {
+			t.Errorf("Children(%s) = %v, want none", leaf, cs)
+		}
+	}
+	if cs := gosymbol.Children(mustParse(t, "piecewise((a, n < 0), (b, otherwise))")); len(cs) != 4 {
+		t.Errorf("piecewise children = %v, want value, lhs, rhs, otherwise", cs)
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	e := gosymbol.B(x).Add(y).Pow(gosymbol.N(2)).Mul(gosymbol.SinOf(x)).Expr()
+	want := gosymbol.MulOf(gosymbol.PowOf(gosymbol.AddOf(x, y), gosymbol.N(2)), gosymbol.SinOf(x))
+	if e.String() != want.String() {
+		t.Errorf("builder %q, nested %q", e, want)
+	}
+	assertStr(t, gosymbol.B(x).Sub(gosymbol.N(1)).Div(y).Simplify().Expr(), "y^-1*(x - 1)")
+	assertStr(t, gosymbol.B(x).Mul(gosymbol.N(2)).Apply("sin").Diff("x").Expr(), "2*cos(2*x)")
+	assertStr(t, gosymbol.B(x).Add(gosymbol.N(1)).Pow(gosymbol.N(2)).Expand().Replace("x", gosymbol.N(2)).Expr(), "9")
+	if got := gosymbol.B(x).Neg().String(); got != "-x" {
+		t.Errorf("Neg = %q", got)
+	}
+	if got := gosymbol.B(x).Pow(gosymbol.N(2)).LaTeX(); got != "x^{2}" {
+		t.Errorf("LaTeX = %q", got)
+	}
+}
+
+func TestAnnotated(t *testing.T) {
+	v := gosymbol.Annotate(mustParse(t, "x + 1"), gosymbol.Meta{Label: "v", Unit: "m/s", Source: "model.txt:3:5"})
+	e := gosymbol.MulOf(gosymbol.N(2), v, v)
+
+	// Printing, comparison and evaluation see through the annotation.
+	assertStr(t, e, "2*(x + 1)*(x + 1)")
+	assertStr(t, e.Simplify(), "2*(x + 1)^2")
+	if !v.Equal(mustParse(t, "1 + x")) {
+		t.Error("annotated x + 1 should equal 1 + x")
+	}
+	if f, err := gosymbol.EvalT(e, map[string]float64{"x": 2}); err != nil || f != 18 {
+		t.Errorf("EvalT = %v, %v", f, err)
+	}
+
+	// Simplify and Sub keep the metadata; Diff keeps the source and
+	// records the step.
+	s := v.Sub("x", gosymbol.N(2)).Simplify()
+	if m, ok := gosymbol.MetaOf(s); !ok || m.Label != "v" || m.Unit != "m/s" || s.String() != "3" {
+		t.Errorf("Sub: %s %+v", s, m)
+	}
+	d := v.Diff("x")
+	if m, ok := gosymbol.MetaOf(d); !ok || m.Label != "" || m.Unit != "" || m.Source != "model.txt:3:5" || strings.Join(m.Provenance, ";") != "Diff x" {
+		t.Errorf("Diff: %+v", m)
+	}
+	// An annotated number folds into the coefficient.
+	assertStr(t, gosymbol.Diff(e, "x"), "4*(x + 1)")
+
+	w := gosymbol.WithProvenance(gosymbol.WithProvenance(v, "step 1"), "step 2")
+	if m, _ := gosymbol.MetaOf(w); m.Label != "v" || strings.Join(m.Provenance, ";") != "step 1;step 2" {
+		t.Errorf("WithProvenance: %+v", m)
+	}
+	if as := gosymbol.Annotations(e); len(as) != 2 || as[0].Meta().Label != "v" || as[0].Expr().String() != "x + 1" {
+		t.Errorf("Annotations = %v", as)
+	}
+	if len(gosymbol.Annotations(gosymbol.StripMeta(e))) != 0 {
+		t.Error("StripMeta left annotations")
+	}
+
+	// Polynomial routines and Integrate see through annotations.
+	if deg := gosymbol.Degree(e, "x"); deg != 2 {
+		t.Errorf("Degree = %d", deg)
+	}
+	if r, ok := gosymbol.Integrate(v, "x"); !ok || r.String() != "1/2*x^2 + x" {
+		t.Errorf("Integrate = %v, %v", r, ok)
+	}
+
+	j, err := gosymbol.ToJSON(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(j), &m); err != nil {
+		t.Fatal(err)
+	}
+	back, err := gosymbol.FromJSON(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if as := gosymbol.Annotations(back); len(as) != 2 || as[1].Meta().Unit != "m/s" || back.String() != e.String() {
+		t.Errorf("JSON round trip: %s %v", back, as)
+	}
+}
+
+// ------------------------------------------------------------
+// Calculus
+// ------------------------------------------------------------
+
+func TestDiff(t *testing.T) {
+	poly := gosymbol.AddOf(
+		gosymbol.MulOf(gosymbol.N(3), gosymbol.PowOf(x, gosymbol.N(2))),
+		gosymbol.MulOf(gosymbol.N(2), x),
+		gosymbol.N(1),
+	)
+	cases := []struct {
+		e    gosymbol.Expr
+		want string
+	}{
+		{poly, "6*x + 2"},
+		{gosymbol.N(5), "0"},
+		{y, "0"},
+		{gosymbol.MulOf(x, gosymbol.SinOf(x)), "x*cos(x) + sin(x)"},
+		{gosymbol.SinOf(gosymbol.MulOf(gosymbol.N(2), x)), "2*cos(2*x)"},
+		{gosymbol.CosOf(x), "-sin(x)"},
+		{gosymbol.TanOf(x), "cos(x)^-2"},
+		{gosymbol.ExpOf(gosymbol.PowOf(x, gosymbol.N(2))), "2*x*exp(x^2)"},
+		{gosymbol.LnOf(x), "x^-1"},
+		{gosymbol.PowOf(gosymbol.N(2), x), "2^x*ln(2)"},
+		{gosymbol.PowOf(x, x), "x^x*(ln(x) + 1)"},
+		{gosymbol.SqrtOf(x), "1/2*x^(-1/2)"},
+	}
+	for _, c := range cases {
+		assertStr(t, gosymbol.Diff(c.e, "x"), c.want)
+	}
+}
+
+func TestEvalDual(t *testing.T) {
+	for _, s := range []string{"3*x^3 - 2*x + 1", "sin(x^2)*exp(x)", "x^x", "ln(x)/x", "sqrt(x + y)", "atan(x*y)^2", "erf(x) + gamma(x)", "2^x*pi"} {
+		e := mustParse(t, s)
+		env := map[string]float64{"x": 1.3, "y": 0.7}
+		v, d, err := gosymbol.EvalDual(e, env, "x")
+		if err != nil {
+			t.Errorf("EvalDual(%s): %v", s, err)
+			continue
+		}
+		wantV, _ := gosymbol.EvalT(e, env)
+		wantD, _ := gosymbol.EvalT(gosymbol.Diff(e, "x"), env)
+		if math.Abs(v-wantV) > 1e-12 || math.Abs(d-wantD) > 1e-9 {
+			t.Errorf("EvalDual(%s) = %v, %v; want %v, %v", s, v, d, wantV, wantD)
+		}
+	}
+	if _, d, _ := gosymbol.EvalDual(mustParse(t, "x^2*y"), map[string]float64{"x": 3, "y": 2}, "y"); d != 9 {
+		t.Errorf("d/dy x^2*y = %v, want 9", d)
+	}
+	if _, _, err := gosymbol.EvalDual(mustParse(t, "x + z"), map[string]float64{"x": 1}, "x"); err == nil {
+		t.Error("unbound symbol should fail")
+	}
+}
+
+func TestEvalWithError(t *testing.T) {
+	for _, c := range []struct {
+		in            string
+		x             float64
+		minDigits     float64
+		maxDigits     float64
+		cancellations int
+	}{
+		{"x^2 + 1", 3, 15, 16, 0},
+		{"1 + x - 1", 1e-12, 3, 4, 1},
+		{"sqrt(x + 1) - sqrt(x)", 1e12, 2, 4, 1},
+		{"1 - cos(x)", 1e-6, 2, 4, 1},
+		{"pi*x", 2, 15, 16, 0},
+	} {
+		env := map[string]float64{"x": c.x}
+		r, err := gosymbol.EvalWithError(mustParse(t, c.in), env)
+		if err != nil {
+			t.Errorf("EvalWithError(%s): %v", c.in, err)
+			continue
+		}
+		want, _ := gosymbol.EvalT(mustParse(t, c.in), env)
+		if d := r.CorrectDigits(); r.Value != want || d < c.minDigits || d > c.maxDigits || len(r.Cancellations) != c.cancellations {
+			t.Errorf("EvalWithError(%s) = %+v with %.2f digits", c.in, r, d)
+		}
+	}
+
+	// 1 - cos(x) is well conditioned; only the formula loses accuracy.
+	r, _ := gosymbol.EvalWithError(mustParse(t, "1 - cos(x)"), map[string]float64{"x": 1e-6})
+	if math.Abs(r.Condition-2) > 1e-3 || r.Cancellations[0].BitsLost < 40 || r.Cancellations[0].Sum.String() != "1 - cos(x)" {
+		t.Errorf("EvalWithError(1 - cos(x)) = %+v", r)
+	}
+	r, _ = gosymbol.EvalWithError(mustParse(t, "x - y"), map[string]float64{"x": 1, "y": 1})
+	if !math.IsInf(r.Condition, 1) || !math.IsInf(r.Cancellations[0].BitsLost, 1) || r.CorrectDigits() != 0 {
+		t.Errorf("EvalWithError(x - y) at x = y = %+v", r)
+	}
+	if r, _ := gosymbol.EvalWithError(mustParse(t, "gamma(x)"), map[string]float64{"x": 3.5}); !math.IsInf(r.Bound, 1) {
+		t.Errorf("gamma has no interval rule, Bound = %v", r.Bound)
+	}
+	if _, err := gosymbol.EvalWithError(mustParse(t, "x + z"), map[string]float64{"x": 1}); err == nil {
+		t.Error("unbound symbol should fail")
+	}
+}
+
+func TestTaylorModel(t *testing.T) {
+	for _, c := range []struct {
+		in       string
+		lo, hi   float64
+		order    int
+		maxWidth float64
+	}{
+		{"x - x^2", 0, 1, 2, 0.26},
+		{"sin(x) - x", -0.5, 0.5, 5, 0.05},
+		{"exp(x)*sin(x)", 0, 1, 6, 2.4},
+		{"ln(1 + x) - x", 0, 0.25, 6, 0.03},
+		{"sqrt(x)", 1, 2, 4, 0.42},
+		{"x^x", 1, 2, 5, 3.1},
+		{"abs(x)*x", -1, 1, 3, 2.1},
+	} {
+		e := mustParse(t, c.in)
+		m, err := gosymbol.TaylorModelOf(e, "x", gosymbol.Interval{Lo: c.lo, Hi: c.hi}, c.order)
+		if err != nil {
+			t.Errorf("TaylorModelOf(%s): %v", c.in, err)
+			continue
+		}
+		b, p := m.Bound(), m.Expr("x")
+		if b.Hi-b.Lo > c.maxWidth {
+			t.Errorf("TaylorModelOf(%s).Bound() = %v, too wide", c.in, b)
+		}
+		for i := 0; i <= 200; i++ {
+			env := map[string]float64{"x": c.lo + (c.hi-c.lo)*float64(i)/200}
+			v, _ := gosymbol.EvalT(e, env)
+			pv, _ := gosymbol.EvalT(p, env)
+			if !b.Contains(v) || v-pv < m.Rem.Lo-1e-12 || v-pv > m.Rem.Hi+1e-12 {
+				t.Fatalf("%s at x = %v: %v not enclosed by %v or %s + %v", c.in, env["x"], v, b, p, m.Rem)
+			}
+		}
+	}
+
+	// The model tracks the dependency that interval arithmetic loses.
+	e := mustParse(t, "x - x^2")
+	iv, _ := gosymbol.EvalIn[gosymbol.Interval](e, gosymbol.IntervalDomain{}, map[string]gosymbol.Interval{"x": {Lo: 0, Hi: 1}})
+	if iv.Hi-iv.Lo < 1.9 {
+		t.Errorf("interval enclosure = %v, expected the overestimate [-1, 1]", iv)
+	}
+	if _, err := gosymbol.TaylorModelOf(e, "x", gosymbol.Interval{Lo: 1, Hi: 0}, 2); err == nil {
+		t.Error("expected an error for an empty interval")
+	}
+	if _, err := gosymbol.TaylorModelOf(mustParse(t, "x + y"), "x", gosymbol.Interval{Lo: 0, Hi: 1}, 2); err == nil {
+		t.Error("expected an error for an unbound symbol")
+	}
+	// Huge arguments of sin and cos give [-1, 1] without reducing them.
+	for _, s := range []string{"sin(10^100 + x)", "cos(10^300*x)", "sin(10^15 + x)"} {
+		done := make(chan gosymbol.Interval, 1)
+		go func() {
+			m, err := gosymbol.TaylorModelOf(mustParse(t, s), "x", gosymbol.Interval{Lo: 0, Hi: 1}, 3)
+			if err != nil {
+				t.Errorf("TaylorModelOf(%s): %v", s, err)
+			}
+			done <- m.Bound()
+		}()
+		select {
+		case b := <-done:
+			if b.Lo < -1-1e-9 || b.Hi > 1+1e-9 {
+				t.Errorf("TaylorModelOf(%s).Bound() = %v, want within [-1, 1]", s, b)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("TaylorModelOf(%s) did not return", s)
+		}
+	}
+}
+func TestCompileProgram(t *testing.T) {
+	params := []string{"x", "y"}
+	args := []float64{1.3, 0.7}
+	env := map[string]float64{"x": 1.3, "y": 0.7}
+	for _, s := range []string{"3*x^3 - 2*x + 1", "sin(x^2)*exp(x)/y", "x^x", "sqrt(x + y)", "-x*y - y", "atan(x*y)^2", "erf(x) + gamma(x)", "2^x*pi + ln(2)", "y"} {
+		e := mustParse(t, s)
+		p, err := gosymbol.CompileProgram(e, params)
+		if err != nil {
+			t.Errorf("CompileProgram(%s): %v", s, err)
+			continue
+		}
+		want, _ := gosymbol.EvalT(e, env)
+		if got, err := p.Exec(args); err != nil || math.Abs(got-want) > 1e-12*math.Max(1, math.Abs(want)) {
+			t.Errorf("Exec(%s) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	// Parameter-free subtrees fold to a single constant.
+	p, err := gosymbol.CompileProgram(mustParse(t, "x + sin(1)*ln(2)^2"), params)
+	if err != nil || p.Len() != 3 {
+		t.Errorf("CompileProgram folded to %d instructions (err %v), want 3", p.Len(), err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { p.Exec(args) }); allocs != 0 {
+		t.Errorf("Exec allocates %v times per call", allocs)
+	}
+	got, _ := p.Clone().Exec(args)
+	if want, _ := p.Exec(args); got != want {
+		t.Errorf("Clone().Exec = %v, want %v", got, want)
+	}
+	for _, a := range [][]float64{nil, {1.3}, {1.3, 0.7, 2}} {
+		if _, err := p.Exec(a); err == nil {
+			t.Errorf("Exec(%v) with 2 parameters should fail", a)
+		}
+	}
+	for _, e := range []gosymbol.Expr{mustParse(t, "x + z"), gosymbol.IntegralOf(mustParse(t, "x*s"), "s", gosymbol.N(0), gosymbol.N(1))} {
+		if _, err := gosymbol.CompileProgram(e, params); err == nil {
+			t.Errorf("CompileProgram(%s) should fail", e)
+		}
+	}
+	if _, err := gosymbol.CompileProgram(x, []string{"x", "x"}); err == nil {
+		t.Error("duplicate parameter should fail")
+	}
+}
+
+func BenchmarkCompileProgram(b *testing.B) {
+	e := gosymbol.Diff(mustParse(b, "exp(-x^2/2)*sin(x*y)/sqrt(2*pi) + y^3"), "x")
+	env := map[string]float64{"x": 0.3, "y": 1.7}
+	b.Run("EvalT", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := gosymbol.EvalT(e, env); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Program", func(b *testing.B) {
+		p, err := gosymbol.CompileProgram(e, []string{"x", "y"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		args := []float64{0.3, 1.7}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p.Exec(args)
+		}
+	})
+}
+
+func TestDiffN(t *testing.T) {
+	assertStr(t, gosymbol.Diff2(gosymbol.PowOf(x, gosymbol.N(3)), "x"), "6*x")
+	assertStr(t, gosymbol.DiffN(gosymbol.PowOf(x, gosymbol.N(3)), "x", 4), "0")
+	assertStr(t, gosymbol.DiffN(gosymbol.SinOf(x), "x", 4), "sin(x)")
+	assertStr(t, gosymbol.DiffN(x, "x", 0), "x")
+}
+
+func TestMixedPartialsAndGradient(t *testing.T) {
+	e := mustParse(t, "x^2*y^3")
+	assertStr(t, gosymbol.Diff(e, "x", "y", "x"), "6*y^2")
+	assertStr(t, gosymbol.Diff(e, "x", "y"), gosymbol.Diff(e, "y", "x").String())
+	g := gosymbol.Gradient(mustParse(t, "x^2*y + sin(y)"), "x", "y")
+	if len(g) != 2 {
+		t.Fatalf("Gradient returned %d components", len(g))
+	}
+	assertStr(t, g[0], "2*x*y")
+	assertStr(t, g[1], "x^2 + cos(y)")
+	if len(gosymbol.Gradient(e)) != 0 {
+		t.Error("Gradient with no variables should be empty")
+	}
+}
+
+func TestGradientMany(t *testing.T) {
+	// A model of 200 equations, each appearing twice, against Gradient.
+	var exprs []gosymbol.Expr
+	for i := 0; i < 100; i++ {
+		e := mustParse(t, fmt.Sprintf("sin(%d*x)*y^2 + exp(x*y)/%d", i, i+1))
+		exprs = append(exprs, e, mustParse(t, e.String()))
+	}
+	exprs = append(exprs, gosymbol.Annotate(x, gosymbol.Meta{Label: "a"}), gosymbol.Annotate(x, gosymbol.Meta{Label: "b"}))
+	jac := gosymbol.GradientMany(exprs, "x", "y")
+	if len(jac) != len(exprs) {
+		t.Fatalf("GradientMany returned %d rows, want %d", len(jac), len(exprs))
+	}
+	for i, e := range exprs {
+		want := gosymbol.Gradient(e, "x", "y")
+		if len(jac[i]) != 2 || jac[i][0].String() != want[0].String() || jac[i][1].String() != want[1].String() {
+			t.Errorf("row %d: got %v, want %v", i, jac[i], want)
+		}
+	}
+	if m, _ := gosymbol.MetaOf(jac[len(jac)-1][0]); m.Provenance[0] != "Diff x" {
+		t.Errorf("annotated row: provenance %v", m.Provenance)
+	}
+	d := gosymbol.DiffMany(exprs[:4], "y")
+	for i, e := range exprs[:4] {
+		assertStr(t, d[i], gosymbol.Diff(e, "y").String())
+	}
+	if len(gosymbol.DiffMany(nil, "x")) != 0 {
+		t.Error("DiffMany(nil) should be empty")
+	}
+}
+
+func TestDiffSteps(t *testing.T) {
+	steps := gosymbol.DiffSteps(mustParse(t, "sin(x^2) + 3*x"), "x")
+	var rules []string
+	for _, s := range steps {
+		rules = append(rules, s.Rule)
+	}
+	if got := strings.Join(rules, ", "); got != "identity, constant multiple, power, chain (sin), sum" {
+		t.Errorf("rules = %s", got)
+	}
+	last := steps[len(steps)-1]
+	assertStr(t, last.After, gosymbol.Diff(mustParse(t, "sin(x^2) + 3*x"), "x").String())
+	if steps[2].String() != "power: x^2 -> 2*x" {
+		t.Errorf("step 2 = %q", steps[2])
+	}
+	if steps[2].LaTeX != `\frac{d}{dx}\left[x^{2}\right] = 2 x` {
+		t.Errorf("step 2 LaTeX = %q", steps[2].LaTeX)
+	}
+
+	rulesOf := func(s string) string {
+		var rs []string
+		for _, st := range gosymbol.DiffSteps(mustParse(t, s), "x") {
+			rs = append(rs, st.Rule)
+		}
+		return strings.Join(rs, ", ")
+	}
+	cases := []struct{ in, want string }{
+		{"x*sin(x)", "identity, sin, product"},
+		{"sin(x)/(x + 1)", "sin, identity, sum, quotient"},
+		{"2^x", "exponential"},
+		{"x^x", "logarithmic"},
+		{"exp(2*x)", "identity, constant multiple, chain (exp)"},
+		{"y", "constant"},
+	}
+	for _, c := range cases {
+		if got := rulesOf(c.in); got != c.want {
+			t.Errorf("DiffSteps(%s) rules = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestIntegrate(t *testing.T) {
+	cases := []struct {
+		e    gosymbol.Expr
+		want string
+	}{
+		{gosymbol.N(3), "3*x"},
+		{x, "1/2*x^2"},
+		{gosymbol.PowOf(x, gosymbol.N(2)), "1/3*x^3"},
+		{gosymbol.PowOf(x, gosymbol.N(-1)), "ln(abs(x))"},
+		{gosymbol.MulOf(gosymbol.N(4), gosymbol.PowOf(x, gosymbol.N(3))), "x^4"},
+		{gosymbol.SinOf(x), "-cos(x)"},
+		{gosymbol.CosOf(gosymbol.MulOf(gosymbol.N(3), x)), "1/3*sin(3*x)"},
+		{gosymbol.ExpOf(x), "exp(x)"},
+		{gosymbol.MulOf(y, gosymbol.ExpOf(x)), "y*exp(x)"},
+		{gosymbol.MulOf(gosymbol.AddOf(x, gosymbol.N(1)), gosymbol.AddOf(x, gosymbol.N(2))), "1/3*x^3 + 3/2*x^2 + 2*x"},
+	}
+	for _, c := range cases {
+		got, ok := gosymbol.Integrate(c.e, "x")
+		if !ok {
+			t.Errorf("Integrate(%s) failed", c.e)
+			continue
+		}
+		assertStr(t, got, c.want)
+	}
+}
+
+func TestIntegrateUnsupported(t *testing.T) {
+	if _, ok := gosymbol.Integrate(gosymbol.SinOf(gosymbol.PowOf(x, gosymbol.N(2))), "x"); ok {
+		t.Error("∫sin(x^2) dx should be unsupported")
+	}
+}
+
+func TestIntegrateRoundTrip(t *testing.T) {
+	exprs := []gosymbol.Expr{
+		gosymbol.PowOf(x, gosymbol.N(5)),
+		gosymbol.SinOf(x),
+		gosymbol.AddOf(gosymbol.ExpOf(x), gosymbol.MulOf(gosymbol.N(3), x)),
+	}
+	for _, e := range exprs {
+		F, ok := gosymbol.Integrate(e, "x")
+		if !ok {
+			t.Fatalf("Integrate(%s) failed", e)
+		}
+		if d := gosymbol.Diff(F, "x"); !d.Equal(e) {
+			t.Errorf("d/dx ∫%s = %s", e, d)
+		}
+	}
+}
+
+func TestIntegrateSteps(t *testing.T) {
+	steps, ok := gosymbol.IntegrateSteps(mustParse(t, "3*x^2 + sin(2*x)"), "x")
+	if !ok {
+		t.Fatal("IntegrateSteps failed")
+	}
+	var got []string
+	for _, s := range steps {
+		got = append(got, s.String())
+	}
+	want := []string{
+		"power: x^2 -> 1/3*x^3",
+		"constant multiple: 3*x^2 -> x^3",
+		"linear substitution (sin): sin(2*x) -> -1/2*cos(2*x)",
+		"sum: 3*x^2 + sin(2*x) -> x^3 - 1/2*cos(2*x)",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("steps:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if steps[0].LaTeX != `\int x^{2} \, dx = \frac{1}{3} x^{3}` {
+		t.Errorf("LaTeX = %q", steps[0].LaTeX)
+	}
+
+	steps, ok = gosymbol.IntegrateSteps(mustParse(t, "(x + 1)*(x + 2)"), "x")
+	if !ok || steps[0].Rule != "expand" {
+		t.Fatalf("expected a leading expand step, got %v", steps)
+	}
+	r, _ := gosymbol.Integrate(mustParse(t, "(x + 1)*(x + 2)"), "x")
+	assertStr(t, steps[len(steps)-1].After, r.String())
+
+	if _, ok := gosymbol.IntegrateSteps(mustParse(t, "sin(x^2)"), "x"); ok {
+		t.Error("IntegrateSteps(sin(x^2)) succeeded")
+	}
+}
+
+func TestSimplifySteps(t *testing.T) {
+	cases := []struct {
+		in    string
+		rules string
+	}{
+		{"x + x + 2*3", "multiply constants, combine like terms"},
+		{"(x^2)^3*x", "power of a power, collect powers"},
+		{"sin(x)^2 + cos(x)^2", "pythagorean identity"},
+		{"x^1 + 0*y", "unit exponent, zero product, add constants"},
+		{"(2*x)^2", "distribute exponent"},
+		{"cos(0)", "evaluate cos"},
+		{"x + 1", ""},
+	}
+	for _, c := range cases {
+		e := mustParse(t, c.in)
+		steps := gosymbol.SimplifySteps(e)
+		var rules []string
+		for _, s := range steps {
+			rules = append(rules, s.Rule)
+		}
+		if got := strings.Join(rules, ", "); got != c.rules {
+			t.Errorf("SimplifySteps(%s) rules = %q, want %q", c.in, got, c.rules)
+		}
+		if len(steps) > 0 && steps[len(steps)-1].After.String() != e.Simplify().String() {
+			t.Errorf("SimplifySteps(%s) ends at %s, want %s", c.in, steps[len(steps)-1].After, e.Simplify())
+		}
+	}
+}
+
+func TestDefiniteIntegrate(t *testing.T) {
+	got := gosymbol.DefiniteIntegrate(gosymbol.PowOf(x, gosymbol.N(2)), "x", 0, 1)
+	if math.Abs(got-1.0/3) > 1e-12 {
+		t.Errorf("∫₀¹ x² dx = %v", got)
+	}
+	got = gosymbol.DefiniteIntegrate(gosymbol.SinOf(x), "x", 0, math.Pi)
+	if math.Abs(got-2) > 1e-9 {
+		t.Errorf("∫₀^π sin x dx = %v", got)
+	}
+	if !math.IsNaN(gosymbol.DefiniteIntegrate(y, "x", 0, 1)) {
+		t.Error("integrand with free symbol should give NaN")
+	}
+}
+
+func TestIntegrateKinks(t *testing.T) {
+	cases := []struct{ f, want string }{
+		{"abs(x)", "5/2"},
+		{"x*abs(x - 1/3)", "245/162"},
+		{"sign(x)*x^2", "7/3"},
+		{"abs(x^2 - 1/4)", "31/12"},
+		{"abs(abs(x) - 1/2)", "3/2"},
+		{"sign(x - 1)*abs(x)", "1/2"},
+		// Irrational breakpoints ±√2 leave the integral unevaluated.
+		{"abs(x^2 - 2)", "integrate(abs(x^2 - 2), x, -1, 2)"},
+	}
+	for _, c := range cases {
+		f := mustParse(t, c.f)
+		g := gosymbol.IntegralOf(f, "x", gosymbol.N(-1), gosymbol.N(2))
+		assertStr(t, g.Simplify(), c.want)
+		v, ok := g.Eval()
+		exact, _ := gosymbol.EvalT(gosymbol.IntegralOf(f, "x", gosymbol.N(-1), gosymbol.N(2)).Simplify(), map[string]float64{})
+		if num := gosymbol.DefiniteIntegrate(f, "x", -1, 2); !ok || math.Abs(v.Float64()-num) > 1e-12 {
+			t.Errorf("∫ %s: Eval = %v, DefiniteIntegrate = %v", c.f, v, num)
+		} else if exact != 0 && math.Abs(num-exact) > 1e-12 {
+			t.Errorf("∫ %s: DefiniteIntegrate = %v, want %v", c.f, num, exact)
+		}
+	}
+	assertStr(t, gosymbol.IntegralOf(gosymbol.AbsOf(x), "x", gosymbol.N(1), gosymbol.N(-1)).Simplify(), "-1")
+	if got := gosymbol.DefiniteIntegrate(gosymbol.AbsOf(x), "x", -1, 1); math.Abs(got-1) > 1e-15 {
+		t.Errorf("∫₋₁¹ |x| dx = %v", got)
+	}
+	if got := gosymbol.DefiniteIntegrate(gosymbol.AbsOf(gosymbol.SinOf(x)), "x", 0, 2*math.Pi); math.Abs(got-4) > 1e-9 {
+		t.Errorf("∫₀^2π |sin x| dx = %v", got)
+	}
+}
+
+func TestPiecewise(t *testing.T) {
+	p := mustParse(t, "piecewise((0, x < 0), (x^2, x <= 1), (1, otherwise))")
+	assertStr(t, p, "piecewise((0, x < 0), (x^2, x <= 1), (1, otherwise))")
+	for _, c := range []struct{ x, want float64 }{{-1, 0}, {0.5, 0.25}, {1, 1}, {3, 1}} {
+		if v, err := gosymbol.EvalT(p, map[string]float64{"x": c.x}); err != nil || v != c.want {
+			t.Errorf("p(%v) = %v, %v; want %v", c.x, v, err, c.want)
+		}
+	}
+	assertStr(t, p.Sub("x", gosymbol.F(1, 2)).Simplify(), "1/4")
+	assertStr(t, p.Diff("x").Simplify(), "piecewise((0, x < 0), (2*x, x <= 1), (0, otherwise))")
+	if got := p.LaTeX(); got != `\begin{cases} 0 & \text{if } x < 0 \\ x^{2} & \text{if } x \leq 1 \\ 1 & \text{otherwise} \end{cases}` {
+		t.Errorf("LaTeX = %s", got)
+	}
+
+	// Simplify drops false and repeated cases, stops at a true one and
+	// substitutes equality conditions into their values.
+	cases := []struct{ in, want string }{
+		{"piecewise((1, 2 > 3), (x, otherwise))", "x"},
+		{"piecewise((1, pi > 3), (x, otherwise))", "1"},
+		{"piecewise((a*x, a = 0), (x, otherwise))", "piecewise((0, a = 0), (x, otherwise))"},
+		{"piecewise((x, a != 1), (x, otherwise))", "x"},
+		{"piecewise((x, a < 0), (y, b > 0), (2*x, a < 0), (1, otherwise))", "piecewise((x, a < 0), (y, b > 0), (1, otherwise))"},
+		{"piecewise((1, a < 0), (piecewise((2, b < 0), (3, otherwise)), otherwise))", "piecewise((1, a < 0), (2, b < 0), (3, otherwise))"},
+	}
+	for _, c := range cases {
+		assertStr(t, mustParse(t, c.in).Simplify(), c.want)
+	}
+
+	if v, err := gosymbol.EvalIn[gosymbol.Interval](p, gosymbol.IntervalDomain{}, map[string]gosymbol.Interval{"x": {Lo: 2, Hi: 3}}); err != nil || v.Lo > 1 || v.Hi < 1 {
+		t.Errorf("interval eval = %v, %v", v, err)
+	}
+	if _, err := gosymbol.EvalIn[gosymbol.Interval](p, gosymbol.IntervalDomain{}, map[string]gosymbol.Interval{"x": {Lo: -1, Hi: 1}}); err == nil {
+		t.Error("expected an error for an interval straddling a boundary")
+	}
+	if _, err := gosymbol.EvalT(p, map[string]complex128{"x": 1i}); err == nil {
+		t.Error("expected an error comparing complex values")
+	}
+
+	for _, bad := range []string{"piecewise((1, x), (0, otherwise))", "piecewise((1, x < 0))", "x <"} {
+		if _, err := gosymbol.Parse(bad); err == nil {
+			t.Errorf("Parse(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestIntegrateParametric(t *testing.T) {
+	cases := []struct{ f, want string }{
+		{"x^n", "piecewise((ln(abs(x)), n = -1), (x^(n + 1)*(n + 1)^-1, otherwise))"},
+		{"sin(k*x)", "piecewise((0, k = 0), (-k^-1*cos(k*x), otherwise))"},
+		{"exp(a*x)", "piecewise((x, a = 0), (a^-1*exp(a*x), otherwise))"},
+		{"c^x", "piecewise((x, c = 1), (c^x*ln(c)^-1, otherwise))"},
+		{"3*x^n", "piecewise((3*ln(abs(x)), n = -1), (3*x^(n + 1)*(n + 1)^-1, otherwise))"},
+		{"piecewise((x, a > 0), (1, otherwise))", "piecewise((1/2*x^2, a > 0), (x, otherwise))"},
+		// Numeric coefficients leave no cases behind.
+		{"x^-1", "ln(abs(x))"},
+		{"sin(2*x)", "-1/2*cos(2*x)"},
+		{"2^x", "2^x*ln(2)^-1"},
+	}
+	for _, c := range cases {
+		got, ok := gosymbol.Integrate(mustParse(t, c.f), "x")
+		if !ok {
+			t.Errorf("Integrate(%s) failed", c.f)
+			continue
+		}
+		assertStr(t, got, c.want)
+	}
+	F, _ := gosymbol.Integrate(mustParse(t, "x^n"), "x")
+	assertStr(t, F.Sub("n", gosymbol.N(-1)).Simplify(), "ln(abs(x))")
+	assertStr(t, F.Sub("n", gosymbol.N(2)).Simplify(), "1/3*x^3")
+	got := gosymbol.IntegralOf(mustParse(t, "x^n"), "x", gosymbol.N(1), gosymbol.N(2)).Simplify()
+	assertStr(t, got.Sub("n", gosymbol.N(-1)).Simplify(), "ln(2)")
+	assertStr(t, got.Sub("n", gosymbol.N(1)).Simplify(), "3/2")
+	// From 0 the limits are taken case by case: ln(0) and 0^(n + 1) with
+	// n + 1 <= 0 diverge and stay unevaluated.
+	got = gosymbol.IntegralOf(mustParse(t, "x^n"), "x", gosymbol.N(0), gosymbol.N(1)).Simplify()
+	assertStr(t, got, "piecewise((integrate(x^-1, x, 0, 1), n = -1), ((n + 1)^-1, n > -1), (integrate(x^n, x, 0, 1), otherwise))")
+	assertStr(t, got.Simplify(), got.String())
+	assertStr(t, got.Sub("n", gosymbol.N(2)).Simplify(), "1/3")
+	assertStr(t, got.Sub("n", gosymbol.F(-1, 2)).Simplify(), "2")
+	assertStr(t, got.Sub("n", gosymbol.N(-2)).Simplify(), "integrate(x^-2, x, 0, 1)")
+	assertStr(t, mustParse(t, "integrate(1/x, x, 0, 1)").Simplify(), "integrate(x^-1, x, 0, 1)")
+	if _, ok := gosymbol.Integrate(mustParse(t, "piecewise((1, x > 0), (0, otherwise))"), "x"); ok {
+		t.Error("integrated a piecewise with conditions on the variable")
+	}
+}
+
+func TestLineIntegral(t *testing.T) {
+	xy := []string{"x", "y"}
+	circle := []gosymbol.Expr{mustParse(t, "cos(t)"), mustParse(t, "sin(t)")}
+	got, err := gosymbol.LineIntegral([]gosymbol.Expr{mustParse(t, "-y"), x}, xy, circle, "t", gosymbol.N(0), mustParse(t, "2*pi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, got, "2*pi")
+	// F = ∇(xy) is conservative: the work is xy at the end point.
+	got, _ = gosymbol.LineIntegral([]gosymbol.Expr{y, x}, xy, []gosymbol.Expr{mustParse(t, "t"), mustParse(t, "t^2")}, "t", gosymbol.N(0), gosymbol.N(2))
+	assertStr(t, got, "8")
+
+	got, _ = gosymbol.ScalarLineIntegral(mustParse(t, "x + y"), xy, []gosymbol.Expr{mustParse(t, "t"), mustParse(t, "1 - t")}, "t", gosymbol.N(0), gosymbol.N(1))
+	assertStr(t, got, "2^(1/2)")
+	// Arc length of y = x^2 on [0, 1] needs the quadrature fallback.
+	got, err = gosymbol.ScalarLineIntegral(gosymbol.N(1), xy, []gosymbol.Expr{mustParse(t, "t"), mustParse(t, "t^2")}, "t", gosymbol.N(0), gosymbol.N(1))
+	if v, _ := got.Eval(); err != nil || math.Abs(v.Float64()-1.4789428575) > 1e-8 {
+		t.Errorf("arc length = %v, %v", got, err)
+	}
+	if _, err := gosymbol.LineIntegral([]gosymbol.Expr{x}, xy, circle, "t", gosymbol.N(0), gosymbol.N(1)); err == nil {
+		t.Error("length mismatch should fail")
+	}
+}
+
+func TestSurfaceIntegral(t *testing.T) {
+	xyz := []string{"x", "y", "z"}
+	plane := gosymbol.Surface{
+		R: [3]gosymbol.Expr{mustParse(t, "u"), mustParse(t, "v"), gosymbol.N(0)},
+		U: "u", V: "v", U0: gosymbol.N(0), U1: gosymbol.N(1), V0: gosymbol.N(0), V1: gosymbol.N(2),
+	}
+	got, err := gosymbol.SurfaceIntegral(mustParse(t, "x*y"), xyz, plane)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, got, "1")
+	got, _ = gosymbol.FluxIntegral([]gosymbol.Expr{gosymbol.N(0), gosymbol.N(0), mustParse(t, "x^2")}, xyz, plane)
+	assertStr(t, got, "2/3")
+
+	sphere := gosymbol.Surface{
+		R: [3]gosymbol.Expr{mustParse(t, "sin(u)*cos(v)"), mustParse(t, "sin(u)*sin(v)"), mustParse(t, "cos(u)")},
+		U: "u", V: "v", U0: gosymbol.N(0), U1: gosymbol.Pi, V0: gosymbol.N(0), V1: mustParse(t, "2*pi"),
+	}
+	area, err := gosymbol.SurfaceIntegral(gosymbol.N(1), xyz, sphere)
+	if v, _ := area.Eval(); err != nil || math.Abs(v.Float64()-4*math.Pi) > 1e-6 {
+		t.Errorf("sphere area = %v, %v", area, err)
+	}
+	flux, err := gosymbol.FluxIntegral([]gosymbol.Expr{x, y, mustParse(t, "z")}, xyz, sphere)
+	if v, _ := flux.Eval(); err != nil || math.Abs(v.Float64()-4*math.Pi) > 1e-6 {
+		t.Errorf("flux = %v, %v", flux, err)
+	}
+}
+
+func TestIntegralNode(t *testing.T) {
+	a := gosymbol.S("a")
+	assertStr(t, gosymbol.IntegralOf(mustParse(t, "x^2"), "x", gosymbol.N(0), a).Simplify(), "1/3*a^3")
+	assertStr(t, gosymbol.IntegralOf(mustParse(t, "exp(-x)*exp(-2*(y - x))"), "x", gosymbol.N(0), y).Simplify(), "-exp(-2*y) + exp(-y)")
+
+	gauss := gosymbol.IntegralOf(mustParse(t, "exp(-x^2)"), "x", mustParse(t, "-oo"), gosymbol.Inf)
+	assertStr(t, gauss.Simplify(), "integrate(exp(-x^2), x, -oo, oo)")
+	if v, ok := gauss.Eval(); !ok || math.Abs(v.Float64()-math.Sqrt(math.Pi)) > 1e-9 {
+		t.Errorf("∫ exp(-x^2) = %v, %v", v, ok)
+	}
+
+	f := gosymbol.IntegralOf(mustParse(t, "x*exp(-s^2)"), "s", gosymbol.N(0), x)
+	if syms := gosymbol.FreeSymbols(f); len(syms) != 1 {
+		t.Errorf("FreeSymbols = %v, want only x", syms)
+	}
+	assertStr(t, gosymbol.Diff(f, "x"), "x*exp(-x^2) + integrate(exp(-s^2), s, 0, x)")
+	assertStr(t, f.Sub("s", gosymbol.N(2)), "integrate(x*exp(-s^2), s, 0, x)")
+	assertStr(t, f.Sub("x", mustParse(t, "s + 1")), "integrate((s + 1)*exp(-s_1^2), s_1, 0, s + 1)")
+
+	js, err := gosymbol.ToJSON(gauss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(js), &m); err != nil {
+		t.Fatal(err)
+	}
+	back, err := gosymbol.FromJSON(m)
+	if err != nil || back.String() != gauss.String() {
+		t.Errorf("JSON round trip = %v, %v", back, err)
+	}
+}
+
+func TestSumAndProduct(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"sum(k, k, 1, n)", "1/2*n^2 + 1/2*n"},
+		{"sum(k^3, k, 0, n)", "1/4*n^4 + 1/2*n^3 + 1/4*n^2"},
+		{"sum(a*k, k, m, n)", "-1/2*a*m^2 + 1/2*a*n^2 + 1/2*a*m + 1/2*a*n"},
+		{"sum(a, k, 1, n)", "a*n"},
+		{"sum(2^k, k, 0, n)", "2^(n + 1) - 1"},
+		{"sum(x^k, k, 0, n)", "piecewise((n + 1, x = 1), ((x - 1)^-1*(x^(n + 1) - 1), otherwise))"},
+		{"sum((1/2)^k, k, 0, oo)", "2"},
+		{"sum(k + 2^k, k, 1, n)", "1/2*n^2 + 1/2*n + 2^(n + 1) - 2"},
+		{"sum(1/k^2, k, 1, 4)", "205/144"},
+		{"sum(k, k, 5, 3)", "0"},
+		{"sum(sin(k), k, 1, n)", "sum(sin(k), k, 1, n)"},
+		{"product(k, k, 1, n)", "gamma(n + 1)"},
+		{"product(k + 2, k, 1, n)", "1/2*gamma(n + 3)"},
+		{"product(2*k, k, 1, n)", "2^n*gamma(n + 1)"},
+		{"product(x^k, k, 1, n)", "x^(1/2*n^2 + 1/2*n)"},
+		{"product(k, k, 1, 5)", "120"},
+		{"product(k, k, 0, n)", "product(k, k, 0, n)"},
+		{"sum(k, k, 1/2, 3)", "sum(k, k, 1/2, 3)"},
+		{"sum(k^2, k, 1, 7/2)", "sum(k^2, k, 1, 7/2)"},
+		{"product(k + 1, k, 1/2, n)", "product(k + 1, k, 1/2, n)"},
+	} {
+		got := mustParse(t, c.in).Simplify()
+		assertStr(t, got, c.want)
+		if back := mustParse(t, got.String()); back.String() != got.String() {
+			t.Errorf("Parse(%q) = %s", got, back)
+		}
+	}
+	// A closed form agrees with the sum written out.
+	closed := mustParse(t, "sum(k^5 - 3*k, k, 2, n)").Simplify()
+	assertStr(t, closed.Sub("n", gosymbol.N(30)).Simplify(), mustParse(t, "sum(k^5 - 3*k, k, 2, 30)").Simplify().String())
+
+	basel := mustParse(t, "sum(1/k^2, k, 1, n)")
+	if v, err := gosymbol.EvalT(basel, map[string]float64{"n": 1e5}); err != nil || math.Abs(v-math.Pi*math.Pi/6) > 1e-4 {
+		t.Errorf("Σ 1/k^2 to 1e5 = %v, %v", v, err)
+	}
+	if _, err := gosymbol.EvalT(basel, map[string]float64{"n": 2.5}); err == nil {
+		t.Error("EvalT with a fractional bound: want error")
+	}
+	assertStr(t, gosymbol.Diff(mustParse(t, "sum(sin(x*k), k, 1, n)"), "x"), "sum(k*cos(k*x), k, 1, n)")
+	assertStr(t, gosymbol.Diff(mustParse(t, "product(x + k, k, 1, n)"), "x"), "product(k + x, k, 1, n)*sum((k + x)^-1, k, 1, n)")
+	assertStr(t, gosymbol.Diff(basel, "k"), "0")
+	if got := mustParse(t, "sum(x^k, k, 0, n)").LaTeX(); got != `\sum_{k = 0}^{n} x^{k}` {
+		t.Errorf("LaTeX = %s", got)
+	}
+
+	p := mustParse(t, "product(x + k, k, 1, n)")
+	js, err := gosymbol.ToJSON(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(js), &m); err != nil {
+		t.Fatal(err)
+	}
+	if back, err := gosymbol.FromJSON(m); err != nil || back.String() != p.String() {
+		t.Errorf("JSON round trip = %v, %v", back, err)
+	}
+}
+
+func TestBoundVariables(t *testing.T) {
+	s := mustParse(t, "sum(x*k, k, 1, n)")
+	in := mustParse(t, "integrate(x*t, t, 0, k)")
+	e := gosymbol.AddOf(s, in)
+	if got := fmt.Sprint(gosymbol.FreeSymbols(e)); got != "[k n x]" {
+		t.Errorf("FreeSymbols = %s", got)
+	}
+	if got := fmt.Sprint(gosymbol.BoundSymbols(e)); got != "[k t]" {
+		t.Errorf("BoundSymbols = %s", got)
+	}
+	// Substituting for the index changes only the bounds; a value that
+	// mentions the index renames it rather than being captured.
+	assertStr(t, s.Sub("k", gosymbol.N(3)), "sum(x*k, k, 1, n)")
+	assertStr(t, s.Sub("x", mustParse(t, "k + 1")), "sum((k + 1)*k_1, k_1, 1, n)")
+	assertStr(t, s.Sub("n", gosymbol.S("k")), "sum(x*k, k, 1, k)")
+	assertStr(t, mustParse(t, "sum(k*k_1*x, k, 1, n)").Sub("x", gosymbol.S("k")), "sum(k_2*k_1*k, k_2, 1, n)")
+	assertStr(t, in.Sub("x", gosymbol.S("t")), "integrate(t*t_1, t_1, 0, k)")
+	assertStr(t, in.Sub("y", gosymbol.S("t")), "integrate(x*t, t, 0, k)")
+	assertStr(t, gosymbol.SubMap(s, map[string]gosymbol.Expr{"x": gosymbol.S("k"), "n": gosymbol.N(3)}), "6*k")
+	assertStr(t, gosymbol.SubExpr(mustParse(t, "sum(sin(k)*sin(x), k, 1, n)"), gosymbol.SinOf(x), y), "sum(y*sin(k), k, 1, n)")
+	assertStr(t, gosymbol.SubExpr(mustParse(t, "sum(sin(k), k, 1, sin(k))"), mustParse(t, "sin(k)"), y), "sum(sin(k), k, 1, y)")
+
+	// A Lambda binds its variable the same way.
+	l := mustParse(t, "Lambda(x, x*y + sin(x))")
+	if got := fmt.Sprint(gosymbol.FreeSymbols(l), gosymbol.BoundSymbols(l)); got != "[y] [x]" {
+		t.Errorf("Lambda symbols = %s", got)
+	}
+	assertStr(t, l.Sub("x", gosymbol.N(2)), "Lambda(x, x*y + sin(x))")
+	assertStr(t, l.Sub("y", x), "Lambda(x_1, x_1*x + sin(x_1))")
+	assertStr(t, l.(*gosymbol.Lambda).Call(mustParse(t, "y + 1")).Simplify(), "y*(y + 1) + sin(y + 1)")
+	assertStr(t, gosymbol.Diff(l, "y"), "Lambda(x, x)")
+	if got := l.LaTeX(); got != `\left(x \mapsto x y + \sin\left(x\right)\right)` {
+		t.Errorf("Lambda LaTeX = %s", got)
+	}
+	js, err := gosymbol.ToJSON(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(js), &m); err != nil {
+		t.Fatal(err)
+	}
+	if back, err := gosymbol.FromJSON(m); err != nil || back.String() != l.String() {
+		t.Errorf("Lambda JSON round trip = %v, %v", back, err)
+	}
+	assertStr(t, mustParse(t, l.String()), l.String())
+}
+
+func TestConvolve(t *testing.T) {
+	decay := func(rate string) gosymbol.Expr {
+		return mustParse(t, "piecewise((0, x < 0), (exp(-"+rate+"*x), otherwise))")
+	}
+	assertStr(t, gosymbol.Convolve(decay("1"), decay("2"), "x"), "piecewise((0, x < 0), (-exp(-2*x) + exp(-x), otherwise))")
+	assertStr(t, gosymbol.Convolve(decay("1"), decay("1"), "x"), "piecewise((0, x < 0), (x*exp(-x), otherwise))")
+
+	box := mustParse(t, "piecewise((0, x < 0), (1, x < 1), (0, otherwise))")
+	assertStr(t, gosymbol.Convolve(box, box, "x"), "piecewise((0, x < 0), (x, x < 1), (-x + 2, x < 2), (0, otherwise))")
+	// A chained condition splits at each of its ends.
+	chained := mustParse(t, "piecewise((1, 0 <= x <= 1), (0, otherwise))")
+	assertStr(t, gosymbol.Convolve(chained, chained, "x"), "piecewise((0, x < 0), (x, x < 1), (-x + 2, x < 2), (0, otherwise))")
+	assertStr(t, gosymbol.Convolve(chained, decay("1"), "x"), "piecewise((0, x < 0), (-exp(-x) + 1, x < 1), (exp(-x + 1) - exp(-x), otherwise))")
+
+	// Without an antiderivative the integral stays unevaluated but still
+	// evaluates numerically.
+	c := gosymbol.Convolve(box, mustParse(t, "exp(-x^2)"), "x")
+	assertStr(t, c, "integrate(exp(-(-tau + x)^2), tau, 0, 1)")
+	want := math.Sqrt(math.Pi) / 2 * (math.Erf(0.5) + math.Erf(0.5))
+	if v, ok := c.Sub("x", gosymbol.F(1, 2)).Eval(); !ok || math.Abs(v.Float64()-want) > 1e-9 {
+		t.Errorf("(box * gauss)(1/2) = %v, %v; want %v", v, ok, want)
+	}
+}
+
+func TestTaylorSeries(t *testing.T) {
+	assertStr(t, gosymbol.TaylorSeries(gosymbol.SinOf(x), "x", gosymbol.N(0), 5), "1/120*x^5 - 1/6*x^3 + x")
+	assertStr(t, gosymbol.TaylorSeries(gosymbol.ExpOf(x), "x", gosymbol.N(0), 3), "1/6*x^3 + 1/2*x^2 + x + 1")
+	assertStr(t, gosymbol.TaylorSeries(gosymbol.PowOf(x, gosymbol.N(2)), "x", gosymbol.N(1), 2), "(x - 1)^2 + 2*(x - 1) + 1")
+}
+
+func TestReverseSeries(t *testing.T) {
+	rev := func(s string) gosymbol.Expr {
+		t.Helper()
+		r, err := gosymbol.ReverseSeries(mustParse(t, s), "x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	assertStr(t, rev("x + x^2/2 + x^3/6"), "1/3*x^3 - 1/2*x^2 + x")
+	// sin reverses to asin.
+	assertStr(t, rev("x - x^3/6 + x^5/120"), gosymbol.TaylorSeries(mustParse(t, "asin(x)"), "x", gosymbol.N(0), 5).String())
+	assertStr(t, rev("x + x^2 + x^3 + x^4"), "-x^4 + x^3 - x^2 + x")
+	assertStr(t, rev("a*x + b*x^2"), "a^-1*x - a^-3*b*x^2")
+	// A constant term gives a series in x - a0.
+	assertStr(t, rev("1 + x + x^2"), "-(x - 1)^2 + x - 1")
+
+	// The composition is the identity up to the order of the series.
+	s := mustParse(t, "a*x + b*x^2 + c*x^3")
+	r := rev(s.String())
+	for k := 2; k <= 3; k++ {
+		assertStr(t, gosymbol.Coeff(s.Sub("x", r), "x", k), "0")
+	}
+	assertStr(t, gosymbol.Coeff(s.Sub("x", r), "x", 1), "1")
+
+	for _, bad := range []string{"x^2 + x^3", "sin(x)"} {
+		if _, err := gosymbol.ReverseSeries(mustParse(t, bad), "x"); err == nil {
+			t.Errorf("ReverseSeries(%s) should fail", bad)
+		}
+	}
+}
+
+func TestSeriesMultivariate(t *testing.T) {
+	origin := map[string]gosymbol.Expr{"x": gosymbol.N(0), "y": gosymbol.N(0)}
+	assertStr(t, gosymbol.Series(mustParse(t, "exp(x + y)"), origin, 2), "1/2*x^2 + x*y + 1/2*y^2 + x + y + 1")
+	assertStr(t, gosymbol.Series(mustParse(t, "exp(x)*sin(y)"), origin, 3), "1/2*x^2*y - 1/6*y^3 + x*y + y")
+	// Symbols without a centre are parameters.
+	assertStr(t, gosymbol.Series(mustParse(t, "1/(1 - a*x - y)"), origin, 2), "a^2*x^2 + 2*a*x*y + a*x + y^2 + y + 1")
+	// A polynomial is reproduced exactly around any point once order
+	// reaches its total degree.
+	p := mustParse(t, "x*y^2 + x^3")
+	s := gosymbol.Series(p, map[string]gosymbol.Expr{"x": gosymbol.N(1), "y": gosymbol.N(2)}, 3)
+	if !gosymbol.Expand(gosymbol.AddOf(s, gosymbol.Neg(p))).Equal(gosymbol.N(0)) {
+		t.Errorf("Series(%s) around (1, 2) = %s", p, s)
+	}
+	one := map[string]gosymbol.Expr{"x": gosymbol.N(1)}
+	if got, want := gosymbol.Series(mustParse(t, "ln(x)"), one, 4), gosymbol.TaylorSeries(mustParse(t, "ln(x)"), "x", gosymbol.N(1), 4); !got.Equal(want) {
+		t.Errorf("Series = %s, TaylorSeries = %s", got, want)
+	}
+}
+
+// ------------------------------------------------------------
+// Algebra
+// ------------------------------------------------------------
+
+func TestExpand(t *testing.T) {
+	assertStr(t, gosymbol.Expand(gosymbol.MulOf(gosymbol.AddOf(x, gosymbol.N(1)), gosymbol.AddOf(x, gosymbol.N(2)))), "x^2 + 3*x + 2")
+	assertStr(t, gosymbol.Expand(gosymbol.PowOf(gosymbol.AddOf(x, gosymbol.N(1)), gosymbol.N(3))), "x^3 + 3*x^2 + 3*x + 1")
+	assertStr(t, gosymbol.Expand(gosymbol.PowOf(gosymbol.AddOf(x, y), gosymbol.N(2))), "x^2 + 2*x*y + y^2")
+	assertStr(t, gosymbol.Expand(gosymbol.MulOf(gosymbol.N(2), gosymbol.AddOf(x, gosymbol.N(1)))), "2*x + 2")
+	assertStr(t, gosymbol.Expand(x), "x")
+	assertStr(t, gosymbol.Expand(mustParse(t, "(x + y)^2*(x - y)")), "x^3 + x^2*y - x*y^2 - y^3")
+	assertStr(t, gosymbol.Expand(mustParse(t, "(2*x + 3)^4/4")), "4*x^4 + 24*x^3 + 54*x^2 + 54*x + 81/4")
+	assertStr(t, gosymbol.Expand(mustParse(t, "sin((x + 1)^2)")), "sin(x^2 + 2*x + 1)")
+	assertStr(t, gosymbol.Expand(mustParse(t, "(x + 1)^2 < 4")), "x^2 + 2*x + 1 < 4")
+	assertStr(t, gosymbol.Expand(mustParse(t, "((x + 1)^2)^2 - x^4")), "4*x^3 + 6*x^2 + 4*x + 1")
+	assertStr(t, gosymbol.Expand(mustParse(t, "(x + 1)^11 - x^11")), "11*x^10 + 55*x^9 + 165*x^8 + 330*x^7 + 462*x^6 + 462*x^5 + 330*x^4 + 165*x^3 + 55*x^2 + 11*x + 1")
+
+	// Powers of more than MaxExpandTerms terms are kept and reported.
+	if _, err := gosymbol.ExpandChecked(mustParse(t, "(x + 1)^11")); err != nil {
+		t.Error(err)
+	}
+	r, err := gosymbol.ExpandChecked(mustParse(t, "(x + 1)^2000 + (x + 1)*x"))
+	assertStr(t, r, "(x + 1)^2000 + x^2 + x")
+	if err == nil || !strings.Contains(err.Error(), "(x + 1)^2000 has more than 1000 terms") {
+		t.Errorf("ExpandChecked error = %v", err)
+	}
+	if resp := toolCall(t, "expand", `{"expr": "(x + y + z)^50"}`); resp.Error == "" {
+		t.Errorf("expand of a 1326-term power = %+v, want an error", resp)
+	}
+}
+
+func TestCollectAndCoeff(t *testing.T) {
+	e := mustParse(t, "a*x^2 + b*x^2 + x + c*x + 3")
+	assertStr(t, gosymbol.Collect(e, "x"), "x^2*(a + b) + x*(c + 1) + 3")
+	assertStr(t, gosymbol.Coeff(e, "x", 2), "a + b")
+	assertStr(t, gosymbol.Coeff(e, "x", 1), "c + 1")
+	assertStr(t, gosymbol.Coeff(e, "x", 0), "3")
+	assertStr(t, gosymbol.Coeff(e, "x", 5), "0")
+
+	// Products are expanded first; other dependence on x is kept apart.
+	assertStr(t, gosymbol.Collect(mustParse(t, "2*(x + 1)*(x + y)"), "x"), "2*x^2 + x*(2*y + 2) + 2*y")
+	assertStr(t, gosymbol.Collect(mustParse(t, "a*x + sin(x) + b*x"), "x"), "x*(a + b) + sin(x)")
+	assertStr(t, gosymbol.Coeff(mustParse(t, "a*x + sin(x)"), "x", 0), "0")
+	assertStr(t, gosymbol.Collect(mustParse(t, "a/x + 1/x + x^(1/2)"), "x"), "x^(1/2) + x^-1*(a + 1)")
+	assertStr(t, gosymbol.Coeff(mustParse(t, "a/x + 1/x"), "x", -1), "a + 1")
+}
+
+func TestHorner(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"x^3 + 2*x^2 + 3*x + 4", "x*(x*(x + 2) + 3) + 4"},
+		{"(x + 1)^3", "x*(x*(x + 3) + 3) + 1"},
+		{"x^5 + x", "x*(x^4 + 1)"},
+		{"a*x^2 + b*x + c", "x*(a*x + b) + c"},
+		{"x^2/2 - x/3 + 1", "x*(1/2*x - 1/3) + 1"},
+		{"x^4 + x^2*y + y^2", "x^2*(x^2 + y) + y^2"},
+		{"2*x^3 - 1", "2*x^3 - 1"},
+		{"y^2 + y", "y^2 + y"},
+		{"sin(x^2 + x) + 2^x", "sin(x*(x + 1)) + 2^x"},
+		{"x + (y - (x + y))", "0"},
+	} {
+		e := mustParse(t, c.in)
+		got := gosymbol.Horner(e, "x")
+		assertStr(t, got, c.want)
+		if d := gosymbol.Expand(gosymbol.AddOf(got, gosymbol.Neg(e))).Simplify(); !d.Equal(gosymbol.N(0)) {
+			t.Errorf("Horner(%s) - input = %s", c.in, d)
+		}
+	}
+	// Horner form needs fewer operations than the expanded polynomial.
+	p := mustParse(t, "x^6 + 2*x^5 + 3*x^4 + 4*x^3 + 5*x^2 + 6*x + 7")
+	if h := gosymbol.Horner(p, "x"); gosymbol.CountOps(h) >= gosymbol.CountOps(p) {
+		t.Errorf("CountOps(%s) = %d, not below %d", h, gosymbol.CountOps(h), gosymbol.CountOps(p))
+	}
+}
+
+func TestFactor(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"x^2 - 1", "(x + 1)*(x - 1)"},
+		{"6*x^2 + 11*x + 3", "(2*x + 3)*(3*x + 1)"},
+		{"2*x^2 - 2", "2*(x + 1)*(x - 1)"},
+		{"x^3 - x^2 - x + 1", "(x - 1)^2*(x + 1)"},
+		{"x^2/4 - 1", "1/4*(x + 2)*(x - 2)"},
+		{"(x^2 - 1)/(x^2 + 2*x + 1)", "(x + 1)^-1*(x - 1)"},
+		// Quadratic factors without rational roots split off.
+		{"x^4 + x^2 + 1", "(x^2 + x + 1)*(x^2 - x + 1)"},
+		{"x^4 + 4", "(x^2 + 2*x + 2)*(x^2 - 2*x + 2)"},
+		{"x^5 + x + 1", "(x^2 + x + 1)*(x^3 - x^2 + 1)"},
+		// Several symbols: contents, repeated and homogeneous factors.
+		{"x^2 - y^2", "(x + y)*(x - y)"},
+		{"x^2*y - y", "y*(x + 1)*(x - 1)"},
+		{"x*y + x + y + 1", "(x + 1)*(y + 1)"},
+		{"x^2 + 2*x*y + y^2 + 2*x + 2*y + 1", "(x + y + 1)^2"},
+		{"x^3 - y^3", "(x - y)*(x^2 + x*y + y^2)"},
+		{"x^2/4 - y^2", "1/4*(x + 2*y)*(x - 2*y)"},
+		// Irreducible, unsupported and non-polynomial inputs stay whole.
+		{"x^2 - 2", "x^2 - 2"},
+		{"x^4 + 1", "x^4 + 1"},
+		{"x^2 + y^2", "x^2 + y^2"},
+		{"x^2*y^2 - 1", "x^2*y^2 - 1"},
+		{"sin(x^2 - 1)", "sin(x^2 - 1)"},
+		// Degrees above MaxFactorDegree are not attempted.
+		{"x^100000 - 1", "x^100000 - 1"},
+		{"(x^2 - 1)^150*(x - y)^60", "(x + 1)^150*(x - 1)^150*(x - y)^60"},
+	} {
+		assertStr(t, gosymbol.Factor(mustParse(t, c.in)), c.want)
+	}
+	if resp := toolCall(t, "factor", `{"expr": "x^1000000 + 1"}`); !strings.HasPrefix(resp.Error, "factor: degree 1000000 exceeds") {
+		t.Errorf("factor of a huge degree: %q", resp.Error)
+	}
+	en, err := gosymbol.NewEngine(gosymbol.EngineConfig{MaxDegree: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := en.HandleToolCall(gosymbol.ToolRequest{Tool: "expand", Params: map[string]interface{}{"expr": "(x + y)^51"}}); !strings.HasPrefix(resp.Error, "engine: polynomial degree 51") {
+		t.Errorf("engine degree limit: %q", resp.Error)
+	}
+	if resp := en.HandleToolCall(gosymbol.ToolRequest{Tool: "factor", Params: map[string]interface{}{"expr": "x^50 - 1"}}); resp.Error != "" {
+		t.Errorf("engine within degree limit: %q", resp.Error)
+	}
+}
+
+func TestTogetherAndApart(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"1/x + 1/y", "x^-1*y^-1*(x + y)"},
+		{"1/(x + 1) + 1/(x - 1)", "2*x*(x + 1)^-1*(x - 1)^-1"},
+		{"1/(x + 1) - 1/(x - 1)", "-2*(x + 1)^-1*(x - 1)^-1"},
+		{"x/(x + 1)^2 + 1/(x + 1)", "(x + 1)^-2*(2*x + 1)"},
+		{"1/(1 + 1/x)", "x*(x + 1)^-1"},
+		{"x + 1", "x + 1"},
+	} {
+		assertStr(t, gosymbol.Together(mustParse(t, c.in)), c.want)
+	}
+	for _, c := range []struct{ in, want string }{
+		{"1/(x^2 - 1)", "-1/2*(x + 1)^-1 + 1/2*(x - 1)^-1"},
+		{"(x^3 + 1)/(x^2 - 1)", "x + (x - 1)^-1"},
+		{"1/((x - 1)^2*(x + 2))", "1/9*(x + 2)^-1 - 1/9*(x - 1)^-1 + 1/3*(x - 1)^-2"},
+		{"1/(x^3 + x)", "-x*(x^2 + 1)^-1 + x^-1"},
+		{"1/(x^2 + 1)", "(x^2 + 1)^-1"},
+		{"sin(x)/(x + 1)", "(x + 1)^-1*sin(x)"},
+	} {
+		e := mustParse(t, c.in)
+		a := gosymbol.Apart(e, "x")
+		assertStr(t, a, c.want)
+		if !gosymbol.EquivN(a, e, 10) {
+			t.Errorf("Apart(%s) = %s is not equivalent", c.in, a)
+		}
+	}
+
+	// Integrate falls back on partial fractions.
+	r, ok := gosymbol.Integrate(mustParse(t, "(2*x + 3)/(x^2 + x - 2)"), "x")
+	if !ok {
+		t.Fatal("no antiderivative")
+	}
+	assertStr(t, r, "1/3*ln(abs(x + 2)) + 5/3*ln(abs(x - 1))")
+	// Irreducible quadratic fractions give a logarithm and an arctangent.
+	for _, c := range []struct{ in, want string }{
+		{"1/(x^2 + 1)", "atan(x)"},
+		{"x/(x^2 + 1)", "1/2*ln(x^2 + 1)"},
+		{"(2*x + 3)/(x^2 + 2*x + 5)", "1/2*atan(1/2*x + 1/2) + ln(x^2 + 2*x + 5)"},
+		{"1/((x - 1)*(x^2 + 1))", "-1/2*atan(x) + 1/2*ln(abs(x - 1)) - 1/4*ln(x^2 + 1)"},
+		{"1/(x^4 - 1)", "-1/2*atan(x) - 1/4*ln(abs(x + 1)) + 1/4*ln(abs(x - 1))"},
+		{"1/(x^2 + x + 1)", "2*3^(-1/2)*atan((2*x + 1)*3^(-1/2))"},
+	} {
+		e := mustParse(t, c.in)
+		r, ok := gosymbol.Integrate(e, "x")
+		if !ok {
+			t.Fatalf("Integrate(%s): no antiderivative", c.in)
+		}
+		assertStr(t, r, c.want)
+		if !gosymbol.EquivN(gosymbol.Diff(r, "x"), e, 10) {
+			t.Errorf("d/dx %s is not %s", r, c.in)
+		}
+	}
+	steps, ok := gosymbol.IntegrateSteps(mustParse(t, "1/(x^2 - 1)"), "x")
+	if !ok || steps[0].Rule != "partial fractions" {
+		t.Errorf("IntegrateSteps = %v, %v", steps, ok)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"(x^2 - 1)/(x - 1)", "x + 1"},
+		{"(x - 1)/(x^2 - 1)", "(x + 1)^-1"},
+		{"(x^2 + 2*x + 1)/(x^2 - 1)", "(x - 1)^-1*(x + 1)"},
+		{"(6*x^2 - 6)/(9*x - 9)", "2/3*(x + 1)"},
+		{"x/(2*x + 2)", "1/2*x*(x + 1)^-1"},
+		{"1/x + 1/(x*(x + 1))", "(x^2 + x)^-1*(x + 2)"},
+		{"(x^2 - 1)/(x - 1) + y", "x + y + 1"},
+		{"sin((x^2 - 1)/(x - 1))", "sin(x + 1)"},
+		{"0/(x + 1)", "0"},
+		{"(x + 1)^2", "(x + 1)^2"},
+		// Several symbols.
+		{"(x^2 - y^2)/(x - y)", "x + y"},
+		{"(x - y)/(x^2 - y^2)", "(x + y)^-1"},
+		{"(x^2*y + x*y^2)/(2*x*y)", "1/2*(x + y)"},
+		{"(x^2 + 2*x*y + y^2)/(x^2 - y^2)", "(x - y)^-1*(x + y)"},
+		{"(a*x - a*y)/(b*x - b*y)", "a*b^-1"},
+		{"(x + y)/(x - y)", "(x - y)^-1*(x + y)"},
+		{"1/x + 1/y", "x^-1*y^-1*(x + y)"},
+	} {
+		e := mustParse(t, c.in)
+		r := gosymbol.Cancel(e)
+		assertStr(t, r, c.want)
+		if !gosymbol.EquivN(r, e, 10) {
+			t.Errorf("Cancel(%s) = %s is not equivalent", c.in, r)
+		}
+	}
+}
+
+func TestTrigExpandAndSimp(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"sin(x + y)", "cos(x)*sin(y) + cos(y)*sin(x)"},
+		{"cos(x + y)", "cos(x)*cos(y) - sin(x)*sin(y)"},
+		{"cos(2*x)", "cos(x)^2 - sin(x)^2"},
+		{"sin(3*x)", "3*cos(x)^2*sin(x) - sin(x)^3"},
+		{"sin(-2*x)", "-2*cos(x)*sin(x)"},
+		{"sin(x + pi)", "-sin(x)"},
+		{"tan(2*x)", "2*(-tan(x)^2 + 1)^-1*tan(x)"},
+		{"exp(sin(2*x))", "exp(2*cos(x)*sin(x))"},
+		{"cos(x/2)", "cos(1/2*x)"},
+	} {
+		e := mustParse(t, c.in)
+		r := gosymbol.TrigExpand(e)
+		assertStr(t, r, c.want)
+		if !gosymbol.EquivN(r, e, 10) {
+			t.Errorf("TrigExpand(%s) = %s is not equivalent", c.in, r)
+		}
+	}
+	for _, c := range []struct{ in, want string }{
+		{"3*sin(x)^2 + 3*cos(x)^2", "3"},
+		{"3*sin(x)^2 + 5*cos(x)^2", "cos(2*x) + 4"},
+		{"y*sin(x)^2 + y*cos(x)^2", "y"},
+		{"1 - cos(x)^2", "sin(x)^2"},
+		{"sin(x)^4 + 2*sin(x)^2*cos(x)^2 + cos(x)^4", "1"},
+		{"cos(x)^2 - sin(x)^2", "cos(2*x)"},
+		{"2*sin(x)*cos(x)", "sin(2*x)"},
+		{"sin(x)*cos(x)", "cos(x)*sin(x)"},
+		{"sin(x)/cos(x)", "tan(x)"},
+		{"sin(x)^3/cos(x)", "sin(x)^2*tan(x)"},
+		{"exp(sin(x)^2 + cos(x)^2)", "e"},
+		{"x + 1", "x + 1"},
+	} {
+		e := mustParse(t, c.in)
+		r := gosymbol.TrigSimp(e)
+		assertStr(t, r, c.want)
+		if !gosymbol.EquivN(r, e, 10) {
+			t.Errorf("TrigSimp(%s) = %s is not equivalent", c.in, r)
+		}
+	}
+	assertStr(t, gosymbol.TrigSimp(gosymbol.TrigExpand(mustParse(t, "cos(3*x)"))), "4*cos(x)^3 - 3*cos(x)")
+}
+
+func TestDegrees(t *testing.T) {
+	for in, want := range map[string]string{
+		"sin(30°)":     "1/2",
+		"cos(deg(60))": "1/2",
+		"tan(45°)":     "1",
+		"deg(90)":      "1/2*pi",
+		"sin(deg(x))":  "sin(deg(x))",
+		"rad(x)":       "x",
+	} {
+		assertStr(t, mustParse(t, in).Simplify(), want)
+	}
+	assertStr(t, mustParse(t, "sin(30°)"), "sin(deg(30))")
+	if got := mustParse(t, "x°").LaTeX(); got != `{x^{\circ}}` {
+		t.Errorf("LaTeX = %q", got)
+	}
+	assertStr(t, gosymbol.Diff(mustParse(t, "sin(deg(x))"), "x"), "1/180*cos(deg(x))*pi")
+
+	// In degree mode unmarked arguments are degrees and inverse functions
+	// return degrees; rad keeps an argument in radians.
+	for in, want := range map[string]float64{
+		"sin(30) + cos(rad(pi))": -0.5,
+		"asin(1/2)":              30,
+		"atan2(1, 1)":            45,
+		"cos(60°)":               0.5,
+	} {
+		v, err := gosymbol.EvalT[float64](gosymbol.DegreeMode(mustParse(t, in)), nil)
+		if err != nil || math.Abs(v-want) > 1e-12 {
+			t.Errorf("DegreeMode(%s) = %v, %v, want %v", in, v, err, want)
+		}
+	}
+	assertStr(t, gosymbol.DegreeMode(mustParse(t, "sin(30) + cos(rad(pi))")).Simplify(), "-1/2")
+
+	en, err := gosymbol.NewEngine(gosymbol.EngineConfig{Degrees: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := en.Parse("2*sin(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, e, "2*sin(deg(x))")
+	resp := en.HandleToolCall(gosymbol.ToolRequest{Tool: "simplify", Params: map[string]interface{}{"expr": "sin(30) + 1"}})
+	if resp.Error != "" || resp.String != "3/2" {
+		t.Errorf("simplify in degree mode = %+v", resp)
+	}
+}
+
+func TestLogExpandAndCombine(t *testing.T) {
+	for in, want := range map[string][2]string{
+		"ln(x*y)":      {"ln(x*y)", "ln(x) + ln(y)"},
+		"ln(x^3)":      {"ln(x^3)", "3*ln(x)"},
+		"ln(x/y)":      {"ln(x*y^-1)", "ln(x) - ln(y)"},
+		"ln(2*x)":      {"ln(2) + ln(x)", "ln(2) + ln(x)"},
+		"ln(exp(x)*y)": {"x + ln(y)", "x + ln(y)"},
+		"ln(sqrt(x))":  {"ln(x^(1/2))", "1/2*ln(x)"},
+	} {
+		assertStr(t, gosymbol.LogExpand(mustParse(t, in)), want[0])
+		assertStr(t, gosymbol.LogExpand(mustParse(t, in), "x", "y"), want[1])
+	}
+	for in, want := range map[string][2]string{
+		"ln(x) + ln(y)":      {"ln(x) + ln(y)", "ln(x*y)"},
+		"2*ln(x) - ln(y)":    {"2*ln(x) - ln(y)", "ln(x^2*y^-1)"},
+		"ln(x) + ln(y) + z":  {"z + ln(x) + ln(y)", "z + ln(x*y)"},
+		"ln(2) + ln(3)":      {"ln(6)", "ln(6)"},
+		"ln(x)*ln(y)":        {"ln(x)*ln(y)", "ln(x)*ln(y)"},
+		"sin(ln(x) + ln(2))": {"sin(ln(2) + ln(x))", "sin(ln(2*x))"},
+	} {
+		assertStr(t, gosymbol.LogCombine(mustParse(t, in)), want[0])
+		assertStr(t, gosymbol.LogCombine(mustParse(t, in), "x", "y"), want[1])
+	}
+	assertStr(t, mustParse(t, "exp(ln(x))").Simplify(), "x")
+	assertStr(t, mustParse(t, "ln(exp(x))").Simplify(), "x")
+
+	// Round trip: combining the expansion gives back the original.
+	e := mustParse(t, "ln(x^2*y^3)")
+	assertStr(t, gosymbol.LogCombine(gosymbol.LogExpand(e, "x", "y"), "x", "y"), "ln(x^2*y^3)")
+
+	en, err := gosymbol.NewEngine(gosymbol.EngineConfig{Assumptions: []gosymbol.Expr{mustParse(t, "x > 0"), mustParse(t, "y >= 0")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only x is positive, so only its logarithm is rewritten.
+	r, err := en.LogExpand(mustParse(t, "ln(x^2*y^2)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, r, "2*ln(x) + ln(y^2)")
+	r, err = en.LogCombine(mustParse(t, "2*ln(x) + ln(y) + ln(2)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, r, "ln(2*x^2) + ln(y)")
+}
+
+func TestRadSimp(t *testing.T) {
+	for in, want := range map[string][2]string{
+		"sqrt(8)":               {"2*2^(1/2)", "2*2^(1/2)"},
+		"16^(1/3)":              {"2*2^(1/3)", "2*2^(1/3)"},
+		"4^(1/4)":               {"2^(1/2)", "2^(1/2)"},
+		"1/sqrt(2)":             {"1/2*2^(1/2)", "1/2*2^(1/2)"},
+		"2^(-3/2)":              {"1/4*2^(1/2)", "1/4*2^(1/2)"},
+		"(2/3)^(1/2)":           {"1/3*6^(1/2)", "1/3*6^(1/2)"},
+		"1/(1 + sqrt(2))":       {"2^(1/2) - 1", "2^(1/2) - 1"},
+		"1/(sqrt(2) + sqrt(3))": {"-2^(1/2) + 3^(1/2)", "-2^(1/2) + 3^(1/2)"},
+		"sqrt(2)*sqrt(6)":       {"2*3^(1/2)", "2*3^(1/2)"},
+		"sqrt(18) + sqrt(8)":    {"5*2^(1/2)", "5*2^(1/2)"},
+		"sqrt(x^2)":             {"abs(x)", "x"},
+		"sqrt(x^4)":             {"x^2", "x^2"},
+		"(x^2)^(3/2)":           {"abs(x)^3", "x^3"},
+		"sqrt(8*x^2)":           {"2*2^(1/2)*abs(x)", "2*x*2^(1/2)"},
+		"sqrt(x^2*y)":           {"y^(1/2)*abs(x)", "x*y^(1/2)"},
+		"sin(sqrt(12))":         {"sin(2*3^(1/2))", "sin(2*3^(1/2))"},
+	} {
+		e := mustParse(t, in)
+		got := gosymbol.RadSimp(e)
+		assertStr(t, got, want[0])
+		assertStr(t, gosymbol.RadSimp(e, "x"), want[1])
+		if !gosymbol.EquivN(e, got, 10) {
+			t.Errorf("RadSimp(%s) = %s is not equivalent", in, got)
+		}
+	}
+
+	en, err := gosymbol.NewEngine(gosymbol.EngineConfig{Assumptions: []gosymbol.Expr{mustParse(t, "x > 0")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := en.RadSimp(mustParse(t, "sqrt(12*x^2*y^2)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, r, "2*x*3^(1/2)*abs(y)")
+}
+
+func TestPolyCoeffsAndDegree(t *testing.T) {
+	p := gosymbol.AddOf(gosymbol.MulOf(gosymbol.N(3), gosymbol.PowOf(x, gosymbol.N(2))), gosymbol.MulOf(y, x), gosymbol.N(5))
+	c := gosymbol.PolyCoeffs(p, "x")
+	if len(c) != 3 {
+		t.Fatalf("got %v", c)
+	}
+	assertStr(t, c[2], "3")
+	assertStr(t, c[1], "y")
+	assertStr(t, c[0], "5")
+	if d := gosymbol.Degree(p, "x"); d != 2 {
+		t.Errorf("Degree = %d", d)
+	}
+	if d := gosymbol.Degree(gosymbol.SinOf(x), "x"); d != -1 {
+		t.Errorf("Degree(sin(x)) = %d, want -1", d)
+	}
+	if d := gosymbol.Degree(gosymbol.N(7), "x"); d != 0 {
+		t.Errorf("Degree(7) = %d, want 0", d)
+	}
+
+	// Powers beyond Expand's limit are multiplied out coefficient by
+	// coefficient.
+	wide := mustParse(t, "(x + 1)^2000 - x^2000")
+	if d := gosymbol.Degree(wide, "x"); d != 1999 {
+		t.Errorf("Degree((x + 1)^2000 - x^2000) = %d, want 1999", d)
+	}
+	assertStr(t, gosymbol.Coeff(wide, "x", 1), "2000")
+	assertStr(t, gosymbol.PolyCoeffs(mustParse(t, "(x + y)^12"), "x")[2], "66*y^10")
+	assertStr(t, gosymbol.PolyCoeffs(mustParse(t, "(x^2 + x + 1)^20"), "x")[39], "20")
+	if c := gosymbol.PolyCoeffs(mustParse(t, "(x + 1)^1000000"), "x"); c != nil {
+		t.Errorf("PolyCoeffs((x + 1)^1000000) has %d coefficients, want nil past the work limit", len(c))
+	}
+}
+
+// factorString renders c and fs as c * base^mult * ...
+func factorString(c gosymbol.Expr, fs []gosymbol.PolyFactor) string {
+	parts := []string{c.String()}
+	for _, f := range fs {
+		parts = append(parts, fmt.Sprintf("(%s)^%d", f.Base, f.Mult))
+	}
+	return strings.Join(parts, " * ")
+}
+
+func TestSquareFree(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"x^3 - x^2 - x + 1", "1 * (x + 1)^1 * (x - 1)^2"},
+		{"2*x^5 - 2*x", "2 * (x^5 - x)^1"},
+		{"3*(x - 1/2)^3*(x^2 + 1)^2", "3/8 * (x^2 + 1)^2 * (2*x - 1)^3"},
+		{"x^2*(x + 1)", "1 * (x + 1)^1 * (x)^2"},
+		{"7", "7"},
+	}
+	for _, c := range cases {
+		p := gosymbol.Expand(mustParse(t, c.in))
+		k, fs, err := gosymbol.SquareFree(p, "x")
+		if err != nil {
+			t.Errorf("SquareFree(%s): %v", c.in, err)
+			continue
+		}
+		if got := factorString(k, fs); got != c.want {
+			t.Errorf("SquareFree(%s) = %s, want %s", c.in, got, c.want)
+		}
+	}
+	for _, s := range []string{"0", "sin(x)", "a*x + 1", "x^300 + 1"} {
+		if _, _, err := gosymbol.SquareFree(mustParse(t, s), "x"); err == nil {
+			t.Errorf("SquareFree(%s) should fail", s)
+		}
+	}
+}
+
+func TestFactorPowersSparse(t *testing.T) {
+	// Monomials and powers of any degree skip the dense coefficients.
+	for _, c := range []struct {
+		in         string
+		sqf, whole string
+	}{
+		{"x^1000000", "1 * (x)^1000000", "1 * (x)^1000000"},
+		{"-3*x^999999", "-3 * (x)^999999", "-3 * (x)^999999"},
+		{"(x^2 - 1)^500000", "1 * (x^2 - 1)^500000", "1 * (x + 1)^500000 * (x - 1)^500000"},
+		{"(-x + 1)^100001", "-1 * (x - 1)^100001", "-1 * (x - 1)^100001"},
+		{"(2*x^2 - 2)^3", "8 * (x^2 - 1)^3", "8 * (x + 1)^3 * (x - 1)^3"},
+	} {
+		p := mustParse(t, c.in)
+		k, fs, err := gosymbol.SquareFree(p, "x")
+		if err != nil || factorString(k, fs) != c.sqf {
+			t.Errorf("SquareFree(%s) = %s, %v; want %s", c.in, factorString(k, fs), err, c.sqf)
+		}
+		k, fs, err = gosymbol.FactorList(p, "x")
+		if err != nil || factorString(k, fs) != c.whole {
+			t.Errorf("FactorList(%s) = %s, %v; want %s", c.in, factorString(k, fs), err, c.whole)
+		}
+	}
+	for _, s := range []string{"x^1000000 + 1", "(3*x + 3)^100000"} {
+		if _, _, err := gosymbol.FactorList(mustParse(t, s), "x"); err == nil {
+			t.Errorf("FactorList(%s) should fail", s)
+		}
+	}
+}
+
+func TestFactorList(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"2*x^5 - 2*x", "2 * (x)^1 * (x + 1)^1 * (x - 1)^1 * (x^2 + 1)^1"},
+		{"6*x^2 + x - 1", "1 * (2*x + 1)^1 * (3*x - 1)^1"},
+		{"(x^2 - 2)^2*(2*x + 3)", "1 * (2*x + 3)^1 * (x^2 - 2)^2"},
+		// No rational roots, but quadratic factors.
+		{"x^4 + 4", "1 * (x^2 + 2*x + 2)^1 * (x^2 - 2*x + 2)^1"},
+		{"x^4 + 1", "1 * (x^4 + 1)^1"},
+	}
+	for _, c := range cases {
+		p := gosymbol.Expand(mustParse(t, c.in))
+		k, fs, err := gosymbol.FactorList(p, "x")
+		if err != nil {
+			t.Errorf("FactorList(%s): %v", c.in, err)
+			continue
+		}
+		if got := factorString(k, fs); got != c.want {
+			t.Errorf("FactorList(%s) = %s, want %s", c.in, got, c.want)
+		}
+		prod := []gosymbol.Expr{k}
+		for _, f := range fs {
+			prod = append(prod, gosymbol.PowOf(f.Base, gosymbol.N(int64(f.Mult))))
+		}
+		if d := gosymbol.Expand(gosymbol.AddOf(gosymbol.MulOf(prod...), gosymbol.Neg(p))); !d.Equal(gosymbol.N(0)) {
+			t.Errorf("FactorList(%s) product differs by %s", c.in, d)
+		}
+	}
+}
+
+func TestGroebnerAndEliminate(t *testing.T) {
+	polys := func(ss ...string) []gosymbol.Expr {
+		out := make([]gosymbol.Expr, len(ss))
+		for i, s := range ss {
+			out[i] = mustParse(t, s)
+		}
+		return out
+	}
+	join := func(es []gosymbol.Expr) string {
+		ss := make([]string, len(es))
+		for i, e := range es {
+			ss[i] = e.String()
+		}
+		return strings.Join(ss, "; ")
+	}
+	bases := []struct {
+		in    []string
+		order []string
+		want  string
+	}{
+		{[]string{"x^2 + y^2 - 1", "x - y"}, []string{"x", "y"}, "2*y^2 - 1; x - y"},
+		{[]string{"x^2*y + x*y^2 + z - 1", "x*y*z - 2", "x + y + z - 3"}, []string{"x", "y", "z"},
+			"z^2 - 3*z + 6; 3*y^2 + 3*y*z - 9*y - z + 3; x + y + z - 3"},
+		{[]string{"x*y - 1", "x"}, nil, "1"},
+	}
+	for _, c := range bases {
+		g, err := gosymbol.GroebnerBasis(polys(c.in...), c.order)
+		if err != nil || join(g) != c.want {
+			t.Errorf("GroebnerBasis(%v) = %s, %v; want %s", c.in, join(g), err, c.want)
+		}
+	}
+	elims := []struct {
+		in   []string
+		syms []string
+		want string
+	}{
+		{[]string{"x - t^2", "y - t^3"}, []string{"t"}, "x^3 - y^2"},
+		{[]string{"x - t/2 - 1/3", "y - t^2"}, []string{"t"}, "36*x^2 - 24*x - 9*y + 4"},
+		// The ellipse x = 2 cos θ, y = 3 sin θ with c = cos θ, s = sin θ.
+		{[]string{"x - 2*c", "y - 3*s", "c^2 + s^2 - 1"}, []string{"c", "s"}, "9*x^2 + 4*y^2 - 36"},
+		{[]string{"x^2 + y^2 - 1", "x - y"}, []string{"x"}, "2*y^2 - 1"},
+		{[]string{"x - t", "y - u"}, []string{"t", "u"}, ""},
+	}
+	for _, c := range elims {
+		g, err := gosymbol.Eliminate(polys(c.in...), c.syms)
+		if err != nil || join(g) != c.want {
+			t.Errorf("Eliminate(%v, %v) = %s, %v; want %s", c.in, c.syms, join(g), err, c.want)
+		}
+	}
+	if _, err := gosymbol.Eliminate(polys("x - sin(t)"), []string{"t"}); err == nil || !strings.HasPrefix(err.Error(), "eliminate: ") {
+		t.Errorf("Eliminate of a non-polynomial: %v", err)
+	}
+	if _, err := gosymbol.GroebnerBasis(polys("x^(1/2) - y"), nil); err == nil {
+		t.Error("GroebnerBasis accepted a fractional power")
+	}
+}
+
+func TestGFPoly(t *testing.T) {
+	gf := func(s string, p int64) gosymbol.GFPoly {
+		t.Helper()
+		f, err := gosymbol.GFPolyOf(mustParse(t, s), "x", big.NewInt(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	factors := func(f gosymbol.GFPoly) string {
+		t.Helper()
+		lead, fs, err := f.Factor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The factors multiply back to f.
+		prod, _ := gosymbol.NewGFPoly(f.Modulus(), []*big.Int{lead})
+		var parts []string
+		for _, g := range fs {
+			if !g.Poly.IsIrreducible() || g.Poly.Lead().Cmp(big.NewInt(1)) != 0 {
+				t.Errorf("factor %v of %v is not monic irreducible", g.Poly, f)
+			}
+			for i := 0; i < g.Mult; i++ {
+				prod, _ = prod.Mul(g.Poly)
+			}
+			parts = append(parts, fmt.Sprintf("(%v)^%d", g.Poly.Expr("x"), g.Mult))
+		}
+		if !prod.Equal(f) {
+			t.Errorf("factors of %v multiply to %v", f, prod)
+		}
+		return lead.String() + " " + strings.Join(parts, " ")
+	}
+
+	assertStr(t, gf("(x^2 + 1)/2", 5).Expr("x"), "3*x^2 + 3")
+	if s := gf("x^2 - 1", 7).String(); s != "x^2 + 6 (mod 7)" {
+		t.Errorf("String = %q", s)
+	}
+	if got := factors(gf("x^4 - 1", 5)); got != "1 (x + 1)^1 (x + 2)^1 (x + 3)^1 (x + 4)^1" {
+		t.Errorf("x^4 - 1 over GF(5) = %s", got)
+	}
+	// x^4 + 1 = (x + 1)^4 over GF(2): the derivative vanishes.
+	if got := factors(gf("x^4 + 1", 2)); got != "1 (x + 1)^4" {
+		t.Errorf("x^4 + 1 over GF(2) = %s", got)
+	}
+	if got := factors(gf("3*(x^2 + x + 1)*(x^3 + x + 1)^2*(x^3 + x^2 + 1)", 2)); got != "1 (x^2 + x + 1)^1 (x^3 + x + 1)^2 (x^3 + x^2 + 1)^1" {
+		t.Errorf("over GF(2) = %s", got)
+	}
+	if got := factors(gf("2*x^9 - 2*x", 3)); got != "2 (x)^1 (x + 1)^1 (x + 2)^1 (x^2 + 1)^1 (x^2 + x + 2)^1 (x^2 + 2*x + 2)^1" {
+		t.Errorf("2*x^9 - 2*x over GF(3) = %s", got)
+	}
+	// Factoring over a large field checks only the product.
+	m61 := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 61), big.NewInt(1))
+	big61, err := gosymbol.GFPolyOf(mustParse(t, "(x^2 + 3)*(x^3 - 7)*(x + 5)^2"), "x", m61)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factors(big61)
+
+	if !gf("x^4 + x + 1", 2).IsIrreducible() || gf("x^4 + x^2 + 1", 2).IsIrreducible() || !gf("x^2 + 1", 3).IsIrreducible() || gf("x^2 + 1", 5).IsIrreducible() || gf("3", 5).IsIrreducible() {
+		t.Error("IsIrreducible")
+	}
+
+	a, b := gf("x^3 + 2*x + 1", 7), gf("x^2 + 3", 7)
+	q, r, err := a.DivMod(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, _ := q.Mul(b)
+	if back, _ = back.Add(r); !back.Equal(a) || r.Degree() >= b.Degree() {
+		t.Errorf("DivMod: q = %v, r = %v", q, r)
+	}
+	g, _ := gf("(x + 1)*(x + 3)", 7).GCD(gf("3*(x + 1)*(x + 4)", 7))
+	assertStr(t, g.Expr("x"), "x + 1")
+	pw, _ := gf("x", 7).PowMod(big.NewInt(7), b)
+	if _, want, _ := gf("x^7", 7).DivMod(b); !want.Equal(pw) {
+		t.Errorf("x^7 mod x^2 + 3 = %v", pw)
+	}
+	if v := gf("x^2 + 1", 7).Eval(big.NewInt(3)); v.Int64() != 3 {
+		t.Errorf("Eval = %v", v)
+	}
+
+	if _, err := gosymbol.GFPolyOf(mustParse(t, "x/5"), "x", big.NewInt(5)); err == nil {
+		t.Error("x/5 over GF(5) should fail")
+	}
+	if _, err := gosymbol.NewGFPoly(big.NewInt(6), nil); err == nil {
+		t.Error("modulus 6 should fail")
+	}
+	if _, err := a.Add(gf("x", 5)); err == nil {
+		t.Error("adding over different fields should fail")
+	}
+	if _, _, err := a.DivMod(gf("0", 7)); err == nil {
+		t.Error("division by zero should fail")
+	}
+	if _, _, err := gf("0", 7).Factor(); err == nil {
+		t.Error("factoring zero should fail")
+	}
+}
+
+func TestGeneratingFunctions(t *testing.T) {
+	n := gosymbol.N
+	joined := func(es []gosymbol.Expr) string {
+		var parts []string
+		for _, e := range es {
+			parts = append(parts, e.String())
+		}
+		return strings.Join(parts, " ")
+	}
+	fib := gosymbol.LinearRecurrence{Coeffs: []gosymbol.Expr{n(1), n(1)}, Initial: []gosymbol.Expr{n(0), n(1)}}
+	if got := joined(fib.Terms(8)); got != "0 1 1 2 3 5 8 13" {
+		t.Errorf("Terms = %s", got)
+	}
+	g := fib.OGF("x")
+	assertStr(t, g, "x*(-x^2 - x + 1)^-1")
+	if got := joined(gosymbol.OGFCoefficients(g, "x", 8)); got != "0 1 1 2 3 5 8 13" {
+		t.Errorf("OGFCoefficients = %s", got)
+	}
+	egf, err := fib.EGF("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := joined(gosymbol.EGFCoefficients(egf, "x", 8)); got != "0 1 1 2 3 5 8 13" {
+		t.Errorf("EGFCoefficients(%s) = %s", egf, got)
+	}
+	r, err := gosymbol.RecurrenceFromOGF(g, "x")
+	if err != nil || joined(r.Coeffs) != "1 1" || joined(r.Initial) != "0 1" {
+		t.Errorf("RecurrenceFromOGF = %v, %v", r, err)
+	}
+
+	// a_n = 2^n - 1 and a_n = 2n + 1 (repeated root).
+	egf, _ = gosymbol.LinearRecurrence{Coeffs: []gosymbol.Expr{n(3), n(-2)}, Initial: []gosymbol.Expr{n(0), n(1)}}.EGF("x")
+	assertStr(t, egf, "exp(2*x) - exp(x)")
+	egf, _ = gosymbol.LinearRecurrence{Coeffs: []gosymbol.Expr{n(2), n(-1)}, Initial: []gosymbol.Expr{n(1), n(3)}}.EGF("x")
+	assertStr(t, egf, "2*x*exp(x) + exp(x)")
+
+	if _, err := gosymbol.RecurrenceFromOGF(mustParse(t, "x^2/(1 - x)"), "x"); err == nil {
+		t.Error("improper rational function should fail")
+	}
+}
+
+func TestGuessSequence(t *testing.T) {
+	seq := func(vs ...int64) []gosymbol.Expr {
+		out := make([]gosymbol.Expr, len(vs))
+		for i, v := range vs {
+			out[i] = gosymbol.N(v)
+		}
+		return out
+	}
+	joined := func(es []gosymbol.Expr) string {
+		var parts []string
+		for _, e := range es {
+			parts = append(parts, e.String())
+		}
+		return strings.Join(parts, " ")
+	}
+	r, err := gosymbol.GuessRecurrence(seq(0, 1, 1, 2, 3, 5, 8, 13))
+	if err != nil || joined(r.Coeffs) != "1 1" || joined(r.Initial) != "0 1" {
+		t.Errorf("GuessRecurrence(fib) = %v, %v", r, err)
+	}
+	if got := joined(r.Terms(10)); got != "0 1 1 2 3 5 8 13 21 34" {
+		t.Errorf("continued = %s", got)
+	}
+	if _, err := gosymbol.GuessRecurrence(seq(1, 1, 2, 6, 24, 120, 720)); err == nil {
+		t.Error("n! has no constant-coefficient recurrence")
+	}
+
+	cases := []struct {
+		seq  []gosymbol.Expr
+		want string
+	}{
+		{seq(1, 2, 4, 8, 16), "2^n"},
+		{seq(1, -2, 4, -8, 16), "(-2)^n"},
+		{seq(1, 2, 5, 10, 17, 26, 37), "n^2 + 1"},
+		{seq(1, 2, 3), "n + 1"},
+		{seq(1, 3, 6, 11, 20, 37, 70), "n + 2^n"},
+	}
+	for _, c := range cases {
+		fs, err := gosymbol.GuessFormula(c.seq, "n")
+		if err != nil || joined(fs) != c.want {
+			t.Errorf("GuessFormula(%s) = %v, %v; want %s", joined(c.seq), fs, err, c.want)
+		}
+	}
+	// Fibonacci gets Binet's formula; check it numerically further out.
+	fs, err := gosymbol.GuessFormula(seq(0, 1, 1, 2, 3, 5, 8, 13), "n")
+	if err != nil || len(fs) != 1 {
+		t.Fatalf("GuessFormula(fib) = %v, %v", fs, err)
+	}
+	if v, err := gosymbol.EvalT(fs[0], map[string]float64{"n": 20}); err != nil || math.Abs(v-6765) > 1e-6 {
+		t.Errorf("%s at n = 20 is %v, %v", fs[0], v, err)
+	}
+	// Complex characteristic roots are out of reach.
+	if _, err := gosymbol.GuessFormula(seq(0, 1, 0, -1, 0, 1, 0, -1), "n"); err == nil {
+		t.Error("expected no closed form for a period-4 sequence")
+	}
+
+	xs, err := gosymbol.SeqFromFloats([]float64{1, 0.5, 0.333333333333, 0.1})
+	if err != nil || joined(xs) != "1 1/2 1/3 1/10" {
+		t.Errorf("SeqFromFloats = %v, %v", xs, err)
+	}
+}
+
+// ------------------------------------------------------------
+// Solvers
+// ------------------------------------------------------------
+
+func TestSolveLinear(t *testing.T) {
+	res := gosymbol.SolveLinear(gosymbol.N(2), gosymbol.N(-6))
+	if res.Error != "" || !res.ExactForm {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	assertStr(t, res.Solutions[0], "3")
+	assertStr(t, gosymbol.SolveLinear(gosymbol.N(3), gosymbol.N(1)).Solutions[0], "-1/3")
+	assertStr(t, gosymbol.SolveLinear(y, gosymbol.N(2)).Solutions[0], "-2*y^-1")
+	if c := gosymbol.SolveLinear(y, gosymbol.N(2)).Conditions; len(c) != 1 || c[0].String() != "y != 0" {
+		t.Errorf("conditions = %v", c)
+	}
+	if c := gosymbol.SolveLinear(gosymbol.N(2), y).Conditions; len(c) != 0 {
+		t.Errorf("conditions for a numeric coefficient = %v", c)
+	}
+	if res := gosymbol.SolveLinear(gosymbol.N(0), gosymbol.N(1)); res.Error == "" {
+		t.Error("expected error for a = 0")
+	}
+}
+
+func TestSolveQuadratic(t *testing.T) {
+	res := gosymbol.SolveQuadratic(gosymbol.N(1), gosymbol.N(-3), gosymbol.N(2))
+	if len(res.Solutions) != 2 {
+		t.Fatalf("got %+v", res)
+	}
+	assertStr(t, res.Solutions[0], "1")
+	assertStr(t, res.Solutions[1], "2")
+
+	res = gosymbol.SolveQuadratic(gosymbol.N(1), gosymbol.N(2), gosymbol.N(1))
+	if len(res.Solutions) != 1 {
+		t.Fatalf("double root: got %+v", res)
+	}
+	assertStr(t, res.Solutions[0], "-1")
+
+	res = gosymbol.SolveQuadratic(gosymbol.N(1), gosymbol.N(0), gosymbol.N(1))
+	if !strings.HasPrefix(res.Error, "complex roots") {
+		t.Errorf("expected complex roots error, got %+v", res)
+	}
+
+	res = gosymbol.SolveQuadratic(gosymbol.N(1), gosymbol.N(0), gosymbol.N(-2))
+	for _, s := range res.Solutions {
+		v, _ := s.Eval()
+		if math.Abs(v.Float64()*v.Float64()-2) > 1e-12 {
+			t.Errorf("root %s does not satisfy x^2 = 2", s)
+		}
+	}
+
+	res = gosymbol.SolveQuadratic(gosymbol.N(0), gosymbol.N(2), gosymbol.N(-4))
+	assertStr(t, res.Solutions[0], "2")
+
+	res = gosymbol.SolveQuadratic(mustParse(t, "a - 1"), gosymbol.N(0), gosymbol.N(-1))
+	var conds []string
+	for _, c := range res.Conditions {
+		conds = append(conds, c.String())
+	}
+	if got := strings.Join(conds, ", "); got != "a != 1, 4*a - 4 >= 0" {
+		t.Errorf("conditions = %s", got)
+	}
+	if len(gosymbol.SolveQuadratic(gosymbol.N(1), gosymbol.N(-3), gosymbol.N(2)).Conditions) != 0 {
+		t.Error("numeric coefficients produced conditions")
+	}
+}
+
+func TestSolveLinearSystem2x2(t *testing.T) {
+	// x + y = 3, x - y = 1
+	xs, ys, err := gosymbol.SolveLinearSystem2x2(gosymbol.N(1), gosymbol.N(1), gosymbol.N(3), gosymbol.N(1), gosymbol.N(-1), gosymbol.N(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, xs, "2")
+	assertStr(t, ys, "1")
+
+	_, _, err = gosymbol.SolveLinearSystem2x2(gosymbol.N(1), gosymbol.N(2), gosymbol.N(3), gosymbol.N(2), gosymbol.N(4), gosymbol.N(6))
+	if err == nil {
+		t.Error("expected singular system error")
+	}
+}
+
+func TestSolveLinearSystem(t *testing.T) {
+	eq := func(l, r string) *gosymbol.Equation { return gosymbol.Eq(mustParse(t, l), mustParse(t, r)) }
+	sol, err := gosymbol.SolveLinearSystem([]*gosymbol.Equation{eq("x + y + z", "6"), eq("2*y - z", "1"), eq("x - z", "-2")}, []string{"x", "y", "z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"1", "2", "3"} {
+		assertStr(t, sol[i], want)
+	}
+	sol, err = gosymbol.SolveLinearSystem([]*gosymbol.Equation{eq("a*x + y", "1"), eq("x - y", "0")}, []string{"x", "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, sol[0].Sub("a", gosymbol.N(3)).Simplify(), "1/4")
+
+	for _, eqs := range [][]*gosymbol.Equation{
+		{eq("x*y", "1"), eq("x", "y")},
+		{eq("x + y", "1"), eq("2*x + 2*y", "3")},
+		{eq("x + y", "1")},
+	} {
+		if _, err := gosymbol.SolveLinearSystem(eqs, []string{"x", "y"}); err == nil {
+			t.Errorf("%v: expected an error", eqs)
+		}
+	}
+}
+
+func TestFindRoot(t *testing.T) {
+	r, err := gosymbol.FindRoot(mustParse(t, "x^2 - 2"), "x", 1)
+	if err != nil || math.Abs(r-math.Sqrt2) > 1e-15 {
+		t.Errorf("FindRoot(x^2 - 2) = %v, %v", r, err)
+	}
+	if _, err := gosymbol.FindRoot(mustParse(t, "x^2 + 1"), "x", 0); err == nil {
+		t.Error("FindRoot(x^2 + 1) from 0: expected an error")
+	}
+}
+
+func TestSolveODE(t *testing.T) {
+	pts, err := gosymbol.SolveODE(mustParse(t, "y"), "t", "y", 0, 1, 1, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := pts[len(pts)-1]
+	if len(pts) != 21 || last.T != 1 || math.Abs(last.Y-math.E) > 1e-6 {
+		t.Errorf("y' = y: %d points, last %v", len(pts), last)
+	}
+	if _, err := gosymbol.SolveODE(mustParse(t, "ln(y)"), "t", "y", 0, -1, 1, 4); err == nil {
+		t.Error("y' = ln(y) from y = -1: expected an error")
+	}
+}
+
+func TestCertifyRootsPolynomial(t *testing.T) {
+	r, err := gosymbol.CertifyRoots(mustParse(t, "x^3 - 2*x"), "x", gosymbol.N(-3), gosymbol.N(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Roots) != 3 || len(r.Unresolved) != 0 {
+		t.Fatalf("roots %v, unresolved %v", r.Roots, r.Unresolved)
+	}
+	assertStr(t, r.Roots[1].Lo, "0")
+	assertStr(t, r.Roots[1].Hi, "0")
+	for i, want := range []float64{-math.Sqrt2, 0, math.Sqrt2} {
+		lo, hi := r.Roots[i].Lo.Float64(), r.Roots[i].Hi.Float64()
+		if want < lo || want > hi || hi-lo > 6.0/(1<<32) {
+			t.Errorf("root %d: %v does not pin %v", i, r.Roots[i], want)
+		}
+	}
+
+	// A double root is one distinct root; no real roots leaves the whole
+	// range root-free.
+	r, _ = gosymbol.CertifyRoots(mustParse(t, "(x - 1)^2*(x + 2)"), "x", gosymbol.N(0), gosymbol.N(3))
+	if len(r.Roots) != 1 || !(r.Roots[0].Lo.Float64() <= 1 && 1 <= r.Roots[0].Hi.Float64()) {
+		t.Errorf("(x - 1)^2*(x + 2): roots %v", r.Roots)
+	}
+	r, _ = gosymbol.CertifyRoots(mustParse(t, "x^2 + 1"), "x", gosymbol.N(-10), gosymbol.N(10))
+	if len(r.Roots) != 0 || len(r.RootFree) != 1 || r.RootFree[0].String() != "[-10, 10]" {
+		t.Errorf("x^2 + 1: %+v", r)
+	}
+
+	if n, err := gosymbol.CountRealRoots(mustParse(t, "x^4 - 5*x^2 + 4"), "x", gosymbol.N(-2), gosymbol.N(1)); err != nil || n != 3 {
+		t.Errorf("CountRealRoots = %d, %v, want 3", n, err)
+	}
+	if _, err := gosymbol.CountRealRoots(mustParse(t, "sin(x)"), "x", gosymbol.N(0), gosymbol.N(1)); err == nil {
+		t.Error("CountRealRoots(sin(x)): expected an error")
+	}
+	if _, err := gosymbol.CertifyRoots(mustParse(t, "x*y"), "x", gosymbol.N(0), gosymbol.N(1)); err == nil {
+		t.Error("CertifyRoots(x*y): expected an error")
+	}
+}
+
+func TestCertifyRootsInterval(t *testing.T) {
+	r, err := gosymbol.CertifyRoots(mustParse(t, "cos(x) - x"), "x", gosymbol.N(-2), gosymbol.N(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Roots) != 1 || len(r.Unresolved) != 0 {
+		t.Fatalf("cos(x) - x: %+v", r)
+	}
+	if lo, hi := r.Roots[0].Lo.Float64(), r.Roots[0].Hi.Float64(); !(lo <= 0.7390851332151607 && 0.7390851332151607 <= hi) || hi-lo > 1e-8 {
+		t.Errorf("cos(x) - x: root interval %v", r.Roots[0])
+	}
+
+	// ln is undefined left of 0, so that part stays unresolved while the
+	// root at 1 is still found.
+	r, _ = gosymbol.CertifyRoots(mustParse(t, "ln(x)"), "x", gosymbol.N(-3), gosymbol.N(3))
+	if len(r.Roots) != 1 || len(r.Unresolved) != 1 || r.Unresolved[0].Lo.Float64() != -3 || r.Unresolved[0].Hi.Float64() > 0.01 {
+		t.Errorf("ln(x): %+v", r)
+	}
+
+	// A root at an endpoint must not be certified away.
+	for _, ends := range [][2]int64{{0, 1}, {-1, 0}} {
+		r, err := gosymbol.CertifyRoots(mustParse(t, "sin(x)"), "x", gosymbol.N(ends[0]), gosymbol.N(ends[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range r.RootFree {
+			if f.Lo.Float64() <= 0 && 0 <= f.Hi.Float64() {
+				t.Errorf("sin(x) on %v: root-free interval %v contains the root 0", ends, f)
+			}
+		}
+		if len(r.Roots)+len(r.Unresolved) == 0 {
+			t.Errorf("sin(x) on %v: root at 0 not reported: %+v", ends, r)
+		}
+	}
+	if _, err := gosymbol.CountRealRoots(mustParse(t, "x^2 - 1"), "x", gosymbol.N(1), gosymbol.N(-1)); err == nil {
+		t.Error("CountRealRoots with lo > hi: expected an error")
+	}
+}
+
+func TestIntervalDomain(t *testing.T) {
+	d := gosymbol.IntervalDomain{}
+	for _, c := range []struct {
+		expr   string
+		x      gosymbol.Interval
+		lo, hi float64 // the exact range, which the enclosure must contain
+	}{
+		{"x^2 - x", gosymbol.Interval{Lo: -1, Hi: 1}, -0.25, 2},
+		{"sin(x)", gosymbol.Interval{Lo: 1, Hi: 2}, math.Sin(1), 1},
+		{"sin(x)", gosymbol.Interval{Lo: 0, Hi: 0}, 0, 0},
+		{"sin(x)", gosymbol.Interval{Lo: -1, Hi: 0}, math.Sin(-1), 0},
+		{"cos(x)", gosymbol.Interval{Lo: 3, Hi: 4}, -1, math.Cos(4)},
+		{"exp(x)/x", gosymbol.Interval{Lo: 1, Hi: 2}, math.E / 2, math.Exp(2)},
+		{"1/3*x", gosymbol.Interval{Lo: 3, Hi: 3}, 1, 1},
+	} {
+		v, err := gosymbol.EvalIn[gosymbol.Interval](mustParse(t, c.expr), d, map[string]gosymbol.Interval{"x": c.x})
+		if err != nil || v.Lo > c.lo || v.Hi < c.hi || v.Hi-v.Lo > 2*(c.hi-c.lo)+1e-12 {
+			t.Errorf("%s on %v = %v, %v; want an enclosure of [%v, %v]", c.expr, c.x, v, err, c.lo, c.hi)
+		}
+	}
+	if _, err := gosymbol.EvalIn[gosymbol.Interval](mustParse(t, "ln(x)"), d, map[string]gosymbol.Interval{"x": {Lo: -1, Hi: 1}}); err == nil {
+		t.Error("ln over [-1, 1]: expected an error")
+	}
+}
+
+func TestSolveSteps(t *testing.T) {
+	texts := func(steps []gosymbol.SolveStep) string {
+		var out []string
+		for _, s := range steps {
+			out = append(out, s.String())
+		}
+		return strings.Join(out, "\n")
+	}
+	steps, r := gosymbol.SolveSteps(gosymbol.Eq(mustParse(t, "2*x + 3"), gosymbol.N(7)), "x")
+	want := "move terms: 2*x - 4 = 0\nsubtract constant: 2*x = 4\ndivide by coefficient: x = 2"
+	if got := texts(steps); got != want || r.Error != "" || r.Solutions[0].String() != "2" {
+		t.Errorf("linear steps:\n%s\nresult %+v", got, r)
+	}
+
+	steps, r = gosymbol.SolveSteps(gosymbol.Eq(mustParse(t, "x^2 - 3*x"), gosymbol.N(-2)), "x")
+	want = "move terms: x^2 - 3*x + 2 = 0\n" +
+		"identify coefficients: a = 1, b = -3, c = 2\n" +
+		"discriminant: b^2 - 4*a*c = 1\n" +
+		"quadratic formula: x = (3 ± 1)/2\n" +
+		"solution: x = 1 or x = 2"
+	if got := texts(steps); got != want || len(r.Solutions) != 2 {
+		t.Errorf("quadratic steps:\n%s\nresult %+v", got, r)
+	}
+	if steps[3].LaTeX != `x = \frac{3 \pm 1}{2}` {
+		t.Errorf("quadratic formula LaTeX = %q", steps[3].LaTeX)
+	}
+
+	steps, r = gosymbol.SolveSteps(gosymbol.Eq(x, gosymbol.N(0)), "x")
+	if texts(steps) != "solution: x = 0" || r.Error != "" {
+		t.Errorf("x = 0 steps %q, result %+v", texts(steps), r)
+	}
+
+	for _, c := range []struct{ lhs, rhs string }{{"x^2", "-1"}, {"x^3", "1"}, {"x", "x"}, {"x + 1", "x"}} {
+		if _, r := gosymbol.SolveSteps(gosymbol.Eq(mustParse(t, c.lhs), mustParse(t, c.rhs)), "x"); r.Error == "" {
+			t.Errorf("SolveSteps(%s = %s) succeeded", c.lhs, c.rhs)
+		}
+	}
+}
+
+func TestLogic(t *testing.T) {
+	a, b, c := gosymbol.BoolVar("a"), gosymbol.BoolVar("b"), gosymbol.BoolVar("c")
+	for _, f := range []struct {
+		f    gosymbol.Bool
+		want string
+	}{
+		{gosymbol.And(gosymbol.Or(a, b), gosymbol.Not(c)), "(a | b) & !c"},
+		{gosymbol.Implies(gosymbol.Implies(a, b), c), "(a -> b) -> c"},
+		{gosymbol.Implies(a, gosymbol.Implies(b, c)), "a -> b -> c"},
+		{gosymbol.Not(gosymbol.And(a, b)), "!(a & b)"},
+		{gosymbol.Iff(a, gosymbol.Or()), "a <-> false"},
+	} {
+		if got := f.f.String(); got != f.want {
+			t.Errorf("String = %q, want %q", got, f.want)
+		}
+	}
+
+	rows, err := gosymbol.TruthTable(gosymbol.Implies(a, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range rows {
+		got = append(got, fmt.Sprint(r.Assignment["a"], r.Assignment["b"], r.Value))
+	}
+	if want := "false false true|false true true|true false false|true true true"; strings.Join(got, "|") != want {
+		t.Errorf("TruthTable(a -> b) = %s", strings.Join(got, "|"))
+	}
+	many := make([]gosymbol.Bool, 17)
+	for i := range many {
+		many[i] = gosymbol.BoolVar(fmt.Sprintf("p%d", i))
+	}
+	if _, err := gosymbol.TruthTable(gosymbol.Or(many...)); err == nil {
+		t.Error("expected an error for 17 symbols")
+	}
+
+	tautologies := []gosymbol.Bool{
+		gosymbol.Or(a, gosymbol.Not(a)),
+		gosymbol.Iff(gosymbol.Not(gosymbol.And(a, b)), gosymbol.Or(gosymbol.Not(a), gosymbol.Not(b))),
+		gosymbol.Implies(gosymbol.Implies(gosymbol.Implies(a, b), a), a),
+		gosymbol.And(),
+	}
+	for _, f := range tautologies {
+		if !gosymbol.IsTautology(f) {
+			t.Errorf("%s is a tautology", f)
+		}
+	}
+	if gosymbol.IsTautology(gosymbol.Implies(a, b)) || gosymbol.IsContradiction(gosymbol.Implies(a, b)) {
+		t.Error("a -> b is contingent")
+	}
+	if !gosymbol.IsContradiction(gosymbol.And(a, gosymbol.Not(a))) || !gosymbol.IsContradiction(gosymbol.BoolConst(false)) {
+		t.Error("expected contradictions")
+	}
+
+	// Exactly one of three: the model must make it true, and it agrees
+	// with the truth table.
+	one := gosymbol.And(gosymbol.Or(a, b, c), gosymbol.Not(gosymbol.And(a, b)), gosymbol.Not(gosymbol.And(a, c)), gosymbol.Not(gosymbol.And(b, c)))
+	model, ok := gosymbol.Satisfiable(one)
+	if !ok || len(model) != 3 {
+		t.Fatalf("Satisfiable = %v, %v", model, ok)
+	}
+	count := 0
+	for _, v := range model {
+		if v {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("model %v sets %d symbols", model, count)
+	}
+
+	// Three pigeons do not fit in two holes: p_ij is pigeon i in hole j.
+	p := func(i, j int) gosymbol.Bool { return gosymbol.BoolVar(fmt.Sprintf("p%d%d", i, j)) }
+	var clauses []gosymbol.Bool
+	for i := 0; i < 3; i++ {
+		clauses = append(clauses, gosymbol.Or(p(i, 0), p(i, 1)))
+		for k := i + 1; k < 3; k++ {
+			for j := 0; j < 2; j++ {
+				clauses = append(clauses, gosymbol.Not(gosymbol.And(p(i, j), p(k, j))))
+			}
+		}
+	}
+	if m, ok := gosymbol.Satisfiable(gosymbol.And(clauses...)); ok {
+		t.Errorf("pigeonhole satisfied by %v", m)
+	}
+}
+
+func TestRealSet(t *testing.T) {
+	n := gosymbol.N
+	must := func(s gosymbol.RealSet, err error) gosymbol.RealSet {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := must(gosymbol.SetOf(
+		gosymbol.Span{Lo: n(0), Hi: n(2), HiOpen: true},
+		gosymbol.Span{Lo: n(1), Hi: n(3)},
+		gosymbol.Span{Lo: n(5), Hi: gosymbol.Inf},
+	))
+	cases := []struct {
+		got  fmt.Stringer
+		want string
+	}{
+		{s, "[0, 3] ∪ [5, oo)"},
+		{s.Measure(), "oo"},
+		{must(s.Complement()), "(-oo, 0) ∪ (3, 5)"},
+		{must(must(s.Complement()).Complement()), "[0, 3] ∪ [5, oo)"},
+		{must(s.Intersect(must(gosymbol.SetOf(gosymbol.Span{Lo: n(3), Hi: n(6)})))), "{3} ∪ [5, 6]"},
+		{must(gosymbol.SetOf(gosymbol.Span{Lo: n(0), Hi: n(1), HiOpen: true}, gosymbol.Span{Lo: n(1), Hi: n(2), LoOpen: true})), "[0, 1) ∪ (1, 2]"},
+		{must(gosymbol.SetOf(gosymbol.Span{Lo: n(2), Hi: n(2), LoOpen: true}, gosymbol.Span{Lo: n(3), Hi: n(1)})), "{}"},
+		{must(gosymbol.Reals().Intersect(gosymbol.EmptySet())), "{}"},
+		{must(gosymbol.EmptySet().Complement()), "(-oo, oo)"},
+		{s.Indicator(x), "(0 <= x <= 3) + (x >= 5)"},
+	}
+	for _, c := range cases {
+		if got := c.got.String(); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+	if got := must(s.Complement()).LaTeX(); got != `(-\infty, 0) \cup (3, 5)` {
+		t.Errorf("LaTeX = %s", got)
+	}
+
+	// Symbolic endpoints work as long as they can be ordered.
+	a := gosymbol.S("a")
+	sa := must(gosymbol.SetOf(
+		gosymbol.Span{Lo: a, Hi: gosymbol.AddOf(a, n(2))},
+		gosymbol.Span{Lo: gosymbol.AddOf(a, n(1)), Hi: gosymbol.AddOf(a, n(4)), HiOpen: true},
+	))
+	if got := sa.String(); got != "[a, a + 4)" {
+		t.Errorf("sa = %s", got)
+	}
+	assertStr(t, sa.Measure(), "4")
+	for _, c := range []struct {
+		x            gosymbol.Expr
+		holds, known bool
+	}{{gosymbol.AddOf(a, n(3)), true, true}, {gosymbol.AddOf(a, n(4)), false, true}, {n(3), false, false}} {
+		if holds, known := sa.Contains(c.x); holds != c.holds || known != c.known {
+			t.Errorf("Contains(%s) = %v, %v", c.x, holds, known)
+		}
+	}
+	if _, err := sa.Union(s); err == nil {
+		t.Error("expected an error ordering a and 0")
+	}
+	if got := must(sa.Sub("a", n(1))).String(); got != "[1, 5)" {
+		t.Errorf("sa at a = 1 is %s", got)
+	}
+}
+
+func TestEquation(t *testing.T) {
+	eq := gosymbol.Eq(x, gosymbol.N(5))
+	if eq.String() != "x = 5" || eq.LaTeX() != "x = 5" {
+		t.Errorf("got %q / %q", eq.String(), eq.LaTeX())
+	}
+	assertStr(t, eq.Residual(), "x - 5")
+}
+
+func TestIsolate(t *testing.T) {
+	cases := []struct {
+		lhs, rhs, target, want, conds string
+	}{
+		{"P*V", "n*R*T", "n*R", "R*n = P*T^-1*V", "T != 0"},
+		{"a + b + c", "0", "a + b", "a + b = -c", ""},
+		{"y", "3*(x + 1)^2 + 2", "(x + 1)^2", "(x + 1)^2 = 1/3*(y - 2)", ""},
+		{"y", "2*sin(w*t)", "sin(w*t)", "sin(t*w) = 1/2*y", ""},
+		{"2*x + 2*y", "4", "x + y", "x + y = 2", ""},
+		{"y", "1/(n*R)", "n*R", "R*n = y^-1", "y != 0"},
+		{"x*y", "x + 1", "x", "x = (y - 1)^-1", "y != 1"},
+	}
+	for _, c := range cases {
+		got, conds, err := gosymbol.Isolate(gosymbol.Eq(mustParse(t, c.lhs), mustParse(t, c.rhs)), mustParse(t, c.target))
+		if err != nil {
+			t.Errorf("%s = %s for %s: %v", c.lhs, c.rhs, c.target, err)
+			continue
+		}
+		var cs []string
+		for _, cond := range conds {
+			cs = append(cs, cond.String())
+		}
+		if got.String() != c.want || strings.Join(cs, ", ") != c.conds {
+			t.Errorf("%s = %s for %s: got %s if %v, want %s if %s", c.lhs, c.rhs, c.target, got, cs, c.want, c.conds)
+		}
+	}
+	for _, c := range [][3]string{{"x^2 + x", "1", "x^2"}, {"x", "x", "x"}, {"y", "2", "3"}, {"y", "exp(x)", "x"}} {
+		if got, _, err := gosymbol.Isolate(gosymbol.Eq(mustParse(t, c[0]), mustParse(t, c[1])), mustParse(t, c[2])); err == nil {
+			t.Errorf("%s = %s for %s: got %s, want error", c[0], c[1], c[2], got)
+		}
+	}
+}
+
+func TestFormulas(t *testing.T) {
+	names := gosymbol.RegisteredFormulas("")
+	if len(names) < 10 {
+		t.Fatalf("only %d formulas registered", len(names))
+	}
+	// Every formula is dimensionally consistent and solvable for each of
+	// its symbols, and the solutions satisfy it.
+	for _, name := range names {
+		f, _ := gosymbol.LookupFormula(name)
+		if err := gosymbol.CheckDimensions(f.Eq); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		for unknown := range f.Units {
+			if _, ok := f.Constants[unknown]; ok {
+				continue
+			}
+			knowns := map[string]gosymbol.Expr{}
+			env := map[string]float64{}
+			for k, s := range sortedKeys(f.Units) {
+				if c, ok := f.Constants[s]; ok {
+					env[s], _ = gosymbol.EvalT[float64](c, nil)
+				} else if s != unknown {
+					knowns[s] = gosymbol.N(int64(k + 2))
+					env[s] = float64(k + 2)
+				}
+			}
+			sol, err := gosymbol.SolveFormula(name, knowns)
+			if err != nil || sol.Unknown != unknown || sol.Unit != f.Units[unknown] {
+				t.Errorf("%s for %s: got %+v, %v", name, unknown, sol, err)
+				continue
+			}
+			for _, v := range sol.Solutions {
+				env[unknown], _ = gosymbol.EvalT[float64](v, nil)
+				l, _ := gosymbol.EvalT(f.Eq.LHS, env)
+				r, _ := gosymbol.EvalT(f.Eq.RHS, env)
+				if math.Abs(l-r) > 1e-9*math.Max(1, math.Abs(l)) {
+					t.Errorf("%s for %s = %s: %v != %v", name, unknown, v, l, r)
+				}
+			}
+		}
+	}
+
+	sol, err := gosymbol.SolveFormula("ohms_law", map[string]gosymbol.Expr{"V": gosymbol.N(12), "I": gosymbol.N(3)})
+	if err != nil || sol.Unknown != "R" || sol.Unit != "ohm" || len(sol.Solutions) != 1 {
+		t.Fatalf("ohms_law: got %+v, %v", sol, err)
+	}
+	assertStr(t, sol.Solutions[0], "4")
+	sol, err = gosymbol.SolveFormula("ideal_gas", map[string]gosymbol.Expr{"P": x, "V": y, "T": mustParse(t, "300")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, sol.Solutions[0], "5000000/12471693927*x*y")
+	sol, err = gosymbol.SolveFormula("velocity_displacement", map[string]gosymbol.Expr{"u": gosymbol.N(3), "a": gosymbol.N(2), "s": gosymbol.N(4)})
+	if err != nil || fmt.Sprint(sol.Solutions) != "[-5 5]" {
+		t.Errorf("velocity_displacement: got %v, %v", sol.Solutions, err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		knowns map[string]gosymbol.Expr
+		want   string
+	}{
+		{"nope", nil, "unknown formula"},
+		{"ohms_law", map[string]gosymbol.Expr{"V": gosymbol.N(1)}, "need exactly one unknown"},
+		{"ohms_law", map[string]gosymbol.Expr{"V": gosymbol.N(1), "Z": gosymbol.N(1)}, "has no symbol Z"},
+		{"ohms_law", map[string]gosymbol.Expr{"V": gosymbol.Annotate(gosymbol.N(5), gosymbol.Meta{Unit: "s"}), "I": gosymbol.N(1)}, "known V: unit s"},
+	} {
+		if _, err := gosymbol.SolveFormula(c.name, c.knowns); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s %v: error %v, want %q", c.name, c.knowns, err, c.want)
+		}
+	}
+
+	m := func(name, unit string) gosymbol.Expr {
+		return gosymbol.Annotate(gosymbol.S(name), gosymbol.Meta{Unit: unit})
+	}
+	if err := gosymbol.CheckDimensions(gosymbol.Eq(m("x", "m"), gosymbol.AddOf(m("v", "m/s"), m("t", "s")))); err == nil {
+		t.Error("m = m/s + s: want dimension error")
+	}
+	if err := gosymbol.CheckDimensions(gosymbol.Eq(m("T", "s"), gosymbol.MulOf(gosymbol.N(2), gosymbol.Pi, gosymbol.SqrtOf(gosymbol.MulOf(m("L", "m"), gosymbol.PowOf(m("g", "m/s^2"), gosymbol.N(-1))))))); err != nil {
+		t.Errorf("pendulum: %v", err)
+	}
+	bad := gosymbol.Formula{Name: "bad_speed", Eq: gosymbol.Eq(x, y), Units: map[string]string{"x": "m", "y": "s"}}
+	if err := gosymbol.RegisterFormula(bad); err == nil || !strings.Contains(err.Error(), "dimension mismatch") {
+		t.Errorf("RegisterFormula(bad): %v", err)
+	}
+	if err := gosymbol.RegisterFormula(gosymbol.Formula{Name: "ohms_law", Eq: gosymbol.Eq(x, x), Units: map[string]string{"x": "m"}}); err == nil {
+		t.Error("duplicate formula registered")
+	}
+
+	resp := toolCall(t, "solve_formula", `{"name": "ohms_law", "knowns": {"V": 12, "R": "4"}}`)
+	if resp.Error != "" || resp.String != "I = 3" {
+		t.Errorf("solve_formula tool: got %+v", resp)
+	}
+	resp = toolCall(t, "list_formulas", `{"category": "circuits"}`)
+	if resp.Error != "" || !strings.Contains(resp.String, "ohms_law") || strings.Contains(resp.String, "ideal_gas") {
+		t.Errorf("list_formulas tool: got %q, %q", resp.String, resp.Error)
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ------------------------------------------------------------
+// Optimization
+// ------------------------------------------------------------
+
+func TestMinimize(t *testing.T) {
+	cases := []struct {
+		expr    string
+		x0      []float64
+		want    []float64
+		wantVal float64
+	}{
+		{"(1 - x)^2 + 100*(y - x^2)^2", []float64{-1.2, 1}, []float64{1, 1}, 0},
+		{"(x - 3)^2 + (y + 1)^2 + 2", []float64{0, 0}, []float64{3, -1}, 2},
+		{"exp(x) + exp(-x) + (y - 2)^2", []float64{1, 0}, []float64{0, 2}, 2},
+	}
+	for _, c := range cases {
+		r, err := gosymbol.Minimize(mustParse(t, c.expr), []string{"x", "y"}, c.x0, gosymbol.MinimizeOptions{})
+		if err != nil {
+			t.Fatalf("Minimize(%s): %v", c.expr, err)
+		}
+		if !r.Converged || math.Abs(r.X[0]-c.want[0]) > 1e-6 || math.Abs(r.X[1]-c.want[1]) > 1e-6 || math.Abs(r.Value-c.wantVal) > 1e-10 {
+			t.Errorf("Minimize(%s) = %+v, want %v (%v)", c.expr, r, c.want, c.wantVal)
+		}
+	}
+	r, _ := gosymbol.Minimize(mustParse(t, "(1 - x)^2 + 100*(y - x^2)^2"), []string{"x", "y"}, []float64{-1.2, 1}, gosymbol.MinimizeOptions{MaxIter: 2})
+	if r.Converged || r.Iterations != 2 {
+		t.Errorf("MaxIter not honored: %+v", r)
+	}
+	if _, err := gosymbol.Minimize(mustParse(t, "x + z"), []string{"x"}, []float64{0}, gosymbol.MinimizeOptions{}); err == nil {
+		t.Error("unbound symbol should fail")
+	}
+	if _, err := gosymbol.Minimize(x, []string{"x"}, []float64{0, 1}, gosymbol.MinimizeOptions{}); err == nil {
+		t.Error("length mismatch should fail")
+	}
+}
+
+func TestLagrangeSolve(t *testing.T) {
+	xy := []string{"x", "y"}
+	c, err := gosymbol.LagrangeSolve(mustParse(t, "x^2 + y^2"), []gosymbol.Expr{mustParse(t, "x + y - 1")}, xy)
+	if err != nil || len(c) != 1 || c[0].Exact == nil {
+		t.Fatalf("linear case: %+v, %v", c, err)
+	}
+	assertStr(t, c[0].Exact["x"], "1/2")
+	assertStr(t, c[0].Exact["lambda_1"], "1")
+	if c[0].Value != 0.5 {
+		t.Errorf("value = %v", c[0].Value)
+	}
+
+	c, err = gosymbol.LagrangeSolve(mustParse(t, "x + y"), []gosymbol.Expr{mustParse(t, "x^2 + y^2 - 1")}, xy)
+	if err != nil || len(c) != 2 {
+		t.Fatalf("circle case: %+v, %v", c, err)
+	}
+	r := math.Sqrt2 / 2
+	if math.Abs(c[0].Point["x"]+r) > 1e-9 || math.Abs(c[1].Point["y"]-r) > 1e-9 || math.Abs(c[1].Value-math.Sqrt2) > 1e-9 || c[0].Exact == nil {
+		t.Errorf("circle candidates = %+v", c)
+	}
+	assertStr(t, c[1].Exact["x"], "1/2*2^(1/2)")
+
+	// Polynomial systems are solved exactly through a Gröbner basis.
+	c, err = gosymbol.LagrangeSolve(mustParse(t, "x*y"), []gosymbol.Expr{mustParse(t, "x^2 + y^2 - 1")}, xy)
+	if err != nil || len(c) != 4 {
+		t.Fatalf("x*y on the circle: %+v, %v", c, err)
+	}
+	for i, want := range []string{"-1/2", "-1/2", "1/2", "1/2"} {
+		if c[i].Exact == nil || c[i].Exact["lambda_1"].String() != want || math.Abs(math.Abs(c[i].Point["y"])-r) > 1e-12 {
+			t.Errorf("x*y candidate %d = %+v", i, c[i])
+		}
+	}
+	// Other systems fall back to Newton's method.
+	c, err = gosymbol.LagrangeSolve(mustParse(t, "exp(x) + y"), []gosymbol.Expr{mustParse(t, "x^2 + y^2 - 1")}, xy)
+	if err != nil || len(c) == 0 || c[0].Exact != nil {
+		t.Errorf("exp(x) + y on the circle: %+v, %v", c, err)
+	}
+
+	if _, err := gosymbol.LagrangeSolve(mustParse(t, "x + z"), nil, []string{"x"}); err == nil {
+		t.Error("unbound symbol should fail")
+	}
+}
+
+func TestLinearProgram(t *testing.T) {
+	rel := func(lhs, rhs string, r gosymbol.LPRelation) gosymbol.LPConstraint {
+		return gosymbol.LPConstraint{LHS: mustParse(t, lhs), RHS: mustParse(t, rhs), Rel: r}
+	}
+	xy := []string{"x", "y"}
+	cases := []struct {
+		obj     string
+		cons    []gosymbol.LPConstraint
+		x, y, v string
+	}{
+		{"-3*x - 5*y", []gosymbol.LPConstraint{
+			rel("x", "4", gosymbol.LPLessEq), rel("2*y", "12", gosymbol.LPLessEq), rel("3*x + 2*y", "18", gosymbol.LPLessEq),
+			rel("x", "0", gosymbol.LPGreaterEq), rel("y", "0", gosymbol.LPGreaterEq),
+		}, "2", "6", "-36"},
+		{"x + y", []gosymbol.LPConstraint{rel("x + 2*y", "3", gosymbol.LPGreaterEq), rel("2*x + y", "3", gosymbol.LPGreaterEq)}, "1", "1", "2"},
+		{"x + y", []gosymbol.LPConstraint{rel("x - y", "1/2", gosymbol.LPEqual), rel("y", "1", gosymbol.LPGreaterEq)}, "3/2", "1", "5/2"},
+	}
+	for _, c := range cases {
+		r, err := gosymbol.LinearProgram(mustParse(t, c.obj), c.cons, xy)
+		if err != nil {
+			t.Fatalf("LinearProgram(%s): %v", c.obj, err)
+		}
+		assertStr(t, r.X[0], c.x)
+		assertStr(t, r.X[1], c.y)
+		assertStr(t, r.Value, c.v)
+	}
+	errs := []struct {
+		obj  string
+		cons []gosymbol.LPConstraint
+		want string
+	}{
+		{"x", []gosymbol.LPConstraint{rel("x", "1", gosymbol.LPLessEq), rel("x", "2", gosymbol.LPGreaterEq)}, "infeasible"},
+		{"x", []gosymbol.LPConstraint{rel("x", "1", gosymbol.LPLessEq)}, "unbounded"},
+		{"x*y", nil, "not linear"},
+		{"x + pi*y", nil, "not rational"},
+	}
+	for _, c := range errs {
+		if _, err := gosymbol.LinearProgram(mustParse(t, c.obj), c.cons, xy); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("LinearProgram(%s) error = %v, want %q", c.obj, err, c.want)
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// Matrix
+// ------------------------------------------------------------
+
+func mustMatrix(t testing.TB, rows ...[]string) gosymbol.Matrix {
+	t.Helper()
+	es := make([][]gosymbol.Expr, len(rows))
+	for i, r := range rows {
+		for _, s := range r {
+			e, err := gosymbol.Parse(s)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", s, err)
+			}
+			es[i] = append(es[i], e)
+		}
+	}
+	m, err := gosymbol.NewMatrix(es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// polyMatrix is an n×n matrix whose entries are polynomials in x and y, the
+// case where fraction-free elimination pays off.
+func polyMatrix(t testing.TB, n int) gosymbol.Matrix {
+	rows := make([][]string, n)
+	for i := range rows {
+		for j := 0; j < n; j++ {
+			rows[i] = append(rows[i], fmt.Sprintf("x^%d*y + %d*y - %d*x", (i*j)%3, i-j, (i+2*j)%5))
+		}
+	}
+	return mustMatrix(t, rows...)
+}
+
+func TestMatrixDet(t *testing.T) {
+	m := mustMatrix(t, []string{"a", "b"}, []string{"c", "d"})
+	d, err := m.Det()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, d, "a*d - b*c")
+
+	m = mustMatrix(t, []string{"1", "2", "3"}, []string{"4", "5", "6"}, []string{"7", "8", "10"})
+	if m.DetMethod() != gosymbol.DetNumeric {
+		t.Errorf("numeric matrix: method %v", m.DetMethod())
+	}
+	for _, method := range []gosymbol.DetMethod{gosymbol.DetAuto, gosymbol.DetCofactor, gosymbol.DetBareiss, gosymbol.DetNumeric} {
+		d, err := m.DetWith(method)
+		if err != nil || d.String() != "-3" {
+			t.Errorf("%v: det = %v, %v, want -3", method, d, err)
+		}
+	}
+
+	// The Vandermonde determinant is the product of the differences.
+	rows := make([][]string, 5)
+	var diffs []string
+	for i := range rows {
+		for j := 0; j < 5; j++ {
+			rows[i] = append(rows[i], fmt.Sprintf("x%d^%d", i, j))
+		}
+		for j := i + 1; j < 5; j++ {
+			diffs = append(diffs, fmt.Sprintf("(x%d - x%d)", j, i))
+		}
+	}
+	want := gosymbol.Expand(mustParse(t, strings.Join(diffs, "*"))).String()
+	m = mustMatrix(t, rows...)
+	for _, method := range []gosymbol.DetMethod{gosymbol.DetCofactor, gosymbol.DetBareiss} {
+		if d, _ := m.DetWith(method); d.String() != want {
+			t.Errorf("Vandermonde by %v = %s", method, d)
+		}
+	}
+
+	// Non-polynomial entries are carried through elimination as atoms.
+	m = mustMatrix(t,
+		[]string{"sin(x)", "1", "0", "x"},
+		[]string{"1", "cos(x)", "x^2", "0"},
+		[]string{"0", "1/x", "2", "1"},
+		[]string{"y", "0", "1", "sin(x)"})
+	c, _ := m.DetWith(gosymbol.DetCofactor)
+	b, _ := m.DetWith(gosymbol.DetBareiss)
+	if c.String() != b.String() {
+		t.Errorf("cofactor %s != bareiss %s", c, b)
+	}
+
+	m = mustMatrix(t, []string{"x", "x^2"}, []string{"1", "x"})
+	if d, _ := m.Det(); d.String() != "0" {
+		t.Errorf("singular det = %s", d)
+	}
+
+	// The zero Matrix is 0×0, with determinant 1 and rank 0.
+	if d, err := (gosymbol.Matrix{}).Det(); err != nil || d.String() != "1" {
+		t.Errorf("Det of 0×0 = %v, %v; want 1", d, err)
+	}
+	if r := (gosymbol.Matrix{}).Rank(); r != 0 {
+		t.Errorf("Rank of 0×0 = %d; want 0", r)
+	}
+	if _, err := mustMatrix(t, []string{"1", "2"}).Det(); err == nil {
+		t.Error("det of a 1×2 matrix: expected an error")
+	}
+	if _, err := mustMatrix(t, []string{"x"}).DetWith(gosymbol.DetNumeric); err == nil {
+		t.Error("DetNumeric with a symbol: expected an error")
+	}
+	if _, err := gosymbol.NewMatrix([][]gosymbol.Expr{{x, y}, {x}}); err == nil {
+		t.Error("ragged rows: expected an error")
+	}
+}
+
+func TestMatrixDetMethod(t *testing.T) {
+	generic := func(n int) gosymbol.Matrix {
+		rows := make([][]string, n)
+		for i := range rows {
+			for j := 0; j < n; j++ {
+				rows[i] = append(rows[i], fmt.Sprintf("a%d%d", i, j))
+			}
+		}
+		return mustMatrix(t, rows...)
+	}
+	for _, c := range []struct {
+		m    gosymbol.Matrix
+		want gosymbol.DetMethod
+	}{
+		{polyMatrix(t, 3), gosymbol.DetCofactor},
+		{polyMatrix(t, 5), gosymbol.DetBareiss},
+		{generic(5), gosymbol.DetCofactor},
+		{generic(7), gosymbol.DetBareiss},
+	} {
+		if got := c.m.DetMethod(); got != c.want {
+			t.Errorf("%dx%d: method %v, want %v", c.m.Rows(), c.m.Cols(), got, c.want)
+		}
+	}
+	// Cofactor expansion of a 6×6 polynomial matrix expands 720 products;
+	// elimination stays fast and agrees with it.
+	m := polyMatrix(t, 6)
+	b, _ := m.Det()
+	c, _ := m.DetWith(gosymbol.DetCofactor)
+	if b.String() != c.String() {
+		t.Errorf("bareiss %s != cofactor %s", b, c)
+	}
+}
+
+func TestMatrixEchelon(t *testing.T) {
+	m := mustMatrix(t, []string{"1", "2", "3"}, []string{"4", "5", "6"}, []string{"7", "8", "9"})
+	e, rank := m.Echelon()
+	if rank != 2 || e.Inline() != "[[1, 2, 3], [0, -3, -6], [0, 0, 0]]" || m.Rank() != 2 {
+		t.Errorf("Echelon = %s, rank %d", e, rank)
+	}
+	m = mustMatrix(t, []string{"0", "x"}, []string{"y", "1"}, []string{"y", "x + 1"})
+	e, rank = m.Echelon()
+	if rank != 2 || e.Inline() != "[[y, 1], [0, x*y], [0, 0]]" {
+		t.Errorf("Echelon = %s, rank %d", e, rank)
+	}
+}
+
+func TestMatrixTraceAndAdjugate(t *testing.T) {
+	m := mustMatrix(t, []string{"a", "b", "0"}, []string{"c", "d", "1"}, []string{"x", "0", "y"})
+	tr, err := m.Trace()
+	if err != nil || tr.String() != "a + d + y" {
+		t.Errorf("Trace = %v, %v", tr, err)
+	}
+	minor, err := m.Minor(0, 1)
+	if err != nil || minor.String() != "c*y - x" {
+		t.Errorf("Minor(0, 1) = %v, %v", minor, err)
+	}
+	cof, err := m.Cofactor(0, 1)
+	if err != nil || cof.String() != "-c*y + x" {
+		t.Errorf("Cofactor(0, 1) = %v, %v", cof, err)
+	}
+	adj, err := m.Adjugate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	det, _ := m.Det()
+	prod, _ := m.Mul(adj)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			want := gosymbol.Expr(gosymbol.N(0))
+			if i == j {
+				want = det
+			}
+			if d := gosymbol.Expand(gosymbol.AddOf(prod.At(i, j), gosymbol.Neg(want))); !d.Equal(gosymbol.N(0)) {
+				t.Errorf("(m*adj(m))[%d][%d] - det δ = %s", i, j, d)
+			}
+		}
+	}
+	one := mustMatrix(t, []string{"x"})
+	if adj, err := one.Adjugate(); err != nil || adj.Inline() != "[[1]]" {
+		t.Errorf("Adjugate of 1×1 = %s, %v", adj.Inline(), err)
+	}
+
+	u := mustMatrix(t, []string{"x"}, []string{"y"}, []string{"1"})
+	v := mustMatrix(t, []string{"a", "b", "c"})
+	a := mustMatrix(t, []string{"1", "x", "0"}, []string{"y", "0", "2"}, []string{"0", "1", "a"})
+	for _, ms := range [][]gosymbol.Matrix{{u, v}, {v, u}, {a, u, v}, {u, v, a}, {a}} {
+		got, err := gosymbol.TraceProduct(ms...)
+		if err != nil {
+			t.Errorf("TraceProduct: %v", err)
+			continue
+		}
+		p := ms[0]
+		for _, f := range ms[1:] {
+			p, _ = p.Mul(f)
+		}
+		want, _ := p.Trace()
+		if d := gosymbol.Expand(gosymbol.AddOf(got, gosymbol.Neg(want))); !d.Equal(gosymbol.N(0)) {
+			t.Errorf("TraceProduct = %s, trace of product = %s", got, want)
+		}
+	}
+	for name, f := range map[string]func() error{
+		"Trace 3×1":        func() error { _, err := u.Trace(); return err },
+		"Minor range":      func() error { _, err := m.Minor(3, 0); return err },
+		"Adjugate 1×3":     func() error { _, err := v.Adjugate(); return err },
+		"TraceProduct u*u": func() error { _, err := gosymbol.TraceProduct(u, u); return err },
+		"TraceProduct a*u": func() error { _, err := gosymbol.TraceProduct(a, u); return err },
+	} {
+		if f() == nil {
+			t.Errorf("%s succeeded", name)
+		}
+	}
+}
+
+func TestMatrixEigen2x2(t *testing.T) {
+	// Numeric entries collapse the Piecewise parts to the case that holds.
+	for _, c := range []struct {
+		rows         [][]string
+		values, vecs [2]string
+	}{
+		{[][]string{{"2", "1"}, {"1", "2"}}, [2]string{"1", "3"}, [2]string{"[1 -1]", "[1 1]"}},
+		{[][]string{{"3", "0"}, {"0", "1"}}, [2]string{"1", "3"}, [2]string{"[0 1]", "[1 0]"}},
+		{[][]string{{"1", "1"}, {"0", "1"}}, [2]string{"1", "1"}, [2]string{"[1 0]", "[1 0]"}},
+		{[][]string{{"0", "0"}, {"1", "2"}}, [2]string{"0", "2"}, [2]string{"[-2 1]", "[0 1]"}},
+	} {
+		eig, err := mustMatrix(t, c.rows...).Eigen2x2()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := 0; k < 2; k++ {
+			if got := eig.ValueRe[k].String(); got != c.values[k] || eig.ValueIm[k].String() != "0" {
+				t.Errorf("%v: λ%d = %s + %s*i, want %s", c.rows, k+1, got, eig.ValueIm[k], c.values[k])
+			}
+			if got := fmt.Sprint(eig.VectorRe[k]); got != c.vecs[k] {
+				t.Errorf("%v: v%d = %s, want %s", c.rows, k+1, got, c.vecs[k])
+			}
+		}
+	}
+	rot, _ := mustMatrix(t, []string{"0", "1"}, []string{"-1", "0"}).Eigen2x2()
+	if rot.ValueRe[0].String() != "0" || rot.ValueIm[0].String() != "-1" || rot.ValueIm[1].String() != "1" {
+		t.Errorf("rotation: λ = %s ± %s*i", rot.ValueRe[0], rot.ValueIm[1])
+	}
+
+	// A damped oscillator x'' + g*x' + k*x = 0 keeps the branch on the
+	// sign of g^2 - 4*k; each branch is an eigenpair where it holds.
+	m := mustMatrix(t, []string{"0", "1"}, []string{"-k", "-g"})
+	eig, err := m.Eigen2x2()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, eig.Discriminant, "g^2 - 4*k")
+	assertStr(t, eig.ValueRe[0], "piecewise((-1/2*g, g^2 - 4*k < 0), (1/2*(-g - (g^2 - 4*k)^(1/2)), otherwise))")
+	for _, env := range []map[string]float64{{"g": 3, "k": 2}, {"g": 1, "k": 2}} {
+		for k := 0; k < 2; k++ {
+			at := func(e gosymbol.Expr) complex128 {
+				v, _ := gosymbol.EvalT(e, env)
+				return complex(v, 0)
+			}
+			lambda := at(eig.ValueRe[k]) + 1i*at(eig.ValueIm[k])
+			v := [2]complex128{at(eig.VectorRe[k][0]) + 1i*at(eig.VectorIm[k][0]), at(eig.VectorRe[k][1]) + 1i*at(eig.VectorIm[k][1])}
+			for i := 0; i < 2; i++ {
+				mv := at(m.At(i, 0))*v[0] + at(m.At(i, 1))*v[1]
+				if cmplx.Abs(mv-lambda*v[i]) > 1e-12 {
+					t.Errorf("%v: (M v%d)[%d] = %v, λ v = %v", env, k+1, i, mv, lambda*v[i])
+				}
+			}
+		}
+	}
+	// The first eigenvector component needs no complex case, and a
+	// symmetric matrix none at all.
+	eig, _ = mustMatrix(t, []string{"a", "b"}, []string{"c", "d"}).Eigen2x2()
+	assertStr(t, eig.VectorRe[1][0], "piecewise((b, b != 0), (1/2*a - 1/2*d + 1/2*(a^2 - 2*a*d + 4*b*c + d^2)^(1/2), c != 0), (0, a <= d), (1, otherwise))")
+	eig, _ = mustMatrix(t, []string{"a", "b"}, []string{"b", "d"}).Eigen2x2()
+	assertStr(t, eig.VectorRe[0][0], "piecewise((b, b != 0), (1, a <= d), (0, otherwise))")
+	assertStr(t, eig.VectorRe[0][1], "piecewise((-1/2*a + 1/2*d - 1/2*(a^2 - 2*a*d + 4*b^2 + d^2)^(1/2), b != 0), (0, a <= d), (1, otherwise))")
+	assertStr(t, eig.ValueIm[0], "0")
+	if _, err := mustMatrix(t, []string{"1", "2", "3"}).Eigen2x2(); err == nil {
+		t.Error("Eigen2x2 of 1×3: want error")
+	}
+}
+
+func TestParseMatrix(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"[[1, x], [y, 2]]", "[[1, x], [y, 2]]"},
+		{"[x, y, z]", "[[x], [y], [z]]"},
+		{"[[x + x, sin(0)]]", "[[2*x, 0]]"},
+		{"transpose([x, y])", "[[x, y]]"},
+		{"inv([[1, 2], [3, 4]])", "[[-2, 1], [3/2, -1/2]]"},
+		{"inv([[x, 1], [0, x]])", "[[x^-1, -x^-2], [0, x^-1]]"},
+		{"adjugate([[a, b], [c, d]])", "[[d, -b], [-c, a]]"},
+		{"transpose([x, y]) * [x, y]", "[[x^2 + y^2]]"},
+		{"[[1, 0], [0, 1]] + [[1, 2], [3, 4]] * inv([[1, 2], [3, 4]])", "[[2, 0], [0, 2]]"},
+		{"([1, 2] + [3, 4])", "[[4], [6]]"},
+	} {
+		m, err := gosymbol.ParseMatrix(c.in)
+		if err != nil || m.Inline() != c.want {
+			t.Errorf("ParseMatrix(%q) = %s, %v; want %s", c.in, m.Inline(), err, c.want)
+		}
+	}
+	for _, c := range []struct{ in, want string }{
+		{"det([[a, b], [c, d]])", "a*d - b*c"},
+		{"trace([[a, b], [c, d]]) + 1", "a + d + 1"},
+		{"det(inv([[1, 2], [3, 4]]))", "-1/2"},
+	} {
+		assertStr(t, gosymbol.Simplify(mustParse(t, c.in)), c.want)
+	}
+	for _, c := range []struct{ in, want string }{
+		{"[[1, 2], [3]]", "column 1: matrix: row 1 has 1 entries, want 2"},
+		{"[[1], 2]", `column 7: expected "[", found "2"`},
+		{"[1, 2] + [1, 2, 3]", "column 8: matrix: cannot add"},
+		{"inv([[1, 2], [2, 4]])", "column 1: matrix: singular matrix"},
+		{"inv([1, 2])", "column 1: matrix: inverse of a 2×1 matrix"},
+		{"[]", `column 2: unexpected "]"`},
+		{"[1, 2] x", `column 8: unexpected "x"`},
+		{"x", `column 1: expected a matrix, found "x"`},
+	} {
+		if _, err := gosymbol.ParseMatrix(c.in); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("ParseMatrix(%q) error = %v, want %q", c.in, err, c.want)
+		}
+	}
+	for _, in := range []string{"[1, 2]", "det([1, 2])", "det(x)", "1 + [x]"} {
+		if _, err := gosymbol.Parse(in); err == nil {
+			t.Errorf("Parse(%q) should fail", in)
+		}
+	}
+}
+
+func TestMatrixPrinting(t *testing.T) {
+	m := mustMatrix(t, []string{"1", "x"}, []string{"0", "2*y"}, []string{"-1/2", "sin(x)"})
+	body := `1 & x \\ 0 & 2 y \\ -\frac{1}{2} & \sin\left(x\right)`
+	for _, c := range []struct{ name, got, want string }{
+		{"String", m.String(), "[   1       x]\n[   0     2*y]\n[-1/2  sin(x)]"},
+		{"Inline", m.Inline(), "[[1, x], [0, 2*y], [-1/2, sin(x)]]"},
+		{"LaTeX", m.LaTeX(), `\begin{pmatrix} ` + body + ` \end{pmatrix}`},
+		{"LaTeXEnv", m.LaTeXEnv("bmatrix"), `\begin{bmatrix} ` + body + ` \end{bmatrix}`},
+		{"MathML", gosymbol.Identity(2).MathML(), `<math xmlns="http://www.w3.org/1998/Math/MathML"><mrow><mo>(</mo><mtable>` +
+			`<mtr><mtd><mn>1</mn></mtd><mtd><mn>0</mn></mtd></mtr>` +
+			`<mtr><mtd><mn>0</mn></mtd><mtd><mn>1</mn></mtd></mtr></mtable><mo>)</mo></mrow></math>`},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestIdentityAndZeroMatrix(t *testing.T) {
+	id := gosymbol.Identity(3)
+	if id.Inline() != "[[1, 0, 0], [0, 1, 0], [0, 0, 1]]" || !id.IsIdentity() || id.IsZero() {
+		t.Errorf("Identity(3) = %s", id)
+	}
+	z := gosymbol.ZeroMatrix(2, 3)
+	if z.Inline() != "[[0, 0, 0], [0, 0, 0]]" || !z.IsZero() || z.IsIdentity() {
+		t.Errorf("ZeroMatrix(2, 3) = %s", z)
+	}
+	a := mustMatrix(t, []string{"a", "b", "c"}, []string{"x", "y", "z"})
+	for _, c := range []struct {
+		name string
+		got  func() (gosymbol.Matrix, error)
+		want string
+	}{
+		{"A*I", func() (gosymbol.Matrix, error) { return a.Mul(id) }, a.Inline()},
+		{"I*A", func() (gosymbol.Matrix, error) { return gosymbol.Identity(2).Mul(a) }, a.Inline()},
+		{"A*0", func() (gosymbol.Matrix, error) { return a.Mul(gosymbol.ZeroMatrix(3, 1)) }, "[[0], [0]]"},
+		{"A+0", func() (gosymbol.Matrix, error) { return a.Add(z) }, a.Inline()},
+		{"A+A", func() (gosymbol.Matrix, error) { return a.Add(a) }, "[[2*a, 2*b, 2*c], [2*x, 2*y, 2*z]]"},
+		{"A*B", func() (gosymbol.Matrix, error) {
+			return a.Mul(mustMatrix(t, []string{"1"}, []string{"x"}, []string{"0"}))
+		}, "[[b*x + a], [x*y + x]]"},
+	} {
+		m, err := c.got()
+		if err != nil || m.Inline() != c.want {
+			t.Errorf("%s = %s, %v; want %s", c.name, m, err, c.want)
+		}
+	}
+	if _, err := a.Mul(a); err == nil {
+		t.Error("multiplied a 2×3 matrix by a 2×3 matrix")
+	}
+	if _, err := a.Add(id); err == nil {
+		t.Error("added matrices of different sizes")
+	}
+}
+
+func TestUndefinedFunction(t *testing.T) {
+	f := gosymbol.Function("f")
+	e := gosymbol.MulOf(x, f(gosymbol.PowOf(x, gosymbol.N(2))))
+	d := gosymbol.Diff(e, "x")
+	assertStr(t, d, "2*x^2*f'(x^2) + f(x^2)")
+	assertStr(t, gosymbol.Diff(d, "x").Simplify(), "4*x^3*f''(x^2) + 6*x*f'(x^2)")
+	assertStr(t, gosymbol.Diff(gosymbol.SinOf(f(x)), "x"), "cos(f(x))*f'(x)")
+	assertStr(t, gosymbol.Diff(f(y), "x"), "0")
+	assertStr(t, f(x).Sub("x", gosymbol.N(2)), "f(2)")
+	if got := gosymbol.LaTeX(d); got != `2 x^{2} f'\left(x^{2}\right) + f\left(x^{2}\right)` {
+		t.Errorf("LaTeX = %s", got)
+	}
+	f4 := f(x)
+	for i := 0; i < 4; i++ {
+		f4 = gosymbol.Diff(f4, "x")
+	}
+	if u, ok := f4.(*gosymbol.UndefFunc); !ok || u.Order() != 4 || u.Name() != "f" || f4.LaTeX() != `f^{(4)}\left(x\right)` {
+		t.Errorf("fourth derivative = %s", f4.LaTeX())
+	}
+	if r, ok := gosymbol.Integrate(gosymbol.MulOf(gosymbol.N(3), gosymbol.Diff(f(x), "x")), "x"); !ok || r.String() != "3*f(x)" {
+		t.Errorf("Integrate(3*f'(x)) = %v, %v", r, ok)
+	}
+	if _, ok := gosymbol.Integrate(f(x), "x"); ok {
+		t.Error("integrated f(x)")
+	}
+	if got := gosymbol.FreeSymbols(e); len(got) != 1 || got[0] != "x" {
+		t.Errorf("FreeSymbols = %v", got)
+	}
+	if _, err := gosymbol.EvalT[float64](f(x), map[string]float64{"x": 1}); err == nil {
+		t.Error("evaluated f(x)")
+	}
+	steps := gosymbol.DiffSteps(f(gosymbol.PowOf(x, gosymbol.N(2))), "x")
+	if rule := steps[len(steps)-1].Rule; rule != "chain (function)" {
+		t.Errorf("DiffSteps rule = %s", rule)
+	}
+	for _, name := range []string{"sin", "sqrt", "2f"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Function(%q) did not panic", name)
+				}
+			}()
+			gosymbol.Function(name)
+		}()
+	}
+}
+
+func TestKroneckerDelta(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"KroneckerDelta(j, i)", "KroneckerDelta(i, j)"},
+		{"KroneckerDelta(i, i)", "1"},
+		{"KroneckerDelta(1, 2)", "0"},
+		{"KroneckerDelta(i + 1, i)", "0"},
+		{"KroneckerDelta(j, j + 1)", "0"},
+		{"KroneckerDelta(i, j)^2", "KroneckerDelta(i, j)"},
+		{"KroneckerDelta(i, j)*KroneckerDelta(j, i)", "KroneckerDelta(i, j)"},
+	}
+	for _, c := range cases {
+		assertStr(t, mustParse(t, c.in).Simplify(), c.want)
+	}
+	d := mustParse(t, "KroneckerDelta(i, j)")
+	assertStr(t, d.Sub("j", gosymbol.N(2)).Sub("i", gosymbol.N(2)).Simplify(), "1")
+	assertStr(t, d.Diff("i"), "0")
+	if got := d.LaTeX(); got != `\delta_{i,j}` {
+		t.Errorf("LaTeX = %s", got)
+	}
+	for _, c := range []struct{ i, j, want float64 }{{1, 1, 5}, {1, 2, 0}} {
+		if v, err := gosymbol.EvalT(mustParse(t, "KroneckerDelta(i, j)*x"), map[string]float64{"i": c.i, "j": c.j, "x": 5}); err != nil || v != c.want {
+			t.Errorf("δ(%v, %v)*5 = %v, %v", c.i, c.j, v, err)
+		}
+	}
+
+	// Σ_j δ(i, j) a(j) = a(i) and Σ_j δ(i, j) δ(j, k) = δ(i, k).
+	got, ok := gosymbol.ContractDelta(mustParse(t, "KroneckerDelta(i, j)*a^j + KroneckerDelta(j, k)*KroneckerDelta(i, j)"), "j")
+	if !ok {
+		t.Fatal("ContractDelta failed")
+	}
+	assertStr(t, got, "KroneckerDelta(i, k) + a^i")
+	if _, ok := gosymbol.ContractDelta(mustParse(t, "KroneckerDelta(i, j) + j"), "j"); ok {
+		t.Error("contracted a term without a delta")
+	}
+	if _, ok := gosymbol.ContractDelta(mustParse(t, "KroneckerDelta(j, j + 1)*x"), "j"); ok {
+		t.Error("contracted a delta whose other index involves the summation index")
+	}
+}
+
+func TestRelational(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"x < 1", "x < 1"},
+		{"2*x + 1 >= x", "2*x + 1 >= x"},
+		{"pi > 3", "1"},
+		{"1 != 1", "0"},
+		{"(x < 1)^3", "x < 1"},
+		{"2*(x <= y) + (x > y)", "2*(x <= y) + (x > y)"},
+		{"(x = 1) = 0", "(x = 1) = 0"},
+		{"0 < x < 1", "0 < x < 1"},
+		{"0 < 1 < x <= 2", "1 < x <= 2"},
+		{"x < 1 < 0", "0"},
+		{"(0 < x < 1) + (x > 1)", "(0 < x < 1) + (x > 1)"},
+	}
+	for _, c := range cases {
+		e := mustParse(t, c.in).Simplify()
+		assertStr(t, e, c.want)
+		if back := mustParse(t, e.String()); back.String() != e.String() {
+			t.Errorf("Parse(%q) = %s", e, back)
+		}
+	}
+
+	r := gosymbol.Le(x, gosymbol.N(2))
+	assertStr(t, r.Sub("x", gosymbol.N(2)).Simplify(), "1")
+	assertStr(t, r.Sub("x", gosymbol.N(3)).Simplify(), "0")
+	assertStr(t, r.Diff("x"), "0")
+	if got := gosymbol.Ne(x, y).LaTeX(); got != `x \neq y` {
+		t.Errorf("LaTeX = %s", got)
+	}
+	for _, c := range []struct{ x, want float64 }{{1, 5}, {3, 0}} {
+		if v, err := gosymbol.EvalT(gosymbol.MulOf(r, gosymbol.N(5)), map[string]float64{"x": c.x}); err != nil || v != c.want {
+			t.Errorf("5*(x <= 2) at x = %v: %v, %v", c.x, v, err)
+		}
+	}
+
+	// Relations convert to and from the conditions of Piecewise and the
+	// equations of the solvers.
+	cond := r.(*gosymbol.Relational).Cond()
+	assertStr(t, gosymbol.PiecewiseOf([]gosymbol.PieceCase{{Value: x, Cond: cond}}, gosymbol.N(2)), "piecewise((x, x <= 2), (2, otherwise))")
+	assertStr(t, cond.Relation(), "x <= 2")
+	assertStr(t, gosymbol.Eq(x, y).Relation(), "x = y")
+
+	js, err := gosymbol.ToJSON(gosymbol.Gt(x, y))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(js), &m); err != nil {
+		t.Fatal(err)
+	}
+	if back, err := gosymbol.FromJSON(m); err != nil || back.String() != "x > y" {
+		t.Errorf("JSON round trip = %v, %v", back, err)
+	}
+	if back, err := gosymbol.ParseMathML(gosymbol.MathML(gosymbol.Ge(x, gosymbol.N(1)))); err != nil || back.String() != "x >= 1" {
+		t.Errorf("MathML round trip = %v, %v", back, err)
+	}
+
+	// A chain holds when all of its links do, and serves as the condition
+	// of a Piecewise case.
+	chain := mustParse(t, "0 <= x < 1")
+	links := chain.(*gosymbol.Relational).Links()
+	if len(links) != 2 || links[0].String() != "0 <= x" || links[1].String() != "x < 1" {
+		t.Errorf("Links = %v", links)
+	}
+	for _, c := range []struct{ x, want float64 }{{0, 1}, {0.5, 1}, {1, 0}, {-1, 0}} {
+		if v, err := gosymbol.EvalT(chain, map[string]float64{"x": c.x}); err != nil || v != c.want {
+			t.Errorf("0 <= x < 1 at x = %v: %v, %v", c.x, v, err)
+		}
+	}
+	if got := chain.LaTeX(); got != `0 \leq x < 1` {
+		t.Errorf("LaTeX = %s", got)
+	}
+	pw := mustParse(t, "piecewise((x, 0 <= x < 1), (0, otherwise))")
+	assertStr(t, pw, "piecewise((x, 0 <= x < 1), (0, otherwise))")
+	assertStr(t, pw.Sub("x", gosymbol.F(1, 2)).Simplify(), "1/2")
+	assertStr(t, pw.Sub("x", gosymbol.N(2)).Simplify(), "0")
+	for _, e := range []gosymbol.Expr{chain, pw} {
+		js, err := gosymbol.ToJSON(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(js), &m); err != nil {
+			t.Fatal(err)
+		}
+		if back, err := gosymbol.FromJSON(m); err != nil || back.String() != e.String() {
+			t.Errorf("JSON round trip of %s = %v, %v", e, back, err)
+		}
+	}
+	if _, err := gosymbol.Parse("piecewise((x, y), (0, otherwise))"); err == nil {
+		t.Error("expected an error for a condition that is not a comparison")
+	}
+}
+
+func TestSolveInequality(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"2*x - 1 > 3", "(2, oo)"},
+		{"0 < x < 1", "(0, 1)"},
+		{"x^2 <= 4", "[-2, 2]"},
+		{"x^2 != 1", "(-oo, -1) ∪ (-1, 1) ∪ (1, oo)"},
+		{"x^3 - x >= 0", "[-1, 0] ∪ [1, oo)"},
+		{"0 < x^2 - 1 <= 3", "[-2, -1) ∪ (1, 2]"},
+		{"(x - 1)^2 < 0", "{}"},
+		{"(x - 1)^2 <= 0", "{1}"},
+		{"x^2 + 1 > 0", "(-oo, oo)"},
+	}
+	for _, c := range cases {
+		s, err := gosymbol.SolveInequality(mustParse(t, c.in), "x")
+		if err != nil {
+			t.Errorf("%s: %v", c.in, err)
+			continue
+		}
+		if got := s.String(); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.in, got, c.want)
+		}
+	}
+
+	// The solution set converts back to a sum of chains.
+	s, err := gosymbol.SolveInequality(mustParse(t, "0 < x^2 - 1 <= 3"), "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, s.Indicator(x), "(-2 <= x < -1) + (1 < x <= 2)")
+
+	for _, in := range []string{"x + 1", "sin(x) < 0", "x^5 - 3*x + 1 < 0"} {
+		if _, err := gosymbol.SolveInequality(mustParse(t, in), "x"); err == nil {
+			t.Errorf("%s: expected an error", in)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	a, b := gosymbol.Wild("a"), gosymbol.Wild("b")
+	poly := gosymbol.AddOf(gosymbol.MulOf(gosymbol.Wild("c", "x"), gosymbol.PowOf(x, gosymbol.Wild("n", "x"))), gosymbol.Wild("d", "x"))
+	cases := []struct {
+		e       string
+		pattern gosymbol.Expr
+		want    string // bindings as name=value, sorted; "-" for no match
+	}{
+		{"2*x*sin(y)", gosymbol.MulOf(a, gosymbol.SinOf(b)), "a=2*x b=y"},
+		{"sin(y)", gosymbol.MulOf(a, gosymbol.SinOf(b)), "a=1 b=y"},
+		{"x + 1", gosymbol.MulOf(a, gosymbol.SinOf(b)), "-"},
+		{"3*x^2 + 5", poly, "c=3 d=5 n=2"},
+		{"x^2", poly, "c=1 d=0 n=2"},
+		{"y*x + 1", poly, "c=y d=1 n=1"},
+		{"x + sin(x)", poly, "-"},
+		{"x*y + x*y", gosymbol.AddOf(a, a), "a=x*y"},
+		{"x + y", gosymbol.AddOf(a, a), "-"},
+		{"exp(2*x)", gosymbol.ExpOf(gosymbol.MulOf(a, x)), "a=2"},
+		{"integrate(x^2, x, 0, 1)", gosymbol.IntegralOf(gosymbol.PowOf(x, a), "x", gosymbol.N(0), b), "a=2 b=1"},
+		{"integrate(x^2, x, 0, 1)", gosymbol.IntegralOf(gosymbol.PowOf(y, a), "y", gosymbol.N(0), b), "-"},
+		{"x", x, ""},
+		{"y", x, "-"},
+	}
+	for _, c := range cases {
+		m, ok := gosymbol.Match(mustParse(t, c.e), c.pattern)
+		var got []string
+		for _, name := range []string{"a", "b", "c", "d", "n"} {
+			if v, ok := m[name]; ok {
+				got = append(got, name+"="+v.String())
+			}
+		}
+		if !ok {
+			got = []string{"-"}
+		}
+		if s := strings.Join(got, " "); s != c.want {
+			t.Errorf("Match(%s, %s) = %q, want %q", c.e, c.pattern, s, c.want)
+		}
+	}
+
+	w := mustParse(t, "Wild(a, x) + y")
+	if _, ok := w.(*gosymbol.Add); !ok || len(gosymbol.FreeSymbols(w)) != 1 {
+		t.Errorf("Wild(a, x) + y: free symbols %v", gosymbol.FreeSymbols(w))
+	}
+	assertStr(t, w.Sub("a", x), "Wild(a, x) + y")
+	if got := gosymbol.Wild("a").LaTeX(); got != "a_{*}" {
+		t.Errorf("LaTeX = %s", got)
+	}
+	if _, err := gosymbol.EvalT(gosymbol.Wild("a"), map[string]float64{"a": 1}); err == nil {
+		t.Error("evaluated a Wild")
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	u, r, a, b := gosymbol.Wild("u"), gosymbol.Wild("r"), gosymbol.Wild("a"), gosymbol.Wild("b")
+	two := gosymbol.N(2)
+	rules := []gosymbol.RewriteRule{
+		{ // cosh² - sinh² = 1, anywhere in a sum
+			Pattern:     gosymbol.AddOf(gosymbol.PowOf(gosymbol.FuncOf("cosh", u), two), gosymbol.Neg(gosymbol.PowOf(gosymbol.FuncOf("sinh", u), two)), r),
+			Replacement: gosymbol.AddOf(gosymbol.N(1), r),
+		},
+		{gosymbol.SinOf(gosymbol.MulOf(two, u)), gosymbol.MulOf(two, gosymbol.SinOf(u), gosymbol.CosOf(u))},
+		{gosymbol.LnOf(gosymbol.MulOf(a, b)), gosymbol.AddOf(gosymbol.LnOf(a), gosymbol.LnOf(b))},
+	}
+	cases := []struct {
+		in    string
+		iters int
+		want  string
+	}{
+		{"cosh(x)^2 - sinh(x)^2", 10, "1"},
+		{"y + cosh(x*y)^2 - sinh(x*y)^2", 10, "y + 1"},
+		{"exp(cosh(x)^2 - sinh(x)^2)", 10, "e"},
+		{"sin(2*x) + sin(x)", 10, "2*cos(x)*sin(x) + sin(x)"},
+		{"sin(4*x)", 10, "sin(4*x)"},
+		{"ln(2*x*y)", 1, "ln(2) + ln(x*y)"},
+		{"ln(2*x*y)", 10, "ln(2) + ln(x) + ln(y)"},
+		{"cosh(x)^2 + sinh(x)^2", 10, "cosh(x)^2 + sinh(x)^2"},
+	}
+	for _, c := range cases {
+		assertStr(t, gosymbol.ApplyRules(mustParse(t, c.in), rules, c.iters), c.want)
+	}
+	// A rule set that never settles stops after maxIters passes.
+	inc := []gosymbol.RewriteRule{{x, gosymbol.AddOf(x, gosymbol.N(1))}}
+	assertStr(t, gosymbol.ApplyRules(x, inc, 3), "x + 3")
+	assertStr(t, gosymbol.ApplyRules(x, inc, 0), "x + 1")
+}
+
+func BenchmarkMatrixDet(b *testing.B) {
+	m := polyMatrix(b, 6)
+	for _, method := range []gosymbol.DetMethod{gosymbol.DetBareiss, gosymbol.DetCofactor} {
+		b.Run(method.String(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := m.DetWith(method); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// ------------------------------------------------------------
+// Structural diff
+// ------------------------------------------------------------
+
+func TestDiffTrees(t *testing.T) {
+	a := mustParse(t, "3*x^2 + sin(x) + 1").Simplify()
+	b := mustParse(t, "3*x^3 + cos(x) + 1").Simplify()
+	diffs := gosymbol.DiffTrees(a, b)
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.String())
+	}
+	want := "terms[0].factors[1].exp: 2 | 3; terms[1]: sin(x) | cos(x)"
+	if s := strings.Join(got, "; "); s != want {
+		t.Errorf("DiffTrees = %q, want %q", s, want)
+	}
+	if d := gosymbol.DiffTrees(a, a); len(d) != 0 {
+		t.Errorf("DiffTrees(a, a) = %v", d)
+	}
+	d := gosymbol.DiffTrees(x, mustParse(t, "x + 1"))
+	if len(d) != 1 || d[0].Path != "" || d[0].String() != "(root): x | x + 1" {
+		t.Errorf("root diff = %v", d)
+	}
+	if d := gosymbol.DiffTrees(mustParse(t, "x + y"), mustParse(t, "x + y + 1")); len(d) != 1 || d[0].Path != "" {
+		t.Errorf("arity diff = %v", d)
+	}
+	if d := gosymbol.DiffTrees(nil, x); len(d) != 1 || d[0].String() != "(root): nil | x" {
+		t.Errorf("nil diff = %v", d)
+	}
+	if d := gosymbol.DiffTrees(nil, nil); len(d) != 0 {
+		t.Errorf("DiffTrees(nil, nil) = %v", d)
+	}
+}
+
+func TestEquivN(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"x*(x + 1)", "x^2 + x", true},
+		{"sin(x)^2 + cos(x)^2", "1", true},
+		{"(x + y)^2", "x^2 + 2*x*y + y^2", true},
+		{"ln(x^2)", "2*ln(abs(x))", true},
+		{"sqrt(x)^2", "x", true},
+		{"x^2", "x^3", false},
+		{"(x + 1)^2", "x^2 + 1", false},
+		{"ln(x) + ln(-x)", "0", false},
+	}
+	for _, c := range cases {
+		if got := gosymbol.EquivN(mustParse(t, c.a), mustParse(t, c.b), 0); got != c.want {
+			t.Errorf("EquivN(%s, %s) = %v", c.a, c.b, got)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cases := []struct {
+		a, b string
+		same bool
+	}{
+		{"(x + 1)^2", "x^2 + 2*x + 1", true},
+		{"sin(x)^2 + cos(x)^2", "1", true},
+		{"2*sin(x)*cos(x)", "sin(2*x)", true},
+		{"exp(x)*exp(y)", "exp(x + y)", true},
+		{"(x^2 - 1)/(x - 1)", "x + 1", true},
+		{"sqrt(x^2)", "abs(x)", true},
+		{"1/(1 + sqrt(2))", "sqrt(2) - 1", true},
+		{"x - y", "y - x", false},
+		{"x", "y", false},
+		{"x^2", "x^3", false},
+	}
+	for _, c := range cases {
+		fa, fb := gosymbol.Fingerprint(mustParse(t, c.a)), gosymbol.Fingerprint(mustParse(t, c.b))
+		if (fa == fb) != c.same {
+			t.Errorf("Fingerprint(%s) = %x, Fingerprint(%s) = %x", c.a, fa, c.b, fb)
+		}
+	}
+	// Stable across runs and builds.
+	if fp := gosymbol.Fingerprint(mustParse(t, "(x + 1)^2")); fp != 0xf884a913c751d2ab {
+		t.Errorf("Fingerprint((x + 1)^2) = %016x", fp)
+	}
+}
+
+func TestCountOpsAndComplexity(t *testing.T) {
+	cases := []struct {
+		in         string
+		ops, nodes int
+	}{
+		{"x", 0, 1},
+		{"x*(x + 1)", 2, 5},
+		{"x^2 + x", 2, 5},
+		{"1/3*x + 1", 3, 6},
+		{"sin(x)^2 + cos(x)^2", 5, 9},
+		{"0 < x < 1", 2, 4},
+		{"piecewise((x, x > 0), (0, otherwise))", 1, 5},
+	}
+	for _, c := range cases {
+		e := mustParse(t, c.in)
+		if got := gosymbol.CountOps(e); got != c.ops {
+			t.Errorf("CountOps(%s) = %d, want %d", e, got, c.ops)
+		}
+		if got := gosymbol.Complexity(e); got != c.nodes {
+			t.Errorf("Complexity(%s) = %d, want %d", e, got, c.nodes)
+		}
+	}
+	a := gosymbol.Annotate(gosymbol.SinOf(x), gosymbol.Meta{Label: "s"})
+	if gosymbol.CountOps(a) != 1 || gosymbol.Complexity(a) != 2 {
+		t.Errorf("annotated sin(x): CountOps %d, Complexity %d", gosymbol.CountOps(a), gosymbol.Complexity(a))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, s := range []string{"x^2 + sin(y)", "piecewise((x, x < 0 <= y), (1, otherwise))", "integrate(exp(-t^2), t, 0, oo)"} {
+		if err := gosymbol.Validate(mustParse(t, s)); err != nil {
+			t.Errorf("Validate(%s) = %v", s, err)
+		}
+	}
+	for _, c := range []struct {
+		e    gosymbol.Expr
+		want string
+	}{
+		{nil, "invalid expression at (root): nil expression"},
+		{gosymbol.AddOf(x, gosymbol.SqrtOf(nil)), "at terms[1].base: nil expression"},
+		{gosymbol.SinOf((*gosymbol.Sym)(nil)), "at arg: nil expression"},
+		{&gosymbol.Num{}, "number without a value"},
+		{gosymbol.MulOf(gosymbol.N(2), gosymbol.S("--x")), `symbol name "--x" is not an identifier`},
+		{&gosymbol.Func{}, `unknown function ""`},
+		{&gosymbol.Const{}, `unknown constant ""`},
+		{&gosymbol.Relational{}, "relation with 0 sides"},
+		{gosymbol.IntegralOf(x, "1x", gosymbol.N(0), gosymbol.N(1)), `integration variable name "1x"`},
+		{gosymbol.AddOf(gosymbol.S("e"), gosymbol.E), `symbol name "e" is the constant e`},
+		{gosymbol.SinOf(gosymbol.S("pi")), `symbol name "pi" is the constant pi`},
+		{gosymbol.SumOf(gosymbol.S("oo"), "oo", gosymbol.N(1), gosymbol.N(3)), `summation index name "oo"`},
+	} {
+		err := gosymbol.Validate(c.e)
+		var verr *gosymbol.ValidationError
+		if !errors.As(err, &verr) || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("Validate(%#v) = %v, want %q", c.e, err, c.want)
+		}
+	}
+
+	// JSON tool parameters are validated before use.
+	resp := toolCall(t, "simplify", `{"expr": {"type": "sym", "name": "x y"}}`)
+	if !strings.Contains(resp.Error, `symbol name "x y"`) {
+		t.Errorf("simplify of a malformed tree: %+v", resp)
+	}
+	if resp := toolCall(t, "simplify", `{"expr": {"type": "sym", "name": "pi"}}`); !strings.Contains(resp.Error, `symbol name "pi" is the constant pi`) {
+		t.Errorf("simplify of a symbol named pi: %+v", resp)
+	}
+}
+func TestStructEqualAndHash(t *testing.T) {
+	cases := []struct {
+		a, b string
+		same bool
+	}{
+		{"sin(x)^2 + 1", "sin(x)^2 + 1", true},
+		{"sin(x)", "cos(x)", false},
+		{"x^2", "x^3", false},
+		{"x < 1", "x <= 1", false},
+		{"0 < x < 1", "0 < x < 1", true},
+		// Bound variables compare by position, not by name.
+		{"integrate(x, x, 0, 1)", "integrate(y, y, 0, 1)", true},
+		{"sum(k, k, 1, n)", "sum(j, j, 1, n)", true},
+		{"integrate(x*y, x, 0, 1)", "integrate(x*y, y, 0, 1)", false},
+		{"sum(k*j, k, 1, n)", "sum(k*j, j, 1, n)", false},
+		{"sum(k, k, 1, k)", "sum(j, j, 1, k)", true},
+		{"sum(k, k, 1, k)", "sum(j, j, 1, j)", false},
+		{"Lambda(x, Lambda(y, x - y))", "Lambda(y, Lambda(x, y - x))", true},
+		{"Lambda(x, Lambda(y, x - y))", "Lambda(a, Lambda(b, b - a))", false},
+		{"piecewise((x, x > 0), (0, otherwise))", "piecewise((x, x > 0), (0, otherwise))", true},
+		{"3/4*x", "3/5*x", false},
+	}
+	for _, c := range cases {
+		a, b := mustParse(t, c.a), mustParse(t, c.b)
+		if got := gosymbol.StructEqual(a, b); got != c.same {
+			t.Errorf("StructEqual(%s, %s) = %v", a, b, got)
+		}
+		if got := gosymbol.Hash(a) == gosymbol.Hash(b); got != c.same {
+			t.Errorf("Hash(%s) == Hash(%s) is %v", a, b, got)
+		}
+	}
+
+	// Sums are compared as built, without reordering, and annotations are
+	// ignored.
+	defer gosymbol.SetAutoSimplify(gosymbol.SetAutoSimplify(false))
+	u, v := gosymbol.AddOf(x, y), gosymbol.AddOf(y, x)
+	if gosymbol.StructEqual(u, v) || !u.Equal(v) {
+		t.Errorf("x + y vs y + x: StructEqual %v, Equal %v", gosymbol.StructEqual(u, v), u.Equal(v))
+	}
+	ann := gosymbol.Annotate(gosymbol.SinOf(x), gosymbol.Meta{Label: "s"})
+	if !gosymbol.StructEqual(ann, gosymbol.SinOf(x)) || gosymbol.Hash(ann) != gosymbol.Hash(gosymbol.SinOf(x)) {
+		t.Error("annotation changed StructEqual or Hash")
+	}
+	m := map[uint64]gosymbol.Expr{gosymbol.Hash(u): u}
+	if got, ok := m[gosymbol.Hash(gosymbol.AddOf(x, y))]; !ok || !gosymbol.StructEqual(got, u) {
+		t.Errorf("lookup by Hash = %v, %v", got, ok)
+	}
+}
+
+// ------------------------------------------------------------
+// Parser
+// ------------------------------------------------------------
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"x^2 + 3*x + 2", "x^2 + 3*x + 2"},
+		{"2*x + x", "3*x"},
+		{"2^3^2", "512"},
+		{"(x + 1)*(x - 1)", "(x + 1)*(x - 1)"},
+		{"sin(x)^2 + cos(x)^2", "1"},
+		{"-x^2", "-x^2"},
+		{"x/2", "1/2*x"},
+		{"sqrt(4)", "2"},
+	}
+	for _, c := range cases {
+		assertStr(t, mustParse(t, c.in).Simplify(), c.want)
+	}
+}
+
+func TestParseUnaryMinus(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"-x^2", "-x^2"},
+		{"(-x)^2", "x^2"},
+		{"-2^2", "-4"},
+		{"2*-3", "-6"},
+		{"--x", "x"},
+		{"---x", "-x"},
+		{"-(-3)", "3"},
+		{"x^-1", "x^-1"},
+		{"2^-2", "1/4"},
+		{"x - -y", "x + y"},
+		{"+x", "x"},
+	}
+	for _, c := range cases {
+		assertStr(t, mustParse(t, c.in).Simplify(), c.want)
+	}
+	// -x^2 must parse as -(x^2), not (-x)^2.
+	v := gosymbol.Sub(mustParse(t, "-x^2"), "x", gosymbol.N(3))
+	assertStr(t, v, "-9")
+}
+
+func TestNeg(t *testing.T) {
+	assertStr(t, gosymbol.Neg(gosymbol.N(3)), "-3")
+	assertStr(t, gosymbol.Neg(gosymbol.F(-1, 2)), "1/2")
+	assertStr(t, gosymbol.Neg(gosymbol.Neg(x)), "x")
+	assertStr(t, gosymbol.Neg(x), "-x")
+	assertStr(t, gosymbol.Neg(gosymbol.MulOf(gosymbol.N(2), x)).Simplify(), "-2*x")
+	assertStr(t, gosymbol.Neg(gosymbol.AddOf(x, gosymbol.N(1))).Simplify(), "-(x + 1)")
+}
+
+func TestNegativePrinting(t *testing.T) {
+	// Print the trees exactly as built.
+	defer gosymbol.SetAutoSimplify(gosymbol.SetAutoSimplify(false))
+	cases := []struct {
+		e          gosymbol.Expr
+		str, latex string
+	}{
+		{gosymbol.AddOf(x, gosymbol.N(-5)), "x - 5", "x - 5"},
+		{gosymbol.AddOf(x, gosymbol.Neg(y)), "x - y", "x - y"},
+		{gosymbol.AddOf(x, gosymbol.MulOf(gosymbol.N(-3), y)), "x - 3*y", "x - 3 y"},
+		{gosymbol.AddOf(x, gosymbol.MulOf(gosymbol.F(-1, 2), y)), "x - 1/2*y", `x - \frac{1}{2} y`},
+		{gosymbol.Neg(x), "-x", "-x"},
+		{gosymbol.MulOf(gosymbol.N(-1), gosymbol.N(-2)), "-(-2)", `-\left(-2\right)`},
+		{gosymbol.MulOf(gosymbol.N(-1), gosymbol.MulOf(gosymbol.N(-1), x)), "-(-x)", `-\left(-x\right)`},
+		{gosymbol.AddOf(gosymbol.N(-1), x), "-1 + x", "-1 + x"},
+	}
+	for _, c := range cases {
+		if got := c.e.String(); got != c.str {
+			t.Errorf("String = %q, want %q", got, c.str)
+		}
+		if got := c.e.LaTeX(); got != c.latex {
+			t.Errorf("LaTeX = %q, want %q", got, c.latex)
+		}
+	}
+}
+
+func TestParseNumbers(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"42", "42"},
+		{"2.5", "5/2"},
+		{".5", "1/2"},
+		{"5.", "5"},
+		{"1e-3", "1/1000"},
+		{"2.5E6", "2500000"},
+		{"1e+2", "100"},
+		{".25e1", "5/2"},
+		{"0.1", "1/10"},
+	}
+	for _, c := range cases {
+		assertStr(t, mustParse(t, c.in), c.want)
+	}
+}
+
+func TestParseMalformedNumbers(t *testing.T) {
+	for _, in := range []string{"1.2.3", "1e", "1e+", "2.5E", "3..4", "1e5.2", "12abc"} {
+		_, err := gosymbol.Parse(in)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", in)
+			continue
+		}
+		var pe *gosymbol.ParseError
+		if !asParseError(err, &pe) || !strings.Contains(pe.Msg, "malformed number") {
+			t.Errorf("Parse(%q) error = %v, want malformed number", in, err)
+		}
+	}
+}
+
+func asParseError(err error, target **gosymbol.ParseError) bool {
+	pe, ok := err.(*gosymbol.ParseError)
+	if ok {
+		*target = pe
+	}
+	return ok
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{"", "x +", "(x + 1", "x)", "foo(x)", "2 $ 3", "x y", "x++2", "x^+2", "x-+2"} {
+		if _, err := gosymbol.Parse(in); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", in)
+		}
+	}
+	// Unary plus is accepted where no operator precedes it.
+	for in, want := range map[string]string{"+x": "x", "(+x) + 1": "x + 1", "f(+2)": "f(2)"} {
+		e, err := gosymbol.ParseWithFunctions(in, []string{"f"})
+		if err != nil {
+			t.Errorf("Parse(%q): %v", in, err)
+			continue
+		}
+		assertStr(t, e, want)
+	}
+}
+
+func TestParseErrorLocation(t *testing.T) {
+	cases := []struct {
+		in, want  string
+		line, col int
+	}{
+		{"(x + 1))", `parse error at column 8: unexpected ")"`, 1, 8},
+		{"sin(x", `parse error at column 6: expected ")", found end of input`, 1, 6},
+		{"α + )", `parse error at column 5: unexpected ")"`, 1, 5},
+		{"x +\n  * 2", `parse error at line 2, column 3: unexpected "*"`, 2, 3},
+		{"x ++2", `parse error at column 4: unexpected "+" after "+"`, 1, 4},
+		{"2*+3", `parse error at column 3: unexpected "+" after "*"`, 1, 3},
+	}
+	for _, c := range cases {
+		_, err := gosymbol.Parse(c.in)
+		var pe *gosymbol.ParseError
+		if !asParseError(err, &pe) || err.Error() != c.want || pe.Line != c.line || pe.Col != c.col {
+			t.Errorf("Parse(%q) error = %v, want %s", c.in, err, c.want)
+		}
+	}
+	_, errs := gosymbol.ParseWithRecovery("1 + foo(x) + )")
+	if len(errs) != 2 || errs[0].Col != 5 || errs[1].Col != 14 {
+		t.Errorf("ParseWithRecovery errors = %v", errs)
+	}
+	if _, err := gosymbol.ParseRPN("x +"); err == nil || err.Error() != `parse error at column 3: "+" needs 2 operand(s), stack has 1` {
+		t.Errorf("ParseRPN error = %v", err)
+	}
+	// Errors built without a location still report the byte offset.
+	if got := (&gosymbol.ParseError{Pos: 4, Msg: "bad"}).Error(); got != "parse error at position 4: bad" {
+		t.Errorf("Error() = %q", got)
+	}
+	if resp := toolCall(t, "simplify", `{"expr": "x + )"}`); resp.Error != `parse error at column 5: unexpected ")"` {
+		t.Errorf("tool error = %q", resp.Error)
+	}
+}
+
+func TestParseWithRecovery(t *testing.T) {
+	cases := []struct {
+		in      string
+		partial string
+		pos     []int
+	}{
+		{"x + 2*y", "x + 2*y", nil},
+		{"x + * y )", "x + ?*y", []int{4, 8}},
+		{"1.2.3 + foo(x) + (y", "? + ? + y", []int{0, 8, 19}},
+		{"2 $ 3", "2", []int{2, 4}},
+		{"x^", "x^?", []int{2}},
+		{"", "?", []int{0}},
+	}
+	for _, c := range cases {
+		e, errs := gosymbol.ParseWithRecovery(c.in)
+		if e == nil {
+			t.Fatalf("ParseWithRecovery(%q) returned nil expression", c.in)
+		}
+		assertStr(t, e, c.partial)
+		if len(errs) != len(c.pos) {
+			t.Errorf("ParseWithRecovery(%q): got %d errors (%v), want %d", c.in, len(errs), errs, len(c.pos))
+			continue
+		}
+		for i, err := range errs {
+			if err.Pos != c.pos[i] {
+				t.Errorf("ParseWithRecovery(%q): error %d at %d, want %d", c.in, i, err.Pos, c.pos[i])
+			}
+		}
+	}
+}
+
+func TestParseWithRecoveryAgreesWithParse(t *testing.T) {
+	// The first recovered error is the one Parse reports.
+	for _, in := range []string{"x + * y", "(x + 1", "foo(x) + 1", "x)", "x + 1.2.3"} {
+		_, err := gosymbol.Parse(in)
+		_, errs := gosymbol.ParseWithRecovery(in)
+		if err == nil || len(errs) == 0 {
+			t.Fatalf("%q: expected errors", in)
+		}
+		if err.Error() != errs[0].Error() {
+			t.Errorf("%q: Parse error %q, first recovered error %q", in, err, errs[0])
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	var pe *gosymbol.ParseError
+	long := strings.Repeat("x+", gosymbol.MaxParseLen/2) + "x"
+	if _, err := gosymbol.Parse(long); !asParseError(err, &pe) || !strings.Contains(pe.Msg, "longer than") {
+		t.Errorf("Parse(long input): error %v", err)
+	}
+	if e, errs := gosymbol.ParseWithRecovery(long); e == nil || len(errs) != 1 {
+		t.Errorf("ParseWithRecovery(long input) = %v, %v", e, errs)
+	}
+
+	deep := strings.Repeat("(", 10000) + "x" + strings.Repeat(")", 10000)
+	if _, err := gosymbol.Parse(deep); !asParseError(err, &pe) || !strings.Contains(pe.Msg, "nested") {
+		t.Errorf("Parse(deep parentheses): error %v", err)
+	}
+	if _, err := gosymbol.Parse(strings.Repeat("-", 10000) + "x"); err == nil {
+		t.Error("Parse(10000 unary minus signs) succeeded")
+	}
+	if e, errs := gosymbol.ParseWithRecovery(deep); e == nil || len(errs) == 0 {
+		t.Errorf("ParseWithRecovery(deep parentheses) = %v, %v", e, errs)
+	}
+	ok := strings.Repeat("(", 100) + "x" + strings.Repeat(")", 100)
+	assertStr(t, mustParse(t, ok), "x")
+
+	assertStr(t, mustParse(t, "α + β_1"), "α + β_1")
+	for _, in := range []string{"x\xff", "x \u00b1 y", "2\xc3"} {
+		if _, err := gosymbol.Parse(in); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", in)
+		}
+	}
+}
+
+// FuzzParse checks that Parse either consumes the whole input or returns a
+// *ParseError inside it, and that ParseWithRecovery agrees.
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{"x + 1", "3*x^2 + sin(x)/2", "(x", "x)", "x y", "2*-3", "1.5e3", "1.2.3", "1e999999", "f(,)", "--x^-2", ""} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		e, err := gosymbol.Parse(in)
+		rec, errs := gosymbol.ParseWithRecovery(in)
+		if rec == nil {
+			t.Fatalf("ParseWithRecovery(%q) returned nil", in)
+		}
+		if err != nil {
+			var pe *gosymbol.ParseError
+			if !asParseError(err, &pe) || pe.Pos < 0 || pe.Pos > len(in) {
+				t.Fatalf("Parse(%q): bad error %v", in, err)
+			}
+			if len(errs) == 0 {
+				t.Fatalf("Parse(%q) failed with %v but recovery found no error", in, err)
+			}
+			return
+		}
+		if e == nil {
+			t.Fatalf("Parse(%q) returned nil without error", in)
+		}
+		if len(errs) != 0 {
+			t.Fatalf("Parse(%q) succeeded but recovery reported %v", in, errs)
+		}
+		_ = e.String()
+	})
+}
+
+// randExpr builds a random expression of at most the given depth through
+// the public constructors, over x, y, t, small rationals, pi and oo (as an
+// integration limit).
+func randExpr(r *rand.Rand, depth int) gosymbol.Expr {
+	if depth == 0 || r.Intn(4) == 0 {
+		switch r.Intn(6) {
+		case 0:
+			return gosymbol.N(int64(r.Intn(21) - 10))
+		case 1:
+			return gosymbol.F(int64(r.Intn(9)-4), int64(r.Intn(5)+1))
+		case 2:
+			return gosymbol.Pi
+		default:
+			return gosymbol.S([]string{"x", "y", "t"}[r.Intn(3)])
+		}
+	}
+	args := func() []gosymbol.Expr {
+		out := make([]gosymbol.Expr, r.Intn(3)+2)
+		for i := range out {
+			out[i] = randExpr(r, depth-1)
+		}
+		return out
+	}
+	switch r.Intn(8) {
+	case 0, 1:
+		return gosymbol.AddOf(args()...)
+	case 2, 3:
+		return gosymbol.MulOf(args()...)
+	case 4:
+		return gosymbol.PowOf(randExpr(r, depth-1), randExpr(r, depth-1))
+	case 5:
+		return gosymbol.Neg(randExpr(r, depth-1))
+	case 6:
+		return gosymbol.IntegralOf(randExpr(r, depth-1), "t", randExpr(r, depth-1), gosymbol.Inf)
+	}
+	return gosymbol.FuncOf([]string{"sin", "exp", "ln", "abs"}[r.Intn(4)], randExpr(r, depth-1))
+}
+
+// structure renders the tree itself, unlike Equal, which compares
+// simplified forms.
+func structure(t *testing.T, e gosymbol.Expr) string {
+	t.Helper()
+	js, err := gosymbol.ToJSON(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+func TestStringParseRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		e := randExpr(r, 4)
+		for _, c := range []gosymbol.Expr{e, e.Simplify()} {
+			back, err := gosymbol.Parse(c.String())
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", c, err)
+			}
+			if structure(t, back) != structure(t, c) {
+				t.Fatalf("Parse(%q) has a different tree:\n%s\n%s", c, structure(t, c), structure(t, back))
+			}
+		}
+	}
+}
+
+// shuffled rebuilds e with the terms of every sum and the factors of every
+// product in random order.
+func shuffled(r *rand.Rand, e gosymbol.Expr) gosymbol.Expr {
+	each := func(es []gosymbol.Expr) []gosymbol.Expr {
+		out := make([]gosymbol.Expr, len(es))
+		for i, x := range es {
+			out[i] = shuffled(r, x)
+		}
+		r.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+		return out
+	}
+	switch t := e.(type) {
+	case *gosymbol.Add:
+		return gosymbol.AddOf(each(t.Terms())...)
+	case *gosymbol.Mul:
+		return gosymbol.MulOf(each(t.Factors())...)
+	case *gosymbol.Pow:
+		return gosymbol.PowOf(shuffled(r, t.Base()), shuffled(r, t.Exp()))
+	case *gosymbol.Func:
+		return gosymbol.FuncOf(t.Name(), shuffled(r, t.Arg()))
+	}
+	return e
+}
+
+func TestDeterministicOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 2000; i++ {
+		e := randExpr(r, 4)
+		sh := shuffled(r, e)
+		if a, b := e.Simplify().String(), sh.Simplify().String(); a != b {
+			t.Fatalf("Simplify depends on operand order:\n%s -> %s\n%s -> %s", e, a, sh, b)
+		}
+		if a, b := gosymbol.Diff(e, "x").String(), gosymbol.Diff(sh, "x").String(); a != b {
+			t.Fatalf("Diff depends on operand order:\n%s -> %s\n%s -> %s", e, a, sh, b)
+		}
+	}
+	// Powers of a base merge whatever the order of numeric and symbolic
+	// exponents.
+	assertStr(t, gosymbol.MulOf(gosymbol.PowOf(x, y), x, x).Simplify(), "x^(y + 2)")
+	assertStr(t, gosymbol.MulOf(x, gosymbol.PowOf(x, y), x).Simplify(), "x^(y + 2)")
+
+	values := map[string]gosymbol.Expr{}
+	var terms []gosymbol.Expr
+	for i := 0; i < 20; i++ {
+		v := fmt.Sprintf("a%d", i)
+		values[v] = gosymbol.S(fmt.Sprintf("a%d", (i+1)%20))
+		terms = append(terms, gosymbol.MulOf(gosymbol.N(int64(i)), gosymbol.S(v)))
+	}
+	e := gosymbol.AddOf(terms...)
+	want := gosymbol.SubMap(e, values).String()
+	for i := 0; i < 20; i++ {
+		if got := gosymbol.SubMap(e, values).String(); got != want {
+			t.Fatalf("SubMap varies between calls: %s vs %s", got, want)
+		}
+	}
+	assertStr(t, gosymbol.SubMap(mustParse(t, "x - 2*y"), map[string]gosymbol.Expr{"x": y, "y": x}), "-2*x + y")
+}
+
+func TestStringParseRoundTripCases(t *testing.T) {
+	cases := []struct {
+		e    gosymbol.Expr
+		want string
+	}{
+		{gosymbol.AddOf(x, gosymbol.Neg(gosymbol.AddOf(y, gosymbol.N(1)))), "x - (y + 1)"},
+		{gosymbol.Neg(gosymbol.MulOf(gosymbol.F(21, 2), gosymbol.ExpOf(x))), "-21/2*exp(x)"},
+		{gosymbol.Neg(gosymbol.MulOf(x, y)), "-x*y"},
+		{gosymbol.PowOf(x, gosymbol.F(-1, 2)), "x^(-1/2)"},
+		{gosymbol.PowOf(gosymbol.N(-2), x), "(-2)^x"},
+		{gosymbol.IntegralOf(gosymbol.ExpOf(gosymbol.Neg(x)), "x", gosymbol.N(0), gosymbol.Inf), "integrate(exp(-x), x, 0, oo)"},
+		{gosymbol.MulOf(gosymbol.Wild("c", "x"), gosymbol.PowOf(x, gosymbol.Wild("n"))), "Wild(c, x)*x^Wild(n)"},
+		{gosymbol.Function("g")(x), "g(x)"},
+		{gosymbol.Diff(gosymbol.Function("g")(gosymbol.PowOf(x, gosymbol.N(2))), "x"), "2*x*g'(x^2)"},
+		{gosymbol.DiffN(gosymbol.SinOf(gosymbol.Function("g")(x)), "x", 2), "-g'(x)^2*sin(g(x)) + cos(g(x))*g''(x)"},
+	}
+	for _, c := range cases {
+		assertStr(t, c.e, c.want)
+		if back := mustParse(t, c.want); structure(t, back) != structure(t, c.e) {
+			t.Errorf("Parse(%q) = %s, want %s", c.want, structure(t, back), structure(t, c.e))
+		}
+	}
+	// High orders print as Derivative rather than a run of primes.
+	g4 := gosymbol.DiffN(gosymbol.Function("g")(x), "x", 4)
+	assertStr(t, g4, "Derivative(g(x), (x, 4))")
+	assertStr(t, mustParse(t, "Derivative(g(x^2), (x^2, 7))"), "Derivative(g(x^2), (x^2, 7))")
+	if back := mustParse(t, g4.String()); structure(t, back) != structure(t, g4) {
+		t.Errorf("Parse(%q) = %s", g4, structure(t, back))
+	}
+	// Only names declared with Function parse as unknown functions.
+	for _, in := range []string{"undeclared(x)", "undeclared'(x)", "sin'(x)", "g'", "g(x, y)",
+		"Derivative(g(x), (y, 4))", "Derivative(g(x), (x, 0))", "Derivative(g(x), (x, 1001))",
+		"Derivative(g'(x), (x, 4))", "Derivative(sin(x), (x, 2))", "Derivative(undeclared(x), (x, 4))"} {
+		if e, err := gosymbol.Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %s, want an error", in, e)
+		}
+	}
+	// Functions named for one parse stay undeclared afterwards.
+	e, err := gosymbol.ParseWithFunctions("scoped'(x) + Derivative(scoped(x), (x, 5))", []string{"scoped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, e, "scoped'(x) + Derivative(scoped(x), (x, 5))")
+	if _, err := gosymbol.FromJSON(map[string]interface{}{"type": "function", "name": "fromjson", "arg": map[string]interface{}{"type": "sym", "name": "x"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []string{"scoped(x)", "fromjson(x)"} {
+		if e, err := gosymbol.Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %s after a scoped parse, want an error", in, e)
+		}
+	}
+	if _, err := gosymbol.ParseWithFunctions("sin(x)", []string{"sin"}); err == nil {
+		t.Error("ParseWithFunctions with a registered name should fail")
+	}
+}
+
+// ------------------------------------------------------------
+// Function registry
+// ------------------------------------------------------------
+
+func TestParseRegisteredFunctions(t *testing.T) {
+	cases := []struct {
+		in, diff string
+	}{
+		{"sinh(x)", "cosh(x)"},
+		{"cosh(x)", "sinh(x)"},
+		{"tanh(x)", "cosh(x)^-2"},
+		{"atan(x)", "(x^2 + 1)^-1"},
+		{"asin(x)", "(-x^2 + 1)^(-1/2)"},
+		{"gamma(x)", "digamma(x)*gamma(x)"},
+	}
+	for _, c := range cases {
+		assertStr(t, gosymbol.Diff(mustParse(t, c.in), "x"), c.diff)
+	}
+	v, ok := mustParse(t, "erf(1/2)").Eval()
+	if !ok || math.Abs(v.Float64()-math.Erf(0.5)) > 1e-15 {
+		t.Errorf("erf(1/2) = %v", v)
+	}
+	v, ok = mustParse(t, "gamma(5)").Eval()
+	if !ok || math.Abs(v.Float64()-24) > 1e-12 {
+		t.Errorf("gamma(5) = %v", v)
+	}
+	d, _ := gosymbol.Diff(mustParse(t, "gamma(x)"), "x").Sub("x", gosymbol.N(1)).Eval()
+	if math.Abs(d.Float64()-(-0.5772156649015329)) > 1e-12 {
+		t.Errorf("Γ'(1) = %v, want -γ", d)
+	}
+	d2 := gosymbol.DiffN(mustParse(t, "gamma(x)"), "x", 2)
+	assertStr(t, d2, "digamma(x)^2*gamma(x) + gamma(x)*polygamma(1, x)")
+	// Γ''(1) = γ² + π²/6
+	d, _ = d2.Sub("x", gosymbol.N(1)).Eval()
+	if want := 0.5772156649015329*0.5772156649015329 + math.Pi*math.Pi/6; math.Abs(d.Float64()-want) > 1e-12 {
+		t.Errorf("Γ''(1) = %v, want %v", d, want)
+	}
+	if s := gosymbol.TaylorSeries(mustParse(t, "gamma(x)"), "x", gosymbol.N(1), 3); len(gosymbol.FreeSymbols(s)) != 1 {
+		t.Errorf("TaylorSeries(gamma(x)) = %v", s)
+	}
+	derf, _ := gosymbol.Diff(mustParse(t, "erf(x)"), "x").Sub("x", gosymbol.N(0)).Eval()
+	if math.Abs(derf.Float64()-2/math.SqrtPi) > 1e-15 {
+		t.Errorf("erf'(0) = %v", derf)
+	}
+}
+
+func TestLambertWAndDilog(t *testing.T) {
+	w := func(x float64) float64 {
+		v, _ := gosymbol.EvalT(gosymbol.LambertWOf(gosymbol.S("x")), map[string]float64{"x": x})
+		return v
+	}
+	for _, c := range []struct{ x, want float64 }{
+		{1, 0.5671432904097838}, {10, 1.7455280027406994}, {-0.3, -0.4894022271802149}, {-1 / math.E, -1}, {0, 0},
+	} {
+		if got := w(c.x); math.Abs(got-c.want) > 1e-14 {
+			t.Errorf("W(%v) = %v, want %v", c.x, got, c.want)
+		}
+	}
+	for _, x := range []float64{1e-8, 0.5, 3, 1e6, -0.36} {
+		if v := w(x); math.Abs(v*math.Exp(v)-x) > 1e-14*math.Max(1, x) {
+			t.Errorf("W(%v) = %v does not solve w*exp(w) = x", x, v)
+		}
+	}
+	if !math.IsNaN(w(-1)) {
+		t.Error("W(-1) should be NaN below the branch point")
+	}
+
+	li2 := func(x float64) float64 {
+		v, _ := gosymbol.EvalT(gosymbol.Li2Of(gosymbol.S("x")), map[string]float64{"x": x})
+		return v
+	}
+	for _, c := range []struct{ x, want float64 }{
+		{0.5, math.Pi*math.Pi/12 - math.Ln2*math.Ln2/2}, {-1, -math.Pi * math.Pi / 12}, {1, math.Pi * math.Pi / 6},
+		{0.9, 1.2997147230049588}, {-3, -1.9393754207667089}, {0.25, 0.26765263908273251},
+	} {
+		if got := li2(c.x); math.Abs(got-c.want) > 1e-14 {
+			t.Errorf("Li2(%v) = %v, want %v", c.x, got, c.want)
+		}
+	}
+	if !math.IsNaN(li2(2)) {
+		t.Error("Li2(2) should be NaN: the value is complex")
+	}
+
+	cases := []struct{ in, want string }{
+		{"lambertw(0)", "0"},
+		{"lambertw(exp(1))", "1"},
+		{"lambertw(-1*exp(-1))", "-1"},
+		{"lambertw(-2*exp(-2))", "lambertw(-2*exp(-2))"},
+		{"li2(1)", "1/6*pi^2"},
+		{"li2(-1)", "-1/12*pi^2"},
+	}
+	for _, c := range cases {
+		assertStr(t, mustParse(t, c.in).Simplify(), c.want)
+	}
+	assertStr(t, gosymbol.Diff(mustParse(t, "lambertw(x)"), "x"), "x^-1*(lambertw(x) + 1)^-1*lambertw(x)")
+	assertStr(t, gosymbol.Diff(mustParse(t, "li2(x)"), "x"), "-x^-1*ln(-x + 1)")
+	// The derivatives agree with finite differences.
+	for _, name := range []string{"lambertw", "li2"} {
+		f := mustParse(t, name+"(x)")
+		d, _ := gosymbol.EvalT(gosymbol.Diff(f, "x"), map[string]float64{"x": 0.3})
+		hi, _ := gosymbol.EvalT(f, map[string]float64{"x": 0.3 + 1e-6})
+		lo, _ := gosymbol.EvalT(f, map[string]float64{"x": 0.3 - 1e-6})
+		if fd := (hi - lo) / 2e-6; math.Abs(d-fd) > 1e-8 {
+			t.Errorf("%s'(0.3) = %v, finite difference %v", name, d, fd)
+		}
+	}
+	if got := mustParse(t, "li2(x) + lambertw(x)").LaTeX(); got != `\operatorname{Li}_2\left(x\right) + W\left(x\right)` {
+		t.Errorf("LaTeX = %s", got)
+	}
+	iv, err := gosymbol.EvalIn[gosymbol.Interval](mustParse(t, "lambertw(x)"), gosymbol.IntervalDomain{}, map[string]gosymbol.Interval{"x": {Lo: 1, Hi: 10}})
+	if err != nil || !iv.Contains(0.5671432904097838) || !iv.Contains(1.7455280027406994) {
+		t.Errorf("interval W([1, 10]) = %v, %v", iv, err)
+	}
+}
+
+func TestRegisterFunction(t *testing.T) {
+	err := gosymbol.RegisterFunction(gosymbol.FuncDef{
+		Name: "cube",
+		Eval: func(v float64) float64 { return v * v * v },
+		Deriv: func(u gosymbol.Expr) gosymbol.Expr {
+			return gosymbol.MulOf(gosymbol.N(3), gosymbol.PowOf(u, gosymbol.N(2)))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mustParse(t, "cube(2*x)")
+	assertStr(t, gosymbol.Diff(e, "x"), "24*x^2")
+	v, ok := gosymbol.Sub(e, "x", gosymbol.N(1)).Eval()
+	if !ok || v.Float64() != 8 {
+		t.Errorf("cube(2) = %v", v)
+	}
+	if got := e.LaTeX(); got != `\operatorname{cube}\left(2 x\right)` {
+		t.Errorf("LaTeX = %q", got)
+	}
+	var m map[string]interface{}
+	js, _ := gosymbol.ToJSON(e)
+	_ = json.Unmarshal([]byte(js), &m)
+	if _, err := gosymbol.FromJSON(m); err != nil {
+		t.Errorf("FromJSON of registered function: %v", err)
+	}
+	if _, ok := gosymbol.LookupFunction("cube"); !ok {
+		t.Error("LookupFunction(cube) failed")
+	}
+	assertStr(t, gosymbol.FuncOf("cube", x), "cube(x)")
+
+	err = gosymbol.RegisterFunction(gosymbol.FuncDef{
+		Name: "hypot", Arity: 2,
+		EvalN: func(xs []float64) float64 { return math.Hypot(xs[0], xs[1]) },
+		DerivN: func(args []gosymbol.Expr, i int) gosymbol.Expr {
+			return gosymbol.MulOf(args[i], gosymbol.PowOf(gosymbol.FuncOf("hypot", args...), gosymbol.N(-1)))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mustParse(t, "hypot(x, y)")
+	if v, err := gosymbol.EvalT[float64](h, map[string]float64{"x": 3, "y": 4}); err != nil || v != 5 {
+		t.Errorf("hypot(3, 4) = %v, %v", v, err)
+	}
+	assertStr(t, gosymbol.Diff(h, "y"), "y*hypot(x, y)^-1")
+	if _, err := gosymbol.Parse("hypot(x)"); err == nil {
+		t.Error("Parse(hypot(x)) succeeded, want arity error")
+	}
+
+	bad := []gosymbol.FuncDef{
+		{Name: "cube", Eval: math.Abs},
+		{Name: "sin", Eval: math.Sin},
+		{Name: "2f", Eval: math.Abs},
+		{Name: "sqrt", Eval: math.Sqrt},
+		{Name: "noeval"},
+		{Name: "noevaln", Arity: 2, Eval: math.Abs},
+		{Name: "negarity", Arity: -1, Eval: math.Abs},
+	}
+	for _, d := range bad {
+		if err := gosymbol.RegisterFunction(d); err == nil {
+			t.Errorf("RegisterFunction(%q) succeeded, want error", d.Name)
+		}
+	}
+}
+
+func TestMultiArgFunctions(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"log(8, 2)", "3"},
+		{"log(1/9, 3)", "-2"},
+		{"log(1, y)", "0"},
+		{"log(x, x)", "1"},
+		{"log(x, e)", "ln(x)"},
+		{"log(x, 10)", "log(x, 10)"},
+		{"atan2(y, 2)", "atan(1/2*y)"},
+		{"atan2(-1, 0)", "-1/2*pi"},
+		{"atan2(0, -3)", "pi"},
+		{"max(y, x)", "max(x, y)"},
+		{"max(2, 3) + min(2, 3)", "5"},
+		{"min(x + 1, 1 + x)", "x + 1"},
+	} {
+		if got := mustParse(t, tc.in).Simplify().String(); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		e       gosymbol.Expr
+		v, want string
+		wantTeX string
+	}{
+		{gosymbol.LogOf(x, gosymbol.N(2)), "x", "x^-1*ln(2)^-1", `\log_{2}\left(x\right)`},
+		{gosymbol.LogOf(gosymbol.N(2), y), "y", "-y^-1*ln(2)*ln(y)^-2", `\log_{y}\left(2\right)`},
+		{gosymbol.Atan2Of(y, x), "x", "-y*(x^2 + y^2)^-1", `\operatorname{atan2}\left(y, x\right)`},
+		{gosymbol.MaxOf(x, y), "x", "1/2*(sign(x - y) + 1)", `\max\left(x, y\right)`},
+		{gosymbol.MinOf(x, y), "y", "1/2*(sign(x - y) + 1)", `\min\left(x, y\right)`},
+	} {
+		if got := gosymbol.Diff(tc.e, tc.v).String(); got != tc.want {
+			t.Errorf("d/d%s %s = %s, want %s", tc.v, tc.e, got, tc.want)
+		}
+		if got := tc.e.LaTeX(); got != tc.wantTeX {
+			t.Errorf("LaTeX(%s) = %s, want %s", tc.e, got, tc.wantTeX)
+		}
+	}
+
+	e := mustParse(t, "log(x, 2) + atan2(y, x) + max(x, y) - min(x, 2*y)")
+	env := map[string]float64{"x": 3, "y": 4}
+	want := math.Log2(3) + math.Atan2(4, 3) + 4 - 3
+	if v, err := gosymbol.EvalT[float64](e, env); err != nil || math.Abs(v-want) > 1e-12 {
+		t.Errorf("EvalT = %v, %v, want %v", v, err, want)
+	}
+	if v, err := gosymbol.EvalT[complex128](e, map[string]complex128{"x": 3, "y": 4}); err != nil || cmplx.Abs(v-complex(want, 0)) > 1e-12 {
+		t.Errorf("EvalT[complex128] = %v, %v, want %v", v, err, want)
+	}
+	p, err := gosymbol.CompileProgram(e, []string{"x", "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := p.Exec([]float64{3, 4}); err != nil || math.Abs(v-want) > 1e-12 {
+		t.Errorf("Exec = %v, %v, want %v", v, err, want)
+	}
+	d, err := gosymbol.EvalT[float64](gosymbol.Diff(e, "x"), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, dd, err := gosymbol.EvalDual(e, env, "x"); err != nil || math.Abs(dd-d) > 1e-12 {
+		t.Errorf("EvalDual derivative = %v, %v, want %v", dd, err, d)
+	}
+
+	js, err := gosymbol.ToJSON(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	_ = json.Unmarshal([]byte(js), &m)
+	if back, err := gosymbol.FromJSON(m); err != nil || back.String() != e.String() {
+		t.Errorf("JSON round trip = %v, %v", back, err)
+	}
+	rpn, err := gosymbol.ToRPN(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back, err := gosymbol.ParseRPN(rpn); err != nil || back.String() != e.String() {
+		t.Errorf("RPN round trip = %v, %v", back, err)
+	}
+	if back, err := gosymbol.ParseMathML(gosymbol.MathML(e)); err != nil || back.String() != e.String() {
+		t.Errorf("MathML round trip = %v, %v", back, err)
+	}
+
+	for _, s := range []string{"log(x)", "atan2(y)", "max(x, y, 1)", "sin(x, y)"} {
+		if _, err := gosymbol.Parse(s); err == nil || !strings.Contains(err.Error(), "argument") {
+			t.Errorf("Parse(%q) error = %v, want arity error", s, err)
+		}
+	}
+	if _, err := gosymbol.FromJSON(map[string]interface{}{"type": "func", "name": "max", "arg": map[string]interface{}{"type": "sym", "name": "x"}}); err == nil {
+		t.Error("FromJSON(max with one arg) succeeded, want error")
+	}
+}
+
+func TestRegisteredFunctions(t *testing.T) {
+	names := strings.Join(gosymbol.RegisteredFunctions(), ",")
+	for _, n := range []string{"sin", "cos", "tan", "exp", "ln", "abs", "sinh", "erf", "gamma"} {
+		if !strings.Contains(","+names+",", ","+n+",") {
+			t.Errorf("%s not registered: %s", n, names)
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// MathML
+// ------------------------------------------------------------
+
+func TestParseMathMLPresentation(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{`<math><mi>x</mi><mo>+</mo><mn>1</mn></math>`, "x + 1"},
+		{`<math xmlns="http://www.w3.org/1998/Math/MathML"><mrow><mn>3</mn><mo>&#x2062;</mo><msup><mi>x</mi><mn>2</mn></msup><mo>&#x2212;</mo><mn>2</mn><mi>x</mi></mrow></math>`, "3*x^2 - 2*x"},
+		{`<mfrac><mn>1</mn><mrow><mi>x</mi><mo>+</mo><mn>1</mn></mrow></mfrac>`, "(x + 1)^-1"},
+		{`<msqrt><mi>x</mi></msqrt>`, "x^(1/2)"},
+		{`<mroot><mi>x</mi><mn>3</mn></mroot>`, "x^(1/3)"},
+		{`<mrow><mi>sin</mi><mo>&#x2061;</mo><mi>x</mi></mrow>`, "sin(x)"},
+		{`<mrow><mi>cos</mi><mo>(</mo><mn>2</mn><mi>θ</mi><mo>)</mo></mrow>`, "cos(2*theta)"},
+		{`<mrow><mn>2</mn><mfenced><mrow><mi>x</mi><mo>−</mo><mn>1</mn></mrow></mfenced></mrow>`, "2*(x - 1)"},
+		{`<mrow><msub><mi>x</mi><mn>1</mn></msub><mo>×</mo><mi>y</mi></mrow>`, "x_1*y"},
+		{`<mrow><mo>-</mo><mn>2.5</mn><mi>x</mi></mrow>`, "-5/2*x"},
+	}
+	for _, c := range cases {
+		e, err := gosymbol.ParseMathML(c.in)
+		if err != nil {
+			t.Errorf("ParseMathML(%s): %v", c.in, err)
+			continue
+		}
+		assertStr(t, e.Simplify(), c.want)
+	}
+}
+
+func TestParseMathMLContent(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{`<math><apply><plus/><apply><power/><ci>x</ci><cn>2</cn></apply><cn>1</cn></apply></math>`, "x^2 + 1"},
+		{`<apply><minus/><ci>x</ci></apply>`, "-x"},
+		{`<apply><minus/><ci>x</ci><ci>y</ci></apply>`, "x - y"},
+		{`<apply><times/><cn type="rational">3<sep/>4</cn><ci>x</ci></apply>`, "3/4*x"},
+		{`<cn type="e-notation">1.5<sep/>3</cn>`, "1500"},
+		{`<apply><divide/><ci>x</ci><cn>2</cn></apply>`, "1/2*x"},
+		{`<apply><root/><degree><cn>3</cn></degree><ci>x</ci></apply>`, "x^(1/3)"},
+		{`<apply><arctan/><ci>x</ci></apply>`, "atan(x)"},
+		{`<apply><log/><logbase><cn>2</cn></logbase><ci>x</ci></apply>`, "log(x, 2)"},
+		{`<apply><csymbol>gamma</csymbol><ci>x</ci></apply>`, "gamma(x)"},
+		{`<apply><sin/><apply><divide/><pi/><cn>6</cn></apply></apply>`, "1/2"},
+	}
+	for _, c := range cases {
+		e, err := gosymbol.ParseMathML(c.in)
+		if err != nil {
+			t.Errorf("ParseMathML(%s): %v", c.in, err)
+			continue
+		}
+		assertStr(t, e.Simplify(), c.want)
+	}
+}
+
+func TestParseMathMLErrors(t *testing.T) {
+	bad := []string{
+		``,
+		`<math><mi>x</mi>`,
+		`<math><mo>%</mo></math>`,
+		`<math><mn>1.2.3</mn></math>`,
+		`<math><mtable/></math>`,
+		`<math><mi>x</mi><mo>+</mo></math>`,
+		`<apply><power/><ci>x</ci></apply>`,
+		`<apply><unknownop/><ci>x</ci></apply>`,
+		`<cn type="rational">1<sep/>0</cn>`,
+	}
+	for _, s := range bad {
+		_, err := gosymbol.ParseMathML(s)
+		if err == nil {
+			t.Errorf("ParseMathML(%q) succeeded, want error", s)
+		} else if !strings.HasPrefix(err.Error(), "mathml: ") {
+			t.Errorf("ParseMathML(%q) error %q lacks mathml prefix", s, err)
+		}
+	}
+}
+
+func TestMathMLOutput(t *testing.T) {
+	const head = `<math xmlns="http://www.w3.org/1998/Math/MathML">`
+	for _, c := range []struct {
+		e    gosymbol.Expr
+		want string
+	}{
+		{gosymbol.F(-2, 3), `<mrow><mo>-</mo><mfrac><mn>2</mn><mn>3</mn></mfrac></mrow>`},
+		{gosymbol.S("theta_1"), `<msub><mi>theta</mi><mn>1</mn></msub>`},
+		{gosymbol.S("alpha"), `<mi>α</mi>`},
+	} {
+		if got := gosymbol.MathML(c.e); got != head+c.want+"</math>" {
+			t.Errorf("MathML(%s) = %s", c.e, got)
+		}
+	}
+	for _, s := range []string{
+		"x^2 + 2*x + 1", "sin(x)/2", "sqrt(y)", "x - 3*y", "-x*y",
+		"alpha + theta_1", "pi*x^(1/3)", "exp(-x^2)", "(x + 1)^2", "2/3*x",
+	} {
+		e := mustParse(t, s)
+		back, err := gosymbol.ParseMathML(gosymbol.MathML(e))
+		if err != nil || back.String() != e.String() {
+			t.Errorf("ParseMathML(MathML(%s)) = %v, %v", e, back, err)
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// RPN
+// ------------------------------------------------------------
+
+func TestParseRPN(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"x 2 ^ 3 x * +", "x^2 + 3*x"},
+		{"x 1 + 2 ^", "(x + 1)^2"},
+		{"2 3 4 * +", "14"},
+		{"2 3 + 4 *", "20"},
+		{"x y -", "x - y"},
+		{"x neg", "-x"},
+		{"-3/4 x *", "-3/4*x"},
+		{"1.5e1 .5 +", "31/2"},
+		{"x 2 * sin", "sin(2*x)"},
+		{"x sqrt", "x^(1/2)"},
+	}
+	for _, c := range cases {
+		e, err := gosymbol.ParseRPN(c.in)
+		if err != nil {
+			t.Errorf("ParseRPN(%q): %v", c.in, err)
+			continue
+		}
+		assertStr(t, e.Simplify(), c.want)
+	}
+}
+
+func TestParseRPNErrors(t *testing.T) {
+	cases := []struct {
+		in  string
+		pos int
+	}{
+		{"", 0},
+		{"x +", 2},
+		{"x y", 3},
+		{"sin", 0},
+		{"x 1.2.3 +", 2},
+		{"1/0", 0},
+		{"x %", 2},
+	}
+	for _, c := range cases {
+		_, err := gosymbol.ParseRPN(c.in)
+		if err == nil {
+			t.Errorf("ParseRPN(%q) succeeded, want error", c.in)
+			continue
+		}
+		var pe *gosymbol.ParseError
+		if !asParseError(err, &pe) || pe.Pos != c.pos {
+			t.Errorf("ParseRPN(%q) error %v, want position %d", c.in, err, c.pos)
+		}
+	}
+}
+
+func TestToRPNRoundTrip(t *testing.T) {
+	for _, s := range []string{"3*x^2 + 2*x - 1", "sin(x/2)^-1", "2*pi*x", "-(x + y)*exp(-x)", "x^(1/3) - 5/7"} {
+		e := mustParse(t, s).Simplify()
+		rpn, err := gosymbol.ToRPN(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		back, err := gosymbol.ParseRPN(rpn)
+		if err != nil {
+			t.Fatalf("ParseRPN(%q): %v", rpn, err)
+		}
+		if back.String() != e.String() {
+			t.Errorf("round trip %q -> %q -> %q", e, rpn, back)
+		}
+	}
+	if got, err := gosymbol.ToRPN(mustParse(t, "x + 2*y")); err != nil || got != "x 2 y * +" {
+		t.Errorf("ToRPN = %q, %v", got, err)
+	}
+	// Nodes outside the postfix format are reported, even when nested.
+	for _, e := range []gosymbol.Expr{
+		mustParse(t, "x < 1"),
+		mustParse(t, "piecewise((0, x < 0), (x, otherwise))"),
+		mustParse(t, "sin(integrate(x, x, 0, 1))"),
+		gosymbol.SumOf(mustParse(t, "k"), "k", gosymbol.N(1), gosymbol.N(3)),
+		gosymbol.ProductOf(mustParse(t, "k"), "k", gosymbol.N(1), gosymbol.N(3)),
+		gosymbol.AddOf(x, gosymbol.KroneckerDelta(x, y)),
+		gosymbol.Function("f")(x),
+		gosymbol.Wild("a"),
+	} {
+		if got, err := gosymbol.ToRPN(e); err == nil || !strings.HasPrefix(err.Error(), "rpn: ") {
+			t.Errorf("ToRPN(%s) = %q, %v; want an error", e, got, err)
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// JSON
+// ------------------------------------------------------------
+
+func TestJSONRoundTrip(t *testing.T) {
+	exprs := []gosymbol.Expr{
+		gosymbol.F(3, 4),
+		gosymbol.AddOf(gosymbol.MulOf(gosymbol.N(2), x), gosymbol.N(1)),
+		gosymbol.PowOf(x, gosymbol.F(1, 2)),
+		gosymbol.SinOf(gosymbol.MulOf(x, y)),
+		gosymbol.MulOf(gosymbol.F(1, 2), gosymbol.Pi),
+		gosymbol.PiecewiseOf([]gosymbol.PieceCase{{Value: x, Cond: gosymbol.Cond{Lhs: x, Op: gosymbol.RelGe, Rhs: gosymbol.N(0)}}}, gosymbol.Neg(x)),
+		gosymbol.MulOf(gosymbol.KroneckerDelta(x, y), x),
+		gosymbol.AddOf(gosymbol.Wild("a"), gosymbol.Wild("b", "x", "y")),
+		gosymbol.Diff(gosymbol.MulOf(x, gosymbol.Function("f")(gosymbol.PowOf(x, gosymbol.N(2)))), "x"),
+	}
+	for _, e := range exprs {
+		s, err := gosymbol.ToJSON(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			t.Fatal(err)
+		}
+		back, err := gosymbol.FromJSON(m)
+		if err != nil {
+			t.Fatalf("FromJSON(%s): %v", s, err)
+		}
+		if back.String() != e.String() {
+			t.Errorf("round trip %q -> %q", e, back)
+		}
+	}
+}
+
+func TestFromJSONErrors(t *testing.T) {
+	bad := []string{
+		`{"type":"bogus"}`,
+		`{"type":"num","value":"abc"}`,
+		`{"type":"sym"}`,
+		`{"type":"const","name":"tau"}`,
+		`{"type":"add","terms":[]}`,
+		`{"type":"func","name":"nope","arg":{"type":"sym","name":"x"}}`,
+		`{"type":"function","name":"sin","arg":{"type":"sym","name":"x"}}`,
+		`{"type":"function","name":"f","order":1.5,"arg":{"type":"sym","name":"x"}}`,
+		`{"type":"function","name":"f","order":1e12,"arg":{"type":"sym","name":"x"}}`,
+		`{"type":"function","name":"f","order":-1,"arg":{"type":"sym","name":"x"}}`,
+		`{"type":"pow","base":{"type":"sym","name":"x"}}`,
+		`{"type":"piecewise","cases":[{"value":{"type":"num","value":"1"},"lhs":{"type":"sym","name":"x"},"op":"~","rhs":{"type":"num","value":"0"}}],"otherwise":{"type":"num","value":"0"}}`,
+	}
+	for _, s := range bad {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gosymbol.FromJSON(m); err == nil {
+			t.Errorf("FromJSON(%s) succeeded, want error", s)
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// Expression store
+// ------------------------------------------------------------
+
+func TestExprStore(t *testing.T) {
+	s := gosymbol.NewExprStore()
+	id1, err := s.Put(mustParse(t, "x + x + 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, _ := s.Put(mustParse(t, "1 + 2*x"))
+	if id1 != id2 || s.Len() != 1 {
+		t.Errorf("equivalent canonical forms stored separately: %s, %s (len %d)", id1, id2, s.Len())
+	}
+	if id1 != gosymbol.ExprID(mustParse(t, "2*x + 1")) || len(id1) != 16 {
+		t.Errorf("ExprID mismatch: %s", id1)
+	}
+	e, ok := s.Get(id1)
+	if !ok {
+		t.Fatal("Get failed")
+	}
+	assertStr(t, e, "2*x + 1")
+	if id3, _ := s.Put(x); id3 == id1 {
+		t.Error("distinct expressions share an ID")
+	}
+	if _, ok := s.Get("0000000000000000"); ok {
+		t.Error("Get of unknown ID succeeded")
+	}
+}
+
+func TestExprStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+	s, err := gosymbol.OpenExprStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Put(mustParse(t, "sin(x)^2/3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := gosymbol.OpenExprStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Len() != 0 {
+		t.Errorf("reopened store preloaded %d entries", reopened.Len())
+	}
+	e, ok := reopened.Get(id)
+	if !ok {
+		t.Fatalf("Get(%s) after reopen failed", id)
+	}
+	assertStr(t, e, "1/3*sin(x)^2")
+	if _, ok := reopened.Get("../" + id); ok {
+		t.Error("Get accepted a path")
+	}
+
+	// A file whose content does not hash to its name is not loaded.
+	other, _ := gosymbol.OpenExprStore(dir)
+	data, _ := gosymbol.ToJSON(x)
+	if err := os.WriteFile(filepath.Join(dir, id+".json"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := other.Get(id); ok {
+		t.Errorf("Get(%s) of a tampered file = %s", id, e)
+	}
+}
+
+func TestStoreRecallTools(t *testing.T) {
+	resp := toolCall(t, "store", `{"expr": "x + x + 1"}`)
+	if resp.Error != "" || resp.String != gosymbol.ExprID(mustParse(t, "2*x + 1")) {
+		t.Fatalf("store = %+v", resp)
+	}
+	if r := toolCall(t, "recall", `{"id": "`+resp.String+`"}`); r.Error != "" || r.String != "2*x + 1" {
+		t.Errorf("recall = %+v", r)
+	}
+	if r := toolCall(t, "recall", `{"id": "0000000000000000"}`); r.Error == "" {
+		t.Errorf("recall of an unknown ID = %+v", r)
+	}
+
+	// An engine with its own store does not share IDs with the process.
+	s := gosymbol.NewExprStore()
+	en, err := gosymbol.NewEngine(gosymbol.EngineConfig{Store: s, Assumptions: []gosymbol.Expr{mustParse(t, "y > 0")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := en.HandleToolCall(gosymbol.ToolRequest{Tool: "store", Params: map[string]interface{}{"expr": "y^3"}})
+	if e, ok := s.Get(r.String); r.Error != "" || !ok {
+		t.Fatalf("engine store = %+v", r)
+	} else {
+		assertStr(t, e, "y^3")
+	}
+	if r := toolCall(t, "recall", `{"id": "`+r.String+`"}`); r.Error == "" {
+		t.Errorf("process store recalled an engine's ID: %+v", r)
+	}
+	if r := en.HandleToolCall(gosymbol.ToolRequest{Tool: "recall", Params: map[string]interface{}{"id": resp.String}}); r.Error == "" {
+		t.Errorf("engine recalled a process ID: %+v", r)
+	}
+}
+
+func TestWorksheet(t *testing.T) {
+	w := gosymbol.NewWorksheet()
+	for _, c := range []struct{ name, input, want string }{
+		{"f", "x^2 + a", "x^2 + a"},
+		{"", "f + 1", "x^2 + a + 1"},
+		{"a", "3", "3"},
+		{"h", "f*a", "3*(x^2 + a)"},
+	} {
+		r, err := w.Eval(c.name, c.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStr(t, r, c.want)
+	}
+	if r, ok := w.Lookup("out2"); !ok || r.String() != "x^2 + a + 1" {
+		t.Errorf("out2 = %v, %v", r, ok)
+	}
+	for _, name := range []string{"2x", "pi", "e"} {
+		if _, err := w.Eval(name, "1"); err == nil {
+			t.Errorf("expected an error for the name %q", name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "session.json")
+	if err := w.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	back, err := gosymbol.LoadWorksheet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(back.Entries()), len(w.Entries()); got != want {
+		t.Fatalf("loaded %d entries, want %d", got, want)
+	}
+	for i, en := range back.Entries() {
+		if old := w.Entries()[i]; en.Name != old.Name || en.Input != old.Input || en.Result.String() != old.Result.String() {
+			t.Errorf("entry %d = %+v, want %+v", i, en, old)
+		}
+	}
+	if r, err := back.Eval("", "f + a"); err != nil || r.String() != "x^2 + a + 3" {
+		t.Errorf("resumed eval = %v, %v", r, err)
+	}
+
+	// An entry without a result is evaluated from its input.
+	var ws gosymbol.Worksheet
+	if err := json.Unmarshal([]byte(`{"format": "gosymbol-worksheet", "version": 1, "entries": [{"name": "k", "input": "2 + 2"}]}`), &ws); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := ws.Lookup("k"); !ok || r.String() != "4" {
+		t.Errorf("k = %v, %v", r, ok)
+	}
+	if err := json.Unmarshal([]byte(`{"format": "other", "version": 1}`), &ws); err == nil {
+		t.Error("expected an error for a foreign format")
+	}
+}
+
+func TestRecorderReplay(t *testing.T) {
+	rec := gosymbol.NewRecorder(nil)
+	d := rec.HandleToolCall(gosymbol.ToolRequest{Tool: "diff", Params: map[string]interface{}{"expr": "x^3 + sin(x)", "var": "x"}})
+	if d.Error != "" {
+		t.Fatal(d.Error)
+	}
+	rec.HandleToolCall(gosymbol.ToolRequest{Tool: "integrate", Params: map[string]interface{}{"expr": d.String, "var": "x"}})
+	rec.HandleToolCall(gosymbol.ToolRequest{Tool: "no_such_tool"})
+	steps := rec.Steps()
+	if len(steps) != 3 || steps[1].Inputs["expr"] != 1 || steps[0].Inputs != nil || steps[2].Response.Error == "" {
+		t.Fatalf("steps = %+v", steps)
+	}
+	data, err := rec.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := gosymbol.Replay(data, nil)
+	if err != nil || len(replayed) != 3 {
+		t.Fatalf("Replay = %d steps, %v", len(replayed), err)
+	}
+	if replayed[1].Response.String != steps[1].Response.String || replayed[1].Digest != steps[1].Digest {
+		t.Errorf("replayed step 2 = %+v", replayed[1])
+	}
+
+	// A handler that computes something else is caught at its first step.
+	other := func(req gosymbol.ToolRequest) gosymbol.ToolResponse {
+		if req.Tool == "integrate" {
+			req.Params["var"] = "y"
+		}
+		return gosymbol.HandleToolCall(req)
+	}
+	if replayed, err := gosymbol.Replay(data, other); err == nil || len(replayed) != 2 || !strings.Contains(err.Error(), "step 2 (integrate)") {
+		t.Errorf("Replay with another handler = %d steps, %v", len(replayed), err)
+	}
+
+	// A tampered log does not verify.
+	tampered := strings.Replace(string(data), `"string": "3*x^2 + cos(x)"`, `"string": "3*x^2"`, 1)
+	if tampered == string(data) {
+		t.Fatal("log does not contain the diff result")
+	}
+	if _, err := gosymbol.Replay([]byte(tampered), nil); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Errorf("Replay of tampered log: %v", err)
+	}
+	if _, err := gosymbol.Replay([]byte(`{"format": "other", "version": 1}`), nil); err == nil {
+		t.Error("Replay accepted a foreign format")
+	}
+
+	// Streamed calls are recorded with their final response, and a stream
+	// the client stopped replays stopped at the same point.
+	rec = gosymbol.NewStreamRecorder(nil)
+	taylor := gosymbol.ToolRequest{Tool: "taylor", Params: map[string]interface{}{"expr": "sin(x)", "var": "x", "order": 7}}
+	n := 0
+	full := rec.HandleToolCallStream(taylor, func(gosymbol.ToolResponse) bool { n++; return true })
+	stopped := rec.HandleToolCallStream(taylor, func(gosymbol.ToolResponse) bool { return false })
+	steps = rec.Steps()
+	if n != 4 || len(steps) != 2 || steps[0].Stopped != 0 || steps[1].Stopped != 1 ||
+		steps[0].Response.String != full.String || steps[1].Response.String != "x" || stopped.String != "x" {
+		t.Fatalf("%d partials, streamed steps = %+v", n, steps)
+	}
+	if data, err = rec.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if replayed, err := gosymbol.Replay(data, nil); err != nil || len(replayed) != 2 {
+		t.Errorf("Replay of streamed calls = %d steps, %v", len(replayed), err)
+	}
+}
+
+// ------------------------------------------------------------
+// MCP tools
+// ------------------------------------------------------------
+
+func toolCall(t *testing.T, tool string, params string) gosymbol.ToolResponse {
+	t.Helper()
+	var p map[string]interface{}
+	if err := json.Unmarshal([]byte(params), &p); err != nil {
+		t.Fatal(err)
+	}
+	return gosymbol.HandleToolCall(gosymbol.ToolRequest{Tool: tool, Params: p})
+}
+
+func TestHandleToolCall(t *testing.T) {
+	cases := []struct {
+		tool, params, want string
+	}{
+		{"simplify", `{"expr": "x + x"}`, "2*x"},
+		{"diff", `{"expr": {"type":"pow","base":{"type":"sym","name":"x"},"exp":{"type":"num","value":"3"}}, "var": "x"}`, "3*x^2"},
+		{"integrate", `{"expr": "x^2", "var": "x"}`, "1/3*x^3"},
+		{"expand", `{"expr": "(x+1)^2"}`, "x^2 + 2*x + 1"},
+		{"factor", `{"expr": "6*x^2 + 11*x + 3"}`, "(2*x + 3)*(3*x + 1)"},
+		{"substitute", `{"expr": "1/3*x^3", "var": "x", "value": {"type":"num","value":"1"}}`, "1/3"},
+		{"to_latex", `{"expr": "x^2"}`, "x^2"},
+		{"free_symbols", `{"expr": "y*x + z"}`, "x, y, z"},
+		{"fingerprint", `{"expr": "x^2 + 2*x + 1"}`, "f884a913c751d2ab"},
+		{"degree", `{"expr": "x^3 + x", "var": "x"}`, "3"},
+		{"solve_linear", `{"a": {"type":"num","value":"5"}, "b": {"type":"num","value":"-10"}}`, "2"},
+		{"solve_quadratic", `{"a": "1", "b": "-3", "c": "2"}`, "1, 2"},
+		{"solve_linear", `{"a": "k", "b": "1"}`, "-k^-1 if k != 0"},
+		{"taylor", `{"expr": "exp(x)", "var": "x", "order": 2}`, "1/2*x^2 + x + 1"},
+		{"solve_system", `{"equations": ["x + y = 3", "x - y - 1"], "vars": ["x", "y"]}`, "x = 2, y = 1"},
+		{"groebner", `{"polys": ["x^2 + y^2 = 1", "x = y"], "order": ["x", "y"]}`, "2*y^2 - 1, x - y"},
+		{"matrix", `{"op": "det", "a": [["a", "b"], ["c", "d"]]}`, "a*d - b*c"},
+		{"matrix", `{"op": "mul", "a": [[1, 2], [3, 4]], "b": [["x"], [{"type": "sym", "name": "y"}]]}`, "[[x + 2*y], [3*x + 4*y]]"},
+		{"matrix", `{"op": "rank", "a": [[1, 2], [2, 4]]}`, "1"},
+		{"matrix", `{"op": "inverse", "a": "[[1, 2], [3, 4]]"}`, "[[-2, 1], [3/2, -1/2]]"},
+		{"matrix", `{"op": "eigen", "a": [[2, 1], [1, 2]]}`, "λ1 = 1, v1 = (1, -1)\nλ2 = 3, v2 = (1, 1)"},
+		{"matrix", `{"op": "transpose", "a": "[x, y]"}`, "[[x, y]]"},
+		{"matrix", `{"op": "det", "a": "transpose([[a, b], [c, d]])"}`, "a*d - b*c"},
+		{"worksheet_eval", `{"input": "x^2", "name": "f"}`, "f = x^2"},
+		{"diff", `{"expr": "tool_u'(x)", "var": "x", "functions": ["tool_u"]}`, "tool_u''(x)"},
+		{"simplify", `{"expr": {"type":"function","name":"tool_u","order":1000,"arg":{"type":"sym","name":"x"}}}`, "Derivative(tool_u(x), (x, 1000))"},
+	}
+	for _, c := range cases {
+		resp := toolCall(t, c.tool, c.params)
+		if resp.Error != "" {
+			t.Errorf("%s: error %q", c.tool, resp.Error)
+			continue
+		}
+		if resp.String != c.want {
+			t.Errorf("%s: got %q, want %q", c.tool, resp.String, c.want)
+		}
+	}
+
+	// Structured results carry the JSON encoding of each expression.
+	resp := toolCall(t, "solve_system", `{"equations": ["2*x = 1"], "vars": ["x"]}`)
+	if m, ok := resp.Result.(map[string]interface{}); !ok {
+		t.Errorf("solve_system result = %#v", resp.Result)
+	} else if e, err := gosymbol.FromJSON(m["x"].(map[string]interface{})); err != nil || e.String() != "1/2" {
+		t.Errorf("x = %v, %v", e, err)
+	}
+	resp = toolCall(t, "worksheet_eval", `{"input": "x + 1", "name": "f"}`)
+	ws, err := json.Marshal(resp.Result.(map[string]interface{})["worksheet"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp = toolCall(t, "worksheet_eval", `{"input": "f^2", "worksheet": `+string(ws)+`}`); resp.String != "out2 = (x + 1)^2" {
+		t.Errorf("worksheet_eval with a worksheet = %q, error %q", resp.String, resp.Error)
+	}
+	resp = toolCall(t, "matrix", `{"op": "adjugate", "a": [[1, 2], [3, 4]]}`)
+	if rows, ok := resp.Result.([]interface{}); !ok || len(rows) != 2 || len(rows[0].([]interface{})) != 2 {
+		t.Errorf("adjugate result = %#v", resp.Result)
+	}
+}
+
+func TestHandleToolCallErrors(t *testing.T) {
+	cases := []struct {
+		tool, params, wantPrefix string
+	}{
+		{"nope", `{}`, "unknown tool"},
+		{"diff", `{"expr": "x"}`, "missing param: var"},
+		{"simplify", `{}`, "missing param: expr"},
+		{"integrate", `{"expr": "sin(x^2)", "var": "x"}`, "integration failed"},
+		{"solve_quadratic", `{"a": "1", "b": "0", "c": "1"}`, "complex roots"},
+		{"simplify", `{"expr": "1.2.3"}`, "parse error"},
+		{"taylor", `{"expr": "x", "var": "x", "order": -1}`, "param order"},
+		{"simplify", `{"expr": "x", "max_nodes": 1.5}`, "param max_nodes"},
+		{"solve_system", `{"equations": ["x + y = 3"], "vars": ["x", "y"]}`, "system: 1 equations"},
+		{"solve_system", `{"equations": ["x < 3"], "vars": ["x"]}`, "param equations[0]"},
+		{"solve_system", `{"equations": "x = 3", "vars": ["x"]}`, "param equations"},
+		{"matrix", `{"op": "det", "a": [[1, 2], [3]]}`, "param a"},
+		{"matrix", `{"op": "mul", "a": [[1]]}`, "missing param: b"},
+		{"matrix", `{"op": "invert", "a": [[1]]}`, "param op"},
+		{"matrix", `{"op": "inverse", "a": "[[1, 2], [2, 4]]"}`, "matrix: singular"},
+		{"matrix", `{"op": "det", "a": "[[1, 2], [3]"}`, "param a"},
+		{"simplify", `{"expr": {"type":"function","name":"f","order":1e12,"arg":{"type":"sym","name":"x"}}}`, "function: order"},
+		{"simplify", `{"expr": "tool_u(x)"}`, "parse error"},
+		{"simplify", `{"expr": "x", "functions": "f"}`, "param functions"},
+	}
+	for _, c := range cases {
+		resp := toolCall(t, c.tool, c.params)
+		if !strings.HasPrefix(resp.Error, c.wantPrefix) {
+			t.Errorf("%s %s: error %q, want prefix %q", c.tool, c.params, resp.Error, c.wantPrefix)
+		}
+	}
+}
+
+func TestHandleToolCallStream(t *testing.T) {
+	stream := func(tool, params string, limit int) ([]gosymbol.ToolResponse, gosymbol.ToolResponse) {
+		var p map[string]interface{}
+		if err := json.Unmarshal([]byte(params), &p); err != nil {
+			t.Fatal(err)
+		}
+		var partials []gosymbol.ToolResponse
+		final := gosymbol.HandleToolCallStream(gosymbol.ToolRequest{Tool: tool, Params: p}, func(r gosymbol.ToolResponse) bool {
+			partials = append(partials, r)
+			return len(partials) < limit
+		})
+		return partials, final
+	}
+
+	partials, final := stream("taylor", `{"expr": "sin(x)", "var": "x", "order": 5}`, 100)
+	if len(partials) != 3 || partials[1].String != "-1/6*x^3 + x" || final.String != "1/120*x^5 - 1/6*x^3 + x" {
+		t.Errorf("taylor: %d partials, final %q", len(partials), final.String)
+	}
+	partials, final = stream("taylor", `{"expr": "sin(x)", "var": "x", "order": 5}`, 2)
+	if len(partials) != 2 || final.String != "-1/6*x^3 + x" {
+		t.Errorf("taylor stopped after 2: %d partials, final %q", len(partials), final.String)
+	}
+
+	partials, final = stream("find_root", `{"expr": "x^2 - 2", "var": "x", "x0": 1}`, 100)
+	if len(partials) < 5 || final.String != partials[len(partials)-1].String || !strings.HasPrefix(final.String, "1.41421356237309") {
+		t.Errorf("find_root: %d partials, final %q", len(partials), final.String)
+	}
+	partials, final = stream("find_root", `{"expr": "x^2 - 2", "var": "x", "x0": 1}`, 2)
+	if len(partials) != 2 || final.String != "1.5" {
+		t.Errorf("find_root stopped after 2: %d partials, final %q", len(partials), final.String)
+	}
+
+	partials, final = stream("ode_solve", `{"expr": "-y", "t0": 0, "y0": 1, "t1": "1", "steps": 10}`, 100)
+	if len(partials) != 10 || len(final.Result.([]map[string]float64)) != 11 || !strings.HasPrefix(final.String, "0.36787") {
+		t.Errorf("ode_solve: %d partials, final %q", len(partials), final.String)
+	}
+
+	partials, final = stream("simplify", `{"expr": "x + x"}`, 100)
+	if len(partials) != 0 || final.String != "2*x" {
+		t.Errorf("simplify: %d partials, final %q", len(partials), final.String)
+	}
+	if resp := toolCall(t, "ode_solve", `{"expr": "y", "t0": 0, "y0": 1}`); resp.Error != "missing param: t1" {
+		t.Errorf("ode_solve without t1: error %q", resp.Error)
+	}
+
+	// An engine streams under its limits.
+	en, err := gosymbol.NewEngine(gosymbol.EngineConfig{MaxDegree: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	emit := func(gosymbol.ToolResponse) bool { n++; return true }
+	req := gosymbol.ToolRequest{Tool: "taylor", Params: map[string]interface{}{"expr": "sin(x)", "var": "x", "order": 5.0}}
+	if final := en.HandleToolCallStream(req, emit); n != 3 || final.String != "1/120*x^5 - 1/6*x^3 + x" {
+		t.Errorf("engine taylor: %d partials, final %+v", n, final)
+	}
+	req.Params["expr"] = "x^6 + sin(x)"
+	if final := en.HandleToolCallStream(req, emit); n != 3 || !strings.HasPrefix(final.Error, "engine: polynomial degree 6") {
+		t.Errorf("engine taylor past its degree limit: %d partials, final %+v", n, final)
+	}
+}
+
+func TestHandleToolCallSteps(t *testing.T) {
+	resp := toolCall(t, "diff_steps", `{"expr": "x^2 + x", "var": "x"}`)
+	if resp.Error != "" {
+		t.Fatal(resp.Error)
+	}
+	want := "power: x^2 -> 2*x\nidentity: x -> 1\nsum: x^2 + x -> 2*x + 1"
+	if resp.String != want {
+		t.Errorf("String = %q, want %q", resp.String, want)
+	}
+	steps, ok := resp.Result.([]map[string]string)
+	if !ok || len(steps) != 3 || steps[2]["rule"] != "sum" || steps[2]["after"] != "2*x + 1" {
+		t.Errorf("Result = %#v", resp.Result)
+	}
+
+	resp = toolCall(t, "integrate_steps", `{"expr": "2*x", "var": "x"}`)
+	if resp.Error != "" || resp.String != "power: x -> 1/2*x^2\nconstant multiple: 2*x -> x^2" {
+		t.Errorf("integrate_steps = %+v", resp)
+	}
+	if resp = toolCall(t, "integrate_steps", `{"expr": "sin(x^2)", "var": "x"}`); resp.Error == "" {
+		t.Error("integrate_steps of sin(x^2) should fail")
+	}
+	resp = toolCall(t, "solve_steps", `{"lhs": "2*x", "rhs": "6", "var": "x"}`)
+	if resp.Error != "" || resp.String != "move terms: 2*x - 6 = 0\nsubtract constant: 2*x = 6\ndivide by coefficient: x = 3" {
+		t.Errorf("solve_steps = %+v", resp)
+	}
+	if resp = toolCall(t, "solve_steps", `{"lhs": "x^2 + 1", "var": "x"}`); resp.Error == "" || resp.String == "" {
+		t.Errorf("solve_steps with complex roots = %+v", resp)
+	}
+	resp = toolCall(t, "simplify_steps", `{"expr": "x + x"}`)
+	if resp.Error != "" || resp.String != "combine like terms: x + x -> 2*x" || resp.LaTeX != "x + x = 2 x" {
+		t.Errorf("simplify_steps = %+v", resp)
+	}
+}
+
+func TestMCPToolSpec(t *testing.T) {
+	var spec struct {
+		Tools []struct {
+			Name        string                 `json:"name"`
+			InputSchema map[string]interface{} `json:"inputSchema"`
+		} `json:"tools"`
+	}
+	if err := json.Unmarshal([]byte(gosymbol.MCPToolSpec()), &spec); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, tool := range spec.Tools {
+		names[tool.Name] = true
+	}
+	for _, n := range []string{"simplify", "simplify_steps", "diff", "diff_steps", "integrate", "integrate_steps", "expand", "substitute", "to_latex", "free_symbols", "fingerprint", "degree", "solve_linear", "solve_quadratic", "solve_steps", "taylor", "list_formulas", "solve_formula", "solve_system", "groebner", "matrix", "worksheet_eval"} {
+		if !names[n] {
+			t.Errorf("tool %q missing from spec", n)
+		}
+	}
+}
+
+// ------------------------------------------------------------
+// Engine
+// ------------------------------------------------------------
+
+func TestEngine(t *testing.T) {
+	pos, err := gosymbol.NewEngine(gosymbol.EngineConfig{
+		Assumptions: []gosymbol.Expr{mustParse(t, "x > 0")},
+		CacheSize:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := gosymbol.NewEngine(gosymbol.EngineConfig{MaxComplexity: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same input simplifies differently under different assumptions.
+	e := mustParse(t, "piecewise((x, x > 0), (-x, otherwise)) + (x < -1)")
+	r, partial, err := pos.Simplify(e)
+	if err != nil || partial {
+		t.Fatalf("Simplify: %v, %v", partial, err)
+	}
+	assertStr(t, r, "x")
+	if _, _, err := plain.Simplify(e); err == nil {
+		t.Error("expected the complexity limit to reject the input")
+	}
+	d, err := pos.Diff(mustParse(t, "x*(x >= 0)"), "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStr(t, d, "1")
+	s, err := pos.SolveInequality(mustParse(t, "x^2 < 4"), "x")
+	if err != nil || s.String() != "(0, 2)" {
+		t.Errorf("SolveInequality = %v, %v", s, err)
+	}
+
+	// Results are cached by structure.
+	if _, _, err := pos.Simplify(e); err != nil {
+		t.Fatal(err)
+	}
+	if hits, misses := pos.CacheStats(); hits != 1 || misses != 1 {
+		t.Errorf("CacheStats = %d, %d", hits, misses)
+	}
+
+	hp, err := gosymbol.NewEngine(gosymbol.EngineConfig{Prec: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, err := hp.Evalf(mustParse(t, "x/3"), map[string]*big.Float{"x": big.NewFloat(1)})
+	if err != nil || third.Prec() != 200 || third.Text('g', 40) != "0.3333333333333333333333333333333333333333" {
+		t.Errorf("Evalf = %v, %v", third, err)
+	}
+
+	if err := gosymbol.RegisterFunction(gosymbol.FuncDef{Name: "engine_sq", Eval: func(v float64) float64 { return v * v }}); err != nil {
+		t.Fatal(err)
+	}
+	strict, err := gosymbol.NewEngine(gosymbol.EngineConfig{Functions: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strict.Parse("engine_sq(x) + sin(x)"); err == nil {
+		t.Error("expected a disabled function to be rejected")
+	}
+	if _, err := strict.Parse("sin(x) + exp(x) + atan2(y, x) + max(x, 1)"); err != nil {
+		t.Errorf("built-in functions rejected: %v", err)
+	}
+	if sq, err := gosymbol.NewEngine(gosymbol.EngineConfig{Functions: []string{"engine_sq"}}); err != nil {
+		t.Fatal(err)
+	} else if _, err := sq.Parse("engine_sq(sin(x))"); err != nil {
+		t.Errorf("enabled function rejected: %v", err)
+	}
+	if _, err := plain.Parse("engine_sq(x) + sin(x)"); err != nil {
+		t.Error(err)
+	}
+
+	// Every kind of param that holds expressions is checked.
+	big := "(x + 1)^2*(y + 1)^2*(z + 1)"
+	for _, c := range []struct{ tool, params string }{
+		{"expand", `{"expr": "` + big + `"}`},
+		{"solve_system", `{"equations": ["x = 1", "` + big + ` = 0"], "vars": ["x", "y"]}`},
+		{"groebner", `{"polys": ["` + big + `"]}`},
+		{"matrix", `{"op": "det", "a": [["1", "` + big + `"], ["0", "1"]]}`},
+		{"matrix", `{"op": "det", "a": "[[1, ` + big + `], [0, 1]]"}`},
+		{"worksheet_eval", `{"input": "` + big + `"}`},
+		{"solve_formula", `{"name": "ohms_law", "knowns": {"V": "` + big + `", "R": 4}}`},
+	} {
+		var p map[string]interface{}
+		if err := json.Unmarshal([]byte(c.params), &p); err != nil {
+			t.Fatal(err)
+		}
+		resp := plain.HandleToolCall(gosymbol.ToolRequest{Tool: c.tool, Params: p})
+		if !strings.HasPrefix(resp.Error, "engine: expression complexity") {
+			t.Errorf("%s %s: tool error = %q", c.tool, c.params, resp.Error)
+		}
+	}
+	if resp := plain.HandleToolCall(gosymbol.ToolRequest{Tool: "groebner", Params: map[string]interface{}{"polys": []interface{}{"x*y - 1", "x - y"}}}); resp.Error != "" {
+		t.Errorf("groebner within limits: %s", resp.Error)
+	}
+
+	for _, bad := range []string{"x*y > 0", "sin(x) > 0"} {
+		if _, err := gosymbol.NewEngine(gosymbol.EngineConfig{Assumptions: []gosymbol.Expr{mustParse(t, bad)}}); err == nil {
+			t.Errorf("assumption %s: expected an error", bad)
+		}
+	}
+	if _, err := gosymbol.NewEngine(gosymbol.EngineConfig{Assumptions: []gosymbol.Expr{mustParse(t, "x > 1"), mustParse(t, "x < 0")}}); err == nil {
+		t.Error("expected contradictory assumptions to be rejected")
+	}
+}
+
+func TestEngineAssumptions(t *testing.T) {
+	var a gosymbol.Assumptions
+	src := `{"symbols": {"x": ["positive"], "n": ["natural"]}, "relations": ["0 <= t <= 1"]}`
+	if err := json.Unmarshal([]byte(src), &a); err != nil {
+		t.Fatal(err)
+	}
+	base, err := gosymbol.NewEngine(gosymbol.EngineConfig{CacheSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	en, err := base.WithAssumptions(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ in, want string }{
+		{"sin(pi*n) + cos(pi*n)", "(-1)^n"},
+		{"cos(2*pi*n) + tan(pi*(n + 1))", "1"},
+		{"(-1)^(2*n + 1)", "-1"},
+		{"(y^(1/2))^(2*n)", "y^n"},
+		{"(n > 1/2) + (t <= 1) + (x > 0)", "3"},
+		{"piecewise((0, n < 1), (1, otherwise))", "1"},
+	} {
+		r, _, err := en.Simplify(mustParse(t, c.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStr(t, r, c.want)
+	}
+	if s, _ := en.Assumed("n"); s.String() != "[1, oo)" {
+		t.Errorf("Assumed(n) = %s", s)
+	}
+	if r, _, _ := base.Simplify(mustParse(t, "sin(pi*n)")); r.String() != "sin(n*pi)" {
+		t.Errorf("base engine: sin(pi*n) = %s", r)
+	}
+
+	steps, r, err := en.SolveSteps(gosymbol.Eq(mustParse(t, "x^2 - x"), gosymbol.N(6)), "x")
+	if err != nil || fmt.Sprint(r.Solutions) != "[3]" || steps[len(steps)-1].String() != "assumptions: x = 3" {
+		t.Errorf("SolveSteps = %v, %v, %v", steps, r.Solutions, err)
+	}
+	if _, r, err := en.SolveSteps(gosymbol.Eq(mustParse(t, "2*n"), gosymbol.N(3)), "n"); err != nil || len(r.Solutions) != 0 {
+		t.Errorf("SolveSteps(2*n = 3) = %v, %v", r.Solutions, err)
+	}
+
+	// Exported assumptions read back into an equivalent engine.
+	b, err := json.Marshal(en.Assumptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back gosymbol.Assumptions
+	if err := json.Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	again, err := base.WithAssumptions(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"n", "t", "x"} {
+		s1, _ := en.Assumed(name)
+		s2, _ := again.Assumed(name)
+		if s1.String() != s2.String() {
+			t.Errorf("round trip: Assumed(%s) = %s, want %s", name, s2, s1)
+		}
+	}
+	if got := again.Config().Integers; fmt.Sprint(got) != "[n]" {
+		t.Errorf("round trip: Integers = %v", got)
+	}
+
+	for _, bad := range []gosymbol.Assumptions{
+		{Symbols: map[string][]string{"x": {"prime"}}},
+		{Symbols: map[string][]string{"x": {"positive", "nonpositive"}}},
+		{Symbols: map[string][]string{"k": {"integer"}}, Relations: []gosymbol.Expr{mustParse(t, "1/3 < k < 2/3")}},
+	} {
+		if _, err := base.WithAssumptions(bad); err == nil {
+			t.Errorf("WithAssumptions(%v): expected an error", bad)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"relations": ["x >"]}`), &a); err == nil {
+		t.Error("expected a malformed relation to be rejected")
+	}
+
+	// Tool calls take the same JSON as an "assumptions" param.
+	call := func(tool string, params map[string]interface{}) gosymbol.ToolResponse {
+		var raw map[string]interface{}
+		if err := json.Unmarshal([]byte(src), &raw); err != nil {
+			t.Fatal(err)
+		}
+		params["assumptions"] = raw
+		return gosymbol.HandleToolCall(gosymbol.ToolRequest{Tool: tool, Params: params})
+	}
+	if resp := call("simplify", map[string]interface{}{"expr": "cos(pi*n)^2 + (x >= 0)"}); resp.Error != "" || resp.String != "2" {
+		t.Errorf("simplify = %+v", resp)
+	}
+	if resp := call("diff", map[string]interface{}{"expr": "x*sin(pi*n)", "var": "x"}); resp.String != "0" {
+		t.Errorf("diff = %+v", resp)
+	}
+	if resp := call("solve_steps", map[string]interface{}{"lhs": "x^2", "rhs": "4", "var": "x"}); !strings.HasSuffix(resp.String, "assumptions: x = 2") {
+		t.Errorf("solve_steps = %+v", resp)
+	}
+	resp := gosymbol.HandleToolCall(gosymbol.ToolRequest{Tool: "simplify", Params: map[string]interface{}{"expr": "x", "assumptions": "x > 0"}})
+	if !strings.HasPrefix(resp.Error, "param assumptions") {
+		t.Errorf("error = %q", resp.Error)
+	}
+}
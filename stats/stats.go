@@ -0,0 +1,1036 @@
+// Package stats provides continuous and discrete probability
+// distributions with symbolic parameters and an algebra of independent
+// random variables.
+//
+// Densities, distribution functions and moment generating functions are
+// gosymbol expressions. Sums and scalar multiples of independent Normal,
+// Uniform, Exponential and Gamma variables reduce to a known family when
+// one applies; otherwise the result is a Convolution whose density is the
+// convolution integral, left as a gosymbol.Integral when it has no closed
+// form.
+//
+// Discrete distributions have closed-form moments and moment generating
+// functions; Expect and Moment sum other expectations from the PMF.
+package stats
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/njchilds90/gosymbol"
+)
+
+// Dist is a continuous probability distribution.
+type Dist interface {
+	// PDF returns the density at x. It is valid on Support; outside the
+	// support the density is 0.
+	PDF(x gosymbol.Expr) gosymbol.Expr
+	// CDF returns P(X <= x) for x in Support.
+	CDF(x gosymbol.Expr) gosymbol.Expr
+	// MGF returns the moment generating function E[exp(t X)].
+	MGF(t gosymbol.Expr) gosymbol.Expr
+	Mean() gosymbol.Expr
+	Variance() gosymbol.Expr
+	// Support returns the interval carrying the density. The ends may be
+	// gosymbol.Inf or -Inf.
+	Support() (lo, hi gosymbol.Expr)
+	String() string
+}
+
+// ============================================================
+// Helpers
+// ============================================================
+
+var (
+	zero    = gosymbol.N(0)
+	one     = gosymbol.N(1)
+	two     = gosymbol.N(2)
+	half    = gosymbol.F(1, 2)
+	negInf  = gosymbol.Neg(gosymbol.Inf)
+	sqrt2   = gosymbol.SqrtOf(two)
+	sqrt2pi = gosymbol.SqrtOf(gosymbol.MulOf(two, gosymbol.Pi))
+)
+
+func add(a ...gosymbol.Expr) gosymbol.Expr { return gosymbol.AddOf(a...) }
+func mul(a ...gosymbol.Expr) gosymbol.Expr { return gosymbol.MulOf(a...) }
+func neg(a gosymbol.Expr) gosymbol.Expr    { return gosymbol.Neg(a) }
+func sub(a, b gosymbol.Expr) gosymbol.Expr { return add(a, neg(b)) }
+func sq(a gosymbol.Expr) gosymbol.Expr     { return gosymbol.PowOf(a, two) }
+func div(a, b gosymbol.Expr) gosymbol.Expr {
+	return mul(a, gosymbol.PowOf(b, gosymbol.N(-1)))
+}
+
+// same reports whether a - b simplifies to 0.
+func same(a, b gosymbol.Expr) bool {
+	n, ok := gosymbol.Expand(sub(a, b)).(*gosymbol.Num)
+	return ok && n.IsZero()
+}
+
+func isInf(e gosymbol.Expr, sign int) bool {
+	if sign > 0 {
+		return e.String() == gosymbol.Inf.String()
+	}
+	return e.String() == negInf.String()
+}
+
+// sign returns the sign of e when it evaluates to a number.
+func sign(e gosymbol.Expr) (int, bool) {
+	n, ok := e.Simplify().Eval()
+	if !ok {
+		return 0, false
+	}
+	return n.Sign(), true
+}
+
+// fresh returns a symbol name that is free in none of es.
+func fresh(base string, es ...gosymbol.Expr) string {
+	name := base
+	for k := 1; ; k++ {
+		clash := false
+		for _, e := range es {
+			for _, s := range gosymbol.FreeSymbols(e) {
+				clash = clash || s == name
+			}
+		}
+		if !clash {
+			return name
+		}
+		name = fmt.Sprintf("%s%d", base, k)
+	}
+}
+
+// ============================================================
+// Distributions
+// ============================================================
+
+// Normal is the normal distribution with mean Mu and standard deviation
+// Sigma.
+type Normal struct {
+	Mu, Sigma gosymbol.Expr
+}
+
+func (d Normal) PDF(x gosymbol.Expr) gosymbol.Expr {
+	z := div(sub(x, d.Mu), d.Sigma)
+	return div(gosymbol.ExpOf(mul(gosymbol.F(-1, 2), sq(z))), mul(d.Sigma, sqrt2pi)).Simplify()
+}
+
+func (d Normal) CDF(x gosymbol.Expr) gosymbol.Expr {
+	z := div(sub(x, d.Mu), mul(d.Sigma, sqrt2))
+	return mul(half, add(one, gosymbol.FuncOf("erf", z))).Simplify()
+}
+
+func (d Normal) MGF(t gosymbol.Expr) gosymbol.Expr {
+	return gosymbol.ExpOf(add(mul(d.Mu, t), mul(half, sq(d.Sigma), sq(t)))).Simplify()
+}
+
+func (d Normal) Mean() gosymbol.Expr                     { return d.Mu }
+func (d Normal) Variance() gosymbol.Expr                 { return sq(d.Sigma).Simplify() }
+func (d Normal) Support() (gosymbol.Expr, gosymbol.Expr) { return negInf, gosymbol.Inf }
+func (d Normal) String() string                          { return fmt.Sprintf("Normal(%s, %s)", d.Mu, d.Sigma) }
+
+// Uniform is the uniform distribution on [A, B].
+type Uniform struct {
+	A, B gosymbol.Expr
+}
+
+func (d Uniform) width() gosymbol.Expr { return sub(d.B, d.A) }
+
+func (d Uniform) PDF(x gosymbol.Expr) gosymbol.Expr {
+	return div(one, d.width()).Simplify()
+}
+
+func (d Uniform) CDF(x gosymbol.Expr) gosymbol.Expr {
+	return div(sub(x, d.A), d.width()).Simplify()
+}
+
+func (d Uniform) MGF(t gosymbol.Expr) gosymbol.Expr {
+	return div(sub(gosymbol.ExpOf(mul(t, d.B)), gosymbol.ExpOf(mul(t, d.A))), mul(t, d.width())).Simplify()
+}
+
+func (d Uniform) Mean() gosymbol.Expr { return mul(half, add(d.A, d.B)).Simplify() }
+func (d Uniform) Variance() gosymbol.Expr {
+	return gosymbol.Expand(div(sq(d.width()), gosymbol.N(12)))
+}
+func (d Uniform) Support() (gosymbol.Expr, gosymbol.Expr) { return d.A, d.B }
+func (d Uniform) String() string                          { return fmt.Sprintf("Uniform(%s, %s)", d.A, d.B) }
+
+// Exponential is the exponential distribution with the given Rate.
+type Exponential struct {
+	Rate gosymbol.Expr
+}
+
+func (d Exponential) gamma() Gamma { return Gamma{Shape: one, Rate: d.Rate} }
+
+func (d Exponential) PDF(x gosymbol.Expr) gosymbol.Expr {
+	return mul(d.Rate, gosymbol.ExpOf(mul(neg(d.Rate), x))).Simplify()
+}
+
+func (d Exponential) CDF(x gosymbol.Expr) gosymbol.Expr {
+	return sub(one, gosymbol.ExpOf(mul(neg(d.Rate), x))).Simplify()
+}
+
+func (d Exponential) MGF(t gosymbol.Expr) gosymbol.Expr       { return d.gamma().MGF(t) }
+func (d Exponential) Mean() gosymbol.Expr                     { return d.gamma().Mean() }
+func (d Exponential) Variance() gosymbol.Expr                 { return d.gamma().Variance() }
+func (d Exponential) Support() (gosymbol.Expr, gosymbol.Expr) { return zero, gosymbol.Inf }
+func (d Exponential) String() string                          { return fmt.Sprintf("Exponential(%s)", d.Rate) }
+
+// Gamma is the gamma distribution with the given Shape and Rate.
+type Gamma struct {
+	Shape, Rate gosymbol.Expr
+}
+
+func (d Gamma) PDF(x gosymbol.Expr) gosymbol.Expr {
+	k, r := d.Shape, d.Rate
+	num := mul(gosymbol.PowOf(r, k), gosymbol.PowOf(x, sub(k, one)), gosymbol.ExpOf(mul(neg(r), x)))
+	return div(num, gosymbol.FuncOf("gamma", k)).Simplify()
+}
+
+// CDF is closed form for a positive integer shape k,
+// 1 - Σ_{i<k} (rx)^i e^(-rx)/i!, and the integral of the PDF otherwise.
+func (d Gamma) CDF(x gosymbol.Expr) gosymbol.Expr {
+	k, ok := d.Shape.Simplify().(*gosymbol.Num)
+	if !ok || !k.IsInt() || k.Sign() <= 0 || k.Rat().Num().Int64() > 50 {
+		s := fresh("s", x, d.Shape, d.Rate)
+		return gosymbol.IntegralOf(d.PDF(gosymbol.S(s)), s, zero, x).Simplify()
+	}
+	rx := mul(d.Rate, x)
+	terms := []gosymbol.Expr{one}
+	fact := int64(1)
+	for i := int64(0); i < k.Rat().Num().Int64(); i++ {
+		if i > 0 {
+			fact *= i
+		}
+		terms = append(terms, neg(div(mul(gosymbol.PowOf(rx, gosymbol.N(i)), gosymbol.ExpOf(neg(rx))), gosymbol.N(fact))))
+	}
+	return add(terms...).Simplify()
+}
+
+func (d Gamma) MGF(t gosymbol.Expr) gosymbol.Expr {
+	return gosymbol.PowOf(div(d.Rate, sub(d.Rate, t)), d.Shape).Simplify()
+}
+
+func (d Gamma) Mean() gosymbol.Expr                     { return div(d.Shape, d.Rate).Simplify() }
+func (d Gamma) Variance() gosymbol.Expr                 { return div(d.Shape, sq(d.Rate)).Simplify() }
+func (d Gamma) Support() (gosymbol.Expr, gosymbol.Expr) { return zero, gosymbol.Inf }
+func (d Gamma) String() string                          { return fmt.Sprintf("Gamma(%s, %s)", d.Shape, d.Rate) }
+
+// ============================================================
+// Algebra of independent random variables
+// ============================================================
+
+// Sum returns the distribution of X + Y for independent X ~ a and Y ~ b.
+// Normals add to a Normal, and Gamma or Exponential variables with equal
+// rates add to a Gamma. Any other pair gives a Convolution.
+func Sum(a, b Dist) Dist {
+	if na, ok := a.(Normal); ok {
+		if nb, ok := b.(Normal); ok {
+			return Normal{
+				Mu:    add(na.Mu, nb.Mu).Simplify(),
+				Sigma: gosymbol.SqrtOf(add(sq(na.Sigma), sq(nb.Sigma))).Simplify(),
+			}
+		}
+	}
+	if ga, ok := asGamma(a); ok {
+		if gb, ok := asGamma(b); ok && same(ga.Rate, gb.Rate) {
+			return Gamma{Shape: add(ga.Shape, gb.Shape).Simplify(), Rate: ga.Rate}
+		}
+	}
+	return Convolution{A: a, B: b}
+}
+
+func asGamma(d Dist) (Gamma, bool) {
+	switch t := d.(type) {
+	case Gamma:
+		return t, true
+	case Exponential:
+		return t.gamma(), true
+	}
+	return Gamma{}, false
+}
+
+// Shift returns the distribution of X + c.
+func Shift(d Dist, c gosymbol.Expr) Dist {
+	switch t := d.(type) {
+	case Normal:
+		return Normal{Mu: add(t.Mu, c).Simplify(), Sigma: t.Sigma}
+	case Uniform:
+		return Uniform{A: add(t.A, c).Simplify(), B: add(t.B, c).Simplify()}
+	case Shifted:
+		return Shifted{D: t.D, C: add(t.C, c).Simplify()}
+	}
+	return Shifted{D: d, C: c}
+}
+
+// Scale returns the distribution of c·X. A Normal accepts any nonzero c;
+// other families need c to evaluate to a number so its sign is known.
+// Uniform stays Uniform, and Exponential and Gamma stay in their family
+// for c > 0.
+func Scale(c gosymbol.Expr, d Dist) (Dist, error) {
+	if n, ok := d.(Normal); ok {
+		if s, ok := sign(c); ok && s == 0 {
+			return nil, fmt.Errorf("stats: scale factor is zero")
+		}
+		return Normal{Mu: mul(c, n.Mu).Simplify(), Sigma: gosymbol.AbsOf(mul(c, n.Sigma)).Simplify()}, nil
+	}
+	s, ok := sign(c)
+	if !ok {
+		return nil, fmt.Errorf("stats: sign of scale factor %s is unknown", c)
+	}
+	if s == 0 {
+		return nil, fmt.Errorf("stats: scale factor is zero")
+	}
+	switch t := d.(type) {
+	case Uniform:
+		a, b := mul(c, t.A).Simplify(), mul(c, t.B).Simplify()
+		if s < 0 {
+			a, b = b, a
+		}
+		return Uniform{A: a, B: b}, nil
+	case Exponential:
+		if s > 0 {
+			return Exponential{Rate: div(t.Rate, c).Simplify()}, nil
+		}
+	case Gamma:
+		if s > 0 {
+			return Gamma{Shape: t.Shape, Rate: div(t.Rate, c).Simplify()}, nil
+		}
+	}
+	return Scaled{D: d, C: c}, nil
+}
+
+// Shifted is the distribution of X + C for X ~ D.
+type Shifted struct {
+	D Dist
+	C gosymbol.Expr
+}
+
+func (d Shifted) PDF(x gosymbol.Expr) gosymbol.Expr { return d.D.PDF(sub(x, d.C)) }
+func (d Shifted) CDF(x gosymbol.Expr) gosymbol.Expr { return d.D.CDF(sub(x, d.C)) }
+func (d Shifted) MGF(t gosymbol.Expr) gosymbol.Expr {
+	return mul(gosymbol.ExpOf(mul(d.C, t)), d.D.MGF(t)).Simplify()
+}
+func (d Shifted) Mean() gosymbol.Expr     { return add(d.D.Mean(), d.C).Simplify() }
+func (d Shifted) Variance() gosymbol.Expr { return d.D.Variance() }
+func (d Shifted) Support() (gosymbol.Expr, gosymbol.Expr) {
+	lo, hi := d.D.Support()
+	return shiftBound(lo, d.C), shiftBound(hi, d.C)
+}
+func (d Shifted) String() string { return fmt.Sprintf("%s + %s", d.D, d.C) }
+
+// Scaled is the distribution of C·X for X ~ D, with C a nonzero number.
+type Scaled struct {
+	D Dist
+	C gosymbol.Expr
+}
+
+func (d Scaled) negative() bool { s, _ := sign(d.C); return s < 0 }
+
+func (d Scaled) PDF(x gosymbol.Expr) gosymbol.Expr {
+	return div(d.D.PDF(div(x, d.C)), gosymbol.AbsOf(d.C)).Simplify()
+}
+
+func (d Scaled) CDF(x gosymbol.Expr) gosymbol.Expr {
+	f := d.D.CDF(div(x, d.C))
+	if d.negative() {
+		return sub(one, f).Simplify()
+	}
+	return f
+}
+
+func (d Scaled) MGF(t gosymbol.Expr) gosymbol.Expr { return d.D.MGF(mul(d.C, t)) }
+func (d Scaled) Mean() gosymbol.Expr               { return mul(d.C, d.D.Mean()).Simplify() }
+func (d Scaled) Variance() gosymbol.Expr           { return mul(sq(d.C), d.D.Variance()).Simplify() }
+func (d Scaled) Support() (gosymbol.Expr, gosymbol.Expr) {
+	lo, hi := d.D.Support()
+	lo, hi = scaleBound(lo, d.C), scaleBound(hi, d.C)
+	if d.negative() {
+		return hi, lo
+	}
+	return lo, hi
+}
+func (d Scaled) String() string { return fmt.Sprintf("%s*%s", d.C, d.D) }
+
+// Convolution is the distribution of X + Y for independent X ~ A and
+// Y ~ B when no closed family applies. Its density is
+// ∫ f_A(s) f_B(x - s) ds over the s where both factors are supported,
+// and 0 outside the support of the sum.
+type Convolution struct {
+	A, B Dist
+}
+
+func (d Convolution) PDF(x gosymbol.Expr) gosymbol.Expr {
+	loA, hiA := d.A.Support()
+	loB, hiB := d.B.Support()
+	s := fresh("s", x)
+	sv := gosymbol.S(s)
+	lo := maxBound(loA, shiftBound(neg(hiB), x))
+	hi := minBound(hiA, shiftBound(neg(loB), x))
+	f := gosymbol.Expand(gosymbol.IntegralOf(mul(d.A.PDF(sv), d.B.PDF(sub(x, sv))), s, lo, hi))
+	// The bounds cross outside the support of the sum, where the integral
+	// would turn negative; inside it they never do.
+	var cases []gosymbol.PieceCase
+	sLo, sHi := d.Support()
+	if !isInf(sLo, -1) {
+		cases = append(cases, gosymbol.PieceCase{Value: zero, Cond: gosymbol.Cond{Lhs: x, Op: gosymbol.RelLt, Rhs: sLo}})
+	}
+	if !isInf(sHi, 1) {
+		cases = append(cases, gosymbol.PieceCase{Value: zero, Cond: gosymbol.Cond{Lhs: x, Op: gosymbol.RelGt, Rhs: sHi}})
+	}
+	if len(cases) == 0 {
+		return f
+	}
+	return gosymbol.PiecewiseOf(cases, f).Simplify()
+}
+
+// CDF integrates PDF from the bottom of the support to x.
+func (d Convolution) CDF(x gosymbol.Expr) gosymbol.Expr {
+	lo, _ := d.Support()
+	u := fresh("u", x)
+	return gosymbol.IntegralOf(d.PDF(gosymbol.S(u)), u, lo, x).Simplify()
+}
+
+func (d Convolution) MGF(t gosymbol.Expr) gosymbol.Expr {
+	return mul(d.A.MGF(t), d.B.MGF(t)).Simplify()
+}
+func (d Convolution) Mean() gosymbol.Expr { return add(d.A.Mean(), d.B.Mean()).Simplify() }
+func (d Convolution) Variance() gosymbol.Expr {
+	return add(d.A.Variance(), d.B.Variance()).Simplify()
+}
+func (d Convolution) Support() (gosymbol.Expr, gosymbol.Expr) {
+	loA, hiA := d.A.Support()
+	loB, hiB := d.B.Support()
+	return shiftBound(loA, loB), shiftBound(hiA, hiB)
+}
+func (d Convolution) String() string { return fmt.Sprintf("(%s) + (%s)", d.A, d.B) }
+
+// shiftBound returns bound + c, keeping infinite bounds infinite.
+func shiftBound(bound, c gosymbol.Expr) gosymbol.Expr {
+	for _, e := range []gosymbol.Expr{bound, c} {
+		if isInf(e, 1) || isInf(e, -1) {
+			return e
+		}
+	}
+	return add(bound, c).Simplify()
+}
+
+// scaleBound returns c·bound for a nonzero number c.
+func scaleBound(bound, c gosymbol.Expr) gosymbol.Expr {
+	s, _ := sign(c)
+	switch {
+	case isInf(bound, 1) && s > 0, isInf(bound, -1) && s < 0:
+		return gosymbol.Inf
+	case isInf(bound, 1), isInf(bound, -1):
+		return negInf
+	}
+	return mul(c, bound).Simplify()
+}
+
+// maxBound and minBound compare exactly when both sides are numbers and
+// otherwise use max(a, b) = (a + b + |a - b|)/2.
+func maxBound(a, b gosymbol.Expr) gosymbol.Expr {
+	switch {
+	case isInf(a, -1) || isInf(b, 1):
+		return b
+	case isInf(b, -1) || isInf(a, 1):
+		return a
+	}
+	if s, ok := sign(sub(a, b)); ok {
+		if s >= 0 {
+			return a
+		}
+		return b
+	}
+	return mul(half, add(a, b, gosymbol.AbsOf(sub(a, b)))).Simplify()
+}
+
+func minBound(a, b gosymbol.Expr) gosymbol.Expr {
+	switch {
+	case isInf(a, 1) || isInf(b, -1):
+		return b
+	case isInf(b, 1) || isInf(a, -1):
+		return a
+	}
+	if s, ok := sign(sub(a, b)); ok {
+		if s <= 0 {
+			return a
+		}
+		return b
+	}
+	return mul(half, sub(add(a, b), gosymbol.AbsOf(sub(a, b)))).Simplify()
+}
+
+// ============================================================
+// Probability of events
+// ============================================================
+
+// RandomVar is a random variable X ~ Dist, named by the symbol that
+// conditions passed to P use for it.
+type RandomVar struct {
+	Name string
+	Dist Dist
+}
+
+// Sym returns the symbol naming the variable.
+func (v RandomVar) Sym() gosymbol.Expr { return gosymbol.S(v.Name) }
+
+func (v RandomVar) String() string { return fmt.Sprintf("%s ~ %s", v.Name, v.Dist) }
+
+// P returns the probability that cond holds for the random variable rv,
+// e.g. P(X > 2), by integrating the density over the region where it
+// holds. Lhs - Rhs must be a polynomial of degree at most 2 in rv.Name
+// whose region can be ordered: the leading coefficient must have a known
+// sign, and the roots of a quadratic must compare numerically. Other
+// symbols act as parameters. Events of the form X = c have probability 0.
+//
+// Each piece of the region is F(hi) - F(lo) for the distribution's CDF F
+// when that is closed form, as for Normal, with F = 0 at -Inf and 1 at
+// Inf. Otherwise pieces with finite ends are integrated directly; a piece
+// reaching an infinite end of the support is integrated as the complement
+// of the rest of the support when that is finite, since the density has
+// total mass 1, and is otherwise left as a gosymbol.Integral, which Eval
+// evaluates by quadrature.
+func P(cond gosymbol.Cond, rv RandomVar) (gosymbol.Expr, error) {
+	spans, err := region(cond, rv.Name)
+	if err != nil {
+		return nil, err
+	}
+	slo, shi := rv.Dist.Support()
+	var terms []gosymbol.Expr
+	for _, s := range spans {
+		lo, hi := maxBound(s[0], slo), minBound(s[1], shi)
+		if d, ok := sign(sub(hi, lo)); ok && d <= 0 && !isInf(hi, 1) && !isInf(lo, -1) {
+			continue
+		}
+		terms = append(terms, mass(rv, lo, hi))
+	}
+	return gosymbol.Expand(add(append(terms, zero)...)), nil
+}
+
+// mass integrates the density of rv from lo to hi, which lie in its
+// support.
+func mass(rv RandomVar, lo, hi gosymbol.Expr) gosymbol.Expr {
+	slo, shi := rv.Dist.Support()
+	whole := func(a, b gosymbol.Expr) bool { return a.String() == slo.String() && b.String() == shi.String() }
+	switch {
+	case whole(lo, hi):
+		return one
+	}
+	if m, ok := cdfMass(rv.Dist, lo, hi); ok {
+		return m
+	}
+	switch {
+	case isInf(hi, 1) && !isInf(lo, -1) && !isInf(slo, -1):
+		return sub(one, mass(rv, slo, lo))
+	case isInf(lo, -1) && !isInf(hi, 1) && !isInf(shi, 1):
+		return sub(one, mass(rv, hi, shi))
+	}
+	s := fresh("s", lo, hi, rv.Dist.PDF(rv.Sym()))
+	return gosymbol.IntegralOf(rv.Dist.PDF(gosymbol.S(s)), s, lo, hi).Simplify()
+}
+
+// cdfMass returns F(hi) - F(lo) for the CDF F of d. ok is false when F
+// is not closed form at an end, i.e. it is left as an integral.
+func cdfMass(d Dist, lo, hi gosymbol.Expr) (gosymbol.Expr, bool) {
+	at := func(x gosymbol.Expr) (gosymbol.Expr, bool) {
+		switch {
+		case isInf(x, -1):
+			return zero, true
+		case isInf(x, 1):
+			return one, true
+		}
+		f := d.CDF(x)
+		closed := true
+		gosymbol.Walk(f, func(e gosymbol.Expr) bool {
+			if _, ok := e.(*gosymbol.Integral); ok {
+				closed = false
+			}
+			return closed
+		})
+		return f, closed
+	}
+	a, ok1 := at(lo)
+	b, ok2 := at(hi)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	return sub(b, a).Simplify(), true
+}
+
+// region returns the intervals of the real line, as [lo, hi] pairs, on
+// which cond holds up to a set of measure zero.
+func region(cond gosymbol.Cond, name string) ([][2]gosymbol.Expr, error) {
+	d := gosymbol.Expand(sub(cond.Lhs, cond.Rhs))
+	all := [][2]gosymbol.Expr{{negInf, gosymbol.Inf}}
+	deg := gosymbol.Degree(d, name)
+	cs := gosymbol.PolyCoeffs(d, name)
+	if cs == nil || deg > 2 {
+		return nil, fmt.Errorf("stats: condition %s is not a polynomial of degree <= 2 in %s", cond, name)
+	}
+	if deg <= 0 {
+		holds, known := cond.Decide()
+		switch {
+		case !known:
+			return nil, fmt.Errorf("stats: cannot decide %s", cond)
+		case holds:
+			return all, nil
+		}
+		return nil, nil
+	}
+	switch cond.Op {
+	case gosymbol.RelEq:
+		return nil, nil
+	case gosymbol.RelNe:
+		return all, nil
+	}
+	coeff := func(k int) gosymbol.Expr {
+		if cs[k] == nil {
+			return zero
+		}
+		return cs[k]
+	}
+	lead, ok := sign(coeff(deg))
+	if !ok || lead == 0 {
+		return nil, fmt.Errorf("stats: sign of leading coefficient %s in %s is unknown", coeff(deg), cond)
+	}
+	// The roots in increasing order, and the sign of d on the interval
+	// after each of them and before the first.
+	var roots []gosymbol.Expr
+	if deg == 1 {
+		roots = []gosymbol.Expr{neg(div(coeff(0), coeff(1))).Simplify()}
+	} else {
+		r := gosymbol.SolveQuadratic(coeff(2), coeff(1), coeff(0))
+		switch {
+		case strings.HasPrefix(r.Error, "complex roots"):
+		case r.Error != "":
+			return nil, fmt.Errorf("stats: %s", r.Error)
+		case len(r.Solutions) == 1:
+			// A double root does not change the sign.
+			roots = []gosymbol.Expr{r.Solutions[0], r.Solutions[0]}
+		default:
+			if s, ok := sign(sub(r.Solutions[1], r.Solutions[0])); !ok || s < 0 {
+				return nil, fmt.Errorf("stats: cannot order the roots of %s", cond)
+			}
+			roots = r.Solutions
+		}
+	}
+	want := 1
+	if cond.Op == gosymbol.RelLt || cond.Op == gosymbol.RelLe {
+		want = -1
+	}
+	ends := append(append([]gosymbol.Expr{negInf}, roots...), gosymbol.Inf)
+	s := lead
+	if len(roots)%2 == 1 {
+		s = -s
+	}
+	var out [][2]gosymbol.Expr
+	for i := 0; i+1 < len(ends); i++ {
+		if s == want && ends[i].String() != ends[i+1].String() {
+			out = append(out, [2]gosymbol.Expr{ends[i], ends[i+1]})
+		}
+		s = -s
+	}
+	return out, nil
+}
+
+// ============================================================
+// Discrete distributions
+// ============================================================
+
+// Discrete is a probability distribution on the integers. The built-in
+// families give Mean, Variance and MGF in closed form; Moment and Expect
+// sum the PMF symbolically.
+type Discrete interface {
+	// PMF returns P(X = k) for an integer k in Support.
+	PMF(k gosymbol.Expr) gosymbol.Expr
+	// MGF returns the moment generating function E[exp(t X)].
+	MGF(t gosymbol.Expr) gosymbol.Expr
+	Mean() gosymbol.Expr
+	Variance() gosymbol.Expr
+	// Support returns the least and greatest values. hi may be
+	// gosymbol.Inf.
+	Support() (lo, hi gosymbol.Expr)
+	String() string
+}
+
+// Bernoulli is 1 with probability P and 0 otherwise.
+type Bernoulli struct {
+	P gosymbol.Expr
+}
+
+// NewBernoulli returns Bernoulli{P: p}. It is an error for p to be a
+// number outside [0, 1].
+func NewBernoulli(p gosymbol.Expr) (Bernoulli, error) {
+	if err := checkProb("Bernoulli", p, true); err != nil {
+		return Bernoulli{}, err
+	}
+	return Bernoulli{P: p}, nil
+}
+
+func (d Bernoulli) PMF(k gosymbol.Expr) gosymbol.Expr {
+	return mul(gosymbol.PowOf(d.P, k), gosymbol.PowOf(sub(one, d.P), sub(one, k))).Simplify()
+}
+
+func (d Bernoulli) MGF(t gosymbol.Expr) gosymbol.Expr {
+	return add(sub(one, d.P), mul(d.P, gosymbol.ExpOf(t))).Simplify()
+}
+
+func (d Bernoulli) Mean() gosymbol.Expr                     { return d.P }
+func (d Bernoulli) Variance() gosymbol.Expr                 { return expand(mul(d.P, sub(one, d.P))) }
+func (d Bernoulli) Support() (gosymbol.Expr, gosymbol.Expr) { return zero, one }
+func (d Bernoulli) String() string                          { return fmt.Sprintf("Bernoulli(%s)", d.P) }
+
+// Binomial is the number of successes in N independent trials that each
+// succeed with probability P.
+type Binomial struct {
+	N, P gosymbol.Expr
+}
+
+// NewBinomial returns Binomial{N: n, P: p}. It is an error for n to be a
+// number other than a non-negative integer or p a number outside [0, 1].
+func NewBinomial(n, p gosymbol.Expr) (Binomial, error) {
+	if v, ok := n.Simplify().Eval(); ok && (!v.IsInt() || v.Sign() < 0) {
+		return Binomial{}, fmt.Errorf("stats: Binomial: trials %s is not a non-negative integer", n)
+	}
+	if err := checkProb("Binomial", p, true); err != nil {
+		return Binomial{}, err
+	}
+	return Binomial{N: n, P: p}, nil
+}
+
+func (d Binomial) PMF(k gosymbol.Expr) gosymbol.Expr {
+	return mul(choose(d.N, k), gosymbol.PowOf(d.P, k), gosymbol.PowOf(sub(one, d.P), sub(d.N, k))).Simplify()
+}
+
+func (d Binomial) MGF(t gosymbol.Expr) gosymbol.Expr {
+	return gosymbol.PowOf(Bernoulli{P: d.P}.MGF(t), d.N).Simplify()
+}
+
+func (d Binomial) Mean() gosymbol.Expr                     { return mul(d.N, d.P).Simplify() }
+func (d Binomial) Variance() gosymbol.Expr                 { return expand(mul(d.N, d.P, sub(one, d.P))) }
+func (d Binomial) Support() (gosymbol.Expr, gosymbol.Expr) { return zero, d.N }
+func (d Binomial) String() string                          { return fmt.Sprintf("Binomial(%s, %s)", d.N, d.P) }
+
+// Poisson is the Poisson distribution with mean Rate.
+type Poisson struct {
+	Rate gosymbol.Expr
+}
+
+// NewPoisson returns Poisson{Rate: rate}. It is an error for rate to be a
+// negative number.
+func NewPoisson(rate gosymbol.Expr) (Poisson, error) {
+	if f, ok := numeric(rate); ok && !(f >= 0) {
+		return Poisson{}, fmt.Errorf("stats: Poisson: rate %s is negative", rate)
+	}
+	return Poisson{Rate: rate}, nil
+}
+
+func (d Poisson) PMF(k gosymbol.Expr) gosymbol.Expr {
+	return div(mul(gosymbol.PowOf(d.Rate, k), gosymbol.ExpOf(neg(d.Rate))), factorial(k)).Simplify()
+}
+
+func (d Poisson) MGF(t gosymbol.Expr) gosymbol.Expr {
+	return gosymbol.ExpOf(expand(mul(d.Rate, sub(gosymbol.ExpOf(t), one)))).Simplify()
+}
+
+func (d Poisson) Mean() gosymbol.Expr                     { return d.Rate }
+func (d Poisson) Variance() gosymbol.Expr                 { return d.Rate }
+func (d Poisson) Support() (gosymbol.Expr, gosymbol.Expr) { return zero, gosymbol.Inf }
+func (d Poisson) String() string                          { return fmt.Sprintf("Poisson(%s)", d.Rate) }
+
+// Geometric is the number of independent trials, each succeeding with
+// probability P, up to and including the first success.
+type Geometric struct {
+	P gosymbol.Expr
+}
+
+// NewGeometric returns Geometric{P: p}. It is an error for p to be a
+// number outside (0, 1].
+func NewGeometric(p gosymbol.Expr) (Geometric, error) {
+	if err := checkProb("Geometric", p, false); err != nil {
+		return Geometric{}, err
+	}
+	return Geometric{P: p}, nil
+}
+
+func (d Geometric) PMF(k gosymbol.Expr) gosymbol.Expr {
+	return mul(d.P, gosymbol.PowOf(sub(one, d.P), sub(k, one))).Simplify()
+}
+
+// MGF holds for t < -ln(1 - P), where the series converges.
+func (d Geometric) MGF(t gosymbol.Expr) gosymbol.Expr {
+	et := gosymbol.ExpOf(t)
+	return div(mul(d.P, et), sub(one, mul(sub(one, d.P), et))).Simplify()
+}
+
+func (d Geometric) Mean() gosymbol.Expr                     { return div(one, d.P).Simplify() }
+func (d Geometric) Variance() gosymbol.Expr                 { return expand(div(sub(one, d.P), sq(d.P))) }
+func (d Geometric) Support() (gosymbol.Expr, gosymbol.Expr) { return one, gosymbol.Inf }
+func (d Geometric) String() string                          { return fmt.Sprintf("Geometric(%s)", d.P) }
+
+func expand(e gosymbol.Expr) gosymbol.Expr { return gosymbol.Expand(e).Simplify() }
+
+// numeric returns the value of e when it has no free symbols.
+func numeric(e gosymbol.Expr) (float64, bool) {
+	if len(gosymbol.FreeSymbols(e)) > 0 {
+		return 0, false
+	}
+	f, err := gosymbol.EvalT[float64](e, nil)
+	return f, err == nil
+}
+
+// checkProb rejects a numeric p outside [0, 1], or (0, 1] when zero is
+// not allowed. Symbolic p is accepted.
+func checkProb(family string, p gosymbol.Expr, zeroOK bool) error {
+	f, ok := numeric(p)
+	if !ok {
+		return nil
+	}
+	if !(f >= 0 && f <= 1) || f == 0 && !zeroOK {
+		interval := "[0, 1]"
+		if !zeroOK {
+			interval = "(0, 1]"
+		}
+		return fmt.Errorf("stats: %s: probability %s is not in %s", family, p, interval)
+	}
+	return nil
+}
+
+// factorial returns k! as gamma(k + 1).
+func factorial(k gosymbol.Expr) gosymbol.Expr { return gosymbol.FuncOf("gamma", add(k, one)) }
+
+// choose returns the binomial coefficient n!/(k!(n-k)!).
+func choose(n, k gosymbol.Expr) gosymbol.Expr {
+	return div(factorial(n), mul(factorial(k), factorial(sub(n, k))))
+}
+
+// Expect returns E[g(X)] for X ~ d, with g given as an expression in the
+// symbol k, by summing g(k)·PMF(k) over the support. It fails when the
+// sum has no closed form; see series.
+func Expect(d Discrete, g gosymbol.Expr, k string) (gosymbol.Expr, error) {
+	k2 := fresh("k", g)
+	if k2 != k {
+		g = g.Sub(k, gosymbol.S(k2))
+	}
+	lo, hi := d.Support()
+	e, ok := series(mul(g, d.PMF(gosymbol.S(k2))), k2, lo, hi)
+	if !ok {
+		return nil, fmt.Errorf("stats: cannot sum E[%s] for %s", g, d)
+	}
+	return e, nil
+}
+
+// Moment returns E[X^m] for X ~ d by summing the PMF, as Expect does.
+func Moment(d Discrete, m int64) (gosymbol.Expr, error) {
+	return Expect(d, gosymbol.PowOf(gosymbol.S("k"), gosymbol.N(m)), "k")
+}
+
+// series returns Σ_{k=lo}^{hi} term in closed form. Ranges of at most
+// 1000 integers are summed term by term. Otherwise term must be
+// P(k)·c·r^k times at most 1/k! or 1/(k!(n-k)!), with P a polynomial and
+// c, r free of k; powers b^(αk+β) and exp(αk+β) contribute to c and r. The
+// base sums are the geometric series, e^r for 1/k! over k >= 0, and
+// (1 + r)^n/n! for 1/(k!(n-k)!) over 0 <= k <= n; P(k) acts as the
+// operator P(r d/dr) on them. Infinite geometric series assume |r| < 1.
+func series(term gosymbol.Expr, k string, lo, hi gosymbol.Expr) (gosymbol.Expr, bool) {
+	direct := func() (gosymbol.Expr, bool) {
+		a, ok1 := lo.Simplify().(*gosymbol.Num)
+		b, ok2 := hi.Simplify().(*gosymbol.Num)
+		if !ok1 || !ok2 || !a.IsInt() || !b.IsInt() {
+			return nil, false
+		}
+		i, j := a.Rat().Num().Int64(), b.Rat().Num().Int64()
+		if j-i > 1000 {
+			return nil, false
+		}
+		terms := []gosymbol.Expr{zero}
+		for n := i; n <= j; n++ {
+			terms = append(terms, term.Sub(k, gosymbol.N(n)))
+		}
+		return gosymbol.Expand(add(terms...)).Simplify(), true
+	}
+	has := func(e gosymbol.Expr) bool {
+		for _, s := range gosymbol.FreeSymbols(e) {
+			if s == k {
+				return true
+			}
+		}
+		return false
+	}
+	// linear returns α and β with e = αk + β.
+	linear := func(e gosymbol.Expr) (gosymbol.Expr, gosymbol.Expr, bool) {
+		cs := gosymbol.PolyCoeffs(gosymbol.Expand(e), k)
+		if cs == nil || gosymbol.Degree(e, k) > 1 {
+			return nil, nil, false
+		}
+		a, b := cs[1], cs[0]
+		if a == nil {
+			a = zero
+		}
+		if b == nil {
+			b = zero
+		}
+		return a, b, !has(a) && !has(b)
+	}
+	factors := []gosymbol.Expr{term.Simplify()}
+	if m, ok := factors[0].(*gosymbol.Mul); ok {
+		factors = m.Factors()
+	}
+	// The factorials come first, since n decides which powers pair with
+	// the binomial coefficient.
+	var fact bool
+	var n gosymbol.Expr
+	rest := factors[:0:0]
+	for _, f := range factors {
+		p, ok := f.(*gosymbol.Pow)
+		g, isGamma := gosymbol.Expr(nil), false
+		if ok && has(p.Base()) && same(p.Exp(), gosymbol.N(-1)) {
+			g = p.Base()
+			fn, ok := g.(*gosymbol.Func)
+			isGamma = ok && fn.Name() == "gamma"
+		}
+		if !isGamma {
+			rest = append(rest, f)
+			continue
+		}
+		a, b, ok := linear(g.(*gosymbol.Func).Arg())
+		switch {
+		case !ok:
+			return direct()
+		case same(a, one) && same(b, one) && !fact:
+			fact = true
+		case same(a, gosymbol.N(-1)) && n == nil:
+			n = sub(b, one).Simplify()
+		default:
+			return direct()
+		}
+	}
+	c, r, bs, poly := []gosymbol.Expr{one}, []gosymbol.Expr{one}, []gosymbol.Expr{one}, []gosymbol.Expr{one}
+	for _, f := range rest {
+		if !has(f) {
+			c = append(c, f)
+			continue
+		}
+		if gosymbol.PolyCoeffs(f, k) != nil {
+			poly = append(poly, f)
+			continue
+		}
+		if fn, ok := f.(*gosymbol.Func); ok && fn.Name() == "exp" {
+			if a, b, ok := linear(fn.Arg()); ok {
+				r, c = append(r, gosymbol.ExpOf(a)), append(c, gosymbol.ExpOf(b))
+				continue
+			}
+		}
+		p, ok := f.(*gosymbol.Pow)
+		if !ok || has(p.Base()) {
+			return direct()
+		}
+		a, b, ok := linear(p.Exp())
+		switch {
+		case !ok:
+			return direct()
+		case n != nil && same(a, gosymbol.N(-1)) && same(b, n):
+			// b^(n-k) of a binomial term.
+			bs = append(bs, p.Base())
+		default:
+			r, c = append(r, gosymbol.PowOf(p.Base(), a)), append(c, gosymbol.PowOf(p.Base(), b))
+		}
+	}
+	rho := fresh("rho", term, lo, hi)
+	rv := gosymbol.S(rho)
+	var s gosymbol.Expr
+	geometric := false
+	switch {
+	case fact && n != nil:
+		if !same(lo, zero) || !same(hi, n) {
+			return direct()
+		}
+		s = div(gosymbol.PowOf(add(rv, mul(bs...)), n), factorial(n))
+	case n != nil:
+		return direct()
+	case fact:
+		if !same(lo, zero) || !isInf(hi, 1) {
+			return direct()
+		}
+		s = gosymbol.ExpOf(rv)
+	case isInf(hi, 1):
+		s, geometric = div(gosymbol.PowOf(rv, lo), sub(one, rv)), true
+	default:
+		if e, ok := direct(); ok {
+			return e, true
+		}
+		s = div(sub(gosymbol.PowOf(rv, lo), gosymbol.PowOf(rv, add(hi, one))), sub(one, rv))
+	}
+	// Apply P(ρ d/dρ) term by term.
+	pk := gosymbol.Expand(mul(poly...))
+	cs := gosymbol.PolyCoeffs(pk, k)
+	var out []gosymbol.Expr
+	d := s
+	for m := 0; m <= gosymbol.Degree(pk, k); m++ {
+		if a := cs[m]; a != nil && geometric {
+			// Over the common denominator (1-ρ)^(m+1) with a factored
+			// numerator, so that factors cancel once ρ is substituted.
+			den := gosymbol.PowOf(sub(one, rv), gosymbol.N(int64(m+1)))
+			terms := []gosymbol.Expr{d}
+			if t, ok := d.(*gosymbol.Add); ok {
+				terms = t.Terms()
+			}
+			for i, t := range terms {
+				terms[i] = mul(t, den).Simplify()
+			}
+			num := gosymbol.Expand(add(terms...))
+			if c0, fs, err := gosymbol.FactorList(num, rho); err == nil {
+				num = c0
+				for _, f := range fs {
+					num = mul(num, gosymbol.PowOf(f.Base, gosymbol.N(int64(f.Mult))))
+				}
+			}
+			out = append(out, mul(a, num, gosymbol.PowOf(den, gosymbol.N(-1))))
+		} else if a != nil {
+			out = append(out, mul(a, d))
+		}
+		d = gosymbol.Expand(mul(rv, gosymbol.Diff(d, rho)))
+	}
+	sum := mul(append(c, add(append(out, zero)...).Sub(rho, mul(r...)))...)
+	// Expanding cancels the moments; keep the factored form when shorter,
+	// as for the MGF (p·exp(t) - p + 1)^n.
+	sum = mergeExp(sum.Simplify())
+	if e := mergeExp(gosymbol.Expand(sum)); len(e.String()) <= len(sum.String()) {
+		return e, true
+	}
+	return sum, true
+}
+
+// mergeExp combines the exp factors of each product in a sum, e.g.
+// λ·exp(-λ)·exp(λ) -> λ.
+func mergeExp(e gosymbol.Expr) gosymbol.Expr {
+	if a, ok := e.(*gosymbol.Add); ok {
+		ts := a.Terms()
+		for i, t := range ts {
+			ts[i] = mergeExp(t)
+		}
+		return add(ts...).Simplify()
+	}
+	fs := []gosymbol.Expr{e}
+	if m, ok := e.(*gosymbol.Mul); ok {
+		fs = m.Factors()
+	}
+	var rest, args []gosymbol.Expr
+	for _, f := range fs {
+		if p, ok := f.(*gosymbol.Pow); ok {
+			if fn, ok := p.Base().(*gosymbol.Func); ok && fn.Name() == "exp" {
+				args = append(args, mul(p.Exp(), fn.Arg()))
+				continue
+			}
+		}
+		if fn, ok := f.(*gosymbol.Func); ok && fn.Name() == "exp" {
+			args = append(args, fn.Arg())
+			continue
+		}
+		rest = append(rest, f)
+	}
+	if len(args) < 2 {
+		return e
+	}
+	return mul(append(rest, gosymbol.ExpOf(gosymbol.Expand(add(args...))))...).Simplify()
+}
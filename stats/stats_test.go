@@ -0,0 +1,237 @@
+package stats_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/njchilds90/gosymbol"
+	"github.com/njchilds90/gosymbol/stats"
+)
+
+var (
+	n = gosymbol.N
+	x = gosymbol.S("x")
+	t = gosymbol.S("t")
+)
+
+func assertStr(tb testing.TB, got interface{ String() string }, want string) {
+	tb.Helper()
+	if got.String() != want {
+		tb.Errorf("got %q, want %q", got.String(), want)
+	}
+}
+
+func eval(tb testing.TB, e gosymbol.Expr) float64 {
+	tb.Helper()
+	v, ok := e.Simplify().Eval()
+	if !ok {
+		tb.Fatalf("cannot evaluate %s", e)
+	}
+	return v.Float64()
+}
+
+func TestDistributions(tt *testing.T) {
+	mu, sigma := gosymbol.S("mu"), gosymbol.S("sigma")
+	norm := stats.Normal{Mu: mu, Sigma: sigma}
+	assertStr(tt, norm.MGF(t), "exp(1/2*sigma^2*t^2 + mu*t)")
+	assertStr(tt, norm.Variance(), "sigma^2")
+	std := stats.Normal{Mu: n(0), Sigma: n(1)}
+	if v := eval(tt, std.CDF(n(1))); math.Abs(v-0.8413447460685429) > 1e-12 {
+		tt.Errorf("Φ(1) = %v", v)
+	}
+
+	u := stats.Uniform{A: n(0), B: n(4)}
+	assertStr(tt, u.PDF(x), "1/4")
+	assertStr(tt, u.CDF(x), "1/4*x")
+	assertStr(tt, u.Variance(), "4/3")
+
+	e := stats.Exponential{Rate: n(2)}
+	assertStr(tt, e.PDF(x), "2*exp(-2*x)")
+	assertStr(tt, e.CDF(x), "-exp(-2*x) + 1")
+	assertStr(tt, e.MGF(t), "2*(-t + 2)^-1")
+
+	g := stats.Gamma{Shape: n(3), Rate: n(1)}
+	assertStr(tt, g.PDF(x), "1/2*x^2*exp(-x)")
+	assertStr(tt, g.CDF(x), "-1/2*x^2*exp(-x) - x*exp(-x) - exp(-x) + 1")
+}
+
+func TestSumAndScale(tt *testing.T) {
+	mu := gosymbol.S("mu")
+	s := stats.Sum(stats.Normal{Mu: n(1), Sigma: n(3)}, stats.Normal{Mu: mu, Sigma: n(4)})
+	assertStr(tt, s, "Normal(mu + 1, 5)")
+
+	s = stats.Sum(stats.Exponential{Rate: n(2)}, stats.Exponential{Rate: n(2)})
+	assertStr(tt, s, "Gamma(2, 2)")
+	assertStr(tt, s.PDF(x), "4*x*exp(-2*x)")
+
+	// Different rates: the hypoexponential density.
+	s = stats.Sum(stats.Exponential{Rate: n(1)}, stats.Exponential{Rate: n(2)})
+	assertStr(tt, s.PDF(x), "piecewise((0, x < 0), (-2*exp(-2*x) + 2*exp(-x), otherwise))")
+	assertStr(tt, s.Mean(), "3/2")
+	assertStr(tt, s.MGF(t), "2*(-t + 1)^-1*(-t + 2)^-1")
+
+	// Two uniforms give the triangular density.
+	s = stats.Sum(stats.Uniform{A: n(0), B: n(1)}, stats.Uniform{A: n(0), B: n(1)})
+	assertStr(tt, s.PDF(x), "piecewise((0, x < 0), (0, x > 2), (-abs(x - 1) + 1, otherwise))")
+	if v := eval(tt, s.CDF(n(1))); math.Abs(v-0.5) > 1e-9 {
+		tt.Errorf("triangular CDF(1) = %v", v)
+	}
+	// Outside the support the density is 0, and the CDF reaches 1.
+	for _, c := range []struct {
+		x        int64
+		pdf, cdf float64
+	}{{-1, 0, 0}, {3, 0, 1}, {2, 0, 1}} {
+		if v := eval(tt, s.PDF(n(c.x))); v != c.pdf {
+			tt.Errorf("triangular PDF(%d) = %v, want %v", c.x, v, c.pdf)
+		}
+		if v := eval(tt, s.CDF(n(c.x))); math.Abs(v-c.cdf) > 1e-9 {
+			tt.Errorf("triangular CDF(%d) = %v, want %v", c.x, v, c.cdf)
+		}
+	}
+
+	// No closed form: the density stays an integral and evaluates numerically.
+	s = stats.Sum(stats.Normal{Mu: n(0), Sigma: n(1)}, stats.Exponential{Rate: n(1)})
+	if _, ok := s.PDF(x).(*gosymbol.Integral); !ok {
+		tt.Errorf("PDF = %s, want an Integral", s.PDF(x))
+	}
+	// Exponentially modified Gaussian at 0: e^(1/2)·(1 - Φ(1)).
+	if v := eval(tt, s.PDF(n(0))); math.Abs(v-math.Exp(0.5)*(1-0.8413447460685429)) > 1e-8 {
+		tt.Errorf("PDF(0) = %v", v)
+	}
+	assertStr(tt, s.Variance(), "2")
+
+	sc, err := stats.Scale(n(-2), stats.Exponential{Rate: n(1)})
+	if err != nil {
+		tt.Fatal(err)
+	}
+	assertStr(tt, sc.PDF(x), "1/2*exp(1/2*x)")
+	if lo, hi := sc.Support(); lo.String() != "-oo" || hi.String() != "0" {
+		tt.Errorf("support = [%s, %s]", lo, hi)
+	}
+	sc, _ = stats.Scale(n(3), stats.Uniform{A: n(0), B: n(1)})
+	assertStr(tt, sc, "Uniform(0, 3)")
+	sc, _ = stats.Scale(gosymbol.S("c"), stats.Normal{Mu: mu, Sigma: n(1)})
+	assertStr(tt, sc, "Normal(c*mu, abs(c))")
+	if _, err := stats.Scale(gosymbol.S("c"), stats.Exponential{Rate: n(1)}); err == nil {
+		tt.Error("symbolic scale of Exponential should fail")
+	}
+	assertStr(tt, stats.Shift(stats.Exponential{Rate: n(1)}, n(5)).Mean(), "6")
+}
+
+func TestP(tt *testing.T) {
+	X := gosymbol.S("X")
+	cond := func(l gosymbol.Expr, op gosymbol.RelOp, r gosymbol.Expr) gosymbol.Cond {
+		return gosymbol.Cond{Lhs: l, Op: op, Rhs: r}
+	}
+	rv := func(d stats.Dist) stats.RandomVar { return stats.RandomVar{Name: "X", Dist: d} }
+	for _, tc := range []struct {
+		c    gosymbol.Cond
+		rv   stats.RandomVar
+		want string
+	}{
+		{cond(X, gosymbol.RelGt, n(2)), rv(stats.Exponential{Rate: n(2)}), "exp(-4)"},
+		{cond(X, gosymbol.RelLt, n(1)), rv(stats.Uniform{A: n(0), B: n(4)}), "1/4"},
+		{cond(gosymbol.MulOf(n(-2), X), gosymbol.RelLt, n(-2)), rv(stats.Uniform{A: n(0), B: n(4)}), "3/4"},
+		{cond(gosymbol.PowOf(X, n(2)), gosymbol.RelLt, n(4)), rv(stats.Uniform{A: n(-1), B: n(4)}), "3/5"},
+		{cond(gosymbol.PowOf(X, n(2)), gosymbol.RelGe, n(4)), rv(stats.Uniform{A: n(-4), B: n(4)}), "1/2"},
+		{cond(X, gosymbol.RelEq, n(1)), rv(stats.Normal{Mu: n(0), Sigma: n(1)}), "0"},
+		{cond(gosymbol.PowOf(X, n(2)), gosymbol.RelGt, n(-1)), rv(stats.Normal{Mu: n(0), Sigma: n(1)}), "1"},
+	} {
+		p, err := stats.P(tc.c, tc.rv)
+		if err != nil {
+			tt.Errorf("P(%s) for %s: %v", tc.c, tc.rv, err)
+			continue
+		}
+		if p.String() != tc.want {
+			tt.Errorf("P(%s) for %s = %s, want %s", tc.c, tc.rv, p, tc.want)
+		}
+	}
+
+	// The normal CDF gives erf.
+	p, err := stats.P(cond(X, gosymbol.RelLe, n(1)), rv(stats.Normal{Mu: n(0), Sigma: n(1)}))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	assertStr(tt, p, "1/2*erf(2^(-1/2)) + 1/2")
+	if v := eval(tt, p); math.Abs(v-0.8413447460685429) > 1e-8 {
+		tt.Errorf("P(X <= 1) = %v", v)
+	}
+	p, _ = stats.P(cond(gosymbol.PowOf(X, n(2)), gosymbol.RelLt, n(4)), rv(stats.Normal{Mu: gosymbol.S("mu"), Sigma: n(1)}))
+	assertStr(tt, p, "1/2*erf(-mu*2^(-1/2) + 2*2^(-1/2)) - 1/2*erf(-mu*2^(-1/2) - 2*2^(-1/2))")
+
+	for _, c := range []gosymbol.Cond{
+		cond(gosymbol.PowOf(X, n(3)), gosymbol.RelGt, n(1)),
+		cond(gosymbol.MulOf(gosymbol.S("a"), X), gosymbol.RelGt, n(1)),
+		cond(gosymbol.S("a"), gosymbol.RelGt, n(1)),
+	} {
+		if _, err := stats.P(c, rv(stats.Uniform{A: n(0), B: n(1)})); err == nil {
+			tt.Errorf("P(%s) succeeded, want error", c)
+		}
+	}
+}
+
+func TestDiscrete(tt *testing.T) {
+	p, lam, m := gosymbol.S("p"), gosymbol.S("lambda"), gosymbol.S("n")
+	for _, tc := range []struct {
+		d                   stats.Discrete
+		mean, variance, mgf string
+	}{
+		{stats.Bernoulli{P: p}, "p", "-p^2 + p", "p*exp(t) - p + 1"},
+		{stats.Binomial{N: n(4), P: p}, "4*p", "-4*p^2 + 4*p", "(p*exp(t) - p + 1)^4"},
+		{stats.Binomial{N: m, P: p}, "n*p", "-n*p^2 + n*p", "(p*exp(t) - p + 1)^n"},
+		{stats.Poisson{Rate: lam}, "lambda", "lambda", "exp(lambda*exp(t) - lambda)"},
+		{stats.Geometric{P: p}, "p^-1", "-p^-1 + p^-2", "p*(-(-p + 1)*exp(t) + 1)^-1*exp(t)"},
+	} {
+		assertStr(tt, tc.d.Mean(), tc.mean)
+		assertStr(tt, tc.d.Variance(), tc.variance)
+		assertStr(tt, tc.d.MGF(t), tc.mgf)
+	}
+
+	assertStr(tt, stats.Binomial{N: n(4), P: p}.PMF(n(1)), "4*p*(-p + 1)^3")
+	assertStr(tt, stats.Poisson{Rate: lam}.PMF(n(2)), "1/2*lambda^2*exp(-lambda)")
+	assertStr(tt, stats.Geometric{P: gosymbol.F(1, 3)}.PMF(n(3)), "4/27")
+
+	k := gosymbol.S("k")
+	e, err := stats.Expect(stats.Poisson{Rate: lam}, gosymbol.PowOf(k, n(3)), "k")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	assertStr(tt, e, "lambda^3 + 3*lambda^2 + lambda")
+	e, err = stats.Expect(stats.Binomial{N: n(3), P: gosymbol.F(1, 2)}, gosymbol.PowOf(n(2), k), "k")
+	if err != nil {
+		tt.Fatal(err)
+	}
+	assertStr(tt, e, "27/8")
+	if _, err := stats.Expect(stats.Poisson{Rate: lam}, gosymbol.SinOf(k), "k"); err == nil {
+		tt.Error("E[sin(X)] for a Poisson variable should have no closed form")
+	}
+	e, err = stats.Moment(stats.Geometric{P: p}, 2)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	assertStr(tt, gosymbol.Expand(e).Simplify(), "-p^-1 + 2*p^-2")
+
+	// Moments of large numeric families do not sum the support.
+	b, err := stats.NewBinomial(n(2000), gosymbol.F(1, 2))
+	if err != nil {
+		tt.Fatal(err)
+	}
+	assertStr(tt, b.Mean(), "1000")
+	assertStr(tt, b.Variance(), "500")
+
+	for name, f := range map[string]func() error{
+		"Binomial(-1, p)":  func() error { _, err := stats.NewBinomial(n(-1), p); return err },
+		"Binomial(5/2, p)": func() error { _, err := stats.NewBinomial(gosymbol.F(5, 2), p); return err },
+		"Binomial(n, 3/2)": func() error { _, err := stats.NewBinomial(m, gosymbol.F(3, 2)); return err },
+		"Bernoulli(-1/2)":  func() error { _, err := stats.NewBernoulli(gosymbol.F(-1, 2)); return err },
+		"Geometric(0)":     func() error { _, err := stats.NewGeometric(n(0)); return err },
+		"Poisson(-1)":      func() error { _, err := stats.NewPoisson(n(-1)); return err },
+	} {
+		if f() == nil {
+			tt.Errorf("New%s succeeded, want error", name)
+		}
+	}
+	if _, err := stats.NewBinomial(m, gosymbol.PowOf(gosymbol.Pi, n(-1))); err != nil {
+		tt.Errorf("NewBinomial(n, 1/pi): %v", err)
+	}
+}